@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/ingest"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/remote"
+	"github.com/spf13/cobra"
+)
+
+// agentDeliverTimeout bounds how long an agent waits, once its command has
+// exited, for the collector to acknowledge the remaining captures.
+const agentDeliverTimeout = time.Minute
+
+// agentOptions carries the resolved settings of the agent command.
+type agentOptions struct {
+	collector string
+	cfg       *config.DiffConfig
+	dial      ingest.DialOptions
+}
+
+func newAgentCmd() *cobra.Command {
+	var collector, configPath, watchDir, namespace string
+	var token, tlsCert, tlsKey, tlsCA string
+	var ignore []string
+	var passthrough bool
+
+	cmd := &cobra.Command{
+		Use:   "agent --collector <host:port> -- <command>",
+		Short: "Run a command and stream its file changes to a collector",
+		Long: `Run a command and stream its file changes to a collector.
+
+The agent watches like record, but keeps no state dir: every capture is
+streamed over gRPC to a ` + "`diffkeeper collect`" + ` server, which stores it. Captures
+are kept in memory until the collector acknowledges them and resent after a
+dropped connection; once the command exits, the agent waits up to a minute
+for the rest to be delivered. The agent exits with the command's status, or
+125 when the command succeeded but its captures were not all delivered
+(unless --passthrough-exit-code is set).
+
+Captures are recorded in --namespace, by default this machine's host name,
+so agents sharing a collector do not mix their files. The token comes from
+--token or $` + remote.EnvToken + `.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if collector == "" {
+				return fmt.Errorf("collector is required")
+			}
+			flags := cmd.Flags()
+			overrides := func(c *config.DiffConfig) {
+				if flags.Changed("watch") {
+					c.WatchDir = watchDir
+				}
+				if flags.Changed("namespace") {
+					c.Namespace = namespace
+				}
+				if flags.Changed("ignore") {
+					c.IgnorePatterns = ignore
+				}
+			}
+			cfg, used, err := config.Load(configPath, watchDir, overrides)
+			if err != nil {
+				return recorderExit(err)
+			}
+			if used != "" {
+				log.Printf("[agent] using config %s", used)
+			}
+			if cfg.Namespace == "" {
+				cfg.Namespace = hostNamespace()
+			}
+
+			opts := agentOptions{collector: collector, cfg: cfg, dial: ingest.DialOptions{Token: token}}
+			if opts.dial.Token == "" {
+				opts.dial.Token = os.Getenv(remote.EnvToken)
+			}
+			if tlsCert != "" || tlsKey != "" || tlsCA != "" {
+				if opts.dial.TLS, err = remote.ClientTLS(tlsCert, tlsKey, tlsCA); err != nil {
+					return recorderExit(err)
+				}
+			}
+			runErr := runAgent(opts, args)
+			if passthrough {
+				runErr = passthroughExit(runErr)
+			}
+			return recorderExit(runErr)
+		},
+	}
+
+	cmd.Flags().StringVar(&collector, "collector", "", "host:port of the collect server")
+	cmd.Flags().StringVar(&configPath, "config", "", "Config file (YAML or TOML); default: diffkeeper.yaml in the watch directory")
+	cmd.Flags().StringVar(&watchDir, "watch", ".", "Directory to watch for changes")
+	cmd.Flags().StringVar(&namespace, "namespace", "", "Record into this namespace (default: the host name)")
+	cmd.Flags().StringArrayVar(&ignore, "ignore", nil, "Never capture paths matching this glob (repeatable, supports **)")
+	cmd.Flags().StringVar(&token, "token", "", "Bearer token with the write scope (default $"+remote.EnvToken+")")
+	cmd.Flags().StringVar(&tlsCert, "tls-cert", "", "Client certificate (PEM) to present to the collector")
+	cmd.Flags().StringVar(&tlsKey, "tls-key", "", "Private key (PEM) of --tls-cert")
+	cmd.Flags().StringVar(&tlsCA, "tls-ca", "", "Connect over TLS, verifying the collector with these CA certificates (PEM)")
+	cmd.Flags().BoolVar(&passthrough, "passthrough-exit-code", false, "Exit with the command's status even when not all captures were delivered (the failure is still logged)")
+	return cmd
+}
+
+// runAgent runs the command while its captures stream to the collector.
+func runAgent(opts agentOptions, args []string) error {
+	cfg := opts.cfg
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	policies, err := newCapturePolicies(cfg.Policies)
+	if err != nil {
+		return err
+	}
+	absWatch, err := filepath.Abs(cfg.WatchDir)
+	if err != nil {
+		return err
+	}
+
+	dial := opts.dial
+	dial.Namespace = cfg.Namespace
+	client, err := ingest.Dial(opts.collector, dial)
+	if err != nil {
+		return err
+	}
+	journal := recorder.NewJournal(nil)
+	journal.SetNamespace(cfg.Namespace)
+	journal.SetSink(client.Send)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tree, err := startTreeWatch(ctx, cfg, policies, journal, nil, nil, newOverheadBudget(cfg.Overhead), absWatch)
+	if err != nil {
+		_ = client.Close(ctx)
+		return err
+	}
+	tree.StartFallback(ctx, nil)
+	log.Printf("[agent] streaming changes under %s to %s as namespace %q", absWatch, opts.collector, cfg.Namespace)
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	cmd.Dir = cfg.WatchDir
+	runErr := cmd.Run()
+	var exitErr *exec.ExitError
+	if runErr != nil && !errors.As(runErr, &exitErr) {
+		runErr = startFailure(fmt.Errorf("run command: %w", runErr))
+	}
+	tree.Flush()
+
+	deliverCtx, deliverCancel := context.WithTimeout(context.Background(), agentDeliverTimeout)
+	defer deliverCancel()
+	if err := client.Close(deliverCtx); err != nil {
+		log.Printf("[agent] recording failed and may be incomplete: %v", err)
+		return recordingFailed(runErr, err, exitRecorderFailed)
+	}
+	return runErr
+}
+
+var invalidNamespaceChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// hostNamespace derives an agent's default namespace from its host name.
+func hostNamespace() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "agent"
+	}
+	return invalidNamespaceChars.ReplaceAllString(host, "-")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/saworbit/diffkeeper/pkg/control"
+	"github.com/spf13/cobra"
+)
+
+func newAttachCmd() *cobra.Command {
+	var stateDir, socketPath, namespace, watchDir string
+
+	cmd := &cobra.Command{
+		Use:   "attach --state-dir <dir> [--namespace <ns>] -- <command> [args...]",
+		Short: "Run a command recorded by a running diffkeeper daemon",
+		Long: `Run a command recorded by a running diffkeeper daemon.
+
+attach registers the watch directory with the daemon serving the state dir,
+runs the command there, and detaches once it exits. The daemon has the store
+and eBPF programs loaded already, so a job starts recording without their
+startup cost. Each job records into its own namespace; two jobs cannot attach
+to the same namespace at once. attach exits with the command's status, or
+with 125 when the daemon cannot record it (see diffkeeper record --help).`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := socketPath
+			if path == "" && stateDir != "" {
+				path = control.SocketPath(stateDir)
+			}
+			if path == "" {
+				return fmt.Errorf("state-dir or socket is required")
+			}
+			return recorderExit(runAttach(path, namespace, watchDir, args))
+		},
+	}
+
+	cmd.Flags().StringVar(&stateDir, "state-dir", "", "State dir served by the daemon")
+	cmd.Flags().StringVar(&socketPath, "socket", "", "Control socket path of the daemon (overrides --state-dir)")
+	cmd.Flags().StringVar(&namespace, "namespace", "", "Namespace to record the job into")
+	cmd.Flags().StringVar(&watchDir, "watch", ".", "Directory to watch and run the command in")
+	return cmd
+}
+
+// runAttach runs args in watchDir while the daemon at socketPath records it.
+func runAttach(socketPath, namespace, watchDir string, args []string) error {
+	dir, err := filepath.Abs(watchDir)
+	if err != nil {
+		return fmt.Errorf("resolve watch dir: %w", err)
+	}
+	resp, err := control.Call(socketPath, control.Request{Op: opAttach, Namespace: namespace, Dir: dir, PID: os.Getpid()})
+	if err != nil {
+		return fmt.Errorf("attach (is `diffkeeper daemon` running for this state dir?): %w", err)
+	}
+	var job attachResult
+	if err := json.Unmarshal(resp.Data, &job); err != nil {
+		return fmt.Errorf("decode attach response: %w", err)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), control.EnvSocket+"="+socketPath)
+	runErr := cmd.Run()
+	exitCode := exitCodeOf(runErr)
+	var exitErr *exec.ExitError
+	if runErr != nil && !errors.As(runErr, &exitErr) {
+		runErr = startFailure(fmt.Errorf("run command: %w", runErr))
+	}
+
+	if _, err := control.Call(socketPath, control.Request{Op: opDetach, Name: job.ID, ExitCode: exitCode}); err != nil {
+		log.Printf("[attach] detach %s: %v", job.ID, err)
+	}
+	return runErr
+}
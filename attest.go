@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/attest"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/glob"
+	"github.com/saworbit/diffkeeper/pkg/merkle"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/spf13/cobra"
+)
+
+// attestOptions carries the flags accepted by the attest command.
+type attestOptions struct {
+	stateDir string
+	outFile  string
+	paths    []string
+	cfg      *config.DiffConfig
+}
+
+func newAttestCmd() *cobra.Command {
+	var opts attestOptions
+	var signKey, namespace string
+
+	cmd := &cobra.Command{
+		Use:   "attest --state-dir <dir> --sign-key <key.pem>",
+		Short: "Sign an in-toto provenance attestation for the files a run produced",
+		Long: `Sign an in-toto provenance attestation for the files a run produced.
+
+Every file written during the recording is listed as a subject with the
+SHA-256 of its final version; files only recorded as they were before the run
+started are left out. The SLSA provenance predicate names the session ID, the
+recorded command, its exit code and when it ran. The statement is signed with
+--sign-key (as for record) and written as a DSSE envelope, which tools such as
+"cosign verify-blob-attestation" or in-toto verifiers accept.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			cfg, err := loadEnvConfig(func(c *config.DiffConfig) {
+				if cmd.Flags().Changed("sign-key") {
+					c.SignKey = signKey
+				}
+				if cmd.Flags().Changed("namespace") {
+					c.Namespace = namespace
+				}
+			})
+			if err != nil {
+				return err
+			}
+			opts.cfg = cfg
+			return runAttest(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&opts.outFile, "out", "", "Write the attestation to this file instead of stdout")
+	cmd.Flags().StringArrayVar(&opts.paths, "path", nil, "Attest only files matching this glob (repeatable; ** spans directories)")
+	cmd.Flags().StringVar(&signKey, "sign-key", "", "PEM private key (PKCS#8 ECDSA P-256 or Ed25519) to sign the attestation with")
+	cmd.Flags().StringVar(&namespace, "namespace", "", "Attest only the files recorded with record --namespace")
+	return cmd
+}
+
+func runAttest(w io.Writer, opts attestOptions) error {
+	cfg := opts.cfg
+	if cfg.SignKey == "" {
+		return fmt.Errorf("--sign-key (or DIFFKEEPER_SIGN_KEY) is required")
+	}
+	keyPEM, err := os.ReadFile(cfg.SignKey)
+	if err != nil {
+		return fmt.Errorf("read sign key: %w", err)
+	}
+	if _, err := merkle.ParseSigningKey(keyPEM); err != nil {
+		return fmt.Errorf("sign key %s: %w", cfg.SignKey, err)
+	}
+
+	db, snapshot, err := openReadOnlyOrSnapshot(opts.stateDir)
+	if err != nil {
+		return err
+	}
+	defer releaseSnapshot(opts.stateDir, snapshot)
+	defer db.Close()
+
+	run := attest.Run{Started: loadSessionStart(db), Files: make(map[string]string)}
+	info, ok, err := recorder.LoadSessionInfo(db)
+	if err != nil {
+		return fmt.Errorf("load session info: %w", err)
+	}
+	if ok {
+		run.SessionID, run.Command, run.Agent = info.ID, info.Command, info.Agent
+	}
+	target := time.Now()
+	if end, ok := loadSessionEnd(db); ok {
+		target = time.Unix(0, end.Timestamp)
+		run.Finished = target
+		run.ExitCode = &end.ExitCode
+	}
+
+	records, err := loadMetadataAt(db, target)
+	if err != nil {
+		return err
+	}
+	records = recorder.NamespaceState(records, cfg.Namespace)
+	for path, meta := range records {
+		rel := filepath.ToSlash(cleanPath(path))
+		if !glob.MatchAny(opts.paths, rel) || !producedDuringRun(meta, run.Started) {
+			continue
+		}
+		run.Files[rel] = contentDigest(meta)
+	}
+	if len(run.Files) == 0 {
+		return fmt.Errorf("no files were written during the run")
+	}
+
+	env, err := attest.Sign(attest.NewStatement(run), keyPEM)
+	if err != nil {
+		return fmt.Errorf("sign attestation: %w", err)
+	}
+	data, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if opts.outFile != "" {
+		return os.WriteFile(opts.outFile, data, 0o644)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// producedDuringRun reports whether meta is a version written by the run,
+// rather than the content a file had before it started.
+func producedDuringRun(meta recorder.MetadataRecord, start time.Time) bool {
+	if meta.Op == recorder.OpBaseline {
+		return false
+	}
+	return start.IsZero() || meta.Timestamp >= start.UnixNano()
+}
+
+// contentDigest returns the hex SHA-256 of the whole file meta describes.
+// Recorded CIDs are the SHA-256 of the stored content, which for a
+// truncated capture is only its head and tail.
+func contentDigest(meta recorder.MetadataRecord) string {
+	if meta.Truncated != nil {
+		return meta.Truncated.SHA256
+	}
+	return meta.CID
+}
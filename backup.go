@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/control"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+	"github.com/spf13/cobra"
+)
+
+// backupOptions carries the flags accepted by the backup command.
+type backupOptions struct {
+	stateDir string
+	out      string
+}
+
+func newBackupCmd() *cobra.Command {
+	var opts backupOptions
+
+	cmd := &cobra.Command{
+		Use:   "backup --state-dir <dir> --out <dir>",
+		Short: "Copy a state dir to a consistent point-in-time backup",
+		Long: `Copy a state dir to a consistent point-in-time backup.
+
+The backup is a Pebble checkpoint: it holds the store exactly as it was at
+one instant, including captures not processed yet. When record, daemon or
+collect holds the state dir, it takes the checkpoint itself, so recording
+continues undisturbed. Table files are hard-linked when --out is on the same
+filesystem (they are never modified) and copied otherwise.
+
+--out must not exist yet. Recreate a state dir from the backup with
+` + "`diffkeeper restore-store`" + `; objects evicted to a remote tier stay there.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" || opts.out == "" {
+				return fmt.Errorf("state-dir and out are required")
+			}
+			return runBackup(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&opts.out, "out", "", "Directory to write the backup to (must not exist)")
+	return cmd
+}
+
+func runBackup(w io.Writer, opts backupOptions) error {
+	out, err := filepath.Abs(opts.out)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("%s already exists", out)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
+		return fmt.Errorf("create backup parent: %w", err)
+	}
+
+	lock, err := statelock.Acquire(opts.stateDir, "backup", false)
+	var locked *statelock.LockedError
+	switch {
+	case errors.As(err, &locked):
+		// A recorder owns the store: it checkpoints while it keeps writing.
+		if _, callErr := control.Call(control.SocketPath(opts.stateDir), control.Request{Op: opBackup, Dir: out}); callErr != nil {
+			return fmt.Errorf("%w; asking it for a backup failed: %v", err, callErr)
+		}
+	case err != nil:
+		return err
+	default:
+		err = checkpointIdle(opts.stateDir, out)
+		lock.Release()
+		if err != nil {
+			return err
+		}
+	}
+
+	files, err := loadStoreFileStats(out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Backed up %s to %s (%d tables, %s)\n", opts.stateDir, out, files.Tables, formatSize(int(files.TotalBytes)))
+	return nil
+}
+
+// checkpointIdle checkpoints a state dir nobody is recording into out.
+func checkpointIdle(stateDir, out string) error {
+	db, err := pebble.Open(stateDir, &pebble.Options{ErrorIfNotExists: true})
+	if err != nil {
+		return fmt.Errorf("open pebble: %w", err)
+	}
+	if err := db.Checkpoint(out, pebble.WithFlushedWAL()); err != nil {
+		db.Close()
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	return db.Close()
+}
+
+// restoreStoreOptions carries the flags accepted by the restore-store
+// command.
+type restoreStoreOptions struct {
+	from     string
+	stateDir string
+}
+
+func newRestoreStoreCmd() *cobra.Command {
+	var opts restoreStoreOptions
+
+	cmd := &cobra.Command{
+		Use:   "restore-store --from <backup> --state-dir <dir>",
+		Short: "Recreate a state dir from a backup",
+		Long: `Recreate a state dir from a backup taken with ` + "`diffkeeper backup`" + `.
+
+The backup is checked, copied next to --state-dir and moved into place, so
+an interrupted restore never leaves a half-written state dir. --state-dir
+must not exist or be empty; the backup itself is left untouched and can be
+restored again. To restore a working directory to an earlier capture, use
+` + "`diffkeeper restore`" + ` instead.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.from == "" || opts.stateDir == "" {
+				return fmt.Errorf("from and state-dir are required")
+			}
+			return runRestoreStore(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.from, "from", "", "Backup directory written by backup")
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "State dir to create")
+	return cmd
+}
+
+func runRestoreStore(w io.Writer, opts restoreStoreOptions) error {
+	db, err := pebble.Open(opts.from, &pebble.Options{ReadOnly: true, ErrorIfNotExists: true})
+	if err != nil {
+		return fmt.Errorf("%s is not a readable backup: %w", opts.from, err)
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(opts.stateDir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	case len(entries) > 0:
+		return fmt.Errorf("state dir %s is not empty; remove it or choose another", opts.stateDir)
+	default:
+		if err := os.Remove(opts.stateDir); err != nil {
+			return err
+		}
+	}
+
+	target := filepath.Clean(opts.stateDir)
+	tmp := target + ".restoring"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	copied, err := copyTree(opts.from, tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("copy backup: %w", err)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	fmt.Fprintf(w, "Restored %s from %s (%s)\n", target, opts.from, formatSize(int(copied)))
+	return nil
+}
+
+// copyTree copies the regular files under src to dest and returns how many
+// bytes it copied.
+func copyTree(src, dest string) (int64, error) {
+	var copied int64
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dest, rel), 0o755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		copied += info.Size()
+		return copyFile(path, filepath.Join(dest, rel))
+	})
+	return copied, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// baselineTailBytes is how much of the end of each file the baseline scan
+// hashes.
+const baselineTailBytes = 4 << 10
+
+// baselineFile is a file as the baseline scan found it.
+type baselineFile struct {
+	size int64
+	// tail is the hash of the last baselineTailBytes bytes.
+	tail [sha256.Size]byte
+}
+
+// appendedTo returns the content the file had when scanned, if data, read
+// after it changed, only appended to it: the old tail is still in place
+// and data is longer.
+func (f baselineFile) appendedTo(data []byte) ([]byte, bool) {
+	if int64(len(data)) <= f.size {
+		return nil, false
+	}
+	head := data[:f.size]
+	if sha256.Sum256(head[max(f.size-baselineTailBytes, 0):]) != f.tail {
+		return nil, false
+	}
+	return head, true
+}
+
+// baselineScan remembers the files present when recording started. Watch
+// events arrive after a write, when a file's previous content is already
+// gone, so its first capture would lose the state the run started from.
+// When that write only appended, the previous content is the start of the
+// capture; the scan keeps each file's size and the hash of its tail, not
+// its content, so it stays cheap on large trees.
+type baselineScan struct {
+	at time.Time
+
+	mu    sync.Mutex
+	files map[string]baselineFile
+}
+
+// scanBaseline records every regular file under root that is not ignored
+// and is at most maxBytes (0 = unlimited).
+func scanBaseline(root string, ignored func(path string) bool, maxBytes int64) *baselineScan {
+	b := &baselineScan{at: time.Now(), files: make(map[string]baselineFile)}
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if ignored(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || (maxBytes > 0 && info.Size() > maxBytes) {
+			return nil
+		}
+		if tail, err := hashTail(path, info.Size()); err == nil {
+			b.files[path] = baselineFile{size: info.Size(), tail: tail}
+		}
+		return nil
+	})
+	return b
+}
+
+// take returns what the scan found at path, the first time path is
+// captured only. A nil scan finds nothing.
+func (b *baselineScan) take(path string) (baselineFile, bool) {
+	if b == nil {
+		return baselineFile{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.files[path]
+	delete(b.files, path)
+	return f, ok
+}
+
+func hashTail(path string, size int64) ([sha256.Size]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	defer f.Close()
+	off := max(size-baselineTailBytes, 0)
+	buf := make([]byte, size-off)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(buf), nil
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/spf13/cobra"
+)
+
+// benchOptions carries the flags accepted by the bench command.
+type benchOptions struct {
+	configPath string
+	dir        string
+	workloads  []string
+	sizeMB     int
+	timeout    time.Duration
+	jsonOut    bool
+}
+
+// benchWorkload generates one kind of write traffic under a watched dir.
+type benchWorkload struct {
+	name string
+	desc string
+	run  func(r *benchRun, size int64) error
+}
+
+// benchWorkloads are the workloads bench knows, in the order it runs them.
+var benchWorkloads = []benchWorkload{
+	{name: "small", desc: "many small files created, then a tenth of them rewritten", run: benchSmallFiles},
+	{name: "log", desc: "one log file appended to in 32 rounds", run: benchAppendLog},
+	{name: "binary", desc: "one large binary file overwritten in place in 16 rounds", run: benchBinaryChurn},
+}
+
+func newBenchCmd() *cobra.Command {
+	var opts benchOptions
+
+	cmd := &cobra.Command{
+		Use:   "bench [--config <file>] [--workload <name>]...",
+		Short: "Measure capture throughput and storage on this machine",
+		Long: `Measure capture throughput and storage on this machine.
+
+Runs synthetic workloads through the same watcher, capturer, journal and
+processor record uses, with the current configuration (--config, the
+DIFFKEEPER_* environment and their defaults), and reports for each:
+
+  small   many small files created, then a tenth of them rewritten
+  log     one log file appended to in 32 rounds
+  binary  one large binary file overwritten in place in 16 rounds
+
+Each workload writes about --size-mb and waits for every round to be stored
+before the next. Throughput is the bytes and versions stored per second;
+latency runs from a file's last write to its version being stored, so it
+includes the debounce window; efficiency is the content recorded over the
+bytes the store holds for it. eBPF is not attached, as there is no traced
+command. Every workload gets its own state dir and watch dir under --dir
+(default a temporary dir), which are removed afterwards.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, _, err := config.Load(opts.configPath, "", nil)
+			if err != nil {
+				return err
+			}
+			if err := cfg.Validate(); err != nil {
+				return fmt.Errorf("invalid config: %w", err)
+			}
+			return runBench(cmd.OutOrStdout(), cfg, opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.configPath, "config", "", "Config file (YAML or TOML) to benchmark")
+	cmd.Flags().StringVar(&opts.dir, "dir", "", "Scratch directory (default: a temporary dir)")
+	cmd.Flags().StringSliceVar(&opts.workloads, "workload", nil, "Workload to run: small, log or binary (repeatable; default: all)")
+	names := make([]string, len(benchWorkloads))
+	for i, wl := range benchWorkloads {
+		names[i] = wl.name
+	}
+	completeValues(cmd, "workload", names...)
+	cmd.Flags().IntVar(&opts.sizeMB, "size-mb", 64, "Approximate MB each workload writes")
+	cmd.Flags().DurationVar(&opts.timeout, "timeout", 2*time.Minute, "How long a round may take to be stored")
+	cmd.Flags().BoolVar(&opts.jsonOut, "json", false, "Print JSON instead of a table")
+	return cmd
+}
+
+// benchResult is what bench reports for one workload.
+type benchResult struct {
+	Workload       string       `json:"workload"`
+	Writes         int          `json:"writes"`
+	Versions       int          `json:"versions"`
+	LogicalBytes   int64        `json:"logical_bytes"`
+	StoredBytes    int64        `json:"stored_bytes"`
+	Efficiency     float64      `json:"efficiency"`
+	Seconds        float64      `json:"seconds"`
+	MBPerSec       float64      `json:"mb_per_sec"`
+	VersionsPerSec float64      `json:"versions_per_sec"`
+	Latency        benchLatency `json:"latency_ms"`
+}
+
+// benchLatency holds write-to-stored latency percentiles in milliseconds.
+type benchLatency struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+func runBench(w io.Writer, cfg *config.DiffConfig, opts benchOptions) error {
+	if opts.sizeMB <= 0 {
+		return fmt.Errorf("--size-mb must be positive, got: %d", opts.sizeMB)
+	}
+	var selected []benchWorkload
+	for _, wl := range benchWorkloads {
+		if len(opts.workloads) == 0 || slices.Contains(opts.workloads, wl.name) {
+			selected = append(selected, wl)
+		}
+	}
+	for _, name := range opts.workloads {
+		if !slices.ContainsFunc(benchWorkloads, func(wl benchWorkload) bool { return wl.name == name }) {
+			return fmt.Errorf("unknown workload %q (must be 'small', 'log' or 'binary')", name)
+		}
+	}
+
+	dir := opts.dir
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "diffkeeper-bench-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+
+	results := make([]benchResult, 0, len(selected))
+	for _, wl := range selected {
+		if !opts.jsonOut {
+			fmt.Fprintf(w, "Running %s: %s...\n", wl.name, wl.desc)
+		}
+		res, err := runBenchWorkload(cfg, filepath.Join(dir, wl.name), wl, int64(opts.sizeMB)<<20, opts.timeout)
+		if err != nil {
+			return fmt.Errorf("workload %s: %w", wl.name, err)
+		}
+		results = append(results, res)
+	}
+
+	if opts.jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	fmt.Fprintf(w, "\nDebounce %s, durability %s, %d processor workers, %s watcher%s\n\n",
+		cfg.DebounceWindow, cfg.Durability, max(cfg.ProcessorWorkers, 1), benchWatcher(cfg), benchOverhead(cfg.Overhead))
+	fmt.Fprintf(w, "%-8s %8s %9s %9s %10s %8s %10s %9s %9s %9s\n",
+		"WORKLOAD", "VERSIONS", "LOGICAL", "STORED", "EFFICIENCY", "MB/S", "VERSIONS/S", "P50", "P95", "P99")
+	for _, res := range results {
+		fmt.Fprintf(w, "%-8s %8d %9s %9s %9.1fx %8.1f %10.1f %7.0fms %7.0fms %7.0fms\n",
+			res.Workload, res.Versions, formatSize(int(res.LogicalBytes)), formatSize(int(res.StoredBytes)), res.Efficiency,
+			res.MBPerSec, res.VersionsPerSec, res.Latency.P50, res.Latency.P95, res.Latency.P99)
+	}
+	return nil
+}
+
+// benchWatcher names the watcher record would use without eBPF.
+func benchWatcher(cfg *config.DiffConfig) string {
+	if cfg.WatchBackend == config.WatchBackendPoll {
+		return "poll"
+	}
+	return "fsnotify"
+}
+
+// benchOverhead describes the overhead limits bench runs under, if any.
+func benchOverhead(o config.OverheadConfig) string {
+	var limits string
+	if o.MaxCPUPercent > 0 {
+		limits += fmt.Sprintf(", max CPU %d%%", o.MaxCPUPercent)
+	}
+	if o.MaxIOMBps > 0 {
+		limits += fmt.Sprintf(", max I/O %d MB/s", o.MaxIOMBps)
+	}
+	return limits
+}
+
+// runBenchWorkload records wl under dir with a pipeline set up as record
+// sets it up, and measures it.
+func runBenchWorkload(cfg *config.DiffConfig, dir string, wl benchWorkload, size int64, timeout time.Duration) (benchResult, error) {
+	stateDir, watchDir := filepath.Join(dir, "state"), filepath.Join(dir, "watch")
+	for _, d := range []string{stateDir, watchDir} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return benchResult{}, err
+		}
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := pebble.Open(stateDir, &pebble.Options{})
+	if err != nil {
+		return benchResult{}, fmt.Errorf("open pebble: %w", err)
+	}
+	defer db.Close()
+	casStore, err := cas.NewCASStore(db, cfg.HashAlgo)
+	if err != nil {
+		return benchResult{}, fmt.Errorf("init CAS: %w", err)
+	}
+	if _, err := casStore.EnableExistenceCache(); err != nil {
+		return benchResult{}, fmt.Errorf("load CAS index: %w", err)
+	}
+	policies, err := newCapturePolicies(cfg.Policies)
+	if err != nil {
+		return benchResult{}, err
+	}
+
+	absWatch, err := filepath.Abs(watchDir)
+	if err != nil {
+		return benchResult{}, err
+	}
+	run := &benchRun{root: absWatch, timeout: timeout, pending: make(map[string]time.Time)}
+	journal := recorder.NewJournal(db)
+	overhead := newOverheadBudget(cfg.Overhead)
+	procOpts := recorder.DefaultProcessorOptions()
+	procOpts.Workers = cfg.ProcessorWorkers
+	if policies != nil {
+		procOpts.Storage = policies.Storage
+	}
+	if overhead != nil {
+		procOpts.Pace = overhead.Spend
+	}
+	recorder.ApplyDurability(cfg.Durability, journal, casStore, &procOpts)
+	if cfg.Durability != config.DurabilityStrict {
+		journal.SetBatchWindow(recorder.DefaultBatchWindow)
+		defer journal.Flush()
+	}
+	procOpts.OnStored = run.stored
+	stopProcessor := recorder.StartProcessorWithOptions(db, casStore, procOpts)
+	defer stopProcessor()
+	if cfg.Durability != config.DurabilityStrict {
+		stopSyncer := recorder.StartSyncer(db, cfg.SyncInterval)
+		defer stopSyncer()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchCfg := *cfg
+	watchCfg.WatchDir = absWatch
+	tree, err := startTreeWatch(ctx, &watchCfg, policies, journal, nil, nil, overhead, absWatch)
+	if err != nil {
+		return benchResult{}, err
+	}
+	tree.StartFallback(ctx, nil)
+
+	started := time.Now()
+	if err := wl.run(run, size); err != nil {
+		return benchResult{}, err
+	}
+	took := time.Since(started)
+
+	objectSizes, err := loadObjectSizes(db)
+	if err != nil {
+		return benchResult{}, err
+	}
+	return run.result(wl.name, took, objectSizes), nil
+}
+
+// benchRun tracks the writes of a workload until their versions are
+// stored.
+type benchRun struct {
+	root    string
+	timeout time.Duration
+
+	mu sync.Mutex
+	// pending holds when the last write of each path began, until a
+	// version of it captured since is stored.
+	pending   map[string]time.Time
+	writes    int
+	versions  int
+	logical   int64
+	latencies []time.Duration
+}
+
+// stored is the processor's OnStored callback.
+func (r *benchRun) stored(ev recorder.StoredEvent) {
+	_, path := recorder.SplitNamespace(ev.Path)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.versions++
+	r.logical += int64(ev.Size)
+	if written, ok := r.pending[path]; ok && ev.Timestamp >= written.UnixNano() {
+		r.latencies = append(r.latencies, time.Since(written))
+		delete(r.pending, path)
+	}
+}
+
+// write replaces the content of rel.
+func (r *benchRun) write(rel string, data []byte) error {
+	r.writing(rel)
+	return os.WriteFile(filepath.Join(r.root, rel), data, 0o644)
+}
+
+// writeAt writes data over the content of rel at each of offsets, or
+// appends it when offsets is empty.
+func (r *benchRun) writeAt(rel string, data []byte, offsets ...int64) error {
+	flags := os.O_WRONLY
+	if len(offsets) == 0 {
+		flags |= os.O_APPEND
+	}
+	r.writing(rel)
+	f, err := os.OpenFile(filepath.Join(r.root, rel), flags, 0o644)
+	if err != nil {
+		return err
+	}
+	if len(offsets) == 0 {
+		_, err = f.Write(data)
+	}
+	for _, off := range offsets {
+		if _, err = f.WriteAt(data, off); err != nil {
+			break
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writing notes that a write of rel begins, so that a version captured
+// from then on counts for it: the capture of its last event may come
+// before the write call returns, with no event after it.
+func (r *benchRun) writing(rel string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes++
+	r.pending[filepath.ToSlash(rel)] = time.Now()
+}
+
+// settle waits until every path written so far has a version stored since.
+func (r *benchRun) settle() error {
+	deadline := time.Now().Add(r.timeout)
+	for {
+		r.mu.Lock()
+		left := len(r.pending)
+		r.mu.Unlock()
+		if left == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d written files not stored within %s", left, r.timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// result summarizes the run, which took took, given the sizes of the
+// stored objects.
+func (r *benchRun) result(name string, took time.Duration, objectSizes map[string]int64) benchResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := benchResult{Workload: name, Writes: r.writes, Versions: r.versions, LogicalBytes: r.logical, Seconds: took.Seconds()}
+	for _, size := range objectSizes {
+		res.StoredBytes += size
+	}
+	if res.StoredBytes > 0 {
+		res.Efficiency = float64(res.LogicalBytes) / float64(res.StoredBytes)
+	}
+	if res.Seconds > 0 {
+		res.MBPerSec = float64(res.LogicalBytes) / (1 << 20) / res.Seconds
+		res.VersionsPerSec = float64(res.Versions) / res.Seconds
+	}
+	latencies := slices.Clone(r.latencies)
+	slices.Sort(latencies)
+	res.Latency = benchLatency{
+		P50: latencyPercentile(latencies, 50),
+		P95: latencyPercentile(latencies, 95),
+		P99: latencyPercentile(latencies, 99),
+		Max: latencyPercentile(latencies, 100),
+	}
+	return res
+}
+
+// latencyPercentile returns the p-th percentile of sorted in milliseconds.
+func latencyPercentile(sorted []time.Duration, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	return float64(sorted[max(i, 1)-1]) / float64(time.Millisecond)
+}
+
+// benchText returns n bytes of log-like lines.
+func benchText(rng *rand.Rand, n int) []byte {
+	var b strings.Builder
+	for b.Len() < n {
+		fmt.Fprintf(&b, "%d level=%s request=%08x latency_ms=%d status=%d\n",
+			1700000000+rng.Intn(1000000), []string{"info", "warn", "debug"}[rng.Intn(3)], rng.Uint32(), rng.Intn(500), 200+rng.Intn(4)*100)
+	}
+	return []byte(b.String()[:n])
+}
+
+// benchSmallFiles creates files of 1-8 KiB adding up to size, then
+// rewrites every tenth.
+func benchSmallFiles(r *benchRun, size int64) error {
+	rng := rand.New(rand.NewSource(1))
+	var names []string
+	for total := int64(0); total < size; {
+		name := fmt.Sprintf("file-%05d.json", len(names))
+		data := benchText(rng, 1024+rng.Intn(7*1024))
+		if err := r.write(name, data); err != nil {
+			return err
+		}
+		names = append(names, name)
+		total += int64(len(data))
+	}
+	if err := r.settle(); err != nil {
+		return err
+	}
+	for i := 0; i < len(names); i += 10 {
+		if err := r.write(names[i], benchText(rng, 1024+rng.Intn(7*1024))); err != nil {
+			return err
+		}
+	}
+	return r.settle()
+}
+
+// benchAppendLog appends size bytes of lines to one file in 32 rounds.
+func benchAppendLog(r *benchRun, size int64) error {
+	const rounds = 32
+	rng := rand.New(rand.NewSource(2))
+	if err := r.write("app.log", nil); err != nil {
+		return err
+	}
+	if err := r.settle(); err != nil {
+		return err
+	}
+	for i := 0; i < rounds; i++ {
+		if err := r.writeAt("app.log", benchText(rng, int(size/rounds))); err != nil {
+			return err
+		}
+		if err := r.settle(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// benchBinaryChurn writes a file of size random bytes, then overwrites 32
+// random 4 KiB blocks of it in each of 16 rounds.
+func benchBinaryChurn(r *benchRun, size int64) error {
+	const (
+		rounds    = 16
+		blocks    = 32
+		blockSize = 4096
+	)
+	rng := rand.New(rand.NewSource(3))
+	data := make([]byte, size)
+	rng.Read(data)
+	if err := r.write("data.bin", data); err != nil {
+		return err
+	}
+	if err := r.settle(); err != nil {
+		return err
+	}
+	block := make([]byte, blockSize)
+	for i := 0; i < rounds; i++ {
+		offsets := make([]int64, blocks)
+		for j := range offsets {
+			offsets[j] = rng.Int63n(max(size-blockSize, 1))
+		}
+		rng.Read(block)
+		if err := r.writeAt("data.bin", block, offsets...); err != nil {
+			return err
+		}
+		if err := r.settle(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
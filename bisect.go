@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/glob"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+	"github.com/spf13/cobra"
+)
+
+// bisectOptions carries the flags accepted by the bisect command.
+type bisectOptions struct {
+	stateDir  string
+	watchDir  string
+	command   string
+	good      string
+	bad       string
+	namespace string
+	paths     []string
+	backupDir string
+	force     bool
+
+	// output receives the test command's stdout and stderr.
+	output io.Writer
+}
+
+func newBisectCmd() *cobra.Command {
+	var opts bisectOptions
+
+	cmd := &cobra.Command{
+		Use:   "bisect --state-dir <dir> --watch <dir> --cmd <test>",
+		Short: "Find the capture at which a test starts failing",
+		Long: `Find the capture at which a test starts failing.
+
+bisect binary-searches the captures between --good and --bad, the way git bisect
+searches commits: at each step the watch directory is restored to the state
+right after a capture and --cmd is run there through the shell. Exit status 0
+means the state is good, anything else means it is bad. The state at --good
+must pass and the state at --bad must fail; both are checked first.
+
+The watch directory is backed up before the first step (default:
+restore-backups/<time> in the state dir) and left at the first failing capture.
+Like restore, bisect only rewrites files diffkeeper recorded.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			if opts.command == "" {
+				return fmt.Errorf("--cmd is required")
+			}
+			if err := config.ValidateNamespace(opts.namespace); err != nil {
+				return err
+			}
+			for _, p := range opts.paths {
+				if err := glob.Validate(p); err != nil {
+					return fmt.Errorf("invalid --path pattern %q: %w", p, err)
+				}
+			}
+			opts.output = cmd.ErrOrStderr()
+			return runBisect(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&opts.watchDir, "watch", ".", "Watch directory of the recording, rewritten at each step")
+	cmd.Flags().StringVar(&opts.command, "cmd", "", "Shell command run in the watch directory; nonzero exit marks the state bad")
+	cmd.Flags().StringVar(&opts.good, "good", "start", "A time whose state passes (same forms as export --time)")
+	cmd.Flags().StringVar(&opts.bad, "bad", "latest", "A time whose state fails (same forms as export --time)")
+	cmd.Flags().StringVar(&opts.namespace, "namespace", "", "Search the captures recorded with record --namespace")
+	cmd.Flags().StringArrayVar(&opts.paths, "path", nil, "Only restore and search captures of paths matching this glob (repeatable, supports **)")
+	cmd.Flags().StringVar(&opts.backupDir, "backup-dir", "", "Where to back up the watch directory first (default: restore-backups/<time> in the state dir)")
+	cmd.Flags().BoolVar(&opts.force, "force", false, "Take over the state dir lock if its previous owner is no longer running")
+	return cmd
+}
+
+func runBisect(w io.Writer, opts bisectOptions) error {
+	cfg, err := loadEnvConfig(nil)
+	if err != nil {
+		return err
+	}
+	watchDir, err := filepath.Abs(opts.watchDir)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(watchDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("watch dir %s is not a directory", opts.watchDir)
+	}
+	if opts.output == nil {
+		opts.output = io.Discard
+	}
+
+	if _, err := os.Stat(opts.stateDir); err != nil {
+		return fmt.Errorf("open state dir: %w", err)
+	}
+	lock, err := statelock.Acquire(opts.stateDir, "bisect", opts.force)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	db, casStore, err := openReadOnlyStoreWithConfig(opts.stateDir, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	anchors := loadSessionAnchors(db)
+	good, err := parseTargetTime(opts.good, anchors)
+	if err != nil {
+		return fmt.Errorf("--good: %w", err)
+	}
+	bad, err := parseTargetTime(opts.bad, anchors)
+	if err != nil {
+		return fmt.Errorf("--bad: %w", err)
+	}
+	if !good.Before(bad) {
+		return fmt.Errorf("--good (%s) must be before --bad (%s)", good.Format(time.RFC3339Nano), bad.Format(time.RFC3339Nano))
+	}
+
+	history, err := loadMetadataHistory(db, bad)
+	if err != nil {
+		return err
+	}
+	captures := bisectCaptures(recorder.NamespaceHistory(history, opts.namespace), good, opts.paths)
+	if len(captures) == 0 {
+		return fmt.Errorf("no captures between --good and --bad")
+	}
+
+	r, err := newRestorer(db, casStore, watchDir, opts.namespace, opts.paths)
+	if err != nil {
+		return err
+	}
+	r.content = recorder.NewContentCache(cfg.ContentCacheBytes())
+	backupDir := opts.backupDir
+	if backupDir == "" {
+		backupDir = filepath.Join(opts.stateDir, restoreBackupDirName, time.Now().UTC().Format("20060102T150405.000Z"))
+	}
+	if err := backupRecorded(r, backupDir); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Backed up %s to %s\n", opts.watchDir, backupDir)
+
+	// test restores the state at t and reports whether the command passes.
+	test := func(t time.Time) (bool, error) {
+		if err := r.restoreTo(t); err != nil {
+			return false, err
+		}
+		return runBisectCommand(opts.command, watchDir, opts.output)
+	}
+
+	if pass, err := test(good); err != nil {
+		return err
+	} else if !pass {
+		return fmt.Errorf("the state at --good (%s) already fails; pass an earlier --good", good.Format(time.RFC3339Nano))
+	}
+	if pass, err := test(bad); err != nil {
+		return err
+	} else if pass {
+		return fmt.Errorf("the state at --bad (%s) passes; pass a later --bad", bad.Format(time.RFC3339Nano))
+	}
+
+	// The state at good passes and the state after captures[hi] fails.
+	lo, hi := -1, len(captures)-1
+	fmt.Fprintf(w, "Bisecting %d captures (about %d steps)\n", len(captures), bisectSteps(len(captures)))
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		pass, err := test(captures[mid])
+		if err != nil {
+			return err
+		}
+		verdict := "bad"
+		if pass {
+			verdict = "good"
+			lo = mid
+		} else {
+			hi = mid
+		}
+		fmt.Fprintf(w, "  %s %s (%d left)\n", captures[mid].Format(time.RFC3339Nano), verdict, hi-lo-1)
+	}
+
+	first := captures[hi]
+	if err := r.restoreTo(first); err != nil {
+		return err
+	}
+	recordAudit(opts.stateDir, auditBisect, map[string]any{"watch_dir": watchDir, "target": first.UTC().Format(time.RFC3339Nano), "backup": backupDir})
+	fmt.Fprintf(w, "First failing capture: %s\n", first.Format(time.RFC3339Nano))
+	for _, meta := range history {
+		if meta.Timestamp == first.UnixNano() && glob.MatchAny(opts.paths, filepath.ToSlash(cleanPath(meta.Path))) {
+			fmt.Fprintf(w, "  %-6s %s\n", meta.Op, meta.Path)
+		}
+	}
+	fmt.Fprintf(w, "%s is left at that capture; the previous state is in %s\n", opts.watchDir, backupDir)
+	return nil
+}
+
+// bisectCaptures returns the distinct capture times after good in history,
+// oldest first.
+func bisectCaptures(history []recorder.MetadataRecord, good time.Time, paths []string) []time.Time {
+	seen := make(map[int64]bool)
+	var captures []time.Time
+	for _, meta := range history {
+		if meta.Timestamp <= good.UnixNano() || seen[meta.Timestamp] || !glob.MatchAny(paths, filepath.ToSlash(cleanPath(meta.Path))) {
+			continue
+		}
+		seen[meta.Timestamp] = true
+		captures = append(captures, time.Unix(0, meta.Timestamp))
+	}
+	sort.Slice(captures, func(i, j int) bool { return captures[i].Before(captures[j]) })
+	return captures
+}
+
+// bisectSteps is the number of tests needed to search n captures.
+func bisectSteps(n int) int {
+	steps := 0
+	for n > 1 {
+		n = (n + 1) / 2
+		steps++
+	}
+	return steps
+}
+
+// backupRecorded copies every recorded file present in the watch dir to
+// backupDir. Recorded paths that are missing are listed as created, since
+// bisect may bring them back.
+func backupRecorded(r *restorer, backupDir string) error {
+	manifest := restoreManifest{WatchDir: r.watchDir}
+	for path := range r.latest {
+		rel := filepath.ToSlash(cleanPath(path))
+		if !glob.MatchAny(r.paths, rel) {
+			continue
+		}
+		change := restoreChange{Path: rel}
+		if _, err := os.Lstat(filepath.Join(r.watchDir, filepath.FromSlash(rel))); err != nil {
+			change.Created = true
+		}
+		manifest.Changes = append(manifest.Changes, change)
+	}
+	sort.Slice(manifest.Changes, func(i, j int) bool { return manifest.Changes[i].Path < manifest.Changes[j].Path })
+	return backupRestore(r.watchDir, backupDir, manifest)
+}
+
+// runBisectCommand runs command through the shell in dir and reports
+// whether it exited 0. Failing to start the shell is an error, not a
+// failing state.
+func runBisectCommand(command, dir string, output io.Writer) (bool, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Dir = dir
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("run --cmd: %w", err)
+	}
+	return true, nil
+}
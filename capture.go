@@ -0,0 +1,246 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/ebpf"
+	"github.com/saworbit/diffkeeper/pkg/glob"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+// hotPathDebounce is the least time writes to a hot path are coalesced
+// over, whatever the configured debounce.
+const hotPathDebounce = 250 * time.Millisecond
+
+// captureSettings are the fs recorder knobs that can change mid-recording.
+type captureSettings struct {
+	ignore       []string
+	debounce     time.Duration
+	maxPerSecond int
+}
+
+// captureGate decides whether and when a changed path is captured. Ignored
+// paths are dropped; otherwise captures wait for the debounce window and are
+// spaced to honor the per-path rate limit. Deferred captures read the file
+// when they fire, so the newest content always wins and nothing is lost.
+//
+// Directory and mode changes skip the debounce and go straight to attr.
+// Per-path policies can ignore a path or capture every write to it at once.
+//
+// Every change is fed to the hot-path profiler. Paths it reports as hot are
+// coalesced for at least hotPathDebounce, and captured once per window
+// while writes continue rather than waiting for them to stop.
+type captureGate struct {
+	root     string
+	capture  func(path string)
+	policies *capturePolicies
+	profiler *ebpf.Profiler
+
+	mu       sync.Mutex
+	settings captureSettings
+	pending  map[string]*time.Timer
+	last     map[string]time.Time
+	attr     func(op, path string, mode fs.FileMode)
+	// modes holds the last mode reported per path, to drop repeated chmod
+	// events and to recognize removed directories.
+	modes map[string]fs.FileMode
+	// hot holds the paths in the profiler's latest hints.
+	hot map[string]bool
+}
+
+func newCaptureGate(root string, settings captureSettings, capture func(path string)) *captureGate {
+	return &captureGate{
+		root:     root,
+		capture:  capture,
+		settings: settings,
+		pending:  make(map[string]*time.Timer),
+		last:     make(map[string]time.Time),
+		modes:    make(map[string]fs.FileMode),
+	}
+}
+
+// OnAttr sets where directory and mode changes are sent; without it they
+// are dropped.
+func (g *captureGate) OnAttr(attr func(op, path string, mode fs.FileMode)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.attr = attr
+}
+
+// UsePolicies applies per-path capture policies. It must be called before
+// the first Offer.
+func (g *captureGate) UsePolicies(policies *capturePolicies) {
+	g.policies = policies
+}
+
+// Update swaps the settings; pending captures keep their current deadline.
+func (g *captureGate) Update(settings captureSettings) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.settings = settings
+}
+
+// Ignored reports whether path matches an ignore pattern relative to root,
+// or an ignore policy.
+func (g *captureGate) Ignored(path string) bool {
+	return g.policy(path) == config.CaptureIgnore
+}
+
+// policy returns the capture mode for path: config.CaptureIgnore for ignored
+// paths, otherwise its policy's mode.
+func (g *captureGate) policy(path string) string {
+	g.mu.Lock()
+	ignore := g.settings.ignore
+	g.mu.Unlock()
+	if len(ignore) == 0 && g.policies == nil {
+		return ""
+	}
+	rel, err := filepath.Rel(g.root, path)
+	if err != nil {
+		return ""
+	}
+	rel = filepath.ToSlash(rel)
+	if len(ignore) > 0 && glob.MatchAny(ignore, rel) {
+		return config.CaptureIgnore
+	}
+	return g.policies.Capture(rel)
+}
+
+// UseProfiler feeds every offered path to p. Its hints come back through
+// ApplyHotPathHints. It must be called before the first Offer.
+func (g *captureGate) UseProfiler(p *ebpf.Profiler) {
+	g.profiler = p
+}
+
+// ApplyHotPathHints marks the paths in hints as hot, and every other path
+// as not.
+func (g *captureGate) ApplyHotPathHints(hints map[string]float64) error {
+	hot := make(map[string]bool, len(hints))
+	for path := range hints {
+		hot[path] = true
+	}
+	g.mu.Lock()
+	g.hot = hot
+	g.mu.Unlock()
+	return nil
+}
+
+// Hot reports whether the profiler currently finds path hot.
+func (g *captureGate) Hot(path string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.hot[path]
+}
+
+// Offer reports a change to path.
+func (g *captureGate) Offer(path string) {
+	policy := g.policy(path)
+	if policy == config.CaptureIgnore {
+		return
+	}
+	g.profiler.Record(path)
+
+	g.mu.Lock()
+	now := time.Now()
+	if policy == config.CaptureSnapshot {
+		g.last[path] = now
+		g.mu.Unlock()
+		g.capture(path)
+		return
+	}
+	delay := g.settings.debounce
+	hot := g.hot[path]
+	if hot && delay < hotPathDebounce {
+		delay = hotPathDebounce
+	}
+	if g.settings.maxPerSecond > 0 {
+		next := g.last[path].Add(time.Second / time.Duration(g.settings.maxPerSecond))
+		if wait := next.Sub(now); wait > delay {
+			delay = wait
+		}
+	}
+
+	if timer, ok := g.pending[path]; ok {
+		// Debouncing restarts the quiet period; a rate-limited capture is
+		// already scheduled for the earliest allowed moment, and so is the
+		// capture of a hot path, which may never go quiet.
+		if g.settings.debounce > 0 && !hot {
+			timer.Reset(delay)
+		}
+		g.mu.Unlock()
+		return
+	}
+	if delay <= 0 {
+		g.last[path] = now
+		g.mu.Unlock()
+		g.capture(path)
+		return
+	}
+	g.pending[path] = time.AfterFunc(delay, func() { g.fire(path) })
+	g.mu.Unlock()
+}
+
+// OfferAttr reports a directory created under root (recorder.OpMkdir) or a
+// mode change (recorder.OpChmod). A chmod that leaves the last reported mode
+// unchanged, as inotify reports for touch, is dropped.
+func (g *captureGate) OfferAttr(op, path string, mode fs.FileMode) {
+	if g.Ignored(path) {
+		return
+	}
+	g.mu.Lock()
+	prev, seen := g.modes[path]
+	g.modes[path] = mode
+	attr := g.attr
+	g.mu.Unlock()
+	if attr == nil || (op == recorder.OpChmod && seen && prev == mode) {
+		return
+	}
+	attr(op, path, mode)
+}
+
+// OfferRemove reports that path is gone. Only directories already reported
+// through OfferAttr are recorded as removed (recorder.OpRmdir); deleted
+// files are not tracked.
+func (g *captureGate) OfferRemove(path string) {
+	g.mu.Lock()
+	mode, seen := g.modes[path]
+	delete(g.modes, path)
+	attr := g.attr
+	g.mu.Unlock()
+	if attr == nil || !seen || !mode.IsDir() {
+		return
+	}
+	attr(recorder.OpRmdir, path, mode)
+}
+
+func (g *captureGate) fire(path string) {
+	g.mu.Lock()
+	if _, ok := g.pending[path]; !ok {
+		g.mu.Unlock()
+		return
+	}
+	delete(g.pending, path)
+	g.last[path] = time.Now()
+	g.mu.Unlock()
+	g.capture(path)
+}
+
+// Flush captures every deferred path immediately.
+func (g *captureGate) Flush() {
+	g.mu.Lock()
+	var paths []string
+	for path, timer := range g.pending {
+		if timer.Stop() {
+			paths = append(paths, path)
+		}
+	}
+	g.mu.Unlock()
+
+	for _, path := range paths {
+		g.fire(path)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/control"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/spf13/cobra"
+)
+
+const (
+	opEvents = "events"
+
+	// captureLogSize is how many recent capture events the recorder keeps
+	// for `diffkeeper log`.
+	captureLogSize = 4096
+)
+
+// captureEvent is one stored capture as reported to `diffkeeper log`.
+type captureEvent struct {
+	Seq uint64 `json:"seq"`
+	recorder.StoredEvent
+}
+
+// eventsReply is the control socket reply to opEvents.
+type eventsReply struct {
+	Events []captureEvent `json:"events"`
+	// Next is the cursor to pass as Since in the following request.
+	Next uint64 `json:"next"`
+	// Dropped counts events that were overwritten before they were read.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// captureLog is a ring buffer of the most recent capture events.
+type captureLog struct {
+	mu     sync.Mutex
+	events []captureEvent
+	next   uint64
+}
+
+func newCaptureLog(size int) *captureLog {
+	return &captureLog{events: make([]captureEvent, size), next: 1}
+}
+
+// Add records ev; it is used as the processor's OnStored hook.
+func (l *captureLog) Add(ev recorder.StoredEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[l.next%uint64(len(l.events))] = captureEvent{Seq: l.next, StoredEvent: ev}
+	l.next++
+}
+
+// Since returns the retained events with a sequence number of at least
+// since. A zero cursor returns everything retained.
+func (l *captureLog) Since(since uint64) eventsReply {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reply := eventsReply{Events: []captureEvent{}, Next: l.next}
+	oldest := uint64(1)
+	if size := uint64(len(l.events)); l.next > size {
+		oldest = l.next - size
+	}
+	if since == 0 {
+		since = oldest
+	} else if since < oldest {
+		reply.Dropped = oldest - since
+		since = oldest
+	}
+	for seq := since; seq < l.next; seq++ {
+		reply.Events = append(reply.Events, l.events[seq%uint64(len(l.events))])
+	}
+	return reply
+}
+
+// register exposes the log on the recorder's control socket.
+func (l *captureLog) register(srv *control.Server) {
+	srv.Handle(opEvents, func(req control.Request) (any, error) {
+		return l.Since(req.Since), nil
+	})
+}
+
+func newLogCmd() *cobra.Command {
+	var stateDir string
+	var socketPath string
+	var follow bool
+	var jsonOut bool
+	var interval time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "log",
+		Short: "Show capture events of a running recording",
+		Long: `Show capture events of a running recording: when each file version was
+stored, its operation, path and size, and whether its content was already in
+the store (dedup) or new. With --follow new events are printed as they happen
+until the recording ends, which is handy when tuning ignore rules and
+debounce settings.
+
+The recorder keeps the most recent events in memory; older ones are in the
+timeline.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := socketPath
+			if path == "" {
+				path = os.Getenv(control.EnvSocket)
+			}
+			if path == "" && stateDir != "" {
+				path = control.SocketPath(stateDir)
+			}
+			if path == "" {
+				return fmt.Errorf("no recorder found: run inside `diffkeeper record` or pass --state-dir")
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return runLog(ctx, cmd.OutOrStdout(), path, follow, jsonOut, interval)
+		},
+	}
+
+	cmd.Flags().StringVar(&stateDir, "state-dir", "", "State dir of the running recording")
+	cmd.Flags().StringVar(&socketPath, "socket", "", "Control socket path (overrides $"+control.EnvSocket+")")
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "Keep printing new events until the recording ends")
+	cmd.Flags().BoolVar(&jsonOut, "json", false, "Print one JSON object per event")
+	cmd.Flags().DurationVar(&interval, "interval", 250*time.Millisecond, "How often to ask the recorder for new events with --follow")
+	return cmd
+}
+
+func runLog(ctx context.Context, w io.Writer, socketPath string, follow, jsonOut bool, interval time.Duration) error {
+	var since uint64
+	for first := true; ; first = false {
+		resp, err := control.Call(socketPath, control.Request{Op: opEvents, Since: since})
+		if err != nil {
+			if !first {
+				fmt.Fprintln(w, "recording ended")
+				return nil
+			}
+			return err
+		}
+		var reply eventsReply
+		if err := json.Unmarshal(resp.Data, &reply); err != nil {
+			return fmt.Errorf("decode reply: %w", err)
+		}
+		if reply.Dropped > 0 && !jsonOut {
+			fmt.Fprintf(w, "... %d events dropped\n", reply.Dropped)
+		}
+		for _, ev := range reply.Events {
+			if err := writeCaptureEvent(w, ev, jsonOut); err != nil {
+				return err
+			}
+		}
+		since = reply.Next
+
+		if !follow {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func writeCaptureEvent(w io.Writer, ev captureEvent, jsonOut bool) error {
+	if jsonOut {
+		return json.NewEncoder(w).Encode(ev.StoredEvent)
+	}
+	status := "new"
+	if ev.Dedup {
+		status = "dedup"
+	}
+	if recorder.IsAttrOp(ev.Op) {
+		status = "-"
+	}
+	_, err := fmt.Fprintf(w, "%s %-8s %8s %-5s %s\n",
+		time.Unix(0, ev.Timestamp).Format("15:04:05.000"),
+		strings.ToUpper(ev.Op),
+		formatSize(ev.Size),
+		status,
+		ev.Path,
+	)
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/diff"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/spf13/cobra"
+)
+
+func newCatCmd() *cobra.Command {
+	var stateDir string
+	var atTime string
+	var lineEndings string
+	var normalizeEncoding bool
+
+	cmd := &cobra.Command{
+		Use:   "cat <path> --time <timestamp>",
+		Short: "Print a single reconstructed file to stdout",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			cfg, err := loadEnvConfig(func(c *config.DiffConfig) {
+				if cmd.Flags().Changed("line-endings") {
+					c.LineEndings = lineEndings
+				}
+				if cmd.Flags().Changed("normalize-encoding") {
+					c.NormalizeEncoding = normalizeEncoding
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return runCat(cmd.OutOrStdout(), stateDir, args[0], atTime, cfg)
+		},
+	}
+
+	cmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&atTime, "time", "latest", "Timestamp, duration, or anchor (e.g. 2s, 2025-01-02T15:04:05Z, end-5s, failure, event:<marker>)")
+	cmd.Flags().StringVar(&lineEndings, "line-endings", config.LineEndingsKeep, "Print text with line endings translated: keep, lf or crlf")
+	cmd.Flags().BoolVar(&normalizeEncoding, "normalize-encoding", false, "Strip UTF-8 byte order marks and print UTF-16 text as UTF-8")
+	return cmd
+}
+
+// runCat prints path as recorded at atTime, normalized as cfg asks.
+func runCat(w io.Writer, stateDir, path, atTime string, cfg *config.DiffConfig) error {
+	db, casStore, err := openReadOnlyStoreWithConfig(stateDir, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	targetTime, err := parseTargetTime(atTime, loadSessionAnchors(db))
+	if err != nil {
+		return err
+	}
+
+	records, err := loadMetadataAt(db, targetTime)
+	if err != nil {
+		return err
+	}
+
+	want := filepath.ToSlash(filepath.Clean(path))
+	return writeSingleFile(w, casStore, records, displayNormalization(cfg), func(recPath string) bool {
+		return filepath.ToSlash(filepath.Clean(recPath)) == want
+	}, fmt.Sprintf("%s at %s", path, atTime))
+}
+
+// writeSingleFile writes the one record accepted by match to w, after norm.
+// It fails when nothing or more than one recorded path matches.
+func writeSingleFile(w io.Writer, casStore *cas.CASStore, records map[string]recorder.MetadataRecord, norm diff.Normalization, match func(string) bool, desc string) error {
+	var matches []string
+	for recPath := range records {
+		if match(recPath) {
+			matches = append(matches, recPath)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("no recorded version of %s", desc)
+	case 1:
+	default:
+		sort.Strings(matches)
+		return fmt.Errorf("%d files match %s (%s); narrow the selection", len(matches), desc, strings.Join(matches, ", "))
+	}
+
+	meta := records[matches[0]]
+	data, err := recorder.ReadContent(casStore, meta)
+	if err != nil {
+		return fmt.Errorf("load CAS object %s: %w", meta.CID, err)
+	}
+	_, err = w.Write(norm.Apply(data))
+	return err
+}
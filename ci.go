@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/ghactions"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// maxSummaryFiles caps the changed-files table in the job summary.
+	maxSummaryFiles = 50
+	// maxAnnotations matches the per-step limit GitHub displays.
+	maxAnnotations = 10
+)
+
+func newCICmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ci",
+		Short: "CI system integrations",
+	}
+	cmd.AddCommand(newCIGitHubCmd())
+	return cmd
+}
+
+// ciGitHubOptions carries the flags accepted by `ci github`.
+type ciGitHubOptions struct {
+	stateDir     string
+	window       time.Duration
+	exportDir    string
+	exportTime   string
+	upload       bool
+	artifactName string
+}
+
+func newCIGitHubCmd() *cobra.Command {
+	var opts ciGitHubOptions
+
+	cmd := &cobra.Command{
+		Use:   "github --state-dir <dir>",
+		Short: "Write a job summary, annotations, and an export for GitHub Actions",
+		Long: `Summarize a recording for GitHub Actions.
+
+Appends a changed-files table and timeline highlights to $GITHUB_STEP_SUMMARY
+(stdout outside Actions) and, when the recorded command failed, emits warning
+annotations for files written within --window of the failure.
+
+With --export-dir, the state at --export-time is exported there. --upload also
+uploads it as a workflow artifact through the Actions API; this needs
+$ACTIONS_RUNTIME_TOKEN, which the runner only exposes to JavaScript and
+container actions. From run: steps, upload --export-dir with
+actions/upload-artifact instead.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			if opts.window <= 0 {
+				return fmt.Errorf("--window must be positive")
+			}
+			return runCIGitHub(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().DurationVar(&opts.window, "window", 5*time.Second, "Highlight writes made this long before the command exited")
+	cmd.Flags().StringVar(&opts.exportDir, "export-dir", "", "Export the state at --export-time into this directory")
+	cmd.Flags().StringVar(&opts.exportTime, "export-time", "", "Point in time to export (default: failure if the command failed, else end)")
+	cmd.Flags().BoolVar(&opts.upload, "upload", false, "Upload the export as a workflow artifact via the Actions API")
+	cmd.Flags().StringVar(&opts.artifactName, "artifact-name", "diffkeeper-export", "Artifact name for --upload")
+	return cmd
+}
+
+// ciFileChange aggregates the writes to one path.
+type ciFileChange struct {
+	path   string
+	writes int
+	size   int
+	last   time.Time
+}
+
+// ciEvent is one row of the timeline highlights.
+type ciEvent struct {
+	at    time.Time
+	op    string
+	label string
+	size  int
+}
+
+// ciReport is everything the summary and annotations are rendered from.
+type ciReport struct {
+	anchors sessionAnchors
+	changes []ciFileChange
+	recent  []ciEvent
+}
+
+func runCIGitHub(w io.Writer, opts ciGitHubOptions) error {
+	report, err := loadCIReport(opts.stateDir, opts.window)
+	if err != nil {
+		return err
+	}
+
+	var exportNote string
+	if opts.exportDir != "" || opts.upload {
+		exportNote, err = ciExport(opts, report.anchors)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := ghactions.AppendSummary(renderCISummary(report, opts.window, exportNote), w); err != nil {
+		return err
+	}
+
+	if report.anchors.hasEnd && report.anchors.exitCode != 0 {
+		return writeCIAnnotations(w, report)
+	}
+	return nil
+}
+
+func loadCIReport(stateDir string, window time.Duration) (ciReport, error) {
+	db, _, err := openReadOnlyStore(stateDir)
+	if err != nil {
+		return ciReport{}, err
+	}
+	defer db.Close()
+
+	report := ciReport{anchors: loadSessionAnchors(db)}
+	history, err := loadMetadataHistory(db, time.Now())
+	if err != nil {
+		return ciReport{}, err
+	}
+	markers, err := loadMarkers(db)
+	if err != nil {
+		return ciReport{}, err
+	}
+
+	end := report.anchors.end
+	if !report.anchors.hasEnd && len(history) > 0 {
+		end = time.Unix(0, history[len(history)-1].Timestamp)
+	}
+	cutoff := end.Add(-window)
+
+	byPath := make(map[string]*ciFileChange)
+	for _, meta := range history {
+		at := time.Unix(0, meta.Timestamp)
+		change, ok := byPath[meta.Path]
+		if !ok {
+			change = &ciFileChange{path: meta.Path}
+			byPath[meta.Path] = change
+		}
+		change.writes++
+		change.size = meta.Size
+		change.last = at
+
+		if !at.Before(cutoff) {
+			report.recent = append(report.recent, ciEvent{at: at, op: meta.Op, label: meta.Path, size: meta.Size})
+		}
+	}
+	for name, at := range markers {
+		if !at.Before(cutoff) && !at.After(end) {
+			report.recent = append(report.recent, ciEvent{at: at, op: "mark", label: name})
+		}
+	}
+
+	for _, change := range byPath {
+		report.changes = append(report.changes, *change)
+	}
+	sort.Slice(report.changes, func(i, j int) bool { return report.changes[i].last.After(report.changes[j].last) })
+	sort.Slice(report.recent, func(i, j int) bool { return report.recent[i].at.Before(report.recent[j].at) })
+	return report, nil
+}
+
+// ciExport writes the point-in-time export and optionally uploads it,
+// returning a line for the job summary.
+func ciExport(opts ciGitHubOptions, anchors sessionAnchors) (string, error) {
+	at := opts.exportTime
+	if at == "" {
+		switch {
+		case anchors.hasEnd && anchors.exitCode != 0:
+			at = "failure"
+		case anchors.hasEnd:
+			at = "end"
+		default:
+			at = "latest"
+		}
+	}
+
+	dir := opts.exportDir
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "diffkeeper-ci-")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(tmp)
+		dir = filepath.Join(tmp, "export")
+	}
+
+	if err := runExport(exportOptions{stateDir: opts.stateDir, outDir: dir, atTime: at, format: exportFormatDir}); err != nil {
+		return "", fmt.Errorf("export at %s: %w", at, err)
+	}
+	note := fmt.Sprintf("Exported the state at `%s` to `%s`.", at, dir)
+
+	if !opts.upload {
+		return note, nil
+	}
+	client, err := ghactions.NewArtifactClientFromEnv()
+	if errors.Is(err, ghactions.ErrNoRuntimeToken) {
+		log.Printf("[ci] skipping artifact upload: %v; upload %s with actions/upload-artifact instead", err, dir)
+		return note, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	id, err := client.UploadDir(opts.artifactName, dir)
+	if err != nil {
+		return "", fmt.Errorf("upload artifact: %w", err)
+	}
+	return fmt.Sprintf("Uploaded the state at `%s` as artifact `%s` (id %s).", at, opts.artifactName, id), nil
+}
+
+func renderCISummary(report ciReport, window time.Duration, exportNote string) string {
+	var b strings.Builder
+	anchors := report.anchors
+	offset := func(t time.Time) string {
+		d := t.Sub(anchors.start)
+		if anchors.start.IsZero() || d < 0 {
+			d = 0
+		}
+		return fmt.Sprintf("+%02dm:%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	}
+
+	b.WriteString("## DiffKeeper flight record\n\n")
+	switch {
+	case !anchors.hasEnd:
+		b.WriteString("The recording has no exit status (still running or interrupted).\n\n")
+	case anchors.termination != nil && anchors.termination.Signal != "":
+		how := "by " + anchors.termination.Signal
+		if anchors.termination.OOMKilled {
+			how += " from the OOM killer"
+		}
+		fmt.Fprintf(&b, "The recorded command was **killed** %s after %s.\n\n", how, anchors.end.Sub(anchors.start).Round(time.Millisecond))
+	case anchors.exitCode != 0:
+		fmt.Fprintf(&b, "The recorded command **failed** with exit code %d after %s.\n\n", anchors.exitCode, anchors.end.Sub(anchors.start).Round(time.Millisecond))
+	default:
+		fmt.Fprintf(&b, "The recorded command succeeded after %s.\n\n", anchors.end.Sub(anchors.start).Round(time.Millisecond))
+	}
+	if term := anchors.termination; term != nil && term.OOMKilled {
+		if term.Signal == "" {
+			b.WriteString("The OOM killer killed a process under the command during the run.\n\n")
+		}
+		if term.KernelLog != "" {
+			fmt.Fprintf(&b, "<details><summary>Kernel log</summary>\n\n```\n%s\n```\n\n</details>\n\n", term.KernelLog)
+		}
+	}
+	if anchors.recorderError != "" {
+		fmt.Fprintf(&b, "DiffKeeper failed to record part of the run, so this record may be incomplete: %s\n\n", anchors.recorderError)
+	}
+
+	if len(report.changes) == 0 {
+		b.WriteString("No file writes were recorded.\n\n")
+	} else {
+		b.WriteString("| File | Writes | Last size | Last write |\n|---|---:|---:|---|\n")
+		for i, change := range report.changes {
+			if i == maxSummaryFiles {
+				fmt.Fprintf(&b, "\n…and %d more files.\n", len(report.changes)-maxSummaryFiles)
+				break
+			}
+			fmt.Fprintf(&b, "| `%s` | %d | %s | %s |\n", ghactions.EscapeMarkdownCell(change.path), change.writes, formatSize(change.size), offset(change.last))
+		}
+		b.WriteString("\n")
+	}
+
+	if len(report.recent) > 0 {
+		fmt.Fprintf(&b, "### Last %s before exit\n\n", window)
+		for _, e := range report.recent {
+			if e.op == "mark" {
+				fmt.Fprintf(&b, "- `%s` MARK **%s**\n", offset(e.at), ghactions.EscapeMarkdownCell(e.label))
+				continue
+			}
+			fmt.Fprintf(&b, "- `%s` %s `%s` (%s)\n", offset(e.at), strings.ToUpper(e.op), ghactions.EscapeMarkdownCell(e.label), formatSize(e.size))
+		}
+		b.WriteString("\n")
+	}
+
+	if exportNote != "" {
+		b.WriteString(exportNote + "\n")
+	}
+	return b.String()
+}
+
+// writeCIAnnotations warns about files written shortly before a failure.
+func writeCIAnnotations(w io.Writer, report ciReport) error {
+	seen := make(map[string]bool)
+	var count int
+	for i := len(report.recent) - 1; i >= 0 && count < maxAnnotations; i-- {
+		e := report.recent[i]
+		if e.op == "mark" || seen[e.label] {
+			continue
+		}
+		seen[e.label] = true
+		count++
+
+		before := report.anchors.end.Sub(e.at).Round(time.Millisecond)
+		a := ghactions.Annotation{
+			Level:   ghactions.LevelWarning,
+			Title:   "DiffKeeper: changed before failure",
+			Message: fmt.Sprintf("%s was written %s before the command exited with code %d", e.label, before, report.anchors.exitCode),
+		}
+		if rel, ok := ghactions.WorkspacePath(e.label); ok {
+			a.File = rel
+		}
+		if err := ghactions.WriteAnnotation(w, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
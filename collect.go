@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/internal/metrics"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/ingest"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/remote"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// collectStopTimeout bounds how long a stopping collector waits for agents
+// to finish their streams.
+const collectStopTimeout = 10 * time.Second
+
+// collectOptions carries the resolved settings of the collect command.
+type collectOptions struct {
+	stateDir             string
+	listen               string
+	cfg                  *config.DiffConfig
+	accessFile           string
+	tlsCert, tlsKey      string
+	clientCA             string
+	allowUnauthenticated bool
+	force                bool
+}
+
+func newCollectCmd() *cobra.Command {
+	var opts collectOptions
+	var configPath string
+
+	cmd := &cobra.Command{
+		Use:   "collect --state-dir <dir> --listen <addr>",
+		Short: "Record journal entries streamed by agents on other machines",
+		Long: `Record journal entries streamed by agents on other machines.
+
+The collector owns the state dir: agents (` + "`diffkeeper agent`" + `) watch their
+runner's files and stream every capture over gRPC, and the collector stores
+them as record would. Runners keep nothing local, so they can be ephemeral.
+Each agent records into its own namespace, which it names when it connects;
+the collector rejects entries outside it.
+
+Agents must present credentials with the write scope from --access-file, in
+the format serve uses. A credential followed by "ns:<namespace>[,...]" may
+only record into those namespaces. --tls-cert, --tls-key and --client-ca
+work as for serve. Without --access-file only loopback addresses may be served, unless
+--allow-unauthenticated is given. Storage settings come from --config and
+DIFFKEEPER_* variables. Stop the collector with Ctrl-C or SIGTERM.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			var err error
+			if configPath != "" {
+				if opts.cfg, _, err = config.Load(configPath, "", nil); err != nil {
+					return err
+				}
+			} else {
+				opts.cfg = config.LoadFromEnv()
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return runCollect(ctx, opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&opts.listen, "listen", "127.0.0.1:7071", "Address to accept agent streams on")
+	cmd.Flags().StringVar(&configPath, "config", "", "Config file (YAML or TOML) with storage settings")
+	cmd.Flags().StringVar(&opts.accessFile, "access-file", "", "File of credentials and their scopes; agents need write")
+	cmd.Flags().StringVar(&opts.tlsCert, "tls-cert", "", "Serve TLS with this certificate (PEM)")
+	cmd.Flags().StringVar(&opts.tlsKey, "tls-key", "", "Private key (PEM) of --tls-cert")
+	cmd.Flags().StringVar(&opts.clientCA, "client-ca", "", "CA certificates (PEM) that sign accepted client certificates")
+	cmd.Flags().BoolVar(&opts.allowUnauthenticated, "allow-unauthenticated", false, "Serve a non-loopback address without --access-file")
+	cmd.Flags().BoolVar(&opts.force, "force", false, "Take over the state dir lock if its previous owner is no longer running")
+	return cmd
+}
+
+// runCollect journals agent streams until ctx is done.
+func runCollect(ctx context.Context, opts collectOptions) error {
+	cfg := opts.cfg
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	var access *remote.Access
+	if opts.accessFile != "" {
+		var err error
+		if access, err = remote.LoadAccess(opts.accessFile); err != nil {
+			return err
+		}
+		if access.NeedsClientCerts() && opts.clientCA == "" {
+			return fmt.Errorf("access file lists client certificates; --client-ca is required")
+		}
+	} else if !opts.allowUnauthenticated && !isLoopbackAddr(opts.listen) {
+		return fmt.Errorf("refusing to serve %s without --access-file (pass --allow-unauthenticated to override)", opts.listen)
+	}
+	if (opts.tlsCert == "") != (opts.tlsKey == "") {
+		return fmt.Errorf("--tls-cert and --tls-key must be given together")
+	}
+	if opts.clientCA != "" && opts.tlsCert == "" {
+		return fmt.Errorf("--client-ca requires --tls-cert and --tls-key")
+	}
+	serverOpts := []grpc.ServerOption{ingest.ServerCodec()}
+	if opts.tlsCert != "" {
+		tlsCfg, err := remote.ServerTLS(opts.tlsCert, opts.tlsKey, opts.clientCA)
+		if err != nil {
+			return err
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+
+	if err := os.MkdirAll(opts.stateDir, 0o755); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	lock, err := statelock.Acquire(opts.stateDir, "collect", opts.force)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	db, err := pebble.Open(opts.stateDir, &pebble.Options{})
+	if err != nil {
+		return fmt.Errorf("open pebble: %w", err)
+	}
+	defer db.Close()
+
+	casStore, err := cas.NewCASStore(db, cfg.HashAlgo)
+	if err != nil {
+		return fmt.Errorf("init CAS: %w", err)
+	}
+	if err := recoverOnOpen(db, casStore); err != nil {
+		return err
+	}
+	if _, err := casStore.EnableExistenceCache(); err != nil {
+		return fmt.Errorf("load CAS index: %w", err)
+	}
+
+	// Agents capture by their own policies; their content is stored by
+	// the collector's.
+	policies, err := newCapturePolicies(cfg.Policies)
+	if err != nil {
+		return err
+	}
+
+	journal := recorder.NewJournal(db)
+	procOpts := recorder.DefaultProcessorOptions()
+	procOpts.Workers = cfg.ProcessorWorkers
+	if policies != nil {
+		procOpts.Storage = policies.Storage
+	}
+	recorder.ApplyDurability(cfg.Durability, journal, casStore, &procOpts)
+	if cfg.Durability != config.DurabilityStrict {
+		journal.SetBatchWindow(recorder.DefaultBatchWindow)
+		defer journal.Flush()
+	}
+	stopProcessor := recorder.StartProcessorWithOptions(db, casStore, procOpts)
+	defer stopProcessor()
+	if cfg.Durability != config.DurabilityStrict {
+		stopSyncer := recorder.StartSyncer(db, cfg.SyncInterval)
+		defer stopSyncer()
+	}
+	stopTier, err := startTier(db, casStore, cfg)
+	if err != nil {
+		return err
+	}
+	defer stopTier()
+	stopReplication, err := startReplication(db, cfg)
+	if err != nil {
+		return err
+	}
+	defer stopReplication()
+	recordSessionStart(db, time.Now())
+
+	if cfg.MetricsAddr != "" {
+		go func() {
+			if err := metrics.Serve(ctx, cfg.MetricsAddr, log.Default(), nil); err != nil {
+				log.Printf("[collect] metrics endpoint stopped: %v", err)
+			}
+		}()
+	}
+
+	// Readers and backups of the live store get checkpoints.
+	ctrl, err := startControlServer(ctx, db, opts.stateDir)
+	if err != nil {
+		log.Printf("[collect] control socket unavailable, live reads and backups disabled: %v", err)
+	} else {
+		defer ctrl.Close()
+		snapshots := newSnapshotter(db, opts.stateDir)
+		defer snapshots.Close()
+		snapshots.register(ctrl)
+	}
+
+	lis, err := net.Listen("tcp", opts.listen)
+	if err != nil {
+		return err
+	}
+	server := ingest.NewServer(journal)
+	if access != nil {
+		server.RequireAccess(access)
+	}
+	g := grpc.NewServer(serverOpts...)
+	server.Register(g)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- g.Serve(lis) }()
+	log.Printf("[collect] collecting into %s on %s (tls=%t, auth=%t)", opts.stateDir, lis.Addr(), opts.tlsCert != "", access != nil)
+
+	select {
+	case <-ctx.Done():
+	case err = <-serveErr:
+	}
+	log.Printf("[collect] shutting down")
+	stopped := make(chan struct{})
+	go func() {
+		g.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(collectStopTimeout):
+		// Agents resend what was not acknowledged to the next collector.
+		g.Stop()
+	}
+	_, entries := server.Stats()
+	log.Printf("[collect] journaled %d entries from agents", entries)
+
+	if flushErr := journal.Flush(); flushErr != nil {
+		log.Printf("[collect] %v", flushErr)
+	}
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), journalDrainTimeout)
+	defer drainCancel()
+	if drainErr := recorder.WaitIdle(drainCtx, db); drainErr != nil {
+		log.Printf("[collect] journal not fully processed at exit: %v", drainErr)
+	}
+	recordSessionEnd(db, time.Now(), 0)
+	stopReplication()
+	stopTier()
+	if err != nil {
+		return err
+	}
+	return db.Flush()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/control"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+	"github.com/spf13/cobra"
+)
+
+const (
+	opCompact = "compact"
+
+	// compactCallTimeout bounds how long compact-store waits for a
+	// recorder to compact its store.
+	compactCallTimeout = time.Hour
+)
+
+// compactKeyspaces are compacted in turn. The journal comes first: every
+// processed capture leaves a tombstone behind in it.
+var compactKeyspaces = []string{cas.PrefixLog, cas.PrefixCAS, cas.PrefixPack, cas.PrefixMeta, cas.PrefixDir, cas.PrefixState}
+
+// compactStore rewrites every keyspace of db, dropping deleted keys and
+// the space they hold. progress, if any, counts the keyspaces compacted.
+func compactStore(db *pebble.DB, progress *progressReporter) error {
+	progress.Start("compact", "keyspaces", len(compactKeyspaces), 0)
+	for _, prefix := range compactKeyspaces {
+		if err := db.Compact([]byte(prefix), []byte(prefix+"\xff"), true); err != nil {
+			return fmt.Errorf("compact %s: %w", prefix, err)
+		}
+		progress.Advance(1, 0)
+	}
+	progress.Finish()
+	return nil
+}
+
+// compactOptions carries the flags accepted by the compact-store command.
+type compactOptions struct {
+	stateDir string
+	jsonOut  bool
+	force    bool
+	// progress reports the compaction when compact-store runs it itself.
+	progress *progressReporter
+}
+
+func newCompactStoreCmd() *cobra.Command {
+	var opts compactOptions
+	var progressMode string
+
+	cmd := &cobra.Command{
+		Use:   "compact-store --state-dir <dir>",
+		Short: "Reclaim the disk space of pruned history",
+		Long: `Reclaim the disk space of pruned history.
+
+Retention, pack and the journal delete keys by writing tombstones; the space
+they held is only freed once Pebble happens to compact the files holding
+them. compact-store compacts every keyspace right away and reports the store
+size before and after. When record, daemon or collect holds the state dir,
+it compacts its store without stopping.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			var err error
+			if opts.progress, err = newProgress(cmd.ErrOrStderr(), progressMode); err != nil {
+				return err
+			}
+			return runCompactStore(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().BoolVar(&opts.jsonOut, "json", false, "Print JSON instead of a summary")
+	cmd.Flags().BoolVar(&opts.force, "force", false, "Take over the state dir lock if its previous owner is no longer running")
+	addProgressFlag(cmd, &progressMode)
+	return cmd
+}
+
+// compactReport is what compact-store prints.
+type compactReport struct {
+	Before    storeFileStats `json:"before"`
+	After     storeFileStats `json:"after"`
+	Reclaimed int64          `json:"reclaimed_bytes"`
+	Seconds   float64        `json:"seconds"`
+	Live      bool           `json:"live"`
+}
+
+func runCompactStore(w io.Writer, opts compactOptions) error {
+	if _, err := os.Stat(opts.stateDir); err != nil {
+		return fmt.Errorf("open state dir: %w", err)
+	}
+	var report compactReport
+	var err error
+	if report.Before, err = loadStoreFileStats(opts.stateDir); err != nil {
+		return err
+	}
+
+	started := time.Now()
+	lock, err := statelock.Acquire(opts.stateDir, "compact-store", opts.force)
+	var locked *statelock.LockedError
+	switch {
+	case errors.As(err, &locked):
+		if _, callErr := control.CallTimeout(control.SocketPath(opts.stateDir), control.Request{Op: opCompact}, compactCallTimeout); callErr != nil {
+			return fmt.Errorf("%w; asking it to compact failed: %v", err, callErr)
+		}
+		report.Live = true
+	case err != nil:
+		return err
+	default:
+		err = compactIdle(opts.stateDir, opts.progress)
+		lock.Release()
+		if err != nil {
+			return err
+		}
+	}
+	took := time.Since(started)
+	report.Seconds = took.Seconds()
+
+	if report.After, err = loadStoreFileStats(opts.stateDir); err != nil {
+		return err
+	}
+	report.Reclaimed = report.Before.TotalBytes - report.After.TotalBytes
+
+	if opts.jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	fmt.Fprintf(w, "Store files: %s -> %s (%d -> %d tables)\n",
+		formatSize(int(report.Before.TotalBytes)), formatSize(int(report.After.TotalBytes)), report.Before.Tables, report.After.Tables)
+	if report.Reclaimed > 0 {
+		fmt.Fprintf(w, "Reclaimed:   %s in %s\n", formatSize(int(report.Reclaimed)), took.Round(time.Millisecond))
+	} else {
+		fmt.Fprintf(w, "Reclaimed:   nothing in %s\n", took.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// compactIdle compacts a state dir nobody is recording. Closing the store
+// deletes the files the compaction made obsolete.
+func compactIdle(stateDir string, progress *progressReporter) error {
+	db, err := pebble.Open(stateDir, &pebble.Options{ErrorIfNotExists: true})
+	if err != nil {
+		return fmt.Errorf("open pebble: %w", err)
+	}
+	if err := compactStore(db, progress); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
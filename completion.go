@@ -0,0 +1,96 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// flagValues lists the values of flags that mean the same on every command
+// they appear on, for shell completion and the schema.
+var flagValues = map[string][]string{
+	"output":          {outputText, outputJSON},
+	"hash-algo":       {"sha256", "blake3"},
+	"capture-backend": {"auto", "fentry", "kprobe"},
+	"durability":      {config.DurabilityStrict, config.DurabilityBatched, config.DurabilityRelaxed},
+	"watch-backend":   {config.WatchBackendInotify, config.WatchBackendPoll},
+	"watch-fallback":  {config.WatchFallbackPoll, "ebpf", config.WatchFallbackError},
+}
+
+// Flags completed with directories or files of the given extensions,
+// whatever the command.
+var (
+	dirFlags  = []string{"state-dir", "watch", "dir"}
+	fileFlags = map[string][]string{
+		"config":   {"yaml", "yml", "toml"},
+		"sign-key": {"pem"},
+		"key":      {"pem"},
+	}
+)
+
+// registerCompletions sets up the shell completion of the flags of cmd and
+// every command under it: flagValues, dirFlags, fileFlags, and points in
+// time for --time. Flags specific to one command register their values
+// with completeValues where they are defined.
+func registerCompletions(cmd *cobra.Command) {
+	cmd.LocalFlags().VisitAll(func(f *pflag.Flag) {
+		if _, ok := cmd.GetFlagCompletionFunc(f.Name); ok {
+			return
+		}
+		switch {
+		case flagValues[f.Name] != nil:
+			completeValues(cmd, f.Name, flagValues[f.Name]...)
+		case f.Name == "time":
+			_ = cmd.RegisterFlagCompletionFunc(f.Name, completeTime)
+		case slices.Contains(dirFlags, f.Name):
+			_ = cmd.MarkFlagDirname(f.Name)
+		case fileFlags[f.Name] != nil:
+			_ = cmd.MarkFlagFilename(f.Name, fileFlags[f.Name]...)
+		}
+	})
+	for _, sub := range cmd.Commands() {
+		registerCompletions(sub)
+	}
+}
+
+// annotationFlagValues lists, on a flag, the values it accepts.
+const annotationFlagValues = "diffkeeper.values"
+
+// completeValues completes flag of cmd with values, the only ones it
+// accepts, and lists them in the schema.
+func completeValues(cmd *cobra.Command, flag string, values ...string) {
+	_ = cmd.Flags().SetAnnotation(flag, annotationFlagValues, values)
+	_ = cmd.RegisterFlagCompletionFunc(flag, cobra.FixedCompletions(values, cobra.ShellCompDirectiveNoFileComp))
+}
+
+// completeTime completes a point in time: the anchors, and the markers of
+// the state dir given with --state-dir, if it can be opened.
+func completeTime(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	values := []string{"latest", "start", "end", "failure"}
+	if f := cmd.Flags().Lookup("state-dir"); f != nil && f.Value.String() != "" {
+		// Completion must not disturb a running recorder, so a state dir
+		// in use is not snapshotted: its markers are just not offered.
+		if db, err := pebble.Open(f.Value.String(), &pebble.Options{ReadOnly: true, ErrorIfNotExists: true}); err == nil {
+			markers, _ := loadMarkers(db)
+			db.Close()
+			names := make([]string, 0, len(markers))
+			for name := range markers {
+				names = append(names, "event:"+name)
+			}
+			sort.Strings(names)
+			values = append(values, names...)
+		}
+	}
+	var matches []string
+	for _, v := range values {
+		if strings.HasPrefix(v, toComplete) {
+			matches = append(matches, v)
+		}
+	}
+	return matches, cobra.ShellCompDirectiveNoFileComp
+}
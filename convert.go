@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/chunk"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/diff"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+	"github.com/spf13/cobra"
+	"go.etcd.io/bbolt"
+)
+
+// Buckets of the bbolt stores written by DiffKeeper v1.
+const (
+	boltBucketDeltas     = "deltas"      // gzip'd full files (schema 1)
+	boltBucketMetadata   = "meta"        // boltFileMetadata per path (schema 2)
+	boltBucketChunkIndex = "chunk_index" // chunk manifests per path
+	boltBucketCAS        = "cas"         // snapshots, bsdiff patches and chunks
+	boltSchemaVersionKey = "schema_version"
+)
+
+// boltFileMetadata is the part of a v1 metadata record needed to rebuild
+// the file. CIDs hold the snapshot, the bsdiff patches applied on top of
+// BaseSnapshotCID, or the chunks of a chunked file.
+type boltFileMetadata struct {
+	CIDs            []string        `json:"cids"`
+	IsChunked       bool            `json:"is_chunked"`
+	ChunkManifest   *chunk.Manifest `json:"chunk_manifest,omitempty"`
+	IsSnapshot      bool            `json:"is_snapshot"`
+	BaseSnapshotCID string          `json:"base_snapshot_cid"`
+	Timestamp       time.Time       `json:"timestamp"`
+}
+
+// convertOptions carries the flags accepted by the convert command.
+type convertOptions struct {
+	from      string
+	to        string
+	namespace string
+	jsonOut   bool
+	force     bool
+	progress  *progressReporter
+}
+
+// convertReport summarizes a conversion.
+type convertReport struct {
+	Files     int      `json:"files"`
+	Snapshots int      `json:"snapshots"`
+	Diffs     int      `json:"diffs"`
+	Chunked   int      `json:"chunked"`
+	Legacy    int      `json:"legacy"`
+	Skipped   []string `json:"skipped,omitempty"`
+}
+
+func newConvertCmd() *cobra.Command {
+	var opts convertOptions
+	var progressMode string
+
+	cmd := &cobra.Command{
+		Use:   "convert --from <bolt.db> --to <state-dir>",
+		Short: "Import a DiffKeeper v1 bbolt store into a state dir",
+		Long: `Import a DiffKeeper v1 bbolt store into a state dir.
+
+v1 kept the latest content of every file in a bbolt database: full gzip'd
+files, CAS snapshots, bsdiff patch chains on top of a base snapshot, or chunk
+manifests. convert rebuilds each file from them and records it as one version
+at its v1 capture time, stored through the usual chunking and dedup. Files
+that cannot be rebuilt are reported and skipped. The bolt store is opened
+read-only and left as it is; the state dir is created if needed.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.from == "" || opts.to == "" {
+				return fmt.Errorf("--from and --to are required")
+			}
+			if err := config.ValidateNamespace(opts.namespace); err != nil {
+				return err
+			}
+			var err error
+			if opts.progress, err = newProgress(cmd.ErrOrStderr(), progressMode); err != nil {
+				return err
+			}
+			return runConvert(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.from, "from", "", "bbolt store written by DiffKeeper v1 (--store)")
+	cmd.Flags().StringVar(&opts.to, "to", "", "State dir to import into")
+	cmd.Flags().StringVar(&opts.namespace, "namespace", "", "Namespace to record the imported files into")
+	cmd.Flags().BoolVar(&opts.jsonOut, "json", false, "Print JSON instead of a summary")
+	cmd.Flags().BoolVar(&opts.force, "force", false, "Take over the state dir lock if its previous owner is no longer running")
+	addProgressFlag(cmd, &progressMode)
+	return cmd
+}
+
+func runConvert(w io.Writer, opts convertOptions) error {
+	cfg, err := loadEnvConfig(nil)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(opts.from)
+	if err != nil {
+		return fmt.Errorf("open bolt store: %w", err)
+	}
+	bolt, err := bbolt.Open(opts.from, 0o600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("open bolt store: %w", err)
+	}
+	defer bolt.Close()
+
+	if err := os.MkdirAll(opts.to, 0o755); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	lock, err := statelock.Acquire(opts.to, "convert", opts.force)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	db, err := pebble.Open(opts.to, &pebble.Options{})
+	if err != nil {
+		return fmt.Errorf("open pebble: %w", err)
+	}
+	defer db.Close()
+
+	casStore, err := cas.NewCASStore(db, cfg.HashAlgo)
+	if err != nil {
+		return fmt.Errorf("init CAS: %w", err)
+	}
+	if err := recoverOnOpen(db, casStore); err != nil {
+		return err
+	}
+
+	journal := recorder.NewJournal(db)
+	journal.SetNamespace(opts.namespace)
+	procOpts := recorder.DefaultProcessorOptions()
+	procOpts.Workers = cfg.ProcessorWorkers
+	stopProcessor := recorder.StartProcessorWithOptions(db, casStore, procOpts)
+	defer stopProcessor()
+
+	// Schema 1 stores have no capture times; the store's mtime is the
+	// latest any of their files can have.
+	report, err := convertBolt(bolt, info.ModTime(), journal.LogEventAt, opts.progress)
+	if err != nil {
+		return err
+	}
+
+	if err := recorder.WaitIdle(context.Background(), db); err != nil {
+		return fmt.Errorf("wait for processor: %w", err)
+	}
+	stopProcessor()
+	if err := db.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	recordAudit(opts.to, auditConvert, map[string]any{"from": opts.from, "namespace": opts.namespace, "files": report.Files, "skipped": len(report.Skipped)})
+
+	if opts.jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	writeConvertReport(w, report)
+	return nil
+}
+
+// convertBolt rebuilds every file of a v1 store and hands it to logAt.
+// Metadata records win over the schema 1 full files v1 left behind after
+// migrating a store to binary diffs. progress, if any, counts the keys of
+// both read, as files, and the bytes rebuilt.
+func convertBolt(bolt *bbolt.DB, legacyTime time.Time, logAt func(path string, data []byte, at time.Time) error, progress *progressReporter) (convertReport, error) {
+	var report convertReport
+	err := bolt.View(func(tx *bbolt.Tx) error {
+		objects := tx.Bucket([]byte(boltBucketCAS))
+		manifests := tx.Bucket([]byte(boltBucketChunkIndex))
+		metas := tx.Bucket([]byte(boltBucketMetadata))
+		deltas := tx.Bucket([]byte(boltBucketDeltas))
+		converted := make(map[string]bool)
+
+		if progress != nil {
+			total := 0
+			for _, b := range []*bbolt.Bucket{metas, deltas} {
+				if b != nil {
+					total += b.Stats().KeyN
+				}
+			}
+			progress.Start("convert", "files", total, 0)
+		}
+
+		if metas != nil {
+			err := metas.ForEach(func(k, v []byte) error {
+				defer progress.Advance(1, 0)
+				rel := string(k)
+				if rel == boltSchemaVersionKey {
+					return nil
+				}
+				var meta boltFileMetadata
+				if err := json.Unmarshal(v, &meta); err != nil {
+					log.Printf("[convert] skip %s: decode metadata: %v", rel, err)
+					report.Skipped = append(report.Skipped, rel)
+					return nil
+				}
+				data, kind, err := rebuildBoltFile(objects, manifests, rel, meta)
+				if err != nil {
+					log.Printf("[convert] skip %s: %v", rel, err)
+					report.Skipped = append(report.Skipped, rel)
+					return nil
+				}
+				at := meta.Timestamp
+				if at.IsZero() {
+					at = legacyTime
+				}
+				if err := logAt(cleanBoltPath(rel), data, at); err != nil {
+					return fmt.Errorf("journal %s: %w", rel, err)
+				}
+				progress.Advance(0, int64(len(data)))
+				converted[rel] = true
+				report.Files++
+				switch kind {
+				case boltKindChunked:
+					report.Chunked++
+				case boltKindDiff:
+					report.Diffs++
+				default:
+					report.Snapshots++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if deltas == nil {
+			return nil
+		}
+		return deltas.ForEach(func(k, v []byte) error {
+			defer progress.Advance(1, 0)
+			rel := string(k)
+			if converted[rel] {
+				return nil
+			}
+			data, err := gunzip(v)
+			if err != nil {
+				log.Printf("[convert] skip %s: decompress: %v", rel, err)
+				report.Skipped = append(report.Skipped, rel)
+				return nil
+			}
+			if err := logAt(cleanBoltPath(rel), data, legacyTime); err != nil {
+				return fmt.Errorf("journal %s: %w", rel, err)
+			}
+			progress.Advance(0, int64(len(data)))
+			report.Files++
+			report.Legacy++
+			return nil
+		})
+	})
+	if err != nil {
+		return report, fmt.Errorf("read bolt store: %w", err)
+	}
+	progress.Finish()
+	return report, nil
+}
+
+// How a v1 metadata record stores its file.
+const (
+	boltKindSnapshot = "snapshot"
+	boltKindDiff     = "diff"
+	boltKindChunked  = "chunked"
+)
+
+// rebuildBoltFile reconstructs rel's content the way v1's RedShift did.
+func rebuildBoltFile(objects, manifests *bbolt.Bucket, rel string, meta boltFileMetadata) ([]byte, string, error) {
+	if objects == nil {
+		return nil, "", fmt.Errorf("store has no %s bucket", boltBucketCAS)
+	}
+
+	if meta.IsChunked {
+		manifest := meta.ChunkManifest
+		if manifest == nil && manifests != nil {
+			if raw := manifests.Get([]byte(rel)); raw != nil {
+				manifest = &chunk.Manifest{}
+				if err := json.Unmarshal(raw, manifest); err != nil {
+					return nil, "", fmt.Errorf("decode chunk manifest: %w", err)
+				}
+			}
+		}
+		if manifest == nil {
+			return nil, "", fmt.Errorf("chunk manifest missing")
+		}
+		var data []byte
+		for i, ref := range manifest.Chunks {
+			part, err := boltObject(objects, hex.EncodeToString(ref.Hash[:]))
+			if err != nil {
+				return nil, "", fmt.Errorf("chunk %d: %w", i, err)
+			}
+			if len(part) != int(ref.Length) || ref.Offset != uint64(len(data)) {
+				return nil, "", fmt.Errorf("chunk %d is %d bytes at %d, manifest says %d at %d", i, len(part), len(data), ref.Length, ref.Offset)
+			}
+			data = append(data, part...)
+		}
+		return data, boltKindChunked, nil
+	}
+
+	if meta.IsSnapshot {
+		if len(meta.CIDs) == 0 {
+			return nil, "", fmt.Errorf("snapshot has no CIDs")
+		}
+		data, err := boltObject(objects, meta.CIDs[0])
+		return data, boltKindSnapshot, err
+	}
+
+	if meta.BaseSnapshotCID == "" {
+		return nil, "", fmt.Errorf("diff has no base snapshot")
+	}
+	data, err := boltObject(objects, meta.BaseSnapshotCID)
+	if err != nil {
+		return nil, "", fmt.Errorf("base snapshot: %w", err)
+	}
+	engine := diff.NewBsdiffEngine()
+	for i, cid := range meta.CIDs {
+		patch, err := boltObject(objects, cid)
+		if err != nil {
+			return nil, "", fmt.Errorf("patch %d: %w", i, err)
+		}
+		if data, err = engine.ApplyPatch(data, patch); err != nil {
+			return nil, "", fmt.Errorf("apply patch %d: %w", i, err)
+		}
+	}
+	return data, boltKindDiff, nil
+}
+
+// boltObject reads one object of a v1 CAS bucket.
+func boltObject(objects *bbolt.Bucket, cid string) ([]byte, error) {
+	val := objects.Get([]byte(cid))
+	if val == nil {
+		return nil, fmt.Errorf("CAS object %s is missing", cid)
+	}
+	return cas.DecodeObject(val)
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return io.ReadAll(gr)
+}
+
+// cleanBoltPath turns a v1 path, relative to the watched state dir and
+// with the separators of the OS that recorded it, into a recorded path.
+func cleanBoltPath(p string) string {
+	return path.Clean(strings.ReplaceAll(p, `\`, "/"))
+}
+
+func writeConvertReport(w io.Writer, report convertReport) {
+	fmt.Fprintf(w, "Imported %d files (%d snapshots, %d diff chains, %d chunked, %d schema 1)\n",
+		report.Files, report.Snapshots, report.Diffs, report.Chunked, report.Legacy)
+	if len(report.Skipped) > 0 {
+		fmt.Fprintf(w, "Skipped %d files that could not be rebuilt:\n", len(report.Skipped))
+		for _, p := range report.Skipped {
+			fmt.Fprintf(w, "  %s\n", p)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/testreport"
+	"github.com/spf13/cobra"
+)
+
+// correlateOptions carries the flags accepted by the correlate command.
+type correlateOptions struct {
+	stateDir string
+	report   string
+	all      bool
+	jsonOut  bool
+	timezone string
+}
+
+func newCorrelateCmd() *cobra.Command {
+	var opts correlateOptions
+
+	cmd := &cobra.Command{
+		Use:   "correlate --state-dir <dir> --report <file>",
+		Short: "List the files each failing test modified while it ran",
+		Long: `List the files each failing test modified while it ran.
+
+--report accepts JUnit XML or "go test -json" output ("-" reads stdin). JUnit
+only records suite start times and case durations, so cases are assumed to run
+sequentially; go test -json provides exact start and end times.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			if opts.report == "" {
+				return fmt.Errorf("report is required")
+			}
+			return runCorrelate(cmd.InOrStdin(), cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&opts.report, "report", "", "JUnit XML or go test -json report ('-' for stdin)")
+	cmd.Flags().BoolVar(&opts.all, "all", false, "Include passing and skipped tests")
+	cmd.Flags().BoolVar(&opts.jsonOut, "json", false, "Print JSON instead of a table")
+	cmd.Flags().StringVar(&opts.timezone, "report-tz", "Local", "Time zone for JUnit timestamps that carry none (e.g. UTC)")
+	return cmd
+}
+
+// testFileChange summarizes one path's writes within a test window.
+type testFileChange struct {
+	Path      string    `json:"path"`
+	Writes    int       `json:"writes"`
+	Size      int       `json:"size"`
+	LastWrite time.Time `json:"last_write"`
+}
+
+// testCorrelation is one test with the files changed while it ran.
+type testCorrelation struct {
+	testreport.TestCase
+	Files []testFileChange `json:"files"`
+}
+
+func runCorrelate(stdin io.Reader, w io.Writer, opts correlateOptions) error {
+	loc, err := time.LoadLocation(opts.timezone)
+	if err != nil {
+		return fmt.Errorf("invalid --report-tz: %w", err)
+	}
+
+	r := stdin
+	if opts.report != "-" {
+		f, err := os.Open(opts.report)
+		if err != nil {
+			return fmt.Errorf("open report: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	cases, err := testreport.Parse(r, loc)
+	if err != nil {
+		return err
+	}
+
+	db, _, err := openReadOnlyStore(opts.stateDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	sessionStart := loadSessionStart(db)
+	history, err := loadMetadataHistory(db, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var results []testCorrelation
+	for _, tc := range cases {
+		if !opts.all && !tc.Failed() {
+			continue
+		}
+		results = append(results, testCorrelation{TestCase: tc, Files: filesChangedBetween(history, tc.Start, tc.End)})
+	}
+
+	if opts.jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if results == nil {
+			results = []testCorrelation{}
+		}
+		return enc.Encode(results)
+	}
+	return writeCorrelationTable(w, results, sessionStart)
+}
+
+// filesChangedBetween aggregates writes in history (sorted by time) made
+// within [start, end].
+func filesChangedBetween(history []recorder.MetadataRecord, start, end time.Time) []testFileChange {
+	lo := sort.Search(len(history), func(i int) bool { return history[i].Timestamp >= start.UnixNano() })
+
+	byPath := make(map[string]*testFileChange)
+	var order []string
+	for _, meta := range history[lo:] {
+		if meta.Timestamp > end.UnixNano() {
+			break
+		}
+		change, ok := byPath[meta.Path]
+		if !ok {
+			change = &testFileChange{Path: meta.Path}
+			byPath[meta.Path] = change
+			order = append(order, meta.Path)
+		}
+		change.Writes++
+		change.Size = meta.Size
+		change.LastWrite = time.Unix(0, meta.Timestamp)
+	}
+
+	files := make([]testFileChange, 0, len(order))
+	for _, path := range order {
+		files = append(files, *byPath[path])
+	}
+	return files
+}
+
+func writeCorrelationTable(w io.Writer, results []testCorrelation, sessionStart time.Time) error {
+	if len(results) == 0 {
+		_, err := fmt.Fprintln(w, "No failing tests in report.")
+		return err
+	}
+
+	offset := func(t time.Time) string {
+		d := t.Sub(sessionStart)
+		if sessionStart.IsZero() {
+			return t.Format(time.RFC3339)
+		}
+		sign := "+"
+		if d <= -time.Second {
+			sign, d = "-", -d
+		} else if d < 0 {
+			d = 0
+		}
+		return fmt.Sprintf("%s%02dm:%02ds", sign, int(d.Minutes()), int(d.Seconds())%60)
+	}
+
+	for _, r := range results {
+		fmt.Fprintf(w, "%-4s %s  [%s .. %s, %s]\n",
+			strings.ToUpper(r.Status), r.FullName(), offset(r.Start), offset(r.End), r.End.Sub(r.Start).Round(time.Millisecond))
+		if len(r.Files) == 0 {
+			fmt.Fprintln(w, "     (no recorded file changes)")
+			continue
+		}
+		for _, f := range r.Files {
+			fmt.Fprintf(w, "     %3d write(s)  %s (%s)  last at %s\n", f.Writes, f.Path, formatSize(f.Size), offset(f.LastWrite))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/internal/metrics"
+	"github.com/saworbit/diffkeeper/internal/version"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/control"
+	"github.com/saworbit/diffkeeper/pkg/ebpf"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/sdnotify"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+	"github.com/spf13/cobra"
+)
+
+const (
+	opAttach = "attach"
+	opDetach = "detach"
+
+	// daemonReapInterval is how often the daemon checks that the clients of
+	// attached jobs are still running.
+	daemonReapInterval = 5 * time.Second
+
+	// daemonEventBuffer is how many eBPF events a job may fall behind by
+	// before further events for it are dropped.
+	daemonEventBuffer = 256
+)
+
+func newDaemonCmd() *cobra.Command {
+	var stateDir, configPath string
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "daemon --state-dir <dir>",
+		Short: "Keep a state dir open and record jobs that attach to it",
+		Long: `Keep a state dir open and record jobs that attach to it.
+
+The daemon opens the store and, when enabled, loads the eBPF programs once, then
+waits on the state dir's control socket. Each ` + "`diffkeeper attach -- <cmd>`" + ` registers
+a job: the daemon watches the job's directory, records into its namespace, and
+stops watching when the command exits. Loading BTF and eBPF per job adds seconds
+of startup that short jobs cannot afford.
+
+Capture settings come from --config and DIFFKEEPER_* variables and apply to
+every job. Jobs whose attach process dies without detaching are detached
+within a few seconds. Stop the daemon with Ctrl-C or SIGTERM; attached jobs
+are detached and the journal is drained first.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			var cfg *config.DiffConfig
+			var err error
+			if configPath != "" {
+				if cfg, _, err = config.Load(configPath, "", nil); err != nil {
+					return recorderExit(err)
+				}
+			} else {
+				cfg = config.LoadFromEnv()
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return recorderExit(runDaemon(ctx, stateDir, cfg, force))
+		},
+	}
+
+	cmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&configPath, "config", "", "Config file (YAML or TOML) applied to every attached job")
+	cmd.Flags().BoolVar(&force, "force", false, "Take over the state dir lock if its previous owner is no longer running")
+	return cmd
+}
+
+// runDaemon serves attach and detach requests until ctx is done.
+func runDaemon(ctx context.Context, stateDir string, cfg *config.DiffConfig, force bool) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return storeFailure(fmt.Errorf("create state dir: %w", err))
+	}
+	lock, err := statelock.Acquire(stateDir, "daemon", force)
+	if err != nil {
+		return storeFailure(err)
+	}
+	defer lock.Release()
+
+	db, err := pebble.Open(stateDir, &pebble.Options{})
+	if err != nil {
+		return storeFailure(fmt.Errorf("open pebble: %w", err))
+	}
+	defer db.Close()
+
+	casStore, err := cas.NewCASStore(db, cfg.HashAlgo)
+	if err != nil {
+		return storeFailure(fmt.Errorf("init CAS: %w", err))
+	}
+	if err := recoverOnOpen(db, casStore); err != nil {
+		return storeFailure(err)
+	}
+	policies, err := newCapturePolicies(cfg.Policies)
+	if err != nil {
+		return err
+	}
+	if _, err := casStore.EnableExistenceCache(); err != nil {
+		return storeFailure(fmt.Errorf("load CAS index: %w", err))
+	}
+
+	overhead := newOverheadBudget(cfg.Overhead)
+	procOpts := recorder.DefaultProcessorOptions()
+	procOpts.Workers = cfg.ProcessorWorkers
+	if policies != nil {
+		procOpts.Storage = policies.Storage
+	}
+	if overhead != nil {
+		procOpts.Pace = overhead.Spend
+	}
+	recorder.ApplyDurability(cfg.Durability, recorder.NewJournal(db), casStore, &procOpts)
+	stopProcessor := recorder.StartProcessorWithOptions(db, casStore, procOpts)
+	defer stopProcessor()
+	if cfg.Durability != config.DurabilityStrict {
+		stopSyncer := recorder.StartSyncer(db, cfg.SyncInterval)
+		defer stopSyncer()
+	}
+	stopTier, err := startTier(db, casStore, cfg)
+	if err != nil {
+		return err
+	}
+	defer stopTier()
+	stopReplication, err := startReplication(db, cfg)
+	if err != nil {
+		return err
+	}
+	defer stopReplication()
+	recordSessionStart(db, time.Now())
+
+	health := startHealth(ctx, db, stateDir)
+	if cfg.MetricsAddr != "" {
+		go func() {
+			if err := metrics.Serve(ctx, cfg.MetricsAddr, log.Default(), health.Handlers()); err != nil {
+				log.Printf("[daemon] metrics endpoint stopped: %v", err)
+			}
+		}()
+	}
+
+	d := &daemon{
+		ctx:      ctx,
+		db:       db,
+		store:    casStore,
+		stateDir: stateDir,
+		cfg:      cfg,
+		policies: policies,
+		disk:     startDiskGuard(ctx, db, stateDir, cfg),
+		overhead: overhead,
+		jobs:     make(map[string]*daemonJob),
+	}
+
+	if cfg.EBPF.Enable {
+		mgr, err := ebpf.NewManager(stateDir, &cfg.EBPF)
+		if err != nil && !errors.Is(err, ebpf.ErrUnsupported) {
+			return fmt.Errorf("start ebpf manager: %w", err)
+		}
+		if mgr != nil {
+			d.mgr = mgr
+			go func() {
+				if err := mgr.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
+					log.Printf("[eBPF] manager stopped: %v", err)
+					watcherFaults.Report(fmt.Errorf("eBPF manager stopped: %w", err))
+				}
+			}()
+			defer mgr.Close()
+			go d.routeEvents(ctx, mgr.Events())
+		}
+	}
+	backend := ebpf.BackendFSNotify
+	if cfg.WatchBackend == config.WatchBackendPoll {
+		backend = config.WatchBackendPoll
+	}
+	if d.mgr != nil {
+		backend = d.mgr.CaptureBackend()
+	}
+	metrics.SetAgentInfo("", "", version.Version, backend)
+
+	ctrl, err := startControlServer(ctx, db, stateDir)
+	if err != nil {
+		return err
+	}
+	snapshots := newSnapshotter(db, stateDir)
+	defer snapshots.Close()
+	snapshots.register(ctrl)
+	ctrl.Handle(opAttach, d.attach)
+	ctrl.Handle(opDetach, d.detach)
+	go d.reap(ctx)
+	log.Printf("[daemon] recording into %s; attach jobs through %s", stateDir, ctrl.Path())
+	health.Started()
+	notifyService(sdnotify.Ready)
+	d.notifyJobs()
+	if interval, err := sdnotify.WatchdogInterval(); err != nil {
+		log.Printf("[daemon] systemd watchdog not pinged: %v", err)
+	} else if interval > 0 {
+		go d.pingWatchdog(ctx, interval)
+	}
+
+	<-ctx.Done()
+	log.Printf("[daemon] shutting down")
+	notifyService(sdnotify.Stopping, sdnotify.Status("draining the journal"))
+	d.detachAll()
+	ctrl.Close()
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), journalDrainTimeout)
+	defer drainCancel()
+	if err := recorder.WaitIdle(drainCtx, db); err != nil {
+		log.Printf("[daemon] journal not fully processed at exit: %v", err)
+	}
+	d.mu.Lock()
+	d.collectGarbage()
+	d.mu.Unlock()
+	return storeFailure(db.Flush())
+}
+
+// daemon records the jobs attached to one state dir.
+type daemon struct {
+	ctx      context.Context
+	db       *pebble.DB
+	store    *cas.CASStore
+	stateDir string
+	cfg      *config.DiffConfig
+	policies *capturePolicies
+	disk     *diskGuard
+	overhead *overheadBudget
+	mgr      ebpf.Manager
+
+	mu   sync.Mutex
+	jobs map[string]*daemonJob
+	seq  int
+	// collect is set when retention left unreferenced objects that were
+	// not collected yet because jobs were recording; see collectGarbage.
+	collect bool
+}
+
+// daemonJob is one attached job: a watched directory recorded into a
+// namespace.
+type daemonJob struct {
+	id        string
+	namespace string
+	root      string
+	// pid is the attach process; the job is detached when it is gone.
+	pid     int
+	journal *recorder.Journal
+	tree    *treeWatch
+	events  chan ebpf.Event
+	cancel  context.CancelFunc
+}
+
+// attachResult is returned to `diffkeeper attach`.
+type attachResult struct {
+	ID string `json:"id"`
+}
+
+func (d *daemon) attach(req control.Request) (any, error) {
+	if err := config.ValidateNamespace(req.Namespace); err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(req.Dir) {
+		return nil, fmt.Errorf("job directory must be absolute, got %q", req.Dir)
+	}
+	if info, err := os.Stat(req.Dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("job directory %s is not a directory", req.Dir)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, job := range d.jobs {
+		if job.namespace == req.Namespace {
+			return nil, fmt.Errorf("namespace %q is already attached as %s", req.Namespace, job.id)
+		}
+	}
+
+	retention := recorder.RetentionPolicy{MaxAge: d.cfg.Retention.MaxAge, MaxVersions: d.cfg.Retention.MaxVersions, Downsample: d.cfg.Retention.Downsample, Namespace: req.Namespace, DeferCollection: true}
+	if d.policies != nil {
+		retention.PathMaxVersions = d.policies.MaxVersions
+	}
+	if pruned, err := recorder.Prune(d.db, d.store, retention, time.Now()); err != nil {
+		return nil, fmt.Errorf("apply retention: %w", err)
+	} else if pruned.Versions > 0 {
+		log.Printf("[daemon] retention pruned %d versions of namespace %q", pruned.Versions, req.Namespace)
+		recordAudit(d.stateDir, auditPrune, map[string]any{"namespace": req.Namespace, "versions": pruned.Versions})
+		d.collect = true
+	}
+	d.collectGarbage()
+
+	journal := recorder.NewJournal(d.db)
+	if d.cfg.Durability == config.DurabilityStrict {
+		journal.SetSync(true)
+	} else {
+		journal.SetBatchWindow(recorder.DefaultBatchWindow)
+	}
+	journal.SetNamespace(req.Namespace)
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	quota := startQuotaGuard(ctx, d.db, journal, d.cfg)
+	tree, err := startTreeWatch(ctx, d.cfg, d.policies, journal, d.disk, quota, d.overhead, filepath.Clean(req.Dir))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	d.seq++
+	job := &daemonJob{id: fmt.Sprintf("job-%d", d.seq), namespace: req.Namespace, root: tree.root, pid: req.PID, journal: journal, tree: tree, cancel: cancel}
+	if d.mgr != nil {
+		job.events = make(chan ebpf.Event, daemonEventBuffer)
+		tree.StartFallback(ctx, job.events)
+		tree.UseKernelHints(d.mgr)
+	} else {
+		tree.StartFallback(ctx, nil)
+	}
+	d.jobs[job.id] = job
+	d.updatePathFilter()
+
+	log.Printf("[daemon] %s attached: %s into namespace %q", job.id, job.root, job.namespace)
+	notifyService(jobStatus(len(d.jobs)))
+	return attachResult{ID: job.id}, nil
+}
+
+func (d *daemon) detach(req control.Request) (any, error) {
+	d.mu.Lock()
+	job, ok := d.jobs[req.Name]
+	if ok {
+		delete(d.jobs, req.Name)
+		d.updatePathFilter()
+	}
+	d.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no attached job %q", req.Name)
+	}
+
+	d.stop(job)
+	log.Printf("[daemon] %s detached (exit code %d)", job.id, req.ExitCode)
+	d.notifyJobs()
+
+	// Let the job's last captures reach the store before attach exits, so
+	// an export right after it sees them.
+	drainCtx, cancel := context.WithTimeout(context.Background(), journalDrainTimeout)
+	defer cancel()
+	if err := recorder.WaitIdle(drainCtx, d.db); err != nil {
+		log.Printf("[daemon] journal not fully processed after %s: %v", job.id, err)
+	}
+	d.mu.Lock()
+	d.collectGarbage()
+	d.mu.Unlock()
+	return nil, nil
+}
+
+// collectGarbage deletes the objects retention left unreferenced once no
+// job is recording: a job's objects are stored before the metadata that
+// references them, so a collection in between would delete them. It waits
+// for the journal of detached jobs to be processed first, and leaves the
+// collection for a later detach when that times out. d.mu must be held, so
+// no job attaches meanwhile.
+func (d *daemon) collectGarbage() {
+	if !d.collect || len(d.jobs) > 0 {
+		return
+	}
+	drainCtx, cancel := context.WithTimeout(context.Background(), journalDrainTimeout)
+	defer cancel()
+	if err := recorder.WaitIdle(drainCtx, d.db); err != nil {
+		log.Printf("[daemon] unreferenced objects not collected: %v", err)
+		return
+	}
+	removed, err := recorder.CollectUnreferenced(d.db, d.store)
+	if err != nil {
+		log.Printf("[daemon] collect unreferenced objects: %v", err)
+		return
+	}
+	d.collect = false
+	if removed > 0 {
+		log.Printf("[daemon] retention collected %d objects", removed)
+		recordAudit(d.stateDir, auditPrune, map[string]any{"objects": removed})
+	}
+}
+
+// stop captures what job still has pending and stops watching it.
+func (d *daemon) stop(job *daemonJob) {
+	job.tree.Flush()
+	job.cancel()
+	if err := job.journal.Flush(); err != nil {
+		log.Printf("[daemon] %s: %v", job.id, err)
+	}
+}
+
+// detachAll stops every job, as at shutdown.
+func (d *daemon) detachAll() {
+	d.mu.Lock()
+	jobs := d.jobs
+	d.jobs = make(map[string]*daemonJob)
+	d.mu.Unlock()
+	for _, job := range jobs {
+		d.stop(job)
+		log.Printf("[daemon] %s detached at shutdown", job.id)
+	}
+}
+
+// reap detaches jobs whose attach process is gone, e.g. killed before it
+// could detach.
+func (d *daemon) reap(ctx context.Context) {
+	ticker := time.NewTicker(daemonReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		d.mu.Lock()
+		var gone []*daemonJob
+		for id, job := range d.jobs {
+			if job.pid > 0 && !statelock.ProcessAlive(job.pid) {
+				gone = append(gone, job)
+				delete(d.jobs, id)
+			}
+		}
+		if len(gone) > 0 {
+			d.updatePathFilter()
+		}
+		d.mu.Unlock()
+		for _, job := range gone {
+			d.stop(job)
+			log.Printf("[daemon] %s detached: attach process %d is gone", job.id, job.pid)
+		}
+		if len(gone) > 0 {
+			d.notifyJobs()
+			d.mu.Lock()
+			d.collectGarbage()
+			d.mu.Unlock()
+		}
+	}
+}
+
+// jobStatus describes a daemon with n attached jobs for `systemctl status`.
+func jobStatus(n int) string {
+	return sdnotify.Status(fmt.Sprintf("%d jobs attached", n))
+}
+
+// notifyJobs reports the number of attached jobs to systemd.
+func (d *daemon) notifyJobs() {
+	d.mu.Lock()
+	n := len(d.jobs)
+	d.mu.Unlock()
+	notifyService(jobStatus(n))
+}
+
+// pingWatchdog pings systemd's watchdog at half its timeout. Each ping
+// takes the job lock, so a daemon wedged on it stops pinging and is
+// restarted.
+func (d *daemon) pingWatchdog(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		d.mu.Lock()
+		d.mu.Unlock()
+		notifyService(sdnotify.Watchdog)
+	}
+}
+
+// notifyService sends states to systemd when the daemon runs under a
+// Type=notify unit. Failures are logged; the daemon keeps running.
+func notifyService(states ...string) {
+	if _, err := sdnotify.Notify(strings.Join(states, "\n")); err != nil {
+		log.Printf("[daemon] systemd notification failed: %v", err)
+	}
+}
+
+// updatePathFilter limits eBPF events to the attached directories. d.mu
+// must be held.
+func (d *daemon) updatePathFilter() {
+	if d.mgr == nil {
+		return
+	}
+	roots := make([]string, 0, len(d.jobs))
+	for _, job := range d.jobs {
+		roots = append(roots, job.root)
+	}
+	if err := d.mgr.SetPathFilter(roots); err != nil {
+		log.Printf("[eBPF] in-kernel path filter disabled: %v", err)
+	}
+}
+
+// routeEvents hands each eBPF event to the job whose directory it is in.
+func (d *daemon) routeEvents(ctx context.Context, events <-chan ebpf.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case evt, ok := <-events:
+			if !ok {
+				return
+			}
+			path := filepath.Clean(evt.Path)
+			d.mu.Lock()
+			for _, job := range d.jobs {
+				if path != job.root && !strings.HasPrefix(path, job.root+string(filepath.Separator)) {
+					continue
+				}
+				select {
+				case job.events <- evt:
+				default:
+				}
+			}
+			d.mu.Unlock()
+		}
+	}
+}
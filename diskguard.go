@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/internal/metrics"
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+// diskCheckInterval is how often the state dir's free space is checked.
+const diskCheckInterval = time.Second
+
+// diskGuard pauses content capture while the filesystem holding the state
+// dir is below a free space watermark, so a recording cannot fill the disk
+// the recorded job needs. Paths, sizes and hashes are still recorded.
+type diskGuard struct {
+	db       *pebble.DB
+	stateDir string
+	minFree  uint64
+	free     func(path string) (uint64, error)
+
+	low atomic.Bool
+
+	mu   sync.Mutex
+	lows int
+}
+
+// newDiskGuard returns a guard for stateDir, or nil when minFree is 0.
+func newDiskGuard(db *pebble.DB, stateDir string, minFree uint64) *diskGuard {
+	if minFree == 0 {
+		return nil
+	}
+	return &diskGuard{db: db, stateDir: stateDir, minFree: minFree, free: diskFree}
+}
+
+// Low reports whether captures should store metadata only. A nil guard
+// never is.
+func (g *diskGuard) Low() bool {
+	return g != nil && g.low.Load()
+}
+
+// Check reads the free space once and updates the guard.
+func (g *diskGuard) Check() error {
+	free, err := g.free(g.stateDir)
+	if err != nil {
+		return err
+	}
+	metrics.StateDirFreeBytes.Set(float64(free))
+
+	low := free < g.minFree
+	if low == g.low.Load() {
+		return nil
+	}
+	g.low.Store(low)
+	if !low {
+		metrics.DiskLow.Set(0)
+		log.Printf("[disk] %s free on the state dir filesystem; capturing content again", formatSize(int(free)))
+		return nil
+	}
+
+	metrics.DiskLow.Set(1)
+	g.mu.Lock()
+	g.lows++
+	name := "disk-low"
+	if g.lows > 1 {
+		name = fmt.Sprintf("disk-low-%d", g.lows)
+	}
+	g.mu.Unlock()
+	log.Printf("[disk] only %s free on the state dir filesystem (watermark %s); recording metadata only, marked %s",
+		formatSize(int(free)), formatSize(int(g.minFree)), name)
+	if err := recordMarker(g.db, name, time.Now()); err != nil {
+		log.Printf("[disk] failed to record marker: %v", err)
+	}
+	return nil
+}
+
+// Run checks the free space until ctx is done. It stops, with one log
+// line, where free space cannot be read.
+func (g *diskGuard) Run(ctx context.Context) {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := g.Check(); err != nil {
+			log.Printf("[disk] free space checks stopped: %v", err)
+			return
+		}
+	}
+}
+
+// startDiskGuard checks the state dir's free space until ctx is done, or
+// returns nil when the check is off or unsupported.
+func startDiskGuard(ctx context.Context, db *pebble.DB, stateDir string, cfg *config.DiffConfig) *diskGuard {
+	disk := newDiskGuard(db, stateDir, cfg.MinFreeBytes())
+	if disk == nil {
+		return nil
+	}
+	if err := disk.Check(); err != nil {
+		log.Printf("[disk] free space is not checked: %v", err)
+		return nil
+	}
+	go disk.Run(ctx)
+	return disk
+}
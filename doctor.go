@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/ebpf"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+	"github.com/spf13/cobra"
+)
+
+// Doctor check outcomes.
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// doctorCheck is one line of the doctor report. Fix says how to resolve a
+// warning or failure.
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+// doctorReport is what doctor prints with --json.
+type doctorReport struct {
+	BTF    ebpf.BTFStatus `json:"btf"`
+	Checks []doctorCheck  `json:"checks"`
+}
+
+// doctorOptions carries the flags accepted by the doctor command.
+type doctorOptions struct {
+	stateDir   string
+	watchDir   string
+	configPath string
+	jsonOut    bool
+}
+
+func newDoctorCmd() *cobra.Command {
+	var opts doctorOptions
+
+	cmd := &cobra.Command{
+		Use:   "doctor [--state-dir <dir>] [--watch <dir>]",
+		Short: "Check whether this machine can record",
+		Long: `Check whether this machine can record.
+
+Checks the kernel version, where eBPF capture would take kernel BTF from
+(system, cache or a BTFHub download), the capabilities eBPF needs, whether
+the inotify watch limit covers every directory under --watch, free disk
+space for the state dir, and whether an existing --state-dir opens cleanly.
+Every warning or failure comes with a fix. Nothing is downloaded or written.
+
+Exits nonzero when a check fails; warnings mean record works with reduced
+capability (for example fsnotify instead of eBPF).`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDoctor(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "State dir to check (existing or to be created)")
+	cmd.Flags().StringVar(&opts.watchDir, "watch", ".", "Directory that will be recorded")
+	cmd.Flags().StringVar(&opts.configPath, "config", "", "Config file (YAML or TOML); default: diffkeeper.yaml in the watch directory")
+	cmd.Flags().BoolVar(&opts.jsonOut, "json", false, "Print JSON instead of a report")
+	return cmd
+}
+
+func runDoctor(w io.Writer, opts doctorOptions) error {
+	cfg, _, err := config.Load(opts.configPath, opts.watchDir, func(c *config.DiffConfig) {
+		c.WatchDir = opts.watchDir
+	})
+	if err != nil {
+		return err
+	}
+
+	btfStatus := ebpf.ProbeBTF(&cfg.EBPF)
+	report := doctorReport{BTF: btfStatus}
+	report.Checks = append(report.Checks,
+		kernelCheck(btfStatus.Kernel.Release),
+		btfCheck(btfStatus, cfg),
+		capabilityCheck(cfg),
+		inotifyCheck(cfg),
+		diskCheck(opts.stateDir),
+		stateDirCheck(opts.stateDir),
+	)
+
+	if opts.jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printDoctorReport(w, report)
+	}
+
+	failed := 0
+	for _, check := range report.Checks {
+		if check.Status == checkFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+// kernelCheck compares the kernel release with what the eBPF backends need:
+// 4.18 for kprobe capture and 5.5 for fentry.
+func kernelCheck(release string) doctorCheck {
+	check := doctorCheck{Name: "kernel", Status: checkOK, Detail: release}
+	if release == "" {
+		check.Status, check.Detail = checkSkip, "not Linux; record uses fsnotify"
+		return check
+	}
+	major, minor, ok := parseKernelVersion(release)
+	switch {
+	case !ok:
+		check.Status = checkWarn
+		check.Detail = fmt.Sprintf("cannot parse kernel release %q", release)
+	case major < 4 || (major == 4 && minor < 18):
+		check.Status = checkWarn
+		check.Detail += " (eBPF capture needs 4.18 or newer)"
+		check.Fix = "record falls back to fsnotify; upgrade the kernel (or runner image) for eBPF capture"
+	case major < 5 || (major == 5 && minor < 5):
+		check.Status = checkWarn
+		check.Detail += " (fentry needs 5.5 or newer; kprobe capture is used)"
+	}
+	return check
+}
+
+// parseKernelVersion extracts major.minor from a release like 6.1.0-18-amd64.
+func parseKernelVersion(release string) (int, int, bool) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	digits := strings.IndexFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+	if digits == -1 {
+		digits = len(parts[1])
+	}
+	minor, err := strconv.Atoi(parts[1][:digits])
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+// btfCheck turns a BTF probe into a check. Without BTF, eBPF capture is
+// unavailable and record falls back to fsnotify.
+func btfCheck(status ebpf.BTFStatus, cfg *config.DiffConfig) doctorCheck {
+	check := doctorCheck{Name: "btf", Status: checkOK}
+	switch status.Source {
+	case ebpf.BTFSourceSystem, ebpf.BTFSourceCache:
+		check.Detail = fmt.Sprintf("%s (%s)", status.Source, status.Path)
+		if status.Error != "" {
+			check.Status, check.Detail = checkFail, fmt.Sprintf("%s: %s", check.Detail, status.Error)
+			check.Fix = fmt.Sprintf("remove %s so it is downloaded again", status.Path)
+		}
+	case ebpf.BTFSourceDownload:
+		check.Status = checkWarn
+		check.Detail = fmt.Sprintf("download from %s on first record", status.URL)
+		check.Fix = fmt.Sprintf("pre-seed the cache for offline runners: curl -L %s | tar -xJ -O > %s", status.URL, status.Path)
+	default:
+		check.Status, check.Detail = checkWarn, status.Error
+		check.Fix = "eBPF capture is unavailable; record falls back to fsnotify. Use a kernel built with CONFIG_DEBUG_INFO_BTF, or set DIFFKEEPER_BTF_ALLOW_DOWNLOAD=true"
+		if cfg.EBPF.BTF.AllowDownload {
+			check.Fix = "eBPF capture is unavailable; record falls back to fsnotify"
+		}
+	}
+	return check
+}
+
+// countWatchDirs counts the directories record would watch under root,
+// skipping ignored subtrees the same way addWatchRecursive does.
+func countWatchDirs(cfg *config.DiffConfig) (int, error) {
+	root, err := filepath.Abs(cfg.WatchDir)
+	if err != nil {
+		return 0, err
+	}
+	gate := newCaptureGate(root, captureSettingsOf(cfg), func(string) {})
+	dirs := 0
+	err = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && gate.Ignored(path) {
+			return filepath.SkipDir
+		}
+		dirs++
+		return nil
+	})
+	return dirs, err
+}
+
+// inotifyLimitCheck grades dirs against the watch limit. Other processes
+// share the per-user limit, so using more than 80% of it is a warning.
+func inotifyLimitCheck(dirs, limit int) doctorCheck {
+	check := doctorCheck{Name: "inotify", Status: checkOK}
+	check.Detail = fmt.Sprintf("%d directories to watch, max_user_watches=%d", dirs, limit)
+
+	fix := watchLimitFix(dirs)
+	switch {
+	case dirs > limit:
+		check.Status, check.Fix = checkFail, fix
+	case dirs*5 > limit*4:
+		check.Status, check.Fix = checkWarn, fix
+	}
+	return check
+}
+
+// watchLimitFix suggests a watch limit with headroom for dirs directories.
+func watchLimitFix(dirs int) string {
+	want := 524288
+	for want < 2*dirs {
+		want *= 2
+	}
+	return fmt.Sprintf("sudo sysctl -w fs.inotify.max_user_watches=%d (persist it with: echo fs.inotify.max_user_watches=%d | sudo tee /etc/sysctl.d/60-diffkeeper.conf), or add ignore patterns for large generated trees", want, want)
+}
+
+// stateDirCheck opens an existing state dir read-only and scans it, which
+// verifies every block checksum, and reports leftovers from a killed
+// recorder.
+func stateDirCheck(stateDir string) doctorCheck {
+	check := doctorCheck{Name: "state", Status: checkOK}
+	if stateDir == "" {
+		check.Status, check.Detail = checkSkip, "pass --state-dir to check a recording"
+		return check
+	}
+	if _, err := os.Stat(stateDir); errors.Is(err, os.ErrNotExist) {
+		check.Detail = fmt.Sprintf("%s does not exist yet; record creates it", stateDir)
+		return check
+	}
+
+	recovery := fmt.Sprintf("diffkeeper recover --state-dir %s --force", stateDir)
+	var notes []string
+	if owner, err := statelock.Read(stateDir); err == nil {
+		if owner.Stale() {
+			check.Status = checkWarn
+			check.Fix = "a killed recorder left its lock behind; take it over with " + recovery
+			notes = append(notes, fmt.Sprintf("stale lock from %s", owner))
+		} else {
+			notes = append(notes, fmt.Sprintf("in use by %s", owner))
+		}
+	}
+
+	db, snapshot, err := openReadOnlyOrSnapshot(stateDir)
+	if err != nil {
+		check.Status, check.Detail = checkFail, err.Error()
+		check.Fix = "salvage what can be read with " + recovery
+		return check
+	}
+	defer releaseSnapshot(stateDir, snapshot)
+	defer db.Close()
+
+	keys, err := scanStore(db)
+	if err != nil {
+		check.Status, check.Detail = checkFail, fmt.Sprintf("scan failed after %d keys: %v", keys, err)
+		check.Fix = "the store is damaged; export what is still readable, then record into a fresh --state-dir"
+		return check
+	}
+	notes = append([]string{fmt.Sprintf("%d keys readable", keys)}, notes...)
+
+	journal, err := loadJournalStats(db)
+	if err == nil && journal.Entries > 0 && snapshot == "" {
+		check.Status = checkWarn
+		check.Fix = "unprocessed captures remain from an interrupted recording; store them with " + recovery
+		notes = append(notes, fmt.Sprintf("%d journal entries pending", journal.Entries))
+	}
+	check.Detail = strings.Join(notes, "; ")
+	return check
+}
+
+// scanStore reads every key and value, returning how many were read.
+func scanStore(db *pebble.DB) (int, error) {
+	iter, err := db.NewIter(nil)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	keys := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if _, err := iter.ValueAndErr(); err != nil {
+			return keys, err
+		}
+		keys++
+	}
+	return keys, iter.Error()
+}
+
+// diskTarget returns the nearest existing directory at or above stateDir,
+// where free space is measured.
+func diskTarget(stateDir string) string {
+	if stateDir == "" {
+		stateDir = "."
+	}
+	dir, err := filepath.Abs(stateDir)
+	if err != nil {
+		return stateDir
+	}
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// diskFreeCheck grades free space: below 256 MiB recording will soon fail,
+// below 1 GiB or 5% it is tight.
+func diskFreeCheck(path string, free, total uint64) doctorCheck {
+	check := doctorCheck{Name: "disk", Status: checkOK}
+	check.Detail = fmt.Sprintf("%s free on %s", formatSize(int(free)), path)
+	fix := fmt.Sprintf("free space on %s, or point --state-dir at a larger volume", path)
+	switch {
+	case free < 256<<20:
+		check.Status, check.Fix = checkFail, fix
+	case free < 1<<30 || (total > 0 && free*20 < total):
+		check.Status, check.Fix = checkWarn, fix
+	}
+	return check
+}
+
+func printDoctorReport(w io.Writer, report doctorReport) {
+	k := report.BTF.Kernel
+	if k.Release != "" {
+		fmt.Fprintf(w, "Kernel: %s (%s %s, %s)\n", k.Release, k.Distro, k.VersionID, k.Arch)
+	}
+	fmt.Fprintf(w, "BTF source: %s\n\n", report.BTF.Source)
+
+	problems := 0
+	for _, check := range report.Checks {
+		fmt.Fprintf(w, "[%-4s] %-12s %s\n", strings.ToUpper(check.Status), check.Name, check.Detail)
+		if check.Fix != "" {
+			fmt.Fprintf(w, "       %-12s -> %s\n", "", check.Fix)
+		}
+		if check.Status == checkWarn || check.Status == checkFail {
+			problems++
+		}
+	}
+	if problems == 0 {
+		fmt.Fprintln(w, "\nNo problems found.")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+// Capability bits from linux/capability.h.
+const (
+	capSysAdmin = 21
+	capPerfmon  = 38
+	capBPF      = 39
+)
+
+const inotifyWatchesPath = "/proc/sys/fs/inotify/max_user_watches"
+
+// capabilityCheck reports whether the effective capabilities allow loading
+// eBPF programs: CAP_SYS_ADMIN, or CAP_BPF with CAP_PERFMON on 5.8+.
+func capabilityCheck(cfg *config.DiffConfig) doctorCheck {
+	check := doctorCheck{Name: "capabilities", Status: checkOK}
+	if !cfg.EBPF.Enable {
+		check.Status, check.Detail = checkSkip, "eBPF disabled in config; fsnotify needs no capabilities"
+		return check
+	}
+	eff, err := effectiveCapabilities()
+	if err != nil {
+		check.Status, check.Detail = checkWarn, fmt.Sprintf("cannot read capabilities: %v", err)
+		return check
+	}
+
+	has := func(bit uint) bool { return eff&(1<<bit) != 0 }
+	switch {
+	case has(capSysAdmin):
+		check.Detail = "CAP_SYS_ADMIN"
+	case has(capBPF) && has(capPerfmon):
+		check.Detail = "CAP_BPF, CAP_PERFMON"
+	default:
+		check.Status = checkWarn
+		check.Detail = "neither CAP_SYS_ADMIN nor CAP_BPF+CAP_PERFMON; record falls back to fsnotify"
+		check.Fix = "run as root, grant the binary capabilities (sudo setcap cap_bpf,cap_perfmon+ep $(command -v diffkeeper)), or start the container with --cap-add BPF --cap-add PERFMON"
+	}
+	return check
+}
+
+// effectiveCapabilities returns the CapEff mask of the current process.
+func effectiveCapabilities() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "CapEff:"); ok {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no CapEff in /proc/self/status")
+}
+
+// Filesystem magics (statfs f_type) that deliver no inotify events for
+// changes made by other hosts or by the FUSE daemon.
+var noInotifyFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+}
+
+// inotifyCheck compares the directories under the watch dir with
+// fs.inotify.max_user_watches, which fsnotify needs one watch each for.
+func inotifyCheck(cfg *config.DiffConfig) doctorCheck {
+	check := doctorCheck{Name: "inotify"}
+	if cfg.WatchBackend == config.WatchBackendPoll {
+		check.Status, check.Detail = checkSkip, "the poll watch backend does not use inotify"
+		return check
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(cfg.WatchDir, &st); err == nil {
+		if fs, ok := noInotifyFilesystems[uint32(st.Type)]; ok {
+			check.Status = checkWarn
+			check.Detail = fmt.Sprintf("%s is on %s, which may not deliver inotify events", cfg.WatchDir, fs)
+			check.Fix = "diffkeeper record --watch-backend=poll"
+			return check
+		}
+	}
+	limit, err := inotifyWatchLimit()
+	if err != nil {
+		check.Status, check.Detail = checkWarn, fmt.Sprintf("cannot read %s: %v", inotifyWatchesPath, err)
+		return check
+	}
+	dirs, err := countWatchDirs(cfg)
+	if err != nil {
+		check.Status, check.Detail = checkWarn, fmt.Sprintf("cannot walk %s: %v", cfg.WatchDir, err)
+		return check
+	}
+	check = inotifyLimitCheck(dirs, limit)
+	if check.Status == checkFail && cfg.WatchFallback != config.WatchFallbackError {
+		check.Status = checkWarn
+		check.Detail += fmt.Sprintf("; record covers the rest with the %s fallback", cfg.WatchFallback)
+	}
+	return check
+}
+
+// diskCheck reports free space on the volume holding stateDir.
+func diskCheck(stateDir string) doctorCheck {
+	path := diskTarget(stateDir)
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return doctorCheck{Name: "disk", Status: checkWarn, Detail: fmt.Sprintf("statfs %s: %v", path, err)}
+	}
+	return diskFreeCheck(path, st.Bavail*uint64(st.Bsize), st.Blocks*uint64(st.Bsize))
+}
+
+// inotifyWatchLimit returns fs.inotify.max_user_watches.
+func inotifyWatchLimit() (int, error) {
+	return readProcInt(inotifyWatchesPath)
+}
+
+func readProcInt(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
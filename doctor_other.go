@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+func capabilityCheck(*config.DiffConfig) doctorCheck {
+	return doctorCheck{Name: "capabilities", Status: checkSkip, Detail: "eBPF capture is Linux-only"}
+}
+
+func inotifyCheck(*config.DiffConfig) doctorCheck {
+	return doctorCheck{Name: "inotify", Status: checkSkip, Detail: "watch limits are only checked on Linux"}
+}
+
+func diskCheck(stateDir string) doctorCheck {
+	return doctorCheck{Name: "disk", Status: checkSkip, Detail: "free space is only checked on Linux (" + diskTarget(stateDir) + ")"}
+}
+
+func inotifyWatchLimit() (int, error) {
+	return 0, fmt.Errorf("inotify is not available on %s", runtime.GOOS)
+}
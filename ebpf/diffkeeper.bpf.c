@@ -9,6 +9,9 @@ struct syscall_event {
 	__u32 pid;
 	__u64 bytes;
 	char path[256];
+	/* File offset the write starts at, or -1 when unknown. Kept last so
+	 * userspace can still decode events of programs built without it. */
+	__s64 offset;
 };
 
 struct lifecycle_event {
@@ -29,14 +32,86 @@ struct {
 	__uint(max_entries, 1 << 20);
 } lifecycle_events SEC(".maps");
 
-static __always_inline int emit_syscall_event(struct file *file, size_t count)
+/* Directories (by device + inode) whose subtrees are recorded. */
+struct path_key {
+	__u64 dev;
+	__u64 ino;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 1024);
+	__type(key, struct path_key);
+	__type(value, __u8);
+} watch_roots SEC(".maps");
+
+/* Slot 0 toggles filtering; zero means every write is emitted. */
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, __u32);
+} filter_settings SEC(".maps");
+
+#define MAX_PATH_DEPTH 32
+
+static __always_inline bool path_allowed(struct dentry *dentry)
+{
+	struct path_key key = {};
+	__u32 zero = 0;
+	__u32 *enabled;
+
+	enabled = bpf_map_lookup_elem(&filter_settings, &zero);
+	if (!enabled || !*enabled) {
+		return true;
+	}
+
+	key.dev = BPF_CORE_READ(dentry, d_sb, s_dev);
+
+#pragma unroll
+	for (int i = 0; i < MAX_PATH_DEPTH; i++) {
+		struct dentry *parent;
+
+		key.ino = BPF_CORE_READ(dentry, d_inode, i_ino);
+		if (bpf_map_lookup_elem(&watch_roots, &key)) {
+			return true;
+		}
+
+		parent = BPF_CORE_READ(dentry, d_parent);
+		if (!parent || parent == dentry) {
+			break;
+		}
+		dentry = parent;
+	}
+	return false;
+}
+
+static __always_inline __s64 read_pos(loff_t *pos)
+{
+	loff_t off = -1;
+
+	if (!pos || bpf_probe_read_kernel(&off, sizeof(off), pos)) {
+		return -1;
+	}
+	return off;
+}
+
+static __always_inline int emit_syscall_event(struct file *file, size_t count,
+					      __s64 offset)
 {
 	struct syscall_event *ev;
+	struct dentry *dentry;
 
 	if (!file) {
 		return 0;
 	}
 
+	/* Drop writes outside the recorded tree before touching the ring buffer. */
+	dentry = BPF_CORE_READ(file, f_path.dentry);
+	if (!dentry || !path_allowed(dentry)) {
+		return 0;
+	}
+
 	ev = bpf_ringbuf_reserve(&events, sizeof(*ev), 0);
 	if (!ev) {
 		return 0;
@@ -44,10 +119,10 @@ static __always_inline int emit_syscall_event(struct file *file, size_t count)
 
 	ev->pid = bpf_get_current_pid_tgid() >> 32;
 	ev->bytes = count;
+	ev->offset = offset;
 	__builtin_memset(ev->path, 0, sizeof(ev->path));
 
 	/* Portable path resolution: just capture the filename (dentry name). */
-	struct dentry *dentry = BPF_CORE_READ(file, f_path.dentry);
 	const unsigned char *name = BPF_CORE_READ(dentry, d_name.name);
 	bpf_probe_read_kernel_str(ev->path, sizeof(ev->path), name);
 
@@ -59,24 +134,53 @@ SEC("fentry/vfs_write")
 int BPF_PROG(fentry_vfs_write, struct file *file, const char *buf, size_t count,
 	     loff_t *pos)
 {
-	return emit_syscall_event(file, count);
+	return emit_syscall_event(file, count, read_pos(pos));
 }
 
 SEC("fentry/vfs_writev")
-int BPF_PROG(fentry_vfs_writev, struct kiocb *iocb, struct iovec *iov,
-	     unsigned long nr_segs)
+int BPF_PROG(fentry_vfs_writev, struct file *file, const struct iovec *vec,
+	     unsigned long vlen, loff_t *pos)
+{
+	size_t total = 0;
+
+#pragma unroll
+	for (int i = 0; i < 6; i++) {
+		struct iovec seg = {};
+
+		if (i >= vlen)
+			break;
+		if (bpf_probe_read_user(&seg, sizeof(seg), &vec[i]))
+			break;
+		total += seg.iov_len;
+	}
+	return emit_syscall_event(file, total, read_pos(pos));
+}
+
+/* kprobe variants for kernels without BPF trampolines (fentry) support. */
+SEC("kprobe/vfs_write")
+int BPF_KPROBE(kprobe_vfs_write, struct file *file, const char *buf,
+	       size_t count, loff_t *pos)
+{
+	return emit_syscall_event(file, count, read_pos(pos));
+}
+
+SEC("kprobe/vfs_writev")
+int BPF_KPROBE(kprobe_vfs_writev, struct file *file, const struct iovec *vec,
+	       unsigned long vlen, loff_t *pos)
 {
-	struct file *file = BPF_CORE_READ(iocb, ki_filp);
 	size_t total = 0;
 
 #pragma unroll
 	for (int i = 0; i < 6; i++) {
-		if (i >= nr_segs)
+		struct iovec seg = {};
+
+		if (i >= vlen)
+			break;
+		if (bpf_probe_read_user(&seg, sizeof(seg), &vec[i]))
 			break;
-		size_t len = BPF_CORE_READ(&iov[i], iov_len);
-		total += len;
+		total += seg.iov_len;
 	}
-	return emit_syscall_event(file, total);
+	return emit_syscall_event(file, total, read_pos(pos));
 }
 
 SEC("tracepoint/sched/sched_process_exec")
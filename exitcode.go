@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os/exec"
+	"syscall"
+)
+
+// Exit statuses of record, attach, agent and daemon, so a pipeline can
+// tell the recorded command failing from diffkeeper failing to record it.
+// Once the command ran, diffkeeper exits with its status (128 + the signal
+// when it was killed); a failure to record a command that succeeded exits
+// with exitStoreFailed or exitRecorderFailed instead, unless
+// --passthrough-exit-code is set. Other commands exit 1 on any error.
+const (
+	// exitStoreFailed: the state dir could not be opened or written.
+	exitStoreFailed = 123
+	// exitRecorderFailed: diffkeeper itself failed, e.g. on an invalid
+	// config or a watcher that could not start.
+	exitRecorderFailed = 125
+	// exitCannotRun: the command was found but could not be started.
+	exitCannotRun = 126
+	// exitNotFound: the command was not found.
+	exitNotFound = 127
+)
+
+// exitCodeError is an error that sets diffkeeper's exit status.
+type exitCodeError struct {
+	code int
+	err  error
+	// commandOK is set when the command succeeded and err is a failure to
+	// record it, which --passthrough-exit-code does not exit with.
+	commandOK bool
+}
+
+func (e *exitCodeError) Error() string { return e.err.Error() }
+
+func (e *exitCodeError) Unwrap() error { return e.err }
+
+// storeFailure marks err, if any, as a failure of the store.
+func storeFailure(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitCodeError{code: exitStoreFailed, err: err}
+}
+
+// recordingFailed returns what a recording that failed with err exits
+// with, after the command exited with runErr: the command's own failure,
+// or code when the command succeeded.
+func recordingFailed(runErr, err error, code int) error {
+	if runErr != nil {
+		return runErr
+	}
+	return &exitCodeError{code: code, err: fmt.Errorf("recording failed: %w", err), commandOK: true}
+}
+
+// passthroughExit returns err unless it only reports a failure to record
+// a command that succeeded. That failure is logged instead, so diffkeeper
+// exits with the command's status.
+func passthroughExit(err error) error {
+	var coded *exitCodeError
+	if errors.As(err, &coded) && coded.commandOK {
+		log.Printf("%v; exiting with the command's status", err)
+		return nil
+	}
+	return err
+}
+
+// startFailure marks err, from starting the recorded command, as the
+// command not being found or not being runnable.
+func startFailure(err error) error {
+	code := exitCannotRun
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		code = exitNotFound
+	}
+	return &exitCodeError{code: code, err: err}
+}
+
+// recorderExit marks err, the error a recording ended with, as a failure
+// of diffkeeper itself unless it is the command's exit or already marked.
+func recorderExit(err error) error {
+	if err == nil {
+		return nil
+	}
+	var coded *exitCodeError
+	var exitErr *exec.ExitError
+	if errors.As(err, &coded) || errors.As(err, &exitErr) {
+		return err
+	}
+	return &exitCodeError{code: exitRecorderFailed, err: err}
+}
+
+// exitStatus returns the status diffkeeper exits with after err.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var coded *exitCodeError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if code := exitErr.ExitCode(); code >= 0 {
+			return code
+		}
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+	}
+	return 1
+}
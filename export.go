@@ -0,0 +1,787 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/internal/version"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/diff"
+	"github.com/saworbit/diffkeeper/pkg/glob"
+	"github.com/saworbit/diffkeeper/pkg/hooks"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/spf13/cobra"
+)
+
+const (
+	exportManifestName = ".diffkeeper-manifest.json"
+	exportProgressName = ".diffkeeper-progress"
+	exportStagingExt   = ".diffkeeper-partial"
+	exportManifestV1   = 1
+)
+
+func newExportCmd() *cobra.Command {
+	var opts exportOptions
+	var hashAlgo, configPath, namespace string
+	var lineEndings string
+	var normalizeEncoding bool
+	var progressMode string
+
+	cmd := &cobra.Command{
+		Use:   "export --out <dir> --time <timestamp>",
+		Short: "Reconstruct files from CAS metadata at a given point in time",
+		Long: `Reconstruct files from CAS metadata at a given point in time.
+
+With --from, only files written between --from and --to are exported. Use
+--format=patch for a git-style patch of those changes, or --format=tar for a
+tarball of the changed files. --line-endings and --normalize-encoding apply to
+the patch only, so text recorded on another platform does not differ on every
+line; stored content is never changed.
+
+--format=git writes the recorded history as a git repository with one commit
+per second (or per write), so git log -p and git bisect work on the timeline.
+
+--format=car writes a CARv1 archive of the CAS objects plus a DAG-JSON
+manifest root, ready for "ipfs dag import".
+
+When the recording was sealed, the manifest carries the session Merkle root
+(and its signature, with record --sign-key). --verify recomputes the root from
+the exported files when the export holds the full final state.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			if opts.fromTime != "" {
+				if cmd.Flags().Changed("time") {
+					return fmt.Errorf("--time cannot be combined with --from; use --to")
+				}
+				opts.atTime = opts.toTime
+			} else if cmd.Flags().Changed("to") {
+				return fmt.Errorf("--to requires --from")
+			}
+
+			switch opts.format {
+			case exportFormatDir, exportFormatTar, exportFormatCAR:
+			case exportFormatGit:
+				if opts.fromTime != "" {
+					return fmt.Errorf("--format=git exports the full history; --from is not supported")
+				}
+				if opts.gitCommitPer != gitCommitPerSecond && opts.gitCommitPer != gitCommitPerWrite {
+					return fmt.Errorf("--git-commit-per must be %s or %s", gitCommitPerSecond, gitCommitPerWrite)
+				}
+			case exportFormatPatch:
+				if opts.fromTime == "" {
+					return fmt.Errorf("--format=patch requires --from")
+				}
+			default:
+				return fmt.Errorf("unsupported --format %q (must be %s, %s, %s, %s, or %s)", opts.format, exportFormatDir, exportFormatTar, exportFormatPatch, exportFormatGit, exportFormatCAR)
+			}
+
+			if opts.stdout {
+				if len(opts.paths) != 1 {
+					return fmt.Errorf("--stdout requires exactly one --path")
+				}
+				if opts.fromTime != "" || opts.format != exportFormatDir {
+					return fmt.Errorf("--stdout cannot be combined with --from or --format")
+				}
+			} else if opts.outDir == "" && opts.format != exportFormatPatch {
+				return fmt.Errorf("out directory is required")
+			}
+			if opts.verify && opts.format != exportFormatDir {
+				return fmt.Errorf("--verify is only supported with --format=%s", exportFormatDir)
+			}
+			for _, p := range opts.paths {
+				if err := glob.Validate(p); err != nil {
+					return fmt.Errorf("invalid --path pattern %q: %w", p, err)
+				}
+			}
+			opts.stdoutWriter = cmd.OutOrStdout()
+			var err error
+			if opts.progress, err = newProgress(cmd.ErrOrStderr(), progressMode); err != nil {
+				return err
+			}
+			overrides := func(c *config.DiffConfig) {
+				if cmd.Flags().Changed("hash-algo") {
+					c.HashAlgo = hashAlgo
+				}
+				if cmd.Flags().Changed("namespace") {
+					c.Namespace = namespace
+				}
+				if cmd.Flags().Changed("line-endings") {
+					c.LineEndings = lineEndings
+				}
+				if cmd.Flags().Changed("normalize-encoding") {
+					c.NormalizeEncoding = normalizeEncoding
+				}
+			}
+			var cfg *config.DiffConfig
+			if configPath != "" {
+				if cfg, _, err = config.Load(configPath, "", overrides); err == nil {
+					if err = cfg.Validate(); err != nil {
+						err = fmt.Errorf("invalid config: %w", err)
+					}
+				}
+			} else {
+				cfg, err = loadEnvConfig(overrides)
+			}
+			if err != nil {
+				return err
+			}
+			opts.cfg = cfg
+			if err := runExport(opts); err != nil {
+				return err
+			}
+			notifyExportCompleted(cfg, opts)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&opts.outDir, "out", "", "Destination directory (must not exist or be empty), or file for --format=tar/patch/car ('-' for stdout)")
+	cmd.Flags().StringVar(&opts.atTime, "time", "latest", "Timestamp, duration, or anchor (e.g. 2s, 2025-01-02T15:04:05Z, end-5s, failure, event:<marker>)")
+	cmd.Flags().StringVar(&opts.fromTime, "from", "", "Export only files changed after this time (same forms as --time)")
+	cmd.Flags().StringVar(&opts.toTime, "to", "latest", "End of the --from interval (same forms as --time)")
+	cmd.Flags().StringVar(&opts.format, "format", exportFormatDir, "Output format: dir, tar, patch (requires --from), git, or car")
+	completeValues(cmd, "format", exportFormatDir, exportFormatTar, exportFormatPatch, exportFormatGit, exportFormatCAR)
+	_ = cmd.RegisterFlagCompletionFunc("from", completeTime)
+	_ = cmd.RegisterFlagCompletionFunc("to", completeTime)
+	cmd.Flags().StringVar(&opts.gitCommitPer, "git-commit-per", gitCommitPerSecond, "With --format=git, create one commit per second or per write")
+	cmd.Flags().StringArrayVar(&opts.paths, "path", nil, "Only restore paths matching this glob (repeatable, supports **)")
+	cmd.Flags().BoolVar(&opts.stdout, "stdout", false, "Print the single file matched by --path to stdout instead of writing --out")
+	cmd.Flags().BoolVar(&opts.verify, "verify", false, "Re-hash restored files against the export manifest after completion")
+	cmd.Flags().StringVar(&hashAlgo, "hash-algo", "sha256", "Content hash algorithm of the state dir (DIFFKEEPER_HASH_ALGO wins when set)")
+	cmd.Flags().StringVar(&namespace, "namespace", "", "Export only the files recorded with record --namespace")
+	cmd.Flags().StringVar(&lineEndings, "line-endings", config.LineEndingsKeep, "With --format=patch, compare text with line endings translated: keep, lf or crlf")
+	cmd.Flags().BoolVar(&normalizeEncoding, "normalize-encoding", false, "With --format=patch, ignore UTF-8 byte order marks and compare UTF-16 text as UTF-8")
+	cmd.Flags().StringVar(&configPath, "config", "", "Config file (YAML or TOML) whose export_completed hooks run after the export")
+	addProgressFlag(cmd, &progressMode)
+	return cmd
+}
+
+// notifyExportCompleted runs the export_completed hooks of cfg, waiting for
+// their delivery before the command exits.
+func notifyExportCompleted(cfg *config.DiffConfig, opts exportOptions) {
+	dispatcher := hooks.New(cfg.Hooks)
+	if dispatcher == nil {
+		return
+	}
+	out := opts.outDir
+	if opts.stdout {
+		out = "-"
+	}
+	dispatcher.Fire(hooks.Event{Event: config.HookExportCompleted, StateDir: opts.stateDir, Out: out, Format: opts.format})
+	dispatcher.Close()
+}
+
+const (
+	exportFormatDir   = "dir"
+	exportFormatTar   = "tar"
+	exportFormatPatch = "patch"
+	exportFormatGit   = "git"
+	exportFormatCAR   = "car"
+)
+
+// exportOptions carries the flags accepted by the export command.
+type exportOptions struct {
+	stateDir string
+	outDir   string
+	atTime   string
+	fromTime string
+	toTime   string
+	format   string
+	paths    []string
+	stdout   bool
+	verify   bool
+
+	gitCommitPer string
+	stdoutWriter io.Writer
+	// progress reports how far dir, tar and car exports and --verify got.
+	progress *progressReporter
+	// cfg is the resolved configuration; nil means DIFFKEEPER_* env only.
+	cfg *config.DiffConfig
+}
+
+// exportManifest is written to the root of every export. While an export is
+// in progress it lives in the staging directory and doubles as the resume plan.
+type exportManifest struct {
+	Version    int                   `json:"version"`
+	FromTime   int64                 `json:"from_time,omitempty"`
+	TargetTime int64                 `json:"target_time"`
+	Complete   bool                  `json:"complete"`
+	Files      []exportManifestEntry `json:"files"`
+	Dirs       []exportManifestDir   `json:"dirs,omitempty"`
+	Session    *exportSeal           `json:"session,omitempty"`
+	// Provenance: the recording's session ID and wrapped command, the
+	// agent that wrote the export and the Merkle root over its files' CIDs,
+	// comparable to a sealed session root when the export is complete.
+	SessionID  string   `json:"session_id,omitempty"`
+	Command    []string `json:"command,omitempty"`
+	Agent      string   `json:"agent"`
+	MerkleRoot string   `json:"merkle_root,omitempty"`
+	// Resources are the usage samples of the recorded command up to the
+	// target time.
+	Resources []recorder.ResourceSample `json:"resources,omitempty"`
+}
+
+// exportManifestEntry describes one restored file.
+type exportManifestEntry struct {
+	Path   string `json:"path"` // slash-separated, relative to the export root
+	CID    string `json:"cid"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Mode is the recorded mode, when a chmod was recorded for the file.
+	Mode fs.FileMode `json:"mode,omitempty"`
+	// ModTime is when the version was recorded, in nanoseconds; restored
+	// files get it as their mtime.
+	ModTime int64 `json:"mtime,omitempty"`
+	// Truncated is set when only the head and tail of the file were
+	// recorded; the restored file holds just those bytes.
+	Truncated *recorder.Truncation `json:"truncated,omitempty"`
+}
+
+// exportManifestDir describes a directory recorded with mkdir or chmod, so
+// empty directories and directory modes are restored.
+type exportManifestDir struct {
+	Path string      `json:"path"`
+	Mode fs.FileMode `json:"mode"`
+}
+
+func runExport(opts exportOptions) error {
+	stateDir, outDir, atTime := opts.stateDir, opts.outDir, opts.atTime
+
+	cfg := opts.cfg
+	if cfg == nil {
+		var err error
+		if cfg, err = loadEnvConfig(nil); err != nil {
+			return err
+		}
+		opts.cfg = cfg
+	}
+	db, casStore, err := openReadOnlyStoreWithConfig(stateDir, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	anchors := loadSessionAnchors(db)
+	targetTime, err := parseTargetTime(atTime, anchors)
+	if err != nil {
+		return err
+	}
+
+	records, err := loadMetadataAt(db, targetTime)
+	if err != nil {
+		return err
+	}
+	records = recorder.NamespaceState(records, cfg.Namespace)
+
+	if opts.stdout {
+		return writeSingleFile(opts.stdoutWriter, casStore, records, diff.Normalization{}, func(path string) bool {
+			return glob.MatchAny(opts.paths, filepath.ToSlash(path))
+		}, fmt.Sprintf("%s at %s", opts.paths[0], atTime))
+	}
+
+	if opts.format == exportFormatGit {
+		return exportGit(db, casStore, opts, targetTime, anchors.start)
+	}
+
+	// In delta mode baseline holds the state at --from; unchanged files are dropped.
+	var baseline map[string]recorder.MetadataRecord
+	plan := exportManifest{Version: exportManifestV1, TargetTime: targetTime.UnixNano()}
+	if opts.fromTime != "" {
+		fromTime, err := parseTargetTime(opts.fromTime, anchors)
+		if err != nil {
+			return fmt.Errorf("--from: %w", err)
+		}
+		if !fromTime.Before(targetTime) {
+			return fmt.Errorf("--from (%s) must be before --to (%s)", fromTime.Format(time.RFC3339Nano), targetTime.Format(time.RFC3339Nano))
+		}
+		if baseline, err = loadMetadataAt(db, fromTime); err != nil {
+			return err
+		}
+		baseline = recorder.NamespaceState(baseline, cfg.Namespace)
+		plan.FromTime = fromTime.UnixNano()
+	}
+
+	attrs, err := recorder.AttrsAt(db, targetTime)
+	if err != nil {
+		return err
+	}
+	attrs = recorder.NamespaceAttrs(attrs, cfg.Namespace)
+	settled, err := settledTime(db, targetTime, records, attrs)
+	if err != nil {
+		return err
+	}
+	plan.TargetTime = settled.UnixNano()
+	// changedSince reports whether rec falls inside the --from interval.
+	changedSince := func(rec recorder.AttrRecord) bool {
+		return baseline == nil || rec.Timestamp > plan.FromTime
+	}
+
+	metas := make(map[string]recorder.MetadataRecord)
+	var observed int
+	for path, meta := range records {
+		if !glob.MatchAny(opts.paths, filepath.ToSlash(path)) {
+			continue
+		}
+		if meta.Observed {
+			observed++
+			continue
+		}
+		attr, hasAttr := attrs[path]
+		hasAttr = hasAttr && !attr.IsDir()
+		if baseline != nil {
+			if prev, ok := baseline[path]; ok && prev.CID == meta.CID && !(hasAttr && changedSince(attr)) {
+				continue
+			}
+		}
+		rel := filepath.ToSlash(cleanPath(path))
+		entry := exportManifestEntry{Path: rel, CID: meta.CID, Size: meta.Size, ModTime: meta.Timestamp, Truncated: meta.Truncated}
+		if hasAttr {
+			entry.Mode = attr.Mode
+		}
+		plan.Files = append(plan.Files, entry)
+		metas[rel] = meta
+	}
+	sort.Slice(plan.Files, func(i, j int) bool { return plan.Files[i].Path < plan.Files[j].Path })
+	if observed > 0 {
+		log.Printf("[export] skipped %d files recorded with --observe; their content was not stored", observed)
+	}
+	for path, attr := range attrs {
+		rel := filepath.ToSlash(cleanPath(path))
+		if !attr.IsDir() || attr.Op == recorder.OpRmdir || rel == "." || !changedSince(attr) {
+			continue
+		}
+		if !glob.MatchAny(opts.paths, rel) {
+			continue
+		}
+		plan.Dirs = append(plan.Dirs, exportManifestDir{Path: rel, Mode: attr.Mode})
+	}
+	sort.Slice(plan.Dirs, func(i, j int) bool { return plan.Dirs[i].Path < plan.Dirs[j].Path })
+	if plan.Session, err = loadExportSeal(db, plan, len(opts.paths) > 0 || cfg.Namespace != ""); err != nil {
+		return fmt.Errorf("load session seal: %w", err)
+	}
+	if err := addProvenance(db, &plan); err != nil {
+		return err
+	}
+	var resourcesFrom time.Time
+	if plan.FromTime > 0 {
+		resourcesFrom = time.Unix(0, plan.FromTime)
+	}
+	if plan.Resources, err = recorder.ResourceSamples(db, cfg.Namespace, resourcesFrom, targetTime); err != nil {
+		return fmt.Errorf("load resource samples: %w", err)
+	}
+
+	load := func(rel string) ([]byte, error) {
+		return recorder.ReadContent(casStore, metas[rel])
+	}
+	open := func(rel string) (io.ReadCloser, error) {
+		return recorder.OpenContent(casStore, metas[rel])
+	}
+
+	switch opts.format {
+	case exportFormatPatch:
+		loadBase := func(rel string) ([]byte, bool, error) {
+			prev, ok := baseline[metas[rel].Path]
+			if !ok {
+				return nil, false, nil
+			}
+			data, err := recorder.ReadContent(casStore, prev)
+			return data, true, err
+		}
+		return writeExportFile(outDir, opts.stdoutWriter, func(w io.Writer) error {
+			return writePatch(w, plan, displayNormalization(cfg), cfg.DiffMaxMemoryBytes(), load, loadBase)
+		})
+	}
+
+	var totalBytes int64
+	for _, entry := range plan.Files {
+		totalBytes += int64(entry.Size)
+	}
+	opts.progress.Start("export", "files", len(plan.Files), totalBytes)
+	switch opts.format {
+	case exportFormatTar:
+		err = writeExportFile(outDir, opts.stdoutWriter, func(w io.Writer) error {
+			return writeTar(w, plan, opts.progress.countReads(open))
+		})
+	case exportFormatCAR:
+		err = writeExportFile(outDir, opts.stdoutWriter, func(w io.Writer) error {
+			return writeCAR(w, plan, metas, casStore, opts.progress)
+		})
+	default:
+		err = writeExportAtomically(outDir, plan, open, opts.progress)
+	}
+	if err != nil {
+		return err
+	}
+	opts.progress.Finish()
+
+	if opts.verify {
+		return verifyExport(outDir, opts.progress)
+	}
+	return nil
+}
+
+// addProvenance fills in the fields that trace plan back to its recording.
+func addProvenance(db *pebble.DB, plan *exportManifest) error {
+	plan.Agent = version.Version
+	info, ok, err := recorder.LoadSessionInfo(db)
+	if err != nil {
+		return fmt.Errorf("load session info: %w", err)
+	}
+	if ok {
+		plan.SessionID, plan.Command = info.ID, info.Command
+	}
+	if len(plan.Files) == 0 {
+		return nil
+	}
+	plan.MerkleRoot, err = exportedRoot(*plan, func(entry exportManifestEntry) string { return entry.CID })
+	return err
+}
+
+// writeExportAtomically materializes plan in a sibling staging directory and
+// renames it over outDir once every file is written. Re-running an export with
+// the same plan resumes from the progress log left by an interrupted attempt.
+// Files are streamed from open, so large versions are never held in memory.
+// progress, if any, counts the files written and resumed.
+func writeExportAtomically(outDir string, plan exportManifest, open func(rel string) (io.ReadCloser, error), progress *progressReporter) error {
+	outDir = filepath.Clean(outDir)
+	if err := ensureEmptyDir(outDir); err != nil {
+		return err
+	}
+
+	staging := outDir + exportStagingExt
+	done, err := prepareStaging(staging, plan)
+	if err != nil {
+		return err
+	}
+
+	progressLog, err := os.OpenFile(filepath.Join(staging, exportProgressName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open export progress: %w", err)
+	}
+	defer progressLog.Close()
+
+	open = progress.countReads(open)
+	for i := range plan.Files {
+		entry := &plan.Files[i]
+		dest := filepath.Join(staging, filepath.FromSlash(entry.Path))
+
+		if sum, ok := done[entry.Path]; ok {
+			if onDisk, err := hashFile(dest); err == nil && onDisk == sum {
+				entry.SHA256 = sum
+				progress.Advance(1, int64(entry.Size))
+				continue
+			}
+		}
+
+		sum, err := restoreFile(dest, entry, open)
+		if err != nil {
+			return err
+		}
+		entry.SHA256 = sum
+		if _, err := fmt.Fprintf(progressLog, "%s %s\n", entry.SHA256, entry.Path); err != nil {
+			return fmt.Errorf("record export progress: %w", err)
+		}
+	}
+
+	if err := progressLog.Close(); err != nil {
+		return fmt.Errorf("close export progress: %w", err)
+	}
+	if err := restoreModes(staging, plan); err != nil {
+		return err
+	}
+
+	plan.Complete = true
+	if err := writeExportManifest(staging, plan); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(staging, exportProgressName)); err != nil {
+		return fmt.Errorf("remove export progress: %w", err)
+	}
+	if err := restoreTimes(staging, plan); err != nil {
+		return err
+	}
+
+	// ensureEmptyDir guaranteed outDir is absent or empty, so removing it is safe.
+	if err := os.Remove(outDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("replace out dir: %w", err)
+	}
+	if err := os.Rename(staging, outDir); err != nil {
+		return fmt.Errorf("finalize export: %w", err)
+	}
+	return nil
+}
+
+// restoreFile streams one planned file to dest and returns its SHA-256.
+func restoreFile(dest string, entry *exportManifestEntry, open func(rel string) (io.ReadCloser, error)) (string, error) {
+	src, err := open(entry.Path)
+	if err != nil {
+		return "", fmt.Errorf("load CAS object %s: %w", entry.CID, err)
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return "", fmt.Errorf("create parent for %s: %w", dest, err)
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return "", fmt.Errorf("write %s: %w", dest, err)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), src); err != nil {
+		f.Close()
+		return "", fmt.Errorf("load CAS object %s: %w", entry.CID, err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("write %s: %w", dest, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// restoreModes creates the recorded directories and applies recorded
+// modes. Directories are changed deepest first, after every file is
+// written, so a read-only directory does not block its own contents.
+func restoreModes(root string, plan exportManifest) error {
+	for _, dir := range plan.Dirs {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir.Path)), 0o755); err != nil {
+			return fmt.Errorf("create directory %s: %w", dir.Path, err)
+		}
+	}
+	for _, entry := range plan.Files {
+		if entry.Mode == 0 {
+			continue
+		}
+		if err := os.Chmod(filepath.Join(root, filepath.FromSlash(entry.Path)), entry.Mode.Perm()); err != nil {
+			return fmt.Errorf("restore mode of %s: %w", entry.Path, err)
+		}
+	}
+	for i := len(plan.Dirs) - 1; i >= 0; i-- {
+		dir := plan.Dirs[i]
+		if err := os.Chmod(filepath.Join(root, filepath.FromSlash(dir.Path)), dir.Mode.Perm()); err != nil {
+			return fmt.Errorf("restore mode of %s: %w", dir.Path, err)
+		}
+	}
+	return nil
+}
+
+// restoreTimes gives every restored file its recorded mtime, and the
+// manifest and every directory the export's target time, so exporting the
+// same state twice yields identical trees.
+func restoreTimes(root string, plan exportManifest) error {
+	mtimes := make(map[string]time.Time, len(plan.Files))
+	for _, entry := range plan.Files {
+		mtimes[entry.Path] = time.Unix(0, entry.ModTime)
+	}
+	target := time.Unix(0, plan.TargetTime)
+
+	// Directories are stamped after their contents, which would otherwise
+	// move their mtime again.
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		mtime, ok := mtimes[filepath.ToSlash(rel)]
+		if !ok {
+			mtime = target
+		}
+		return os.Chtimes(path, mtime, mtime)
+	})
+	if err != nil {
+		return fmt.Errorf("restore mtimes: %w", err)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i], target, target); err != nil {
+			return fmt.Errorf("restore mtimes: %w", err)
+		}
+	}
+	return nil
+}
+
+// settledTime pulls target back to the last recorded change at or before
+// it, or to the session end when that is later and not after target. The
+// state is the same at both times, so exports resolved against "latest" at
+// different moments carry the same timestamps.
+func settledTime(db *pebble.DB, target time.Time, records map[string]recorder.MetadataRecord, attrs map[string]recorder.AttrRecord) (time.Time, error) {
+	var last int64
+	for _, meta := range records {
+		last = max(last, meta.Timestamp)
+	}
+	for _, attr := range attrs {
+		last = max(last, attr.Timestamp)
+	}
+	end, ok, err := recorder.LoadSessionEnd(db)
+	if err != nil {
+		return target, fmt.Errorf("load session end: %w", err)
+	}
+	if ok && end.Timestamp <= target.UnixNano() {
+		last = max(last, end.Timestamp)
+	}
+	if last == 0 || last > target.UnixNano() {
+		return target, nil
+	}
+	return time.Unix(0, last), nil
+}
+
+// prepareStaging creates the staging directory or, when an interrupted export
+// with an identical plan is found, returns the checksums it already wrote.
+func prepareStaging(staging string, plan exportManifest) (map[string]string, error) {
+	if prev, err := readExportManifest(staging); err == nil && samePlan(prev, plan) {
+		return readExportProgress(filepath.Join(staging, exportProgressName)), nil
+	}
+
+	if err := os.RemoveAll(staging); err != nil {
+		return nil, fmt.Errorf("clear stale staging dir: %w", err)
+	}
+	if err := os.MkdirAll(staging, 0o755); err != nil {
+		return nil, fmt.Errorf("create staging dir: %w", err)
+	}
+	if err := writeExportManifest(staging, plan); err != nil {
+		return nil, err
+	}
+	return map[string]string{}, nil
+}
+
+// samePlan reports whether two manifests restore identical content.
+func samePlan(a, b exportManifest) bool {
+	if a.Version != b.Version || len(a.Files) != len(b.Files) {
+		return false
+	}
+	for i := range a.Files {
+		if a.Files[i].Path != b.Files[i].Path || a.Files[i].CID != b.Files[i].CID {
+			return false
+		}
+	}
+	return true
+}
+
+func readExportProgress(path string) map[string]string {
+	done := make(map[string]string)
+	f, err := os.Open(path)
+	if err != nil {
+		return done
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		sum, rel, ok := strings.Cut(scanner.Text(), " ")
+		if ok && len(sum) == sha256.Size*2 {
+			done[rel] = sum
+		}
+	}
+	return done
+}
+
+func ensureEmptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("inspect out dir: %w", err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("out dir %s is not empty; choose a new directory", dir)
+	}
+	return nil
+}
+
+func writeExportManifest(dir string, manifest exportManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode export manifest: %w", err)
+	}
+	tmp := filepath.Join(dir, exportManifestName+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("write export manifest: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, exportManifestName)); err != nil {
+		return fmt.Errorf("write export manifest: %w", err)
+	}
+	return nil
+}
+
+func readExportManifest(dir string) (exportManifest, error) {
+	var manifest exportManifest
+	data, err := os.ReadFile(filepath.Join(dir, exportManifestName))
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("decode export manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// verifyExport re-hashes every file listed in an export's manifest.
+func verifyExport(dir string, progress *progressReporter) error {
+	manifest, err := readExportManifest(dir)
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	if !manifest.Complete {
+		return fmt.Errorf("verify: export manifest in %s is incomplete", dir)
+	}
+
+	var totalBytes int64
+	for _, entry := range manifest.Files {
+		totalBytes += int64(entry.Size)
+	}
+	progress.Start("verify", "files", len(manifest.Files), totalBytes)
+	var failures []string
+	for _, entry := range manifest.Files {
+		sum, err := hashFile(filepath.Join(dir, filepath.FromSlash(entry.Path)))
+		progress.Advance(1, int64(entry.Size))
+		switch {
+		case err != nil:
+			failures = append(failures, fmt.Sprintf("%s: %v", entry.Path, err))
+		case sum != entry.SHA256:
+			failures = append(failures, fmt.Sprintf("%s: checksum %s, manifest %s", entry.Path, sum, entry.SHA256))
+		}
+	}
+	progress.Finish()
+	failures = append(failures, verifySeal(manifest)...)
+
+	if len(failures) > 0 {
+		return fmt.Errorf("verify failed for %d file(s):\n  %s", len(failures), strings.Join(failures, "\n  "))
+	}
+	return nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
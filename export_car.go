@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/saworbit/diffkeeper/pkg/car"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+// carLink is a DAG-JSON link.
+type carLink struct {
+	CID string `json:"/"`
+}
+
+// carFile is the DAG-JSON node for one exported file. Its content is the
+// concatenation of the raw blocks it links to. Fields are declared in
+// DAG-JSON key order.
+type carFile struct {
+	Blocks []carLink `json:"blocks"`
+	Path   string    `json:"path"`
+	Size   int       `json:"size"`
+}
+
+// carManifest is the root DAG-JSON node of an exported CAR.
+type carManifest struct {
+	Agent      string    `json:"agent"`
+	Command    []string  `json:"command,omitempty"`
+	Files      []carFile `json:"files"`
+	FromTime   int64     `json:"from_time,omitempty"`
+	MerkleRoot string    `json:"merkle_root,omitempty"`
+	SessionID  string    `json:"session_id,omitempty"`
+	TargetTime int64     `json:"target_time"`
+	Version    int       `json:"version"`
+}
+
+// writeCAR exports the files in plan as a CARv1 archive: each CAS object (or
+// chunk) becomes a raw block and a DAG-JSON manifest rooted in the header
+// links them to their paths.
+func writeCAR(w io.Writer, plan exportManifest, metas map[string]recorder.MetadataRecord, store *cas.CASStore, progress *progressReporter) error {
+	manifest := carManifest{
+		Agent:      plan.Agent,
+		Command:    plan.Command,
+		FromTime:   plan.FromTime,
+		MerkleRoot: plan.MerkleRoot,
+		SessionID:  plan.SessionID,
+		TargetTime: plan.TargetTime,
+		Version:    exportManifestV1,
+	}
+
+	// Block CIDs come straight from the recorded CAS IDs, so the root can be
+	// computed before any content is read.
+	for _, entry := range plan.Files {
+		meta := metas[entry.Path]
+		file := carFile{Path: entry.Path, Size: meta.Size}
+		for _, id := range casBlockIDs(meta) {
+			c, err := carBlockCID(id)
+			if err != nil {
+				return fmt.Errorf("%s: %w", entry.Path, err)
+			}
+			file.Blocks = append(file.Blocks, carLink{CID: c.String()})
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	root, err := encodeDagJSON(manifest)
+	if err != nil {
+		return err
+	}
+	rootCID := car.NewCID(car.CodecDagJSON, root)
+
+	cw, err := car.NewWriter(w, []car.CID{rootCID})
+	if err != nil {
+		return err
+	}
+	if err := cw.WriteBlock(rootCID, root); err != nil {
+		return err
+	}
+
+	written := make(map[string]bool)
+	for _, entry := range plan.Files {
+		for _, id := range casBlockIDs(metas[entry.Path]) {
+			if written[id] {
+				continue
+			}
+			data, err := store.Get(id)
+			if err != nil {
+				return fmt.Errorf("load CAS object %s: %w", id, err)
+			}
+			c, _ := carBlockCID(id)
+			if err := cw.WriteBlock(c, data); err != nil {
+				return err
+			}
+			written[id] = true
+		}
+		progress.Advance(1, int64(entry.Size))
+	}
+	return cw.Flush()
+}
+
+// casBlockIDs lists the CAS objects holding a record's content, in order.
+func casBlockIDs(meta recorder.MetadataRecord) []string {
+	if len(meta.Chunks) > 0 {
+		return meta.Chunks
+	}
+	return []string{meta.CID}
+}
+
+// carBlockCID maps a CAS ID onto a raw-codec CIDv1. Recorder IDs are hex
+// sha2-256 digests; older stores use base58 multihashes.
+func carBlockCID(id string) (car.CID, error) {
+	if digest, err := hex.DecodeString(id); err == nil && len(digest) == 32 {
+		mh, err := multihash.Encode(digest, multihash.SHA2_256)
+		if err != nil {
+			return nil, err
+		}
+		return car.FromMultihash(car.CodecRaw, mh), nil
+	}
+	mh, err := multihash.FromB58String(id)
+	if err != nil {
+		return nil, fmt.Errorf("unrecognized CAS ID %q: %w", id, err)
+	}
+	return car.FromMultihash(car.CodecRaw, mh), nil
+}
+
+// encodeDagJSON renders v without insignificant whitespace or HTML escaping,
+// as DAG-JSON requires.
+func encodeDagJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, fmt.Errorf("encode DAG-JSON: %w", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
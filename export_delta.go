@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/diff"
+)
+
+// writeExportFile runs write against out, or stdout when out is empty or "-".
+// Files are written beside out and renamed into place once complete.
+func writeExportFile(out string, stdout io.Writer, write func(io.Writer) error) error {
+	if out == "" || out == "-" {
+		bw := bufio.NewWriter(stdout)
+		if err := write(bw); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("output %s already exists", out)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("inspect output: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
+		return fmt.Errorf("create output parent: %w", err)
+	}
+
+	staging := out + exportStagingExt
+	f, err := os.Create(staging)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", staging, err)
+	}
+	bw := bufio.NewWriter(f)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(staging)
+		return err
+	}
+	if err := os.Rename(staging, out); err != nil {
+		return fmt.Errorf("finalize export: %w", err)
+	}
+	return nil
+}
+
+// writeTar streams the files in plan as a tarball, followed by the export
+// manifest so the archive can be verified after extraction.
+func writeTar(w io.Writer, plan exportManifest, open func(rel string) (io.ReadCloser, error)) error {
+	tw := tar.NewWriter(w)
+
+	for _, dir := range plan.Dirs {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     dir.Path + "/",
+			Mode:     int64(dir.Mode.Perm()),
+			ModTime:  time.Unix(0, plan.TargetTime),
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return fmt.Errorf("write tar header for %s: %w", dir.Path, err)
+		}
+	}
+	for i := range plan.Files {
+		entry := &plan.Files[i]
+		mode := int64(0o644)
+		if entry.Mode != 0 {
+			mode = int64(entry.Mode.Perm())
+		}
+		hdr := &tar.Header{
+			Name:    entry.Path,
+			Mode:    mode,
+			Size:    int64(entry.Size),
+			ModTime: time.Unix(0, entry.ModTime),
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("write tar header for %s: %w", entry.Path, err)
+		}
+
+		sum, err := copyTarEntry(tw, entry, open)
+		if err != nil {
+			return err
+		}
+		entry.SHA256 = sum
+	}
+
+	plan.Complete = true
+	manifest, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode export manifest: %w", err)
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    exportManifestName,
+		Mode:    0o644,
+		Size:    int64(len(manifest)),
+		ModTime: time.Unix(0, plan.TargetTime),
+		Format:  tar.FormatPAX,
+	}); err != nil {
+		return fmt.Errorf("write tar manifest: %w", err)
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return fmt.Errorf("write tar manifest: %w", err)
+	}
+	return tw.Close()
+}
+
+// copyTarEntry streams one planned file into the current tar entry and
+// returns its SHA-256.
+func copyTarEntry(tw *tar.Writer, entry *exportManifestEntry, open func(rel string) (io.ReadCloser, error)) (string, error) {
+	src, err := open(entry.Path)
+	if err != nil {
+		return "", fmt.Errorf("load CAS object %s: %w", entry.CID, err)
+	}
+	defer src.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), src); err != nil {
+		return "", fmt.Errorf("write tar entry %s: %w", entry.Path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writePatch renders the files in plan as a git-style patch against the
+// baseline returned by loadBase, comparing both sides after norm. Binary
+// files are reported but not inlined, as are files whose diff would take
+// more than budget bytes of memory (0 = unlimited).
+func writePatch(w io.Writer, plan exportManifest, norm diff.Normalization, budget int64, load func(rel string) ([]byte, error), loadBase func(rel string) ([]byte, bool, error)) error {
+	for _, entry := range plan.Files {
+		oldName, newName := "a/"+entry.Path, "b/"+entry.Path
+		if budget > 0 && 2*int64(entry.Size) > budget {
+			// Diffing copies the file at least once more: skip loading it.
+			if _, err := fmt.Fprintf(w, "diff --git %s %s\nFiles %s and %s differ (too large to diff)\n", oldName, newName, oldName, newName); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := load(entry.Path)
+		if err != nil {
+			return fmt.Errorf("load CAS object %s: %w", entry.CID, err)
+		}
+		base, existed, err := loadBase(entry.Path)
+		if err != nil {
+			return fmt.Errorf("load baseline for %s: %w", entry.Path, err)
+		}
+
+		base, data = norm.Apply(base), norm.Apply(data)
+
+		if _, err := fmt.Fprintf(w, "diff --git %s %s\n", oldName, newName); err != nil {
+			return err
+		}
+		if !existed {
+			oldName = "/dev/null"
+			fmt.Fprintf(w, "new file mode 100644\n")
+		}
+
+		if diff.IsBinary(base) || diff.IsBinary(data) {
+			fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+			continue
+		}
+
+		hunks, err := diff.UnifiedWithin(base, data, diff.DefaultContext, budget)
+		if errors.Is(err, diff.ErrOverBudget) {
+			fmt.Fprintf(w, "Files %s and %s differ (too large to diff)\n", oldName, newName)
+			continue
+		}
+		if hunks == "" {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n%s", oldName, newName, hunks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// displayNormalization returns the text normalization cfg asks for.
+func displayNormalization(cfg *config.DiffConfig) diff.Normalization {
+	norm := diff.Normalization{Encoding: cfg.NormalizeEncoding}
+	switch cfg.LineEndings {
+	case config.LineEndingsLF:
+		norm.EOL = "\n"
+	case config.LineEndingsCRLF:
+		norm.EOL = "\r\n"
+	}
+	return norm
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/glob"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+const (
+	gitCommitPerSecond = "second"
+	gitCommitPerWrite  = "write"
+
+	gitBranch    = "main"
+	gitCommitter = "diffkeeper <diffkeeper@localhost>"
+)
+
+// gitCommitGroup is the set of writes that becomes one commit.
+type gitCommitGroup struct {
+	at      time.Time
+	records []recorder.MetadataRecord
+}
+
+// exportGit materializes the recorded history up to target as a git repository
+// in opts.outDir, one commit per second (or per write). Markers become tags
+// under marker/ pointing at the last commit recorded before them.
+func exportGit(db *pebble.DB, casStore *cas.CASStore, opts exportOptions, target time.Time, sessionStart time.Time) error {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return fmt.Errorf("--format=git requires git on PATH: %w", err)
+	}
+
+	history, err := loadMetadataHistory(db, target)
+	if err != nil {
+		return err
+	}
+	history = recorder.NamespaceHistory(history, opts.cfg.Namespace)
+	var selected []recorder.MetadataRecord
+	for _, meta := range history {
+		if !meta.Observed && glob.MatchAny(opts.paths, filepath.ToSlash(meta.Path)) {
+			selected = append(selected, meta)
+		}
+	}
+	groups := groupCommits(selected, opts.gitCommitPer)
+
+	markers, err := loadMarkers(db)
+	if err != nil {
+		return err
+	}
+
+	outDir := filepath.Clean(opts.outDir)
+	if err := ensureEmptyDir(outDir); err != nil {
+		return err
+	}
+	staging := outDir + exportStagingExt
+	if err := os.RemoveAll(staging); err != nil {
+		return fmt.Errorf("clear stale staging dir: %w", err)
+	}
+	if err := os.MkdirAll(staging, 0o755); err != nil {
+		return fmt.Errorf("create staging dir: %w", err)
+	}
+
+	if err := buildGitRepo(gitPath, staging, groups, markers, sessionStart, casStore); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	if err := os.Remove(outDir); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("replace out dir: %w", err)
+	}
+	if err := os.Rename(staging, outDir); err != nil {
+		return fmt.Errorf("finalize export: %w", err)
+	}
+	return nil
+}
+
+func buildGitRepo(gitPath, dir string, groups []gitCommitGroup, markers map[string]time.Time, sessionStart time.Time, casStore *cas.CASStore) error {
+	runGit := func(stdin io.Reader, args ...string) error {
+		cmd := exec.Command(gitPath, args...)
+		cmd.Dir = dir
+		cmd.Stdin = stdin
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+
+	if err := runGit(nil, "init", "-q"); err != nil {
+		return err
+	}
+	if err := runGit(nil, "symbolic-ref", "HEAD", "refs/heads/"+gitBranch); err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	streamErr := make(chan error, 1)
+	go func() {
+		err := writeFastImport(pw, groups, markers, sessionStart, casStore)
+		pw.CloseWithError(err)
+		streamErr <- err
+	}()
+	importErr := runGit(pr, "fast-import", "--quiet")
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err := <-streamErr; err != nil && err != io.ErrClosedPipe {
+		return err
+	}
+	if importErr != nil {
+		return importErr
+	}
+
+	return runGit(nil, "reset", "-q", "--hard", gitBranch)
+}
+
+// writeFastImport emits a git fast-import stream for groups.
+func writeFastImport(w io.Writer, groups []gitCommitGroup, markers map[string]time.Time, sessionStart time.Time, casStore *cas.CASStore) error {
+	bw := bufio.NewWriter(w)
+
+	writeData := func(data []byte) {
+		fmt.Fprintf(bw, "data %d\n", len(data))
+		bw.Write(data)
+		bw.WriteByte('\n')
+	}
+
+	for i, group := range groups {
+		mark := i + 1
+		fmt.Fprintf(bw, "commit refs/heads/%s\nmark :%d\n", gitBranch, mark)
+		fmt.Fprintf(bw, "committer %s %d +0000\n", gitCommitter, group.at.Unix())
+		writeData([]byte(gitCommitMessage(group, sessionStart)))
+		if i > 0 {
+			fmt.Fprintf(bw, "from :%d\n", mark-1)
+		}
+
+		for _, meta := range group.records {
+			data, err := recorder.ReadContent(casStore, meta)
+			if err != nil {
+				return fmt.Errorf("load CAS object %s: %w", meta.CID, err)
+			}
+			fmt.Fprintf(bw, "M 100644 inline %s\n", filepath.ToSlash(cleanPath(meta.Path)))
+			writeData(data)
+		}
+		bw.WriteByte('\n')
+	}
+
+	names := make([]string, 0, len(markers))
+	for name := range markers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// The tag points at the last commit whose writes precede the marker.
+		idx := sort.Search(len(groups), func(i int) bool { return groups[i].at.After(markers[name]) })
+		ref := gitRefName(name)
+		if idx == 0 || ref == "" {
+			log.Printf("[export] no tag created for marker %q", name)
+			continue
+		}
+		fmt.Fprintf(bw, "reset refs/tags/marker/%s\nfrom :%d\n\n", ref, idx)
+	}
+
+	return bw.Flush()
+}
+
+func gitCommitMessage(group gitCommitGroup, sessionStart time.Time) string {
+	var b strings.Builder
+	offset := group.at.Sub(sessionStart)
+	if sessionStart.IsZero() || offset < 0 {
+		offset = 0
+	}
+	noun := "files"
+	if len(group.records) == 1 {
+		noun = "file"
+	}
+	fmt.Fprintf(&b, "[%02dm:%02ds] %d %s written\n\n", int(offset.Minutes()), int(offset.Seconds())%60, len(group.records), noun)
+	for _, meta := range group.records {
+		fmt.Fprintf(&b, "%-8s %s (%s)\n", strings.ToUpper(meta.Op), meta.Path, formatSize(meta.Size))
+	}
+	return b.String()
+}
+
+// gitRefName maps a marker name onto characters that are always valid in a ref.
+func gitRefName(name string) string {
+	ref := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '-'
+	}, name)
+	return strings.Trim(ref, "-")
+}
+
+// groupCommits buckets chronologically sorted records into commits. Within a
+// commit only the last write to each path is kept.
+func groupCommits(records []recorder.MetadataRecord, per string) []gitCommitGroup {
+	var groups []gitCommitGroup
+	for _, meta := range records {
+		at := time.Unix(0, meta.Timestamp)
+		if per == gitCommitPerSecond {
+			at = at.Truncate(time.Second)
+		}
+		if n := len(groups); n > 0 && groups[n-1].at.Equal(at) {
+			groups[n-1].records = upsertRecord(groups[n-1].records, meta)
+			continue
+		}
+		groups = append(groups, gitCommitGroup{at: at, records: []recorder.MetadataRecord{meta}})
+	}
+	return groups
+}
+
+func upsertRecord(records []recorder.MetadataRecord, meta recorder.MetadataRecord) []recorder.MetadataRecord {
+	for i := range records {
+		if records[i].Path == meta.Path {
+			records[i] = meta
+			return records
+		}
+	}
+	return append(records, meta)
+}
+
+// loadMetadataHistory returns every file write recorded up to target, oldest first.
+func loadMetadataHistory(db *pebble.DB, target time.Time) ([]recorder.MetadataRecord, error) {
+	iter, err := newPrefixIter(db, cas.PrefixMeta)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	cutoff := target.UnixNano()
+	var history []recorder.MetadataRecord
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		if isSessionMetaKey(key) {
+			continue
+		}
+
+		var meta recorder.MetadataRecord
+		if err := json.Unmarshal(iter.Value(), &meta); err != nil {
+			log.Printf("[export] skip corrupt metadata %s: %v", key, err)
+			continue
+		}
+		if meta.Timestamp > cutoff {
+			continue
+		}
+		history = append(history, meta)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Timestamp < history[j].Timestamp })
+	return history, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/merkle"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+// exportSeal carries the Merkle root sealed when the recording ended into an
+// export, so auditors can check the evidence against it.
+type exportSeal struct {
+	Root string `json:"root"`
+	// Version is the merkle.ProofVersion of Root.
+	Version   int               `json:"version,omitempty"`
+	Files     int               `json:"files"`
+	Signature *merkle.Signature `json:"signature,omitempty"`
+	// Complete is set when the export holds exactly the sealed state, so the
+	// root can be recomputed from the exported files alone.
+	Complete bool `json:"complete"`
+}
+
+// loadExportSeal returns the session seal for plan, or nil when the session
+// was never sealed. A full export at or after the session end is checked
+// against the root right away: a mismatch means the state dir changed after
+// the run.
+func loadExportSeal(db *pebble.DB, plan exportManifest, filtered bool) (*exportSeal, error) {
+	end, ok, err := recorder.LoadSessionEnd(db)
+	if err != nil || !ok || end.MerkleRoot == "" {
+		return nil, err
+	}
+	seal := &exportSeal{Root: end.MerkleRoot, Version: end.MerkleVersion, Files: end.Files, Signature: end.Signature}
+
+	if !merkle.SupportedVersion(end.MerkleVersion) {
+		log.Printf("[export] WARNING: session root uses Merkle version %d, which this build cannot recompute", end.MerkleVersion)
+		return seal, nil
+	}
+	if filtered || plan.FromTime != 0 || plan.TargetTime < end.Timestamp || len(plan.Files) != end.Files {
+		return seal, nil
+	}
+	root, err := exportedRoot(plan, func(entry exportManifestEntry) string { return entry.CID })
+	if err != nil {
+		return nil, err
+	}
+	if root != end.MerkleRoot {
+		log.Printf("[export] WARNING: recorded state does not match the sealed session root %s (got %s)", end.MerkleRoot, root)
+		return seal, nil
+	}
+	seal.Complete = true
+	return seal, nil
+}
+
+// exportedRoot computes the session root over plan's files, taking each
+// file's CID from cid.
+func exportedRoot(plan exportManifest, cid func(exportManifestEntry) string) (string, error) {
+	states := make(map[string]string, len(plan.Files))
+	for _, entry := range plan.Files {
+		states[entry.Path] = cid(entry)
+	}
+	root, err := merkle.NewMerkleManager().SessionRoot(states)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(root), nil
+}
+
+// verifySeal recomputes the session root from the exported files' checksums
+// (a recorded CID is the SHA-256 of the content) and checks the signature.
+func verifySeal(manifest exportManifest) []string {
+	seal := manifest.Session
+	if seal == nil || !seal.Complete {
+		return nil
+	}
+
+	if !merkle.SupportedVersion(seal.Version) {
+		return []string{fmt.Sprintf("session root: unsupported Merkle version %d", seal.Version)}
+	}
+
+	var failures []string
+	root, err := exportedRoot(manifest, func(entry exportManifestEntry) string { return entry.SHA256 })
+	if err != nil {
+		return []string{fmt.Sprintf("session root: %v", err)}
+	}
+	if root != seal.Root {
+		failures = append(failures, fmt.Sprintf("session root: computed %s, sealed %s", root, seal.Root))
+	}
+	if seal.Signature != nil {
+		sealed, err := hex.DecodeString(seal.Root)
+		if err == nil {
+			err = seal.Signature.Verify(sealed, nil)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("session signature: %v", err))
+		}
+	}
+	return failures
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/spf13/cobra"
+)
+
+const (
+	flakyOscillates = "oscillates"
+	flakyDiverges   = "differs-across-runs"
+
+	// maxClassifySize caps the versions loaded to guess a cause.
+	maxClassifySize = 4 << 20
+)
+
+// flakyOptions carries the flags accepted by the flaky command.
+type flakyOptions struct {
+	stateDirs   []string
+	maxVariants int
+	minRevisits int
+	jsonOut     bool
+}
+
+func newFlakyCmd() *cobra.Command {
+	var opts flakyOptions
+
+	cmd := &cobra.Command{
+		Use:   "flaky --state-dir <dir> [--state-dir <dir>...]",
+		Short: "Flag files with nondeterministic content",
+		Long: `Flag files with nondeterministic content.
+
+Within a recording, a file oscillates when its content keeps returning to a
+small set of earlier versions (A, B, A, B...). Given several state dirs of the
+same job, files whose final content differs between runs are flagged too.
+Where possible the difference is attributed to embedded timestamps, random
+IDs, reordered JSON keys, or reordered lines.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(opts.stateDirs) == 0 {
+				return fmt.Errorf("state-dir is required")
+			}
+			if opts.maxVariants < 2 {
+				return fmt.Errorf("--max-variants must be at least 2")
+			}
+			return runFlaky(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringArrayVar(&opts.stateDirs, "state-dir", nil, "Directory where Pebble state is stored (repeat to compare runs)")
+	cmd.Flags().IntVar(&opts.maxVariants, "max-variants", 3, "Only flag oscillation between at most this many distinct versions")
+	cmd.Flags().IntVar(&opts.minRevisits, "min-revisits", 1, "Returns to an earlier version needed to flag oscillation")
+	cmd.Flags().BoolVar(&opts.jsonOut, "json", false, "Print JSON instead of a table")
+	return cmd
+}
+
+// flakyFinding is one file flagged as nondeterministic.
+type flakyFinding struct {
+	Path     string `json:"path"`
+	Kind     string `json:"kind"`
+	Run      string `json:"run,omitempty"`
+	Variants int    `json:"variants"`
+	Changes  int    `json:"changes,omitempty"`
+	Revisits int    `json:"revisits,omitempty"`
+	Runs     int    `json:"runs,omitempty"`
+	Cause    string `json:"cause,omitempty"`
+
+	// samples are two differing versions used to guess Cause.
+	samples [2]flakySample
+}
+
+type flakySample struct {
+	store *cas.CASStore
+	meta  recorder.MetadataRecord
+}
+
+func runFlaky(w io.Writer, opts flakyOptions) error {
+	var findings []flakyFinding
+	finals := make([]map[string]flakySample, 0, len(opts.stateDirs))
+
+	for _, dir := range opts.stateDirs {
+		db, casStore, err := openReadOnlyStore(dir)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+		defer db.Close()
+
+		history, err := loadMetadataHistory(db, time.Now())
+		if err != nil {
+			return err
+		}
+
+		for _, f := range detectOscillation(history, opts.maxVariants, opts.minRevisits) {
+			f.samples[0].store, f.samples[1].store = casStore, casStore
+			if len(opts.stateDirs) > 1 {
+				f.Run = dir
+			}
+			findings = append(findings, f)
+		}
+
+		final := make(map[string]flakySample)
+		for _, meta := range history {
+			final[meta.Path] = flakySample{store: casStore, meta: meta}
+		}
+		finals = append(finals, final)
+	}
+
+	if len(finals) > 1 {
+		findings = append(findings, detectRunDivergence(finals)...)
+	}
+
+	for i := range findings {
+		findings[i].Cause = classifyFinding(findings[i])
+	}
+
+	if opts.jsonOut {
+		if findings == nil {
+			findings = []flakyFinding{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(findings)
+	}
+	return writeFlakyTable(w, findings)
+}
+
+// detectOscillation flags paths in history (sorted by time) whose content
+// returns to an earlier version at least minRevisits times while taking at
+// most maxVariants distinct values.
+func detectOscillation(history []recorder.MetadataRecord, maxVariants, minRevisits int) []flakyFinding {
+	type track struct {
+		finding flakyFinding
+		last    string
+		seen    map[string]recorder.MetadataRecord
+	}
+	byPath := make(map[string]*track)
+	var order []string
+
+	for _, meta := range history {
+		if meta.CID == "" {
+			continue
+		}
+		t, ok := byPath[meta.Path]
+		if !ok {
+			t = &track{finding: flakyFinding{Path: meta.Path, Kind: flakyOscillates}, seen: make(map[string]recorder.MetadataRecord)}
+			byPath[meta.Path] = t
+			order = append(order, meta.Path)
+		}
+		if meta.CID == t.last {
+			continue
+		}
+
+		if _, revisit := t.seen[meta.CID]; revisit {
+			t.finding.Revisits++
+		} else {
+			t.seen[meta.CID] = meta
+			switch len(t.seen) {
+			case 1:
+				t.finding.samples[0].meta = meta
+			case 2:
+				t.finding.samples[1].meta = meta
+			}
+		}
+		if t.last != "" {
+			t.finding.Changes++
+		}
+		t.last = meta.CID
+	}
+
+	var findings []flakyFinding
+	for _, path := range order {
+		t := byPath[path]
+		t.finding.Variants = len(t.seen)
+		if t.finding.Revisits >= minRevisits && t.finding.Variants <= maxVariants {
+			findings = append(findings, t.finding)
+		}
+	}
+	return findings
+}
+
+// detectRunDivergence flags paths recorded in every run whose final content
+// is not the same everywhere.
+func detectRunDivergence(finals []map[string]flakySample) []flakyFinding {
+	var paths []string
+	for path := range finals[0] {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var findings []flakyFinding
+	for _, path := range paths {
+		f := flakyFinding{Path: path, Kind: flakyDiverges, Runs: len(finals)}
+		variants := make(map[string]bool)
+		inAll := true
+		for _, final := range finals {
+			s, ok := final[path]
+			if !ok || s.meta.CID == "" {
+				inAll = false
+				break
+			}
+			if !variants[s.meta.CID] {
+				variants[s.meta.CID] = true
+				if len(variants) <= 2 {
+					f.samples[len(variants)-1] = s
+				}
+			}
+		}
+		if !inAll || len(variants) < 2 {
+			continue
+		}
+		f.Variants = len(variants)
+		findings = append(findings, f)
+	}
+	return findings
+}
+
+func classifyFinding(f flakyFinding) string {
+	a, b := f.samples[0], f.samples[1]
+	if a.store == nil || b.store == nil || a.meta.Size > maxClassifySize || b.meta.Size > maxClassifySize {
+		return ""
+	}
+	left, err := recorder.ReadContent(a.store, a.meta)
+	if err != nil {
+		return ""
+	}
+	right, err := recorder.ReadContent(b.store, b.meta)
+	if err != nil {
+		return ""
+	}
+	return classifyNondeterminism(left, right)
+}
+
+var (
+	timestampPattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?|\b1[5-9]\d{8}(\d{3}|\d{6}|\d{9})?\b`)
+	uuidPattern      = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+)
+
+// classifyNondeterminism guesses why two versions of a file differ.
+func classifyNondeterminism(a, b []byte) string {
+	if bytes.Equal(timestampPattern.ReplaceAll(a, nil), timestampPattern.ReplaceAll(b, nil)) {
+		return "embedded timestamp"
+	}
+	if bytes.Equal(uuidPattern.ReplaceAll(a, nil), uuidPattern.ReplaceAll(b, nil)) {
+		return "embedded random ID"
+	}
+
+	var ja, jb any
+	if json.Unmarshal(a, &ja) == nil && json.Unmarshal(b, &jb) == nil && reflect.DeepEqual(ja, jb) {
+		return "reordered JSON keys"
+	}
+
+	la, lb := bytes.Split(a, []byte("\n")), bytes.Split(b, []byte("\n"))
+	if len(la) == len(lb) && len(la) > 1 {
+		less := func(lines [][]byte) func(i, j int) bool {
+			return func(i, j int) bool { return bytes.Compare(lines[i], lines[j]) < 0 }
+		}
+		sort.Slice(la, less(la))
+		sort.Slice(lb, less(lb))
+		if reflect.DeepEqual(la, lb) {
+			return "reordered lines"
+		}
+	}
+	return ""
+}
+
+func writeFlakyTable(w io.Writer, findings []flakyFinding) error {
+	if len(findings) == 0 {
+		_, err := fmt.Fprintln(w, "No nondeterministic files found.")
+		return err
+	}
+
+	for _, f := range findings {
+		detail := fmt.Sprintf("%d variants across %d runs", f.Variants, f.Runs)
+		if f.Kind == flakyOscillates {
+			detail = fmt.Sprintf("%d variants, %d changes, %d revisits", f.Variants, f.Changes, f.Revisits)
+		}
+		if f.Run != "" {
+			detail += ", in " + f.Run
+		}
+		fmt.Fprintf(w, "%-19s %s (%s)\n", f.Kind, f.Path, detail)
+		if f.Cause != "" {
+			fmt.Fprintf(w, "%-19s likely cause: %s\n", "", f.Cause)
+		}
+	}
+	return nil
+}
@@ -3,16 +3,24 @@ module github.com/saworbit/diffkeeper
 go 1.23.0
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/cbergoon/merkletree v0.2.0
 	github.com/cilium/ebpf v0.15.0
 	github.com/cockroachdb/pebble v1.1.5
 	github.com/fsnotify/fsnotify v1.7.0
 	github.com/gabstv/go-bsdiff v1.0.5
+	github.com/hanwen/go-fuse/v2 v2.11.0
 	github.com/klauspost/compress v1.18.0
 	github.com/multiformats/go-multihash v0.2.3
 	github.com/prometheus/client_golang v1.23.2
 	github.com/spf13/cobra v1.8.1
+	github.com/spf13/pflag v1.0.6
 	github.com/ulikunitz/xz v0.5.15
+	go.etcd.io/bbolt v1.4.3
+	go.yaml.in/yaml/v2 v2.4.2
+	golang.org/x/sys v0.37.0
+	google.golang.org/grpc v1.68.1
+	google.golang.org/protobuf v1.36.8
 )
 
 require (
@@ -42,13 +50,11 @@ require (
 	github.com/prometheus/procfs v0.16.1 // indirect
 	github.com/rogpeppe/go-internal v1.11.0 // indirect
 	github.com/spaolacci/murmur3 v1.1.0 // indirect
-	github.com/spf13/pflag v1.0.6 // indirect
-	go.yaml.in/yaml/v2 v2.4.2 // indirect
-	golang.org/x/crypto v0.7.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/exp v0.0.0-20230626212559-97b1e661b5df // indirect
-	golang.org/x/sys v0.37.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
 	golang.org/x/text v0.28.0 // indirect
-	google.golang.org/protobuf v1.36.8 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240903143218-8af14fe29dc1 // indirect
 	lukechampine.com/blake3 v1.1.6 // indirect
 )
 
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/diff"
+	"github.com/saworbit/diffkeeper/pkg/glob"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/spf13/cobra"
+)
+
+// maxGrepLine bounds how much of a single line is matched and kept; the rest
+// of an over-long line is skipped rather than buffered.
+const maxGrepLine = 1 << 20
+
+// grepOptions carries the flags accepted by the grep command.
+type grepOptions struct {
+	stateDir   string
+	paths      []string
+	fixed      bool
+	ignoreCase bool
+	first      bool
+	toTime     string
+}
+
+func newGrepCmd() *cobra.Command {
+	var opts grepOptions
+
+	cmd := &cobra.Command{
+		Use:   "grep <pattern> --state-dir <dir>",
+		Short: "Search every recorded version of files for a pattern",
+		Long: `Search every recorded version of files for a pattern.
+
+Each version containing a match is reported with its offset from the session
+start, so --first answers "when did this line first appear". Versions are
+streamed from the store chunk by chunk; identical versions are searched once.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			for _, p := range opts.paths {
+				if err := glob.Validate(p); err != nil {
+					return err
+				}
+			}
+			return runGrep(cmd.OutOrStdout(), args[0], opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringArrayVar(&opts.paths, "path", nil, "Only search paths matching this glob (repeatable, supports **)")
+	cmd.Flags().BoolVarP(&opts.fixed, "fixed-strings", "F", false, "Treat the pattern as a literal string")
+	cmd.Flags().BoolVarP(&opts.ignoreCase, "ignore-case", "i", false, "Match case-insensitively")
+	cmd.Flags().BoolVar(&opts.first, "first", false, "Only report the first matching version of each path")
+	cmd.Flags().StringVar(&opts.toTime, "to", "latest", "Ignore versions recorded after this point in time")
+	_ = cmd.RegisterFlagCompletionFunc("to", completeTime)
+	return cmd
+}
+
+// grepLine is one matching line of a file version.
+type grepLine struct {
+	num  int
+	text []byte
+}
+
+// grepResult is the outcome of searching one stored version.
+type grepResult struct {
+	lines  []grepLine
+	binary bool
+}
+
+func (r grepResult) matched() bool { return r.binary || len(r.lines) > 0 }
+
+func runGrep(w io.Writer, pattern string, opts grepOptions) error {
+	match, err := compileGrepPattern(pattern, opts.fixed, opts.ignoreCase)
+	if err != nil {
+		return err
+	}
+
+	db, casStore, err := openReadOnlyStore(opts.stateDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	anchors := loadSessionAnchors(db)
+	target, err := parseTargetTime(opts.toTime, anchors)
+	if err != nil {
+		return err
+	}
+	history, err := loadMetadataHistory(db, target)
+	if err != nil {
+		return err
+	}
+
+	cache := make(map[string]grepResult)
+	done := make(map[string]bool)
+	var found int
+	for _, meta := range history {
+		if done[meta.Path] || meta.CID == "" || meta.Observed {
+			continue
+		}
+		if len(opts.paths) > 0 && !glob.MatchAny(opts.paths, filepath.ToSlash(meta.Path)) {
+			continue
+		}
+
+		res, ok := cache[meta.CID]
+		if !ok {
+			rc, err := recorder.OpenContent(casStore, meta)
+			if err != nil {
+				return err
+			}
+			res, err = grepStream(rc, match)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("search %s: %w", meta.Path, err)
+			}
+			cache[meta.CID] = res
+		}
+		if !res.matched() {
+			continue
+		}
+
+		found++
+		writeGrepResult(w, meta, res, anchors.start)
+		if opts.first {
+			done[meta.Path] = true
+		}
+	}
+
+	if found == 0 {
+		return fmt.Errorf("no recorded version matches %q", pattern)
+	}
+	return nil
+}
+
+func compileGrepPattern(pattern string, fixed, ignoreCase bool) (func([]byte) bool, error) {
+	if fixed {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	return re.Match, nil
+}
+
+// grepStream reads r line by line and collects the lines accepted by match.
+// Binary content is only reported as matching, like grep does.
+func grepStream(r io.Reader, match func([]byte) bool) (grepResult, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var res grepResult
+	head, _ := br.Peek(8000)
+	binary := diff.IsBinary(head)
+
+	var line []byte
+	num := 0
+	for {
+		frag, err := br.ReadSlice('\n')
+		if len(line)+len(frag) <= maxGrepLine {
+			line = append(line, frag...)
+		} else if len(line) < maxGrepLine {
+			line = append(line, frag[:maxGrepLine-len(line)]...)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return grepResult{}, err
+		}
+
+		if len(line) > 0 {
+			num++
+			text := bytes.TrimRight(line, "\r\n")
+			if match(text) {
+				if binary {
+					return grepResult{binary: true}, nil
+				}
+				res.lines = append(res.lines, grepLine{num: num, text: append([]byte(nil), text...)})
+			}
+		}
+		if err != nil {
+			return res, nil
+		}
+		line = line[:0]
+	}
+}
+
+func writeGrepResult(w io.Writer, meta recorder.MetadataRecord, res grepResult, sessionStart time.Time) {
+	d := time.Unix(0, meta.Timestamp).Sub(sessionStart)
+	if sessionStart.IsZero() || d < 0 {
+		d = 0
+	}
+	stamp := fmt.Sprintf("[%02dm:%02ds]", int(d.Minutes()), int(d.Seconds())%60)
+
+	if res.binary {
+		fmt.Fprintf(w, "%s %s: binary version matches\n", stamp, meta.Path)
+		return
+	}
+	for _, l := range res.lines {
+		fmt.Fprintf(w, "%s %s:%d: %s\n", stamp, meta.Path, l.num, l.text)
+	}
+}
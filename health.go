@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/internal/metrics"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+const (
+	// healthProbeInterval is how often the state dir is checked to still
+	// take writes.
+	healthProbeInterval = 5 * time.Second
+
+	// healthMaxLag is how long the oldest journal entry may wait for the
+	// processor before the recorder is reported not ready.
+	healthMaxLag = 30 * time.Second
+
+	// watcherFaultWindow is how long a watcher error keeps the recorder
+	// reported unhealthy.
+	watcherFaultWindow = time.Minute
+)
+
+// watcherFaults collects the errors of the file watchers and the eBPF
+// manager, for the health endpoints.
+var watcherFaults faultLog
+
+// faultLog keeps the last error reported to it.
+type faultLog struct {
+	mu  sync.Mutex
+	at  time.Time
+	err error
+}
+
+// Report records err as the latest fault.
+func (f *faultLog) Report(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.at, f.err = time.Now(), err
+}
+
+// Recent returns the latest fault if it was reported within window of now.
+func (f *faultLog) Recent(now time.Time, window time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil || now.Sub(f.at) > window {
+		return nil
+	}
+	return f.err
+}
+
+// recorderHealth answers /healthz and /readyz for record and daemon. It is
+// healthy while the state dir takes writes and no watcher failed in the
+// last minute, and ready once it has started, is healthy, and the
+// processor is no more than healthMaxLag behind the journal.
+type recorderHealth struct {
+	db       *pebble.DB
+	stateDir string
+	now      func() time.Time
+
+	started atomic.Bool
+
+	mu       sync.Mutex
+	storeErr error
+	// failed is the first failed probe, which fails the recording.
+	failed error
+}
+
+// healthReport is the body of both endpoints: "ok" or the failure of each
+// check.
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// startHealth probes stateDir now and then every healthProbeInterval until
+// ctx is done.
+func startHealth(ctx context.Context, db *pebble.DB, stateDir string) *recorderHealth {
+	h := &recorderHealth{db: db, stateDir: stateDir, now: time.Now}
+	h.probe()
+	go func() {
+		ticker := time.NewTicker(healthProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.probe()
+			}
+		}
+	}()
+	return h
+}
+
+// Started reports the recorder ready to capture.
+func (h *recorderHealth) Started() {
+	h.started.Store(true)
+}
+
+// StoreFailure returns the first failed write probe of the state dir, or
+// nil.
+func (h *recorderHealth) StoreFailure() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failed
+}
+
+// Handlers returns the endpoints to serve next to /metrics.
+func (h *recorderHealth) Handlers() map[string]http.Handler {
+	return map[string]http.Handler{
+		"/healthz": h.handler(false),
+		"/readyz":  h.handler(true),
+	}
+}
+
+func (h *recorderHealth) handler(ready bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.report(ready)
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(report)
+	})
+}
+
+// report runs the liveness checks, and with ready the readiness ones too.
+func (h *recorderHealth) report(ready bool) healthReport {
+	report := healthReport{Status: "ok", Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			report.Status = "failing"
+			report.Checks[name] = err.Error()
+			return
+		}
+		report.Checks[name] = "ok"
+	}
+	now := h.now()
+	h.mu.Lock()
+	storeErr := h.storeErr
+	h.mu.Unlock()
+	check("store", storeErr)
+	check("watcher", watcherFaults.Recent(now, watcherFaultWindow))
+	if !ready {
+		return report
+	}
+	if !h.started.Load() {
+		check("startup", errors.New("starting"))
+	} else {
+		check("startup", nil)
+	}
+	lag, err := recorder.JournalLag(h.db, now)
+	if err == nil && lag > healthMaxLag {
+		err = fmt.Errorf("oldest journal entry waiting for %s", lag.Round(time.Second))
+	}
+	check("processor", err)
+	return report
+}
+
+func (h *recorderHealth) probe() {
+	err := probeStateDir(h.stateDir)
+	h.mu.Lock()
+	previous := h.storeErr
+	h.storeErr = err
+	if err != nil && h.failed == nil {
+		h.failed = err
+	}
+	h.mu.Unlock()
+	metrics.SetUp(err == nil)
+	switch {
+	case err != nil && previous == nil:
+		log.Printf("[health] %v", err)
+	case err == nil && previous != nil:
+		log.Printf("[health] state dir takes writes again")
+	}
+}
+
+// probeStateDir writes and syncs a file in dir, as a full or read-only
+// filesystem fails the journal's writes.
+func probeStateDir(dir string) error {
+	f, err := os.CreateTemp(dir, ".health-*")
+	if err != nil {
+		return fmt.Errorf("state dir is not writable: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte("ok"))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("state dir is not writable: %w", err)
+	}
+	return nil
+}
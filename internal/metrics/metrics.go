@@ -109,6 +109,46 @@ var (
 		[]string{"outcome"}, // new | reuse
 	)
 
+	// CASExistenceTotal counts how CAS existence checks were answered.
+	CASExistenceTotal = promauto.With(Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cas_existence_checks_total",
+			Help:      "CAS existence checks by how they were answered",
+		},
+		[]string{"result"}, // cached | filtered | lookup
+	)
+
+	// MerkleCacheTotal counts Merkle tree cache lookups.
+	MerkleCacheTotal = promauto.With(Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "merkle_cache_lookups_total",
+			Help:      "Merkle tree cache lookups by result",
+		},
+		[]string{"result"}, // hit | miss
+	)
+
+	// MerkleCacheHitRatio reports the share of Merkle tree cache lookups
+	// answered from the cache.
+	MerkleCacheHitRatio = promauto.With(Registry).NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "merkle_cache_hit_ratio",
+			Help:      "Fraction of Merkle tree cache lookups that hit",
+		},
+	)
+
+	// ContentCacheTotal counts lookups of reconstructed file versions.
+	ContentCacheTotal = promauto.With(Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "content_cache_lookups_total",
+			Help:      "Reconstructed file version cache lookups by result",
+		},
+		[]string{"result"}, // hit | miss
+	)
+
 	// ChunkDedupRatio reports global dedup ratio across chunk captures.
 	ChunkDedupRatio = promauto.With(Registry).NewGauge(
 		prometheus.GaugeOpts{
@@ -147,6 +187,170 @@ var (
 		[]string{"compression"}, // bsdiff | gzip | none
 	)
 
+	// StateDirFreeBytes reports the free space on the state dir's filesystem.
+	StateDirFreeBytes = promauto.With(Registry).NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "state_dir_free_bytes",
+			Help:      "Bytes available on the filesystem holding the state dir",
+		},
+	)
+
+	// DiskLow is 1 while free space is below the low watermark and captures
+	// store metadata only.
+	DiskLow = promauto.With(Registry).NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "disk_low",
+			Help:      "1 while the state dir is below its free space watermark and content capture is paused",
+		},
+	)
+
+	// QuotaExceededTotal counts how often a recording went over a soft or
+	// hard storage quota.
+	QuotaExceededTotal = promauto.With(Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "quota_exceeded_total",
+			Help:      "Times a recording went over a storage quota",
+		},
+		[]string{"level"}, // soft | hard
+	)
+
+	// ThrottledSecondsTotal counts the time capture and processing paused
+	// to keep diffkeeper within its overhead budget.
+	ThrottledSecondsTotal = promauto.With(Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "throttled_seconds_total",
+			Help:      "Seconds capture and processing paused to stay within the overhead budget",
+		},
+		[]string{"limit"}, // cpu | io
+	)
+
+	// ProcessorWorkers reports how many journal processor workers run.
+	ProcessorWorkers = promauto.With(Registry).NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "processor_workers",
+			Help:      "Number of workers turning journal entries into versions",
+		},
+	)
+
+	// ProcessorEntriesTotal counts journal entries processed by each worker.
+	ProcessorEntriesTotal = promauto.With(Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "processor_entries_total",
+			Help:      "Journal entries processed, by worker",
+		},
+		[]string{"worker"},
+	)
+
+	// TierUploadedBytesTotal counts bytes uploaded to the remote tier.
+	TierUploadedBytesTotal = promauto.With(Registry).NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tier_uploaded_bytes_total",
+			Help:      "Bytes of CAS objects and packs uploaded to the remote tier",
+		},
+	)
+
+	// TierUploadedObjectsTotal counts objects uploaded to the remote tier.
+	TierUploadedObjectsTotal = promauto.With(Registry).NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tier_uploaded_objects_total",
+			Help:      "CAS objects and packs uploaded to the remote tier",
+		},
+	)
+
+	// TierDeduplicatedBytesTotal counts bytes not uploaded because the
+	// remote tier already held them.
+	TierDeduplicatedBytesTotal = promauto.With(Registry).NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tier_deduplicated_bytes_total",
+			Help:      "Bytes of CAS objects skipped because the remote tier already held them",
+		},
+	)
+
+	// TierDeduplicatedObjectsTotal counts objects not uploaded because the
+	// remote tier already held them.
+	TierDeduplicatedObjectsTotal = promauto.With(Registry).NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tier_deduplicated_objects_total",
+			Help:      "CAS objects skipped because the remote tier already held them",
+		},
+	)
+
+	// TierPendingBytes reports what is stored locally but not uploaded yet.
+	TierPendingBytes = promauto.With(Registry).NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "tier_pending_bytes",
+			Help:      "Bytes waiting to be uploaded to the remote tier",
+		},
+	)
+
+	// TierUploadRetriesTotal counts upload batches retried after a failure.
+	TierUploadRetriesTotal = promauto.With(Registry).NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tier_upload_retries_total",
+			Help:      "Remote tier upload batches retried after a failure",
+		},
+	)
+
+	// TierEvictedBytesTotal counts local bytes freed by evicting uploaded
+	// objects.
+	TierEvictedBytesTotal = promauto.With(Registry).NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tier_evicted_bytes_total",
+			Help:      "Local bytes freed by evicting objects to the remote tier",
+		},
+	)
+
+	// ReplicationShippedBytesTotal counts bytes shipped to the standby.
+	ReplicationShippedBytesTotal = promauto.With(Registry).NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replication_shipped_bytes_total",
+			Help:      "Bytes of objects and metadata shipped to the standby",
+		},
+	)
+
+	// ReplicationShippedKeysTotal counts keys shipped to the standby.
+	ReplicationShippedKeysTotal = promauto.With(Registry).NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replication_shipped_keys_total",
+			Help:      "Objects and metadata keys shipped to the standby",
+		},
+	)
+
+	// ReplicationPendingBytes reports what is recorded but not on the
+	// standby yet.
+	ReplicationPendingBytes = promauto.With(Registry).NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "replication_pending_bytes",
+			Help:      "Bytes waiting to be shipped to the standby",
+		},
+	)
+
+	// ReplicationLagSeconds reports how much recent history the standby
+	// lacks.
+	ReplicationLagSeconds = promauto.With(Registry).NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "replication_lag_seconds",
+			Help:      "Seconds since the standby last held everything recorded",
+		},
+	)
+
 	// AgentInfo exposes static information about the running agent.
 	AgentInfo = promauto.With(Registry).NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -172,6 +376,8 @@ var (
 	totalSavedBytes   atomic.Int64
 	chunkTotalCount   atomic.Int64
 	chunkReuseCount   atomic.Int64
+	merkleLookups     atomic.Int64
+	merkleHits        atomic.Int64
 )
 
 func init() {
@@ -246,6 +452,34 @@ func ObserveChunk(outcome string) {
 	ChunkTotal.WithLabelValues(outcome).Inc()
 }
 
+// ObserveCASExistence records how a CAS existence check was answered.
+func ObserveCASExistence(result string) {
+	CASExistenceTotal.WithLabelValues(result).Inc()
+}
+
+// ObserveMerkleCache records a Merkle tree cache lookup and updates the hit
+// ratio.
+func ObserveMerkleCache(hit bool) {
+	lookups := merkleLookups.Add(1)
+	hits := merkleHits.Load()
+	result := "miss"
+	if hit {
+		hits = merkleHits.Add(1)
+		result = "hit"
+	}
+	MerkleCacheHitRatio.Set(float64(hits) / float64(lookups))
+	MerkleCacheTotal.WithLabelValues(result).Inc()
+}
+
+// ObserveContentCache records a lookup in the reconstructed version cache.
+func ObserveContentCache(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	ContentCacheTotal.WithLabelValues(result).Inc()
+}
+
 // ObserveChunkCapture tracks the latency of a streaming chunking pass.
 func ObserveChunkCapture(start time.Time) {
 	elapsed := float64(time.Since(start)) / float64(time.Millisecond)
@@ -284,6 +518,55 @@ func AddDeltas(compression string, count int) {
 	DeltasTotal.WithLabelValues(compression).Add(float64(count))
 }
 
+// ObserveTierUpload records a batch uploaded to the remote tier.
+func ObserveTierUpload(objects int, bytes int64) {
+	TierUploadedObjectsTotal.Add(float64(objects))
+	TierUploadedBytesTotal.Add(float64(bytes))
+}
+
+// ObserveTierDedup records objects the remote tier already held.
+func ObserveTierDedup(objects int, bytes int64) {
+	TierDeduplicatedObjectsTotal.Add(float64(objects))
+	TierDeduplicatedBytesTotal.Add(float64(bytes))
+}
+
+// SetTierPending reports the bytes left to upload to the remote tier.
+func SetTierPending(bytes int64) {
+	if bytes < 0 {
+		bytes = 0
+	}
+	TierPendingBytes.Set(float64(bytes))
+}
+
+// ObserveTierRetry records a retried remote tier upload.
+func ObserveTierRetry() {
+	TierUploadRetriesTotal.Inc()
+}
+
+// ObserveTierEviction records bytes freed by evicting an object.
+func ObserveTierEviction(bytes int) {
+	TierEvictedBytesTotal.Add(float64(bytes))
+}
+
+// ObserveReplication records a batch shipped to the standby.
+func ObserveReplication(keys int, bytes int64) {
+	ReplicationShippedKeysTotal.Add(float64(keys))
+	ReplicationShippedBytesTotal.Add(float64(bytes))
+}
+
+// SetReplicationPending reports the bytes left to ship to the standby.
+func SetReplicationPending(bytes int64) {
+	if bytes < 0 {
+		bytes = 0
+	}
+	ReplicationPendingBytes.Set(float64(bytes))
+}
+
+// SetReplicationLag reports how far the standby is behind.
+func SetReplicationLag(lag time.Duration) {
+	ReplicationLagSeconds.Set(lag.Seconds())
+}
+
 // SetUp toggles the liveness gauge.
 func SetUp(healthy bool) {
 	if healthy {
@@ -293,8 +576,9 @@ func SetUp(healthy bool) {
 	Up.Set(0)
 }
 
-// Serve starts the /metrics HTTP endpoint on the provided address.
-func Serve(ctx context.Context, addr string, logger *log.Logger) error {
+// Serve starts the /metrics HTTP endpoint on the provided address, along
+// with handlers, keyed by path, when given.
+func Serve(ctx context.Context, addr string, logger *log.Logger, handlers map[string]http.Handler) error {
 	if ctx == nil {
 		ctx = context.Background()
 	}
@@ -304,6 +588,9 @@ func Serve(ctx context.Context, addr string, logger *log.Logger) error {
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	for path, handler := range handlers {
+		mux.Handle(path, handler)
+	}
 
 	srv := &http.Server{Addr: addr, Handler: mux}
 
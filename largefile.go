@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+// truncatedKeepBytes is how much of the start and of the end of a file above
+// the capture size limit is stored.
+const truncatedKeepBytes = 64 << 10
+
+// fileCapturer reads changed files under root into the journal. Files above
+// maxBytes (0 = unlimited) keep only their head and tail, with the size and
+// hash of the whole file; in observe mode no file keeps any content. Capture
+// policies can override both per path, and mask secrets. The first capture
+// of a file that was only appended to also records the content it had when
+// recording started, from the baseline scan. While the disk
+// guard reports low space, or a hard quota is exceeded, every file is
+// captured as metadata only; a hard quota may instead stop capture. Hashing
+// a multi-gigabyte file takes seconds, so those are captured off the
+// caller's goroutine, and writes that arrive in the meantime coalesce into
+// one more capture. Files that are not hot paths are queued ahead of those
+// that are. Large files eBPF reports writes to may be captured from just
+// the written ranges; see partialCaptures. Every read is charged to the
+// overhead budget, which may pause capture.
+type fileCapturer struct {
+	root     string
+	maxBytes int64
+	observe  bool
+	journal  *recorder.Journal
+	policies *capturePolicies
+	disk     *diskGuard
+	quota    *quotaGuard
+	baseline *baselineScan
+	partial  *partialCaptures
+	overhead *overheadBudget
+	hot      func(path string) bool
+
+	mu     sync.Mutex
+	idle   *sync.Cond
+	queued map[string]bool
+	queue  []string
+	busy   bool
+	warned map[string]bool
+}
+
+func newFileCapturer(root string, maxBytes int64, observe bool, journal *recorder.Journal) *fileCapturer {
+	c := &fileCapturer{
+		root:     root,
+		maxBytes: maxBytes,
+		observe:  observe,
+		journal:  journal,
+		queued:   make(map[string]bool),
+		warned:   make(map[string]bool),
+	}
+	c.idle = sync.NewCond(&c.mu)
+	return c
+}
+
+// UsePolicies applies per-path capture policies. It must be called before
+// the first Capture.
+func (c *fileCapturer) UsePolicies(policies *capturePolicies) {
+	c.policies = policies
+}
+
+// UseDiskGuard captures metadata only while g reports low space. It must be
+// called before the first Capture.
+func (c *fileCapturer) UseDiskGuard(g *diskGuard) {
+	c.disk = g
+}
+
+// UseQuotaGuard captures metadata only, or nothing, while g reports a hard
+// quota exceeded. It must be called before the first Capture.
+func (c *fileCapturer) UseQuotaGuard(g *quotaGuard) {
+	c.quota = g
+}
+
+// UseBaseline backfills the content files had at scan b on their first
+// capture. It must be called before the first Capture.
+func (c *fileCapturer) UseBaseline(b *baselineScan) {
+	c.baseline = b
+}
+
+// UsePartialCaptures captures large files from the ranges p saw written
+// when it can. It must be called before the first Capture.
+func (c *fileCapturer) UsePartialCaptures(p *partialCaptures) {
+	c.partial = p
+}
+
+// UseOverhead charges the bytes each capture reads to b. It must be called
+// before the first Capture.
+func (c *fileCapturer) UseOverhead(b *overheadBudget) {
+	c.overhead = b
+}
+
+// UseHotPaths queues large files for which hot returns false ahead of
+// those for which it returns true. It must be called before the first
+// Capture.
+func (c *fileCapturer) UseHotPaths(hot func(path string) bool) {
+	c.hot = hot
+}
+
+// limits returns whether path is captured as metadata only and its capture
+// size limit, after policies.
+func (c *fileCapturer) limits(path string) (observe bool, maxBytes int64) {
+	if c.disk.Low() || c.quota.MetadataOnly() {
+		return true, c.maxBytes
+	}
+	switch c.policies.Capture(c.rel(path)) {
+	case config.CaptureFull:
+		return false, 0
+	case config.CaptureMetadata:
+		return true, c.maxBytes
+	case config.CaptureRedact:
+		return false, c.maxBytes
+	}
+	return c.observe, c.maxBytes
+}
+
+// Capture records the current content of path.
+func (c *fileCapturer) Capture(path string) {
+	if c.quota.Stopped() {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	prev, scanned := c.baseline.take(path)
+	observe, maxBytes := c.limits(path)
+	if maxBytes <= 0 || info.Size() <= maxBytes {
+		rel := c.rel(path)
+		// Masking needs the whole content, so masked files are read whole,
+		// as are those stored as one object: a patch stores chunks.
+		storage := c.policies.Storage(rel)
+		patchable := !observe && c.policies.Capture(rel) != config.CaptureRedact &&
+			storage != config.StorageStore && storage != config.StorageWhole
+		if !patchable {
+			c.partial.forget(path)
+		}
+		if observe {
+			c.captureObserved(path)
+			return
+		}
+		if patchable && c.capturePartial(path, info.Size()) {
+			return
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			c.partial.forget(path)
+			return
+		}
+		c.overhead.Spend(len(data))
+		if scanned {
+			if head, ok := prev.appendedTo(data); ok {
+				_ = c.journal.LogBaseline(rel, c.policies.Redact(rel, head), c.baseline.at)
+			}
+		}
+		if err := c.journal.LogEvent(rel, c.policies.Redact(rel, data)); err == nil && patchable {
+			c.partial.captured(path, int64(len(data)), false)
+		} else {
+			c.partial.forget(path)
+		}
+		return
+	}
+	c.partial.forget(path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.queued[path] {
+		return
+	}
+	c.queued[path] = true
+	c.enqueue(path)
+	if !c.busy {
+		c.busy = true
+		go c.drain()
+	}
+}
+
+// capturePartial journals only the ranges of path written since its
+// previous capture, now that it is size bytes, and reports whether it did.
+// When it did not, path is to be read whole.
+func (c *fileCapturer) capturePartial(path string, size int64) bool {
+	patch, ok := c.partial.plan(path, size)
+	if !ok {
+		return false
+	}
+	data, err := readRanges(path, patch.Ranges)
+	if err != nil {
+		// Most likely cut short since; read what is there now.
+		return false
+	}
+	c.overhead.Spend(len(data))
+	if err := c.journal.LogPatch(c.rel(path), data, patch); err != nil {
+		c.partial.forget(path)
+		return true
+	}
+	c.partial.captured(path, size, true)
+	return true
+}
+
+// enqueue queues path behind the other paths of its kind: a path that is
+// not hot goes ahead of every hot one. c.mu must be held.
+func (c *fileCapturer) enqueue(path string) {
+	at := len(c.queue)
+	if c.hot != nil && !c.hot(path) {
+		for i, queued := range c.queue {
+			if c.hot(queued) {
+				at = i
+				break
+			}
+		}
+	}
+	c.queue = slices.Insert(c.queue, at, path)
+}
+
+// Wait blocks until every queued large file is captured.
+func (c *fileCapturer) Wait() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.busy {
+		c.idle.Wait()
+	}
+}
+
+func (c *fileCapturer) drain() {
+	c.mu.Lock()
+	for len(c.queue) > 0 {
+		path := c.queue[0]
+		c.queue = c.queue[1:]
+		delete(c.queued, path)
+		c.mu.Unlock()
+		c.captureLarge(path)
+		c.mu.Lock()
+	}
+	c.busy = false
+	c.idle.Broadcast()
+	c.mu.Unlock()
+}
+
+func (c *fileCapturer) captureLarge(path string) {
+	observe, maxBytes := c.limits(path)
+	if observe {
+		c.captureObserved(path)
+		return
+	}
+	data, trunc, err := readTruncated(path, maxBytes)
+	if err != nil {
+		log.Printf("[record] cannot capture %s: %v", path, err)
+		return
+	}
+	if trunc != nil {
+		// The whole file was read to hash it.
+		c.overhead.Spend(int(trunc.Size))
+	} else {
+		c.overhead.Spend(len(data))
+	}
+	rel := c.rel(path)
+	if trunc == nil {
+		// Shrank below the limit since it was queued.
+		_ = c.journal.LogEvent(rel, c.policies.Redact(rel, data))
+		return
+	}
+	// Mask the head and the tail separately so their lengths stay known.
+	head := c.policies.Redact(rel, data[:trunc.Head])
+	tail := c.policies.Redact(rel, data[trunc.Head:])
+	trunc.Head, trunc.Tail = len(head), len(tail)
+	data = append(head[:len(head):len(head)], tail...)
+
+	c.mu.Lock()
+	first := !c.warned[path]
+	c.warned[path] = true
+	c.mu.Unlock()
+	if first {
+		log.Printf("[record] %s is %s, above the capture size limit; storing its first and last %s",
+			c.rel(path), formatSize(int(trunc.Size)), formatSize(trunc.Head))
+	}
+	_ = c.journal.LogTruncated(c.rel(path), data, *trunc)
+}
+
+func (c *fileCapturer) captureObserved(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		log.Printf("[record] cannot hash %s: %v", path, err)
+		return
+	}
+	c.overhead.Spend(int(size))
+	_ = c.journal.LogObserved(c.rel(path), recorder.Observation{Size: size, SHA256: hex.EncodeToString(h.Sum(nil))})
+}
+
+func (c *fileCapturer) rel(path string) string {
+	if rel, err := filepath.Rel(c.root, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// readRanges reads ranges of path, one after another.
+func readRanges(path string, ranges []recorder.PatchRange) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	n := 0
+	for _, r := range ranges {
+		n += r.Length
+	}
+	data := make([]byte, n)
+	pos := 0
+	for _, r := range ranges {
+		if _, err := f.ReadAt(data[pos:pos+r.Length], r.Offset); err != nil {
+			return nil, err
+		}
+		pos += r.Length
+	}
+	return data, nil
+}
+
+// readTruncated reads path whole if it is at most maxBytes. Otherwise it
+// returns the file's head and tail, each up to truncatedKeepBytes (and
+// together at most maxBytes), with the size and hash of the whole file.
+func readTruncated(path string, maxBytes int64) ([]byte, *recorder.Truncation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	if size <= maxBytes {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(f)
+		return data, nil, err
+	}
+
+	keep := min(int64(truncatedKeepBytes), maxBytes/2)
+	data := make([]byte, 2*keep)
+	if _, err := f.ReadAt(data[:keep], 0); err != nil {
+		return nil, nil, err
+	}
+	if _, err := f.ReadAt(data[keep:], size-keep); err != nil {
+		return nil, nil, err
+	}
+	return data, &recorder.Truncation{
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+		Head:   int(keep),
+		Tail:   int(keep),
+	}, nil
+}
@@ -5,53 +5,110 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/fsnotify/fsnotify"
+	"github.com/saworbit/diffkeeper/internal/metrics"
 	"github.com/saworbit/diffkeeper/internal/version"
 	"github.com/saworbit/diffkeeper/pkg/cas"
 	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/control"
 	"github.com/saworbit/diffkeeper/pkg/ebpf"
+	"github.com/saworbit/diffkeeper/pkg/hooks"
+	"github.com/saworbit/diffkeeper/pkg/merkle"
 	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
 	"github.com/spf13/cobra"
 )
 
-const sessionMetaKey = cas.PrefixMeta + "session:start"
-
 func main() {
 	root := newRootCmd()
 	if err := root.Execute(); err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		os.Exit(exitStatus(err))
 	}
 }
 
 func newRootCmd() *cobra.Command {
+	var output string
+
 	root := &cobra.Command{
 		Use:     "diffkeeper",
 		Short:   "DiffKeeper - CI/CD flight recorder",
 		Version: version.Version,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return applyOutputFormat(cmd, output)
+		},
 	}
+	root.PersistentFlags().StringVar(&output, "output", outputText, "Output format: text, or json for the commands that print a report or summary")
 
-	root.AddCommand(newRecordCmd(), newExportCmd(), newTimelineCmd())
+	root.AddCommand(newRecordCmd(), newExportCmd(), newTimelineCmd(), newCatCmd(), newMarkCmd(), newMountCmd(),
+		newPushCmd(), newPullCmd(), newGCCmd(), newServeCmd(), newSyncServeCmd(), newCICmd(), newCorrelateCmd(), newGrepCmd(), newFlakyCmd(), newStatsCmd(), newReportCmd(), newReloadCmd(), newRecoverCmd(), newMigrateCmd(), newLogCmd(), newMirrorCmd(), newPackCmd(), newProofCmd(), newVerifyProofCmd(), newDoctorCmd(), newRestoreCmd(), newBisectCmd(), newDaemonCmd(), newAttachCmd(), newConvertCmd(), newAttestCmd(), newAuditCmd(), newCollectCmd(), newAgentCmd(), newReplicateCmd(), newBackupCmd(), newRestoreStoreCmd(), newCompactStoreCmd(), newBenchCmd(), newSchemaCmd())
+	registerCompletions(root)
 	return root
 }
 
 func newRecordCmd() *cobra.Command {
 	var stateDir string
+	var configPath string
 	var watchDir string
+	var hashAlgo string
+	var enableEBPF bool
+	var captureBackend string
+	var debounce time.Duration
+	var maxPerSecond int
+	var maxFileSizeMB int
+	var observe, backfill bool
+	var namespace string
+	var minFreeMB int
+	var ignore []string
+	var metricsAddr string
+	var durability string
+	var watchFallback string
+	var watchBackend string
+	var pollInterval time.Duration
+	var signKey string
+	var jsonOut bool
+	var exportOnFailure string
+	var stallTimeout time.Duration
+	var resourceInterval time.Duration
+	var stallKill bool
+	var maxCPUPercent, maxIOMBps int
+	var overheadCgroup bool
+	var passthrough bool
+	var force bool
 
 	cmd := &cobra.Command{
 		Use:   "record -- <command>",
 		Short: "Record raw filesystem events into the Pebble journal",
-		Args:  cobra.MinimumNArgs(1),
+		Long: `Record raw filesystem events into the Pebble journal.
+
+Settings are resolved with precedence env (DIFFKEEPER_*) > flags > config file >
+defaults. Without --config, diffkeeper.yaml, diffkeeper.yml or diffkeeper.toml
+is picked up from the watch directory.
+
+Ignore patterns, debounce, rate limits and profiler thresholds can be changed
+while recording: send SIGHUP to re-read the config, or use "diffkeeper reload".
+
+With --export-on-failure, a nonzero exit of the command exports the state at
+the failure into that directory (or tarball, for a path ending in .tar)
+before record returns.
+
+record exits with the command's status. If the command could not be run it
+exits 127 (not found) or 126; if recording failed, 123 when the state dir
+could not be opened or written and 125 for any other failure of diffkeeper.
+A recording failure after the command ran is logged and noted in the
+session; it only changes the exit status when the command succeeded, and
+not at all with --passthrough-exit-code.`,
+		Args: cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if stateDir == "" {
 				return fmt.Errorf("state-dir is required")
@@ -59,42 +116,147 @@ func newRecordCmd() *cobra.Command {
 			if watchDir == "" {
 				watchDir = "."
 			}
-			return runRecord(stateDir, watchDir, args)
-		},
-	}
-
-	cmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory where Pebble state is stored")
-	cmd.Flags().StringVar(&watchDir, "watch", ".", "Directory to watch for changes")
-	return cmd
-}
-
-func newExportCmd() *cobra.Command {
-	var stateDir string
-	var outDir string
-	var atTime string
 
-	cmd := &cobra.Command{
-		Use:   "export --out <dir> --time <timestamp>",
-		Short: "Reconstruct files from CAS metadata at a given point in time",
-		RunE: func(cmd *cobra.Command, args []string) error {
-			if stateDir == "" {
-				return fmt.Errorf("state-dir is required")
+			flags := cmd.Flags()
+			overrides := func(c *config.DiffConfig) {
+				if flags.Changed("watch") {
+					c.WatchDir = watchDir
+				}
+				if flags.Changed("namespace") {
+					c.Namespace = namespace
+				}
+				if flags.Changed("hash-algo") {
+					c.HashAlgo = hashAlgo
+				}
+				if flags.Changed("ebpf") {
+					c.EBPF.Enable = enableEBPF
+				}
+				if flags.Changed("capture-backend") {
+					c.EBPF.CaptureBackend = captureBackend
+				}
+				if flags.Changed("debounce") {
+					c.DebounceWindow = debounce
+				}
+				if flags.Changed("max-captures-per-second") {
+					c.MaxCapturesPerSecond = maxPerSecond
+				}
+				if flags.Changed("max-file-size-mb") {
+					c.MaxFileSizeMB = maxFileSizeMB
+				}
+				if flags.Changed("observe") {
+					c.Observe = observe
+				}
+				if flags.Changed("backfill") {
+					c.Backfill = backfill
+				}
+				if flags.Changed("min-free-mb") {
+					c.MinFreeMB = minFreeMB
+				}
+				if flags.Changed("stall-timeout") {
+					c.StallTimeout = stallTimeout
+				}
+				if flags.Changed("stall-kill") {
+					c.StallKill = stallKill
+				}
+				if flags.Changed("resource-interval") {
+					c.ResourceInterval = resourceInterval
+				}
+				if flags.Changed("ignore") {
+					c.IgnorePatterns = ignore
+				}
+				if flags.Changed("metrics-addr") {
+					c.MetricsAddr = metricsAddr
+				}
+				if flags.Changed("durability") {
+					c.Durability = durability
+				}
+				if flags.Changed("watch-fallback") {
+					c.WatchFallback = watchFallback
+				}
+				if flags.Changed("watch-backend") {
+					c.WatchBackend = watchBackend
+				}
+				if flags.Changed("poll-interval") {
+					c.PollInterval = pollInterval
+					if c.PollMaxInterval < pollInterval {
+						c.PollMaxInterval = pollInterval
+					}
+				}
+				if flags.Changed("sign-key") {
+					c.SignKey = signKey
+				}
+				if flags.Changed("max-cpu-percent") {
+					c.Overhead.MaxCPUPercent = maxCPUPercent
+				}
+				if flags.Changed("max-io-mbps") {
+					c.Overhead.MaxIOMBps = maxIOMBps
+				}
+				if flags.Changed("overhead-cgroup") {
+					c.Overhead.Cgroup = overheadCgroup
+				}
+			}
+			cfg, used, err := config.Load(configPath, watchDir, overrides)
+			if err != nil {
+				return recorderExit(err)
+			}
+			if used != "" {
+				log.Printf("[record] using config %s", used)
+			}
+			reload := func() (*config.DiffConfig, error) {
+				cfg, _, err := config.Load(used, "", overrides)
+				return cfg, err
+			}
+			opts := recordOptions{stateDir: stateDir, cfg: cfg, reload: reload, force: force}
+			if jsonOut {
+				opts.summary = cmd.OutOrStdout()
+			}
+			runErr := runRecord(opts, args)
+			if exportOnFailure != "" {
+				exportAtFailure(stateDir, exportOnFailure, cfg, runErr)
 			}
-			if outDir == "" {
-				return fmt.Errorf("out directory is required")
+			if passthrough {
+				runErr = passthroughExit(runErr)
 			}
-			return runExport(stateDir, outDir, atTime)
+			return recorderExit(runErr)
 		},
 	}
 
 	cmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory where Pebble state is stored")
-	cmd.Flags().StringVar(&outDir, "out", "", "Destination directory for restored files")
-	cmd.Flags().StringVar(&atTime, "time", "latest", "Timestamp or duration (e.g. 2s, 2025-01-02T15:04:05Z)")
+	cmd.Flags().StringVar(&configPath, "config", "", "Config file (YAML or TOML); default: diffkeeper.yaml in the watch directory")
+	cmd.Flags().StringVar(&watchDir, "watch", ".", "Directory to watch for changes")
+	cmd.Flags().StringVar(&namespace, "namespace", "", "Record into this namespace, isolated from other jobs recorded into the same state dir")
+	cmd.Flags().StringVar(&hashAlgo, "hash-algo", "sha256", "Content hash algorithm: sha256 or blake3")
+	cmd.Flags().BoolVar(&enableEBPF, "ebpf", true, "Capture writes with eBPF when the kernel supports it")
+	cmd.Flags().StringVar(&captureBackend, "capture-backend", "auto", "eBPF write probe backend: auto, fentry or kprobe")
+	cmd.Flags().StringArrayVar(&ignore, "ignore", nil, "Never capture paths matching this glob (repeatable, supports **)")
+	cmd.Flags().DurationVar(&debounce, "debounce", 0, "Wait for writes to a path to settle this long before capturing")
+	cmd.Flags().IntVar(&maxPerSecond, "max-captures-per-second", 0, "Per-path capture rate limit (0 = unlimited)")
+	cmd.Flags().IntVar(&maxFileSizeMB, "max-file-size-mb", 0, "Store only the first and last 64KiB of files larger than this (0 = unlimited)")
+	cmd.Flags().BoolVar(&observe, "observe", false, "Record only the path, size and hash of every capture, not its content")
+	cmd.Flags().BoolVar(&backfill, "backfill", true, "Record the pre-run content of files the run only appends to")
+	cmd.Flags().IntVar(&minFreeMB, "min-free-mb", 256, "Record metadata only while the state dir's filesystem has less than this many MB free (0 = unchecked)")
+	cmd.Flags().StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics on this address (e.g. 127.0.0.1:9911)")
+	cmd.Flags().StringVar(&watchBackend, "watch-backend", config.WatchBackendInotify, "How changes are noticed: inotify, or poll for filesystems without inotify events (NFS, FUSE)")
+	cmd.Flags().DurationVar(&pollInterval, "poll-interval", 500*time.Millisecond, "Shortest interval between scans of the poll backend")
+	cmd.Flags().StringVar(&watchFallback, "watch-fallback", config.WatchFallbackPoll, "How to cover directories beyond the inotify watch limit: poll, ebpf or error")
+	cmd.Flags().StringVar(&durability, "durability", config.DurabilityBatched, "Which writes wait for an fsync: strict, batched or relaxed")
+	cmd.Flags().StringVar(&signKey, "sign-key", "", "PEM private key (PKCS#8 ECDSA P-256 or Ed25519) used to sign the session Merkle root")
+	cmd.Flags().DurationVar(&stallTimeout, "stall-timeout", 0, "Mark the command as stalled after this long without file changes or output (0 = off)")
+	cmd.Flags().DurationVar(&resourceInterval, "resource-interval", time.Second, "How often to sample CPU, memory and I/O of the command's process tree (0 = off)")
+	cmd.Flags().BoolVar(&stallKill, "stall-kill", false, "Stop a stalled command (SIGQUIT, then SIGKILL after 10s)")
+	cmd.Flags().IntVar(&maxCPUPercent, "max-cpu-percent", 0, "Throttle diffkeeper to this share of one CPU core, in percent (0 = unlimited)")
+	cmd.Flags().IntVar(&maxIOMBps, "max-io-mbps", 0, "Throttle the MB per second diffkeeper reads from captured files and stores (0 = unlimited)")
+	cmd.Flags().BoolVar(&overheadCgroup, "overhead-cgroup", false, "Also enforce --max-cpu-percent and --max-io-mbps by moving diffkeeper into a cgroup v2 group of its own")
+	cmd.Flags().StringVar(&exportOnFailure, "export-on-failure", "", "When the command exits nonzero, export the state at the failure to this directory, or tarball if it ends in .tar")
+	cmd.Flags().BoolVar(&passthrough, "passthrough-exit-code", false, "Exit with the command's status even when recording it failed (the failure is still logged and noted in the session)")
+	cmd.Flags().BoolVar(&force, "force", false, "Take over the state dir lock if its previous owner is no longer running")
+	cmd.Flags().BoolVar(&jsonOut, "json", false, "Print a JSON summary of the session to stdout once the command exits")
 	return cmd
 }
 
 func newTimelineCmd() *cobra.Command {
 	var stateDir string
+	var jsonOut bool
 
 	cmd := &cobra.Command{
 		Use:   "timeline",
@@ -103,134 +265,405 @@ func newTimelineCmd() *cobra.Command {
 			if stateDir == "" {
 				return fmt.Errorf("state-dir is required")
 			}
-			return runTimeline(stateDir)
+			return runTimeline(cmd.OutOrStdout(), stateDir, jsonOut)
 		},
 	}
 
 	cmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().BoolVar(&jsonOut, "json", false, "Print JSON instead of a table")
 	return cmd
 }
 
-func runRecord(stateDir, watchDir string, args []string) error {
-	cfg := config.DefaultConfig()
+// journalDrainTimeout bounds how long record waits at exit for pending
+// journal entries to be processed.
+const journalDrainTimeout = 10 * time.Second
+
+// recordOptions carries the resolved settings for the record command.
+type recordOptions struct {
+	stateDir string
+	cfg      *config.DiffConfig
+	// reload re-resolves the configuration on SIGHUP or a reload request.
+	reload func() (*config.DiffConfig, error)
+	// force takes over a stale state dir lock.
+	force bool
+	// summary, when set, gets a JSON summary of the session once the
+	// command exits.
+	summary io.Writer
+}
+
+func runRecord(opts recordOptions, args []string) error {
+	cfg := opts.cfg
+	stateDir, watchDir := opts.stateDir, cfg.WatchDir
+
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	var signKey []byte
+	if cfg.SignKey != "" {
+		var err error
+		if signKey, err = os.ReadFile(cfg.SignKey); err != nil {
+			return fmt.Errorf("read sign key: %w", err)
+		}
+		if _, err := merkle.ParseSigningKey(signKey); err != nil {
+			return fmt.Errorf("sign key %s: %w", cfg.SignKey, err)
+		}
+	}
 
 	if err := os.MkdirAll(stateDir, 0o755); err != nil {
-		return fmt.Errorf("create state dir: %w", err)
+		return storeFailure(fmt.Errorf("create state dir: %w", err))
+	}
+
+	lock, err := statelock.Acquire(stateDir, "record", opts.force)
+	if err != nil {
+		return storeFailure(err)
+	}
+	defer lock.Release()
+
+	var cgroup *overheadCgroup
+	if cfg.Overhead.Cgroup && cfg.Overhead.Enabled() {
+		if cgroup, err = placeInCgroup(cfg.Overhead, stateDir, watchDir); err != nil {
+			log.Printf("[record] cannot move into a cgroup of its own, throttling capture only: %v", err)
+		} else {
+			defer cgroup.Close()
+		}
 	}
 
 	db, err := pebble.Open(stateDir, &pebble.Options{})
 	if err != nil {
-		return fmt.Errorf("open pebble: %w", err)
+		return storeFailure(fmt.Errorf("open pebble: %w", err))
 	}
 	defer db.Close()
 
 	casStore, err := cas.NewCASStore(db, cfg.HashAlgo)
 	if err != nil {
-		return fmt.Errorf("init CAS: %w", err)
+		return storeFailure(fmt.Errorf("init CAS: %w", err))
+	}
+
+	if err := recoverOnOpen(db, casStore); err != nil {
+		return storeFailure(err)
+	}
+
+	policies, err := newCapturePolicies(cfg.Policies)
+	if err != nil {
+		return err
+	}
+	retention := recorder.RetentionPolicy{MaxAge: cfg.Retention.MaxAge, MaxVersions: cfg.Retention.MaxVersions, Downsample: cfg.Retention.Downsample, Namespace: cfg.Namespace}
+	if policies != nil {
+		retention.PathMaxVersions = policies.MaxVersions
+	}
+	pruned, err := recorder.Prune(db, casStore, retention, time.Now())
+	if err != nil {
+		return storeFailure(fmt.Errorf("apply retention: %w", err))
+	}
+	if pruned.Versions > 0 {
+		log.Printf("[record] retention pruned %d versions and %d objects", pruned.Versions, pruned.Objects)
+		recordAudit(stateDir, auditPrune, map[string]any{"namespace": cfg.Namespace, "versions": pruned.Versions, "objects": pruned.Objects})
+	}
+
+	if _, err := casStore.EnableExistenceCache(); err != nil {
+		return storeFailure(fmt.Errorf("load CAS index: %w", err))
 	}
 
 	journal := recorder.NewJournal(db)
-	stopProcessor := recorder.StartProcessor(db, casStore)
+	journal.SetNamespace(cfg.Namespace)
+	overhead := newOverheadBudget(cfg.Overhead)
+	procOpts := recorder.DefaultProcessorOptions()
+	procOpts.Workers = cfg.ProcessorWorkers
+	if policies != nil {
+		procOpts.Storage = policies.Storage
+	}
+	if overhead != nil {
+		procOpts.Pace = overhead.Spend
+	}
+	recorder.ApplyDurability(cfg.Durability, journal, casStore, &procOpts)
+	if cfg.Durability != config.DurabilityStrict {
+		// Bursts of captures share a commit; flushed before the journal is
+		// drained, and before the store closes on early returns.
+		journal.SetBatchWindow(recorder.DefaultBatchWindow)
+		defer journal.Flush()
+	}
+	captures := newCaptureLog(captureLogSize)
+	dispatcher := hooks.New(cfg.Hooks)
+	defer dispatcher.Close()
+	var watchdog *stallWatchdog
+	stalls := &stallHandler{db: db, stateDir: stateDir, timeout: cfg.StallTimeout, kill: cfg.StallKill}
+	if cfg.StallTimeout > 0 {
+		watchdog = newStallWatchdog(cfg.StallTimeout, stalls.Stall)
+	}
+	procOpts.OnStored = func(ev recorder.StoredEvent) {
+		// Hooks and the capture log see paths within the namespace.
+		_, ev.Path = recorder.SplitNamespace(ev.Path)
+		captures.Add(ev)
+		dispatcher.Changed(time.Unix(0, ev.Timestamp), ev.Op, ev.Path, ev.Size)
+		watchdog.Touch()
+	}
+	stopProcessor := recorder.StartProcessorWithOptions(db, casStore, procOpts)
 	defer stopProcessor()
+	if cfg.Durability != config.DurabilityStrict {
+		stopSyncer := recorder.StartSyncer(db, cfg.SyncInterval)
+		defer stopSyncer()
+	}
+	stopTier, err := startTier(db, casStore, cfg)
+	if err != nil {
+		return err
+	}
+	defer stopTier()
+	stopReplication, err := startReplication(db, cfg)
+	if err != nil {
+		return err
+	}
+	defer stopReplication()
 
 	recordSessionStart(db, time.Now())
+	recordSessionInfo(db, args)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if err := startFSRecorder(ctx, watchDir, journal); err != nil {
-		return fmt.Errorf("start fs recorder: %w", err)
+	absWatch, err := filepath.Abs(watchDir)
+	if err != nil {
+		return err
+	}
+	if cfg.Observe {
+		log.Printf("[record] observe mode: recording paths, sizes and hashes only")
+	}
+	disk := startDiskGuard(ctx, db, stateDir, cfg)
+	quota := startQuotaGuard(ctx, db, journal, cfg)
+	health := startHealth(ctx, db, stateDir)
+	tree, err := startTreeWatch(ctx, cfg, policies, journal, disk, quota, overhead, absWatch)
+	if err != nil {
+		return err
+	}
+	gate := tree.gate
+
+	if cfg.MetricsAddr != "" {
+		go func() {
+			if err := metrics.Serve(ctx, cfg.MetricsAddr, log.Default(), health.Handlers()); err != nil {
+				log.Printf("[record] metrics endpoint stopped: %v", err)
+			}
+		}()
 	}
 
-	mgr, err := ebpf.NewManager(stateDir, &cfg.EBPF)
-	if err != nil && !errors.Is(err, ebpf.ErrUnsupported) {
-		return fmt.Errorf("start ebpf manager: %w", err)
+	ctrl, err := startControlServer(ctx, db, stateDir)
+	if err != nil {
+		log.Printf("[record] control socket unavailable, markers disabled: %v", err)
+	} else {
+		defer ctrl.Close()
+	}
+
+	reloader := &recordReloader{load: opts.reload, gate: gate, profiler: tree.profiler, stateDir: stateDir, current: cfg}
+	snapshots := newSnapshotter(db, stateDir)
+	defer snapshots.Close()
+	if ctrl != nil {
+		reloader.register(ctrl)
+		snapshots.register(ctrl)
+		captures.register(ctrl)
+	}
+	watchReloadSignal(ctx, reloader)
+
+	var mgr ebpf.Manager
+	if cfg.EBPF.Enable {
+		mgr, err = ebpf.NewManager(stateDir, &cfg.EBPF)
+		if err != nil && !errors.Is(err, ebpf.ErrUnsupported) {
+			return fmt.Errorf("start ebpf manager: %w", err)
+		}
 	}
 
 	if mgr != nil {
+		if err := mgr.SetPathFilter([]string{absWatch}); err != nil {
+			log.Printf("[eBPF] in-kernel path filter disabled: %v", err)
+		}
+		tree.UseKernelHints(mgr)
 		go func() {
 			if err := mgr.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
 				log.Printf("[eBPF] manager stopped: %v", err)
+				watcherFaults.Report(fmt.Errorf("eBPF manager stopped: %w", err))
 			}
 		}()
 		defer mgr.Close()
 	}
 
+	var events <-chan ebpf.Event
+	if mgr != nil {
+		events = mgr.Events()
+	}
+	tree.StartFallback(ctx, events)
+
+	backend := ebpf.BackendFSNotify
+	if tree.poller != nil {
+		backend = config.WatchBackendPoll
+	}
+	if mgr != nil {
+		backend = mgr.CaptureBackend()
+	}
+	metrics.SetAgentInfo("", "", version.Version, backend)
+
 	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = watchdog.Writer(os.Stdout)
+	cmd.Stderr = watchdog.Writer(os.Stderr)
 	cmd.Stdin = os.Stdin
 	cmd.Dir = watchDir
+	if ctrl != nil {
+		cmd.Env = append(os.Environ(), control.EnvSocket+"="+ctrl.Path())
+	}
 
+	oom := startOOMWatch(cgroup)
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("start command: %w", err)
+		return startFailure(fmt.Errorf("start command: %w", err))
+	}
+	if err := cgroup.Adopt(cmd.Process.Pid); err != nil {
+		log.Printf("[record] command shares diffkeeper's cgroup limits: %v", err)
+	}
+	health.Started()
+	watchCtx, stopWatchdog := context.WithCancel(ctx)
+	if watchdog != nil {
+		stalls.Attach(cmd.Process)
+		watchdog.Touch()
+		go watchdog.Run(watchCtx)
+	}
+	if cfg.ResourceInterval > 0 {
+		go sampleResources(watchCtx, db, cfg.Namespace, cmd.Process.Pid, watchDir, cfg.ResourceInterval)
 	}
 
 	runErr := cmd.Wait()
+	stopWatchdog()
+	tree.Flush()
+	storeErr := health.StoreFailure()
+	if err := journal.Flush(); err != nil {
+		storeErr = err
+	}
+	exitCode := exitCodeOf(runErr)
+	ended := time.Now()
+	recordSessionEnd(db, ended, exitCode)
+	if term, ok := terminationOf(runErr, cmd.Process.Pid, oom, ended); ok {
+		recordTermination(db, term)
+	}
+	if storeErr != nil {
+		recordRecorderError(db, storeErr)
+	}
+	if exitCode != 0 {
+		dispatcher.Fire(hooks.Event{Event: config.HookCommandFailed, Command: args, ExitCode: exitCode, StateDir: stateDir})
+	}
 
-	// Give the processor a short window to drain the journal before closing.
-	time.Sleep(200 * time.Millisecond)
-
-	if flushErr := db.Flush(); flushErr != nil && runErr == nil {
-		runErr = flushErr
+	// Let the processor drain the journal before closing.
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), journalDrainTimeout)
+	if err := recorder.WaitIdle(drainCtx, db); err != nil {
+		log.Printf("[record] journal not fully processed at exit: %v", err)
+	}
+	drainCancel()
+	sealSession(db, signKey)
+	stopReplication()
+	stopTier()
+	if exitCode != 0 {
+		notifyFailure(db, cfg, args, stateDir, exitCode)
 	}
 
+	if flushErr := db.Flush(); flushErr != nil {
+		log.Printf("[record] recording failed and may be incomplete: %v", flushErr)
+		storeErr = flushErr
+	}
+	if opts.summary != nil {
+		if err := writeRecordSummary(opts.summary, db, storeErr); err != nil {
+			log.Printf("[record] failed to print the session summary: %v", err)
+		}
+	}
+	if storeErr != nil {
+		return recordingFailed(runErr, storeErr, exitStoreFailed)
+	}
 	return runErr
 }
 
-func runExport(stateDir, outDir, atTime string) error {
-	if err := os.MkdirAll(outDir, 0o755); err != nil {
-		return fmt.Errorf("create out dir: %w", err)
+// exportAtFailure exports the state at the failure anchor to out when the
+// recorded command exited nonzero. Record errors that are not a command
+// exit leave no failure to anchor, so nothing is exported for them. Export
+// errors are logged; record still reports the command's status.
+func exportAtFailure(stateDir, out string, cfg *config.DiffConfig, runErr error) {
+	var exitErr *exec.ExitError
+	if !errors.As(runErr, &exitErr) {
+		return
 	}
-
-	db, err := pebble.Open(stateDir, &pebble.Options{ReadOnly: true})
-	if err != nil {
-		return fmt.Errorf("open pebble: %w", err)
+	opts := exportOptions{stateDir: stateDir, outDir: out, atTime: "failure", format: exportFormatDir, cfg: cfg}
+	if strings.EqualFold(filepath.Ext(out), ".tar") {
+		opts.format = exportFormatTar
 	}
-	defer db.Close()
+	if err := runExport(opts); err != nil {
+		log.Printf("[record] export on failure to %s failed: %v", out, err)
+		return
+	}
+	log.Printf("[record] exported the state at the failure to %s", out)
+	notifyExportCompleted(cfg, opts)
+}
 
+// loadEnvConfig resolves the configuration for commands without a config
+// file with the precedence config.Load uses: DIFFKEEPER_* variables, then
+// flags (may be nil), then defaults.
+func loadEnvConfig(flags func(*config.DiffConfig)) (*config.DiffConfig, error) {
 	cfg := config.DefaultConfig()
-	casStore, err := cas.NewCASStore(db, cfg.HashAlgo)
-	if err != nil {
-		return fmt.Errorf("init CAS: %w", err)
+	if flags != nil {
+		flags(cfg)
 	}
+	config.ApplyEnv(cfg)
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
 
-	sessionStart := loadSessionStart(db)
-	targetTime, err := parseTargetTime(atTime, sessionStart)
+// openReadOnlyStore opens a recorded state dir for reconstruction.
+func openReadOnlyStore(stateDir string) (*pebble.DB, *cas.CASStore, error) {
+	cfg, err := loadEnvConfig(nil)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	return openReadOnlyStoreWithConfig(stateDir, cfg)
+}
 
-	records, err := loadMetadataAt(db, targetTime)
+// openReadOnlyStoreWithConfig is openReadOnlyStore with an already resolved
+// configuration.
+func openReadOnlyStoreWithConfig(stateDir string, cfg *config.DiffConfig) (*pebble.DB, *cas.CASStore, error) {
+	db, err := openReadOnlyDB(stateDir)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	for path, meta := range records {
-		data, err := casStore.Get(meta.CID)
-		if err != nil {
-			return fmt.Errorf("load CAS object %s: %w", meta.CID, err)
-		}
-
-		relPath := cleanPath(path)
-		dest := filepath.Join(outDir, relPath)
-
-		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
-			return fmt.Errorf("create parent for %s: %w", dest, err)
-		}
-
-		if err := os.WriteFile(dest, data, 0o644); err != nil {
-			return fmt.Errorf("write %s: %w", dest, err)
-		}
+	casStore, err := cas.NewCASStore(db, cfg.HashAlgo)
+	if err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("init CAS: %w", err)
+	}
+	if err := enableReadThrough(casStore, cfg); err != nil {
+		db.Close()
+		return nil, nil, err
 	}
+	return db, casStore, nil
+}
 
-	return nil
+// timelineEvent is a line of the timeline: a capture, an attribute change
+// or a marker.
+type timelineEvent struct {
+	Time time.Time `json:"time"`
+	// Offset is the time since the session started.
+	Offset float64 `json:"offset_seconds"`
+	Op     string  `json:"op"`
+	// Path is the marker name for markers.
+	Path      string `json:"path"`
+	Size      *int   `json:"size,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Observed  bool   `json:"observed,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+}
+
+// timelineReport is what timeline prints with --json.
+type timelineReport struct {
+	SessionStart time.Time       `json:"session_start"`
+	Events       []timelineEvent `json:"events"`
 }
 
-func runTimeline(stateDir string) error {
-	db, err := pebble.Open(stateDir, &pebble.Options{ReadOnly: true})
+func runTimeline(w io.Writer, stateDir string, jsonOut bool) error {
+	db, err := openReadOnlyDB(stateDir)
 	if err != nil {
-		return fmt.Errorf("open pebble: %w", err)
+		return err
 	}
 	defer db.Close()
 
@@ -245,22 +678,11 @@ func runTimeline(stateDir string) error {
 	}
 	defer iter.Close()
 
-	fmt.Printf("Session Start: %s\n", sessionStart.Format(time.RFC3339))
-	fmt.Println("TIME       OP       PATH")
-	fmt.Println("------------------------------------------------")
-
-	type Event struct {
-		TS   time.Time
-		Path string
-		Op   string
-		Size int
-	}
-
-	var events []Event
+	events := []timelineEvent{}
 
 	for iter.First(); iter.Valid(); iter.Next() {
 		key := string(iter.Key())
-		if key == sessionMetaKey {
+		if isSessionMetaKey(key) {
 			continue
 		}
 
@@ -271,11 +693,17 @@ func runTimeline(stateDir string) error {
 			continue
 		}
 
-		events = append(events, Event{
-			TS:   time.Unix(0, meta.Timestamp),
-			Path: meta.Path,
-			Op:   meta.Op,
-			Size: meta.Size,
+		size := meta.Size
+		if meta.Truncated != nil {
+			size = int(meta.Truncated.Size)
+		}
+		events = append(events, timelineEvent{
+			Time:      time.Unix(0, meta.Timestamp),
+			Path:      meta.Path,
+			Op:        meta.Op,
+			Size:      &size,
+			Truncated: meta.Truncated != nil,
+			Observed:  meta.Observed,
 		})
 	}
 
@@ -283,130 +711,90 @@ func runTimeline(stateDir string) error {
 		return err
 	}
 
-	sort.Slice(events, func(i, j int) bool {
-		return events[i].TS.Before(events[j].TS)
-	})
-
-	for _, e := range events {
-		duration := e.TS.Sub(sessionStart)
-		if duration < 0 {
-			duration = 0
-		}
-
-		fmt.Printf(
-			"[%02dm:%02ds] %-8s %s (%s)\n",
-			int(duration.Minutes()),
-			int(duration.Seconds())%60,
-			strings.ToUpper(e.Op),
-			e.Path,
-			formatSize(e.Size),
-		)
-	}
-
-	return nil
-}
-
-func loadMetadataAt(db *pebble.DB, target time.Time) (map[string]recorder.MetadataRecord, error) {
-	iter, err := newPrefixIter(db, cas.PrefixMeta)
+	attrs, err := recorder.AttrHistory(db, time.Now())
 	if err != nil {
-		return nil, err
-	}
-	defer iter.Close()
-
-	records := make(map[string]recorder.MetadataRecord)
-	cutoff := target.UnixNano()
-
-	for iter.First(); iter.Valid(); iter.Next() {
-		key := string(iter.Key())
-		if key == sessionMetaKey {
-			continue
-		}
-
-		val := append([]byte(nil), iter.Value()...)
-		var meta recorder.MetadataRecord
-		if err := json.Unmarshal(val, &meta); err != nil {
-			log.Printf("[export] skip corrupt metadata %s: %v", key, err)
-			continue
-		}
-
-		if meta.Timestamp > cutoff {
-			continue
-		}
-
-		if prev, ok := records[meta.Path]; !ok || meta.Timestamp > prev.Timestamp {
-			records[meta.Path] = meta
-		}
+		return err
 	}
-
-	if err := iter.Error(); err != nil {
-		return nil, err
+	for _, rec := range attrs {
+		events = append(events, timelineEvent{Time: time.Unix(0, rec.Timestamp), Path: rec.Path, Op: rec.Op, Mode: rec.Mode.String()})
 	}
 
-	return records, nil
-}
-
-func recordSessionStart(db *pebble.DB, start time.Time) {
-	if db == nil {
-		return
+	markers, err := loadMarkers(db)
+	if err != nil {
+		return err
 	}
-
-	val := []byte(fmt.Sprintf("%020d", start.UnixNano()))
-
-	if _, closer, err := db.Get([]byte(sessionMetaKey)); err == nil {
-		closer.Close()
-		return
+	for name, ts := range markers {
+		events = append(events, timelineEvent{Time: ts, Path: name, Op: "mark"})
 	}
 
-	if err := db.Set([]byte(sessionMetaKey), val, pebble.Sync); err != nil {
-		log.Printf("[record] failed to record session start: %v", err)
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	for i := range events {
+		events[i].Offset = max(events[i].Time.Sub(sessionStart), 0).Seconds()
 	}
-}
 
-func loadSessionStart(db *pebble.DB) time.Time {
-	val, closer, err := db.Get([]byte(sessionMetaKey))
-	if err != nil {
-		return time.Time{}
+	if jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(timelineReport{SessionStart: sessionStart, Events: events})
 	}
-	defer closer.Close()
 
-	ts, err := strconv.ParseInt(strings.TrimSpace(string(val)), 10, 64)
-	if err != nil {
-		return time.Time{}
+	fmt.Fprintf(w, "Session Start: %s\n", sessionStart.Format(time.RFC3339))
+	fmt.Fprintln(w, "TIME       OP       PATH")
+	fmt.Fprintln(w, "------------------------------------------------")
+	for _, e := range events {
+		duration := max(e.Time.Sub(sessionStart), 0)
+		fmt.Fprintf(w, "[%02dm:%02ds] %-8s %s", int(duration.Minutes()), int(duration.Seconds())%60, strings.ToUpper(e.Op), e.Path)
+		if detail := e.detail(); detail != "" {
+			fmt.Fprintf(w, " (%s)", detail)
+		}
+		fmt.Fprintln(w)
 	}
 
-	return time.Unix(0, ts)
+	return nil
 }
 
-func parseTargetTime(raw string, sessionStart time.Time) (time.Time, error) {
-	if raw == "" || raw == "latest" {
-		return time.Now(), nil
+// detail is the size or mode shown after the path; empty for markers.
+func (e timelineEvent) detail() string {
+	if e.Size == nil {
+		return e.Mode
 	}
-
-	if dur, err := time.ParseDuration(raw); err == nil {
-		if sessionStart.IsZero() {
-			return time.Time{}, fmt.Errorf("session start unknown; cannot apply duration %s", raw)
-		}
-		return sessionStart.Add(dur), nil
+	detail := formatSize(*e.Size)
+	if e.Truncated {
+		detail += ", truncated"
 	}
-
-	if ts, err := time.Parse(time.RFC3339, raw); err == nil {
-		return ts, nil
+	if e.Observed {
+		detail += ", observed"
 	}
+	return detail
+}
 
-	return time.Time{}, fmt.Errorf("invalid time value %q", raw)
+func loadMetadataAt(db *pebble.DB, target time.Time) (map[string]recorder.MetadataRecord, error) {
+	return recorder.StateAt(db, target)
 }
 
-func startFSRecorder(ctx context.Context, root string, journal *recorder.Journal) error {
-	if journal == nil {
-		return fmt.Errorf("journal is not initialized")
+// exitCodeOf maps a Wait error to the child's exit status (-1 when killed by a signal).
+func exitCodeOf(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
 	}
+	return -1
+}
 
-	absRoot, err := filepath.Abs(root)
-	if err != nil {
-		return err
+// startFSRecorder watches root recursively and offers every written file to
+// gate, which decides when it is captured. Directories beyond the inotify
+// watch limit are handed to fallback.
+func startFSRecorder(ctx context.Context, root string, gate *captureGate, fallback *watchFallback) error {
+	if gate == nil {
+		return fmt.Errorf("capture gate is not initialized")
 	}
 
-	if err := os.MkdirAll(absRoot, 0o755); err != nil {
+	if err := os.MkdirAll(root, 0o755); err != nil {
 		return err
 	}
 
@@ -415,7 +803,7 @@ func startFSRecorder(ctx context.Context, root string, journal *recorder.Journal
 		return err
 	}
 
-	if err := addWatchRecursive(watcher, absRoot); err != nil {
+	if err := addWatchRecursive(watcher, root, gate.Ignored, fallback); err != nil {
 		watcher.Close()
 		return err
 	}
@@ -427,28 +815,29 @@ func startFSRecorder(ctx context.Context, root string, journal *recorder.Journal
 			case <-ctx.Done():
 				return
 			case evt := <-watcher.Events:
-				if evt.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+				if gate.Ignored(evt.Name) {
+					continue
+				}
+				switch {
+				case evt.Op&(fsnotify.Create|fsnotify.Write) != 0:
 					info, err := os.Stat(evt.Name)
 					if err == nil && info.IsDir() && evt.Op&fsnotify.Create != 0 {
-						_ = watcher.Add(evt.Name)
-						continue
-					}
-
-					data, err := os.ReadFile(evt.Name)
-					if err != nil {
+						watchNewDir(watcher, evt.Name, gate, fallback)
 						continue
 					}
 
-					path := evt.Name
-					if rel, relErr := filepath.Rel(absRoot, evt.Name); relErr == nil {
-						path = rel
+					gate.Offer(evt.Name)
+				case evt.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+					gate.OfferRemove(evt.Name)
+				case evt.Op&fsnotify.Chmod != 0:
+					if info, err := os.Lstat(evt.Name); err == nil {
+						gate.OfferAttr(recorder.OpChmod, evt.Name, info.Mode())
 					}
-
-					_ = journal.LogEvent(path, data)
 				}
 			case err := <-watcher.Errors:
 				if err != nil {
 					log.Printf("[record] watcher error: %v", err)
+					watcherFaults.Report(err)
 				}
 			}
 		}
@@ -457,7 +846,62 @@ func startFSRecorder(ctx context.Context, root string, journal *recorder.Journal
 	return nil
 }
 
-func addWatchRecursive(watcher *fsnotify.Watcher, root string) error {
+// watchNewDir watches a directory created during the recording and its
+// subdirectories. Files written before the watch was in place are offered
+// right away, so a quick mkdir and write is not missed.
+func watchNewDir(watcher *fsnotify.Watcher, dir string, gate *captureGate, fallback *watchFallback) {
+	_ = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			// Removed again before the walk reached it.
+			return nil
+		}
+		if gate.Ignored(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			if d.Type().IsRegular() {
+				gate.Offer(path)
+			}
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			gate.OfferAttr(recorder.OpMkdir, path, info.Mode())
+		}
+		if err := watcher.Add(path); err != nil {
+			if err := fallback.Add(path, err, false); err != nil {
+				log.Printf("[record] cannot watch %s: %v", path, err)
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// startPollRecorder scans root for new or changed files and offers them to
+// gate, for filesystems that deliver no inotify events. Files present at
+// start are taken as unchanged, as with startFSRecorder.
+func startPollRecorder(ctx context.Context, root string, gate *captureGate, minInterval, maxInterval time.Duration) (*dirPoller, error) {
+	if gate == nil {
+		return nil, fmt.Errorf("capture gate is not initialized")
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	poller := newDirPoller(gate, minInterval, maxInterval)
+	poller.Add(root, true)
+	log.Printf("[record] polling %s every %s to %s", root, minInterval, maxInterval)
+	go poller.Run(ctx)
+	return poller, nil
+}
+
+// addWatchRecursive watches every directory under root that is not ignored.
+// A directory refused for lack of inotify watches goes to fallback with its
+// whole subtree.
+func addWatchRecursive(watcher *fsnotify.Watcher, root string, ignored func(string) bool, fallback *watchFallback) error {
 	return filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -465,7 +909,16 @@ func addWatchRecursive(watcher *fsnotify.Watcher, root string) error {
 		if !d.IsDir() {
 			return nil
 		}
-		return watcher.Add(path)
+		if path != root && ignored(path) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			if err := fallback.Add(path, err, true); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		return nil
 	})
 }
 
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/control"
+	"github.com/spf13/cobra"
+)
+
+const opMark = "mark"
+
+func newMarkCmd() *cobra.Command {
+	var stateDir string
+	var socketPath string
+
+	cmd := &cobra.Command{
+		Use:   "mark <name>",
+		Short: "Drop a named marker into a running recording",
+		Long: "Drop a named marker into a running recording. Markers appear in the timeline and\n" +
+			"can be used as export anchors via --time event:<name>. Inside a recorded command the\n" +
+			"recorder is found through $" + control.EnvSocket + "; elsewhere pass --state-dir.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateMarkerName(args[0]); err != nil {
+				return err
+			}
+
+			path := socketPath
+			if path == "" {
+				path = os.Getenv(control.EnvSocket)
+			}
+			if path == "" && stateDir != "" {
+				path = control.SocketPath(stateDir)
+			}
+			if path == "" {
+				return fmt.Errorf("no recorder found: run inside `diffkeeper record` or pass --state-dir")
+			}
+
+			_, err := control.Call(path, control.Request{Op: opMark, Name: args[0]})
+			return err
+		},
+	}
+
+	cmd.Flags().StringVar(&stateDir, "state-dir", "", "State dir of the running recording")
+	cmd.Flags().StringVar(&socketPath, "socket", "", "Control socket path (overrides $"+control.EnvSocket+")")
+	return cmd
+}
+
+// startControlServer exposes the recorder's control socket for the given state dir.
+func startControlServer(ctx context.Context, db *pebble.DB, stateDir string) (*control.Server, error) {
+	srv, err := control.Listen(control.SocketPath(stateDir))
+	if err != nil {
+		return nil, err
+	}
+
+	srv.Handle(opMark, func(req control.Request) (any, error) {
+		return nil, recordMarker(db, req.Name, time.Now())
+	})
+	srv.Handle(opCompact, func(control.Request) (any, error) {
+		return nil, compactStore(db, nil)
+	})
+
+	go srv.Serve(ctx)
+	return srv, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+	"github.com/spf13/cobra"
+)
+
+// migrateOptions carries the flags accepted by the migrate command.
+type migrateOptions struct {
+	stateDir string
+	dryRun   bool
+	jsonOut  bool
+	force    bool
+}
+
+func newMigrateCmd() *cobra.Command {
+	var opts migrateOptions
+
+	cmd := &cobra.Command{
+		Use:   "migrate --state-dir <dir>",
+		Short: "Upgrade a state dir to the current schema version",
+		Long: `Upgrade a state dir to the current schema version.
+
+Every pending migration runs in a single batch, so an interrupted run leaves
+the state dir as it was. record and recover migrate automatically when they
+open an older state dir; migrate lets you do it ahead of time, or see what
+would change with --dry-run.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			return runMigrate(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "Report pending migrations without changing the state dir")
+	cmd.Flags().BoolVar(&opts.jsonOut, "json", false, "Print JSON instead of a summary")
+	cmd.Flags().BoolVar(&opts.force, "force", false, "Take over the state dir lock if its previous owner is no longer running")
+	return cmd
+}
+
+func runMigrate(w io.Writer, opts migrateOptions) error {
+	if _, err := os.Stat(opts.stateDir); err != nil {
+		return fmt.Errorf("open state dir: %w", err)
+	}
+	lock, err := statelock.Acquire(opts.stateDir, "migrate", opts.force)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	db, err := pebble.Open(opts.stateDir, &pebble.Options{ErrorIfNotExists: true})
+	if err != nil {
+		return fmt.Errorf("open pebble: %w", err)
+	}
+	defer db.Close()
+
+	report, err := recorder.Migrate(db, opts.dryRun)
+	if err != nil {
+		return err
+	}
+	if !opts.dryRun && report.From != report.To {
+		recordAudit(opts.stateDir, auditMigrate, map[string]any{"from": report.From, "to": report.To, "records": report.Records()})
+	}
+
+	if opts.jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	writeMigrationReport(w, report)
+	return nil
+}
+
+func writeMigrationReport(w io.Writer, report recorder.MigrationReport) {
+	if len(report.Steps) == 0 {
+		fmt.Fprintf(w, "State dir is at schema version %d; nothing to migrate.\n", report.To)
+		return
+	}
+	for _, step := range report.Steps {
+		fmt.Fprintf(w, "v%d: %s (%d records)\n", step.Version, step.Description, step.Records)
+	}
+	if report.DryRun {
+		fmt.Fprintf(w, "Dry run: schema version %d would be migrated to %d.\n", report.From, report.To)
+		return
+	}
+	fmt.Fprintf(w, "Migrated schema version %d to %d.\n", report.From, report.To)
+}
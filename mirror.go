@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/glob"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/spf13/cobra"
+)
+
+// mirrorTempPrefix marks files being written by mirror; they are renamed into
+// place so readers of the mirror never see a partial file.
+const mirrorTempPrefix = ".diffkeeper-mirror-"
+
+// mirrorOptions carries the flags accepted by the mirror command.
+type mirrorOptions struct {
+	stateDir string
+	outDir   string
+	interval time.Duration
+	paths    []string
+	once     bool
+}
+
+func newMirrorCmd() *cobra.Command {
+	var opts mirrorOptions
+
+	cmd := &cobra.Command{
+		Use:   "mirror --state-dir <dir> --out <dir>",
+		Short: "Keep a directory in sync with the latest recorded state",
+		Long: `Keep a directory in sync with the latest recorded state.
+
+Every --interval, files whose newest recorded version changed are rewritten in
+--out (atomically, via rename), so the directory can be tailed or shared while
+the recording is still running. Files mirror wrote earlier but that are no
+longer recorded (e.g. pruned by retention) are removed. Stop with Ctrl-C.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			if opts.outDir == "" {
+				return fmt.Errorf("--out is required")
+			}
+			if opts.interval <= 0 {
+				return fmt.Errorf("--interval must be positive")
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return runMirror(ctx, opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&opts.outDir, "out", "", "Directory to keep in sync")
+	cmd.Flags().DurationVar(&opts.interval, "interval", time.Second, "How often to pick up new versions")
+	cmd.Flags().StringArrayVar(&opts.paths, "path", nil, "Only mirror paths matching this glob (repeatable, supports **)")
+	cmd.Flags().BoolVar(&opts.once, "once", false, "Sync once and exit")
+	return cmd
+}
+
+func runMirror(ctx context.Context, opts mirrorOptions) error {
+	if err := os.MkdirAll(opts.outDir, 0o755); err != nil {
+		return fmt.Errorf("create output dir: %w", err)
+	}
+	cfg, err := loadEnvConfig(nil)
+	if err != nil {
+		return err
+	}
+
+	m := &mirror{outDir: opts.outDir, paths: opts.paths, applied: make(map[string]string)}
+	for {
+		stats, err := m.syncFrom(opts.stateDir, cfg)
+		if err != nil {
+			if opts.once {
+				return err
+			}
+			log.Printf("[mirror] sync failed, retrying: %v", err)
+		} else if stats.Updated > 0 || stats.Removed > 0 {
+			log.Printf("[mirror] %d updated, %d removed (%d files mirrored)", stats.Updated, stats.Removed, len(m.applied))
+		}
+
+		if opts.once {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(opts.interval):
+		}
+	}
+}
+
+// mirror tracks which version of each path is present in outDir.
+type mirror struct {
+	outDir string
+	paths  []string
+	// applied maps a mirrored relative path to the CID written for it.
+	applied map[string]string
+}
+
+// mirrorStats counts the changes made by one sync.
+type mirrorStats struct {
+	Updated int
+	Removed int
+}
+
+func (m *mirror) syncFrom(stateDir string, cfg *config.DiffConfig) (mirrorStats, error) {
+	db, snapshot, err := openReadOnlyOrSnapshot(stateDir)
+	if err != nil {
+		return mirrorStats{}, err
+	}
+	defer releaseSnapshot(stateDir, snapshot)
+	defer db.Close()
+
+	casStore, err := cas.NewCASStore(db, cfg.HashAlgo)
+	if err != nil {
+		return mirrorStats{}, fmt.Errorf("init CAS: %w", err)
+	}
+	if err := enableReadThrough(casStore, cfg); err != nil {
+		return mirrorStats{}, err
+	}
+	return m.sync(db, casStore)
+}
+
+// sync brings outDir up to date with the newest version of every path.
+func (m *mirror) sync(db *pebble.DB, casStore *cas.CASStore) (mirrorStats, error) {
+	var stats mirrorStats
+
+	records, err := loadMetadataAt(db, time.Now())
+	if err != nil {
+		return stats, err
+	}
+
+	latest := make(map[string]recorder.MetadataRecord)
+	for path, meta := range records {
+		if !meta.Observed && glob.MatchAny(m.paths, filepath.ToSlash(path)) {
+			latest[filepath.ToSlash(cleanPath(path))] = meta
+		}
+	}
+
+	rels := make([]string, 0, len(latest))
+	for rel := range latest {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	for _, rel := range rels {
+		meta := latest[rel]
+		if m.applied[rel] == meta.CID {
+			continue
+		}
+		if err := m.write(rel, casStore, meta); err != nil {
+			return stats, err
+		}
+		m.applied[rel] = meta.CID
+		stats.Updated++
+	}
+
+	for rel := range m.applied {
+		if _, ok := latest[rel]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(m.outDir, filepath.FromSlash(rel))); err != nil && !os.IsNotExist(err) {
+			return stats, fmt.Errorf("remove %s: %w", rel, err)
+		}
+		delete(m.applied, rel)
+		stats.Removed++
+	}
+	return stats, nil
+}
+
+func (m *mirror) write(rel string, casStore *cas.CASStore, meta recorder.MetadataRecord) error {
+	dest := filepath.Join(m.outDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return fmt.Errorf("create parent for %s: %w", dest, err)
+	}
+
+	src, err := recorder.OpenContent(casStore, meta)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", rel, err)
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), mirrorTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.ReadFrom(src); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %w", rel, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", rel, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("replace %s: %w", rel, err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// timestampsDirName is the virtual directory at the mount root that exposes
+// every recorded second (and any --time expression) as a snapshot.
+const timestampsDirName = "@timestamps"
+
+func newMountCmd() *cobra.Command {
+	var stateDir string
+	var atTime string
+
+	cmd := &cobra.Command{
+		Use:   "mount <mountpoint> --time <timestamp>",
+		Short: "Mount a read-only view of the recorded filesystem at a point in time",
+		Long: `Mount a read-only view of the recorded filesystem at a point in time.
+
+The mount root shows the files as they were at --time. The ` + timestampsDirName + `/
+directory lists one snapshot per recorded second, and looking up any --time
+expression inside it (for example ` + timestampsDirName + `/end-5s or
+` + timestampsDirName + `/event:migrations-done) opens that snapshot. The
+command runs until interrupted, then unmounts. Linux only.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			return runMount(stateDir, args[0], atTime)
+		},
+	}
+
+	cmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&atTime, "time", "latest", "Timestamp, duration, or anchor (e.g. 2s, 2025-01-02T15:04:05Z, end-5s, failure, event:<marker>)")
+	return cmd
+}
@@ -0,0 +1,269 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+// snapshotTTL is how long the kernel may cache entries and attributes. Every
+// snapshot is immutable, so this only bounds memory held by the kernel.
+const snapshotTTL = time.Minute
+
+func runMount(stateDir, mountpoint, atTime string) error {
+	cfg, err := loadEnvConfig(nil)
+	if err != nil {
+		return err
+	}
+	db, casStore, err := openReadOnlyStoreWithConfig(stateDir, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// A version shows up in every later snapshot under @timestamps; each is
+	// a new inode to the kernel, so reads share this cache instead.
+	content := recorder.NewContentCache(cfg.ContentCacheBytes())
+
+	anchors := loadSessionAnchors(db)
+	target, err := parseTargetTime(atTime, anchors)
+	if err != nil {
+		return err
+	}
+	records, err := loadMetadataAt(db, target)
+	if err != nil {
+		return err
+	}
+
+	root := &snapshotDir{store: casStore, content: content, records: records, at: target}
+	root.timestamps = &timestampsDir{roDir: roDir{mtime: target}, db: db, store: casStore, content: content, anchors: anchors}
+
+	ttl := snapshotTTL
+	server, err := fs.Mount(mountpoint, root, &fs.Options{
+		EntryTimeout: &ttl,
+		AttrTimeout:  &ttl,
+		MountOptions: fuse.MountOptions{
+			FsName:  "diffkeeper",
+			Name:    "diffkeeper",
+			Options: []string{"ro"},
+			// Mount directly when running as root (e.g. under sudo in CI) and
+			// fall back to fusermount otherwise.
+			DirectMount: true,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("mount %s: %w", mountpoint, err)
+	}
+
+	log.Printf("[mount] %s mounted at %s (read-only); press Ctrl+C to unmount", stateDir, mountpoint)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	go func() {
+		<-sigCh
+		if err := server.Unmount(); err != nil {
+			log.Printf("[mount] unmount failed: %v (try fusermount -u %s)", err, mountpoint)
+		}
+	}()
+
+	server.Wait()
+	return nil
+}
+
+// roDir is a read-only intermediate directory.
+type roDir struct {
+	fs.Inode
+	mtime time.Time
+}
+
+var _ = (fs.NodeGetattrer)((*roDir)(nil))
+
+func (d *roDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	setDirAttr(&out.Attr, d.mtime)
+	return 0
+}
+
+// snapshotDir is the root of the tree of files recorded up to at. When
+// timestamps is set it also exposes the @timestamps directory.
+type snapshotDir struct {
+	roDir
+	store      *cas.CASStore
+	content    *recorder.ContentCache
+	records    map[string]recorder.MetadataRecord
+	at         time.Time
+	timestamps *timestampsDir
+}
+
+var _ = (fs.NodeOnAdder)((*snapshotDir)(nil))
+
+func (d *snapshotDir) OnAdd(ctx context.Context) {
+	d.mtime = d.at
+	for recPath, meta := range d.records {
+		rel := path.Clean(strings.TrimPrefix(filepath.ToSlash(cleanPath(recPath)), "/"))
+		if rel == "." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		dir, base := path.Split(rel)
+
+		p := &d.Inode
+		for _, component := range strings.Split(dir, "/") {
+			if component == "" {
+				continue
+			}
+			ch := p.GetChild(component)
+			if ch == nil {
+				ch = p.NewPersistentInode(ctx, &roDir{mtime: d.at}, fs.StableAttr{Mode: fuse.S_IFDIR})
+				p.AddChild(component, ch, true)
+			}
+			p = ch
+		}
+		ch := p.NewPersistentInode(ctx, &casFile{store: d.store, content: d.content, meta: meta}, fs.StableAttr{Mode: fuse.S_IFREG})
+		p.AddChild(base, ch, true)
+	}
+
+	if d.timestamps != nil {
+		ch := d.NewPersistentInode(ctx, d.timestamps, fs.StableAttr{Mode: fuse.S_IFDIR})
+		d.AddChild(timestampsDirName, ch, true)
+	}
+}
+
+// timestampsDir lists one snapshot per recorded second and resolves any
+// --time expression on lookup.
+type timestampsDir struct {
+	roDir
+	db      *pebble.DB
+	store   *cas.CASStore
+	content *recorder.ContentCache
+	anchors sessionAnchors
+}
+
+var (
+	_ = (fs.NodeReaddirer)((*timestampsDir)(nil))
+	_ = (fs.NodeLookuper)((*timestampsDir)(nil))
+)
+
+func (d *timestampsDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	history, err := loadMetadataHistory(d.db, time.Now())
+	if err != nil {
+		log.Printf("[mount] list timestamps: %v", err)
+		return nil, syscall.EIO
+	}
+
+	var entries []fuse.DirEntry
+	seen := make(map[string]bool)
+	for _, meta := range history {
+		name := snapshotName(time.Unix(0, meta.Timestamp))
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFDIR})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return fs.NewListDirStream(entries), 0
+}
+
+func (d *timestampsDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	target, err := parseTargetTime(name, d.anchors)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	records, err := loadMetadataAt(d.db, target)
+	if err != nil {
+		log.Printf("[mount] load snapshot %s: %v", name, err)
+		return nil, syscall.EIO
+	}
+
+	setDirAttr(&out.Attr, target)
+	return d.NewInode(ctx, &snapshotDir{store: d.store, content: d.content, records: records, at: target}, fs.StableAttr{Mode: fuse.S_IFDIR}), 0
+}
+
+// snapshotName names the snapshot that includes every write made during the
+// second containing ts.
+func snapshotName(ts time.Time) string {
+	return ts.UTC().Truncate(time.Second).Add(time.Second).Format(time.RFC3339)
+}
+
+// casFile is a recorded file version served from the CAS.
+type casFile struct {
+	fs.Inode
+	store   *cas.CASStore
+	content *recorder.ContentCache
+	meta    recorder.MetadataRecord
+}
+
+var (
+	_ = (fs.NodeGetattrer)((*casFile)(nil))
+	_ = (fs.NodeOpener)((*casFile)(nil))
+	_ = (fs.NodeReader)((*casFile)(nil))
+)
+
+// casHandle holds the content of one open casFile.
+type casHandle struct {
+	data []byte
+}
+
+func (f *casFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0o444
+	out.Nlink = 1
+	out.Size = uint64(f.meta.Size)
+	setTimes(&out.Attr, time.Unix(0, f.meta.Timestamp))
+	const bs = 512
+	out.Blksize = bs
+	out.Blocks = (out.Size + bs - 1) / bs
+	return 0
+}
+
+func (f *casFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	data, err := f.content.Read(f.store, f.meta)
+	if err != nil {
+		log.Printf("[mount] read %s: %v", f.meta.Path, err)
+		return nil, 0, syscall.EIO
+	}
+	// Recorded versions never change, so the kernel may keep its page cache.
+	return &casHandle{data: data}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (f *casFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h, ok := fh.(*casHandle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	if off >= int64(len(h.data)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := min(off+int64(len(dest)), int64(len(h.data)))
+	return fuse.ReadResultData(h.data[off:end]), 0
+}
+
+func setDirAttr(attr *fuse.Attr, mtime time.Time) {
+	attr.Mode = fuse.S_IFDIR | 0o555
+	attr.Nlink = 2
+	setTimes(attr, mtime)
+}
+
+func setTimes(attr *fuse.Attr, mtime time.Time) {
+	attr.Mtime = uint64(mtime.Unix())
+	attr.Mtimensec = uint32(mtime.Nanosecond())
+	attr.Atime, attr.Atimensec = attr.Mtime, attr.Mtimensec
+	attr.Ctime, attr.Ctimensec = attr.Mtime, attr.Mtimensec
+}
@@ -0,0 +1,25 @@
+//go:build linux
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotNameCoversWholeSecond(t *testing.T) {
+	ts := time.Date(2025, 1, 2, 15, 4, 5, 900_000_000, time.UTC)
+	name := snapshotName(ts)
+	if name != "2025-01-02T15:04:06Z" {
+		t.Fatalf("snapshotName = %q", name)
+	}
+
+	// Resolving the listed name must include the write it was derived from.
+	at, err := parseTargetTime(name, sessionAnchors{})
+	if err != nil {
+		t.Fatalf("parseTargetTime(%q): %v", name, err)
+	}
+	if at.Before(ts) {
+		t.Fatalf("snapshot %s resolves before the write at %s", at, ts)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func runMount(stateDir, mountpoint, atTime string) error {
+	return fmt.Errorf("mount is not supported on %s; use export or cat instead", runtime.GOOS)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/ghactions"
+	"github.com/saworbit/diffkeeper/pkg/hooks"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+// notifyTimeout bounds the failure notification so a dead webhook cannot
+// hold up the exit of record.
+const notifyTimeout = 10 * time.Second
+
+// notifyFailure posts a failure summary to cfg.Notify.URL. Errors are
+// logged; the recorded command's exit status is what record reports.
+func notifyFailure(db *pebble.DB, cfg *config.DiffConfig, command []string, stateDir string, exitCode int) {
+	if cfg.Notify.URL == "" {
+		return
+	}
+	summary, err := failureSummary(db, cfg.Notify, cfg.Namespace, command, stateDir, exitCode)
+	if err != nil {
+		log.Printf("[notify] failed to load changed files: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	if err := hooks.NotifyFailure(ctx, cfg.Notify.URL, cfg.Notify.Format, summary); err != nil {
+		log.Printf("[notify] failed to post %s summary: %v", cfg.Notify.Format, err)
+	}
+}
+
+// failureSummary lists the most recently changed paths of namespace ns in
+// the current session, newest first and each path once.
+func failureSummary(db *pebble.DB, notify config.NotifyConfig, ns string, command []string, stateDir string, exitCode int) (hooks.FailureSummary, error) {
+	summary := hooks.FailureSummary{Command: command, ExitCode: exitCode, StateDir: stateDir, Link: notify.Link}
+	if summary.Link == "" {
+		summary.Link = ghactions.RunURL()
+	}
+	if notify.RecentFiles == 0 {
+		return summary, nil
+	}
+
+	history, err := loadMetadataHistory(db, time.Now())
+	if err != nil {
+		return summary, err
+	}
+	history = recorder.NamespaceHistory(history, ns)
+	start := loadSessionStart(db).UnixNano()
+	seen := make(map[string]bool)
+	for i := len(history) - 1; i >= 0 && len(summary.Files) < notify.RecentFiles; i-- {
+		meta := history[i]
+		if meta.Timestamp < start || seen[meta.Path] {
+			continue
+		}
+		seen[meta.Path] = true
+		summary.Files = append(summary.Files, hooks.ChangedFile{Path: meta.Path, Op: meta.Op, Time: time.Unix(0, meta.Timestamp)})
+	}
+	return summary, nil
+}
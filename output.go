@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Values of the global --output flag.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// annotationJSONOutput marks a command whose JSON output is not chosen with
+// a --json flag: "always" for one that only prints JSON, or the
+// "flag=value" that --output json sets.
+const annotationJSONOutput = "diffkeeper.json-output"
+
+// applyOutputFormat makes --output json choose cmd's JSON output: its
+// --json flag, or what annotationJSONOutput says. Commands without a JSON
+// form refuse it rather than print text a script cannot parse.
+func applyOutputFormat(cmd *cobra.Command, output string) error {
+	switch output {
+	case outputText:
+		return nil
+	case outputJSON:
+	default:
+		return fmt.Errorf("unsupported --output %q (use text or json)", output)
+	}
+	annotation := cmd.Annotations[annotationJSONOutput]
+	if annotation == "always" {
+		return nil
+	}
+	if flag, value, ok := strings.Cut(annotation, "="); ok {
+		if f := cmd.Flags().Lookup(flag); f != nil && f.Changed && f.Value.String() != value {
+			return fmt.Errorf("--output json conflicts with --%s %s", flag, f.Value)
+		}
+		return cmd.Flags().Set(flag, value)
+	}
+	if f := cmd.Flags().Lookup("json"); f != nil && f.Value.Type() == "bool" {
+		return cmd.Flags().Set("json", "true")
+	}
+	return fmt.Errorf("%s has no JSON output", cmd.CommandPath())
+}
+
+// hasJSONOutput reports whether --output json works with cmd.
+func hasJSONOutput(cmd *cobra.Command) bool {
+	if cmd.Annotations[annotationJSONOutput] != "" {
+		return true
+	}
+	f := cmd.Flags().Lookup("json")
+	return f != nil && f.Value.Type() == "bool"
+}
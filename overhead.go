@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/saworbit/diffkeeper/internal/metrics"
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+const (
+	// overheadWindow is how long CPU use is averaged over before the
+	// budget starts afresh, so an idle minute does not pay for a burst.
+	overheadWindow = 2 * time.Second
+
+	// maxOverheadPause bounds one pause for the CPU limit; a caller
+	// further over budget pauses again on its next Spend.
+	maxOverheadPause = time.Second
+)
+
+// overheadBudget keeps diffkeeper within config.OverheadConfig by pausing
+// the capturer and the processor, which charge it every file they read and
+// every journal entry they store. I/O is paced like tier uploads: each
+// charge reserves its bytes at the configured rate and waits for those
+// reserved before it. CPU is the process's own CPU time: while it exceeds
+// the budget's share of the time since the window began, callers pause
+// until the average is back under. A nil *overheadBudget never pauses.
+type overheadBudget struct {
+	cores  float64
+	ioRate float64
+
+	now     func() time.Time
+	sleep   func(time.Duration)
+	cpuTime func() (time.Duration, bool)
+
+	mu       sync.Mutex
+	ioNext   time.Time
+	winStart time.Time
+	winCPU   time.Duration
+}
+
+// newOverheadBudget returns the budget for cfg, or nil when it sets no
+// limit.
+func newOverheadBudget(cfg config.OverheadConfig) *overheadBudget {
+	if !cfg.Enabled() {
+		return nil
+	}
+	b := &overheadBudget{
+		cores:   float64(cfg.MaxCPUPercent) / 100,
+		ioRate:  float64(cfg.MaxIOMBps) * (1 << 20),
+		now:     time.Now,
+		sleep:   time.Sleep,
+		cpuTime: processCPUTime,
+	}
+	if _, ok := b.cpuTime(); b.cores > 0 && !ok {
+		log.Printf("[overhead] process CPU time is not available on this platform; max_cpu_percent is not enforced")
+		b.cores = 0
+	}
+	return b
+}
+
+// Spend charges n bytes of I/O, and blocks while diffkeeper is over
+// budget.
+func (b *overheadBudget) Spend(n int) {
+	if b == nil {
+		return
+	}
+	ioPause, cpuPause := b.reserve(int64(n))
+	if ioPause > 0 {
+		metrics.ThrottledSecondsTotal.WithLabelValues("io").Add(ioPause.Seconds())
+	}
+	if cpuPause > 0 {
+		metrics.ThrottledSecondsTotal.WithLabelValues("cpu").Add(cpuPause.Seconds())
+	}
+	if pause := max(ioPause, cpuPause); pause > 0 {
+		b.sleep(pause)
+	}
+}
+
+// reserve reserves n bytes and returns how long the caller must pause for
+// the I/O and for the CPU limit.
+func (b *overheadBudget) reserve(n int64) (ioPause, cpuPause time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if b.ioRate > 0 {
+		if b.ioNext.Before(now) {
+			b.ioNext = now
+		} else {
+			ioPause = b.ioNext.Sub(now)
+		}
+		b.ioNext = b.ioNext.Add(time.Duration(float64(n) / b.ioRate * float64(time.Second)))
+	}
+	if b.cores > 0 {
+		used, ok := b.cpuTime()
+		if !ok {
+			return ioPause, 0
+		}
+		if b.winStart.IsZero() {
+			b.winStart, b.winCPU = now, used
+		}
+		elapsed := now.Sub(b.winStart)
+		// The CPU time used so far fits the budget once this much wall
+		// time has passed.
+		due := time.Duration(float64(used-b.winCPU) / b.cores)
+		if due > elapsed {
+			cpuPause = min(due-elapsed, maxOverheadPause)
+		} else if elapsed >= overheadWindow {
+			b.winStart, b.winCPU = now, used
+		}
+	}
+	return ioPause, cpuPause
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// cpuMaxPeriod is the cpu.max period, in microseconds, the CPU limit
+	// is written with.
+	cpuMaxPeriod = 100000
+)
+
+// processCPUTime returns the user and system CPU time of this process.
+func processCPUTime() (time.Duration, bool) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, false
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), true
+}
+
+// overheadCgroup is the cgroup v2 group diffkeeper moved itself into, with
+// the overhead limits, and the sibling group the recorded command is moved
+// into, without them. Both are children of the group diffkeeper started
+// in. A nil *overheadCgroup does nothing.
+type overheadCgroup struct {
+	parent, self, job string
+	// enabled lists the controllers diffkeeper enabled for the parent's
+	// children, to disable again on Close.
+	enabled []string
+}
+
+// placeInCgroup moves diffkeeper into a cgroup of its own limited to cfg.
+// The I/O limit applies to the block devices holding dirs. It needs a
+// cgroup v2 group diffkeeper may create children in, with no other
+// processes in it: a container, or a systemd unit with Delegate=yes.
+func placeInCgroup(cfg config.OverheadConfig, dirs ...string) (*overheadCgroup, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(cgroupRoot, &fs); err != nil || fs.Type != unix.CGROUP2_SUPER_MAGIC {
+		return nil, fmt.Errorf("cgroup v2 is not mounted at %s", cgroupRoot)
+	}
+	own, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+	pid := os.Getpid()
+	parent := filepath.Join(cgroupRoot, own)
+	g := &overheadCgroup{
+		parent: parent,
+		self:   filepath.Join(parent, fmt.Sprintf("diffkeeper-%d", pid)),
+		job:    filepath.Join(parent, fmt.Sprintf("diffkeeper-%d-job", pid)),
+	}
+	for _, dir := range []string{g.self, g.job} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			g.Close()
+			return nil, fmt.Errorf("create cgroup: %w", err)
+		}
+	}
+	// Controllers can only be enabled for the children of a group with
+	// no processes of its own.
+	if err := writeCgroupFile(g.self, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+		g.Close()
+		return nil, err
+	}
+	current, err := os.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+	if err != nil {
+		g.Close()
+		return nil, fmt.Errorf("read cgroup controllers: %w", err)
+	}
+	var wanted []string
+	if cfg.MaxCPUPercent > 0 {
+		wanted = append(wanted, "cpu")
+	}
+	if cfg.MaxIOMBps > 0 {
+		wanted = append(wanted, "io")
+	}
+	for _, c := range wanted {
+		if !slices.Contains(strings.Fields(string(current)), c) {
+			g.enabled = append(g.enabled, c)
+		}
+	}
+	if len(g.enabled) > 0 {
+		if err := writeCgroupFile(parent, "cgroup.subtree_control", controllerList("+", g.enabled)); err != nil {
+			g.enabled = nil
+			g.Close()
+			return nil, fmt.Errorf("%w (does another process share cgroup %s?)", err, own)
+		}
+	}
+
+	if cfg.MaxCPUPercent > 0 {
+		quota := cfg.MaxCPUPercent * cpuMaxPeriod / 100
+		if err := writeCgroupFile(g.self, "cpu.max", fmt.Sprintf("%d %d", quota, cpuMaxPeriod)); err != nil {
+			g.Close()
+			return nil, err
+		}
+	}
+	if cfg.MaxIOMBps > 0 {
+		rate := int64(cfg.MaxIOMBps) << 20
+		seen := make(map[string]bool)
+		for _, dir := range dirs {
+			dev, err := blockDevice(dir)
+			if err != nil || seen[dev] {
+				continue
+			}
+			seen[dev] = true
+			if err := writeCgroupFile(g.self, "io.max", fmt.Sprintf("%s rbps=%d wbps=%d", dev, rate, rate)); err != nil {
+				log.Printf("[overhead] no cgroup I/O limit for %s: %v", dir, err)
+			}
+		}
+	}
+	return g, nil
+}
+
+// Adopt moves the process pid, which diffkeeper just started, out of its
+// limits.
+func (g *overheadCgroup) Adopt(pid int) error {
+	if g == nil {
+		return nil
+	}
+	return writeCgroupFile(g.job, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// Close moves diffkeeper back into the group it started in and removes
+// the groups it created. The recorded command must have exited.
+func (g *overheadCgroup) Close() {
+	if g == nil {
+		return
+	}
+	if len(g.enabled) > 0 {
+		_ = writeCgroupFile(g.parent, "cgroup.subtree_control", controllerList("-", g.enabled))
+	}
+	_ = writeCgroupFile(g.parent, "cgroup.procs", strconv.Itoa(os.Getpid()))
+	_ = os.Remove(g.job)
+	_ = os.Remove(g.self)
+}
+
+// ownCgroup returns the cgroup v2 group of this process, relative to
+// cgroupRoot.
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", fmt.Errorf("read own cgroup: %w", err)
+	}
+	return parseCgroupV2(data)
+}
+
+// parseCgroupV2 returns the unified hierarchy's group from the contents of
+// /proc/<pid>/cgroup.
+func parseCgroupV2(data []byte) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("cgroup v2 is not in use")
+}
+
+// blockDevice returns the major:minor of the disk holding dir, as io.max
+// takes it: a partition is replaced by its disk.
+func blockDevice(dir string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return "", err
+	}
+	dev := fmt.Sprintf("%d:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)))
+	// /sys/dev/block/<dev> links to the partition's directory, which is
+	// inside its disk's.
+	sys, err := filepath.EvalSymlinks(filepath.Join("/sys/dev/block", dev))
+	if err != nil {
+		return dev, nil
+	}
+	if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+		if disk, err := os.ReadFile(filepath.Join(filepath.Dir(sys), "dev")); err == nil {
+			return strings.TrimSpace(string(disk)), nil
+		}
+	}
+	return dev, nil
+}
+
+// controllerList formats controllers for cgroup.subtree_control, each
+// prefixed with op.
+func controllerList(op string, controllers []string) string {
+	parts := make([]string, len(controllers))
+	for i, c := range controllers {
+		parts[i] = op + c
+	}
+	return strings.Join(parts, " ")
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", filepath.Join(dir, name), err)
+	}
+	return nil
+}
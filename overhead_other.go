@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+// processCPUTime is not implemented outside Linux.
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
+
+// overheadCgroup is only available on Linux.
+type overheadCgroup struct{}
+
+func placeInCgroup(cfg config.OverheadConfig, dirs ...string) (*overheadCgroup, error) {
+	return nil, errors.New("cgroups are only available on Linux")
+}
+
+func (g *overheadCgroup) Adopt(pid int) error { return nil }
+
+func (g *overheadCgroup) Close() {}
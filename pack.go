@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+	"github.com/spf13/cobra"
+)
+
+// packOptions carries the flags accepted by the pack command.
+type packOptions struct {
+	stateDir string
+	pack     cas.PackOptions
+	jsonOut  bool
+	force    bool
+}
+
+func newPackCmd() *cobra.Command {
+	opts := packOptions{pack: cas.DefaultPackOptions()}
+
+	cmd := &cobra.Command{
+		Use:   "pack --state-dir <dir>",
+		Short: "Group small CAS objects into compressed packs",
+		Long: `Group small CAS objects into compressed packs.
+
+Recordings of append-heavy files (logs, JSONL) store one small object per
+capture. pack concatenates objects up to --max-object-size into packs of about
+--pack-size and compresses each pack as a whole, which compresses much better
+and leaves one small pointer per object. Packs whose objects were all removed
+by retention are deleted. Run it on a state dir that is not being recorded.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			return runPack(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().IntVar(&opts.pack.MaxObjectBytes, "max-object-size", opts.pack.MaxObjectBytes, "Pack objects stored in at most this many bytes")
+	cmd.Flags().IntVar(&opts.pack.TargetPackBytes, "pack-size", opts.pack.TargetPackBytes, "Uncompressed size (bytes) at which a pack is sealed")
+	cmd.Flags().BoolVar(&opts.jsonOut, "json", false, "Print JSON instead of a summary")
+	cmd.Flags().BoolVar(&opts.force, "force", false, "Take over the state dir lock if its previous owner is no longer running")
+	return cmd
+}
+
+func runPack(w io.Writer, opts packOptions) error {
+	cfg, err := loadEnvConfig(nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(opts.stateDir); err != nil {
+		return fmt.Errorf("open state dir: %w", err)
+	}
+	lock, err := statelock.Acquire(opts.stateDir, "pack", opts.force)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	db, err := pebble.Open(opts.stateDir, &pebble.Options{ErrorIfNotExists: true})
+	if err != nil {
+		return fmt.Errorf("open pebble: %w", err)
+	}
+	defer db.Close()
+
+	casStore, err := cas.NewCASStore(db, cfg.HashAlgo)
+	if err != nil {
+		return fmt.Errorf("init CAS: %w", err)
+	}
+
+	report, err := casStore.Pack(opts.pack)
+	if err != nil {
+		return fmt.Errorf("pack: %w", err)
+	}
+	if err := db.Compact([]byte(cas.PrefixCAS), []byte(cas.PrefixPack+"\xff"), true); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	if report.Objects > 0 || report.RemovedPacks > 0 {
+		recordAudit(opts.stateDir, auditPack, map[string]any{"objects": report.Objects, "packs": report.Packs, "removed_packs": report.RemovedPacks})
+	}
+
+	if opts.jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	if report.Objects == 0 {
+		fmt.Fprintln(w, "No small objects left to pack.")
+	} else {
+		fmt.Fprintf(w, "Packed objects:   %d into %d pack(s)\n", report.Objects, report.Packs)
+		fmt.Fprintf(w, "Stored size:      %s -> %s\n", formatSize(int(report.BytesBefore)), formatSize(int(report.BytesAfter)))
+	}
+	if report.RemovedPacks > 0 {
+		fmt.Fprintf(w, "Removed packs:    %d (no longer referenced)\n", report.RemovedPacks)
+	}
+	return nil
+}
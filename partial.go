@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/saworbit/diffkeeper/pkg/ebpf"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+const (
+	// maxWriteRanges bounds the written ranges kept per file; past it the
+	// closest ranges merge, and the bytes between them are captured too.
+	maxWriteRanges = 256
+
+	// writeEventBuffer is how many eBPF events TrackWrites holds for their
+	// next consumer before dropping them.
+	writeEventBuffer = 1024
+)
+
+// partialCaptures collects the byte ranges eBPF sees written to large
+// files, so the capturer can read and journal just those ranges instead
+// of the whole file. Only files of at least minBytes whose previous
+// capture stored their content qualify, and every verifyEvery partial
+// captures the file is read whole again: writes eBPF does not report,
+// such as through mmap, would otherwise be missed until the file changes
+// there again. A nil *partialCaptures never captures partially.
+type partialCaptures struct {
+	minBytes    int64
+	verifyEvery int
+
+	mu    sync.Mutex
+	files map[string]*writtenFile
+}
+
+// writtenFile is what partialCaptures knows about one file since the
+// previous capture of its content.
+type writtenFile struct {
+	// stored is set once a capture stored the file's content; writes are
+	// tracked from just before it.
+	stored bool
+	// size is the file's size at that capture.
+	size int64
+	// partials counts the partial captures since it was last read whole.
+	partials int
+	ranges   []recorder.PatchRange
+	// unknown is set once a write was reported without its offset.
+	unknown bool
+}
+
+// newPartialCaptures returns the tracker, or nil when minBytes is 0 or less.
+func newPartialCaptures(minBytes int64, verifyEvery int) *partialCaptures {
+	if minBytes <= 0 {
+		return nil
+	}
+	return &partialCaptures{minBytes: minBytes, verifyEvery: verifyEvery, files: make(map[string]*writtenFile)}
+}
+
+// TrackWrites notes the writes in events and passes each event on to the
+// returned channel, dropping those its consumer is not ready for. Without
+// a tracker, or events, it returns events.
+func (p *partialCaptures) TrackWrites(ctx context.Context, events <-chan ebpf.Event) <-chan ebpf.Event {
+	if p == nil || events == nil {
+		return events
+	}
+	out := make(chan ebpf.Event, writeEventBuffer)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case evt, ok := <-events:
+				if !ok {
+					return
+				}
+				p.Written(filepath.Clean(evt.Path), evt.Offset, evt.Bytes)
+				select {
+				case out <- evt:
+				default:
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// Written notes a write of n bytes at offset (-1 if unknown) to path.
+// Writes to files no capture has planned for are not kept; their first
+// capture reads them whole.
+func (p *partialCaptures) Written(path string, offset int64, n uint64) {
+	if p == nil || n == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.files[path]
+	if f == nil {
+		return
+	}
+	if offset < 0 {
+		f.unknown = true
+		f.ranges = nil
+		return
+	}
+	if !f.unknown {
+		f.ranges = addRange(f.ranges, recorder.PatchRange{Offset: offset, Length: int(n)})
+	}
+}
+
+// plan returns the patch that captures path, now size bytes, from the
+// ranges written since its previous capture, or false when it must be
+// read whole. Either way the ranges are taken: the capture covers them.
+func (p *partialCaptures) plan(path string, size int64) (recorder.Patch, bool) {
+	if p == nil {
+		return recorder.Patch{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.files[path]
+	if f == nil {
+		if size >= p.minBytes {
+			// Track writes made while this capture reads the file whole.
+			p.files[path] = &writtenFile{}
+		}
+		return recorder.Patch{}, false
+	}
+	ranges, unknown := f.ranges, f.unknown
+	f.ranges, f.unknown = nil, false
+	if !f.stored || unknown || len(ranges) == 0 || size < p.minBytes || f.partials >= p.verifyEvery {
+		return recorder.Patch{}, false
+	}
+
+	patch := recorder.Patch{Size: size, BaseSize: f.size}
+	var total int64
+	for _, r := range ranges {
+		end := min(r.Offset+int64(r.Length), size)
+		if r.Offset >= end {
+			continue
+		}
+		patch.Ranges = append(patch.Ranges, recorder.PatchRange{Offset: r.Offset, Length: int(end - r.Offset)})
+		total += end - r.Offset
+	}
+	// A file that grew is expected to have been written up to its new
+	// end, the bytes in between being a hole; otherwise the write that
+	// grew it may not have been reported yet.
+	if size > f.size && !slices.ContainsFunc(patch.Ranges, func(r recorder.PatchRange) bool { return r.Offset+int64(r.Length) == size }) {
+		return recorder.Patch{}, false
+	}
+	if len(patch.Ranges) == 0 || total > size/2 {
+		return recorder.Patch{}, false
+	}
+	return patch, true
+}
+
+// captured records that path's content was journaled at size bytes, read
+// whole or, with partial, from its written ranges. Files below minBytes
+// are not tracked.
+func (p *partialCaptures) captured(path string, size int64, partial bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if size < p.minBytes {
+		delete(p.files, path)
+		return
+	}
+	f := p.files[path]
+	if f == nil {
+		f = &writtenFile{}
+		p.files[path] = f
+	}
+	f.stored, f.size = true, size
+	if partial {
+		f.partials++
+	} else {
+		f.partials = 0
+	}
+}
+
+// forget stops tracking path until its content is captured again, as after
+// a capture that did not store it.
+func (p *partialCaptures) forget(path string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.files, path)
+}
+
+// addRange adds r to ranges, which are sorted and do not touch, merging it
+// with those it overlaps or adjoins. Past maxWriteRanges the two ranges
+// with the smallest gap between them merge.
+func addRange(ranges []recorder.PatchRange, r recorder.PatchRange) []recorder.PatchRange {
+	start, end := r.Offset, r.Offset+int64(r.Length)
+	i := 0
+	for i < len(ranges) && ranges[i].Offset+int64(ranges[i].Length) < start {
+		i++
+	}
+	j := i
+	for j < len(ranges) && ranges[j].Offset <= end {
+		start = min(start, ranges[j].Offset)
+		end = max(end, ranges[j].Offset+int64(ranges[j].Length))
+		j++
+	}
+	ranges = slices.Replace(ranges, i, j, recorder.PatchRange{Offset: start, Length: int(end - start)})
+	if len(ranges) <= maxWriteRanges {
+		return ranges
+	}
+	closest := 0
+	for k := 1; k < len(ranges)-1; k++ {
+		if gap(ranges[k], ranges[k+1]) < gap(ranges[closest], ranges[closest+1]) {
+			closest = k
+		}
+	}
+	a, b := ranges[closest], ranges[closest+1]
+	merged := recorder.PatchRange{Offset: a.Offset, Length: int(b.Offset + int64(b.Length) - a.Offset)}
+	return slices.Replace(ranges, closest, closest+2, merged)
+}
+
+// gap returns the bytes between a and the range b after it.
+func gap(a, b recorder.PatchRange) int64 {
+	return b.Offset - (a.Offset + int64(a.Length))
+}
@@ -0,0 +1,218 @@
+// Package attest builds in-toto attestations with SLSA provenance for the
+// files a recording produced, and signs them as DSSE envelopes.
+package attest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/merkle"
+)
+
+// Type URIs of the attestations produced here.
+const (
+	StatementType = "https://in-toto.io/Statement/v1"
+	PredicateType = "https://slsa.dev/provenance/v1"
+	PayloadType   = "application/vnd.in-toto+json"
+	BuildType     = "https://github.com/saworbit/diffkeeper/recording/v1"
+	BuilderID     = "https://github.com/saworbit/diffkeeper"
+)
+
+// Statement is an in-toto v1 statement.
+type Statement struct {
+	Type          string     `json:"_type"`
+	Subject       []Subject  `json:"subject"`
+	PredicateType string     `json:"predicateType"`
+	Predicate     Provenance `json:"predicate"`
+}
+
+// Subject is one attested file.
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Provenance is a SLSA v1 provenance predicate.
+type Provenance struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+// BuildDefinition describes what was run.
+type BuildDefinition struct {
+	BuildType          string         `json:"buildType"`
+	ExternalParameters map[string]any `json:"externalParameters"`
+}
+
+// RunDetails describes the recorder and the run.
+type RunDetails struct {
+	Builder  Builder       `json:"builder"`
+	Metadata BuildMetadata `json:"metadata"`
+}
+
+// Builder identifies the agent that recorded the run.
+type Builder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+// BuildMetadata identifies the run.
+type BuildMetadata struct {
+	InvocationID string     `json:"invocationId,omitempty"`
+	StartedOn    *time.Time `json:"startedOn,omitempty"`
+	FinishedOn   *time.Time `json:"finishedOn,omitempty"`
+}
+
+// Run describes a recording for NewStatement.
+type Run struct {
+	SessionID string
+	Command   []string
+	Agent     string
+	ExitCode  *int
+	Started   time.Time
+	Finished  time.Time
+	// Files maps slash-separated paths to the hex SHA-256 of their content.
+	Files map[string]string
+}
+
+// NewStatement returns the provenance statement for run, with one subject
+// per file in path order.
+func NewStatement(run Run) Statement {
+	st := Statement{
+		Type:          StatementType,
+		Subject:       make([]Subject, 0, len(run.Files)),
+		PredicateType: PredicateType,
+		Predicate: Provenance{
+			BuildDefinition: BuildDefinition{
+				BuildType:          BuildType,
+				ExternalParameters: map[string]any{},
+			},
+			RunDetails: RunDetails{
+				Builder:  Builder{ID: BuilderID},
+				Metadata: BuildMetadata{InvocationID: run.SessionID},
+			},
+		},
+	}
+	for name, sum := range run.Files {
+		st.Subject = append(st.Subject, Subject{Name: name, Digest: map[string]string{"sha256": sum}})
+	}
+	sort.Slice(st.Subject, func(i, j int) bool { return st.Subject[i].Name < st.Subject[j].Name })
+
+	params := st.Predicate.BuildDefinition.ExternalParameters
+	if len(run.Command) > 0 {
+		params["command"] = run.Command
+	}
+	if run.ExitCode != nil {
+		params["exitCode"] = *run.ExitCode
+	}
+	if run.Agent != "" {
+		st.Predicate.RunDetails.Builder.Version = map[string]string{"diffkeeper": run.Agent}
+	}
+	meta := &st.Predicate.RunDetails.Metadata
+	if !run.Started.IsZero() {
+		started := run.Started.UTC()
+		meta.StartedOn = &started
+	}
+	if !run.Finished.IsZero() {
+		finished := run.Finished.UTC()
+		meta.FinishedOn = &finished
+	}
+	return st
+}
+
+// Envelope is a DSSE envelope.
+type Envelope struct {
+	PayloadType string `json:"payloadType"`
+	// Payload is the base64 statement.
+	Payload    string              `json:"payload"`
+	Signatures []EnvelopeSignature `json:"signatures"`
+}
+
+// EnvelopeSignature is one signature over an envelope's payload. KeyID is
+// the hex SHA-256 of the signer's DER public key; PublicKey carries the key
+// itself (PEM) so the envelope can be checked without a key server.
+type EnvelopeSignature struct {
+	KeyID     string `json:"keyid"`
+	Sig       string `json:"sig"`
+	PublicKey string `json:"publicKey,omitempty"`
+}
+
+// Sign encodes st and signs it with a key accepted by
+// merkle.ParseSigningKey.
+func Sign(st Statement, keyPEM []byte) (Envelope, error) {
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("encode statement: %w", err)
+	}
+	sig, err := merkle.SignMessage(pae(PayloadType, payload), keyPEM)
+	if err != nil {
+		return Envelope{}, err
+	}
+	keyID, err := keyID(sig.PublicKey)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		PayloadType: PayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []EnvelopeSignature{{KeyID: keyID, Sig: sig.Value, PublicKey: sig.PublicKey}},
+	}, nil
+}
+
+// Verify checks that a signature of env matches pubPEM or, when pubPEM is
+// empty, its embedded public key, and returns the statement. As with
+// merkle.Signature.Verify, only a trusted pubPEM proves who signed.
+func (env Envelope) Verify(pubPEM []byte) (Statement, error) {
+	var st Statement
+	if env.PayloadType != PayloadType {
+		return st, fmt.Errorf("unexpected payload type %q", env.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return st, fmt.Errorf("decode payload: %w", err)
+	}
+	if len(env.Signatures) == 0 {
+		return st, fmt.Errorf("envelope is not signed")
+	}
+
+	msg := pae(env.PayloadType, payload)
+	err = fmt.Errorf("no signature matches")
+	for _, s := range env.Signatures {
+		key := pubPEM
+		if len(key) == 0 {
+			key = []byte(s.PublicKey)
+		}
+		sig := merkle.Signature{Value: s.Sig}
+		if err = sig.VerifyMessage(msg, key); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(payload, &st); err != nil {
+		return st, fmt.Errorf("decode statement: %w", err)
+	}
+	return st, nil
+}
+
+// pae is the DSSE pre-authentication encoding of a payload, the message
+// that is actually signed.
+func pae(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+func keyID(pubPEM string) (string, error) {
+	block, _ := pem.Decode([]byte(pubPEM))
+	if block == nil {
+		return "", fmt.Errorf("public key is not PEM encoded")
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
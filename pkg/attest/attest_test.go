@@ -0,0 +1,91 @@
+package attest
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pkcs8PEM(t *testing.T, key any) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestSignAndVerifyStatement(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDER, err := x509.MarshalPKIXPublicKey(other.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: otherDER})
+
+	exit := 0
+	st := NewStatement(Run{
+		SessionID: "0123456789abcdef",
+		Command:   []string{"make", "dist"},
+		Agent:     "v1.2.0",
+		ExitCode:  &exit,
+		Started:   time.Unix(100, 0),
+		Finished:  time.Unix(160, 0),
+		Files:     map[string]string{"dist/app": "aa", "dist/app.sha256": "bb"},
+	})
+	if len(st.Subject) != 2 || st.Subject[0].Name != "dist/app" || st.Subject[1].Digest["sha256"] != "bb" {
+		t.Fatalf("subjects = %+v", st.Subject)
+	}
+
+	for name, key := range map[string]any{"ecdsa": ecKey, "ed25519": edKey} {
+		t.Run(name, func(t *testing.T) {
+			env, err := Sign(st, pkcs8PEM(t, key))
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+			got, err := env.Verify(nil)
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if got.Predicate.RunDetails.Metadata.InvocationID != "0123456789abcdef" || len(got.Subject) != 2 {
+				t.Fatalf("statement = %+v", got)
+			}
+			if _, err := env.Verify(otherPub); err == nil {
+				t.Fatal("envelope should not verify against another key")
+			}
+
+			tampered := env
+			tampered.Payload = base64.StdEncoding.EncodeToString([]byte(strings.Replace(string(mustDecode(t, env.Payload)), `"aa"`, `"cc"`, 1)))
+			if _, err := tampered.Verify(nil); err == nil {
+				t.Fatal("envelope should not verify an edited statement")
+			}
+		})
+	}
+}
+
+func mustDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
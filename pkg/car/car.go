@@ -0,0 +1,126 @@
+// Package car writes Content Addressable aRchives (CARv1) so recorded CAS
+// objects can be imported into IPFS or any other IPLD-aware store.
+package car
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// Multicodec codes for the block types this package produces.
+const (
+	CodecRaw     = 0x55
+	CodecDagJSON = 0x0129
+)
+
+const cidVersion1 = 1
+
+var base32Lower = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// CID is a binary CIDv1: version, codec, and multihash.
+type CID []byte
+
+// NewCID returns the CIDv1 for data under codec, hashed with sha2-256.
+func NewCID(codec uint64, data []byte) CID {
+	sum := sha256.Sum256(data)
+	mh, _ := multihash.Encode(sum[:], multihash.SHA2_256)
+	return FromMultihash(codec, mh)
+}
+
+// FromMultihash wraps an existing multihash in a CIDv1 with the given codec.
+func FromMultihash(codec uint64, mh multihash.Multihash) CID {
+	buf := binary.AppendUvarint(nil, cidVersion1)
+	buf = binary.AppendUvarint(buf, codec)
+	return append(buf, mh...)
+}
+
+// String renders the CID in its canonical base32 multibase form ("b...").
+func (c CID) String() string {
+	return "b" + strings.ToLower(base32Lower.EncodeToString(c))
+}
+
+// Writer streams blocks into a CARv1 archive.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter writes the CAR header naming roots and returns a Writer for the
+// blocks that follow.
+func NewWriter(w io.Writer, roots []CID) (*Writer, error) {
+	bw := bufio.NewWriter(w)
+	header := encodeHeader(roots)
+	if _, err := bw.Write(binary.AppendUvarint(nil, uint64(len(header)))); err != nil {
+		return nil, err
+	}
+	if _, err := bw.Write(header); err != nil {
+		return nil, fmt.Errorf("write CAR header: %w", err)
+	}
+	return &Writer{w: bw}, nil
+}
+
+// WriteBlock appends one block. Callers are responsible for deduplication.
+func (w *Writer) WriteBlock(c CID, data []byte) error {
+	if _, err := w.w.Write(binary.AppendUvarint(nil, uint64(len(c)+len(data)))); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(c); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return fmt.Errorf("write CAR block: %w", err)
+	}
+	return nil
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// encodeHeader produces the DAG-CBOR header {"roots": [...], "version": 1}.
+// Keys are emitted in DAG-CBOR canonical order (shorter keys first).
+func encodeHeader(roots []CID) []byte {
+	var b []byte
+	b = cborHead(b, 5, 2) // map, 2 entries
+	b = cborString(b, "roots")
+	b = cborHead(b, 4, uint64(len(roots)))
+	for _, root := range roots {
+		b = cborHead(b, 6, 42) // tag 42: IPLD link
+		// Links are byte strings prefixed with the identity multibase (0x00).
+		b = cborHead(b, 2, uint64(len(root)+1))
+		b = append(b, 0x00)
+		b = append(b, root...)
+	}
+	b = cborString(b, "version")
+	b = cborHead(b, 0, 1)
+	return b
+}
+
+func cborString(b []byte, s string) []byte {
+	b = cborHead(b, 3, uint64(len(s)))
+	return append(b, s...)
+}
+
+// cborHead encodes a CBOR major type and argument using the shortest form.
+func cborHead(b []byte, major byte, n uint64) []byte {
+	m := major << 5
+	switch {
+	case n < 24:
+		return append(b, m|byte(n))
+	case n <= 0xff:
+		return append(b, m|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, m|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(b, m|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, m|27), n)
+	}
+}
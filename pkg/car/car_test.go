@@ -0,0 +1,63 @@
+package car
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func TestNewCIDMatchesKnownVector(t *testing.T) {
+	// `ipfs block put --cid-codec raw` of "hello world\n".
+	got := NewCID(CodecRaw, []byte("hello world\n")).String()
+	want := "bafkreifjjcie6lypi6ny7amxnfftagclbuxndqonfipmb64f2km2devei4"
+	if got != want {
+		t.Fatalf("CID = %s, want %s", got, want)
+	}
+}
+
+func TestWriterLayout(t *testing.T) {
+	data := []byte("payload")
+	c := NewCID(CodecRaw, data)
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, []CID{c})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if err := w.WriteBlock(c, data); err != nil {
+		t.Fatalf("WriteBlock: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	headerLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		t.Fatalf("read header length: %v", err)
+	}
+	header := make([]byte, headerLen)
+	if _, err := r.Read(header); err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	// a2 65 "roots" 81 d8 2a ...
+	if hex.EncodeToString(header[:8]) != "a265726f6f747381" {
+		t.Fatalf("unexpected header prefix %x", header[:8])
+	}
+	if !bytes.HasSuffix(header, []byte("\x67version\x01")) {
+		t.Fatalf("header missing version: %x", header)
+	}
+
+	blockLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		t.Fatalf("read block length: %v", err)
+	}
+	if int(blockLen) != len(c)+len(data) || r.Len() != int(blockLen) {
+		t.Fatalf("block length %d, remaining %d", blockLen, r.Len())
+	}
+	rest := buf.Bytes()[buf.Len()-r.Len():]
+	if !bytes.Equal(rest[:len(c)], c) || !bytes.Equal(rest[len(c):], data) {
+		t.Fatalf("block payload mismatch")
+	}
+}
@@ -0,0 +1,117 @@
+package cas
+
+import (
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// Object is one payload for PutBatch.
+type Object struct {
+	Data []byte
+
+	// Hash, when set, is the SHA-256 of Data and keys the object like
+	// PutChunkWithHash. Otherwise the CID is computed like Put.
+	Hash *[32]byte
+
+	// Compressed, when set, is Data as CompressObject returns it, so
+	// PutBatch stores it without compressing Data again.
+	Compressed []byte
+}
+
+// PutResult reports where PutBatch stored an object.
+type PutResult struct {
+	CID string
+	// Written is the compressed size stored, or zero if the object was
+	// already present (in the store or earlier in the batch).
+	Written int
+}
+
+// PutBatch stores objects with one Pebble batch and a single fsync (unless
+// disabled by SetSync) instead of one synced write per object. Missing
+// objects that were not compressed by the caller are compressed in
+// parallel. Results are in input order.
+func (c *CASStore) PutBatch(objects []Object) ([]PutResult, error) {
+	results := make([]PutResult, len(objects))
+	var pending []int
+	seen := make(map[string]bool, len(objects))
+
+	for i, obj := range objects {
+		cid, err := c.objectCID(obj)
+		if err != nil {
+			return nil, err
+		}
+		results[i].CID = cid
+
+		if seen[cid] {
+			continue
+		}
+		seen[cid] = true
+
+		exists, err := c.Has(cid)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) == 0 {
+		return results, nil
+	}
+
+	compressed := make([][]byte, len(pending))
+	errs := make([]error, len(pending))
+	var uncompressed []int
+	for j, i := range pending {
+		if objects[i].Compressed != nil {
+			compressed[j] = objects[i].Compressed
+		} else {
+			uncompressed = append(uncompressed, j)
+		}
+	}
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(runtime.GOMAXPROCS(0), len(uncompressed)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				compressed[j], errs[j] = compressForStorage(objects[pending[j]].Data)
+			}
+		}()
+	}
+	for _, j := range uncompressed {
+		work <- j
+	}
+	close(work)
+	wg.Wait()
+
+	batch := c.db.NewBatch()
+	defer batch.Close()
+	for j, i := range pending {
+		if errs[j] != nil {
+			return nil, fmt.Errorf("failed to compress object %d: %w", i, errs[j])
+		}
+		if err := batch.Set(casKey(results[i].CID), compressed[j], nil); err != nil {
+			return nil, fmt.Errorf("failed to stage object %d: %w", i, err)
+		}
+	}
+	if err := batch.Commit(c.writeOpts); err != nil {
+		return nil, fmt.Errorf("failed to store batch in CAS: %w", err)
+	}
+
+	for j, i := range pending {
+		results[i].Written = len(compressed[j])
+		c.markStored(results[i].CID)
+	}
+	return results, nil
+}
+
+func (c *CASStore) objectCID(obj Object) (string, error) {
+	if obj.Hash != nil {
+		return hex.EncodeToString(obj.Hash[:]), nil
+	}
+	return c.computeCID(obj.Data)
+}
@@ -0,0 +1,86 @@
+package cas
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+func TestCASStore_PutBatch(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	store, err := NewCASStore(db, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := mustPut(t, store, []byte("already stored"))
+
+	chunk := []byte("hashed chunk")
+	hash := sha256.Sum256(chunk)
+	objects := []Object{
+		{Data: []byte("already stored")},
+		{Data: chunk, Hash: &hash},
+		{Data: []byte("fresh")},
+		{Data: chunk, Hash: &hash},
+	}
+
+	results, err := store.PutBatch(objects)
+	if err != nil {
+		t.Fatalf("PutBatch() error = %v", err)
+	}
+	if len(results) != len(objects) {
+		t.Fatalf("expected %d results, got %d", len(objects), len(results))
+	}
+	if results[0].CID != existing || results[0].Written != 0 {
+		t.Fatalf("existing object should be deduplicated: %+v", results[0])
+	}
+	if results[1].Written == 0 || results[3].Written != 0 || results[1].CID != results[3].CID {
+		t.Fatalf("duplicate within the batch should be written once: %+v %+v", results[1], results[3])
+	}
+
+	for i, obj := range objects {
+		got, err := store.Get(results[i].CID)
+		if err != nil || !bytes.Equal(got, obj.Data) {
+			t.Fatalf("object %d round trip: %q err=%v", i, got, err)
+		}
+	}
+	if cid, err := store.PutChunk(hash, chunk); err != nil || cid != results[1].CID {
+		t.Fatalf("hashed objects must be keyed like PutChunk, got %s err=%v", cid, err)
+	}
+}
+
+func TestUncompressedObjectsReadBackIntact(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	store, err := NewCASStore(db, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pointer := append([]byte(packPointerMagic), make([]byte, sha256.Size)...)
+	pointer = binary.AppendUvarint(pointer, 0)
+	pointer = binary.AppendUvarint(pointer, 5)
+
+	for name, data := range map[string][]byte{
+		"plain":        []byte("already compressed elsewhere"),
+		"zstd magic":   []byte(compressionMagic + "not zstd"),
+		"remote stub":  []byte(remoteStubMagic),
+		"pack pointer": pointer,
+	} {
+		raw, err := UncompressedObject(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		hash := sha256.Sum256(data)
+		results, err := store.PutBatch([]Object{{Data: data, Hash: &hash, Compressed: raw}})
+		if err != nil {
+			t.Fatalf("%s: PutBatch() error = %v", name, err)
+		}
+		got, err := store.Get(results[0].CID)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s round trip: %q err=%v", name, got, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package cas
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+
+	"github.com/saworbit/diffkeeper/internal/metrics"
+)
+
+const (
+	// DefaultKnownCIDs bounds the LRU of CIDs known to be stored.
+	DefaultKnownCIDs = 128 * 1024
+
+	// bloomBitsPerCID gives roughly a 1% false positive rate with
+	// bloomHashes probes.
+	bloomBitsPerCID = 10
+	bloomHashes     = 7
+
+	// bloomMinCIDs is the smallest capacity a filter is sized for.
+	bloomMinCIDs = 1 << 20
+)
+
+// existenceCache short-circuits Has for writers. A bloom filter over every
+// stored CID answers "definitely absent" for new content without touching
+// Pebble, and an LRU of recently seen CIDs answers "present" for the common
+// dedup hit. Anything else falls through to a point lookup.
+type existenceCache struct {
+	mu sync.Mutex
+
+	known    map[string]*list.Element
+	order    *list.List
+	capacity int
+
+	// filter is nil until built, and dropped once more CIDs were added than
+	// it was sized for (its false positive rate would be useless).
+	filter *bloomFilter
+}
+
+func newExistenceCache(capacity int) *existenceCache {
+	return &existenceCache{known: make(map[string]*list.Element), order: list.New(), capacity: capacity}
+}
+
+// lookup reports (present, answered). When answered is false the caller
+// must check the store.
+func (e *existenceCache) lookup(cid string) (bool, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if el, ok := e.known[cid]; ok {
+		e.order.MoveToFront(el)
+		metrics.ObserveCASExistence("cached")
+		return true, true
+	}
+	if e.filter != nil && !e.filter.mayContain(cid) {
+		metrics.ObserveCASExistence("filtered")
+		return false, true
+	}
+	metrics.ObserveCASExistence("lookup")
+	return false, false
+}
+
+// add records that cid is stored.
+func (e *existenceCache) add(cid string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.filter != nil && !e.filter.add(cid) {
+		e.filter = nil
+	}
+	if el, ok := e.known[cid]; ok {
+		e.order.MoveToFront(el)
+		return
+	}
+	e.known[cid] = e.order.PushFront(cid)
+	if e.order.Len() > e.capacity {
+		oldest := e.order.Back()
+		e.order.Remove(oldest)
+		delete(e.known, oldest.Value.(string))
+	}
+}
+
+// remove forgets cid after it was deleted. The bloom filter cannot forget;
+// it only errs towards lookups.
+func (e *existenceCache) remove(cid string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if el, ok := e.known[cid]; ok {
+		e.order.Remove(el)
+		delete(e.known, cid)
+	}
+}
+
+// setFilter installs a filter built from every stored CID.
+func (e *existenceCache) setFilter(f *bloomFilter) {
+	e.mu.Lock()
+	e.filter = f
+	e.mu.Unlock()
+}
+
+// bloomFilter is a fixed-size bloom filter over CID strings.
+type bloomFilter struct {
+	bits     []uint64
+	count    int
+	capacity int
+}
+
+func newBloomFilter(capacity int) *bloomFilter {
+	if capacity < bloomMinCIDs {
+		capacity = bloomMinCIDs
+	}
+	words := (capacity*bloomBitsPerCID + 63) / 64
+	return &bloomFilter{bits: make([]uint64, words), capacity: capacity}
+}
+
+// add inserts cid and reports whether the filter is still within capacity.
+func (b *bloomFilter) add(cid string) bool {
+	h1, h2 := bloomHashPair(cid)
+	n := uint64(len(b.bits) * 64)
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % n
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+	b.count++
+	return b.count <= b.capacity
+}
+
+func (b *bloomFilter) mayContain(cid string) bool {
+	h1, h2 := bloomHashPair(cid)
+	n := uint64(len(b.bits) * 64)
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % n
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHashPair derives the two hashes used for double hashing.
+func bloomHashPair(cid string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(cid))
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31
+	return h1, h2 | 1
+}
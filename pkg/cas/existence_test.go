@@ -0,0 +1,78 @@
+package cas
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilterHasNoFalseNegatives(t *testing.T) {
+	f := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		f.add(fmt.Sprintf("cid-%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !f.mayContain(fmt.Sprintf("cid-%d", i)) {
+			t.Fatalf("cid-%d reported absent", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain(fmt.Sprintf("other-%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 200 {
+		t.Fatalf("false positive rate too high: %d/10000", falsePositives)
+	}
+}
+
+func TestExistenceCacheEvictsOldest(t *testing.T) {
+	c := newExistenceCache(2)
+	c.add("a")
+	c.add("b")
+	c.add("c")
+	if _, ok := c.lookup("a"); ok {
+		t.Fatalf("oldest entry should have been evicted")
+	}
+	if present, ok := c.lookup("c"); !ok || !present {
+		t.Fatalf("newest entry should be cached")
+	}
+}
+
+func TestCASStore_ExistenceCache(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	store, err := NewCASStore(db, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := mustPut(t, store, []byte("stored before the cache"))
+
+	loaded, err := store.EnableExistenceCache()
+	if err != nil || loaded != 1 {
+		t.Fatalf("EnableExistenceCache() = %d, %v", loaded, err)
+	}
+	if ok, err := store.Has(before); err != nil || !ok {
+		t.Fatalf("object stored before enabling must be found: %v %v", ok, err)
+	}
+
+	after := mustPut(t, store, []byte("stored after"))
+	if ok, _ := store.Has(after); !ok {
+		t.Fatalf("new object must be found")
+	}
+	if ok, _ := store.Has("missing"); ok {
+		t.Fatalf("unknown CID must be absent")
+	}
+
+	if err := store.Delete(after); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.Has(after); ok {
+		t.Fatalf("deleted object must not be reported present")
+	}
+	if _, written, err := store.PutWithSize([]byte("stored after")); err != nil || written == 0 {
+		t.Fatalf("re-put after delete must write the object again, written=%d err=%v", written, err)
+	}
+}
@@ -0,0 +1,285 @@
+package cas
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// packPointerMagic marks a CAS value that locates the object inside a pack
+// instead of holding its content: magic, pack hash (32 bytes), then the
+// offset and length of the object as uvarints.
+const packPointerMagic = "DKP1"
+
+// PackOptions tunes Pack.
+type PackOptions struct {
+	// MaxObjectBytes is the largest stored (compressed) object that is packed.
+	MaxObjectBytes int
+
+	// TargetPackBytes is the uncompressed size at which a pack is sealed.
+	TargetPackBytes int
+}
+
+// DefaultPackOptions packs objects up to 4 KiB into packs of about 1 MiB.
+func DefaultPackOptions() PackOptions {
+	return PackOptions{MaxObjectBytes: 4 * 1024, TargetPackBytes: 1024 * 1024}
+}
+
+// PackReport summarizes a Pack run.
+type PackReport struct {
+	// Objects moved into packs by this run.
+	Objects int `json:"objects"`
+	// Packs written by this run.
+	Packs int `json:"packs"`
+	// RemovedPacks no longer referenced by any object (e.g. after
+	// retention deleted their objects).
+	RemovedPacks int `json:"removed_packs"`
+	// BytesBefore is the stored size of the packed objects.
+	BytesBefore int64 `json:"bytes_before"`
+	// BytesAfter is the size of the new packs plus their pointers.
+	BytesAfter int64 `json:"bytes_after"`
+}
+
+// packedObject is an object queued for the current pack.
+type packedObject struct {
+	cid  string
+	data []byte
+}
+
+// Pack moves small objects into packs: their contents are concatenated and
+// compressed together, which compresses far better than one zstd frame per
+// object, and each object's value is replaced by a pointer into its pack.
+// CIDs are unchanged, so Get, GetReader and Has work as before. Packs whose
+// objects were all deleted are removed.
+func (c *CASStore) Pack(opts PackOptions) (PackReport, error) {
+	var report PackReport
+	if opts.MaxObjectBytes <= 0 || opts.TargetPackBytes <= 0 {
+		return report, fmt.Errorf("pack sizes must be positive (max_object=%d target=%d)", opts.MaxObjectBytes, opts.TargetPackBytes)
+	}
+
+	iter, err := newPrefixIter(c.db, PrefixCAS)
+	if err != nil {
+		return report, err
+	}
+	defer iter.Close()
+
+	live := make(map[string]bool)
+	var group []packedObject
+	var groupBytes int
+	var groupStored int64
+
+	flush := func() error {
+		if len(group) > 1 {
+			hash, written, err := c.writePack(group)
+			if err != nil {
+				return err
+			}
+			live[hash] = true
+			report.Objects += len(group)
+			report.Packs++
+			report.BytesBefore += groupStored
+			report.BytesAfter += written
+		}
+		group, groupBytes, groupStored = nil, 0, 0
+		return nil
+	}
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		val := iter.Value()
+		if hash, _, _, ok := decodePackPointer(val); ok {
+			live[hash] = true
+			continue
+		}
+		if len(val) > opts.MaxObjectBytes || isRemoteStub(val) {
+			continue
+		}
+
+		data, err := decompressFromStorage(val)
+		if err != nil {
+			return report, fmt.Errorf("decompress %s: %w", iter.Key(), err)
+		}
+		group = append(group, packedObject{cid: stripPrefix(iter.Key(), PrefixCAS), data: data})
+		groupBytes += len(data)
+		groupStored += int64(len(val))
+		if groupBytes >= opts.TargetPackBytes {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return report, err
+	}
+	if err := flush(); err != nil {
+		return report, err
+	}
+
+	removed, err := c.removeDeadPacks(live)
+	report.RemovedPacks = removed
+	return report, err
+}
+
+// writePack stores group as one pack and points each object at it, in one
+// batch so readers never see a pointer without its pack.
+func (c *CASStore) writePack(group []packedObject) (string, int64, error) {
+	var buf bytes.Buffer
+	offsets := make([]int, len(group))
+	for i, obj := range group {
+		offsets[i] = buf.Len()
+		buf.Write(obj.data)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	hash := hex.EncodeToString(sum[:])
+
+	compressed, err := compressForStorage(buf.Bytes())
+	if err != nil {
+		return "", 0, fmt.Errorf("compress pack: %w", err)
+	}
+
+	batch := c.db.NewBatch()
+	defer batch.Close()
+	if err := batch.Set(packKey(hash), compressed, nil); err != nil {
+		return "", 0, err
+	}
+	written := int64(len(compressed))
+	for i, obj := range group {
+		ptr := encodePackPointer(sum, offsets[i], len(obj.data))
+		if err := batch.Set(casKey(obj.cid), ptr, nil); err != nil {
+			return "", 0, err
+		}
+		written += int64(len(ptr))
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return "", 0, fmt.Errorf("store pack: %w", err)
+	}
+	return hash, written, nil
+}
+
+// removeDeadPacks deletes packs that no object points into.
+func (c *CASStore) removeDeadPacks(live map[string]bool) (int, error) {
+	iter, err := newPrefixIter(c.db, PrefixPack)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	batch := c.db.NewBatch()
+	defer batch.Close()
+	removed := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if live[stripPrefix(iter.Key(), PrefixPack)] {
+			continue
+		}
+		if err := batch.Delete(iter.Key(), nil); err != nil {
+			return 0, err
+		}
+		removed++
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return 0, fmt.Errorf("delete unreferenced packs: %w", err)
+	}
+	c.packs.reset()
+	return removed, nil
+}
+
+// readPacked returns the object a pack pointer refers to.
+func (c *CASStore) readPacked(ptr []byte) ([]byte, error) {
+	hash, offset, length, ok := decodePackPointer(ptr)
+	if !ok {
+		return nil, fmt.Errorf("invalid pack pointer")
+	}
+
+	pack, err := c.packs.get(hash, func() ([]byte, error) {
+		val, closer, err := c.db.Get(packKey(hash))
+		if errors.Is(err, pebble.ErrNotFound) {
+			return nil, fmt.Errorf("pack not found: %s", hash)
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		return decompressFromStorage(val)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if offset+length > len(pack) {
+		return nil, fmt.Errorf("pack %s is truncated", hash)
+	}
+	return append([]byte(nil), pack[offset:offset+length]...), nil
+}
+
+func encodePackPointer(hash [32]byte, offset, length int) []byte {
+	ptr := make([]byte, 0, len(packPointerMagic)+len(hash)+2*binary.MaxVarintLen64)
+	ptr = append(ptr, packPointerMagic...)
+	ptr = append(ptr, hash[:]...)
+	ptr = binary.AppendUvarint(ptr, uint64(offset))
+	ptr = binary.AppendUvarint(ptr, uint64(length))
+	return ptr
+}
+
+func decodePackPointer(val []byte) (string, int, int, bool) {
+	header := len(packPointerMagic) + sha256.Size
+	if len(val) <= header || !bytes.Equal(val[:len(packPointerMagic)], []byte(packPointerMagic)) {
+		return "", 0, 0, false
+	}
+	hash := hex.EncodeToString(val[len(packPointerMagic):header])
+	offset, n := binary.Uvarint(val[header:])
+	if n <= 0 {
+		return "", 0, 0, false
+	}
+	length, m := binary.Uvarint(val[header+n:])
+	if m <= 0 {
+		return "", 0, 0, false
+	}
+	return hash, int(offset), int(length), true
+}
+
+func isPackPointer(val []byte) bool {
+	_, _, _, ok := decodePackPointer(val)
+	return ok
+}
+
+func packKey(hash string) []byte {
+	return []byte(PrefixPack + hash)
+}
+
+// packCache keeps the most recently read pack decompressed; reads of small
+// files restored together usually hit the same pack.
+type packCache struct {
+	mu   sync.Mutex
+	hash string
+	data []byte
+}
+
+func (p *packCache) get(hash string, load func() ([]byte, error)) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hash == hash {
+		return p.data, nil
+	}
+	data, err := load()
+	if err != nil {
+		return nil, err
+	}
+	p.hash, p.data = hash, data
+	return data, nil
+}
+
+func (p *packCache) reset() {
+	p.mu.Lock()
+	p.hash, p.data = "", nil
+	p.mu.Unlock()
+}
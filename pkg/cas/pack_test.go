@@ -0,0 +1,75 @@
+package cas
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestCASStore_Pack(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	store, err := NewCASStore(db, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := make(map[string][]byte)
+	for i := 0; i < 50; i++ {
+		data := []byte(fmt.Sprintf("2025-01-02T15:00:%02dZ INFO worker %d finished batch\n", i, i%3))
+		contents[mustPut(t, store, data)] = data
+	}
+	large := make([]byte, 16*1024)
+	rand.New(rand.NewSource(1)).Read(large)
+	largeCID := mustPut(t, store, large)
+
+	report, err := store.Pack(PackOptions{MaxObjectBytes: 4096, TargetPackBytes: 1024})
+	if err != nil {
+		t.Fatalf("Pack() error = %v", err)
+	}
+	if report.Objects != 50 || report.Packs < 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if report.BytesAfter >= report.BytesBefore {
+		t.Fatalf("packing should shrink the store: %+v", report)
+	}
+
+	for cid, want := range contents {
+		got, err := store.Get(cid)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("Get(%s) = %q, %v; want %q", cid, got, err, want)
+		}
+		rc, err := store.GetReader(cid)
+		if err != nil {
+			t.Fatalf("GetReader(%s) error = %v", cid, err)
+		}
+		streamed, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(streamed, want) {
+			t.Fatalf("GetReader(%s) = %q, %v; want %q", cid, streamed, err, want)
+		}
+	}
+	if got, err := store.Get(largeCID); err != nil || !bytes.Equal(got, large) {
+		t.Fatalf("large object should stay unpacked and readable: %v", err)
+	}
+
+	// A second run has nothing left to pack.
+	again, err := store.Pack(DefaultPackOptions())
+	if err != nil || again.Objects != 0 || again.RemovedPacks != 0 {
+		t.Fatalf("second Pack() = %+v, %v", again, err)
+	}
+
+	// Once every object in the packs is deleted, the packs go too.
+	for cid := range contents {
+		if err := store.Delete(cid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	swept, err := store.Pack(DefaultPackOptions())
+	if err != nil || swept.RemovedPacks != report.Packs {
+		t.Fatalf("expected %d packs removed, got %+v, %v", report.Packs, swept, err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 
@@ -15,9 +16,12 @@ import (
 )
 
 const (
-	PrefixCAS  = "c:" // Stores compressed file chunks
-	PrefixMeta = "m:" // Stores file metadata
-	PrefixLog  = "l:" // Stores raw incoming events (The "Journal")
+	PrefixCAS   = "c:" // Stores compressed file chunks
+	PrefixMeta  = "m:" // Stores file metadata
+	PrefixLog   = "l:" // Stores raw incoming events (The "Journal")
+	PrefixPack  = "p:" // Stores packs of small objects (see Pack)
+	PrefixDir   = "d:" // Stores directory and mode changes
+	PrefixState = "s:" // Stores bookkeeping local to one state dir (never synced)
 )
 
 const (
@@ -30,6 +34,17 @@ const compressionMagic = "DKZ1"
 type CASStore struct {
 	db       *pebble.DB
 	hashAlgo string
+
+	// exists is nil until EnableExistenceCache is called.
+	exists *existenceCache
+
+	// writeOpts applies to object writes; see SetSync.
+	writeOpts *pebble.WriteOptions
+
+	packs packCache
+
+	// remote reads evicted objects; nil without a remote tier.
+	remote RemoteFetcher
 }
 
 // CASObject represents a stored object in CAS
@@ -53,11 +68,22 @@ func NewCASStore(db *pebble.DB, hashAlgo string) (*CASStore, error) {
 	}
 
 	return &CASStore{
-		db:       db,
-		hashAlgo: hashAlgo,
+		db:        db,
+		hashAlgo:  hashAlgo,
+		writeOpts: pebble.Sync,
 	}, nil
 }
 
+// SetSync controls whether object writes wait for an fsync (the default).
+// Without it, a crash can lose recently stored objects until the WAL is
+// synced by a later synced write, LogData or Flush.
+func (c *CASStore) SetSync(sync bool) {
+	c.writeOpts = pebble.NoSync
+	if sync {
+		c.writeOpts = pebble.Sync
+	}
+}
+
 // computeCID computes a content identifier for the given data
 func (c *CASStore) computeCID(data []byte) (string, error) {
 	var hashType uint64
@@ -101,9 +127,10 @@ func (c *CASStore) PutWithSize(data []byte) (string, int, error) {
 		return "", 0, fmt.Errorf("failed to compress object: %w", err)
 	}
 
-	if err := c.db.Set(casKey(cid), compressed, pebble.Sync); err != nil {
+	if err := c.db.Set(casKey(cid), compressed, c.writeOpts); err != nil {
 		return "", 0, fmt.Errorf("failed to store in CAS: %w", err)
 	}
+	c.markStored(cid)
 
 	return cid, len(compressed), nil
 }
@@ -133,9 +160,10 @@ func (c *CASStore) PutChunkWithHash(hash [32]byte, data []byte) (string, int, er
 		return "", 0, fmt.Errorf("failed to compress chunk: %w", err)
 	}
 
-	if err := c.db.Set(casKey(cid), compressed, pebble.Sync); err != nil {
+	if err := c.db.Set(casKey(cid), compressed, c.writeOpts); err != nil {
 		return "", 0, fmt.Errorf("failed to store chunk in CAS: %w", err)
 	}
+	c.markStored(cid)
 
 	return cid, len(compressed), nil
 }
@@ -157,10 +185,71 @@ func (c *CASStore) Get(cid string) ([]byte, error) {
 	}
 	defer closer.Close()
 
+	if isPackPointer(val) {
+		return c.readPacked(val)
+	}
+	if isRemoteStub(val) {
+		return c.readRemote(cid)
+	}
 	copied := append([]byte(nil), val...)
 	return decompressFromStorage(copied)
 }
 
+// GetReader streams an object's content, decompressing it as it is read,
+// without materializing it in memory like Get does. The caller must Close
+// the reader.
+func (c *CASStore) GetReader(cid string) (io.ReadCloser, error) {
+	val, closer, err := c.db.Get(casKey(cid))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, fmt.Errorf("CID not found: %s", cid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if isPackPointer(val) {
+		// Packed objects are small; read them whole.
+		defer closer.Close()
+		data, err := c.readPacked(val)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	if isRemoteStub(val) {
+		closer.Close()
+		data, err := c.readRemote(cid)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	if len(val) < len(compressionMagic) || !bytes.Equal(val[:len(compressionMagic)], []byte(compressionMagic)) {
+		return &objectReader{Reader: bytes.NewReader(val), closer: closer}, nil
+	}
+
+	dec, err := zstd.NewReader(bytes.NewReader(val[len(compressionMagic):]), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		closer.Close()
+		return nil, fmt.Errorf("open zstd stream: %w", err)
+	}
+	return &objectReader{Reader: dec, closer: closer, dec: dec}, nil
+}
+
+// objectReader keeps the Pebble value pinned until the stream is closed.
+type objectReader struct {
+	io.Reader
+	closer io.Closer
+	dec    *zstd.Decoder
+}
+
+func (r *objectReader) Close() error {
+	if r.dec != nil {
+		r.dec.Close()
+	}
+	return r.closer.Close()
+}
+
 // GetChunk retrieves data using a pre-computed SHA256 hash.
 func (c *CASStore) GetChunk(hash [32]byte) ([]byte, error) {
 	return c.Get(hex.EncodeToString(hash[:]))
@@ -168,6 +257,12 @@ func (c *CASStore) GetChunk(hash [32]byte) ([]byte, error) {
 
 // Has checks if a CID exists in CAS
 func (c *CASStore) Has(cid string) (bool, error) {
+	if c.exists != nil {
+		if present, ok := c.exists.lookup(cid); ok {
+			return present, nil
+		}
+	}
+
 	_, closer, err := c.db.Get(casKey(cid))
 	if errors.Is(err, pebble.ErrNotFound) {
 		return false, nil
@@ -176,13 +271,78 @@ func (c *CASStore) Has(cid string) (bool, error) {
 		return false, err
 	}
 	closer.Close()
+	c.markStored(cid)
 	return true, nil
 }
 
+// EnableExistenceCache speeds up Has (and so every Put) for a long-running
+// writer: it loads a bloom filter of all stored CIDs and keeps an LRU of
+// recently seen ones. Objects must only be deleted through this store
+// afterwards; deleting CAS keys directly in Pebble would leave stale
+// "present" answers. Call it before the store is shared between goroutines.
+// It returns the number of CIDs loaded.
+func (c *CASStore) EnableExistenceCache() (int, error) {
+	iter, err := newPrefixIter(c.db, PrefixCAS)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	var cids []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		cids = append(cids, stripPrefix(iter.Key(), PrefixCAS))
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	filter := newBloomFilter(2 * len(cids))
+	for _, cid := range cids {
+		filter.add(cid)
+	}
+	cache := newExistenceCache(DefaultKnownCIDs)
+	cache.setFilter(filter)
+	c.exists = cache
+	return len(cids), nil
+}
+
+func (c *CASStore) markStored(cid string) {
+	if c.exists != nil {
+		c.exists.add(cid)
+	}
+}
+
 // Delete removes a CID from CAS
 // WARNING: This should only be called after verifying no references exist
 func (c *CASStore) Delete(cid string) error {
-	return c.db.Delete(casKey(cid), pebble.Sync)
+	if err := c.db.Delete(casKey(cid), pebble.Sync); err != nil {
+		return err
+	}
+	if c.exists != nil {
+		c.exists.remove(cid)
+	}
+	return nil
+}
+
+// DeleteBatch removes cids with one synced batch. Like Delete, it must only
+// be called for objects nothing references.
+func (c *CASStore) DeleteBatch(cids []string) error {
+	batch := c.db.NewBatch()
+	defer batch.Close()
+	for _, cid := range cids {
+		if err := batch.Delete(casKey(cid), nil); err != nil {
+			return err
+		}
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return err
+	}
+	if c.exists != nil {
+		for _, cid := range cids {
+			c.exists.remove(cid)
+		}
+	}
+	return nil
 }
 
 // AddReference adds a reference from a file to a CID
@@ -306,7 +466,7 @@ func (c *CASStore) GarbageCollect() (int, error) {
 		}
 
 		if refs <= 0 {
-			if err := c.db.Delete(casKey(cid), pebble.Sync); err != nil {
+			if err := c.Delete(cid); err != nil {
 				return deleted, fmt.Errorf("failed to delete CID %s: %w", cid, err)
 			}
 			deleted++
@@ -322,11 +482,11 @@ func (c *CASStore) GarbageCollect() (int, error) {
 
 // Stats returns statistics about the CAS store
 type CASStats struct {
-	TotalObjects     int
-	TotalSize        int64
-	TotalRefs        int
-	UniqueFiles      int
-	UnreferencedObjs int
+	TotalObjects     int   `json:"total_objects"`
+	TotalSize        int64 `json:"total_size"`
+	TotalRefs        int   `json:"total_refs"`
+	UniqueFiles      int   `json:"unique_files"`
+	UnreferencedObjs int   `json:"unreferenced_objects"`
 }
 
 // GetStats returns statistics about the CAS store
@@ -418,6 +578,22 @@ func getZstdDecoder() (*zstd.Decoder, error) {
 	return zstdDecoder, zstdInitErr
 }
 
+// CompressObject returns data as the store keeps it, for Object.Compressed.
+func CompressObject(data []byte) ([]byte, error) {
+	return compressForStorage(data)
+}
+
+// UncompressedObject returns data as the store keeps it without compressing
+// it, for Object.Compressed. Data the store would read as something else, a
+// compressed object, a pack pointer or a remote stub, is compressed anyway,
+// as it would not read back intact otherwise.
+func UncompressedObject(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte(compressionMagic)) || isPackPointer(data) || isRemoteStub(data) {
+		return compressForStorage(data)
+	}
+	return data, nil
+}
+
 func compressForStorage(data []byte) ([]byte, error) {
 	enc, err := getZstdEncoder()
 	if err != nil {
@@ -427,6 +603,13 @@ func compressForStorage(data []byte) ([]byte, error) {
 	return append([]byte(compressionMagic), dst...), nil
 }
 
+// DecodeObject returns the content of a stored CAS value, which is either
+// raw or zstd-compressed with the storage magic. It reads objects copied
+// out of other stores, such as the bbolt stores of DiffKeeper v1.
+func DecodeObject(val []byte) ([]byte, error) {
+	return decompressFromStorage(val)
+}
+
 func decompressFromStorage(data []byte) ([]byte, error) {
 	if len(data) < len(compressionMagic) || !bytes.Equal(data[:len(compressionMagic)], []byte(compressionMagic)) {
 		out := make([]byte, len(data))
@@ -1,6 +1,8 @@
 package cas
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"testing"
 
@@ -116,6 +118,41 @@ func TestCASStore_PutAndGet(t *testing.T) {
 	}
 }
 
+func TestCASStore_Open(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	store, err := NewCASStore(db, "sha256")
+	if err != nil {
+		t.Fatalf("NewCASStore() error = %v", err)
+	}
+
+	data := bytes.Repeat([]byte("streamed content\n"), 4096)
+	cid, err := store.Put(data)
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	rc, err := store.GetReader(cid)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Open() streamed %d bytes, want %d", len(got), len(data))
+	}
+
+	if _, err := store.GetReader("missing"); err == nil {
+		t.Error("Open() of a missing CID should fail")
+	}
+}
+
 func TestCASStore_Deduplication(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
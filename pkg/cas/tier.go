@@ -0,0 +1,167 @@
+package cas
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/multiformats/go-multihash"
+)
+
+// remoteStubMagic is the whole value of a CAS object evicted to the remote
+// tier: the key stays, so Has and recovery still see the object, but its
+// content must be fetched.
+const remoteStubMagic = "DKR1"
+
+// ErrEvicted is returned when reading an evicted object from a store
+// without a remote tier.
+var ErrEvicted = errors.New("object was evicted to the remote tier")
+
+// RemoteFetcher returns the value stored under a CAS or pack key in the
+// remote tier.
+type RemoteFetcher func(key string) ([]byte, error)
+
+// SetRemote makes Get and GetReader fetch evicted objects through fetch.
+// Fetched content is checked against its CID but not stored locally, so
+// read-only stores can read through too.
+func (c *CASStore) SetRemote(fetch RemoteFetcher) {
+	c.remote = fetch
+}
+
+// Evict replaces an object's content with a stub once it is safely stored
+// in the remote tier, returning the bytes freed. Packed and already
+// evicted objects are left alone.
+func (c *CASStore) Evict(cid string) (int, error) {
+	val, closer, err := c.db.Get(casKey(cid))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	size := len(val)
+	skip := isPackPointer(val) || isRemoteStub(val)
+	closer.Close()
+	if skip {
+		return 0, nil
+	}
+	if err := c.db.Set(casKey(cid), []byte(remoteStubMagic), c.writeOpts); err != nil {
+		return 0, fmt.Errorf("evict %s: %w", cid, err)
+	}
+	return size - len(remoteStubMagic), nil
+}
+
+// IsRemoteStub reports whether a stored CAS value is the stub of an
+// evicted object, which must never be copied in place of its content.
+func IsRemoteStub(val []byte) bool {
+	return isRemoteStub(val)
+}
+
+// readRemote fetches an evicted object and checks it against its CID.
+func (c *CASStore) readRemote(cid string) ([]byte, error) {
+	if c.remote == nil {
+		return nil, fmt.Errorf("%s: %w", cid, ErrEvicted)
+	}
+	val, err := c.remote(string(casKey(cid)))
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s from the remote tier: %w", cid, err)
+	}
+	if isRemoteStub(val) {
+		return nil, fmt.Errorf("%s is evicted in the remote tier too", cid)
+	}
+
+	return verifiedContent(cid, val, func(hash string) ([]byte, error) {
+		packed, err := c.remote(string(packKey(hash)))
+		if err != nil {
+			return nil, fmt.Errorf("fetch pack %s from the remote tier: %w", hash, err)
+		}
+		return decompressFromStorage(packed)
+	})
+}
+
+// VerifyObject checks a CAS value received from another store against cid
+// before it is stored. Packed objects are read through pack, which returns
+// the decompressed content of the pack with the given hash.
+func VerifyObject(cid string, val []byte, pack func(hash string) ([]byte, error)) error {
+	_, err := verifiedContent(cid, val, pack)
+	return err
+}
+
+// VerifyPack checks a pack value received from another store against the
+// hash it is keyed by and returns the pack's content.
+func VerifyPack(hash string, val []byte) ([]byte, error) {
+	data, err := decompressFromStorage(val)
+	if err != nil {
+		return nil, fmt.Errorf("pack %s: %w", hash, err)
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != hash {
+		return nil, fmt.Errorf("content for pack %s hashes to %s", hash, got)
+	}
+	return data, nil
+}
+
+// verifiedContent decodes a stored CAS value and checks it against cid.
+func verifiedContent(cid string, val []byte, pack func(hash string) ([]byte, error)) ([]byte, error) {
+	if isRemoteStub(val) {
+		return nil, fmt.Errorf("%s: %w", cid, ErrEvicted)
+	}
+
+	var data []byte
+	if hash, offset, length, ok := decodePackPointer(val); ok {
+		packed, err := pack(hash)
+		if err != nil {
+			return nil, err
+		}
+		if offset+length > len(packed) {
+			return nil, fmt.Errorf("pack %s is truncated", hash)
+		}
+		data = packed[offset : offset+length]
+	} else {
+		var err error
+		if data, err = decompressFromStorage(val); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkCID(cid, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// checkCID verifies content fetched from outside the store: chunks are
+// keyed by their hex SHA-256, other objects by their multihash, which names
+// the hash function it was computed with.
+func checkCID(cid string, data []byte) error {
+	var got string
+	if raw, err := hex.DecodeString(cid); err == nil && len(raw) == sha256.Size {
+		sum := sha256.Sum256(data)
+		got = hex.EncodeToString(sum[:])
+	} else {
+		mh, err := multihash.FromB58String(cid)
+		if err != nil {
+			return fmt.Errorf("invalid CID %q: %w", cid, err)
+		}
+		decoded, err := multihash.Decode(mh)
+		if err != nil {
+			return fmt.Errorf("invalid CID %q: %w", cid, err)
+		}
+		sum, err := multihash.Sum(data, decoded.Code, decoded.Length)
+		if err != nil {
+			return fmt.Errorf("hash content for %s: %w", cid, err)
+		}
+		got = sum.B58String()
+	}
+	if got != cid {
+		return fmt.Errorf("content for %s hashes to %s", cid, got)
+	}
+	return nil
+}
+
+func isRemoteStub(val []byte) bool {
+	return bytes.Equal(val, []byte(remoteStubMagic))
+}
@@ -0,0 +1,58 @@
+package cas
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestCASStore_EvictAndReadRemote(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	store, err := NewCASStore(db, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("small object, evicted before packing\n")
+	cid := mustPut(t, store, data)
+	stored, closer, err := db.Get(casKey(cid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := map[string][]byte{PrefixCAS + cid: append([]byte(nil), stored...)}
+	closer.Close()
+
+	if freed, err := store.Evict(cid); err != nil || freed <= 0 {
+		t.Fatalf("Evict() = %d, %v", freed, err)
+	}
+	if freed, err := store.Evict(cid); err != nil || freed != 0 {
+		t.Fatalf("second Evict() = %d, %v, want a no-op", freed, err)
+	}
+	if _, err := store.Get(cid); !errors.Is(err, ErrEvicted) {
+		t.Fatalf("Get() without a remote = %v, want ErrEvicted", err)
+	}
+
+	// Pack must not mistake the stub for content.
+	if report, err := store.Pack(PackOptions{MaxObjectBytes: 4096, TargetPackBytes: 1024}); err != nil || report.Objects != 0 {
+		t.Fatalf("Pack() = %+v, %v, want the stub left alone", report, err)
+	}
+
+	store.SetRemote(func(key string) ([]byte, error) { return remote[key], nil })
+	r, err := store.GetReader(cid)
+	if err != nil {
+		t.Fatalf("GetReader() error = %v", err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read-through content = %q", got)
+	}
+
+	// A remote that returns other content is caught by the CID check.
+	remote[PrefixCAS+cid] = []byte("tampered")
+	if _, err := store.Get(cid); err == nil {
+		t.Fatal("Get() should reject content that does not match its CID")
+	}
+}
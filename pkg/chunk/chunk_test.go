@@ -2,7 +2,9 @@ package chunk
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
 	"testing"
 )
@@ -307,3 +309,31 @@ func TestRabinChunkerStreaming(t *testing.T) {
 		t.Fatalf("expected at least one chunk")
 	}
 }
+
+func TestRabinChunkerCutsAtLineEnds(t *testing.T) {
+	var payload []byte
+	for i := 0; len(payload) < 256*1024; i++ {
+		sum := sha256.Sum256([]byte{byte(i), byte(i >> 8)})
+		payload = append(payload, fmt.Sprintf("line %d: %x\n", i, sum[:i%32])...)
+	}
+	params := Params{MinSize: 1024, AvgSize: 4096, MaxSize: 64 * 1024, Window: 32, Lines: true}
+
+	chunker := NewRabinChunker(bytes.NewReader(payload), params)
+	var chunks int
+	for {
+		ch, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("chunker.Next error: %v", err)
+		}
+		if ch.Data[len(ch.Data)-1] != '\n' {
+			t.Fatalf("chunk at %d (%d bytes) does not end at a line end", ch.Ref.Offset, ch.Ref.Length)
+		}
+		chunks++
+	}
+	if chunks < 2 {
+		t.Fatalf("expected several chunks, got %d", chunks)
+	}
+}
@@ -29,6 +29,10 @@ type Params struct {
 	AvgSize int // Target average chunk size in bytes
 	MaxSize int // Hard maximum chunk size in bytes
 	Window  int // Rolling hash window size
+	// Lines defers each cut the rolling hash picks to the next line end,
+	// so chunks of text hold whole lines and an edit re-stores only the
+	// chunks around the lines it changed. MaxSize still cuts mid-line.
+	Lines bool
 }
 
 // Chunk holds a chunk's byte data and reference metadata.
@@ -44,6 +48,9 @@ type RabinChunker struct {
 	offset uint64
 	mask   uint64
 	hash   *rollingHash
+
+	// deferHash leaves Ref.Hash zero; see DeferHashing.
+	deferHash bool
 }
 
 // NewRabinChunker builds a streaming chunker over the provided reader.
@@ -57,6 +64,12 @@ func NewRabinChunker(r io.Reader, params Params) *RabinChunker {
 	}
 }
 
+// DeferHashing makes Next leave Ref.Hash zero, for callers that hash the
+// chunks themselves, such as on several cores while chunking continues.
+func (c *RabinChunker) DeferHashing() {
+	c.deferHash = true
+}
+
 // Next returns the next content-defined chunk or io.EOF when complete.
 // It never holds more than MaxSize bytes in memory for a single chunk.
 func (c *RabinChunker) Next() (Chunk, error) {
@@ -65,6 +78,7 @@ func (c *RabinChunker) Next() (Chunk, error) {
 	}
 
 	buf := make([]byte, 0, c.params.AvgSize)
+	armed := false
 	for {
 		b, err := c.r.ReadByte()
 		if err != nil {
@@ -84,23 +98,48 @@ func (c *RabinChunker) Next() (Chunk, error) {
 			continue
 		}
 
-		// Cut at a boundary once min is satisfied, either via hash match or max length.
-		if (c.hash.sum()&c.mask) == 0 || len(buf) >= c.params.MaxSize {
+		if len(buf) >= c.params.MaxSize {
+			break
+		}
+		// Cut at a boundary once min is satisfied, either via hash match or,
+		// for Lines, at the first line end after one.
+		if (c.boundaryHash() & c.mask) == 0 {
+			armed = true
+		}
+		if armed && (!c.params.Lines || b == '\n') {
 			break
 		}
 	}
 
-	sum := sha256.Sum256(buf)
 	ref := ChunkRef{
-		Hash:   sum,
 		Offset: c.offset,
 		Length: uint32(len(buf)),
 	}
+	if !c.deferHash {
+		ref.Hash = sha256.Sum256(buf)
+	}
 	c.offset += uint64(len(buf))
 
 	return Chunk{Ref: ref, Data: buf}, nil
 }
 
+// boundaryHash returns the rolling hash boundaries are picked from. Lines
+// mixes its bits first: the raw sum's low bits follow the last few bytes,
+// and over text they are rarely all zero. Other chunking keeps the raw sum
+// so its boundaries, and the chunks stored along them, stay the same.
+func (c *RabinChunker) boundaryHash() uint64 {
+	h := c.hash.sum()
+	if !c.params.Lines {
+		return h
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
 // normalize ensures sane defaults and bounds for chunking parameters.
 func (p Params) normalize() Params {
 	if p.MinSize <= 0 {
@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/glob"
 )
 
 // DiffConfig holds configuration for binary diff operations
@@ -34,7 +38,9 @@ type DiffConfig struct {
 	// HashAlgo specifies the hash algorithm for CAS ("sha256" or "blake3")
 	HashAlgo string
 
-	// DedupScope defines deduplication scope ("container" or "cluster")
+	// DedupScope defines deduplication scope ("container" or "cluster").
+	// With "cluster", the remote tier is asked which objects it already
+	// holds before uploading them.
 	DedupScope string
 
 	// EnableDiff enables binary diff mode (vs legacy full-file compression)
@@ -43,17 +49,497 @@ type DiffConfig struct {
 	// SnapshotInterval defines how often to create full snapshots (version count)
 	SnapshotInterval int
 
+	// LineEndings translates the line endings of text shown by cat and
+	// patch exports (LineEndingsKeep, LineEndingsLF or LineEndingsCRLF);
+	// stored content is never changed
+	LineEndings string
+
+	// NormalizeEncoding strips UTF-8 byte order marks and shows UTF-16 text
+	// as UTF-8 in cat and patch exports
+	NormalizeEncoding bool
+
+	// DiffMaxMemoryMB bounds the memory one diff may take; larger files
+	// are reported as changed without one (0 = unlimited)
+	DiffMaxMemoryMB int
+
 	// ChunkThresholdBytes is the file size threshold for chunking
 	ChunkThresholdBytes int64
 
 	// EBPF holds configuration for kernel-level monitoring, profiler, and lifecycle tracing
 	EBPF EBPFConfig
+
+	// WatchDir is the directory tree recorded by `diffkeeper record`
+	WatchDir string
+
+	// Namespace isolates the files recorded by one job from the other jobs
+	// recorded into the same state dir (empty = default namespace)
+	Namespace string
+
+	// IgnorePatterns are globs, relative to WatchDir, that are never captured
+	IgnorePatterns []string
+
+	// DebounceWindow delays a capture until a path has been quiet this long
+	DebounceWindow time.Duration
+
+	// MaxCapturesPerSecond caps how often a single path is captured (0 = unlimited)
+	MaxCapturesPerSecond int
+
+	// MaxFileSizeMB caps the content stored per capture (0 = unlimited).
+	// Larger files keep only their head and tail plus their size and hash.
+	MaxFileSizeMB int
+
+	// Observe records only the size and hash of every capture, not its
+	// content
+	Observe bool
+
+	// Backfill records the content a file had before the run when its first
+	// change during the run only appended to it
+	Backfill bool
+
+	// Policies override how matching paths are captured and retained; the
+	// first policy whose pattern matches a path applies
+	Policies []PathPolicy
+
+	// Hooks notify webhooks or run scripts when recording events happen
+	Hooks []Hook
+
+	// Notify posts a failure summary to a chat webhook when the recorded
+	// command exits nonzero
+	Notify NotifyConfig
+
+	// ResourceInterval is how often CPU, memory and I/O of the recorded
+	// process tree are sampled (0 = disabled)
+	ResourceInterval time.Duration
+
+	// StallTimeout marks the recorded command as stalled after this long
+	// without file changes or output (0 = disabled)
+	StallTimeout time.Duration
+
+	// StallKill stops a stalled command, with SIGQUIT first so Go programs
+	// print their goroutine stacks
+	StallKill bool
+
+	// WatchFallback covers directories inotify cannot watch once
+	// fs.inotify.max_user_watches is exhausted (WatchFallbackPoll,
+	// WatchFallbackEBPF or WatchFallbackError)
+	WatchFallback string
+
+	// WatchBackend selects how changes under WatchDir are noticed
+	// (WatchBackendInotify or WatchBackendPoll)
+	WatchBackend string
+
+	// PollInterval is the shortest interval between scans of the poll
+	// backend, used while files keep changing
+	PollInterval time.Duration
+
+	// PollMaxInterval is the longest interval the poll backend backs off to
+	// while nothing changes
+	PollMaxInterval time.Duration
+
+	// Retention bounds how much history a state dir keeps
+	Retention RetentionConfig
+
+	// Tier copies CAS objects to a remote as they are stored and keeps
+	// only a bounded cache of them locally
+	Tier TierConfig
+
+	// Replication ships everything recorded to a standby state dir
+	Replication ReplicationConfig
+
+	// MetricsAddr serves Prometheus metrics on this address when non-empty
+	MetricsAddr string
+
+	// Durability selects which writes wait for an fsync (DurabilityStrict,
+	// DurabilityBatched or DurabilityRelaxed)
+	Durability string
+
+	// SyncInterval is how often unsynced writes are flushed to disk under
+	// the batched and relaxed durability levels
+	SyncInterval time.Duration
+
+	// ProcessorWorkers is how many goroutines turn journal entries into
+	// versions; entries for one path always go to the same worker
+	ProcessorWorkers int
+
+	// MinFreeMB is the free space the state dir's filesystem must keep;
+	// below it, captures store metadata only (0 = unchecked)
+	MinFreeMB int
+
+	// ContentCacheMB bounds the reconstructed file versions kept in memory
+	// by commands that read the same versions repeatedly, such as bisect
+	// and mount (0 = no cache)
+	ContentCacheMB int
+
+	// Quota bounds how much a recording and its state dir may store
+	Quota QuotaConfig
+
+	// Overhead bounds the CPU and I/O diffkeeper itself may take from the
+	// job it records
+	Overhead OverheadConfig
+
+	// SignKey is a PEM private key file used to sign the session Merkle root
+	// when a recording ends (empty = unsigned)
+	SignKey string
+}
+
+// namespacePattern is what a namespace may look like; it is part of every
+// recorded path, so it must not contain a path separator.
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ValidateNamespace checks a namespace name. The empty string selects the
+// default namespace.
+func ValidateNamespace(ns string) error {
+	if ns != "" && !namespacePattern.MatchString(ns) {
+		return fmt.Errorf("invalid namespace %q: use letters, digits, '.', '_' and '-'", ns)
+	}
+	return nil
+}
+
+// Watch fallbacks for directories beyond the inotify watch limit.
+const (
+	// WatchFallbackPoll scans unwatched directories for changes periodically.
+	WatchFallbackPoll = "poll"
+
+	// WatchFallbackEBPF captures writes under unwatched directories from
+	// eBPF events only, polling when eBPF is unavailable.
+	WatchFallbackEBPF = "ebpf"
+
+	// WatchFallbackError fails the recording instead.
+	WatchFallbackError = "error"
+)
+
+// Watch backends for `diffkeeper record`.
+const (
+	// WatchBackendInotify watches every directory with inotify (fsnotify).
+	WatchBackendInotify = "inotify"
+
+	// WatchBackendPoll scans the watch directory for new or changed files,
+	// for filesystems that deliver no inotify events (NFS, FUSE).
+	WatchBackendPoll = "poll"
+)
+
+// Durability levels, from safest to fastest.
+const (
+	// DurabilityStrict fsyncs every journal append, CAS object and metadata
+	// record. Nothing acknowledged is lost on a crash.
+	DurabilityStrict = "strict"
+
+	// DurabilityBatched fsyncs CAS objects and metadata as they are
+	// processed; journal appends are synced every SyncInterval. A crash can
+	// lose captures from the last interval.
+	DurabilityBatched = "batched"
+
+	// DurabilityRelaxed fsyncs nothing on the write path and syncs every
+	// SyncInterval. A crash can lose the last interval of captures and
+	// processed versions.
+	DurabilityRelaxed = "relaxed"
+)
+
+// What a recording does once it exceeds a hard quota.
+const (
+	// QuotaActionMetadata keeps recording paths, sizes and hashes only.
+	QuotaActionMetadata = "metadata"
+
+	// QuotaActionStop captures nothing more.
+	QuotaActionStop = "stop"
+)
+
+// Line ending translations for displayed text.
+const (
+	// LineEndingsKeep shows line endings as recorded.
+	LineEndingsKeep = "keep"
+
+	// LineEndingsLF shows every line ending as \n.
+	LineEndingsLF = "lf"
+
+	// LineEndingsCRLF shows every line ending as \r\n.
+	LineEndingsCRLF = "crlf"
+)
+
+// Capture modes of a PathPolicy.
+const (
+	// CaptureFull stores the whole content, regardless of Observe and
+	// MaxFileSizeMB.
+	CaptureFull = "full"
+
+	// CaptureMetadata stores only the size and hash, as Observe does.
+	CaptureMetadata = "metadata"
+
+	// CaptureRedact stores the content with secrets masked, also in
+	// observe mode.
+	CaptureRedact = "redact"
+
+	// CaptureIgnore never captures the path.
+	CaptureIgnore = "ignore"
+
+	// CaptureSnapshot captures every write, skipping debounce and the rate
+	// limit.
+	CaptureSnapshot = "snapshot"
+)
+
+// Storage strategies of a PathPolicy.
+const (
+	// StorageAuto stores content up to the chunk threshold as one
+	// compressed object and larger content as content-defined chunks, and
+	// stores appends as just their new bytes.
+	StorageAuto = "auto"
+
+	// StorageStore stores the content as one object without compressing
+	// it, for formats such as images and archives that are compressed
+	// already.
+	StorageStore = "store"
+
+	// StorageWhole stores the content as one compressed object, whatever
+	// its size.
+	StorageWhole = "whole"
+
+	// StorageChunk splits the content into content-defined chunks whatever
+	// its size, so files such as tar archives share the chunks they have in
+	// common.
+	StorageChunk = "chunk"
+
+	// StorageLines splits the content into chunks cut at line ends, so an
+	// edit to a text file stores only the chunks around the lines it
+	// changed.
+	StorageLines = "lines"
+)
+
+// PathPolicy overrides capture settings for paths matching Path, a glob
+// relative to WatchDir. Empty fields keep the global setting.
+type PathPolicy struct {
+	Path    string
+	Capture string
+	// MaxVersions overrides Retention.MaxVersions for matching paths.
+	MaxVersions int
+	// Redact lists regular expressions masked under CaptureRedact; a
+	// pattern with a capture group masks only the first group. Empty uses
+	// built-in patterns for passwords, tokens and private keys.
+	Redact []string
+	// Critical stores captures of matching paths ahead of any backlog of
+	// other captures.
+	Critical bool
+	// Storage picks how the content of matching paths is stored, one of
+	// the Storage* strategies.
+	Storage string
+}
+
+// Validate checks the pattern, capture mode, storage strategy and
+// redaction patterns.
+func (p PathPolicy) Validate() error {
+	if err := glob.Validate(p.Path); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", p.Path, err)
+	}
+	switch p.Capture {
+	case "", CaptureFull, CaptureMetadata, CaptureRedact, CaptureIgnore, CaptureSnapshot:
+	default:
+		return fmt.Errorf("invalid capture mode %q for %s (must be 'full', 'metadata', 'redact', 'ignore' or 'snapshot')", p.Capture, p.Path)
+	}
+	switch p.Storage {
+	case "", StorageAuto, StorageStore, StorageWhole, StorageChunk, StorageLines:
+	default:
+		return fmt.Errorf("invalid storage %q for %s (must be 'auto', 'store', 'whole', 'chunk' or 'lines')", p.Storage, p.Path)
+	}
+	if p.MaxVersions < 0 {
+		return fmt.Errorf("max_versions for %s cannot be negative, got: %d", p.Path, p.MaxVersions)
+	}
+	for _, expr := range p.Redact {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("invalid redact pattern for %s: %w", p.Path, err)
+		}
+	}
+	return nil
+}
+
+// Hook events.
+const (
+	// HookFileChanged fires for every stored version of a matching path.
+	HookFileChanged = "file_changed"
+
+	// HookBurst fires when matching paths are captured at least Threshold
+	// times within Window.
+	HookBurst = "burst"
+
+	// HookCommandFailed fires when the recorded command exits nonzero.
+	HookCommandFailed = "command_failed"
+
+	// HookExportCompleted fires after a successful export.
+	HookExportCompleted = "export_completed"
+)
+
+// Hook delivers one kind of event as JSON, either POSTed to URL or written
+// to the stdin of Exec (program and arguments, run without a shell).
+type Hook struct {
+	On   string
+	Path string // glob limiting file_changed and burst; empty matches all
+	URL  string
+	Exec []string
+
+	Threshold int
+	Window    time.Duration
+
+	// Timeout bounds one delivery (0 = 10s).
+	Timeout time.Duration
+}
+
+// Validate checks the event, target and burst settings.
+func (h Hook) Validate() error {
+	switch h.On {
+	case HookFileChanged, HookBurst, HookCommandFailed, HookExportCompleted:
+	default:
+		return fmt.Errorf("invalid hook event %q (must be '%s', '%s', '%s' or '%s')", h.On, HookFileChanged, HookBurst, HookCommandFailed, HookExportCompleted)
+	}
+	if (h.URL == "") == (len(h.Exec) == 0) {
+		return fmt.Errorf("%s hook needs exactly one of url and exec", h.On)
+	}
+	if h.Path != "" {
+		if err := glob.Validate(h.Path); err != nil {
+			return fmt.Errorf("invalid %s hook pattern %q: %w", h.On, h.Path, err)
+		}
+	}
+	if h.On == HookBurst && (h.Threshold <= 0 || h.Window <= 0) {
+		return fmt.Errorf("burst hook needs a positive threshold and window (threshold=%d window=%s)", h.Threshold, h.Window)
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("%s hook timeout cannot be negative, got: %s", h.On, h.Timeout)
+	}
+	return nil
+}
+
+// Chat formats for failure notifications.
+const (
+	NotifySlack = "slack"
+	NotifyTeams = "teams"
+)
+
+// NotifyConfig selects where failure summaries are posted. An empty URL
+// disables them.
+type NotifyConfig struct {
+	URL    string
+	Format string // NotifySlack or NotifyTeams
+
+	// RecentFiles is how many of the last changed paths to list.
+	RecentFiles int
+
+	// Link points readers at the run or its artifacts; in GitHub Actions it
+	// defaults to the workflow run.
+	Link string
+}
+
+// RetentionConfig limits recorded history. Zero values disable a limit; the
+// latest version of every path is always kept.
+type RetentionConfig struct {
+	MaxAge      time.Duration
+	MaxVersions int
+	// Downsample thins history older than each step's After to one version
+	// per path every Every, ordered by After.
+	Downsample []DownsampleStep
+}
+
+// DownsampleStep is one step of RetentionConfig.Downsample.
+type DownsampleStep struct {
+	After time.Duration
+	Every time.Duration
+}
+
+// ParseDownsample parses steps written as after:every pairs separated by
+// commas, such as "1h:1m,24h:1h".
+func ParseDownsample(s string) ([]DownsampleStep, error) {
+	var steps []DownsampleStep
+	for _, pair := range strings.Split(s, ",") {
+		after, every, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, fmt.Errorf("downsample step %q: want after:every", pair)
+		}
+		a, err := time.ParseDuration(after)
+		if err != nil {
+			return nil, fmt.Errorf("downsample step %q: %w", pair, err)
+		}
+		e, err := time.ParseDuration(every)
+		if err != nil {
+			return nil, fmt.Errorf("downsample step %q: %w", pair, err)
+		}
+		steps = append(steps, DownsampleStep{After: a, Every: e})
+	}
+	return steps, nil
+}
+
+// TierConfig uploads CAS objects to a push/pull remote in the background
+// and reads them back from it once they are evicted locally. An empty
+// Remote disables tiering.
+type TierConfig struct {
+	Remote string
+	// Endpoint replaces the service URL of gs:// and az:// remotes.
+	Endpoint string
+	// CacheMaxMB bounds the CAS objects kept locally once uploaded; the
+	// ones uploaded longest ago are evicted first (0 = keep all).
+	CacheMaxMB int
+	// UploadInterval is how often newly stored objects are uploaded.
+	UploadInterval time.Duration
+	// UploadRateKB caps the upload bandwidth in KiB per second (0 =
+	// unlimited), so uploads leave room for the job's own traffic.
+	UploadRateKB int
+}
+
+// QuotaConfig bounds what a recording stores. Soft limits log a warning
+// and raise a metric; hard limits also apply HardAction. Zero values
+// disable a limit.
+type QuotaConfig struct {
+	// SessionSoftMB and SessionHardMB bound the content one recording
+	// captures (per attached job under a daemon).
+	SessionSoftMB int
+	SessionHardMB int
+	// StoreSoftMB and StoreHardMB bound the size of the state dir's store.
+	StoreSoftMB int
+	StoreHardMB int
+	// StoreSoftObjects and StoreHardObjects bound its CAS objects.
+	StoreSoftObjects int
+	StoreHardObjects int
+	// HardAction is QuotaActionMetadata or QuotaActionStop.
+	HardAction string
+}
+
+// Enabled reports whether any limit is set.
+func (q QuotaConfig) Enabled() bool {
+	return q.SessionSoftMB > 0 || q.SessionHardMB > 0 || q.StoreSoftMB > 0 || q.StoreHardMB > 0 ||
+		q.StoreSoftObjects > 0 || q.StoreHardObjects > 0
+}
+
+// OverheadConfig throttles diffkeeper's own capture and processing work.
+// Zero values disable a limit.
+type OverheadConfig struct {
+	// MaxCPUPercent caps the CPU time diffkeeper uses, in percent of one
+	// core; 200 allows two.
+	MaxCPUPercent int
+	// MaxIOMBps caps the MB per second diffkeeper reads from captured
+	// files and stores.
+	MaxIOMBps int
+	// Cgroup also moves diffkeeper into a cgroup of its own with the same
+	// limits, where cgroup v2 allows it, and starts the recorded command
+	// in another one without them.
+	Cgroup bool
+}
+
+// Enabled reports whether any limit is set.
+func (o OverheadConfig) Enabled() bool {
+	return o.MaxCPUPercent > 0 || o.MaxIOMBps > 0
+}
+
+// ReplicationConfig ships a state dir's objects and metadata to a standby
+// push/pull remote in the background, so a lost disk loses at most one
+// interval of history. An empty Target disables replication.
+type ReplicationConfig struct {
+	Target string
+	// Endpoint replaces the service URL of gs:// and az:// targets.
+	Endpoint string
+	// Interval is how often newly recorded keys are shipped.
+	Interval time.Duration
 }
 
 // EBPFConfig captures settings for eBPF-based monitoring and adaptive profiling
 type EBPFConfig struct {
 	Enable           bool
 	ProgramPath      string
+	CaptureBackend   string
 	ProfilerInterval time.Duration
 	ProfilerAlpha    float64
 	HotPathThreshold float64
@@ -66,6 +552,16 @@ type EBPFConfig struct {
 	EventBufferSize  int
 	LifecycleBufSize int
 	BTF              BTFConfig
+
+	// PartialCaptureMB is the size from which a file is captured from the
+	// byte ranges eBPF saw written since its previous capture, instead of
+	// being read whole (0 = always read whole)
+	PartialCaptureMB int
+
+	// PartialVerifyEvery reads such a file whole again after this many
+	// partial captures, catching writes eBPF does not see, such as through
+	// mmap
+	PartialVerifyEvery int
 }
 
 // BTFConfig controls CO-RE relocations and BTFHub downloads
@@ -86,18 +582,41 @@ func DefaultConfig() *DiffConfig {
 		ChunkMaxBytes:       64 * 1024 * 1024, // 64MiB
 		ChunkHashWindow:     64,               // 64 bytes rolling window
 		HashAlgo:            "sha256",
+		LineEndings:         LineEndingsKeep,
+		DiffMaxMemoryMB:     256,
 		DedupScope:          "container",
 		EnableDiff:          true,
 		SnapshotInterval:    10,                     // Full snapshot every 10 versions
 		ChunkThresholdBytes: 1 * 1024 * 1024 * 1024, // 1GB
 		EBPF:                defaultEBPFConfig(),
+		WatchDir:            ".",
+		WatchFallback:       WatchFallbackPoll,
+		WatchBackend:        WatchBackendInotify,
+		PollInterval:        500 * time.Millisecond,
+		PollMaxInterval:     5 * time.Second,
+		Durability:          DurabilityBatched,
+		SyncInterval:        time.Second,
+		ProcessorWorkers:    4,
+		MinFreeMB:           256,
+		ContentCacheMB:      64,
+		Backfill:            true,
+		ResourceInterval:    time.Second,
+		Notify:              NotifyConfig{Format: NotifySlack, RecentFiles: 10},
+		Tier:                TierConfig{UploadInterval: 10 * time.Second},
+		Replication:         ReplicationConfig{Interval: 5 * time.Second},
+		Quota:               QuotaConfig{HardAction: QuotaActionMetadata},
 	}
 }
 
 // LoadFromEnv loads configuration from environment variables
 func LoadFromEnv() *DiffConfig {
 	cfg := DefaultConfig()
+	ApplyEnv(cfg)
+	return cfg
+}
 
+// ApplyEnv overrides cfg with any DIFFKEEPER_* environment variables that are set.
+func ApplyEnv(cfg *DiffConfig) {
 	if lib := os.Getenv("DIFFKEEPER_DIFF_LIBRARY"); lib != "" {
 		cfg.Library = lib
 	}
@@ -149,6 +668,18 @@ func LoadFromEnv() *DiffConfig {
 		}
 	}
 
+	if eol := os.Getenv("DIFFKEEPER_LINE_ENDINGS"); eol != "" {
+		cfg.LineEndings = eol
+	}
+	if normalize := os.Getenv("DIFFKEEPER_NORMALIZE_ENCODING"); normalize != "" {
+		cfg.NormalizeEncoding = normalize == "true" || normalize == "1"
+	}
+	if budget := os.Getenv("DIFFKEEPER_DIFF_MAX_MEMORY_MB"); budget != "" {
+		if n, err := strconv.Atoi(budget); err == nil {
+			cfg.DiffMaxMemoryMB = n
+		}
+	}
+
 	if threshold := os.Getenv("DIFFKEEPER_CHUNK_THRESHOLD_MB"); threshold != "" {
 		if t, err := strconv.Atoi(threshold); err == nil {
 			cfg.ChunkThresholdBytes = int64(t) * 1024 * 1024
@@ -157,7 +688,201 @@ func LoadFromEnv() *DiffConfig {
 
 	cfg.EBPF = loadEBPFConfigFromEnv(cfg.EBPF)
 
-	return cfg
+	if watch := os.Getenv("DIFFKEEPER_WATCH"); watch != "" {
+		cfg.WatchDir = watch
+	}
+	if ns := os.Getenv("DIFFKEEPER_NAMESPACE"); ns != "" {
+		cfg.Namespace = ns
+	}
+	if ignore := os.Getenv("DIFFKEEPER_IGNORE"); ignore != "" {
+		cfg.IgnorePatterns = nil
+		for _, p := range strings.Split(ignore, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				cfg.IgnorePatterns = append(cfg.IgnorePatterns, p)
+			}
+		}
+	}
+	if debounce := os.Getenv("DIFFKEEPER_DEBOUNCE"); debounce != "" {
+		if d, err := time.ParseDuration(debounce); err == nil {
+			cfg.DebounceWindow = d
+		}
+	}
+	if rate := os.Getenv("DIFFKEEPER_MAX_CAPTURES_PER_SECOND"); rate != "" {
+		if n, err := strconv.Atoi(rate); err == nil {
+			cfg.MaxCapturesPerSecond = n
+		}
+	}
+	if size := os.Getenv("DIFFKEEPER_MAX_FILE_SIZE_MB"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil {
+			cfg.MaxFileSizeMB = n
+		}
+	}
+	if observe := os.Getenv("DIFFKEEPER_OBSERVE"); observe != "" {
+		cfg.Observe = observe == "1" || observe == "true" || observe == "TRUE"
+	}
+	if backfill := os.Getenv("DIFFKEEPER_BACKFILL"); backfill != "" {
+		cfg.Backfill = backfill == "1" || backfill == "true" || backfill == "TRUE"
+	}
+	if fallback := os.Getenv("DIFFKEEPER_WATCH_FALLBACK"); fallback != "" {
+		cfg.WatchFallback = fallback
+	}
+	if backend := os.Getenv("DIFFKEEPER_WATCH_BACKEND"); backend != "" {
+		cfg.WatchBackend = backend
+	}
+	if interval := os.Getenv("DIFFKEEPER_POLL_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			cfg.PollInterval = d
+		}
+	}
+	if interval := os.Getenv("DIFFKEEPER_POLL_MAX_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			cfg.PollMaxInterval = d
+		}
+	}
+	if maxAge := os.Getenv("DIFFKEEPER_RETENTION_MAX_AGE"); maxAge != "" {
+		if d, err := time.ParseDuration(maxAge); err == nil {
+			cfg.Retention.MaxAge = d
+		}
+	}
+	if maxVersions := os.Getenv("DIFFKEEPER_RETENTION_MAX_VERSIONS"); maxVersions != "" {
+		if n, err := strconv.Atoi(maxVersions); err == nil {
+			cfg.Retention.MaxVersions = n
+		}
+	}
+	if downsample := os.Getenv("DIFFKEEPER_RETENTION_DOWNSAMPLE"); downsample != "" {
+		if steps, err := ParseDownsample(downsample); err == nil {
+			cfg.Retention.Downsample = steps
+		}
+	}
+	if remote := os.Getenv("DIFFKEEPER_TIER_REMOTE"); remote != "" {
+		cfg.Tier.Remote = remote
+	}
+	if endpoint := os.Getenv("DIFFKEEPER_TIER_ENDPOINT"); endpoint != "" {
+		cfg.Tier.Endpoint = endpoint
+	}
+	if size := os.Getenv("DIFFKEEPER_TIER_CACHE_MAX_MB"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil {
+			cfg.Tier.CacheMaxMB = n
+		}
+	}
+	if interval := os.Getenv("DIFFKEEPER_TIER_UPLOAD_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			cfg.Tier.UploadInterval = d
+		}
+	}
+	if rate := os.Getenv("DIFFKEEPER_TIER_UPLOAD_RATE_KB"); rate != "" {
+		if n, err := strconv.Atoi(rate); err == nil {
+			cfg.Tier.UploadRateKB = n
+		}
+	}
+	if target := os.Getenv("DIFFKEEPER_REPLICATION_TARGET"); target != "" {
+		cfg.Replication.Target = target
+	}
+	if endpoint := os.Getenv("DIFFKEEPER_REPLICATION_ENDPOINT"); endpoint != "" {
+		cfg.Replication.Endpoint = endpoint
+	}
+	if interval := os.Getenv("DIFFKEEPER_REPLICATION_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			cfg.Replication.Interval = d
+		}
+	}
+	if addr := os.Getenv("DIFFKEEPER_METRICS_ADDR"); addr != "" {
+		cfg.MetricsAddr = addr
+	}
+	if durability := os.Getenv("DIFFKEEPER_DURABILITY"); durability != "" {
+		cfg.Durability = durability
+	}
+	if interval := os.Getenv("DIFFKEEPER_SYNC_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			cfg.SyncInterval = d
+		}
+	}
+	if workers := os.Getenv("DIFFKEEPER_PROCESSOR_WORKERS"); workers != "" {
+		if n, err := strconv.Atoi(workers); err == nil {
+			cfg.ProcessorWorkers = n
+		}
+	}
+	if free := os.Getenv("DIFFKEEPER_MIN_FREE_MB"); free != "" {
+		if n, err := strconv.Atoi(free); err == nil {
+			cfg.MinFreeMB = n
+		}
+	}
+	if cacheMB := os.Getenv("DIFFKEEPER_CONTENT_CACHE_MB"); cacheMB != "" {
+		if n, err := strconv.Atoi(cacheMB); err == nil {
+			cfg.ContentCacheMB = n
+		}
+	}
+	if limit := os.Getenv("DIFFKEEPER_QUOTA_SESSION_SOFT_MB"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil {
+			cfg.Quota.SessionSoftMB = n
+		}
+	}
+	if limit := os.Getenv("DIFFKEEPER_QUOTA_SESSION_HARD_MB"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil {
+			cfg.Quota.SessionHardMB = n
+		}
+	}
+	if limit := os.Getenv("DIFFKEEPER_QUOTA_STORE_SOFT_MB"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil {
+			cfg.Quota.StoreSoftMB = n
+		}
+	}
+	if limit := os.Getenv("DIFFKEEPER_QUOTA_STORE_HARD_MB"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil {
+			cfg.Quota.StoreHardMB = n
+		}
+	}
+	if limit := os.Getenv("DIFFKEEPER_QUOTA_STORE_SOFT_OBJECTS"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil {
+			cfg.Quota.StoreSoftObjects = n
+		}
+	}
+	if limit := os.Getenv("DIFFKEEPER_QUOTA_STORE_HARD_OBJECTS"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil {
+			cfg.Quota.StoreHardObjects = n
+		}
+	}
+	if action := os.Getenv("DIFFKEEPER_QUOTA_HARD_ACTION"); action != "" {
+		cfg.Quota.HardAction = action
+	}
+	if key := os.Getenv("DIFFKEEPER_SIGN_KEY"); key != "" {
+		cfg.SignKey = key
+	}
+	if interval := os.Getenv("DIFFKEEPER_RESOURCE_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			cfg.ResourceInterval = d
+		}
+	}
+	if timeout := os.Getenv("DIFFKEEPER_STALL_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err == nil {
+			cfg.StallTimeout = d
+		}
+	}
+	if kill := os.Getenv("DIFFKEEPER_STALL_KILL"); kill != "" {
+		cfg.StallKill = kill == "1" || kill == "true" || kill == "TRUE"
+	}
+	if limit := os.Getenv("DIFFKEEPER_MAX_CPU_PERCENT"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil {
+			cfg.Overhead.MaxCPUPercent = n
+		}
+	}
+	if limit := os.Getenv("DIFFKEEPER_MAX_IO_MBPS"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil {
+			cfg.Overhead.MaxIOMBps = n
+		}
+	}
+	if cgroup := os.Getenv("DIFFKEEPER_OVERHEAD_CGROUP"); cgroup != "" {
+		cfg.Overhead.Cgroup = cgroup == "1" || cgroup == "true" || cgroup == "TRUE"
+	}
+	if url := os.Getenv("DIFFKEEPER_NOTIFY_URL"); url != "" {
+		cfg.Notify.URL = url
+	}
+	if format := os.Getenv("DIFFKEEPER_NOTIFY_FORMAT"); format != "" {
+		cfg.Notify.Format = format
+	}
+	if link := os.Getenv("DIFFKEEPER_NOTIFY_LINK"); link != "" {
+		cfg.Notify.Link = link
+	}
 }
 
 // Validate checks if the configuration is valid
@@ -194,6 +919,15 @@ func (c *DiffConfig) Validate() error {
 		return fmt.Errorf("invalid dedup scope: %s (must be 'container' or 'cluster')", c.DedupScope)
 	}
 
+	switch c.LineEndings {
+	case LineEndingsKeep, LineEndingsLF, LineEndingsCRLF:
+	default:
+		return fmt.Errorf("invalid line endings: %s (must be 'keep', 'lf' or 'crlf')", c.LineEndings)
+	}
+	if c.DiffMaxMemoryMB < 0 {
+		return fmt.Errorf("diff max_memory_mb cannot be negative, got: %d", c.DiffMaxMemoryMB)
+	}
+
 	if c.SnapshotInterval <= 0 {
 		return fmt.Errorf("snapshot interval must be positive, got: %d", c.SnapshotInterval)
 	}
@@ -206,6 +940,149 @@ func (c *DiffConfig) Validate() error {
 		return fmt.Errorf("ebpf config invalid: %w", err)
 	}
 
+	if c.WatchDir == "" {
+		return fmt.Errorf("watch directory must be provided")
+	}
+
+	if err := ValidateNamespace(c.Namespace); err != nil {
+		return err
+	}
+
+	for _, p := range c.IgnorePatterns {
+		if err := glob.Validate(p); err != nil {
+			return fmt.Errorf("invalid ignore pattern %q: %w", p, err)
+		}
+	}
+
+	if c.DebounceWindow < 0 || c.MaxCapturesPerSecond < 0 {
+		return fmt.Errorf("capture limits cannot be negative (debounce=%s max_per_second=%d)", c.DebounceWindow, c.MaxCapturesPerSecond)
+	}
+
+	if c.MaxFileSizeMB < 0 {
+		return fmt.Errorf("max file size cannot be negative, got: %d", c.MaxFileSizeMB)
+	}
+
+	for _, p := range c.Policies {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("policy invalid: %w", err)
+		}
+	}
+
+	if c.ResourceInterval < 0 {
+		return fmt.Errorf("resource interval cannot be negative, got: %s", c.ResourceInterval)
+	}
+
+	if c.StallTimeout < 0 {
+		return fmt.Errorf("stall timeout cannot be negative, got: %s", c.StallTimeout)
+	}
+
+	if c.Notify.Format != NotifySlack && c.Notify.Format != NotifyTeams {
+		return fmt.Errorf("invalid notify format: %s (must be '%s' or '%s')", c.Notify.Format, NotifySlack, NotifyTeams)
+	}
+	if c.Notify.RecentFiles < 0 {
+		return fmt.Errorf("notify recent_files cannot be negative, got: %d", c.Notify.RecentFiles)
+	}
+
+	for _, h := range c.Hooks {
+		if err := h.Validate(); err != nil {
+			return fmt.Errorf("hook invalid: %w", err)
+		}
+	}
+
+	switch c.WatchFallback {
+	case WatchFallbackPoll, WatchFallbackEBPF, WatchFallbackError:
+	default:
+		return fmt.Errorf("invalid watch fallback: %s (must be 'poll', 'ebpf' or 'error')", c.WatchFallback)
+	}
+
+	switch c.WatchBackend {
+	case WatchBackendInotify, WatchBackendPoll:
+	default:
+		return fmt.Errorf("invalid watch backend: %s (must be 'inotify' or 'poll')", c.WatchBackend)
+	}
+
+	if c.PollInterval <= 0 || c.PollMaxInterval < c.PollInterval {
+		return fmt.Errorf("poll intervals must be positive with max >= min (interval=%s max_interval=%s)", c.PollInterval, c.PollMaxInterval)
+	}
+
+	if c.Retention.MaxAge < 0 || c.Retention.MaxVersions < 0 {
+		return fmt.Errorf("retention limits cannot be negative (max_age=%s max_versions=%d)", c.Retention.MaxAge, c.Retention.MaxVersions)
+	}
+	for i, step := range c.Retention.Downsample {
+		if step.After < 0 || step.Every <= 0 {
+			return fmt.Errorf("retention downsample step %d needs after >= 0 and every > 0 (after=%s every=%s)", i+1, step.After, step.Every)
+		}
+		if i > 0 && step.After <= c.Retention.Downsample[i-1].After {
+			return fmt.Errorf("retention downsample steps must be ordered by after (%s follows %s)", step.After, c.Retention.Downsample[i-1].After)
+		}
+	}
+
+	if c.Tier.CacheMaxMB < 0 {
+		return fmt.Errorf("tier cache_max_mb cannot be negative, got: %d", c.Tier.CacheMaxMB)
+	}
+	if c.Tier.UploadRateKB < 0 {
+		return fmt.Errorf("tier upload_rate_kb cannot be negative, got: %d", c.Tier.UploadRateKB)
+	}
+	if c.Tier.Remote != "" && c.Tier.UploadInterval <= 0 {
+		return fmt.Errorf("tier upload interval must be positive, got: %s", c.Tier.UploadInterval)
+	}
+	if c.Replication.Target != "" && c.Replication.Interval <= 0 {
+		return fmt.Errorf("replication interval must be positive, got: %s", c.Replication.Interval)
+	}
+
+	switch c.Durability {
+	case DurabilityStrict, DurabilityBatched, DurabilityRelaxed:
+	default:
+		return fmt.Errorf("invalid durability: %s (must be 'strict', 'batched' or 'relaxed')", c.Durability)
+	}
+
+	if c.Durability != DurabilityStrict && c.SyncInterval <= 0 {
+		return fmt.Errorf("sync interval must be positive for %s durability, got: %s", c.Durability, c.SyncInterval)
+	}
+
+	if c.ProcessorWorkers < 1 {
+		return fmt.Errorf("processor workers must be at least 1, got: %d", c.ProcessorWorkers)
+	}
+
+	if c.MinFreeMB < 0 {
+		return fmt.Errorf("min free space cannot be negative, got: %d", c.MinFreeMB)
+	}
+	if c.ContentCacheMB < 0 {
+		return fmt.Errorf("content cache size cannot be negative, got: %d", c.ContentCacheMB)
+	}
+
+	if err := c.Quota.Validate(); err != nil {
+		return err
+	}
+	if c.Overhead.MaxCPUPercent < 0 || c.Overhead.MaxIOMBps < 0 {
+		return fmt.Errorf("overhead limits cannot be negative (max_cpu_percent=%d max_io_mbps=%d)", c.Overhead.MaxCPUPercent, c.Overhead.MaxIOMBps)
+	}
+
+	return nil
+}
+
+// Validate checks that limits are not negative and soft limits are below
+// hard ones.
+func (q QuotaConfig) Validate() error {
+	pairs := []struct {
+		name       string
+		soft, hard int
+	}{
+		{"session_mb", q.SessionSoftMB, q.SessionHardMB},
+		{"store_mb", q.StoreSoftMB, q.StoreHardMB},
+		{"store_objects", q.StoreSoftObjects, q.StoreHardObjects},
+	}
+	for _, p := range pairs {
+		if p.soft < 0 || p.hard < 0 {
+			return fmt.Errorf("quota %s limits cannot be negative (soft=%d hard=%d)", p.name, p.soft, p.hard)
+		}
+		if p.soft > 0 && p.hard > 0 && p.soft > p.hard {
+			return fmt.Errorf("quota soft %s (%d) cannot exceed hard %s (%d)", p.name, p.soft, p.name, p.hard)
+		}
+	}
+	if q.HardAction != QuotaActionMetadata && q.HardAction != QuotaActionStop {
+		return fmt.Errorf("invalid quota hard_action: %s (must be '%s' or '%s')", q.HardAction, QuotaActionMetadata, QuotaActionStop)
+	}
 	return nil
 }
 
@@ -214,6 +1091,31 @@ func (c *DiffConfig) GetChunkSizeBytes() int {
 	return c.ChunkSizeMB * 1024 * 1024
 }
 
+// PartialCaptureBytes returns EBPF.PartialCaptureMB in bytes (0 = never).
+func (c *DiffConfig) PartialCaptureBytes() int64 {
+	return int64(c.EBPF.PartialCaptureMB) * 1024 * 1024
+}
+
+// MaxFileSizeBytes returns MaxFileSizeMB in bytes (0 = unlimited).
+func (c *DiffConfig) MaxFileSizeBytes() int64 {
+	return int64(c.MaxFileSizeMB) * 1024 * 1024
+}
+
+// MinFreeBytes returns MinFreeMB in bytes (0 = unchecked).
+func (c *DiffConfig) MinFreeBytes() uint64 {
+	return uint64(c.MinFreeMB) * 1024 * 1024
+}
+
+// DiffMaxMemoryBytes returns DiffMaxMemoryMB in bytes (0 = unlimited).
+func (c *DiffConfig) DiffMaxMemoryBytes() int64 {
+	return int64(c.DiffMaxMemoryMB) * 1024 * 1024
+}
+
+// ContentCacheBytes returns ContentCacheMB in bytes (0 = no cache).
+func (c *DiffConfig) ContentCacheBytes() int64 {
+	return int64(c.ContentCacheMB) * 1024 * 1024
+}
+
 // ShouldChunk returns true if a file of the given size should be chunked
 func (c *DiffConfig) ShouldChunk(fileSize int64) bool {
 	if !c.EnableChunking {
@@ -242,19 +1144,22 @@ func (c *DiffConfig) GetChunkingConfig() ChunkingConfig {
 
 func defaultEBPFConfig() EBPFConfig {
 	return EBPFConfig{
-		Enable:           true,
-		ProgramPath:      "",
-		ProfilerInterval: 100 * time.Millisecond,
-		ProfilerAlpha:    0.1,
-		HotPathThreshold: 10.0,
-		EnableProfiler:   true,
-		AutoInject:       true,
-		InjectorCommand:  "",
-		LifecycleTracing: true,
-		FallbackFSNotify: true,
-		CollectLifecycle: true,
-		EventBufferSize:  4096,
-		LifecycleBufSize: 256,
+		Enable:             true,
+		ProgramPath:        "",
+		CaptureBackend:     "auto",
+		ProfilerInterval:   100 * time.Millisecond,
+		ProfilerAlpha:      0.1,
+		HotPathThreshold:   10.0,
+		EnableProfiler:     true,
+		AutoInject:         true,
+		InjectorCommand:    "",
+		LifecycleTracing:   true,
+		FallbackFSNotify:   true,
+		CollectLifecycle:   true,
+		EventBufferSize:    4096,
+		LifecycleBufSize:   256,
+		PartialCaptureMB:   256,
+		PartialVerifyEvery: 16,
 		BTF: BTFConfig{
 			CacheDir:      defaultBTFCacheDir(),
 			AllowDownload: true,
@@ -277,6 +1182,9 @@ func loadEBPFConfigFromEnv(cfg EBPFConfig) EBPFConfig {
 	if v := os.Getenv("DIFFKEEPER_EBPF_PROGRAM"); v != "" {
 		cfg.ProgramPath = v
 	}
+	if v := os.Getenv("DIFFKEEPER_EBPF_CAPTURE_BACKEND"); v != "" {
+		cfg.CaptureBackend = v
+	}
 	if v := os.Getenv("DIFFKEEPER_EBPF_PROFILER_INTERVAL"); v != "" {
 		if d, err := time.ParseDuration(v); err == nil {
 			cfg.ProfilerInterval = d
@@ -317,6 +1225,16 @@ func loadEBPFConfigFromEnv(cfg EBPFConfig) EBPFConfig {
 			cfg.LifecycleBufSize = size
 		}
 	}
+	if v := os.Getenv("DIFFKEEPER_EBPF_PARTIAL_CAPTURE_MB"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.PartialCaptureMB = n
+		}
+	}
+	if v := os.Getenv("DIFFKEEPER_EBPF_PARTIAL_VERIFY_EVERY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.PartialVerifyEvery = n
+		}
+	}
 
 	if cacheDir := os.Getenv("DIFFKEEPER_BTF_CACHE_DIR"); cacheDir != "" {
 		cfg.BTF.CacheDir = cacheDir
@@ -336,6 +1254,11 @@ func (c EBPFConfig) Validate() error {
 	if !c.Enable {
 		return nil
 	}
+	switch c.CaptureBackend {
+	case "", "auto", "fentry", "kprobe":
+	default:
+		return fmt.Errorf("invalid capture backend: %s (must be 'auto', 'fentry' or 'kprobe')", c.CaptureBackend)
+	}
 	if c.ProfilerInterval <= 0 {
 		return fmt.Errorf("profiler interval must be > 0")
 	}
@@ -351,6 +1274,12 @@ func (c EBPFConfig) Validate() error {
 	if c.LifecycleBufSize <= 0 {
 		return fmt.Errorf("lifecycle buffer size must be positive")
 	}
+	if c.PartialCaptureMB < 0 {
+		return fmt.Errorf("partial capture size cannot be negative, got: %d", c.PartialCaptureMB)
+	}
+	if c.PartialCaptureMB > 0 && c.PartialVerifyEvery <= 0 {
+		return fmt.Errorf("partial verify interval must be positive, got: %d", c.PartialVerifyEvery)
+	}
 	if err := c.BTF.Validate(); err != nil {
 		return err
 	}
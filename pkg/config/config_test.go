@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -185,6 +186,24 @@ func TestValidate(t *testing.T) {
 			}(),
 			wantErr: true,
 		},
+		{
+			name: "invalid capture backend",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.EBPF.CaptureBackend = "uprobe"
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "partial captures never verified",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.EBPF.PartialVerifyEvery = 0
+				return c
+			}(),
+			wantErr: true,
+		},
 		{
 			name: "invalid chunk bounds",
 			cfg: func() *DiffConfig {
@@ -195,6 +214,209 @@ func TestValidate(t *testing.T) {
 			}(),
 			wantErr: true,
 		},
+		{
+			name: "invalid watch fallback",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.WatchFallback = "ignore"
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "negative max file size",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.MaxFileSizeMB = -1
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "invalid policy capture mode",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Policies = []PathPolicy{{Path: "**/*.log", Capture: "compress"}}
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "invalid policy storage",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Policies = []PathPolicy{{Path: "**/*.bin", Storage: "bsdiff"}}
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "invalid policy redact pattern",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Policies = []PathPolicy{{Path: "secrets/**", Capture: CaptureRedact, Redact: []string{"("}}}
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "hook without target",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Hooks = []Hook{{On: HookFileChanged, Path: "db.lock"}}
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "burst hook without window",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Hooks = []Hook{{On: HookBurst, URL: "http://localhost/hook", Threshold: 100}}
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "negative stall timeout",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.StallTimeout = -time.Second
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "negative min free space",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.MinFreeMB = -1
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "negative resource interval",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.ResourceInterval = -time.Second
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "invalid notify format",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Notify.Format = "discord"
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "invalid watch backend",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.WatchBackend = "fanotify"
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "poll max interval below interval",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.PollInterval = 2 * time.Second
+				c.PollMaxInterval = time.Second
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "invalid durability",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Durability = "paranoid"
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "relaxed durability without sync interval",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Durability = DurabilityRelaxed
+				c.SyncInterval = 0
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "unknown line endings",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.LineEndings = "cr"
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "no processor workers",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.ProcessorWorkers = 0
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "soft quota above hard quota",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Quota.SessionSoftMB = 200
+				c.Quota.SessionHardMB = 100
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "invalid quota action",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Quota.StoreHardMB = 100
+				c.Quota.HardAction = "pause"
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "negative overhead limit",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Overhead.MaxIOMBps = -1
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "downsample steps out of order",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Retention.Downsample = []DownsampleStep{{After: 24 * time.Hour, Every: time.Hour}, {After: time.Hour, Every: time.Minute}}
+				return c
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "strict durability ignores sync interval",
+			cfg: func() *DiffConfig {
+				c := DefaultConfig()
+				c.Durability = DurabilityStrict
+				c.SyncInterval = 0
+				return c
+			}(),
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -207,6 +429,22 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestParseDownsample(t *testing.T) {
+	steps, err := ParseDownsample("1h:1m, 24h:1h")
+	if err != nil {
+		t.Fatalf("ParseDownsample() error = %v", err)
+	}
+	want := []DownsampleStep{{After: time.Hour, Every: time.Minute}, {After: 24 * time.Hour, Every: time.Hour}}
+	if len(steps) != len(want) || steps[0] != want[0] || steps[1] != want[1] {
+		t.Fatalf("ParseDownsample() = %+v, want %+v", steps, want)
+	}
+	for _, bad := range []string{"1h", "1h:soon", "later:1m"} {
+		if _, err := ParseDownsample(bad); err == nil {
+			t.Errorf("ParseDownsample(%q) should fail", bad)
+		}
+	}
+}
+
 func TestGetChunkSizeBytes(t *testing.T) {
 	cfg := &DiffConfig{ChunkSizeMB: 4}
 	expected := 4 * 1024 * 1024
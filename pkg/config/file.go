@@ -0,0 +1,499 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.yaml.in/yaml/v2"
+)
+
+// FileNames are the config files looked up in the watch root, in order.
+var FileNames = []string{"diffkeeper.yaml", "diffkeeper.yml", "diffkeeper.toml"}
+
+// File mirrors the config file schema. Keys left out of the file keep the
+// default value.
+type File struct {
+	Watch       *string          `yaml:"watch" toml:"watch"`
+	Namespace   *string          `yaml:"namespace" toml:"namespace"`
+	Ignore      []string         `yaml:"ignore" toml:"ignore"`
+	Capture     *FileCapture     `yaml:"capture" toml:"capture"`
+	Policies    []FilePolicy     `yaml:"policies" toml:"policies"`
+	Hooks       []FileHook       `yaml:"hooks" toml:"hooks"`
+	Chunking    *FileChunking    `yaml:"chunking" toml:"chunking"`
+	Diff        *FileDiff        `yaml:"diff" toml:"diff"`
+	EBPF        *FileEBPF        `yaml:"ebpf" toml:"ebpf"`
+	Retention   *FileRetention   `yaml:"retention" toml:"retention"`
+	Tier        *FileTier        `yaml:"tier" toml:"tier"`
+	Replication *FileReplication `yaml:"replication" toml:"replication"`
+	Quota       *FileQuota       `yaml:"quota" toml:"quota"`
+	Overhead    *FileOverhead    `yaml:"overhead" toml:"overhead"`
+	Metrics     *FileMetrics     `yaml:"metrics" toml:"metrics"`
+	Storage     *FileStorage     `yaml:"storage" toml:"storage"`
+	Signing     *FileSigning     `yaml:"signing" toml:"signing"`
+	Notify      *FileNotify      `yaml:"notify" toml:"notify"`
+	Watchdog    *FileWatchdog    `yaml:"watchdog" toml:"watchdog"`
+	Resources   *FileResources   `yaml:"resources" toml:"resources"`
+}
+
+// FileCapture is the `capture` section.
+type FileCapture struct {
+	Debounce        *Duration `yaml:"debounce" toml:"debounce"`
+	MaxPerSecond    *int      `yaml:"max_per_second" toml:"max_per_second"`
+	MaxFileSizeMB   *int      `yaml:"max_file_size_mb" toml:"max_file_size_mb"`
+	Observe         *bool     `yaml:"observe" toml:"observe"`
+	Backfill        *bool     `yaml:"backfill" toml:"backfill"`
+	WatchFallback   *string   `yaml:"watch_fallback" toml:"watch_fallback"`
+	WatchBackend    *string   `yaml:"watch_backend" toml:"watch_backend"`
+	PollInterval    *Duration `yaml:"poll_interval" toml:"poll_interval"`
+	PollMaxInterval *Duration `yaml:"poll_max_interval" toml:"poll_max_interval"`
+}
+
+// FilePolicy is one entry of the `policies` list.
+type FilePolicy struct {
+	Path        string   `yaml:"path" toml:"path"`
+	Capture     string   `yaml:"capture" toml:"capture"`
+	MaxVersions int      `yaml:"max_versions" toml:"max_versions"`
+	Redact      []string `yaml:"redact" toml:"redact"`
+	Critical    bool     `yaml:"critical" toml:"critical"`
+	Storage     string   `yaml:"storage" toml:"storage"`
+}
+
+// FileHook is one entry of the `hooks` list.
+type FileHook struct {
+	On        string    `yaml:"on" toml:"on"`
+	Path      string    `yaml:"path" toml:"path"`
+	URL       string    `yaml:"url" toml:"url"`
+	Exec      []string  `yaml:"exec" toml:"exec"`
+	Threshold int       `yaml:"threshold" toml:"threshold"`
+	Window    *Duration `yaml:"window" toml:"window"`
+	Timeout   *Duration `yaml:"timeout" toml:"timeout"`
+}
+
+// FileChunking is the `chunking` section.
+type FileChunking struct {
+	Enable      *bool  `yaml:"enable" toml:"enable"`
+	SizeMB      *int   `yaml:"size_mb" toml:"size_mb"`
+	MinBytes    *int   `yaml:"min_bytes" toml:"min_bytes"`
+	AvgBytes    *int   `yaml:"avg_bytes" toml:"avg_bytes"`
+	MaxBytes    *int   `yaml:"max_bytes" toml:"max_bytes"`
+	HashWindow  *int   `yaml:"hash_window" toml:"hash_window"`
+	ThresholdMB *int64 `yaml:"threshold_mb" toml:"threshold_mb"`
+}
+
+// FileDiff is the `diff` section.
+type FileDiff struct {
+	Enable            *bool   `yaml:"enable" toml:"enable"`
+	Library           *string `yaml:"library" toml:"library"`
+	HashAlgo          *string `yaml:"hash_algo" toml:"hash_algo"`
+	DedupScope        *string `yaml:"dedup_scope" toml:"dedup_scope"`
+	SnapshotInterval  *int    `yaml:"snapshot_interval" toml:"snapshot_interval"`
+	LineEndings       *string `yaml:"line_endings" toml:"line_endings"`
+	NormalizeEncoding *bool   `yaml:"normalize_encoding" toml:"normalize_encoding"`
+	MaxMemoryMB       *int    `yaml:"max_memory_mb" toml:"max_memory_mb"`
+}
+
+// FileEBPF is the `ebpf` section.
+type FileEBPF struct {
+	Enable           *bool     `yaml:"enable" toml:"enable"`
+	Program          *string   `yaml:"program" toml:"program"`
+	CaptureBackend   *string   `yaml:"capture_backend" toml:"capture_backend"`
+	ProfilerInterval *Duration `yaml:"profiler_interval" toml:"profiler_interval"`
+	ProfilerAlpha    *float64  `yaml:"profiler_alpha" toml:"profiler_alpha"`
+	HotPathThreshold *float64  `yaml:"hot_path_threshold" toml:"hot_path_threshold"`
+	EnableProfiler   *bool     `yaml:"enable_profiler" toml:"enable_profiler"`
+	AutoInject       *bool     `yaml:"auto_inject" toml:"auto_inject"`
+	InjectorCommand  *string   `yaml:"injector_cmd" toml:"injector_cmd"`
+	LifecycleTracing *bool     `yaml:"lifecycle_tracing" toml:"lifecycle_tracing"`
+	FallbackFSNotify *bool     `yaml:"fallback_fsnotify" toml:"fallback_fsnotify"`
+	EventBuffer      *int      `yaml:"event_buffer" toml:"event_buffer"`
+	LifecycleBuffer  *int      `yaml:"lifecycle_buffer" toml:"lifecycle_buffer"`
+	PartialCaptureMB *int      `yaml:"partial_capture_mb" toml:"partial_capture_mb"`
+	PartialVerify    *int      `yaml:"partial_verify_every" toml:"partial_verify_every"`
+	BTF              *FileBTF  `yaml:"btf" toml:"btf"`
+}
+
+// FileBTF is the `ebpf.btf` section.
+type FileBTF struct {
+	CacheDir      *string `yaml:"cache_dir" toml:"cache_dir"`
+	AllowDownload *bool   `yaml:"allow_download" toml:"allow_download"`
+	Mirror        *string `yaml:"mirror" toml:"mirror"`
+}
+
+// FileRetention is the `retention` section.
+type FileRetention struct {
+	MaxAge      *Duration        `yaml:"max_age" toml:"max_age"`
+	MaxVersions *int             `yaml:"max_versions" toml:"max_versions"`
+	Downsample  []FileDownsample `yaml:"downsample" toml:"downsample"`
+}
+
+// FileDownsample is one entry of the `retention.downsample` list.
+type FileDownsample struct {
+	After Duration `yaml:"after" toml:"after"`
+	Every Duration `yaml:"every" toml:"every"`
+}
+
+// FileTier is the `tier` section.
+type FileTier struct {
+	Remote         *string   `yaml:"remote" toml:"remote"`
+	Endpoint       *string   `yaml:"endpoint" toml:"endpoint"`
+	CacheMaxMB     *int      `yaml:"cache_max_mb" toml:"cache_max_mb"`
+	UploadInterval *Duration `yaml:"upload_interval" toml:"upload_interval"`
+	UploadRateKB   *int      `yaml:"upload_rate_kb" toml:"upload_rate_kb"`
+}
+
+// FileReplication is the `replication` section.
+type FileReplication struct {
+	Target   *string   `yaml:"target" toml:"target"`
+	Endpoint *string   `yaml:"endpoint" toml:"endpoint"`
+	Interval *Duration `yaml:"interval" toml:"interval"`
+}
+
+// FileQuota is the `quota` section.
+type FileQuota struct {
+	SessionSoftMB    *int    `yaml:"session_soft_mb" toml:"session_soft_mb"`
+	SessionHardMB    *int    `yaml:"session_hard_mb" toml:"session_hard_mb"`
+	StoreSoftMB      *int    `yaml:"store_soft_mb" toml:"store_soft_mb"`
+	StoreHardMB      *int    `yaml:"store_hard_mb" toml:"store_hard_mb"`
+	StoreSoftObjects *int    `yaml:"store_soft_objects" toml:"store_soft_objects"`
+	StoreHardObjects *int    `yaml:"store_hard_objects" toml:"store_hard_objects"`
+	HardAction       *string `yaml:"hard_action" toml:"hard_action"`
+}
+
+// FileOverhead is the `overhead` section.
+type FileOverhead struct {
+	MaxCPUPercent *int  `yaml:"max_cpu_percent" toml:"max_cpu_percent"`
+	MaxIOMBps     *int  `yaml:"max_io_mbps" toml:"max_io_mbps"`
+	Cgroup        *bool `yaml:"cgroup" toml:"cgroup"`
+}
+
+// FileMetrics is the `metrics` section.
+type FileMetrics struct {
+	Listen *string `yaml:"listen" toml:"listen"`
+}
+
+// FileStorage is the `storage` section.
+type FileStorage struct {
+	Durability       *string   `yaml:"durability" toml:"durability"`
+	SyncInterval     *Duration `yaml:"sync_interval" toml:"sync_interval"`
+	ProcessorWorkers *int      `yaml:"processor_workers" toml:"processor_workers"`
+	MinFreeMB        *int      `yaml:"min_free_mb" toml:"min_free_mb"`
+	ContentCacheMB   *int      `yaml:"content_cache_mb" toml:"content_cache_mb"`
+}
+
+// FileSigning is the `signing` section.
+type FileSigning struct {
+	Key *string `yaml:"key" toml:"key"`
+}
+
+// FileNotify is the `notify` section.
+type FileNotify struct {
+	URL         *string `yaml:"url" toml:"url"`
+	Format      *string `yaml:"format" toml:"format"`
+	RecentFiles *int    `yaml:"recent_files" toml:"recent_files"`
+	Link        *string `yaml:"link" toml:"link"`
+}
+
+// FileResources is the `resources` section.
+type FileResources struct {
+	Interval *Duration `yaml:"interval" toml:"interval"`
+}
+
+// FileWatchdog is the `watchdog` section.
+type FileWatchdog struct {
+	StallTimeout *Duration `yaml:"stall_timeout" toml:"stall_timeout"`
+	Kill         *bool     `yaml:"kill" toml:"kill"`
+}
+
+// Duration is a time.Duration written as a string such as "90s" or "72h".
+type Duration time.Duration
+
+// UnmarshalText parses a Go duration string.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// UnmarshalYAML parses a Go duration string.
+func (d *Duration) UnmarshalYAML(unmarshal func(any) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+// Discover returns the first of FileNames present in dir, or "" if none is.
+func Discover(dir string) string {
+	for _, name := range FileNames {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// LoadFile parses a YAML (.yaml, .yml) or TOML (.toml) config file. Unknown
+// keys are rejected so typos do not go unnoticed.
+func LoadFile(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	var f File
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(data, &f); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.NewDecoder(bytes.NewReader(data)).Decode(&f)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("parse %s: unknown key %q", path, undecoded[0].String())
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format %q (use .yaml, .yml or .toml)", filepath.Ext(path))
+	}
+	return &f, nil
+}
+
+// Apply overrides cfg with every key set in the file.
+func (f *File) Apply(cfg *DiffConfig) {
+	setString(&cfg.WatchDir, f.Watch)
+	setString(&cfg.Namespace, f.Namespace)
+	if f.Ignore != nil {
+		cfg.IgnorePatterns = append([]string(nil), f.Ignore...)
+	}
+
+	if f.Policies != nil {
+		cfg.Policies = make([]PathPolicy, len(f.Policies))
+		for i, p := range f.Policies {
+			cfg.Policies[i] = PathPolicy{Path: p.Path, Capture: p.Capture, MaxVersions: p.MaxVersions, Redact: p.Redact, Critical: p.Critical, Storage: p.Storage}
+		}
+	}
+
+	if f.Hooks != nil {
+		cfg.Hooks = make([]Hook, len(f.Hooks))
+		for i, h := range f.Hooks {
+			hook := Hook{On: h.On, Path: h.Path, URL: h.URL, Exec: h.Exec, Threshold: h.Threshold}
+			if h.Window != nil {
+				hook.Window = time.Duration(*h.Window)
+			}
+			if h.Timeout != nil {
+				hook.Timeout = time.Duration(*h.Timeout)
+			}
+			cfg.Hooks[i] = hook
+		}
+	}
+
+	if c := f.Capture; c != nil {
+		if c.Debounce != nil {
+			cfg.DebounceWindow = time.Duration(*c.Debounce)
+		}
+		setInt(&cfg.MaxCapturesPerSecond, c.MaxPerSecond)
+		setInt(&cfg.MaxFileSizeMB, c.MaxFileSizeMB)
+		setBool(&cfg.Observe, c.Observe)
+		setBool(&cfg.Backfill, c.Backfill)
+		setString(&cfg.WatchFallback, c.WatchFallback)
+		setString(&cfg.WatchBackend, c.WatchBackend)
+		if c.PollInterval != nil {
+			cfg.PollInterval = time.Duration(*c.PollInterval)
+		}
+		if c.PollMaxInterval != nil {
+			cfg.PollMaxInterval = time.Duration(*c.PollMaxInterval)
+		}
+	}
+
+	if c := f.Chunking; c != nil {
+		setBool(&cfg.EnableChunking, c.Enable)
+		setInt(&cfg.ChunkSizeMB, c.SizeMB)
+		setInt(&cfg.ChunkMinBytes, c.MinBytes)
+		setInt(&cfg.ChunkAvgBytes, c.AvgBytes)
+		setInt(&cfg.ChunkMaxBytes, c.MaxBytes)
+		setInt(&cfg.ChunkHashWindow, c.HashWindow)
+		if c.ThresholdMB != nil {
+			cfg.ChunkThresholdBytes = *c.ThresholdMB * 1024 * 1024
+		}
+	}
+
+	if d := f.Diff; d != nil {
+		setBool(&cfg.EnableDiff, d.Enable)
+		setString(&cfg.Library, d.Library)
+		setString(&cfg.HashAlgo, d.HashAlgo)
+		setString(&cfg.DedupScope, d.DedupScope)
+		setInt(&cfg.SnapshotInterval, d.SnapshotInterval)
+		setString(&cfg.LineEndings, d.LineEndings)
+		setBool(&cfg.NormalizeEncoding, d.NormalizeEncoding)
+		setInt(&cfg.DiffMaxMemoryMB, d.MaxMemoryMB)
+	}
+
+	if e := f.EBPF; e != nil {
+		setBool(&cfg.EBPF.Enable, e.Enable)
+		setString(&cfg.EBPF.ProgramPath, e.Program)
+		setString(&cfg.EBPF.CaptureBackend, e.CaptureBackend)
+		if e.ProfilerInterval != nil {
+			cfg.EBPF.ProfilerInterval = time.Duration(*e.ProfilerInterval)
+		}
+		if e.ProfilerAlpha != nil {
+			cfg.EBPF.ProfilerAlpha = *e.ProfilerAlpha
+		}
+		if e.HotPathThreshold != nil {
+			cfg.EBPF.HotPathThreshold = *e.HotPathThreshold
+		}
+		setBool(&cfg.EBPF.EnableProfiler, e.EnableProfiler)
+		setBool(&cfg.EBPF.AutoInject, e.AutoInject)
+		setString(&cfg.EBPF.InjectorCommand, e.InjectorCommand)
+		setBool(&cfg.EBPF.LifecycleTracing, e.LifecycleTracing)
+		setBool(&cfg.EBPF.FallbackFSNotify, e.FallbackFSNotify)
+		setInt(&cfg.EBPF.EventBufferSize, e.EventBuffer)
+		setInt(&cfg.EBPF.LifecycleBufSize, e.LifecycleBuffer)
+		setInt(&cfg.EBPF.PartialCaptureMB, e.PartialCaptureMB)
+		setInt(&cfg.EBPF.PartialVerifyEvery, e.PartialVerify)
+		if b := e.BTF; b != nil {
+			setString(&cfg.EBPF.BTF.CacheDir, b.CacheDir)
+			setBool(&cfg.EBPF.BTF.AllowDownload, b.AllowDownload)
+			setString(&cfg.EBPF.BTF.HubMirror, b.Mirror)
+		}
+	}
+
+	if r := f.Retention; r != nil {
+		if r.MaxAge != nil {
+			cfg.Retention.MaxAge = time.Duration(*r.MaxAge)
+		}
+		setInt(&cfg.Retention.MaxVersions, r.MaxVersions)
+		if r.Downsample != nil {
+			cfg.Retention.Downsample = make([]DownsampleStep, len(r.Downsample))
+			for i, d := range r.Downsample {
+				cfg.Retention.Downsample[i] = DownsampleStep{After: time.Duration(d.After), Every: time.Duration(d.Every)}
+			}
+		}
+	}
+
+	if t := f.Tier; t != nil {
+		setString(&cfg.Tier.Remote, t.Remote)
+		setString(&cfg.Tier.Endpoint, t.Endpoint)
+		setInt(&cfg.Tier.CacheMaxMB, t.CacheMaxMB)
+		if t.UploadInterval != nil {
+			cfg.Tier.UploadInterval = time.Duration(*t.UploadInterval)
+		}
+		setInt(&cfg.Tier.UploadRateKB, t.UploadRateKB)
+	}
+
+	if r := f.Replication; r != nil {
+		setString(&cfg.Replication.Target, r.Target)
+		setString(&cfg.Replication.Endpoint, r.Endpoint)
+		if r.Interval != nil {
+			cfg.Replication.Interval = time.Duration(*r.Interval)
+		}
+	}
+
+	if q := f.Quota; q != nil {
+		setInt(&cfg.Quota.SessionSoftMB, q.SessionSoftMB)
+		setInt(&cfg.Quota.SessionHardMB, q.SessionHardMB)
+		setInt(&cfg.Quota.StoreSoftMB, q.StoreSoftMB)
+		setInt(&cfg.Quota.StoreHardMB, q.StoreHardMB)
+		setInt(&cfg.Quota.StoreSoftObjects, q.StoreSoftObjects)
+		setInt(&cfg.Quota.StoreHardObjects, q.StoreHardObjects)
+		setString(&cfg.Quota.HardAction, q.HardAction)
+	}
+
+	if o := f.Overhead; o != nil {
+		setInt(&cfg.Overhead.MaxCPUPercent, o.MaxCPUPercent)
+		setInt(&cfg.Overhead.MaxIOMBps, o.MaxIOMBps)
+		setBool(&cfg.Overhead.Cgroup, o.Cgroup)
+	}
+
+	if m := f.Metrics; m != nil {
+		setString(&cfg.MetricsAddr, m.Listen)
+	}
+
+	if s := f.Storage; s != nil {
+		setString(&cfg.Durability, s.Durability)
+		if s.SyncInterval != nil {
+			cfg.SyncInterval = time.Duration(*s.SyncInterval)
+		}
+		setInt(&cfg.ProcessorWorkers, s.ProcessorWorkers)
+		setInt(&cfg.MinFreeMB, s.MinFreeMB)
+		setInt(&cfg.ContentCacheMB, s.ContentCacheMB)
+	}
+
+	if s := f.Signing; s != nil {
+		setString(&cfg.SignKey, s.Key)
+	}
+
+	if r := f.Resources; r != nil && r.Interval != nil {
+		cfg.ResourceInterval = time.Duration(*r.Interval)
+	}
+
+	if w := f.Watchdog; w != nil {
+		if w.StallTimeout != nil {
+			cfg.StallTimeout = time.Duration(*w.StallTimeout)
+		}
+		setBool(&cfg.StallKill, w.Kill)
+	}
+
+	if n := f.Notify; n != nil {
+		setString(&cfg.Notify.URL, n.URL)
+		setString(&cfg.Notify.Format, n.Format)
+		setInt(&cfg.Notify.RecentFiles, n.RecentFiles)
+		setString(&cfg.Notify.Link, n.Link)
+	}
+}
+
+// Load resolves the configuration with precedence env > flags > file >
+// defaults, so DIFFKEEPER_* variables set by the environment a recorder runs
+// in win over flags baked into its command line. path names an explicit
+// config file; when empty, FileNames are looked up in discoverDir. flags
+// applies command-line overrides and may be nil. The returned path is the
+// config file that was read, if any.
+func Load(path, discoverDir string, flags func(*DiffConfig)) (*DiffConfig, string, error) {
+	cfg := DefaultConfig()
+
+	if path == "" && discoverDir != "" {
+		path = Discover(discoverDir)
+	}
+	if path != "" {
+		f, err := LoadFile(path)
+		if err != nil {
+			return nil, "", err
+		}
+		f.Apply(cfg)
+	}
+
+	if flags != nil {
+		flags(cfg)
+	}
+	ApplyEnv(cfg)
+	return cfg, path, nil
+}
+
+func setString(dst *string, v *string) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func setInt(dst *int, v *int) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func setBool(dst *bool, v *bool) {
+	if v != nil {
+		*dst = *v
+	}
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadFileYAML(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "diffkeeper.yaml")
+	content := `watch: ./workspace
+ignore:
+  - "**/*.tmp"
+  - .git/
+capture:
+  debounce: 200ms
+  max_per_second: 5
+  max_file_size_mb: 512
+  observe: true
+  backfill: false
+  watch_fallback: ebpf
+  watch_backend: poll
+  poll_interval: 1s
+policies:
+  - path: "**/*.log"
+    capture: metadata
+    storage: lines
+  - path: conf/**
+    capture: full
+    max_versions: 20
+    critical: true
+hooks:
+  - on: file_changed
+    path: db.lock
+    url: http://localhost:9000/page
+  - on: burst
+    threshold: 500
+    window: 10s
+    exec: [./notify.sh, burst]
+watchdog:
+  stall_timeout: 10m
+  kill: true
+resources:
+  interval: 5s
+notify:
+  url: https://hooks.slack.com/services/T/B/X
+  recent_files: 5
+chunking:
+  min_bytes: 2048
+  threshold_mb: 16
+diff:
+  library: xdelta
+  line_endings: lf
+  normalize_encoding: true
+ebpf:
+  capture_backend: kprobe
+  profiler_interval: 250ms
+  partial_capture_mb: 64
+  btf:
+    allow_download: false
+retention:
+  max_age: 72h
+  max_versions: 50
+  downsample:
+    - after: 1h
+      every: 1m
+    - after: 24h
+      every: 1h
+metrics:
+  listen: 127.0.0.1:9911
+storage:
+  durability: relaxed
+  sync_interval: 5s
+  processor_workers: 8
+  min_free_mb: 1024
+overhead:
+  max_cpu_percent: 25
+  max_io_mbps: 50
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+	cfg := DefaultConfig()
+	f.Apply(cfg)
+
+	if cfg.WatchDir != "./workspace" || len(cfg.IgnorePatterns) != 2 || cfg.IgnorePatterns[1] != ".git/" {
+		t.Errorf("unexpected watch/ignore: %q %v", cfg.WatchDir, cfg.IgnorePatterns)
+	}
+	if cfg.DebounceWindow != 200*time.Millisecond || cfg.MaxCapturesPerSecond != 5 || cfg.WatchFallback != WatchFallbackEBPF {
+		t.Errorf("unexpected capture settings: %s %d %s", cfg.DebounceWindow, cfg.MaxCapturesPerSecond, cfg.WatchFallback)
+	}
+	if cfg.MaxFileSizeBytes() != 512<<20 {
+		t.Errorf("unexpected max file size: %d MB", cfg.MaxFileSizeMB)
+	}
+	if !cfg.Observe {
+		t.Errorf("capture.observe not applied")
+	}
+	if cfg.Backfill {
+		t.Errorf("capture.backfill not applied")
+	}
+	if len(cfg.Policies) != 2 || cfg.Policies[0].Capture != CaptureMetadata || cfg.Policies[0].Storage != StorageLines || cfg.Policies[1].MaxVersions != 20 || !cfg.Policies[1].Critical {
+		t.Errorf("unexpected policies: %+v", cfg.Policies)
+	}
+	if len(cfg.Hooks) != 2 || cfg.Hooks[0].URL == "" || cfg.Hooks[1].Window != 10*time.Second || len(cfg.Hooks[1].Exec) != 2 {
+		t.Errorf("unexpected hooks: %+v", cfg.Hooks)
+	}
+	if cfg.ResourceInterval != 5*time.Second {
+		t.Errorf("unexpected resource interval: %s", cfg.ResourceInterval)
+	}
+	if cfg.StallTimeout != 10*time.Minute || !cfg.StallKill {
+		t.Errorf("unexpected watchdog: %s kill=%v", cfg.StallTimeout, cfg.StallKill)
+	}
+	if cfg.Notify.URL == "" || cfg.Notify.Format != NotifySlack || cfg.Notify.RecentFiles != 5 {
+		t.Errorf("unexpected notify: %+v", cfg.Notify)
+	}
+	if cfg.WatchBackend != WatchBackendPoll || cfg.PollInterval != time.Second || cfg.PollMaxInterval != DefaultConfig().PollMaxInterval {
+		t.Errorf("unexpected poll settings: %s %s %s", cfg.WatchBackend, cfg.PollInterval, cfg.PollMaxInterval)
+	}
+	if cfg.ChunkMinBytes != 2048 || cfg.ChunkThresholdBytes != 16*1024*1024 {
+		t.Errorf("unexpected chunking: min=%d threshold=%d", cfg.ChunkMinBytes, cfg.ChunkThresholdBytes)
+	}
+	if cfg.ChunkAvgBytes != DefaultConfig().ChunkAvgBytes {
+		t.Errorf("unset keys should keep defaults, avg=%d", cfg.ChunkAvgBytes)
+	}
+	if cfg.Library != "xdelta" || cfg.EBPF.CaptureBackend != "kprobe" || cfg.EBPF.ProfilerInterval != 250*time.Millisecond {
+		t.Errorf("unexpected diff/ebpf: %s %s %s", cfg.Library, cfg.EBPF.CaptureBackend, cfg.EBPF.ProfilerInterval)
+	}
+	if cfg.LineEndings != LineEndingsLF || !cfg.NormalizeEncoding {
+		t.Errorf("unexpected normalization: %s encoding=%v", cfg.LineEndings, cfg.NormalizeEncoding)
+	}
+	if cfg.EBPF.BTF.AllowDownload || cfg.EBPF.BTF.CacheDir == "" {
+		t.Errorf("unexpected btf config: %+v", cfg.EBPF.BTF)
+	}
+	if cfg.EBPF.PartialCaptureMB != 64 || cfg.EBPF.PartialVerifyEvery != DefaultConfig().EBPF.PartialVerifyEvery {
+		t.Errorf("unexpected partial captures: %d MB, verify every %d", cfg.EBPF.PartialCaptureMB, cfg.EBPF.PartialVerifyEvery)
+	}
+	if cfg.Retention.MaxAge != 72*time.Hour || cfg.Retention.MaxVersions != 50 || cfg.MetricsAddr != "127.0.0.1:9911" ||
+		len(cfg.Retention.Downsample) != 2 || cfg.Retention.Downsample[1] != (DownsampleStep{After: 24 * time.Hour, Every: time.Hour}) {
+		t.Errorf("unexpected retention/metrics: %+v %q", cfg.Retention, cfg.MetricsAddr)
+	}
+	if cfg.Durability != DurabilityRelaxed || cfg.SyncInterval != 5*time.Second || cfg.ProcessorWorkers != 8 || cfg.MinFreeMB != 1024 {
+		t.Errorf("unexpected storage: %s %s workers %d min free %d", cfg.Durability, cfg.SyncInterval, cfg.ProcessorWorkers, cfg.MinFreeMB)
+	}
+	if cfg.Overhead != (OverheadConfig{MaxCPUPercent: 25, MaxIOMBps: 50}) {
+		t.Errorf("unexpected overhead: %+v", cfg.Overhead)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestLoadFileTOML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "diffkeeper.toml")
+	content := `watch = "src"
+ignore = ["*.log"]
+
+[retention]
+max_age = "1h"
+
+[[retention.downsample]]
+after = "1h"
+every = "1m"
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+	cfg := DefaultConfig()
+	f.Apply(cfg)
+	if cfg.WatchDir != "src" || cfg.IgnorePatterns[0] != "*.log" || cfg.Retention.MaxAge != time.Hour ||
+		len(cfg.Retention.Downsample) != 1 || cfg.Retention.Downsample[0].Every != time.Minute {
+		t.Errorf("unexpected config: %q %v %+v", cfg.WatchDir, cfg.IgnorePatterns, cfg.Retention)
+	}
+}
+
+func TestLoadFileRejectsUnknownKeys(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"diffkeeper.yaml": "retention:\n  max_agee: 1h\n",
+		"diffkeeper.toml": "[metrics]\nlisten = \":1\"\nport = 2\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadFile(path); err == nil {
+			t.Errorf("%s: expected unknown key error", name)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	content := "watch: from-file\ndiff:\n  library: xdelta\n  hash_algo: blake3\nmetrics:\n  listen: \":1\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "diffkeeper.yml"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DIFFKEEPER_HASH_ALGO", "sha256")
+	t.Setenv("DIFFKEEPER_WATCH", "from-env")
+
+	cfg, used, err := Load("", dir, func(c *DiffConfig) {
+		c.WatchDir = "from-flag"
+		c.MetricsAddr = ":2"
+	})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if used != filepath.Join(dir, "diffkeeper.yml") {
+		t.Errorf("expected discovered file, got %q", used)
+	}
+	if cfg.WatchDir != "from-env" {
+		t.Errorf("env should override flag and file, got %q", cfg.WatchDir)
+	}
+	if cfg.HashAlgo != "sha256" {
+		t.Errorf("env should override file, got %q", cfg.HashAlgo)
+	}
+	if cfg.MetricsAddr != ":2" {
+		t.Errorf("flag should override file, got %q", cfg.MetricsAddr)
+	}
+	if cfg.Library != "xdelta" {
+		t.Errorf("file should override defaults, got %q", cfg.Library)
+	}
+	if cfg.ChunkSizeMB != DefaultConfig().ChunkSizeMB {
+		t.Errorf("defaults should fill the rest, got %d", cfg.ChunkSizeMB)
+	}
+
+	if _, used, err := Load("", t.TempDir(), nil); err != nil || used != "" {
+		t.Errorf("expected no config file, got %q err=%v", used, err)
+	}
+}
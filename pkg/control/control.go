@@ -0,0 +1,222 @@
+// Package control implements the recorder's local control socket. Helper
+// commands such as `diffkeeper mark` use it to talk to a running recording.
+package control
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// EnvSocket is exported to the recorded command so it can reach the recorder.
+	EnvSocket = "DIFFKEEPER_CONTROL_SOCKET"
+
+	// SocketName is the socket file created inside the state dir.
+	SocketName = "control.sock"
+
+	// maxSocketPath stays below the sun_path limit on Linux (108) and macOS (104).
+	maxSocketPath = 100
+)
+
+// Request is a single command sent to the recorder.
+type Request struct {
+	Op       string            `json:"op"`
+	Name     string            `json:"name,omitempty"`
+	Settings map[string]string `json:"settings,omitempty"`
+	// Since is a cursor for ops that page through a stream.
+	Since uint64 `json:"since,omitempty"`
+
+	// Namespace, Dir and PID describe a job attaching to a daemon; ExitCode
+	// is its command's status when it detaches.
+	Namespace string `json:"namespace,omitempty"`
+	Dir       string `json:"dir,omitempty"`
+	PID       int    `json:"pid,omitempty"`
+	ExitCode  int    `json:"exit_code,omitempty"`
+}
+
+// Response reports the outcome of a Request.
+type Response struct {
+	OK    bool            `json:"ok"`
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// HandlerFunc serves one operation. A non-nil result is encoded into Response.Data.
+type HandlerFunc func(Request) (any, error)
+
+// SocketPath returns the control socket location for a state dir. Paths too
+// long for a unix socket fall back to a deterministic name in the temp dir so
+// both the recorder and clients derive the same location.
+func SocketPath(stateDir string) string {
+	abs, err := filepath.Abs(stateDir)
+	if err != nil {
+		abs = stateDir
+	}
+	path := filepath.Join(abs, SocketName)
+	if len(path) <= maxSocketPath {
+		return path
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(os.TempDir(), "diffkeeper-"+hex.EncodeToString(sum[:6])+".sock")
+}
+
+// Server accepts control connections and dispatches requests by Op.
+type Server struct {
+	path string
+	ln   net.Listener
+
+	mu       sync.RWMutex
+	handlers map[string]HandlerFunc
+	wg       sync.WaitGroup
+}
+
+// Listen creates the control socket at path, replacing a stale socket left by
+// a previous run.
+func Listen(path string) (*Server, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("remove stale control socket: %w", err)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen on control socket: %w", err)
+	}
+
+	return &Server{
+		path:     path,
+		ln:       ln,
+		handlers: make(map[string]HandlerFunc),
+	}, nil
+}
+
+// Path returns the socket location.
+func (s *Server) Path() string {
+	return s.path
+}
+
+// Handle registers fn for requests with the given op.
+func (s *Server) Handle(op string, fn HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[op] = fn
+}
+
+// Serve accepts connections until ctx is cancelled or Close is called.
+func (s *Server) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.ln.Close()
+	}()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("[control] accept error: %v", err)
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops accepting connections, waits for in-flight requests, and removes the socket.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.wg.Wait()
+	os.Remove(s.path)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req Request
+		resp := Response{}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = fmt.Sprintf("decode request: %v", err)
+		} else {
+			resp = s.dispatch(req)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) dispatch(req Request) Response {
+	s.mu.RLock()
+	fn, ok := s.handlers[req.Op]
+	s.mu.RUnlock()
+
+	if !ok {
+		return Response{Error: fmt.Sprintf("unknown op %q", req.Op)}
+	}
+
+	result, err := fn(req)
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+
+	resp := Response{OK: true}
+	if result != nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return Response{Error: fmt.Sprintf("encode result: %v", err)}
+		}
+		resp.Data = data
+	}
+	return resp
+}
+
+// Call sends req to the recorder listening on socketPath and waits for its response.
+func Call(socketPath string, req Request) (Response, error) {
+	return CallTimeout(socketPath, req, 30*time.Second)
+}
+
+// CallTimeout is Call for ops that may take longer than usual, such as
+// compacting a large store; the exchange may take up to timeout.
+func CallTimeout(socketPath string, req Request, timeout time.Duration) (Response, error) {
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return Response{}, fmt.Errorf("connect to recorder at %s: %w", socketPath, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return Response{}, fmt.Errorf("send request: %w", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return Response{}, fmt.Errorf("read response: %w", err)
+	}
+	if !resp.OK {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
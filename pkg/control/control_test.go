@@ -0,0 +1,72 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServerRoundTrip(t *testing.T) {
+	srv, err := Listen(SocketPath(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	var got []string
+	srv.Handle("mark", func(req Request) (any, error) {
+		if req.Name == "" {
+			return nil, errors.New("marker name is required")
+		}
+		got = append(got, req.Name)
+		return map[string]string{"name": req.Name}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.Serve(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		srv.Close()
+	}()
+
+	resp, err := Call(srv.Path(), Request{Op: "mark", Name: "migrations-done"})
+	if err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+	if !strings.Contains(string(resp.Data), "migrations-done") {
+		t.Fatalf("unexpected response data: %s", resp.Data)
+	}
+
+	if _, err := Call(srv.Path(), Request{Op: "mark"}); err == nil {
+		t.Fatalf("expected handler error to propagate")
+	}
+	if _, err := Call(srv.Path(), Request{Op: "bogus"}); err == nil {
+		t.Fatalf("expected unknown op error")
+	}
+
+	if len(got) != 1 || got[0] != "migrations-done" {
+		t.Fatalf("handler saw %v", got)
+	}
+}
+
+func TestSocketPathFallsBackForLongStateDirs(t *testing.T) {
+	short := SocketPath("/tmp/trace")
+	if short != filepath.Join("/tmp/trace", SocketName) {
+		t.Fatalf("unexpected short socket path %s", short)
+	}
+
+	long := "/" + strings.Repeat("deep/", 30) + "trace"
+	got := SocketPath(long)
+	if len(got) > maxSocketPath {
+		t.Fatalf("socket path too long: %s", got)
+	}
+	if got != SocketPath(long) {
+		t.Fatalf("fallback socket path must be deterministic")
+	}
+}
@@ -8,7 +8,12 @@ import (
 )
 
 // BsdiffEngine implements the DiffEngine interface using bsdiff
-type BsdiffEngine struct{}
+type BsdiffEngine struct {
+	// MaxMemory bounds BsdiffMemory for ComputeDiff in bytes (0 =
+	// unlimited). Larger inputs fail with ErrOverBudget, so the caller can
+	// store a full snapshot instead.
+	MaxMemory int64
+}
 
 // NewBsdiffEngine creates a new bsdiff-based diff engine
 func NewBsdiffEngine() *BsdiffEngine {
@@ -33,6 +38,10 @@ func (e *BsdiffEngine) ComputeDiff(oldData, newData []byte) ([]byte, error) {
 		return newData, nil
 	}
 
+	if e.MaxMemory > 0 && BsdiffMemory(len(oldData), len(newData)) > e.MaxMemory {
+		return nil, fmt.Errorf("bsdiff of %d and %d bytes: %w", len(oldData), len(newData), ErrOverBudget)
+	}
+
 	// Compute diff using bsdiff.Bytes
 	patch, err := bsdiff.Bytes(oldData, newData)
 	if err != nil {
@@ -0,0 +1,38 @@
+package diff
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrOverBudget is returned when computing a diff would need more memory
+// than its budget allows. Callers fall back to storing or showing the
+// whole file.
+var ErrOverBudget = errors.New("diff exceeds its memory budget")
+
+// UnifiedMemory estimates the memory Unified allocates for oldData and
+// newData, on top of the inputs: a string copy of each, a header per line
+// and per edit, the Myers trace and the rendered hunks.
+func UnifiedMemory(oldData, newData []byte) int64 {
+	size := int64(len(oldData) + len(newData))
+	lines := int64(bytes.Count(oldData, []byte("\n")) + bytes.Count(newData, []byte("\n")) + 2)
+	d := min(lines, maxEditDistance)
+	trace := 8 * (d + 1) * (d + 3)
+	return 2*size + 40*lines + trace
+}
+
+// UnifiedWithin is Unified with a memory budget in bytes (0 = unlimited).
+// It returns ErrOverBudget, without diffing, when UnifiedMemory exceeds it.
+func UnifiedWithin(oldData, newData []byte, context int, budget int64) (string, error) {
+	if budget > 0 && UnifiedMemory(oldData, newData) > budget {
+		return "", ErrOverBudget
+	}
+	return Unified(oldData, newData, context), nil
+}
+
+// BsdiffMemory estimates the memory ComputeDiff allocates for inputs of
+// oldSize and newSize bytes, on top of the inputs: bsdiff's suffix array
+// and its rank array hold one int per byte of the old data.
+func BsdiffMemory(oldSize, newSize int) int64 {
+	return 16*int64(oldSize+1) + 3*int64(newSize+1)
+}
@@ -0,0 +1,43 @@
+package diff
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestUnifiedWithinBudget(t *testing.T) {
+	oldData := bytes.Repeat([]byte("same line\n"), 100)
+	newData := append(append([]byte(nil), oldData...), "added\n"...)
+
+	need := UnifiedMemory(oldData, newData)
+	hunks, err := UnifiedWithin(oldData, newData, DefaultContext, need)
+	if err != nil || hunks != Unified(oldData, newData, DefaultContext) {
+		t.Fatalf("diff within budget = %q, %v", hunks, err)
+	}
+	if _, err := UnifiedWithin(oldData, newData, DefaultContext, need-1); !errors.Is(err, ErrOverBudget) {
+		t.Fatalf("diff over budget should fail with ErrOverBudget, got %v", err)
+	}
+	if _, err := UnifiedWithin(oldData, newData, DefaultContext, 0); err != nil {
+		t.Fatalf("a zero budget is unlimited, got %v", err)
+	}
+}
+
+func TestBsdiffEngineRespectsMaxMemory(t *testing.T) {
+	oldData := bytes.Repeat([]byte("abcdefgh"), 1024)
+	newData := append(append([]byte(nil), oldData...), "tail"...)
+
+	engine := &BsdiffEngine{MaxMemory: BsdiffMemory(len(oldData), len(newData)) - 1}
+	if _, err := engine.ComputeDiff(oldData, newData); !errors.Is(err, ErrOverBudget) {
+		t.Fatalf("ComputeDiff over budget should fail with ErrOverBudget, got %v", err)
+	}
+
+	engine.MaxMemory = BsdiffMemory(len(oldData), len(newData))
+	patch, err := engine.ComputeDiff(oldData, newData)
+	if err != nil {
+		t.Fatalf("ComputeDiff within budget: %v", err)
+	}
+	if got, err := engine.ApplyPatch(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("patch round trip failed: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Normalization rewrites text before it is compared or shown, so content
+// recorded on another platform does not differ on every line. It applies
+// to displayed copies only; stored bytes are never changed.
+type Normalization struct {
+	// EOL is the line ending every line is rewritten to ("\n" or "\r\n").
+	// Empty keeps line endings as they are.
+	EOL string
+
+	// Encoding strips a UTF-8 byte order mark and decodes UTF-16 text that
+	// starts with a byte order mark to UTF-8.
+	Encoding bool
+}
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// Apply returns data normalized. Binary content is returned unchanged, as
+// is data when n does nothing.
+func (n Normalization) Apply(data []byte) []byte {
+	if n.Encoding {
+		data = normalizeEncoding(data)
+	}
+	if n.EOL == "" || IsBinary(data) || !bytes.Contains(data, []byte("\n")) {
+		return data
+	}
+	lf := bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if n.EOL == "\n" {
+		return lf
+	}
+	return bytes.ReplaceAll(lf, []byte("\n"), []byte(n.EOL))
+}
+
+// normalizeEncoding drops a UTF-8 byte order mark and turns UTF-16 with a
+// byte order mark into UTF-8.
+func normalizeEncoding(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, bomUTF8):
+		return data[len(bomUTF8):]
+	case len(data)%2 != 0:
+		return data
+	case bytes.HasPrefix(data, bomUTF16LE):
+		return decodeUTF16(data[2:], binary.LittleEndian)
+	case bytes.HasPrefix(data, bomUTF16BE):
+		return decodeUTF16(data[2:], binary.BigEndian)
+	}
+	return data
+}
+
+func decodeUTF16(data []byte, order binary.ByteOrder) []byte {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+	out := make([]byte, 0, len(units))
+	for _, r := range utf16.Decode(units) {
+		out = utf8.AppendRune(out, r)
+	}
+	return out
+}
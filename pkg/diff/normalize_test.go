@@ -0,0 +1,31 @@
+package diff
+
+import "testing"
+
+func TestNormalizationApply(t *testing.T) {
+	utf16le := []byte{0xFF, 0xFE, 'h', 0, 'i', 0, '\r', 0, '\n', 0}
+	utf16be := []byte{0xFE, 0xFF, 0, 'h', 0, 'i', 0, '\n'}
+
+	tests := []struct {
+		name string
+		n    Normalization
+		data string
+		want string
+	}{
+		{"nothing", Normalization{}, "a\r\nb\n", "a\r\nb\n"},
+		{"to lf", Normalization{EOL: "\n"}, "a\r\nb\n", "a\nb\n"},
+		{"to crlf", Normalization{EOL: "\r\n"}, "a\r\nb\nc", "a\r\nb\r\nc"},
+		{"binary untouched", Normalization{EOL: "\n"}, "a\r\n\x00b", "a\r\n\x00b"},
+		{"utf-8 bom", Normalization{Encoding: true}, "\xEF\xBB\xBFkey: 1\n", "key: 1\n"},
+		{"utf-16le", Normalization{Encoding: true, EOL: "\n"}, string(utf16le), "hi\n"},
+		{"utf-16be", Normalization{Encoding: true}, string(utf16be), "hi\n"},
+		{"utf-16 left alone", Normalization{EOL: "\n"}, string(utf16le), string(utf16le)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(tt.n.Apply([]byte(tt.data))); got != tt.want {
+				t.Fatalf("Apply(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// DefaultContext is the number of unchanged lines shown around each hunk,
+// matching git and GNU diff defaults.
+const DefaultContext = 3
+
+// maxEditDistance bounds the Myers search. Inputs that differ by more lines
+// than this are rendered as a single whole-file replacement hunk.
+const maxEditDistance = 4096
+
+type opKind int8
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+type lineOp struct {
+	kind opKind
+	line string
+}
+
+// IsBinary reports whether data looks like binary content (contains a NUL byte
+// in its first 8KiB), using the same heuristic as git.
+func IsBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// Unified renders the hunks of a unified diff between oldData and newData
+// with context lines of surrounding context. File headers are left to the
+// caller. Identical inputs produce an empty string.
+func Unified(oldData, newData []byte, context int) string {
+	if bytes.Equal(oldData, newData) {
+		return ""
+	}
+	if context < 0 {
+		context = DefaultContext
+	}
+
+	ops := diffLines(splitLines(oldData), splitLines(newData))
+
+	var b strings.Builder
+	for start := 0; start < len(ops); {
+		// Find the next change.
+		first := start
+		for first < len(ops) && ops[first].kind == opEqual {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+
+		// Extend the hunk while changes are separated by at most 2*context lines.
+		last := first
+		for i := first; i < len(ops); i++ {
+			if ops[i].kind != opEqual {
+				last = i
+				continue
+			}
+			if i-last > 2*context {
+				break
+			}
+		}
+
+		lo := max(first-context, start)
+		hi := min(last+context+1, len(ops))
+		writeHunk(&b, ops, lo, hi)
+		start = hi
+	}
+	return b.String()
+}
+
+func writeHunk(b *strings.Builder, ops []lineOp, lo, hi int) {
+	// Line numbers of the first op in the hunk.
+	oldLine, newLine := 1, 1
+	for _, op := range ops[:lo] {
+		if op.kind != opInsert {
+			oldLine++
+		}
+		if op.kind != opDelete {
+			newLine++
+		}
+	}
+
+	var oldCount, newCount int
+	for _, op := range ops[lo:hi] {
+		if op.kind != opInsert {
+			oldCount++
+		}
+		if op.kind != opDelete {
+			newCount++
+		}
+	}
+	// An empty range is addressed by the line before it.
+	if oldCount == 0 {
+		oldLine--
+	}
+	if newCount == 0 {
+		newLine--
+	}
+
+	fmt.Fprintf(b, "@@ -%s +%s @@\n", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+	for _, op := range ops[lo:hi] {
+		prefix := " "
+		switch op.kind {
+		case opDelete:
+			prefix = "-"
+		case opInsert:
+			prefix = "+"
+		}
+		b.WriteString(prefix)
+		b.WriteString(op.line)
+		if !strings.HasSuffix(op.line, "\n") {
+			b.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// splitLines splits data after each newline, keeping the terminators so a
+// missing final newline is preserved.
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes a shortest edit script between a and b using Myers'
+// O(ND) algorithm.
+func diffLines(a, b []string) []lineOp {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxEditDistance)
+	off := limit + 1
+	v := make([]int, 2*limit+3)
+
+	// trace[d] holds v[-d-1..d+1] as it was before step d.
+	var trace [][]int
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, a, b)
+			}
+		}
+	}
+
+	return replaceAll(a, b)
+}
+
+func backtrack(trace [][]int, a, b []string) []lineOp {
+	x, y := len(a), len(b)
+	var ops []lineOp
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d+1] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, lineOp{opEqual, a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, lineOp{opInsert, b[y-1]})
+			} else {
+				ops = append(ops, lineOp{opDelete, a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+func replaceAll(a, b []string) []lineOp {
+	ops := make([]lineOp, 0, len(a)+len(b))
+	for _, line := range a {
+		ops = append(ops, lineOp{opDelete, line})
+	}
+	for _, line := range b {
+		ops = append(ops, lineOp{opInsert, line})
+	}
+	return ops
+}
@@ -0,0 +1,89 @@
+package diff
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name    string
+		oldData string
+		newData string
+		want    string
+	}{
+		{"identical", "a\nb\n", "a\nb\n", ""},
+		{"new file", "", "a\nb\n", "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"deleted content", "a\n", "", "@@ -1 +0,0 @@\n-a\n"},
+		{
+			"middle change",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			"1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			"missing final newline",
+			"a\nb",
+			"a\nc",
+			"@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+		{
+			"separate hunks",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			"one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Unified([]byte(tt.oldData), []byte(tt.newData), DefaultContext)
+			if got != tt.want {
+				t.Errorf("Unified() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnifiedAppliesWithPatch(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch not installed")
+	}
+
+	oldData := strings.Repeat("line\n", 20) + "tail\n"
+	newData := "head\n" + strings.Repeat("line\n", 10) + "inserted\n" + strings.Repeat("line\n", 10)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "f.txt")
+	if err := os.WriteFile(file, []byte(oldData), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	body := "--- a/f.txt\n+++ b/f.txt\n" + Unified([]byte(oldData), []byte(newData), DefaultContext)
+	cmd := exec.Command("patch", "-p1", "-s")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(body)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("patch failed: %v\n%s\n%s", err, out, body)
+	}
+
+	got, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != newData {
+		t.Fatalf("patched content mismatch:\n%q\nwant\n%q", got, newData)
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	if IsBinary([]byte("plain text\n")) {
+		t.Error("text reported as binary")
+	}
+	if !IsBinary([]byte{0x7f, 'E', 'L', 'F', 0}) {
+		t.Error("NUL-containing data not reported as binary")
+	}
+}
@@ -0,0 +1,318 @@
+// Package diffkeeper embeds the flight recorder in a Go process. Test
+// harnesses use it to capture state in-process instead of wrapping the run in
+// `diffkeeper record`; the state dir it writes can be inspected with the CLI.
+//
+//	rec, err := diffkeeper.New(diffkeeper.Options{StateDir: dir})
+//	...
+//	if err := rec.Start(); err != nil { ... }
+//	defer rec.Close()
+//	rec.Capture("config.json", data)
+package diffkeeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/internal/version"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/merkle"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+)
+
+// closeDrainTimeout bounds how long Close waits for pending captures.
+const closeDrainTimeout = 10 * time.Second
+
+var (
+	// ErrClosed is returned by calls on a Recorder after Close.
+	ErrClosed = errors.New("diffkeeper: recorder is closed")
+
+	// ErrNotStarted is returned by Capture and Flush before Start.
+	ErrNotStarted = errors.New("diffkeeper: recorder is not started")
+)
+
+// Options configures a Recorder.
+type Options struct {
+	// StateDir is where the Pebble state is stored. Required.
+	StateDir string
+
+	// Config overrides the configuration. When nil, defaults and
+	// DIFFKEEPER_* environment variables are used.
+	Config *config.DiffConfig
+
+	// ForceLock takes over the state dir lock when its previous owner is
+	// no longer running.
+	ForceLock bool
+}
+
+// Recorder is an in-process flight recorder. It is safe for concurrent use.
+type Recorder struct {
+	lock    *statelock.Lock
+	db      *pebble.DB
+	store   *cas.CASStore
+	journal *recorder.Journal
+
+	cfg      *config.DiffConfig
+	procOpts recorder.ProcessorOptions
+	signKey  []byte
+
+	mu       sync.Mutex
+	stop     func()
+	started  bool
+	closed   bool
+	exitCode int
+}
+
+// New opens (or creates) the state dir, recovering it if a previous recorder
+// was killed. Call Start before capturing.
+func New(opts Options) (*Recorder, error) {
+	if opts.StateDir == "" {
+		return nil, fmt.Errorf("diffkeeper: state dir is required")
+	}
+
+	cfg := opts.Config
+	if cfg == nil {
+		cfg = config.LoadFromEnv()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("diffkeeper: invalid config: %w", err)
+	}
+
+	var signKey []byte
+	if cfg.SignKey != "" {
+		var err error
+		if signKey, err = os.ReadFile(cfg.SignKey); err != nil {
+			return nil, fmt.Errorf("diffkeeper: read sign key: %w", err)
+		}
+		if _, err := merkle.ParseSigningKey(signKey); err != nil {
+			return nil, fmt.Errorf("diffkeeper: sign key %s: %w", cfg.SignKey, err)
+		}
+	}
+
+	if err := os.MkdirAll(opts.StateDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create state dir: %w", err)
+	}
+
+	lock, err := statelock.Acquire(opts.StateDir, "library", opts.ForceLock)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := pebble.Open(opts.StateDir, &pebble.Options{})
+	if err != nil {
+		lock.Release()
+		return nil, fmt.Errorf("open pebble: %w", err)
+	}
+
+	store, err := cas.NewCASStore(db, cfg.HashAlgo)
+	if err != nil {
+		db.Close()
+		lock.Release()
+		return nil, fmt.Errorf("init CAS: %w", err)
+	}
+
+	// Pick up captures a killed process left in the journal.
+	if _, err := recorder.Recover(db, store, recorder.DefaultProcessorOptions()); err != nil {
+		db.Close()
+		lock.Release()
+		return nil, fmt.Errorf("recover state dir: %w", err)
+	}
+	if _, err := store.EnableExistenceCache(); err != nil {
+		db.Close()
+		lock.Release()
+		return nil, fmt.Errorf("load CAS index: %w", err)
+	}
+
+	journal := recorder.NewJournal(db)
+	journal.SetNamespace(cfg.Namespace)
+	procOpts := recorder.DefaultProcessorOptions()
+	procOpts.Workers = cfg.ProcessorWorkers
+	recorder.ApplyDurability(cfg.Durability, journal, store, &procOpts)
+
+	return &Recorder{lock: lock, db: db, store: store, journal: journal, cfg: cfg, procOpts: procOpts, signKey: signKey}, nil
+}
+
+// Start marks the session start and begins processing captures.
+func (r *Recorder) Start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+	if r.started {
+		return fmt.Errorf("diffkeeper: recorder already started")
+	}
+
+	if err := recorder.MarkSessionStart(r.db, time.Now()); err != nil {
+		return fmt.Errorf("record session start: %w", err)
+	}
+	if _, err := recorder.MarkSessionInfo(r.db, recorder.SessionInfo{Agent: version.Version}); err != nil {
+		return fmt.Errorf("record session info: %w", err)
+	}
+	stopProcessor := recorder.StartProcessorWithOptions(r.db, r.store, r.procOpts)
+	r.stop = stopProcessor
+	if r.cfg.Durability != config.DurabilityStrict {
+		stopSyncer := recorder.StartSyncer(r.db, r.cfg.SyncInterval)
+		r.stop = func() {
+			stopSyncer()
+			stopProcessor()
+		}
+	}
+	r.started = true
+	return nil
+}
+
+// Capture records data as the current contents of path. Paths are stored as
+// given; use paths relative to the directory under test so exports are
+// portable.
+func (r *Recorder) Capture(path string, data []byte) error {
+	if err := r.checkRunning(); err != nil {
+		return err
+	}
+	return r.journal.LogEvent(path, data)
+}
+
+// CaptureFile reads the file at name and records it under path.
+func (r *Recorder) CaptureFile(path, name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return r.Capture(path, data)
+}
+
+// SetExitCode sets the exit code stored with the session end on Close, so a
+// failed test can be exported with `--time failure`.
+func (r *Recorder) SetExitCode(code int) {
+	r.mu.Lock()
+	r.exitCode = code
+	r.mu.Unlock()
+}
+
+// Flush blocks until every capture so far is stored and synced to disk.
+func (r *Recorder) Flush(ctx context.Context) error {
+	if err := r.checkRunning(); err != nil {
+		return err
+	}
+	if err := recorder.WaitIdle(ctx, r.db); err != nil {
+		return fmt.Errorf("wait for journal: %w", err)
+	}
+	return r.db.Flush()
+}
+
+// ExportAt writes the newest version of every path recorded at or before t
+// into outDir. Pending captures are flushed first.
+func (r *Recorder) ExportAt(ctx context.Context, t time.Time, outDir string) error {
+	if err := r.Flush(ctx); err != nil && !errors.Is(err, ErrNotStarted) {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+
+	records, err := recorder.StateAt(r.db, t)
+	if err != nil {
+		return err
+	}
+
+	root, err := filepath.Abs(outDir)
+	if err != nil {
+		return err
+	}
+	for path, meta := range records {
+		dest := filepath.Join(root, filepath.FromSlash(path))
+		if dest != root && !strings.HasPrefix(dest, root+string(filepath.Separator)) {
+			return fmt.Errorf("diffkeeper: recorded path %q escapes the export dir", path)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			return fmt.Errorf("create parent for %s: %w", dest, err)
+		}
+		if err := r.exportFile(dest, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportFile streams one recorded version to dest.
+func (r *Recorder) exportFile(dest string, meta recorder.MetadataRecord) error {
+	src, err := recorder.OpenContent(r.store, meta)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", meta.Path, err)
+	}
+	defer src.Close()
+
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", dest, err)
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", dest, err)
+	}
+	return f.Close()
+}
+
+// Close drains pending captures, records the session end and closes the
+// state dir. It is safe to call more than once.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	var errs []error
+	if r.started {
+		ctx, cancel := context.WithTimeout(context.Background(), closeDrainTimeout)
+		if err := recorder.WaitIdle(ctx, r.db); err != nil {
+			errs = append(errs, fmt.Errorf("wait for journal: %w", err))
+		}
+		cancel()
+		r.stop()
+
+		if err := recorder.MarkSessionEnd(r.db, time.Now(), r.exitCode); err != nil {
+			errs = append(errs, fmt.Errorf("record session end: %w", err))
+		} else if _, err := recorder.SealSession(r.db, r.signKey); err != nil {
+			errs = append(errs, fmt.Errorf("seal session: %w", err))
+		}
+	}
+	if err := r.db.Flush(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := r.db.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := r.lock.Release(); err != nil {
+		errs = append(errs, fmt.Errorf("release lock: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Recorder) checkRunning() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	if !r.started {
+		return ErrNotStarted
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package diffkeeper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+)
+
+func TestRecorderLifecycle(t *testing.T) {
+	stateDir := t.TempDir()
+	rec, err := New(Options{StateDir: stateDir, Config: config.DefaultConfig()})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	var locked *statelock.LockedError
+	if _, err := New(Options{StateDir: stateDir, Config: config.DefaultConfig()}); !errors.As(err, &locked) {
+		t.Fatalf("expected a second recorder to be locked out, got %v", err)
+	}
+
+	if err := rec.Capture("early.txt", []byte("x")); !errors.Is(err, ErrNotStarted) {
+		t.Fatalf("expected ErrNotStarted, got %v", err)
+	}
+	if err := rec.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if err := rec.Capture("app/config.json", []byte(`{"v":1}`)); err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := rec.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	first := time.Now()
+
+	if err := rec.Capture("app/config.json", []byte(`{"v":2}`)); err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+
+	out := t.TempDir()
+	if err := rec.ExportAt(ctx, first, out); err != nil {
+		t.Fatalf("ExportAt: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(out, "app", "config.json")); err != nil || string(got) != `{"v":1}` {
+		t.Fatalf("expected first version, got %q err=%v", got, err)
+	}
+
+	latest := t.TempDir()
+	if err := rec.ExportAt(ctx, time.Now(), latest); err != nil {
+		t.Fatalf("ExportAt: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(latest, "app", "config.json")); string(got) != `{"v":2}` {
+		t.Fatalf("expected latest version, got %q", got)
+	}
+
+	rec.SetExitCode(3)
+	if err := rec.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if err := rec.Capture("late.txt", nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	db, err := pebble.Open(stateDir, &pebble.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	val, closer, err := db.Get([]byte(recorder.SessionEndKey))
+	if err != nil {
+		t.Fatalf("session end missing: %v", err)
+	}
+	defer closer.Close()
+	var end recorder.SessionEnd
+	if err := json.Unmarshal(val, &end); err != nil || end.ExitCode != 3 {
+		t.Fatalf("unexpected session end %s", val)
+	}
+}
+
+func TestNewRequiresStateDir(t *testing.T) {
+	if _, err := New(Options{}); err == nil {
+		t.Fatalf("expected error without state dir")
+	}
+}
@@ -13,12 +13,36 @@ import (
 //go:embed diffkeeper.bpf.o
 var diffkeeperObject []byte
 
+const (
+	mapEvents          = "events"
+	mapLifecycleEvents = "lifecycle_events"
+	mapWatchRoots      = "watch_roots"
+	mapFilterSettings  = "filter_settings"
+
+	progFentryVfsWrite  = "fentry_vfs_write"
+	progFentryVfsWritev = "fentry_vfs_writev"
+	progKprobeVfsWrite  = "kprobe_vfs_write"
+	progKprobeVfsWritev = "kprobe_vfs_writev"
+	progHandleSchedExec = "handle_sched_exec"
+)
+
+// writeProbePrograms lists the program variants shipped for each capture backend.
+var writeProbePrograms = map[string][]string{
+	BackendFentry: {progFentryVfsWrite, progFentryVfsWritev},
+	BackendKprobe: {progKprobeVfsWrite, progKprobeVfsWritev},
+}
+
 // bpfObjects mirrors the maps and programs compiled into diffkeeper.bpf.o.
+// Only the write probes for the selected backend are populated.
 type bpfObjects struct {
 	Events          *ebpf.Map     `ebpf:"events"`
 	LifecycleEvents *ebpf.Map     `ebpf:"lifecycle_events"`
+	WatchRoots      *ebpf.Map     `ebpf:"watch_roots"`
+	FilterSettings  *ebpf.Map     `ebpf:"filter_settings"`
 	FentryVfsWrite  *ebpf.Program `ebpf:"fentry_vfs_write"`
 	FentryVfsWritev *ebpf.Program `ebpf:"fentry_vfs_writev"`
+	KprobeVfsWrite  *ebpf.Program `ebpf:"kprobe_vfs_write"`
+	KprobeVfsWritev *ebpf.Program `ebpf:"kprobe_vfs_writev"`
 	HandleSchedExec *ebpf.Program `ebpf:"handle_sched_exec"`
 }
 
@@ -27,20 +51,21 @@ func (o *bpfObjects) Close() error {
 		return nil
 	}
 
-	if o.Events != nil {
-		o.Events.Close()
+	for _, m := range []*ebpf.Map{o.Events, o.LifecycleEvents, o.WatchRoots, o.FilterSettings} {
+		if m != nil {
+			m.Close()
+		}
 	}
-	if o.LifecycleEvents != nil {
-		o.LifecycleEvents.Close()
-	}
-	if o.FentryVfsWrite != nil {
-		o.FentryVfsWrite.Close()
-	}
-	if o.FentryVfsWritev != nil {
-		o.FentryVfsWritev.Close()
-	}
-	if o.HandleSchedExec != nil {
-		o.HandleSchedExec.Close()
+	for _, p := range []*ebpf.Program{
+		o.FentryVfsWrite,
+		o.FentryVfsWritev,
+		o.KprobeVfsWrite,
+		o.KprobeVfsWritev,
+		o.HandleSchedExec,
+	} {
+		if p != nil {
+			p.Close()
+		}
 	}
 	return nil
 }
@@ -56,13 +81,52 @@ func loadEmbeddedSpec() (*ebpf.CollectionSpec, error) {
 	return spec, nil
 }
 
-func loadBpfObjects(objs *bpfObjects, opts *ebpf.CollectionOptions) error {
-	spec, err := loadEmbeddedSpec()
-	if err != nil {
-		return err
+// specHasBackend reports whether every write probe for backend is present in spec.
+func specHasBackend(spec *ebpf.CollectionSpec, backend string) bool {
+	names, ok := writeProbePrograms[backend]
+	if !ok || spec == nil {
+		return false
 	}
-	if err := spec.LoadAndAssign(objs, opts); err != nil {
+	for _, name := range names {
+		if _, ok := spec.Programs[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// loadBpfObjects loads spec into the kernel, dropping write probes that belong to
+// other backends so the verifier never sees program types the kernel may reject.
+func loadBpfObjects(spec *ebpf.CollectionSpec, backend string, objs *bpfObjects, opts *ebpf.CollectionOptions) error {
+	spec = spec.Copy()
+	for b, names := range writeProbePrograms {
+		if b == backend {
+			continue
+		}
+		for _, name := range names {
+			delete(spec.Programs, name)
+		}
+	}
+
+	var collOpts ebpf.CollectionOptions
+	if opts != nil {
+		collOpts = *opts
+	}
+
+	coll, err := ebpf.NewCollectionWithOptions(spec, collOpts)
+	if err != nil {
 		return fmt.Errorf("load diffkeeper objects: %w", err)
 	}
+	defer coll.Close()
+
+	objs.Events = coll.DetachMap(mapEvents)
+	objs.LifecycleEvents = coll.DetachMap(mapLifecycleEvents)
+	objs.WatchRoots = coll.DetachMap(mapWatchRoots)
+	objs.FilterSettings = coll.DetachMap(mapFilterSettings)
+	objs.FentryVfsWrite = coll.DetachProgram(progFentryVfsWrite)
+	objs.FentryVfsWritev = coll.DetachProgram(progFentryVfsWritev)
+	objs.KprobeVfsWrite = coll.DetachProgram(progKprobeVfsWrite)
+	objs.KprobeVfsWritev = coll.DetachProgram(progKprobeVfsWritev)
+	objs.HandleSchedExec = coll.DetachProgram(progHandleSchedExec)
 	return nil
 }
@@ -0,0 +1,17 @@
+//go:build linux
+
+package ebpf
+
+import "testing"
+
+func TestEmbeddedSpecShipsBothBackends(t *testing.T) {
+	spec, err := loadEmbeddedSpec()
+	if err != nil {
+		t.Fatalf("loadEmbeddedSpec failed: %v", err)
+	}
+	for _, backend := range []string{BackendFentry, BackendKprobe} {
+		if !specHasBackend(spec, backend) {
+			t.Errorf("embedded object is missing %s programs; rebuild it with `make build-ebpf`", backend)
+		}
+	}
+}
@@ -99,6 +99,52 @@ func (l *BTFLoader) LoadSpec(ctx context.Context) (*btf.Spec, string, error) {
 	return spec, path, loadErr
 }
 
+// ProbeBTF reports where LoadSpec would take BTF from, without downloading
+// anything. A download source means BTFHub would be queried at URL.
+func ProbeBTF(cfg *config.EBPFConfig) BTFStatus {
+	status := BTFStatus{Source: BTFSourceNone}
+	status.Kernel.Release, _ = readTrimmed("/proc/sys/kernel/osrelease")
+	status.Kernel.Arch = runtime.GOARCH
+	if arch, err := normalizeArch(runtime.GOARCH); err == nil {
+		status.Kernel.Arch = arch
+	}
+	osMeta, _ := parseOSRelease()
+	status.Kernel.Distro, status.Kernel.VersionID = osMeta["ID"], osMeta["VERSION_ID"]
+
+	_, sysErr := btf.LoadSpec(systemBTFPath)
+	if sysErr == nil {
+		status.Source, status.Path = BTFSourceSystem, systemBTFPath
+		return status
+	}
+
+	l := NewBTFLoader(cfg)
+	if l == nil {
+		status.Error = fmt.Sprintf("no system BTF: %v", sysErr)
+		return status
+	}
+	info, err := detectKernelInfo()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	cachedPath := filepath.Join(l.cacheDir, fmt.Sprintf("%s.btf", info.KernelRelease))
+	if _, err := os.Stat(cachedPath); err == nil {
+		status.Source, status.Path = BTFSourceCache, cachedPath
+		if _, err := btf.LoadSpec(cachedPath); err != nil {
+			status.Error = fmt.Sprintf("cached BTF unreadable: %v", err)
+		}
+		return status
+	}
+	if l.allowDownload {
+		status.Source, status.Path = BTFSourceDownload, cachedPath
+		status.URL = buildBTFHubURL(l.baseURL, info)
+		return status
+	}
+	status.Error = fmt.Sprintf("no system BTF (%v), no cache at %s, and downloads disabled", sysErr, cachedPath)
+	return status
+}
+
 func (l *BTFLoader) downloadAndCache(ctx context.Context, info kernelInfo, destPath string) (string, error) {
 	url := buildBTFHubURL(l.baseURL, info)
 
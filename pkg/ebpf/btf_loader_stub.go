@@ -0,0 +1,18 @@
+//go:build !linux
+
+package ebpf
+
+import (
+	"runtime"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+// ProbeBTF reports that BTF is unavailable off Linux.
+func ProbeBTF(_ *config.EBPFConfig) BTFStatus {
+	return BTFStatus{
+		Source: BTFSourceNone,
+		Kernel: KernelInfo{Arch: runtime.GOARCH},
+		Error:  ErrUnsupported.Error(),
+	}
+}
@@ -0,0 +1,67 @@
+//go:build linux
+
+package ebpf
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/features"
+)
+
+// fentryTargets are the kernel functions the fentry programs attach to.
+var fentryTargets = []string{"vfs_write"}
+
+// selectCaptureBackend resolves the requested backend against what the object
+// ships and what the running kernel supports. "auto" prefers fentry and falls
+// back to kprobes on kernels without BPF trampolines or kernel BTF.
+func selectCaptureBackend(requested string, spec *ebpf.CollectionSpec, kernelBTF *btf.Spec) (string, error) {
+	switch requested {
+	case BackendFentry, BackendKprobe:
+		if !specHasBackend(spec, requested) {
+			return "", fmt.Errorf("eBPF object does not contain %s programs", requested)
+		}
+		return requested, nil
+	case "", BackendAuto:
+	default:
+		return "", fmt.Errorf("unknown capture backend %q", requested)
+	}
+
+	if specHasBackend(spec, BackendFentry) {
+		if err := probeFentrySupport(kernelBTF); err == nil {
+			return BackendFentry, nil
+		}
+	}
+	if specHasBackend(spec, BackendKprobe) {
+		return BackendKprobe, nil
+	}
+	if specHasBackend(spec, BackendFentry) {
+		// Older objects only ship fentry; try it and let attach report failures.
+		return BackendFentry, nil
+	}
+	return "", fmt.Errorf("eBPF object contains no write probes")
+}
+
+// probeFentrySupport checks for tracing program support and BTF describing the attach targets.
+func probeFentrySupport(kernelBTF *btf.Spec) error {
+	if err := features.HaveProgramType(ebpf.Tracing); err != nil {
+		return fmt.Errorf("tracing programs unsupported: %w", err)
+	}
+
+	if kernelBTF == nil {
+		spec, err := btf.LoadKernelSpec()
+		if err != nil {
+			return fmt.Errorf("kernel BTF unavailable: %w", err)
+		}
+		kernelBTF = spec
+	}
+
+	for _, target := range fentryTargets {
+		var fn *btf.Func
+		if err := kernelBTF.TypeByName(target, &fn); err != nil {
+			return fmt.Errorf("BTF missing %s: %w", target, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+//go:build linux
+
+package ebpf
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+func specWithPrograms(names ...string) *ebpf.CollectionSpec {
+	spec := &ebpf.CollectionSpec{Programs: make(map[string]*ebpf.ProgramSpec)}
+	for _, name := range names {
+		spec.Programs[name] = &ebpf.ProgramSpec{Name: name}
+	}
+	return spec
+}
+
+func TestSelectCaptureBackendExplicit(t *testing.T) {
+	spec := specWithPrograms(progFentryVfsWrite, progFentryVfsWritev)
+
+	got, err := selectCaptureBackend(BackendFentry, spec, nil)
+	if err != nil || got != BackendFentry {
+		t.Fatalf("expected fentry backend, got %q (err=%v)", got, err)
+	}
+
+	if _, err := selectCaptureBackend(BackendKprobe, spec, nil); err == nil {
+		t.Fatalf("expected error when kprobe programs are missing from the object")
+	}
+
+	if _, err := selectCaptureBackend("uprobe", spec, nil); err == nil {
+		t.Fatalf("expected error for unknown backend")
+	}
+}
+
+func TestSelectCaptureBackendAutoFallsBackToKprobe(t *testing.T) {
+	spec := specWithPrograms(progKprobeVfsWrite, progKprobeVfsWritev)
+
+	got, err := selectCaptureBackend(BackendAuto, spec, nil)
+	if err != nil {
+		t.Fatalf("selectCaptureBackend failed: %v", err)
+	}
+	if got != BackendKprobe {
+		t.Fatalf("expected kprobe backend, got %q", got)
+	}
+
+	if _, err := selectCaptureBackend(BackendAuto, specWithPrograms(), nil); err == nil {
+		t.Fatalf("expected error for object without write probes")
+	}
+}
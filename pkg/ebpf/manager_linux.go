@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -40,6 +41,9 @@ type kernelManager struct {
 
 	hotPaths sync.Map
 	running  bool
+	backend  string
+
+	filter *pathFilter
 }
 
 // NewManager loads a compiled eBPF program and prepares syscall/lifecycle probes.
@@ -117,47 +121,83 @@ func (m *kernelManager) init() error {
 }
 
 func (m *kernelManager) loadObjects(opts *ebpf.CollectionOptions) error {
+	spec, err := m.loadSpec()
+	if err != nil {
+		return err
+	}
+
+	backend, err := selectCaptureBackend(m.cfg.CaptureBackend, spec, m.btfSpec)
+	if err != nil {
+		return err
+	}
+	m.backend = backend
+	log.Printf("[eBPF] Capture backend: %s", backend)
+
+	return loadBpfObjects(spec, backend, &m.objs, opts)
+}
+
+func (m *kernelManager) loadSpec() (*ebpf.CollectionSpec, error) {
 	if m.cfg.ProgramPath == "" {
-		return loadBpfObjects(&m.objs, opts)
+		return loadEmbeddedSpec()
 	}
 
 	programPath := platform.LongPathname(m.cfg.ProgramPath)
 	f, err := os.Open(programPath)
 	if err != nil {
-		return fmt.Errorf("open eBPF object (%s): %w", m.cfg.ProgramPath, err)
+		return nil, fmt.Errorf("open eBPF object (%s): %w", m.cfg.ProgramPath, err)
 	}
 	defer f.Close()
 
 	spec, err := ebpf.LoadCollectionSpecFromReader(f)
 	if err != nil {
-		return fmt.Errorf("load eBPF spec: %w", err)
+		return nil, fmt.Errorf("load eBPF spec: %w", err)
 	}
+	return spec, nil
+}
 
-	if err := spec.LoadAndAssign(&m.objs, opts); err != nil {
-		return fmt.Errorf("assign eBPF objects: %w", err)
-	}
-	return nil
+// writeProbe pairs a loaded program with the kernel symbol it instruments.
+type writeProbe struct {
+	prog   *ebpf.Program
+	symbol string
 }
 
-func (m *kernelManager) attachSyscallProbes() error {
+func (m *kernelManager) writeProbes() []writeProbe {
+	if m.backend == BackendKprobe {
+		return []writeProbe{
+			{m.objs.KprobeVfsWrite, "vfs_write"},
+			{m.objs.KprobeVfsWritev, "vfs_writev"},
+		}
+	}
 	// fentry attachment for write paths (enables bpf_d_path in helper)
-	probes := []*ebpf.Program{
-		m.objs.FentryVfsWrite,
-		m.objs.FentryVfsWritev,
+	return []writeProbe{
+		{m.objs.FentryVfsWrite, "vfs_write"},
+		{m.objs.FentryVfsWritev, "vfs_writev"},
 	}
+}
+
+func (m *kernelManager) attachSyscallProbes() error {
+	probes := m.writeProbes()
 
 	attached := 0
-	for _, prog := range probes {
-		if prog == nil {
+	for _, probe := range probes {
+		if probe.prog == nil {
 			continue
 		}
 
-		l, err := link.AttachTracing(link.TracingOptions{
-			Program: prog,
-		})
+		var (
+			l   link.Link
+			err error
+		)
+		if m.backend == BackendKprobe {
+			l, err = link.Kprobe(probe.symbol, probe.prog, nil)
+		} else {
+			l, err = link.AttachTracing(link.TracingOptions{
+				Program: probe.prog,
+			})
+		}
 		if err != nil {
 			// Log warning but continue; some kernels may miss certain symbols.
-			log.Printf("[eBPF] warning: failed to attach fentry %s: %v", prog.String(), err)
+			log.Printf("[eBPF] warning: failed to attach %s %s: %v", m.backend, probe.prog.String(), err)
 			continue
 		}
 		m.links = append(m.links, l)
@@ -299,15 +339,24 @@ func decodeSyscallEvent(raw []byte) (Event, error) {
 		Path  [256]byte
 	}
 
-	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &payload); err != nil {
+	r := bytes.NewReader(raw)
+	if err := binary.Read(r, binary.LittleEndian, &payload); err != nil {
 		return Event{}, err
 	}
+	// Programs built before the offset was added end their event here.
+	offset := int64(-1)
+	if r.Len() >= 8 {
+		if err := binary.Read(r, binary.LittleEndian, &offset); err != nil {
+			return Event{}, err
+		}
+	}
 
 	path := string(bytes.Trim(payload.Path[:], "\x00"))
 	return Event{
 		PID:       payload.PID,
 		Path:      path,
 		Bytes:     payload.Bytes,
+		Offset:    offset,
 		Timestamp: time.Now(),
 	}, nil
 }
@@ -359,14 +408,54 @@ func (m *kernelManager) LifecycleEvents() <-chan LifecycleEvent {
 }
 
 func (m *kernelManager) ApplyHotPathHints(hints map[string]float64) error {
+	// Hints repeat every profiler interval while a path stays hot; only
+	// newly hot paths are worth a log line.
+	fresh := 0
 	for path, score := range hints {
-		m.hotPaths.Store(path, score)
+		if _, loaded := m.hotPaths.Swap(path, score); !loaded {
+			fresh++
+		}
 	}
-	// Future: write hints into kernel BPF map. For now we log to aid tuning.
-	if len(hints) > 0 {
-		log.Printf("[Profiler] Updated %d hot path hint(s)", len(hints))
+	if fresh > 0 {
+		log.Printf("[Profiler] %d new hot path hint(s)", fresh)
 	}
-	return nil
+
+	// Absolute hints widen the kernel filter to their parent directories.
+	var dirs []string
+	for path := range hints {
+		if filepath.IsAbs(path) {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+	}
+	m.mu.Lock()
+	filter := m.filter
+	m.mu.Unlock()
+
+	if len(dirs) == 0 || filter == nil {
+		return nil
+	}
+	return filter.add(dirs)
+}
+
+// SetPathFilter restricts kernel-side capture to writes beneath the given
+// directories. An empty list disables filtering.
+func (m *kernelManager) SetPathFilter(roots []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.filter == nil {
+		f, err := newPathFilter(m.objs.WatchRoots, m.objs.FilterSettings)
+		if err != nil {
+			return err
+		}
+		m.filter = f
+	}
+	return m.filter.replace(roots)
+}
+
+// CaptureBackend reports which write probe variant is attached.
+func (m *kernelManager) CaptureBackend() string {
+	return m.backend
 }
 
 // Close detaches probes and frees kernel/user-space resources
@@ -0,0 +1,33 @@
+//go:build linux
+
+package ebpf
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecodeSyscallEventOffset(t *testing.T) {
+	raw := make([]byte, 272, 280)
+	binary.LittleEndian.PutUint32(raw[0:], 42)
+	binary.LittleEndian.PutUint64(raw[8:], 4096)
+	copy(raw[16:], "data.db")
+
+	// Programs built before the offset was added send 272 bytes.
+	evt, err := decodeSyscallEvent(raw)
+	if err != nil {
+		t.Fatalf("decode without offset: %v", err)
+	}
+	if evt.PID != 42 || evt.Bytes != 4096 || evt.Path != "data.db" || evt.Offset != -1 {
+		t.Fatalf("event without offset = %+v", evt)
+	}
+
+	raw = binary.LittleEndian.AppendUint64(raw, 1<<30)
+	evt, err = decodeSyscallEvent(raw)
+	if err != nil {
+		t.Fatalf("decode with offset: %v", err)
+	}
+	if evt.Offset != 1<<30 || evt.Path != "data.db" {
+		t.Fatalf("event with offset = %+v", evt)
+	}
+}
@@ -21,3 +21,5 @@ func (stubManager) Close() error                               { return nil }
 func (stubManager) Events() <-chan Event                       { return nil }
 func (stubManager) LifecycleEvents() <-chan LifecycleEvent     { return nil }
 func (stubManager) ApplyHotPathHints(map[string]float64) error { return nil }
+func (stubManager) CaptureBackend() string                     { return BackendFSNotify }
+func (stubManager) SetPathFilter([]string) error               { return nil }
@@ -0,0 +1,110 @@
+//go:build linux
+
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+var errPathFilterUnavailable = errors.New("eBPF object does not support in-kernel path filtering")
+
+// pathKey mirrors struct path_key in diffkeeper.bpf.c.
+type pathKey struct {
+	Dev uint64
+	Ino uint64
+}
+
+// pathFilter keeps the kernel watch_roots map in sync with the directories
+// whose subtrees should reach userspace.
+type pathFilter struct {
+	mu        sync.Mutex
+	roots     *ebpf.Map
+	settings  *ebpf.Map
+	installed map[pathKey]string
+}
+
+func newPathFilter(roots, settings *ebpf.Map) (*pathFilter, error) {
+	if roots == nil || settings == nil {
+		return nil, errPathFilterUnavailable
+	}
+	return &pathFilter{
+		roots:     roots,
+		settings:  settings,
+		installed: make(map[pathKey]string),
+	}, nil
+}
+
+// replace swaps the installed directory set for dirs.
+func (f *pathFilter) replace(dirs []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key := range f.installed {
+		if err := f.roots.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("remove watch root: %w", err)
+		}
+		delete(f.installed, key)
+	}
+	return f.addLocked(dirs)
+}
+
+// add installs dirs alongside the existing set.
+func (f *pathFilter) add(dirs []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addLocked(dirs)
+}
+
+func (f *pathFilter) addLocked(dirs []string) error {
+	for _, dir := range dirs {
+		key, err := pathKeyFor(dir)
+		if err != nil {
+			return err
+		}
+		if _, ok := f.installed[key]; ok {
+			continue
+		}
+		if err := f.roots.Put(key, uint8(1)); err != nil {
+			return fmt.Errorf("install watch root %s: %w", dir, err)
+		}
+		f.installed[key] = dir
+	}
+
+	var enabled uint32
+	if len(f.installed) > 0 {
+		enabled = 1
+	}
+	if err := f.settings.Put(uint32(0), enabled); err != nil {
+		return fmt.Errorf("update filter settings: %w", err)
+	}
+	return nil
+}
+
+// pathKeyFor resolves dir to the device/inode pair the kernel sees on its dentry.
+func pathKeyFor(dir string) (pathKey, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return pathKey{}, fmt.Errorf("stat watch root: %w", err)
+	}
+	if !info.IsDir() {
+		return pathKey{}, fmt.Errorf("watch root %s is not a directory", dir)
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return pathKey{}, fmt.Errorf("watch root %s: unsupported stat type", dir)
+	}
+	return pathKey{Dev: kernelDevice(uint64(st.Dev)), Ino: st.Ino}, nil
+}
+
+// kernelDevice converts a userspace dev_t into the kernel's internal
+// encoding used by super_block.s_dev (MINORBITS = 20).
+func kernelDevice(dev uint64) uint64 {
+	return uint64(unix.Major(dev))<<20 | uint64(unix.Minor(dev))
+}
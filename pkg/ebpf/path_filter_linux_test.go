@@ -0,0 +1,55 @@
+//go:build linux
+
+package ebpf
+
+import (
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestKernelDeviceEncoding(t *testing.T) {
+	dev := unix.Mkdev(259, 3)
+	if got, want := kernelDevice(dev), uint64(259<<20|3); got != want {
+		t.Fatalf("kernelDevice(%d) = %d, want %d", dev, got, want)
+	}
+}
+
+func TestPathKeyFor(t *testing.T) {
+	dir := t.TempDir()
+	key, err := pathKeyFor(dir)
+	if err != nil {
+		t.Fatalf("pathKeyFor(dir) failed: %v", err)
+	}
+	if key.Ino == 0 {
+		t.Fatalf("expected non-zero inode for %s", dir)
+	}
+
+	if _, err := pathKeyFor(dir + "/missing"); err == nil {
+		t.Fatalf("expected error for missing path")
+	}
+}
+
+func TestEmbeddedSpecShipsPathFilterMaps(t *testing.T) {
+	spec, err := loadEmbeddedSpec()
+	if err != nil {
+		t.Fatalf("loadEmbeddedSpec failed: %v", err)
+	}
+
+	roots, ok := spec.Maps[mapWatchRoots]
+	if !ok {
+		t.Fatalf("embedded object is missing the %s map; rebuild it with `make build-ebpf`", mapWatchRoots)
+	}
+	if roots.KeySize != uint32(unsafe.Sizeof(pathKey{})) {
+		t.Fatalf("%s key size = %d, want %d", mapWatchRoots, roots.KeySize, unsafe.Sizeof(pathKey{}))
+	}
+
+	settings, ok := spec.Maps[mapFilterSettings]
+	if !ok {
+		t.Fatalf("embedded object is missing the %s map; rebuild it with `make build-ebpf`", mapFilterSettings)
+	}
+	if settings.MaxEntries != 1 {
+		t.Fatalf("%s max entries = %d, want 1", mapFilterSettings, settings.MaxEntries)
+	}
+}
@@ -45,6 +45,17 @@ func (p *Profiler) Record(path string) {
 	p.samples[path]++
 }
 
+// SetTuning swaps the EMA smoothing factor and hot-path threshold at runtime
+func (p *Profiler) SetTuning(alpha, threshold float64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.alpha = alpha
+	p.threshold = threshold
+}
+
 // Run begins periodic prediction loop until ctx is cancelled
 func (p *Profiler) Run(ctx context.Context) {
 	if p == nil {
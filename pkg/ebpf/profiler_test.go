@@ -51,3 +51,31 @@ func TestProfilerEMA(t *testing.T) {
 		t.Fatalf("snapshot missing EMA for hot path")
 	}
 }
+
+func TestProfilerSetTuning(t *testing.T) {
+	cfg := config.EBPFConfig{
+		EnableProfiler:   true,
+		ProfilerInterval: 10 * time.Millisecond,
+		ProfilerAlpha:    0.5,
+		HotPathThreshold: 100,
+	}
+
+	sink := &captureSink{}
+	prof := NewProfiler(&cfg, sink)
+
+	prof.Record("/data/hot")
+	prof.Flush()
+	if len(sink.hints) != 0 {
+		t.Fatalf("expected no hints above threshold 100: %#v", sink.hints)
+	}
+
+	prof.SetTuning(1, 1)
+	prof.Record("/data/hot")
+	prof.Flush()
+	if sink.hints["/data/hot"] != 1 {
+		t.Fatalf("expected hint with alpha 1 after retuning: %#v", sink.hints)
+	}
+
+	var nilProf *Profiler
+	nilProf.SetTuning(0.5, 1)
+}
@@ -9,11 +9,47 @@ import (
 // ErrUnsupported is returned when the current platform cannot host eBPF programs
 var ErrUnsupported = errors.New("eBPF monitoring is only supported on Linux kernels >= 4.18")
 
+// Capture backends reported through agent_info and selectable via --capture-backend
+const (
+	BackendAuto     = "auto"
+	BackendFentry   = "fentry"
+	BackendKprobe   = "kprobe"
+	BackendFSNotify = "fsnotify"
+)
+
+// BTF sources reported by ProbeBTF
+const (
+	BTFSourceSystem   = "system"
+	BTFSourceCache    = "cache"
+	BTFSourceDownload = "download"
+	BTFSourceNone     = "none"
+)
+
+// KernelInfo identifies the running kernel the way BTFHub indexes it
+type KernelInfo struct {
+	Release   string `json:"release"`
+	Distro    string `json:"distro"`
+	VersionID string `json:"version_id"`
+	Arch      string `json:"arch"`
+}
+
+// BTFStatus describes where kernel BTF for CO-RE relocations comes from
+type BTFStatus struct {
+	Source string     `json:"source"`
+	Path   string     `json:"path,omitempty"`
+	URL    string     `json:"url,omitempty"`
+	Kernel KernelInfo `json:"kernel"`
+	Error  string     `json:"error,omitempty"`
+}
+
 // Event represents a captured syscall write targeting a given path
 type Event struct {
-	PID       uint32
-	Path      string
-	Bytes     uint64
+	PID   uint32
+	Path  string
+	Bytes uint64
+	// Offset is where in the file the write started, or -1 when the
+	// program does not report it
+	Offset    int64
 	Timestamp time.Time
 }
 
@@ -39,4 +75,6 @@ type Manager interface {
 	Events() <-chan Event
 	LifecycleEvents() <-chan LifecycleEvent
 	ApplyHotPathHints(map[string]float64) error
+	CaptureBackend() string
+	SetPathFilter(roots []string) error
 }
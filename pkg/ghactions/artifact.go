@@ -0,0 +1,208 @@
+package ghactions
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoRuntimeToken is returned when the Actions runtime credentials are not
+// visible to the process. Composite and `run:` steps do not receive them;
+// upload with actions/upload-artifact instead.
+var ErrNoRuntimeToken = errors.New(EnvRuntimeTok + " and " + EnvResultsURL + " are not set")
+
+const artifactService = "/twirp/github.actions.results.api.v1.ArtifactService/"
+
+// ArtifactClient uploads artifacts through the Actions results service, the
+// same API used by actions/upload-artifact@v4.
+type ArtifactClient struct {
+	ResultsURL string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// NewArtifactClientFromEnv builds a client from the runner environment.
+func NewArtifactClientFromEnv() (*ArtifactClient, error) {
+	token, resultsURL := os.Getenv(EnvRuntimeTok), os.Getenv(EnvResultsURL)
+	if token == "" || resultsURL == "" {
+		return nil, ErrNoRuntimeToken
+	}
+	return &ArtifactClient{ResultsURL: resultsURL, Token: token, HTTPClient: &http.Client{Timeout: 10 * time.Minute}}, nil
+}
+
+// UploadDir zips dir and uploads it as artifact name, returning the artifact ID.
+func (c *ArtifactClient) UploadDir(name, dir string) (string, error) {
+	runID, jobID, err := backendIDs(c.Token)
+	if err != nil {
+		return "", err
+	}
+
+	var archive bytes.Buffer
+	if err := zipDir(&archive, dir); err != nil {
+		return "", err
+	}
+
+	var created struct {
+		OK              bool   `json:"ok"`
+		SignedUploadURL string `json:"signed_upload_url"`
+	}
+	if err := c.twirp("CreateArtifact", map[string]any{
+		"workflow_run_backend_id":     runID,
+		"workflow_job_run_backend_id": jobID,
+		"name":                        name,
+		"version":                     4,
+	}, &created); err != nil {
+		return "", err
+	}
+	if !created.OK || created.SignedUploadURL == "" {
+		return "", fmt.Errorf("create artifact %q was rejected", name)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, created.SignedUploadURL, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("Content-Type", "application/zip")
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("upload artifact: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("upload artifact: %s", resp.Status)
+	}
+
+	sum := sha256.Sum256(archive.Bytes())
+	var finalized struct {
+		OK         bool   `json:"ok"`
+		ArtifactID string `json:"artifact_id"`
+	}
+	if err := c.twirp("FinalizeArtifact", map[string]any{
+		"workflow_run_backend_id":     runID,
+		"workflow_job_run_backend_id": jobID,
+		"name":                        name,
+		"size":                        strconv.Itoa(archive.Len()),
+		"hash":                        "sha256:" + hex.EncodeToString(sum[:]),
+	}, &finalized); err != nil {
+		return "", err
+	}
+	if !finalized.OK {
+		return "", fmt.Errorf("finalize artifact %q was rejected", name)
+	}
+	return finalized.ArtifactID, nil
+}
+
+func (c *ArtifactClient) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *ArtifactClient) twirp(method string, body, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.ResultsURL, "/")+artifactService+method, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s: %s", method, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s: decode response: %w", method, err)
+	}
+	return nil
+}
+
+// backendIDs extracts the workflow run and job IDs from the runtime token's
+// "Actions.Results:<run>:<job>" scope.
+func backendIDs(token string) (runID, jobID string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", errors.New("runtime token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", "", fmt.Errorf("decode runtime token: %w", err)
+	}
+
+	var claims struct {
+		Scope string `json:"scp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", "", fmt.Errorf("decode runtime token: %w", err)
+	}
+	for _, scope := range strings.Fields(claims.Scope) {
+		fields := strings.Split(scope, ":")
+		if len(fields) == 3 && fields[0] == "Actions.Results" {
+			return fields[1], fields[2], nil
+		}
+	}
+	return "", "", errors.New("runtime token has no Actions.Results scope")
+}
+
+func zipDir(w io.Writer, dir string) error {
+	zw := zip.NewWriter(w)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		hdr.Method = zip.Deflate
+
+		dst, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(dst, src)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("zip %s: %w", dir, err)
+	}
+	return zw.Close()
+}
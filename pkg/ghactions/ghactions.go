@@ -0,0 +1,119 @@
+// Package ghactions integrates with GitHub Actions: workflow commands for
+// annotations, the job summary file, and the artifact upload API.
+package ghactions
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Environment variables provided by the Actions runner.
+const (
+	EnvActions     = "GITHUB_ACTIONS"
+	EnvStepSummary = "GITHUB_STEP_SUMMARY"
+	EnvWorkspace   = "GITHUB_WORKSPACE"
+	EnvRuntimeTok  = "ACTIONS_RUNTIME_TOKEN"
+	EnvResultsURL  = "ACTIONS_RESULTS_URL"
+	EnvServerURL   = "GITHUB_SERVER_URL"
+	EnvRepository  = "GITHUB_REPOSITORY"
+	EnvRunID       = "GITHUB_RUN_ID"
+)
+
+// Annotation levels accepted by workflow commands.
+const (
+	LevelNotice  = "notice"
+	LevelWarning = "warning"
+	LevelError   = "error"
+)
+
+// Annotation is a message attached to a file (or the run) in the Actions UI.
+type Annotation struct {
+	Level   string
+	File    string // repository-relative path; empty for run-level annotations
+	Title   string
+	Message string
+}
+
+// WriteAnnotation emits a workflow command such as
+// "::warning file=a.go,title=T::message" to w (normally stdout).
+func WriteAnnotation(w io.Writer, a Annotation) error {
+	level := a.Level
+	if level == "" {
+		level = LevelWarning
+	}
+
+	var props []string
+	if a.File != "" {
+		props = append(props, "file="+escapeProperty(a.File))
+	}
+	if a.Title != "" {
+		props = append(props, "title="+escapeProperty(a.Title))
+	}
+
+	cmd := "::" + level
+	if len(props) > 0 {
+		cmd += " " + strings.Join(props, ",")
+	}
+	_, err := fmt.Fprintf(w, "%s::%s\n", cmd, escapeData(a.Message))
+	return err
+}
+
+func escapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+func escapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// AppendSummary appends markdown to the job summary. Outside Actions (no
+// $GITHUB_STEP_SUMMARY) the markdown is written to fallback instead.
+func AppendSummary(markdown string, fallback io.Writer) error {
+	path := os.Getenv(EnvStepSummary)
+	if path == "" {
+		_, err := io.WriteString(fallback, markdown)
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open job summary: %w", err)
+	}
+	if _, err := io.WriteString(f, markdown); err != nil {
+		f.Close()
+		return fmt.Errorf("write job summary: %w", err)
+	}
+	return f.Close()
+}
+
+// WorkspacePath maps an absolute path onto the repository-relative form that
+// annotations require. ok is false for paths outside $GITHUB_WORKSPACE.
+func WorkspacePath(path string) (rel string, ok bool) {
+	workspace := os.Getenv(EnvWorkspace)
+	if workspace == "" || !filepath.IsAbs(path) {
+		return "", false
+	}
+	rel, err := filepath.Rel(workspace, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// RunURL returns the web URL of the current workflow run, or "" outside
+// Actions.
+func RunURL() string {
+	server, repo, run := os.Getenv(EnvServerURL), os.Getenv(EnvRepository), os.Getenv(EnvRunID)
+	if server == "" || repo == "" || run == "" {
+		return ""
+	}
+	return strings.TrimSuffix(server, "/") + "/" + repo + "/actions/runs/" + run
+}
+
+// EscapeMarkdownCell makes s safe inside a markdown table cell.
+func EscapeMarkdownCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ", "\r", "").Replace(s)
+}
@@ -0,0 +1,109 @@
+package ghactions
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteAnnotationEscapes(t *testing.T) {
+	var out strings.Builder
+	err := WriteAnnotation(&out, Annotation{
+		Level:   LevelWarning,
+		File:    "logs/a,b.log",
+		Title:   "DiffKeeper: changed",
+		Message: "100% changed\nright before exit",
+	})
+	if err != nil {
+		t.Fatalf("WriteAnnotation: %v", err)
+	}
+	want := "::warning file=logs/a%2Cb.log,title=DiffKeeper%3A changed::100%25 changed%0Aright before exit\n"
+	if out.String() != want {
+		t.Fatalf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestWorkspacePath(t *testing.T) {
+	t.Setenv(EnvWorkspace, "/home/runner/work/repo")
+
+	if rel, ok := WorkspacePath("/home/runner/work/repo/logs/app.log"); !ok || rel != "logs/app.log" {
+		t.Fatalf("WorkspacePath = %q, %v", rel, ok)
+	}
+	if _, ok := WorkspacePath("/tmp/elsewhere"); ok {
+		t.Fatalf("path outside the workspace should not map")
+	}
+}
+
+func TestRunURL(t *testing.T) {
+	t.Setenv(EnvServerURL, "https://github.com/")
+	t.Setenv(EnvRepository, "saworbit/diffkeeper")
+	t.Setenv(EnvRunID, "42")
+	if got, want := RunURL(), "https://github.com/saworbit/diffkeeper/actions/runs/42"; got != want {
+		t.Errorf("RunURL() = %q, want %q", got, want)
+	}
+	t.Setenv(EnvRunID, "")
+	if got := RunURL(); got != "" {
+		t.Errorf("RunURL() outside Actions = %q, want empty", got)
+	}
+}
+
+func testToken(scope string) string {
+	claims, _ := json.Marshal(map[string]string{"scp": scope})
+	return "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+}
+
+func TestUploadDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "status.log"), []byte("ERROR"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var uploaded int
+	var finalize map[string]any
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/CreateArtifact"):
+			var body map[string]any
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["workflow_run_backend_id"] != "run1" || body["workflow_job_run_backend_id"] != "job1" {
+				t.Errorf("unexpected backend ids: %v", body)
+			}
+			json.NewEncoder(w).Encode(map[string]any{"ok": true, "signed_upload_url": srv.URL + "/blob"})
+		case r.URL.Path == "/blob" && r.Method == http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			uploaded = len(data)
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasSuffix(r.URL.Path, "/FinalizeArtifact"):
+			json.NewDecoder(r.Body).Decode(&finalize)
+			json.NewEncoder(w).Encode(map[string]any{"ok": true, "artifact_id": "42"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client := &ArtifactClient{ResultsURL: srv.URL, Token: testToken("Actions.ExampleScope Actions.Results:run1:job1")}
+	id, err := client.UploadDir("diffkeeper-export", dir)
+	if err != nil {
+		t.Fatalf("UploadDir: %v", err)
+	}
+	if id != "42" || uploaded == 0 {
+		t.Fatalf("id=%q uploaded=%d", id, uploaded)
+	}
+	if !strings.HasPrefix(finalize["hash"].(string), "sha256:") {
+		t.Fatalf("finalize hash = %v", finalize["hash"])
+	}
+}
+
+func TestBackendIDsRequiresResultsScope(t *testing.T) {
+	if _, _, err := backendIDs(testToken("Actions.Other")); err == nil {
+		t.Fatalf("expected error without Actions.Results scope")
+	}
+}
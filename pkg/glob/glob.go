@@ -0,0 +1,83 @@
+// Package glob matches slash-separated paths against shell-style patterns
+// with support for "**" spanning any number of directories.
+package glob
+
+import (
+	"path"
+	"strings"
+)
+
+// Match reports whether name matches pattern. Patterns use path.Match syntax
+// per segment; a "**" segment matches zero or more segments and a trailing
+// slash matches everything beneath a directory ("logs/" == "logs/**").
+// Both pattern and name are interpreted with forward slashes.
+func Match(pattern, name string) bool {
+	pattern = normalize(pattern)
+	name = normalize(name)
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	return matchSegments(split(pattern), split(name))
+}
+
+// MatchAny reports whether name matches at least one pattern. An empty
+// pattern list matches everything.
+func MatchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if Match(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate reports a malformed pattern before it is used for matching.
+func Validate(pattern string) error {
+	for _, seg := range split(normalize(pattern)) {
+		if seg == "**" {
+			continue
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func normalize(p string) string {
+	p = strings.ReplaceAll(p, "\\", "/")
+	return strings.TrimPrefix(p, "./")
+}
+
+func split(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
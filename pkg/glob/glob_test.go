@@ -0,0 +1,55 @@
+package glob
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"status.log", "status.log", true},
+		{"status.log", "logs/status.log", false},
+		{"*.log", "status.log", true},
+		{"*.log", "logs/status.log", false},
+		{"logs/**", "logs/app/today.log", true},
+		{"logs/**", "logs", true},
+		{"logs/**", "other/app.log", false},
+		{"logs/", "logs/app.log", true},
+		{"**/*.json", "package.json", true},
+		{"**/*.json", "web/app/package.json", true},
+		{"web/**/dist/*.js", "web/a/b/dist/main.js", true},
+		{"web/**/dist/*.js", "web/dist/main.js", true},
+		{"web/**/dist/*.js", "web/a/dist/sub/main.js", false},
+		{"./status.log", "status.log", true},
+		{"logs/*.log", `logs\app.log`, true},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	if !MatchAny(nil, "anything") {
+		t.Fatalf("empty pattern list should match everything")
+	}
+	patterns := []string{"logs/**", "status.log"}
+	if !MatchAny(patterns, "status.log") || !MatchAny(patterns, "logs/a.log") {
+		t.Fatalf("expected patterns to match")
+	}
+	if MatchAny(patterns, "db.lock") {
+		t.Fatalf("db.lock should not match %v", patterns)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate("logs/**/[a-z]*.log"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := Validate("logs/[a-"); err == nil {
+		t.Fatalf("expected malformed pattern error")
+	}
+}
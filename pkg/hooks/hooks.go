@@ -0,0 +1,257 @@
+// Package hooks delivers recording events to webhooks and local scripts, and
+// failure summaries to Slack or Teams, so a run can page someone when, for
+// example, a sentinel file changes.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/glob"
+)
+
+const (
+	// EnvEvent is set to the event name for exec hooks.
+	EnvEvent = "DIFFKEEPER_EVENT"
+
+	defaultTimeout = 10 * time.Second
+
+	// queueSize bounds pending deliveries; events beyond it are dropped so a
+	// slow endpoint never stalls capture.
+	queueSize = 256
+)
+
+// Event is the JSON payload sent to every hook.
+type Event struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path,omitempty"`
+	Op       string    `json:"op,omitempty"`
+	Size     int       `json:"size,omitempty"`
+	Captures int       `json:"captures,omitempty"`
+	Window   string    `json:"window,omitempty"`
+	Command  []string  `json:"command,omitempty"`
+	ExitCode int       `json:"exit_code,omitempty"`
+	StateDir string    `json:"state_dir,omitempty"`
+	Out      string    `json:"out,omitempty"`
+	Format   string    `json:"format,omitempty"`
+}
+
+type delivery struct {
+	hook  config.Hook
+	event Event
+}
+
+// Dispatcher matches events against the configured hooks and delivers them
+// in order on a background worker. A nil Dispatcher ignores everything.
+type Dispatcher struct {
+	hooks  []config.Hook
+	client *http.Client
+
+	mu     sync.Mutex
+	bursts map[int]*burst
+	closed bool
+
+	queue chan delivery
+	done  chan struct{}
+}
+
+// burst is the sliding capture window of one burst hook.
+type burst struct {
+	times []time.Time
+	fired bool
+}
+
+// New starts a dispatcher for hooks, or returns nil when there are none.
+func New(hooks []config.Hook) *Dispatcher {
+	if len(hooks) == 0 {
+		return nil
+	}
+	d := &Dispatcher{
+		hooks:  hooks,
+		client: &http.Client{},
+		bursts: make(map[int]*burst),
+		queue:  make(chan delivery, queueSize),
+		done:   make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Fire delivers ev to every hook registered for ev.Event. Path filters only
+// apply to file events.
+func (d *Dispatcher) Fire(ev Event) {
+	if d == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for _, h := range d.hooks {
+		if h.On != ev.Event {
+			continue
+		}
+		if h.On == config.HookFileChanged && !matches(h, ev.Path) {
+			continue
+		}
+		d.enqueue(h, ev)
+	}
+}
+
+// Changed reports a stored version of path. It fires file_changed hooks and
+// feeds the burst windows.
+func (d *Dispatcher) Changed(at time.Time, op, path string, size int) {
+	if d == nil {
+		return
+	}
+	d.Fire(Event{Event: config.HookFileChanged, Time: at, Path: path, Op: op, Size: size})
+
+	for i, h := range d.hooks {
+		if h.On != config.HookBurst || !matches(h, path) {
+			continue
+		}
+		if n, ok := d.observe(i, h, at); ok {
+			d.enqueue(h, Event{Event: config.HookBurst, Time: at, Path: path, Op: op, Captures: n, Window: h.Window.String()})
+		}
+	}
+}
+
+// observe records one capture for burst hook i and reports whether the
+// hook should fire. A burst fires once when the window reaches the
+// threshold and re-arms after the rate drops below it again.
+func (d *Dispatcher) observe(i int, h config.Hook, at time.Time) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b := d.bursts[i]
+	if b == nil {
+		b = &burst{}
+		d.bursts[i] = b
+	}
+	cutoff := at.Add(-h.Window)
+	keep := b.times[:0]
+	for _, t := range b.times {
+		if t.After(cutoff) {
+			keep = append(keep, t)
+		}
+	}
+	b.times = append(keep, at)
+	if len(b.times) < h.Threshold {
+		b.fired = false
+		return len(b.times), false
+	}
+	if b.fired {
+		return len(b.times), false
+	}
+	b.fired = true
+	return len(b.times), true
+}
+
+// Close delivers queued events and stops the worker. It is safe to call
+// more than once.
+func (d *Dispatcher) Close() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	close(d.queue)
+	d.mu.Unlock()
+	<-d.done
+}
+
+func (d *Dispatcher) enqueue(h config.Hook, ev Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.queue <- delivery{hook: h, event: ev}:
+	default:
+		log.Printf("[hooks] queue full, dropping %s event for %s", ev.Event, target(h))
+	}
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	for item := range d.queue {
+		if err := d.deliver(item.hook, item.event); err != nil {
+			log.Printf("[hooks] %s hook %s failed: %v", item.event.Event, target(item.hook), err)
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(h config.Hook, ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if h.URL != "" {
+		return d.post(ctx, h.URL, payload)
+	}
+	return runExec(ctx, h.Exec, ev.Event, payload)
+}
+
+func (d *Dispatcher) post(ctx context.Context, url string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func runExec(ctx context.Context, argv []string, event string, payload []byte) error {
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), EnvEvent+"="+event)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(out) > 0 {
+			return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+		}
+		return err
+	}
+	return nil
+}
+
+func matches(h config.Hook, path string) bool {
+	return h.Path == "" || glob.Match(h.Path, path)
+}
+
+func target(h config.Hook) string {
+	if h.URL != "" {
+		return h.URL
+	}
+	return h.Exec[0]
+}
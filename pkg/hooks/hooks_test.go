@@ -0,0 +1,117 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+// recorder collects the events POSTed to a test webhook.
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var ev Event
+	if err := json.NewDecoder(req.Body).Decode(&ev); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	r.events = append(r.events, ev)
+	r.mu.Unlock()
+}
+
+func TestFileChangedHookMatchesPath(t *testing.T) {
+	rec := &recorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	d := New([]config.Hook{{On: config.HookFileChanged, Path: "**/db.lock", URL: srv.URL}})
+	d.Changed(time.Now(), "WRITE", "app/main.go", 10)
+	d.Changed(time.Now(), "WRITE", "data/db.lock", 4)
+	d.Fire(Event{Event: config.HookExportCompleted})
+	d.Close()
+
+	if len(rec.events) != 1 {
+		t.Fatalf("got %d events, want 1: %+v", len(rec.events), rec.events)
+	}
+	if ev := rec.events[0]; ev.Event != config.HookFileChanged || ev.Path != "data/db.lock" || ev.Size != 4 {
+		t.Errorf("unexpected payload: %+v", ev)
+	}
+}
+
+func TestBurstHookFiresOncePerBurst(t *testing.T) {
+	rec := &recorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	d := New([]config.Hook{{On: config.HookBurst, URL: srv.URL, Threshold: 3, Window: time.Second}})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		d.Changed(start.Add(time.Duration(i)*time.Millisecond), "WRITE", "out.log", 1)
+	}
+	// The window empties, so the next run of captures is a new burst.
+	later := start.Add(5 * time.Second)
+	for i := 0; i < 3; i++ {
+		d.Changed(later.Add(time.Duration(i)*time.Millisecond), "WRITE", "out.log", 1)
+	}
+	d.Close()
+
+	if len(rec.events) != 2 {
+		t.Fatalf("got %d burst events, want 2: %+v", len(rec.events), rec.events)
+	}
+	if rec.events[0].Captures != 3 || rec.events[0].Window != "1s" {
+		t.Errorf("unexpected payload: %+v", rec.events[0])
+	}
+}
+
+func TestNilDispatcherIgnoresEvents(t *testing.T) {
+	d := New(nil)
+	if d != nil {
+		t.Fatalf("New(nil) = %v, want nil", d)
+	}
+	d.Changed(time.Now(), "WRITE", "a", 1)
+	d.Fire(Event{Event: config.HookCommandFailed})
+	d.Close()
+}
+
+func TestNotifyFailureFormats(t *testing.T) {
+	var got map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = nil
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	summary := FailureSummary{
+		Command:  []string{"go", "test", "./..."},
+		ExitCode: 1,
+		StateDir: "/tmp/state",
+		Files:    []ChangedFile{{Path: "db.lock", Op: "WRITE", Time: time.Now()}},
+		Link:     "https://ci.example.com/run/7",
+	}
+	if err := NotifyFailure(context.Background(), srv.URL, config.NotifySlack, summary); err != nil {
+		t.Fatalf("slack: %v", err)
+	}
+	if text := got["text"]; !strings.Contains(text, "exit code 1") || !strings.Contains(text, "`db.lock`") || !strings.Contains(text, summary.Link) {
+		t.Errorf("unexpected slack text: %q", text)
+	}
+
+	if err := NotifyFailure(context.Background(), srv.URL, config.NotifyTeams, summary); err != nil {
+		t.Fatalf("teams: %v", err)
+	}
+	if got["@type"] != "MessageCard" || !strings.Contains(got["title"], "go test ./...") || !strings.Contains(got["text"], "db.lock") {
+		t.Errorf("unexpected teams card: %+v", got)
+	}
+}
@@ -0,0 +1,95 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+// ChangedFile is one entry of a failure summary.
+type ChangedFile struct {
+	Path string
+	Op   string
+	Time time.Time
+}
+
+// FailureSummary describes a recording whose command exited nonzero.
+type FailureSummary struct {
+	Command  []string
+	ExitCode int
+	StateDir string
+	Files    []ChangedFile // most recent first
+	Link     string
+}
+
+// Title is the one-line headline of s.
+func (s FailureSummary) Title() string {
+	return fmt.Sprintf("diffkeeper: `%s` failed with exit code %d", strings.Join(s.Command, " "), s.ExitCode)
+}
+
+// Text renders the body of s as chat markdown.
+func (s FailureSummary) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "State dir: `%s`\n", s.StateDir)
+	if len(s.Files) == 0 {
+		b.WriteString("No files changed during the run.\n")
+	} else {
+		fmt.Fprintf(&b, "Last %d changed files:\n", len(s.Files))
+		for _, f := range s.Files {
+			fmt.Fprintf(&b, "- %s `%s` (%s)\n", f.Time.UTC().Format("15:04:05.000"), f.Path, f.Op)
+		}
+	}
+	if s.Link != "" {
+		fmt.Fprintf(&b, "Details: %s\n", s.Link)
+	}
+	return b.String()
+}
+
+// NotifyFailure posts s to a Slack or Teams incoming webhook.
+func NotifyFailure(ctx context.Context, url, format string, s FailureSummary) error {
+	var payload any
+	switch format {
+	case config.NotifySlack:
+		payload = map[string]string{"text": "*" + s.Title() + "*\n" + s.Text()}
+	case config.NotifyTeams:
+		// Teams renders MessageCard text as markdown, which needs blank
+		// lines between list items to keep them on separate lines.
+		payload = map[string]string{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    s.Title(),
+			"title":      s.Title(),
+			"themeColor": "D70000",
+			"text":       strings.ReplaceAll(s.Text(), "\n", "\n\n"),
+		}
+	default:
+		return fmt.Errorf("unsupported notify format %q", format)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encode notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
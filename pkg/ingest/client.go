@@ -0,0 +1,252 @@
+package ingest
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// maxQueueBytes bounds the captured content an agent holds while the
+	// collector is unreachable; Send blocks beyond it.
+	maxQueueBytes = 256 << 20
+
+	reconnectMin = time.Second
+	reconnectMax = 30 * time.Second
+)
+
+// DialOptions configures how an agent reaches its collector.
+type DialOptions struct {
+	// TLS, when set, secures the connection; otherwise it is plaintext.
+	TLS *tls.Config
+	// Token is sent as a bearer token.
+	Token string
+	// Namespace is the namespace the agent records into. The collector
+	// rejects entries whose path is not in it.
+	Namespace string
+}
+
+// Client streams journal entries to a collector. Entries are queued and
+// kept until the collector acknowledges them, and resent after the
+// connection drops, so a collector restart loses nothing.
+type Client struct {
+	conn  *grpc.ClientConn
+	addr  string
+	token string
+	ns    string
+	done  chan struct{}
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queue holds the entries not acknowledged yet; queue[:sent] went out
+	// on the current stream.
+	queue      []recorder.JournalEntry
+	queueBytes int
+	sent       int
+	live       bool
+	closing    bool
+	abandoned  bool
+	cancel     context.CancelFunc
+}
+
+// Dial starts streaming to the collector at addr (host:port).
+func Dial(addr string, opts DialOptions) (*Client, error) {
+	creds := insecure.NewCredentials()
+	if opts.TLS != nil {
+		creds = credentials.NewTLS(opts.TLS)
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("dial collector %s: %w", addr, err)
+	}
+	c := &Client{conn: conn, addr: addr, token: opts.Token, ns: opts.Namespace, done: make(chan struct{})}
+	c.cond = sync.NewCond(&c.mu)
+	go c.run()
+	return c, nil
+}
+
+// Send queues entry for the collector. It blocks while the queue is full,
+// which only happens when the collector has been unreachable for a while.
+func (c *Client) Send(entry recorder.JournalEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.queueBytes >= maxQueueBytes && !c.abandoned {
+		c.cond.Wait()
+	}
+	if c.closing || c.abandoned {
+		return errors.New("ingest client is closed")
+	}
+	c.queue = append(c.queue, entry)
+	c.queueBytes += len(entry.Data)
+	c.cond.Broadcast()
+	return nil
+}
+
+// Close waits until the collector has acknowledged every queued entry, or
+// ctx is done, and disconnects.
+func (c *Client) Close(ctx context.Context) error {
+	c.mu.Lock()
+	c.closing = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	var err error
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.mu.Lock()
+		c.abandoned = true
+		err = fmt.Errorf("%d captured entries were not delivered to %s: %w", len(c.queue), c.addr, ctx.Err())
+		if c.cancel != nil {
+			c.cancel()
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		<-c.done
+	}
+	return errors.Join(err, c.conn.Close())
+}
+
+// Pending returns how many entries the collector has not acknowledged.
+func (c *Client) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queue)
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+	delay := reconnectMin
+	for {
+		progressed, err := c.stream()
+		c.mu.Lock()
+		finished := c.abandoned || (c.closing && len(c.queue) == 0)
+		c.mu.Unlock()
+		if finished {
+			return
+		}
+		if progressed {
+			delay = reconnectMin
+		}
+		log.Printf("[agent] stream to %s ended, reconnecting in %s: %v", c.addr, delay, err)
+		c.wait(delay)
+		delay = min(delay*2, reconnectMax)
+	}
+}
+
+// wait sleeps for d, or until the client is abandoned.
+func (c *Client) wait(d time.Duration) {
+	timer := time.AfterFunc(d, func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(d)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for !c.abandoned && time.Now().Before(deadline) {
+		c.cond.Wait()
+	}
+}
+
+// stream sends the queue over one stream until it fails or, once the
+// client is closing, everything is acknowledged. It reports whether any
+// entry was acknowledged.
+func (c *Client) stream() (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, namespaceHeader, c.ns)
+	if c.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.token)
+	}
+	c.mu.Lock()
+	if c.abandoned {
+		c.mu.Unlock()
+		return false, errors.New("abandoned")
+	}
+	c.cancel = cancel
+	c.mu.Unlock()
+
+	s, err := c.conn.NewStream(ctx, &serviceDesc.Streams[0], streamPath, grpc.ForceCodec(codec{}))
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.sent, c.live = 0, true
+	c.mu.Unlock()
+	sendErr := make(chan error, 1)
+	go func() { sendErr <- c.send(s) }()
+
+	progressed := false
+	var acked uint64
+	for {
+		var ack Ack
+		err := s.RecvMsg(&ack)
+		if err != nil {
+			c.mu.Lock()
+			c.live = false
+			c.cond.Broadcast()
+			c.mu.Unlock()
+			cancel()
+			if serr := <-sendErr; errors.Is(err, io.EOF) {
+				err = serr
+			}
+			if err == nil {
+				err = errors.New("collector closed the stream")
+			}
+			return progressed, err
+		}
+
+		if ack.Received <= acked {
+			continue
+		}
+		c.mu.Lock()
+		n := min(int(ack.Received-acked), c.sent)
+		acked = ack.Received
+		for _, e := range c.queue[:n] {
+			c.queueBytes -= len(e.Data)
+		}
+		c.queue = append(c.queue[:0:0], c.queue[n:]...)
+		c.sent -= n
+		progressed = progressed || n > 0
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
+
+// send writes queued entries to s as they arrive, and ends the stream
+// once the client is closing and everything was sent.
+func (c *Client) send(s grpc.ClientStream) error {
+	for {
+		c.mu.Lock()
+		for c.live && c.sent == len(c.queue) && !c.closing {
+			c.cond.Wait()
+		}
+		if !c.live {
+			c.mu.Unlock()
+			return nil
+		}
+		if c.sent == len(c.queue) {
+			c.mu.Unlock()
+			return s.CloseSend()
+		}
+		entry := c.queue[c.sent]
+		c.sent++
+		c.mu.Unlock()
+		if err := s.SendMsg(&entry); err != nil {
+			return err
+		}
+	}
+}
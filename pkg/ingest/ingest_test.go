@@ -0,0 +1,238 @@
+package ingest
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/remote"
+	"google.golang.org/grpc"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, entry := range []recorder.JournalEntry{
+		{Timestamp: 42, Path: "ci//logs/app.log", Op: "write", Data: []byte("hello\n")},
+		{Timestamp: 43, Path: "ci//out", Op: recorder.OpMkdir, Mode: fs.ModeDir | 0o755},
+		{Timestamp: 44, Path: "ci//big.bin", Op: "write", Data: []byte("headtail"),
+			Truncated: &recorder.Truncation{Size: 1 << 30, SHA256: "ab", Head: 4, Tail: 4}},
+		{Timestamp: 45, Path: "ci//secret", Op: "write", Observed: &recorder.Observation{Size: 7, SHA256: "cd"}},
+	} {
+		data, err := codec{}.Marshal(&entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got recorder.JournalEntry
+		if err := (codec{}).Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, entry) {
+			t.Errorf("round trip = %+v, want %+v", got, entry)
+		}
+	}
+	if err := (codec{}).Unmarshal([]byte{0x12, 0x05, 'a'}, &recorder.JournalEntry{}); err == nil {
+		t.Error("a truncated message should not decode")
+	}
+}
+
+func openJournal(t *testing.T) (*pebble.DB, *recorder.Journal) {
+	t.Helper()
+	db, err := pebble.Open(t.TempDir(), &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, recorder.NewJournal(db)
+}
+
+func serve(t *testing.T, lis net.Listener, server *Server) {
+	t.Helper()
+	g := grpc.NewServer(ServerCodec())
+	server.Register(g)
+	go g.Serve(lis)
+	t.Cleanup(g.Stop)
+}
+
+func journaled(t *testing.T, db *pebble.DB) int {
+	t.Helper()
+	iter, err := db.NewIter(&pebble.IterOptions{LowerBound: []byte(cas.PrefixLog), UpperBound: append([]byte(cas.PrefixLog), 0xff)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		n++
+	}
+	return n
+}
+
+func TestClientDeliversOnceTheCollectorListens(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	// Captures made before the collector is up are queued, not lost.
+	client, err := Dial(addr, DialOptions{Token: "agent-secret", Namespace: "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := client.Send(recorder.JournalEntry{Timestamp: int64(i + 1), Path: "ci//f.txt", Op: "write", Data: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	db, journal := openJournal(t)
+	access, err := remote.ParseAccess(strings.NewReader("write token:agent-secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(journal)
+	server.RequireAccess(access)
+	if lis, err = net.Listen("tcp", addr); err != nil {
+		t.Skipf("port reused: %v", err)
+	}
+	serve(t, lis, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if n := journaled(t, db); n != 3 {
+		t.Fatalf("collector journaled %d entries, want 3", n)
+	}
+}
+
+func TestServerRejectsReadOnlyCredentials(t *testing.T) {
+	db, journal := openJournal(t)
+	access, err := remote.ParseAccess(strings.NewReader("read token:reader\nwrite token:writer\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(journal)
+	server.RequireAccess(access)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, lis, server)
+
+	client, err := Dial(lis.Addr().String(), DialOptions{Token: "reader", Namespace: "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send(recorder.JournalEntry{Timestamp: 1, Path: "ci//f.txt", Op: "write"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := client.Close(ctx); err == nil || !strings.Contains(err.Error(), "not delivered") {
+		t.Fatalf("close = %v, want undelivered entries", err)
+	}
+	if n := journaled(t, db); n != 0 {
+		t.Fatalf("collector journaled %d entries from a read-only client", n)
+	}
+}
+
+func TestServerRejectsNamespacesTheTokenIsNotBoundTo(t *testing.T) {
+	db, journal := openJournal(t)
+	access, err := remote.ParseAccess(strings.NewReader("write token:runner ns:ci\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(journal)
+	server.RequireAccess(access)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, lis, server)
+
+	send := func(ns string, wait time.Duration) error {
+		t.Helper()
+		client, err := Dial(lis.Addr().String(), DialOptions{Token: "runner", Namespace: ns})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Send(recorder.JournalEntry{Timestamp: 1, Path: ns + "//f.txt", Op: "write"}); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), wait)
+		defer cancel()
+		return client.Close(ctx)
+	}
+	if err := send("other", 500*time.Millisecond); err == nil {
+		t.Error("a token bound to ci recorded into namespace other")
+	}
+	if n := journaled(t, db); n != 0 {
+		t.Fatalf("collector journaled %d entries from an unbound namespace", n)
+	}
+	if err := send("ci", 10*time.Second); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if n := journaled(t, db); n != 1 {
+		t.Fatalf("collector journaled %d entries, want 1", n)
+	}
+}
+
+func TestServerRejectsEntriesOutsideTheStreamNamespace(t *testing.T) {
+	db, journal := openJournal(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, lis, NewServer(journal))
+
+	for _, tc := range []struct {
+		ns, path string
+	}{
+		{"ci", "other//f.txt"},
+		{"ci", "f.txt"},
+		{"ci", "ci//../f.txt"},
+		{"", "ci//f.txt"},
+	} {
+		client, err := Dial(lis.Addr().String(), DialOptions{Namespace: tc.ns})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Send(recorder.JournalEntry{Timestamp: 1, Path: tc.path, Op: "write"}); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		if err := client.Close(ctx); err == nil {
+			t.Errorf("namespace %q accepted an entry for %s", tc.ns, tc.path)
+		}
+		cancel()
+	}
+	if n := journaled(t, db); n != 0 {
+		t.Fatalf("collector journaled %d entries outside their namespace", n)
+	}
+
+	client, err := Dial(lis.Addr().String(), DialOptions{Namespace: "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send(recorder.JournalEntry{Timestamp: 1, Path: "ci//f.txt", Op: "write"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if n := journaled(t, db); n != 1 {
+		t.Fatalf("collector journaled %d entries, want 1", n)
+	}
+}
@@ -0,0 +1,244 @@
+// Package ingest streams journal entries from agents on other machines to
+// a collector that owns the store, so ephemeral runners keep nothing
+// local. The protocol is gRPC; see ingest.proto.
+package ingest
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/remote"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	serviceName = "diffkeeper.ingest.v1.Ingest"
+	streamName  = "Stream"
+	streamPath  = "/" + serviceName + "/" + streamName
+
+	// namespaceHeader is the stream metadata naming the namespace an agent
+	// records into. The collector binds the stream to it and rejects
+	// entries outside it, so an agent cannot write over another's files.
+	namespaceHeader = "diffkeeper-namespace"
+
+	// ackInterval is how often a collector acknowledges the entries it
+	// journaled.
+	ackInterval = 200 * time.Millisecond
+)
+
+// ingester is the service interface registered with gRPC.
+type ingester interface {
+	stream(grpc.ServerStream) error
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*ingester)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    streamName,
+		Handler:       func(srv any, s grpc.ServerStream) error { return srv.(ingester).stream(s) },
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+	Metadata: "ingest.proto",
+}
+
+// ServerCodec must be passed to grpc.NewServer for a server that Register
+// is called on.
+func ServerCodec() grpc.ServerOption {
+	return grpc.ForceServerCodec(codec{})
+}
+
+// Server journals the entries agents stream to it.
+type Server struct {
+	journal *recorder.Journal
+	access  *remote.Access
+
+	mu      sync.Mutex
+	streams int
+	entries uint64
+}
+
+// NewServer journals into journal. Each stream is bound to the namespace
+// its agent declares, so journal should have none.
+func NewServer(journal *recorder.Journal) *Server {
+	return &Server{journal: journal}
+}
+
+// RequireAccess makes the server accept only agents whose credentials are
+// in access with the write scope.
+func (s *Server) RequireAccess(access *remote.Access) {
+	s.access = access
+}
+
+// Register adds the ingest service to g.
+func (s *Server) Register(g *grpc.Server) {
+	g.RegisterService(&serviceDesc, s)
+}
+
+// Stats returns the number of open streams and of entries journaled.
+func (s *Server) Stats() (streams int, entries uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams, s.entries
+}
+
+func (s *Server) stream(st grpc.ServerStream) error {
+	ns, err := streamNamespace(st)
+	if err != nil {
+		return err
+	}
+	if err := s.authorize(st, ns); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.streams++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.streams--
+		s.mu.Unlock()
+	}()
+
+	// Entries are acknowledged in the background, so an agent that has
+	// sent everything hears back without sending more.
+	var mu sync.Mutex
+	var received, acked uint64
+	ack := func() error {
+		mu.Lock()
+		n := received
+		mu.Unlock()
+		if n == acked {
+			return nil
+		}
+		if err := s.journal.Flush(); err != nil {
+			return status.Errorf(codes.Internal, "journal: %v", err)
+		}
+		if err := st.SendMsg(&Ack{Received: n}); err != nil {
+			return err
+		}
+		acked = n
+		return nil
+	}
+	done := make(chan struct{})
+	ackErr := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(ackInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				ackErr <- nil
+				return
+			case <-ticker.C:
+				if err := ack(); err != nil {
+					ackErr <- err
+					return
+				}
+			}
+		}
+	}()
+	stopAcks := func() error {
+		close(done)
+		return <-ackErr
+	}
+
+	for {
+		var entry recorder.JournalEntry
+		if err := st.RecvMsg(&entry); err != nil {
+			if ackFailed := stopAcks(); ackFailed != nil {
+				return ackFailed
+			}
+			if errors.Is(err, io.EOF) {
+				// The agent is done: acknowledge the rest.
+				return ack()
+			}
+			return err
+		}
+		if err := validEntry(entry, ns); err != nil {
+			stopAcks()
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := s.journal.Append(entry); err != nil {
+			stopAcks()
+			return status.Errorf(codes.Internal, "journal: %v", err)
+		}
+		mu.Lock()
+		received++
+		mu.Unlock()
+		s.mu.Lock()
+		s.entries++
+		s.mu.Unlock()
+	}
+}
+
+// authorize checks the bearer token or client certificate of a stream
+// recording into namespace ns.
+func (s *Server) authorize(st grpc.ServerStream, ns string) error {
+	if s.access == nil {
+		return nil
+	}
+	var auth string
+	if md, ok := metadata.FromIncomingContext(st.Context()); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			auth = values[0]
+		}
+	}
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(st.Context()); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	if !s.access.Authorize(auth, state, remote.ScopeWrite, ns) {
+		return status.Errorf(codes.PermissionDenied, "missing or insufficient credentials: the write scope in namespace %q is required", ns)
+	}
+	return nil
+}
+
+// streamNamespace returns the namespace a stream declared in its metadata.
+func streamNamespace(st grpc.ServerStream) (string, error) {
+	var values []string
+	if md, ok := metadata.FromIncomingContext(st.Context()); ok {
+		values = md.Get(namespaceHeader)
+	}
+	if len(values) != 1 || values[0] == "" {
+		return "", status.Errorf(codes.InvalidArgument, "the stream must name one namespace in %s", namespaceHeader)
+	}
+	if err := config.ValidateNamespace(values[0]); err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	return values[0], nil
+}
+
+// validEntry rejects entries outside namespace ns and entries the processor
+// could not store.
+func validEntry(e recorder.JournalEntry, ns string) error {
+	if e.Path == "" || e.Op == "" {
+		return errors.New("entry needs a path and an op")
+	}
+	path, ok := recorder.InNamespace(e.Path, ns)
+	if !ok {
+		return fmt.Errorf("entry for %s is outside the stream's namespace %q", e.Path, ns)
+	}
+	if path == "" || strings.HasPrefix(path, "/") || strings.Contains(path, "\x00") || slices.Contains(strings.Split(path, "/"), "..") {
+		return fmt.Errorf("invalid path %q", e.Path)
+	}
+	if e.Timestamp <= 0 {
+		return fmt.Errorf("entry for %s has no timestamp", e.Path)
+	}
+	return nil
+}
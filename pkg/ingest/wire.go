@@ -0,0 +1,201 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Ack acknowledges the entries journaled from a stream.
+type Ack struct {
+	Received uint64
+}
+
+// codec encodes the messages of ingest.proto. It is named "proto" so
+// clients generated from ingest.proto interoperate with it.
+type codec struct{}
+
+func (codec) Name() string { return "proto" }
+
+func (codec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case *recorder.JournalEntry:
+		return appendEntry(nil, m), nil
+	case *Ack:
+		return appendVarint(nil, 1, m.Received), nil
+	default:
+		return nil, fmt.Errorf("ingest: cannot marshal %T", v)
+	}
+}
+
+func (codec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *recorder.JournalEntry:
+		*m = recorder.JournalEntry{}
+		return parseEntry(data, m)
+	case *Ack:
+		*m = Ack{}
+		return parseFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			if num == 1 && typ == protowire.VarintType {
+				v, n := protowire.ConsumeVarint(b)
+				m.Received = v
+				return n, nil
+			}
+			return 0, errUnknownField
+		})
+	default:
+		return fmt.Errorf("ingest: cannot unmarshal into %T", v)
+	}
+}
+
+func appendEntry(b []byte, e *recorder.JournalEntry) []byte {
+	b = appendVarint(b, 1, uint64(e.Timestamp))
+	b = appendString(b, 2, e.Path)
+	b = appendString(b, 3, e.Op)
+	if len(e.Data) > 0 {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, e.Data)
+	}
+	b = appendVarint(b, 5, uint64(e.Mode))
+	if t := e.Truncated; t != nil {
+		var sub []byte
+		sub = appendVarint(sub, 1, uint64(t.Size))
+		sub = appendString(sub, 2, t.SHA256)
+		sub = appendVarint(sub, 3, uint64(t.Head))
+		sub = appendVarint(sub, 4, uint64(t.Tail))
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, sub)
+	}
+	if o := e.Observed; o != nil {
+		var sub []byte
+		sub = appendVarint(sub, 1, uint64(o.Size))
+		sub = appendString(sub, 2, o.SHA256)
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendBytes(b, sub)
+	}
+	return b
+}
+
+func parseEntry(data []byte, e *recorder.JournalEntry) error {
+	return parseFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case typ == protowire.VarintType && (num == 1 || num == 5):
+			v, n := protowire.ConsumeVarint(b)
+			if num == 1 {
+				e.Timestamp = int64(v)
+			} else {
+				e.Mode = fs.FileMode(v)
+			}
+			return n, nil
+		case typ == protowire.BytesType && num >= 2 && num <= 7:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			switch num {
+			case 2:
+				e.Path = string(v)
+			case 3:
+				e.Op = string(v)
+			case 4:
+				e.Data = append([]byte(nil), v...)
+			case 6:
+				e.Truncated = &recorder.Truncation{}
+				return n, parseTruncation(v, e.Truncated)
+			case 7:
+				e.Observed = &recorder.Observation{}
+				return n, parseObservation(v, e.Observed)
+			}
+			return n, nil
+		}
+		return 0, errUnknownField
+	})
+}
+
+func parseTruncation(data []byte, t *recorder.Truncation) error {
+	return parseFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case typ == protowire.VarintType && num != 2:
+			v, n := protowire.ConsumeVarint(b)
+			switch num {
+			case 1:
+				t.Size = int64(v)
+			case 3:
+				t.Head = int(v)
+			case 4:
+				t.Tail = int(v)
+			}
+			return n, nil
+		case typ == protowire.BytesType && num == 2:
+			v, n := protowire.ConsumeBytes(b)
+			t.SHA256 = string(v)
+			return n, nil
+		}
+		return 0, errUnknownField
+	})
+}
+
+func parseObservation(data []byte, o *recorder.Observation) error {
+	return parseFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case typ == protowire.VarintType && num == 1:
+			v, n := protowire.ConsumeVarint(b)
+			o.Size = int64(v)
+			return n, nil
+		case typ == protowire.BytesType && num == 2:
+			v, n := protowire.ConsumeBytes(b)
+			o.SHA256 = string(v)
+			return n, nil
+		}
+		return 0, errUnknownField
+	})
+}
+
+var (
+	errMalformed    = errors.New("ingest: malformed message")
+	errUnknownField = errors.New("unknown field")
+)
+
+// parseFields calls field for each field of a message with the bytes after
+// its tag. field returns how many bytes the value took (negative for a
+// malformed value, as protowire reports it), or errUnknownField to have
+// the field skipped.
+func parseFields(data []byte, field func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return errMalformed
+		}
+		data = data[n:]
+		n, err := field(num, typ, data)
+		if errors.Is(err, errUnknownField) {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		} else if err != nil {
+			return err
+		}
+		if n < 0 {
+			return errMalformed
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
@@ -0,0 +1,185 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// incrementalMagic prefixes an encoded IncrementalTree.
+const incrementalMagic = "DKMT"
+
+// IncrementalTree is a Merkle tree that grows by appending leaves. It keeps
+// every level, so an append rehashes only the path from the new leaf to the
+// root, and its root and proofs match BuildTree over the same leaves (see
+// ProofVersion). The encoded form keeps the levels too, so a persisted tree
+// can be verified against without rebuilding it.
+type IncrementalTree struct {
+	// levels[0] holds the leaf hashes and the last level the root. A level
+	// with an odd number of nodes pairs its last node with itself.
+	levels [][][]byte
+}
+
+// NewIncrementalTree returns a tree over contents, which may be empty.
+func NewIncrementalTree(contents ...string) *IncrementalTree {
+	t := &IncrementalTree{}
+	for _, content := range contents {
+		t.Append(content)
+	}
+	return t
+}
+
+// Len returns the number of leaves.
+func (t *IncrementalTree) Len() int {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return len(t.levels[0])
+}
+
+// Root returns the root hash, or nil for an empty tree.
+func (t *IncrementalTree) Root() []byte {
+	if len(t.levels) == 0 {
+		return nil
+	}
+	top := t.levels[len(t.levels)-1]
+	return top[0]
+}
+
+// Append adds a leaf for content and rehashes its path to the root.
+func (t *IncrementalTree) Append(content string) {
+	leaf := sha256.Sum256([]byte(content))
+	if len(t.levels) == 0 {
+		t.levels = [][][]byte{nil}
+	}
+	t.levels[0] = append(t.levels[0], leaf[:])
+
+	// A single leaf is still paired with itself, so level 0 always has a
+	// parent; above it the level holding one node is the root.
+	for k := 0; k == 0 || len(t.levels[k]) > 1; k++ {
+		if k+1 == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		level := t.levels[k]
+		p := (len(level) - 1) / 2
+		parent := hashPair(level, p)
+		if p == len(t.levels[k+1]) {
+			t.levels[k+1] = append(t.levels[k+1], parent)
+		} else {
+			t.levels[k+1][p] = parent
+		}
+	}
+}
+
+// Proof returns an inclusion proof for leaf i, whose content must be given
+// since the tree keeps only hashes.
+func (t *IncrementalTree) Proof(i int, content string) (*Proof, error) {
+	if i < 0 || i >= t.Len() {
+		return nil, fmt.Errorf("leaf %d out of range (tree has %d leaves)", i, t.Len())
+	}
+	if leaf := sha256.Sum256([]byte(content)); !bytes.Equal(leaf[:], t.levels[0][i]) {
+		return nil, fmt.Errorf("content %q is not leaf %d", content, i)
+	}
+
+	proof := &Proof{Version: ProofVersion, Leaf: content}
+	for k := 0; k < len(t.levels)-1; k++ {
+		level := t.levels[k]
+		sibling, index := i^1, int64(0)
+		if i%2 == 0 {
+			index = 1
+		}
+		if sibling >= len(level) {
+			sibling = i
+		}
+		proof.Siblings = append(proof.Siblings, level[sibling])
+		proof.Index = append(proof.Index, index)
+		i /= 2
+	}
+	return proof, nil
+}
+
+// MarshalBinary encodes every level of the tree.
+func (t *IncrementalTree) MarshalBinary() ([]byte, error) {
+	buf := []byte(incrementalMagic)
+	buf = binary.AppendUvarint(buf, ProofVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(t.levels)))
+	for _, level := range t.levels {
+		buf = binary.AppendUvarint(buf, uint64(len(level)))
+		for _, node := range level {
+			buf = append(buf, node...)
+		}
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a tree written by MarshalBinary. The level sizes
+// are checked, but hashes are not recomputed; compare Root with a trusted
+// root to verify the content.
+func (t *IncrementalTree) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, []byte(incrementalMagic)) {
+		return fmt.Errorf("not an encoded Merkle tree")
+	}
+	r := bytes.NewReader(data[len(incrementalMagic):])
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("decode tree version: %w", err)
+	}
+	if !SupportedVersion(int(version)) {
+		return fmt.Errorf("unsupported tree version %d (this build reads version %d)", version, ProofVersion)
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("decode tree levels: %w", err)
+	}
+	if count > 64 {
+		return fmt.Errorf("tree has %d levels", count)
+	}
+
+	levels := make([][][]byte, count)
+	for k := range levels {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("decode level %d: %w", k, err)
+		}
+		if n == 0 || n > uint64(r.Len()/sha256.Size) {
+			return fmt.Errorf("level %d has an invalid size %d", k, n)
+		}
+		levels[k] = make([][]byte, n)
+		for i := range levels[k] {
+			node := make([]byte, sha256.Size)
+			if _, err := r.Read(node); err != nil {
+				return fmt.Errorf("decode level %d: %w", k, err)
+			}
+			levels[k][i] = node
+		}
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%d trailing bytes after tree", r.Len())
+	}
+
+	for k := 0; k+1 < len(levels); k++ {
+		if want := (len(levels[k]) + 1) / 2; len(levels[k+1]) != want {
+			return fmt.Errorf("level %d has %d nodes, want %d", k+1, len(levels[k+1]), want)
+		}
+	}
+	if n := len(levels); n == 1 || (n > 1 && len(levels[n-1]) != 1) {
+		return fmt.Errorf("tree does not end in a single root")
+	}
+	t.levels = levels
+	return nil
+}
+
+// hashPair hashes the pair holding parent p's children in level, pairing an
+// odd last node with itself.
+func hashPair(level [][]byte, p int) []byte {
+	left := level[2*p]
+	right := left
+	if 2*p+1 < len(level) {
+		right = level[2*p+1]
+	}
+	h := sha256.New()
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
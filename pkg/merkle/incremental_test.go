@@ -0,0 +1,79 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestIncrementalTreeMatchesBuildTree(t *testing.T) {
+	mm := NewMerkleManager()
+	tree := NewIncrementalTree()
+	if tree.Root() != nil || tree.Len() != 0 {
+		t.Fatal("an empty tree should have no root")
+	}
+
+	var cids []string
+	for n := 1; n <= 33; n++ {
+		cid := fmt.Sprintf("chunk-%d", n)
+		cids = append(cids, cid)
+		tree.Append(cid)
+
+		built, err := mm.BuildTree(cids)
+		if err != nil {
+			t.Fatalf("BuildTree(%d) error = %v", n, err)
+		}
+		if !bytes.Equal(tree.Root(), GetRoot(built)) {
+			t.Fatalf("n=%d: incremental root %x, built root %x", n, tree.Root(), GetRoot(built))
+		}
+		for i, leaf := range cids {
+			proof, err := tree.Proof(i, leaf)
+			if err != nil {
+				t.Fatalf("n=%d: Proof(%d) error = %v", n, i, err)
+			}
+			if ok, err := VerifyInclusion(tree.Root(), proof); err != nil || !ok {
+				t.Fatalf("n=%d: proof for leaf %d = %v, %v", n, i, ok, err)
+			}
+		}
+	}
+
+	if _, err := tree.Proof(0, "chunk-2"); err == nil {
+		t.Fatal("expected an error for content that is not the leaf")
+	}
+	if _, err := tree.Proof(tree.Len(), "chunk-1"); err == nil {
+		t.Fatal("expected an error for an out of range leaf")
+	}
+}
+
+func TestIncrementalTreePersists(t *testing.T) {
+	tree := NewIncrementalTree("a", "b", "c", "d", "e")
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error = %v", err)
+	}
+
+	var loaded IncrementalTree
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() error = %v", err)
+	}
+	if loaded.Len() != 5 || !bytes.Equal(loaded.Root(), tree.Root()) {
+		t.Fatalf("loaded tree has %d leaves and root %x, want 5 and %x", loaded.Len(), loaded.Root(), tree.Root())
+	}
+
+	// A loaded tree keeps growing without a rebuild.
+	loaded.Append("f")
+	tree.Append("f")
+	if !bytes.Equal(loaded.Root(), tree.Root()) {
+		t.Fatalf("root after append %x, want %x", loaded.Root(), tree.Root())
+	}
+
+	for name, corrupt := range map[string][]byte{
+		"magic":     append([]byte("XXXX"), data[4:]...),
+		"truncated": data[:len(data)-1],
+		"trailing":  append(append([]byte{}, data...), 0),
+	} {
+		if err := new(IncrementalTree).UnmarshalBinary(corrupt); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
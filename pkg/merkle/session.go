@@ -0,0 +1,40 @@
+package merkle
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SessionLeaf is the tree content binding a recorded path (slash-separated)
+// to the CID of its version.
+func SessionLeaf(path, cid string) string {
+	return path + "\x00" + cid
+}
+
+// SessionLeaves returns the leaves for a set of file states (path -> CID),
+// ordered by path so the same state always yields the same root.
+func SessionLeaves(states map[string]string) []string {
+	paths := make([]string, 0, len(states))
+	for path := range states {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	leaves := make([]string, len(paths))
+	for i, path := range paths {
+		leaves[i] = SessionLeaf(path, states[path])
+	}
+	return leaves
+}
+
+// SessionRoot returns the Merkle root over a set of file states (path -> CID).
+func (m *MerkleManager) SessionRoot(states map[string]string) ([]byte, error) {
+	if len(states) == 0 {
+		return nil, fmt.Errorf("cannot compute a session root without files")
+	}
+	tree, err := m.BuildTree(SessionLeaves(states))
+	if err != nil {
+		return nil, err
+	}
+	return GetRoot(tree), nil
+}
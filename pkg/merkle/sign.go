@@ -0,0 +1,134 @@
+package merkle
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+)
+
+// Signature algorithms produced by SignRoot.
+const (
+	AlgorithmECDSAP256SHA256 = "ecdsa-p256-sha256"
+	AlgorithmEd25519         = "ed25519"
+)
+
+// Signature is a detached signature over a hex-encoded root. The signed
+// message is the lowercase hex string, so ECDSA signatures can be checked
+// with `cosign verify-blob --key <public key> --signature <value>` on a file
+// holding the root.
+type Signature struct {
+	Algorithm string `json:"algorithm"`
+	// Value is the base64 signature.
+	Value string `json:"value"`
+	// PublicKey is the PEM-encoded (PKIX) public key of the signer.
+	PublicKey string `json:"public_key"`
+}
+
+// ParseSigningKey parses a PEM-encoded, unencrypted PKCS#8 private key.
+// ECDSA P-256 (the key type cosign generates) and Ed25519 keys are supported.
+func ParseSigningKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("signing key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse signing key (expected unencrypted PKCS#8): %w", err)
+	}
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		if k.Curve.Params().Name != "P-256" {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s (want P-256)", k.Curve.Params().Name)
+		}
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+}
+
+// SignRoot signs root with a key accepted by ParseSigningKey.
+func SignRoot(root []byte, keyPEM []byte) (*Signature, error) {
+	return SignMessage([]byte(hex.EncodeToString(root)), keyPEM)
+}
+
+// SignMessage signs msg with a key accepted by ParseSigningKey: ECDSA keys
+// sign its SHA-256, Ed25519 keys msg itself.
+func SignMessage(msg []byte, keyPEM []byte) (*Signature, error) {
+	key, err := ParseSigningKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := &Signature{}
+	var raw []byte
+	var pub crypto.PublicKey
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(msg)
+		if raw, err = ecdsa.SignASN1(rand.Reader, k, digest[:]); err != nil {
+			return nil, fmt.Errorf("sign: %w", err)
+		}
+		sig.Algorithm, pub = AlgorithmECDSAP256SHA256, k.Public()
+	case ed25519.PrivateKey:
+		raw = ed25519.Sign(k, msg)
+		sig.Algorithm, pub = AlgorithmEd25519, k.Public()
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("encode public key: %w", err)
+	}
+	sig.Value = base64.StdEncoding.EncodeToString(raw)
+	sig.PublicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return sig, nil
+}
+
+// Verify checks the signature over root against pubPEM or, when pubPEM is
+// empty, against the embedded public key. Only a trusted pubPEM proves who
+// signed; the embedded key just proves the signature is intact.
+func (s *Signature) Verify(root []byte, pubPEM []byte) error {
+	return s.VerifyMessage([]byte(hex.EncodeToString(root)), pubPEM)
+}
+
+// VerifyMessage is Verify for a signature made by SignMessage.
+func (s *Signature) VerifyMessage(msg []byte, pubPEM []byte) error {
+	if len(pubPEM) == 0 {
+		pubPEM = []byte(s.PublicKey)
+	}
+	block, _ := pem.Decode(pubPEM)
+	if block == nil {
+		return fmt.Errorf("public key is not PEM encoded")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("parse public key: %w", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(s.Value)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(msg)
+		if !ecdsa.VerifyASN1(k, digest[:], raw) {
+			return fmt.Errorf("signature does not match")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, msg, raw) {
+			return fmt.Errorf("signature does not match")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package merkle
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func pkcs8PEM(t *testing.T, key any) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestSignRoot(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewMerkleManager().SessionRoot(map[string]string{"a.txt": "cid-a", "logs/b.log": "cid-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]any{AlgorithmECDSAP256SHA256: ecKey, AlgorithmEd25519: edKey} {
+		t.Run(name, func(t *testing.T) {
+			sig, err := SignRoot(root, pkcs8PEM(t, key))
+			if err != nil {
+				t.Fatalf("SignRoot() error = %v", err)
+			}
+			if sig.Algorithm != name {
+				t.Fatalf("algorithm = %s, want %s", sig.Algorithm, name)
+			}
+			if err := sig.Verify(root, nil); err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+
+			tampered := append([]byte(nil), root...)
+			tampered[0] ^= 0xff
+			if err := sig.Verify(tampered, nil); err == nil {
+				t.Fatal("signature should not verify a different root")
+			}
+		})
+	}
+}
+
+func TestParseSigningKeyRejectsOtherCurves(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseSigningKey(pkcs8PEM(t, key)); err == nil {
+		t.Fatal("expected P-384 key to be rejected")
+	}
+	if _, err := ParseSigningKey([]byte("not a key")); err == nil {
+		t.Fatal("expected non-PEM input to be rejected")
+	}
+}
+
+func TestSessionRootIsOrderIndependent(t *testing.T) {
+	mm := NewMerkleManager()
+	a, err := mm.SessionRoot(map[string]string{"x": "1", "y": "2", "z": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := mm.SessionRoot(map[string]string{"z": "3", "x": "1", "y": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytesEqual(a, b) {
+		t.Fatal("same states should give the same root")
+	}
+	c, err := mm.SessionRoot(map[string]string{"x": "1", "y": "2", "z": "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesEqual(a, c) {
+		t.Fatal("changing a version should change the root")
+	}
+}
@@ -1,21 +1,68 @@
 package merkle
 
 import (
+	"container/list"
 	"crypto/sha256"
 	"fmt"
+	"sync"
+
+	"github.com/saworbit/diffkeeper/internal/metrics"
 
 	"github.com/cbergoon/merkletree"
 )
 
-// MerkleManager manages Merkle trees for file integrity verification
+// DefaultTreeCacheSize bounds the number of trees a MerkleManager caches.
+const DefaultTreeCacheSize = 256
+
+// MerkleManager manages Merkle trees for file integrity verification. It is
+// safe for concurrent use; cached trees are evicted least recently used
+// first once the cache is full.
 type MerkleManager struct {
-	treeCache map[string]*merkletree.MerkleTree
+	mu        sync.Mutex
+	treeCache map[string]*list.Element
+	order     *list.List
+	capacity  int
+	stats     CacheStats
+}
+
+// cachedTree is the value held by an element of MerkleManager.order.
+type cachedTree struct {
+	key  string
+	tree *merkletree.MerkleTree
+}
+
+// CacheStats counts tree cache activity.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Size      int
+	Capacity  int
+}
+
+// HitRate returns the fraction of lookups answered from the cache.
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
 }
 
 // NewMerkleManager creates a new Merkle tree manager
 func NewMerkleManager() *MerkleManager {
+	return NewMerkleManagerWithCacheSize(DefaultTreeCacheSize)
+}
+
+// NewMerkleManagerWithCacheSize creates a manager caching at most size
+// trees. A size below 1 disables caching.
+func NewMerkleManagerWithCacheSize(size int) *MerkleManager {
+	if size < 0 {
+		size = 0
+	}
 	return &MerkleManager{
-		treeCache: make(map[string]*merkletree.MerkleTree),
+		treeCache: make(map[string]*list.Element),
+		order:     list.New(),
+		capacity:  size,
 	}
 }
 
@@ -106,24 +153,68 @@ func (m *MerkleManager) BuildAndCache(key string, cids []string) (*merkletree.Me
 		return nil, err
 	}
 
-	m.treeCache[key] = tree
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.capacity == 0 {
+		return tree, nil
+	}
+	if el, ok := m.treeCache[key]; ok {
+		el.Value.(*cachedTree).tree = tree
+		m.order.MoveToFront(el)
+		return tree, nil
+	}
+	m.treeCache[key] = m.order.PushFront(&cachedTree{key: key, tree: tree})
+	if m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.treeCache, oldest.Value.(*cachedTree).key)
+		m.stats.Evictions++
+	}
 	return tree, nil
 }
 
 // GetCachedTree retrieves a cached tree
 func (m *MerkleManager) GetCachedTree(key string) (*merkletree.MerkleTree, bool) {
-	tree, ok := m.treeCache[key]
-	return tree, ok
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.treeCache[key]
+	metrics.ObserveMerkleCache(ok)
+	if !ok {
+		m.stats.Misses++
+		return nil, false
+	}
+	m.stats.Hits++
+	m.order.MoveToFront(el)
+	return el.Value.(*cachedTree).tree, true
 }
 
 // ClearCache clears the tree cache
 func (m *MerkleManager) ClearCache() {
-	m.treeCache = make(map[string]*merkletree.MerkleTree)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.treeCache = make(map[string]*list.Element)
+	m.order.Init()
 }
 
 // RemoveFromCache removes a specific tree from cache
 func (m *MerkleManager) RemoveFromCache(key string) {
-	delete(m.treeCache, key)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.treeCache[key]; ok {
+		m.order.Remove(el)
+		delete(m.treeCache, key)
+	}
+}
+
+// CacheStats returns the tree cache counters.
+func (m *MerkleManager) CacheStats() CacheStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats
+	stats.Size = m.order.Len()
+	stats.Capacity = m.capacity
+	return stats
 }
 
 // FileIntegrity represents the integrity information for a file
@@ -178,8 +269,34 @@ func bytesEqual(a, b []byte) bool {
 	return true
 }
 
+// ProofVersion identifies the tree layout that roots and proofs are built
+// with. Version 1: a leaf hashes to SHA-256 of its content, an inner node to
+// SHA-256(left || right), and a level with an odd number of nodes pairs the
+// last node with itself. Roots and proofs stored without a version predate
+// versioning and use version 1.
+const ProofVersion = 1
+
+// Proof shows that a leaf is included in a tree with a given root.
+type Proof struct {
+	// Version is the ProofVersion the proof was generated with.
+	Version int
+	// Leaf is the proven tree content (a CID, or a SessionLeaf).
+	Leaf string
+	// Siblings are the sibling hashes from the leaf up to the root.
+	Siblings [][]byte
+	// Index has one entry per sibling: 1 when the sibling is the right
+	// child (the running hash goes on the left), 0 when it is the left child.
+	Index []int64
+}
+
+// SupportedVersion reports whether roots and proofs of version v can be
+// verified. Zero stands for the unversioned format, which is version 1.
+func SupportedVersion(v int) bool {
+	return v == 0 || v == ProofVersion
+}
+
 // GenerateProof generates a Merkle proof for a specific CID in the tree
-func (m *MerkleManager) GenerateProof(tree *merkletree.MerkleTree, cid string) ([][]byte, error) {
+func (m *MerkleManager) GenerateProof(tree *merkletree.MerkleTree, cid string) (*Proof, error) {
 	if tree == nil {
 		return nil, fmt.Errorf("cannot generate proof from nil tree")
 	}
@@ -189,39 +306,63 @@ func (m *MerkleManager) GenerateProof(tree *merkletree.MerkleTree, cid string) (
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate proof: %w", err)
 	}
+	if path == nil && indices == nil {
+		return nil, fmt.Errorf("content %q is not in the tree", cid)
+	}
 
-	// Combine path and indices into proof
-	// Note: This is a simplified version. In production, you might want to
-	// include more information like the indices
-	_ = indices // Currently unused but available for extended proof format
-	return path, nil
+	return &Proof{Version: ProofVersion, Leaf: cid, Siblings: path, Index: indices}, nil
 }
 
 // VerifyProof verifies a Merkle proof for a specific content
-func (m *MerkleManager) VerifyProof(tree *merkletree.MerkleTree, cid string, proof [][]byte) (bool, error) {
+func (m *MerkleManager) VerifyProof(tree *merkletree.MerkleTree, cid string, proof *Proof) (bool, error) {
 	if tree == nil {
 		return false, fmt.Errorf("cannot verify proof against nil tree")
 	}
+	if proof == nil || proof.Leaf != cid {
+		return false, nil
+	}
+	return VerifyInclusion(GetRoot(tree), proof)
+}
 
-	content := NewContent(cid)
+// VerifyInclusion checks a proof against a root without the tree, e.g. a
+// root stored with a recorded session.
+func VerifyInclusion(root []byte, proof *Proof) (bool, error) {
+	if proof == nil {
+		return false, fmt.Errorf("cannot verify nil proof")
+	}
+	if !SupportedVersion(proof.Version) {
+		return false, fmt.Errorf("unsupported proof version %d (this build verifies version %d)", proof.Version, ProofVersion)
+	}
+	if len(proof.Siblings) != len(proof.Index) {
+		return false, fmt.Errorf("proof has %d siblings but %d index entries", len(proof.Siblings), len(proof.Index))
+	}
+	if len(proof.Siblings) == 0 {
+		return false, fmt.Errorf("proof has no siblings")
+	}
 
-	// Calculate content hash
-	contentHash, err := content.CalculateHash()
+	currentHash, err := NewContent(proof.Leaf).CalculateHash()
 	if err != nil {
 		return false, fmt.Errorf("failed to calculate content hash: %w", err)
 	}
 
-	// Reconstruct root from proof
-	currentHash := contentHash
-	for _, proofElement := range proof {
+	// Reconstruct root from proof, keeping each pair in tree order
+	for i, sibling := range proof.Siblings {
+		if len(sibling) != sha256.Size {
+			return false, fmt.Errorf("sibling %d is %d bytes, want %d", i, len(sibling), sha256.Size)
+		}
+		if proof.Index[i] != 0 && proof.Index[i] != 1 {
+			return false, fmt.Errorf("index %d is %d, want 0 or 1", i, proof.Index[i])
+		}
 		h := sha256.New()
-		// Concatenate hashes (simplified - production version should handle ordering)
-		h.Write(currentHash)
-		h.Write(proofElement)
+		if proof.Index[i] == 1 {
+			h.Write(currentHash)
+			h.Write(sibling)
+		} else {
+			h.Write(sibling)
+			h.Write(currentHash)
+		}
 		currentHash = h.Sum(nil)
 	}
 
-	// Compare with tree root
-	treeRoot := GetRoot(tree)
-	return bytesEqual(currentHash, treeRoot), nil
+	return bytesEqual(currentHash, root), nil
 }
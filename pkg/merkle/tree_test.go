@@ -2,7 +2,9 @@ package merkle
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -404,3 +406,190 @@ func BenchmarkVerifyFileIntegrity(b *testing.B) {
 		}
 	}
 }
+
+// referenceRoot computes a version 1 root straight from the definition of
+// ProofVersion, independent of the tree library.
+func referenceRoot(leaves []string) []byte {
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		sum := sha256.Sum256([]byte(leaf))
+		level[i] = sum[:]
+	}
+	// A single leaf is paired with itself like any other odd level.
+	for {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			right := level[len(level)-1]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			sum := sha256.Sum256(append(append([]byte{}, level[i]...), right...))
+			next = append(next, sum[:])
+		}
+		if len(next) == 1 {
+			return next[0]
+		}
+		level = next
+	}
+}
+
+func TestProofRoundTrip(t *testing.T) {
+	mm := NewMerkleManager()
+	for n := 1; n <= 17; n++ {
+		cids := make([]string, n)
+		for i := range cids {
+			cids[i] = fmt.Sprintf("cid-%d", i)
+		}
+		tree, err := mm.BuildTree(cids)
+		if err != nil {
+			t.Fatalf("BuildTree(%d) error = %v", n, err)
+		}
+		root := GetRoot(tree)
+		if want := referenceRoot(cids); !bytes.Equal(root, want) {
+			t.Fatalf("n=%d: root %x does not follow version %d (want %x)", n, root, ProofVersion, want)
+		}
+
+		for _, cid := range cids {
+			proof, err := mm.GenerateProof(tree, cid)
+			if err != nil {
+				t.Fatalf("n=%d: GenerateProof(%s) error = %v", n, cid, err)
+			}
+			if proof.Version != ProofVersion {
+				t.Fatalf("n=%d: proof version = %d, want %d", n, proof.Version, ProofVersion)
+			}
+			if ok, err := VerifyInclusion(root, proof); err != nil || !ok {
+				t.Fatalf("n=%d: VerifyInclusion(%s) = %v, %v", n, cid, ok, err)
+			}
+			if ok, err := mm.VerifyProof(tree, cid, proof); err != nil || !ok {
+				t.Fatalf("n=%d: VerifyProof(%s) = %v, %v", n, cid, ok, err)
+			}
+
+			other := *proof
+			other.Leaf = "cid-missing"
+			if ok, _ := VerifyInclusion(root, &other); ok {
+				t.Fatalf("n=%d: proof for %s verified a different leaf", n, cid)
+			}
+			if n > 1 {
+				flipped := *proof
+				flipped.Index = append([]int64{}, proof.Index...)
+				// The top pair always differs; lower ones may be a node
+				// paired with itself.
+				flipped.Index[len(flipped.Index)-1] ^= 1
+				if ok, _ := VerifyInclusion(root, &flipped); ok {
+					t.Fatalf("n=%d: proof for %s verified with swapped order", n, cid)
+				}
+			}
+		}
+	}
+
+	tree, err := mm.BuildTree([]string{"a", "b"})
+	if err != nil {
+		t.Fatalf("BuildTree() error = %v", err)
+	}
+	if _, err := mm.GenerateProof(tree, "c"); err == nil {
+		t.Fatal("expected an error for content missing from the tree")
+	}
+}
+
+func TestVerifyInclusionVersions(t *testing.T) {
+	mm := NewMerkleManager()
+	tree, err := mm.BuildTree([]string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("BuildTree() error = %v", err)
+	}
+	proof, err := mm.GenerateProof(tree, "b")
+	if err != nil {
+		t.Fatalf("GenerateProof() error = %v", err)
+	}
+	root := GetRoot(tree)
+
+	// Roots sealed before versioning must stay verifiable.
+	if got, want := fmt.Sprintf("%x", root), "d31a37ef6ac14a2db1470c4316beb5592e6afd4465022339adafda76a18ffabe"; got != want {
+		t.Fatalf("version 1 root changed: got %s, want %s", got, want)
+	}
+	legacy := *proof
+	legacy.Version = 0
+	if ok, err := VerifyInclusion(root, &legacy); err != nil || !ok {
+		t.Fatalf("unversioned proof: VerifyInclusion() = %v, %v", ok, err)
+	}
+
+	future := *proof
+	future.Version = ProofVersion + 1
+	if _, err := VerifyInclusion(root, &future); err == nil {
+		t.Fatal("expected an error for an unsupported proof version")
+	}
+	short := *proof
+	short.Siblings = [][]byte{proof.Siblings[0][:8]}
+	short.Index = proof.Index[:1]
+	if _, err := VerifyInclusion(root, &short); err == nil {
+		t.Fatal("expected an error for a truncated sibling hash")
+	}
+}
+
+func TestTreeCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	mm := NewMerkleManagerWithCacheSize(2)
+	for _, key := range []string{"file1", "file2"} {
+		if _, err := mm.BuildAndCache(key, []string{key + "-cid"}); err != nil {
+			t.Fatalf("BuildAndCache(%s) error = %v", key, err)
+		}
+	}
+	// Touch file1 so file2 is the oldest.
+	if _, ok := mm.GetCachedTree("file1"); !ok {
+		t.Fatal("file1 should be cached")
+	}
+	if _, err := mm.BuildAndCache("file3", []string{"file3-cid"}); err != nil {
+		t.Fatalf("BuildAndCache(file3) error = %v", err)
+	}
+
+	if _, ok := mm.GetCachedTree("file2"); ok {
+		t.Error("file2 should have been evicted")
+	}
+	for _, key := range []string{"file1", "file3"} {
+		if _, ok := mm.GetCachedTree(key); !ok {
+			t.Errorf("%s should still be cached", key)
+		}
+	}
+
+	stats := mm.CacheStats()
+	if stats.Size != 2 || stats.Capacity != 2 || stats.Evictions != 1 {
+		t.Fatalf("unexpected cache stats %+v", stats)
+	}
+	if stats.Hits != 3 || stats.Misses != 1 || stats.HitRate() != 0.75 {
+		t.Fatalf("expected 3 hits and 1 miss, got %+v (rate %v)", stats, stats.HitRate())
+	}
+
+	disabled := NewMerkleManagerWithCacheSize(0)
+	if _, err := disabled.BuildAndCache("file1", []string{"cid"}); err != nil {
+		t.Fatalf("BuildAndCache() error = %v", err)
+	}
+	if _, ok := disabled.GetCachedTree("file1"); ok {
+		t.Error("a zero-sized cache should not keep trees")
+	}
+}
+
+func TestTreeCacheConcurrentAccess(t *testing.T) {
+	mm := NewMerkleManagerWithCacheSize(8)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("file-%d", (w+i)%16)
+				if _, err := mm.BuildAndCache(key, []string{key}); err != nil {
+					t.Errorf("BuildAndCache() error = %v", err)
+					return
+				}
+				mm.GetCachedTree(key)
+				if i%10 == 0 {
+					mm.RemoveFromCache(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if stats := mm.CacheStats(); stats.Size > 8 {
+		t.Fatalf("cache grew past its capacity: %+v", stats)
+	}
+}
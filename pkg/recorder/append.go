@@ -0,0 +1,89 @@
+package recorder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// maxAppendRun is how many versions in a row may be stored as appends.
+// The next one is stored through the chunker again, which bounds the
+// length of a version's object list; its chunks mostly dedupe against the
+// content already stored.
+const maxAppendRun = 64
+
+// appendsTo reports whether entry only appends to prev, the latest version
+// of its path: prev's content is a proper prefix of entry's. Log files grow
+// this way, and storing just the appended bytes keeps every version of them
+// from costing a full copy.
+func appendsTo(prev MetadataRecord, entry JournalEntry) bool {
+	if entry.Truncated != nil || entry.Observed != nil || entry.Patch != nil {
+		return false
+	}
+	if prev.Observed || prev.Truncated != nil || prev.Patched || prev.Size == 0 || prev.Size >= len(entry.Data) || prev.Timestamp >= entry.Timestamp {
+		return false
+	}
+	want, err := hex.DecodeString(prev.CID)
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(entry.Data[:prev.Size])
+	return bytes.Equal(sum[:], want)
+}
+
+// latestVersion reads the newest version recorded for path.
+func latestVersion(r pebble.Reader, path string) (MetadataRecord, bool, error) {
+	val, closer, err := r.Get(latestKey(path))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return MetadataRecord{}, false, nil
+	}
+	if err != nil {
+		return MetadataRecord{}, false, err
+	}
+	ts, perr := strconv.ParseInt(string(val), 10, 64)
+	closer.Close()
+	if perr != nil {
+		return MetadataRecord{}, false, nil
+	}
+
+	val, closer, err = r.Get(VersionKey(path, ts))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return MetadataRecord{}, false, nil
+	}
+	if err != nil {
+		return MetadataRecord{}, false, err
+	}
+	defer closer.Close()
+	var meta MetadataRecord
+	if json.Unmarshal(val, &meta) != nil {
+		return MetadataRecord{}, false, nil
+	}
+	return meta, true, nil
+}
+
+// objects returns the CAS objects meta's content is the concatenation of.
+func (meta MetadataRecord) objects() []string {
+	if len(meta.Chunks) > 0 {
+		return meta.Chunks
+	}
+	return []string{meta.CID}
+}
+
+// objectSizes returns the sizes of meta's objects, or nil when they are not
+// known, as for versions recorded before chunk sizes were.
+func (meta MetadataRecord) objectSizes() []int {
+	switch {
+	case meta.Observed:
+		return nil
+	case len(meta.Chunks) == 0:
+		return []int{meta.Size}
+	case len(meta.ChunkSizes) == len(meta.Chunks):
+		return meta.ChunkSizes
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/saworbit/diffkeeper/pkg/merkle"
+)
+
+func TestProcessorStoresAppendsAsSuffix(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+	opts := testChunkOptions()
+
+	first := processEntry(t, db, store, opts, JournalEntry{Timestamp: 1, Path: "build.log", Data: []byte("step 1\n")})
+	grown := []byte("step 1\nstep 2\n")
+	second := processEntry(t, db, store, opts, JournalEntry{Timestamp: 2, Path: "build.log", Data: grown})
+
+	if second.Appended != 1 || len(second.Chunks) != 2 || second.Chunks[0] != first.CID {
+		t.Fatalf("append = %+v, want the first version plus one suffix object", second)
+	}
+	suffix, err := store.Get(second.Chunks[1])
+	if err != nil {
+		t.Fatalf("Get(suffix) error = %v", err)
+	}
+	if string(suffix) != "step 2\n" {
+		t.Fatalf("suffix object = %q", suffix)
+	}
+	if second.CID != contentID(grown) || second.Size != len(grown) {
+		t.Fatalf("append identifies %s (%d bytes), want the full content", second.CID, second.Size)
+	}
+	got, err := ReadContent(store, second)
+	if err != nil {
+		t.Fatalf("ReadContent() error = %v", err)
+	}
+	if !bytes.Equal(got, grown) {
+		t.Fatalf("content = %q, want %q", got, grown)
+	}
+
+	rewritten := processEntry(t, db, store, opts, JournalEntry{Timestamp: 3, Path: "build.log", Data: []byte("step 0\nstep 1\nstep 2\n")})
+	if rewritten.Appended != 0 || len(rewritten.Chunks) != 0 {
+		t.Fatalf("rewrite = %+v, want whole content", rewritten)
+	}
+}
+
+func TestProcessorRechunksLongAppendRuns(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+	opts := testChunkOptions()
+
+	var data []byte
+	var meta MetadataRecord
+	for i := 0; i <= maxAppendRun+1; i++ {
+		data = append(data, fmt.Sprintf("line %d\n", i)...)
+		meta = processEntry(t, db, store, opts, JournalEntry{Timestamp: int64(i + 1), Path: "app.log", Data: data})
+		if i == maxAppendRun && meta.Appended != maxAppendRun {
+			t.Fatalf("version %d appended = %d, want %d", i, meta.Appended, maxAppendRun)
+		}
+	}
+	if meta.Appended != 0 || len(meta.Chunks) == 0 {
+		t.Fatalf("version after a full run = %+v, want it chunked again", meta)
+	}
+	got, err := ReadContent(store, meta)
+	if err != nil {
+		t.Fatalf("ReadContent() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("content mismatch after rechunking")
+	}
+}
+
+func TestProcessorExtendsChunkTreeOnAppend(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+	opts := testChunkOptions()
+
+	data := []byte("step 1\n")
+	meta := processEntry(t, db, store, opts, JournalEntry{Timestamp: 1, Path: "build.log", Data: data})
+	for i := 2; i <= 4; i++ {
+		data = append(data, fmt.Sprintf("step %d\n", i)...)
+		meta = processEntry(t, db, store, opts, JournalEntry{Timestamp: int64(i), Path: "build.log", Data: data})
+	}
+	if meta.Appended != 3 {
+		t.Fatalf("appended = %d, want 3", meta.Appended)
+	}
+
+	want := hex.EncodeToString(merkle.NewIncrementalTree(meta.Chunks...).Root())
+	if meta.ChunkRoot != want {
+		t.Fatalf("ChunkRoot = %s, want %s", meta.ChunkRoot, want)
+	}
+	tree, ok, err := loadChunkTree(db, "build.log")
+	if err != nil || !ok {
+		t.Fatalf("loadChunkTree() = %v, %v", ok, err)
+	}
+	if tree.Len() != len(meta.Chunks) || hex.EncodeToString(tree.Root()) != want {
+		t.Fatalf("persisted tree has %d leaves and root %x, want %d and %s", tree.Len(), tree.Root(), len(meta.Chunks), want)
+	}
+
+	// An older version arriving late must not replace the latest tree.
+	processEntry(t, db, store, opts, JournalEntry{Timestamp: 0, Path: "build.log", Data: []byte("unrelated content\n")})
+	if tree, _, _ := loadChunkTree(db, "build.log"); tree == nil || hex.EncodeToString(tree.Root()) != want {
+		t.Fatalf("late version replaced the latest chunk tree")
+	}
+}
@@ -0,0 +1,115 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+// Journal ops for directory and mode changes. They carry no content and are
+// stored as AttrRecords under cas.PrefixDir, apart from file versions.
+const (
+	OpMkdir = "mkdir"
+	OpRmdir = "rmdir"
+	OpChmod = "chmod"
+)
+
+// IsAttrOp reports whether op is a directory or mode change.
+func IsAttrOp(op string) bool {
+	return op == OpMkdir || op == OpRmdir || op == OpChmod
+}
+
+// AttrRecord is a directory or mode change: a directory created or removed,
+// or the permissions of a file or directory changed.
+type AttrRecord struct {
+	Path      string      `json:"path"`
+	Timestamp int64       `json:"ts"`
+	Op        string      `json:"op"`
+	Mode      fs.FileMode `json:"mode"`
+}
+
+// IsDir reports whether the record describes a directory.
+func (r AttrRecord) IsDir() bool {
+	return r.Mode.IsDir()
+}
+
+// processAttrEntry publishes a directory or mode change and retires its
+// journal entry.
+func processAttrEntry(db *pebble.DB, opts ProcessorOptions, logKey []byte, entry JournalEntry) error {
+	rec := AttrRecord{Path: entry.Path, Timestamp: entry.Timestamp, Op: entry.Op, Mode: entry.Mode}
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshal attribute record: %w", err)
+	}
+	key := attrKey(entry.Path, entry.Timestamp)
+
+	batch := db.NewBatch()
+	defer batch.Close()
+	if err := batch.Set(key, payload, nil); err != nil {
+		return fmt.Errorf("write attribute record: %w", err)
+	}
+	if err := batch.Delete(logKey, nil); err != nil {
+		return fmt.Errorf("delete journal key: %w", err)
+	}
+	writeOpts := pebble.Sync
+	if opts.NoSync {
+		writeOpts = pebble.NoSync
+	}
+	if err := batch.Commit(writeOpts); err != nil {
+		return fmt.Errorf("commit attribute record: %w", err)
+	}
+	if opts.OnStored != nil {
+		opts.OnStored(StoredEvent{Timestamp: rec.Timestamp, Op: rec.Op, Path: rec.Path})
+	}
+	return nil
+}
+
+// AttrHistory returns every directory and mode change recorded up to
+// target, oldest first.
+func AttrHistory(db *pebble.DB, target time.Time) ([]AttrRecord, error) {
+	iter, err := newPrefixIter(db, cas.PrefixDir)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	cutoff := target.UnixNano()
+	var history []AttrRecord
+	for iter.First(); iter.Valid(); iter.Next() {
+		var rec AttrRecord
+		if err := json.Unmarshal(iter.Value(), &rec); err != nil {
+			log.Printf("[recorder] skip corrupt attribute record %s: %v", iter.Key(), err)
+			continue
+		}
+		if rec.Timestamp > cutoff {
+			continue
+		}
+		history = append(history, rec)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Timestamp < history[j].Timestamp })
+	return history, nil
+}
+
+// AttrsAt returns the latest directory or mode change per path at target.
+// Directories whose latest record is OpRmdir no longer exist at target.
+func AttrsAt(db *pebble.DB, target time.Time) (map[string]AttrRecord, error) {
+	history, err := AttrHistory(db, target)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]AttrRecord, len(history))
+	for _, rec := range history {
+		attrs[rec.Path] = rec
+	}
+	return attrs, nil
+}
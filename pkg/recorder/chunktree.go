@@ -0,0 +1,114 @@
+package recorder
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/merkle"
+)
+
+// ChunkTreeKeyPrefix holds the encoded merkle.IncrementalTree over the
+// Chunks of each path's latest version, keyed by path. An appended version
+// extends it by its one new chunk instead of rehashing the whole list. Like
+// the rest of cas.PrefixState it is local, and it is rebuilt from Chunks
+// whenever it does not match the version's ChunkRoot.
+const ChunkTreeKeyPrefix = cas.PrefixState + "tree:"
+
+func chunkTreeKey(path string) []byte {
+	return []byte(ChunkTreeKeyPrefix + path)
+}
+
+// loadChunkTree reads the persisted chunk tree of path. A missing or
+// undecodable tree is reported as not found.
+func loadChunkTree(r pebble.Reader, path string) (*merkle.IncrementalTree, bool, error) {
+	val, closer, err := r.Get(chunkTreeKey(path))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer closer.Close()
+	tree := &merkle.IncrementalTree{}
+	if err := tree.UnmarshalBinary(val); err != nil {
+		log.Printf("[processor] rebuild chunk tree of %s: %v", path, err)
+		return nil, false, nil
+	}
+	return tree, true, nil
+}
+
+// chunkTree returns the tree over meta's Chunks. When meta appends one chunk
+// to base, base's persisted tree is extended if it still has base's root.
+func chunkTree(r pebble.Reader, base, meta MetadataRecord, appended bool) (*merkle.IncrementalTree, error) {
+	if appended && base.ChunkRoot != "" {
+		tree, ok, err := loadChunkTree(r, base.Path)
+		if err != nil {
+			return nil, err
+		}
+		if ok && tree.Len() == len(base.Chunks) && hex.EncodeToString(tree.Root()) == base.ChunkRoot {
+			tree.Append(meta.Chunks[len(meta.Chunks)-1])
+			return tree, nil
+		}
+	}
+	return merkle.NewIncrementalTree(meta.Chunks...), nil
+}
+
+// verifyChunkRoot checks that meta's Chunks hash to its ChunkRoot.
+func verifyChunkRoot(meta MetadataRecord) error {
+	if meta.ChunkRoot == "" {
+		return nil
+	}
+	if root := hex.EncodeToString(merkle.NewIncrementalTree(meta.Chunks...).Root()); root != meta.ChunkRoot {
+		return fmt.Errorf("chunks hash to %s, want %s", root, meta.ChunkRoot)
+	}
+	return nil
+}
+
+// pruneChunkTrees deletes the persisted chunk trees that no longer match
+// the ChunkRoot of their path's latest version, so the next append rebuilds
+// them instead of extending a stale tree.
+func pruneChunkTrees(db *pebble.DB) error {
+	iter, err := newPrefixIter(db, ChunkTreeKeyPrefix)
+	if err != nil {
+		return err
+	}
+
+	var stale [][]byte
+	for iter.First(); iter.Valid(); iter.Next() {
+		path := string(iter.Key()[len(ChunkTreeKeyPrefix):])
+		tree := &merkle.IncrementalTree{}
+		if err := tree.UnmarshalBinary(iter.Value()); err != nil {
+			log.Printf("[recover] drop chunk tree of %s: %v", path, err)
+			stale = append(stale, append([]byte(nil), iter.Key()...))
+			continue
+		}
+		latest, found, err := latestVersion(db, path)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		if !found || latest.ChunkRoot != hex.EncodeToString(tree.Root()) || tree.Len() != len(latest.Chunks) {
+			log.Printf("[recover] drop chunk tree of %s: it does not match the latest version", path)
+			stale = append(stale, append([]byte(nil), iter.Key()...))
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if len(stale) == 0 {
+		return nil
+	}
+	batch := db.NewBatch()
+	defer batch.Close()
+	for _, key := range stale {
+		if err := batch.Delete(key, nil); err != nil {
+			return err
+		}
+	}
+	return batch.Commit(pebble.Sync)
+}
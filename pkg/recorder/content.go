@@ -0,0 +1,349 @@
+package recorder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/saworbit/diffkeeper/internal/metrics"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/chunk"
+)
+
+// maxChunkBatchBytes bounds the chunk data staged for one CAS batch.
+const maxChunkBatchBytes = 64 << 20
+
+// storeUncompressed stores data as one CAS object without compressing it,
+// for content that is compressed already and would only cost the time.
+func storeUncompressed(store *cas.CASStore, data []byte) (string, int, error) {
+	raw, err := cas.UncompressedObject(data)
+	if err != nil {
+		return "", 0, fmt.Errorf("store CAS object: %w", err)
+	}
+	hash := sha256.Sum256(data)
+	res, err := store.PutBatch([]cas.Object{{Data: data, Hash: &hash, Compressed: raw}})
+	if err != nil {
+		return "", 0, fmt.Errorf("store CAS object: %w", err)
+	}
+	return res[0].CID, res[0].Written, nil
+}
+
+// storeChunked splits data with the content-defined chunker and stores the
+// chunks in CAS, returning the ordered chunk CIDs and sizes and the number
+// of chunks that were not stored yet. The leading and trailing runs of
+// objects data shares with prev, the previous version of its path, are
+// reused as they are, so only the region in between goes through the
+// chunker. While the chunker runs, a worker per core hashes each chunk and
+// compresses those not stored yet, and the chunks are committed in order,
+// in batches with one fsync each. Chunks shared with earlier versions,
+// other files, or previous sessions are deduplicated by CAS.
+func storeChunked(store *cas.CASStore, data []byte, params chunk.Params, prev MetadataRecord) (chunkedContent, error) {
+	head, tail := sharedRuns(data, prev)
+	headEnd, tailStart := runBytes(prev, head, tail, len(data))
+
+	workers := runtime.GOMAXPROCS(0)
+	work := make(chan *pendingChunk)
+	// ordered holds the chunks in payload order; its capacity bounds how
+	// far chunking runs ahead of the commits.
+	ordered := make(chan *pendingChunk, 4*workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for c := range work {
+				c.prepare(store)
+			}
+		}()
+	}
+	committed := make(chan chunkCommit, 1)
+	go func() {
+		committed <- commitChunks(store, ordered)
+	}()
+	send := func(p *pendingChunk) {
+		ordered <- p
+		work <- p
+	}
+
+	objects, sizes := prev.objects(), prev.objectSizes()
+	off := 0
+	for i := 0; i < head; i++ {
+		send(reusedChunk(data[off:off+sizes[i]], objects[i]))
+		off += sizes[i]
+	}
+	var chunkErr error
+	chunker := chunk.NewRabinChunker(bytes.NewReader(data[headEnd:tailStart]), params)
+	chunker.DeferHashing()
+	for {
+		c, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			chunkErr = fmt.Errorf("chunk payload: %w", err)
+			break
+		}
+		send(&pendingChunk{data: c.Data, done: make(chan struct{})})
+	}
+	if chunkErr == nil {
+		off = tailStart
+		for i := len(objects) - tail; i < len(objects); i++ {
+			send(reusedChunk(data[off:off+sizes[i]], objects[i]))
+			off += sizes[i]
+		}
+	}
+	close(work)
+	close(ordered)
+
+	res := <-committed
+	if chunkErr != nil {
+		return chunkedContent{}, chunkErr
+	}
+	if res.err != nil {
+		return chunkedContent{}, res.err
+	}
+	return res.chunkedContent, nil
+}
+
+// sharedRuns returns how many of prev's objects, from the front and from
+// the back, data holds unchanged at the same offsets from its start and
+// end. Each is checked by hashing the bytes of data where it would be, so
+// a small change to a large file costs a hash of the unchanged regions
+// instead of chunking the whole file again. The runs never overlap.
+func sharedRuns(data []byte, prev MetadataRecord) (head, tail int) {
+	objects, sizes := prev.objects(), prev.objectSizes()
+	if sizes == nil || prev.Appended > 0 {
+		// An appended version's suffix objects are left to the chunker,
+		// which is what keeps runs of appends from growing chunk lists.
+		return 0, 0
+	}
+	start := 0
+	for head < len(objects) && start+sizes[head] <= len(data) && holdsObject(data[start:start+sizes[head]], objects[head]) {
+		start += sizes[head]
+		head++
+	}
+	end := len(data)
+	for i := len(objects) - 1; i >= head && end-sizes[i] >= start && holdsObject(data[end-sizes[i]:end], objects[i]); i-- {
+		end -= sizes[i]
+		tail++
+	}
+	return head, tail
+}
+
+// runBytes returns where the leading run of head objects of prev ends, and
+// the trailing run of tail objects starts, in a payload of n bytes.
+func runBytes(prev MetadataRecord, head, tail, n int) (int, int) {
+	sizes := prev.objectSizes()
+	headEnd, tailStart := 0, n
+	for i := 0; i < head; i++ {
+		headEnd += sizes[i]
+	}
+	for i := len(sizes) - tail; i < len(sizes); i++ {
+		tailStart -= sizes[i]
+	}
+	return headEnd, tailStart
+}
+
+// holdsObject reports whether data is the chunk object cid.
+func holdsObject(data []byte, cid string) bool {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) == cid
+}
+
+// chunkedContent is how storeChunked stored a payload.
+type chunkedContent struct {
+	cids  []string
+	sizes []int
+	fresh int
+}
+
+// pendingChunk is one chunk on its way from the chunker to CAS.
+type pendingChunk struct {
+	data       []byte
+	hash       [32]byte
+	hashed     bool
+	compressed []byte
+	err        error
+	done       chan struct{}
+}
+
+// reusedChunk returns data, which is known to be the object cid of a
+// previous version, ready to be committed without hashing it again.
+func reusedChunk(data []byte, cid string) *pendingChunk {
+	c := &pendingChunk{data: data, hashed: true, done: make(chan struct{})}
+	hex.Decode(c.hash[:], []byte(cid))
+	return c
+}
+
+// prepare hashes the chunk and, unless CAS already holds it, compresses it.
+// A reused chunk is still checked for in CAS, as it may have been removed
+// since the previous version was recorded.
+func (c *pendingChunk) prepare(store *cas.CASStore) {
+	defer close(c.done)
+	if !c.hashed {
+		c.hash = sha256.Sum256(c.data)
+	}
+	stored, err := store.Has(hex.EncodeToString(c.hash[:]))
+	if err != nil {
+		c.err = err
+		return
+	}
+	if !stored {
+		c.compressed, c.err = cas.CompressObject(c.data)
+	}
+}
+
+// chunkCommit is what commitChunks stored.
+type chunkCommit struct {
+	chunkedContent
+	err error
+}
+
+// commitChunks stores the chunks received from ordered, in order, once each
+// is prepared. After an error it keeps draining ordered without storing.
+func commitChunks(store *cas.CASStore, ordered <-chan *pendingChunk) chunkCommit {
+	var res chunkCommit
+	var batch []cas.Object
+	var batchBytes int
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		results, err := store.PutBatch(batch)
+		if err != nil {
+			return fmt.Errorf("store chunks %d-%d: %w", len(res.cids), len(res.cids)+len(batch)-1, err)
+		}
+		for i, r := range results {
+			res.sizes = append(res.sizes, len(batch[i].Data))
+			if r.Written == 0 {
+				metrics.ObserveChunk("reuse")
+			} else {
+				metrics.ObserveChunk("new")
+				res.fresh++
+			}
+			res.cids = append(res.cids, r.CID)
+		}
+		batch, batchBytes = batch[:0], 0
+		return nil
+	}
+
+	for c := range ordered {
+		<-c.done
+		if res.err != nil {
+			continue
+		}
+		if c.err != nil {
+			res.err = fmt.Errorf("prepare chunk %d: %w", len(res.cids)+len(batch), c.err)
+			continue
+		}
+		batch = append(batch, cas.Object{Data: c.data, Hash: &c.hash, Compressed: c.compressed})
+		if batchBytes += len(c.data); batchBytes >= maxChunkBatchBytes {
+			res.err = flush()
+		}
+	}
+	if res.err == nil {
+		res.err = flush()
+	}
+	return res
+}
+
+// contentID returns the identifier recorded for a payload's full contents.
+func contentID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ErrNotStored is returned for versions recorded in observe-only mode.
+var ErrNotStored = errors.New("content not stored (recorded with --observe)")
+
+// ReadContent reconstructs the file contents referenced by a metadata record,
+// reassembling chunked payloads when a manifest is present.
+func ReadContent(store *cas.CASStore, meta MetadataRecord) ([]byte, error) {
+	if store == nil {
+		return nil, fmt.Errorf("CAS store is not initialized")
+	}
+	if meta.Observed {
+		return nil, ErrNotStored
+	}
+	if len(meta.Chunks) == 0 {
+		return store.Get(meta.CID)
+	}
+
+	buf := make([]byte, 0, meta.Size)
+	for i, cid := range meta.Chunks {
+		data, err := store.Get(cid)
+		if err != nil {
+			return nil, fmt.Errorf("load chunk %d of %s: %w", i, meta.Path, err)
+		}
+		buf = append(buf, data...)
+	}
+
+	if len(buf) != meta.Size {
+		return nil, fmt.Errorf("reassembled %s is %d bytes, expected %d", meta.Path, len(buf), meta.Size)
+	}
+	return buf, nil
+}
+
+// OpenContent streams a recorded file version, opening chunks one at a time
+// so large files are never fully held in memory. The caller must Close it.
+func OpenContent(store *cas.CASStore, meta MetadataRecord) (io.ReadCloser, error) {
+	if store == nil {
+		return nil, fmt.Errorf("CAS store is not initialized")
+	}
+	if meta.Observed {
+		return nil, ErrNotStored
+	}
+	if len(meta.Chunks) == 0 {
+		return store.GetReader(meta.CID)
+	}
+	return &chunkReader{store: store, meta: meta}, nil
+}
+
+// chunkReader concatenates a record's chunks, opening the next on EOF.
+type chunkReader struct {
+	store *cas.CASStore
+	meta  MetadataRecord
+	next  int
+	cur   io.ReadCloser
+	read  int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.next == len(r.meta.Chunks) {
+				if r.read != r.meta.Size {
+					return 0, fmt.Errorf("reassembled %s is %d bytes, expected %d", r.meta.Path, r.read, r.meta.Size)
+				}
+				return 0, io.EOF
+			}
+			rc, err := r.store.GetReader(r.meta.Chunks[r.next])
+			if err != nil {
+				return 0, fmt.Errorf("load chunk %d of %s: %w", r.next, r.meta.Path, err)
+			}
+			r.cur = rc
+			r.next++
+		}
+
+		n, err := r.cur.Read(p)
+		r.read += n
+		if errors.Is(err, io.EOF) {
+			r.cur.Close()
+			r.cur = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
@@ -0,0 +1,91 @@
+package recorder
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/saworbit/diffkeeper/internal/metrics"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+// ContentCache keeps the content of recently read file versions, so reading
+// the same version again does not load and decompress its objects again.
+// Versions are keyed by path and timestamp; they never change once
+// recorded. The least recently read are evicted once the cached content
+// exceeds maxBytes, and a version larger than maxBytes is never cached.
+// A nil *ContentCache reads through. It is safe for concurrent use.
+type ContentCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	entries  map[contentKey]*list.Element
+	order    *list.List
+}
+
+type contentKey struct {
+	path string
+	ts   int64
+}
+
+type cachedContent struct {
+	key  contentKey
+	data []byte
+}
+
+// NewContentCache returns a cache holding up to maxBytes of content, or nil
+// when maxBytes is 0 or less.
+func NewContentCache(maxBytes int64) *ContentCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &ContentCache{maxBytes: maxBytes, entries: make(map[contentKey]*list.Element), order: list.New()}
+}
+
+// Read returns the content of meta like ReadContent, from the cache when it
+// holds it. The returned slice is shared and must not be modified.
+func (c *ContentCache) Read(store *cas.CASStore, meta MetadataRecord) ([]byte, error) {
+	if c == nil || meta.Observed {
+		return ReadContent(store, meta)
+	}
+	key := contentKey{path: meta.Path, ts: meta.Timestamp}
+
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.order.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	metrics.ObserveContentCache(ok)
+	if ok {
+		return el.Value.(*cachedContent).data, nil
+	}
+
+	data, err := ReadContent(store, meta)
+	if err != nil {
+		return nil, err
+	}
+	c.add(key, data)
+	return data, nil
+}
+
+// add caches data under key, evicting the least recently read versions.
+func (c *ContentCache) add(key contentKey, data []byte) {
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cachedContent{key: key, data: data})
+	c.size += size
+	for c.size > c.maxBytes {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*cachedContent)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.data))
+	}
+}
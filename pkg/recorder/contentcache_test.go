@@ -0,0 +1,54 @@
+package recorder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContentCacheEvictsLeastRecentlyRead(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	now := time.Unix(1_000_000, 0)
+	opts := DefaultProcessorOptions()
+	a := processEntry(t, db, store, opts, JournalEntry{Timestamp: now.UnixNano(), Path: "a.txt", Op: "write", Data: []byte("aaaa")})
+	b := processEntry(t, db, store, opts, JournalEntry{Timestamp: now.UnixNano(), Path: "b.txt", Op: "write", Data: []byte("bbbb")})
+	c := processEntry(t, db, store, opts, JournalEntry{Timestamp: now.UnixNano(), Path: "c.txt", Op: "write", Data: []byte("cccc")})
+	big := processEntry(t, db, store, opts, JournalEntry{Timestamp: now.UnixNano(), Path: "big.bin", Op: "write", Data: []byte("0123456789")})
+
+	cache := NewContentCache(8)
+	read := func(meta MetadataRecord) string {
+		t.Helper()
+		data, err := cache.Read(store, meta)
+		if err != nil {
+			t.Fatalf("Read(%s) error = %v", meta.Path, err)
+		}
+		return string(data)
+	}
+	read(a)
+	read(b)
+	read(a) // a is now the most recently read
+	read(c) // evicts b
+	read(big)
+
+	if _, ok := cache.entries[contentKey{path: "a.txt", ts: a.Timestamp}]; !ok {
+		t.Error("recently read a.txt was evicted")
+	}
+	if _, ok := cache.entries[contentKey{path: "b.txt", ts: b.Timestamp}]; ok {
+		t.Error("least recently read b.txt should be evicted")
+	}
+	if _, ok := cache.entries[contentKey{path: "big.bin", ts: big.Timestamp}]; ok {
+		t.Error("a version larger than the cache should not be cached")
+	}
+	if cache.size != 8 {
+		t.Errorf("cached %d bytes, want 8", cache.size)
+	}
+
+	if got := read(c); got != "cccc" {
+		t.Fatalf("cached c.txt = %q", got)
+	}
+	var none *ContentCache
+	if data, err := none.Read(store, big); err != nil || string(data) != "0123456789" {
+		t.Fatalf("nil cache should read through, got %q %v", data, err)
+	}
+}
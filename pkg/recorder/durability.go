@@ -0,0 +1,57 @@
+package recorder
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+// ApplyDurability configures the journal, store and processor writes for a
+// durability level (config.DurabilityStrict, DurabilityBatched or
+// DurabilityRelaxed). Unless the level is strict, StartSyncer must run so
+// unsynced writes reach disk.
+func ApplyDurability(level string, journal *Journal, store *cas.CASStore, opts *ProcessorOptions) {
+	journal.SetSync(level == config.DurabilityStrict)
+	store.SetSync(level != config.DurabilityRelaxed)
+	opts.NoSync = level == config.DurabilityRelaxed
+}
+
+// StartSyncer syncs the Pebble WAL every interval, bounding how much
+// unsynced work a crash can lose. The returned function stops it after a
+// final sync.
+func StartSyncer(db *pebble.DB, interval time.Duration) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := syncWAL(db); err != nil {
+					log.Printf("[durability] WAL sync failed: %v", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		if err := syncWAL(db); err != nil {
+			log.Printf("[durability] final WAL sync failed: %v", err)
+		}
+	}
+}
+
+// syncWAL makes every write committed so far durable. A synced LogData
+// record waits for the WAL, including earlier unsynced entries, to be synced.
+func syncWAL(db *pebble.DB) error {
+	return db.LogData(nil, pebble.Sync)
+}
@@ -0,0 +1,61 @@
+package recorder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+func TestRelaxedDurabilityStoresCaptures(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	journal := NewJournal(db)
+	opts := testChunkOptions()
+	ApplyDurability(config.DurabilityRelaxed, journal, store, &opts)
+	if !opts.NoSync {
+		t.Fatalf("relaxed durability should not sync metadata")
+	}
+
+	stopProcessor := StartProcessorWithOptions(db, store, opts)
+	defer stopProcessor()
+	stopSyncer := StartSyncer(db, 10*time.Millisecond)
+
+	if err := journal.LogEvent("state.json", []byte(`{"ok":true}`)); err != nil {
+		t.Fatalf("LogEvent() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitIdle(ctx, db); err != nil {
+		t.Fatalf("WaitIdle() error = %v", err)
+	}
+	stopSyncer()
+
+	records, err := StateAt(db, time.Now())
+	if err != nil {
+		t.Fatalf("StateAt() error = %v", err)
+	}
+	data, err := ReadContent(store, records["state.json"])
+	if err != nil {
+		t.Fatalf("ReadContent() error = %v", err)
+	}
+	if string(data) != `{"ok":true}` {
+		t.Fatalf("content = %q", data)
+	}
+}
+
+func TestApplyDurabilityLevels(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	for _, level := range []string{config.DurabilityStrict, config.DurabilityBatched} {
+		opts := DefaultProcessorOptions()
+		opts.NoSync = true
+		ApplyDurability(level, NewJournal(db), store, &opts)
+		if opts.NoSync {
+			t.Fatalf("%s durability should sync metadata", level)
+		}
+	}
+}
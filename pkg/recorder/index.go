@@ -0,0 +1,214 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+// LatestKeyPrefix indexes the newest version of every path: the key is the
+// prefix plus the path, the value that version's timestamp. Together with
+// the per-path ordering of VersionKey it lets StateAt seek straight to each
+// path's version at a point in time. Like the rest of cas.PrefixState it is
+// rebuilt locally rather than synced.
+const LatestKeyPrefix = cas.PrefixState + "latest:"
+
+// indexedSchemaVersion is the first schema version that maintains the
+// latest-version index.
+const indexedSchemaVersion = 3
+
+func latestKey(path string) []byte {
+	return []byte(LatestKeyPrefix + path)
+}
+
+// advanceLatest points path's index entry at ts in batch unless it already
+// points at a newer version.
+func advanceLatest(r pebble.Reader, batch *pebble.Batch, path string, ts int64) error {
+	val, closer, err := r.Get(latestKey(path))
+	switch {
+	case errors.Is(err, pebble.ErrNotFound):
+	case err != nil:
+		return err
+	default:
+		prev, perr := strconv.ParseInt(string(val), 10, 64)
+		closer.Close()
+		if perr == nil && prev >= ts {
+			return nil
+		}
+	}
+	return batch.Set(latestKey(path), []byte(strconv.FormatInt(ts, 10)), nil)
+}
+
+// indexLatestVersions rebuilds the latest-version index from the version
+// records and returns the number of index entries it changed.
+func indexLatestVersions(batch *pebble.Batch) (int, error) {
+	latest := make(map[string]int64)
+	iter, err := batch.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(cas.PrefixMeta),
+		UpperBound: append([]byte(cas.PrefixMeta), 0xff),
+	})
+	if err != nil {
+		return 0, err
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		var meta MetadataRecord
+		if json.Unmarshal(iter.Value(), &meta) != nil || meta.Path == "" || meta.CID == "" {
+			continue
+		}
+		if prev, ok := latest[meta.Path]; !ok || meta.Timestamp > prev {
+			latest[meta.Path] = meta.Timestamp
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return 0, fmt.Errorf("scan versions: %w", err)
+	}
+
+	changed := 0
+	iter, err = batch.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(LatestKeyPrefix),
+		UpperBound: append([]byte(LatestKeyPrefix), 0xff),
+	})
+	if err != nil {
+		return 0, err
+	}
+	var stale [][]byte
+	indexed := make(map[string]bool)
+	for iter.First(); iter.Valid(); iter.Next() {
+		path := string(iter.Key()[len(LatestKeyPrefix):])
+		ts, ok := latest[path]
+		if !ok {
+			stale = append(stale, append([]byte(nil), iter.Key()...))
+			continue
+		}
+		if string(iter.Value()) == strconv.FormatInt(ts, 10) {
+			indexed[path] = true
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return 0, fmt.Errorf("scan index: %w", err)
+	}
+
+	for _, key := range stale {
+		if err := batch.Delete(key, nil); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+	for path, ts := range latest {
+		if indexed[path] {
+			continue
+		}
+		if err := batch.Set(latestKey(path), []byte(strconv.FormatInt(ts, 10)), nil); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// StateAt returns the newest version of every path recorded at or before
+// target.
+func StateAt(db *pebble.DB, target time.Time) (map[string]MetadataRecord, error) {
+	version, err := StoredSchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version < indexedSchemaVersion {
+		// Not migrated yet (e.g. opened read-only by an export).
+		return scanStateAt(db, target)
+	}
+
+	index, err := newPrefixIter(db, LatestKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+	versions, err := newPrefixIter(db, cas.PrefixMeta)
+	if err != nil {
+		return nil, err
+	}
+	defer versions.Close()
+
+	records := make(map[string]MetadataRecord)
+	cutoff := target.UnixNano()
+
+	for index.First(); index.Valid(); index.Next() {
+		path := string(index.Key()[len(LatestKeyPrefix):])
+		bound, err := strconv.ParseInt(string(index.Value()), 10, 64)
+		if err != nil {
+			log.Printf("[recorder] skip corrupt index entry for %s: %v", path, err)
+			continue
+		}
+		if bound > cutoff {
+			bound = cutoff
+		}
+
+		// The newest version at or before bound sorts just below the key of
+		// bound+1. Seeking also copes with an index entry whose version has
+		// since been dropped by recovery.
+		if !versions.SeekLT(VersionKey(path, bound+1)) || !bytes.HasPrefix(versions.Key(), VersionKeyPrefix(path)) {
+			continue
+		}
+		var meta MetadataRecord
+		if err := json.Unmarshal(versions.Value(), &meta); err != nil {
+			log.Printf("[recorder] skip corrupt metadata %s: %v", versions.Key(), err)
+			continue
+		}
+		records[path] = meta
+	}
+
+	if err := index.Error(); err != nil {
+		return nil, err
+	}
+	if err := versions.Error(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// scanStateAt is StateAt for state dirs without the latest-version index:
+// it reads every version of every path.
+func scanStateAt(db *pebble.DB, target time.Time) (map[string]MetadataRecord, error) {
+	iter, err := newPrefixIter(db, cas.PrefixMeta)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	records := make(map[string]MetadataRecord)
+	cutoff := target.UnixNano()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		if IsSessionKey(key) {
+			continue
+		}
+
+		var meta MetadataRecord
+		if err := json.Unmarshal(iter.Value(), &meta); err != nil {
+			log.Printf("[recorder] skip corrupt metadata %s: %v", key, err)
+			continue
+		}
+
+		if meta.Timestamp > cutoff {
+			continue
+		}
+
+		if prev, ok := records[meta.Path]; !ok || meta.Timestamp > prev.Timestamp {
+			records[meta.Path] = meta
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
@@ -0,0 +1,75 @@
+package recorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func TestStateAtSeeksLatestVersionIndex(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultProcessorOptions()
+	for _, e := range []JournalEntry{
+		{Path: "a.txt", Timestamp: 10, Data: []byte("a1")},
+		{Path: "a.txt", Timestamp: 30, Data: []byte("a3")},
+		{Path: "a.txt", Timestamp: 20, Data: []byte("a2")},
+		{Path: "a.txt:b", Timestamp: 5, Data: []byte("ab")},
+		{Path: "b.txt", Timestamp: 25, Data: []byte("b1")},
+	} {
+		processEntry(t, db, store, opts, e)
+	}
+
+	want := map[int64]map[string]int64{
+		4:  {},
+		10: {"a.txt": 10, "a.txt:b": 5},
+		24: {"a.txt": 20, "a.txt:b": 5},
+		25: {"a.txt": 20, "a.txt:b": 5, "b.txt": 25},
+		99: {"a.txt": 30, "a.txt:b": 5, "b.txt": 25},
+	}
+	check := func(label string) {
+		t.Helper()
+		for at, paths := range want {
+			state, err := StateAt(db, time.Unix(0, at))
+			if err != nil {
+				t.Fatalf("%s: StateAt(%d) error = %v", label, at, err)
+			}
+			if len(state) != len(paths) {
+				t.Fatalf("%s: StateAt(%d) = %+v, want %v", label, at, state, paths)
+			}
+			for path, ts := range paths {
+				if state[path].Timestamp != ts {
+					t.Fatalf("%s: StateAt(%d)[%s] = %+v, want ts %d", label, at, path, state[path], ts)
+				}
+			}
+		}
+	}
+	check("indexed")
+
+	// Versions removed by recovery leave their index entry behind.
+	if err := db.Delete(VersionKey("a.txt", 30), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	want[99]["a.txt"] = 20
+	check("stale index")
+
+	// Records copied in by a pull have no index entry until re-migrated.
+	if err := db.Delete(latestKey("b.txt"), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := MigrateImported(db); err != nil || changed != 2 {
+		t.Fatalf("MigrateImported() = %d, %v; want 2 index entries rebuilt", changed, err)
+	}
+	check("rebuilt")
+
+	// Unmigrated state dirs fall back to a full scan.
+	if err := db.Set([]byte(SchemaKey), []byte("2"), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	check("scan")
+}
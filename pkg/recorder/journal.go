@@ -5,6 +5,10 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/pebble"
@@ -17,66 +21,343 @@ type JournalEntry struct {
 	Path      string `json:"path"`
 	Op        string `json:"op"`   // "write", "create", etc.
 	Data      []byte `json:"data"` // The raw content written
+	// Mode is the file mode (including fs.ModeDir) for attribute ops.
+	Mode fs.FileMode `json:"mode,omitempty"`
+	// Truncated is set when Data holds only the head and tail of the file.
+	Truncated *Truncation `json:"truncated,omitempty"`
+	// Observed is set, and Data empty, when only the file's size and hash
+	// were captured.
+	Observed *Observation `json:"observed,omitempty"`
+	// Patch is set when Data holds only the byte ranges written since the
+	// previous capture of the path, one after another.
+	Patch *Patch `json:"patch,omitempty"`
 }
 
+// Truncation marks a capture of a file above the capture size limit. Only
+// its first Head and last Tail bytes are stored, in that order; Size and
+// SHA256 describe the whole file.
+type Truncation struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Head   int    `json:"head"`
+	Tail   int    `json:"tail"`
+}
+
+// Observation describes a file captured in observe-only mode, whose content
+// is not stored.
+type Observation struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Patch describes a capture of only the byte ranges of a file written since
+// its previous capture, which was BaseSize bytes. The file is now Size
+// bytes: the previous content, cut or zero-extended to Size, with each
+// range overwritten.
+type Patch struct {
+	Size     int64        `json:"size"`
+	BaseSize int64        `json:"base_size"`
+	Ranges   []PatchRange `json:"ranges"`
+}
+
+// PatchRange is one written byte range of a Patch.
+type PatchRange struct {
+	Offset int64 `json:"offset"`
+	Length int   `json:"length"`
+}
+
+// OpBaseline is the op of a version backfilled from a later capture: the
+// content a file had when recording started.
+const OpBaseline = "baseline"
+
+// DefaultBatchWindow is how long a batching journal holds an event for
+// others to share its commit.
+const DefaultBatchWindow = 5 * time.Millisecond
+
+// maxBatchBytes commits a batch early once it holds this much, so a burst
+// of large captures is not held in memory for the whole window.
+const maxBatchBytes = 4 << 20
+
+// Journal keys lead with a priority class, so the processor, reading in
+// key order, stores captures of critical paths first, then small captures,
+// then large ones. Within a class, entries are in time order.
+const (
+	classCritical = "0"
+	classSmall    = "1"
+	classLarge    = "2"
+)
+
+// smallEntryBytes is the most content an entry of classSmall holds.
+const smallEntryBytes = 64 << 10
+
 // Journal appends raw events to Pebble using a time-ordered prefix.
 type Journal struct {
-	db *pebble.DB
+	db        *pebble.DB
+	writeOpts *pebble.WriteOptions
+	namespace string
+	critical  func(path string) bool
+
+	// sink, when set, receives every entry instead of the store.
+	sink func(JournalEntry) error
+
+	// captured sums the content of every entry appended.
+	captured atomic.Int64
+
+	// window > 0 groups unsynced appends into one batch per window.
+	window time.Duration
+	mu     sync.Mutex
+	batch  *pebble.Batch
+	timer  *time.Timer
+	// err is the failure of a batch committed in the background, reported
+	// by the next append or Flush.
+	err error
 }
 
 // NewJournal creates a journal writer bound to the provided Pebble instance.
+// Appends do not wait for an fsync unless SetSync(true) is called, and each
+// commits on its own unless SetBatchWindow is called.
 func NewJournal(db *pebble.DB) *Journal {
-	return &Journal{db: db}
+	return &Journal{db: db, writeOpts: pebble.NoSync}
+}
+
+// SetSync controls whether each append waits for an fsync. Synced appends
+// are never batched.
+func (j *Journal) SetSync(sync bool) {
+	j.writeOpts = pebble.NoSync
+	if sync {
+		j.writeOpts = pebble.Sync
+	}
+}
+
+// SetBatchWindow groups unsynced appends made within window of each other
+// into one Pebble batch, instead of committing a batch per event. Batched
+// events reach the store, and the processor, up to window late; call Flush
+// before waiting for the journal to drain. 0 turns batching off.
+func (j *Journal) SetBatchWindow(window time.Duration) {
+	j.window = window
+}
+
+// SetCritical makes captures of paths for which critical returns true go
+// ahead of any backlog of other captures. It must be called before the
+// first append.
+func (j *Journal) SetCritical(critical func(path string) bool) {
+	j.critical = critical
+}
+
+// SetSink forwards every following entry to sink instead of the store, as
+// an agent streaming its captures to a collector does. A journal with a
+// sink needs no store; NewJournal may be given nil.
+func (j *Journal) SetSink(sink func(JournalEntry) error) {
+	j.sink = sink
+}
+
+// Append journals an entry captured elsewhere, such as by an agent,
+// keeping its path and timestamp.
+func (j *Journal) Append(entry JournalEntry) error {
+	return j.append(entry)
+}
+
+// SetNamespace records every following event in namespace ns.
+func (j *Journal) SetNamespace(ns string) {
+	j.namespace = ns
 }
 
 // LogEvent writes a journal entry with a default "write" operation.
 func (j *Journal) LogEvent(path string, data []byte) error {
-	return logEventWithOp(j.db, "write", path, data)
+	return j.append(JournalEntry{Path: NamespacePath(j.namespace, path), Op: "write", Data: data})
+}
+
+// LogEventAt writes a "write" entry for content path had at a known time,
+// such as versions imported from another store.
+func (j *Journal) LogEventAt(path string, data []byte, at time.Time) error {
+	return j.append(JournalEntry{Timestamp: at.UnixNano(), Path: NamespacePath(j.namespace, path), Op: "write", Data: data})
 }
 
 // LogEventWithOp writes a journal entry with an explicit operation string.
 func (j *Journal) LogEventWithOp(op, path string, data []byte) error {
-	return logEventWithOp(j.db, op, path, data)
+	return j.append(JournalEntry{Path: NamespacePath(j.namespace, path), Op: op, Data: data})
 }
 
-func logEventWithOp(db *pebble.DB, op, path string, data []byte) error {
-	if db == nil {
-		return fmt.Errorf("pebble database is not initialized")
+// LogTruncated writes a "write" entry for a file above the capture size
+// limit: data is its head followed by its tail, as described by trunc.
+func (j *Journal) LogTruncated(path string, data []byte, trunc Truncation) error {
+	if trunc.Head+trunc.Tail != len(data) {
+		return fmt.Errorf("truncated capture of %s has %d bytes, want head %d + tail %d", path, len(data), trunc.Head, trunc.Tail)
 	}
+	return j.append(JournalEntry{Path: NamespacePath(j.namespace, path), Op: "write", Data: data, Truncated: &trunc})
+}
 
-	entry := JournalEntry{
-		Timestamp: time.Now().UnixNano(),
-		Path:      path,
-		Op:        op,
-		Data:      data,
+// LogObserved writes a "write" entry that records only the size and hash of
+// path.
+func (j *Journal) LogObserved(path string, obs Observation) error {
+	return j.append(JournalEntry{Path: NamespacePath(j.namespace, path), Op: "write", Observed: &obs})
+}
+
+// LogPatch writes a "write" entry for the byte ranges of path written since
+// its previous capture: data holds them one after another, as described by
+// patch.
+func (j *Journal) LogPatch(path string, data []byte, patch Patch) error {
+	n := 0
+	for _, r := range patch.Ranges {
+		n += r.Length
+	}
+	if n != len(data) {
+		return fmt.Errorf("patch of %s has %d bytes, want %d for its ranges", path, len(data), n)
 	}
+	return j.append(JournalEntry{Path: NamespacePath(j.namespace, path), Op: "write", Data: data, Patch: &patch})
+}
 
-	payload, err := json.Marshal(entry)
-	if err != nil {
-		return fmt.Errorf("marshal journal entry: %w", err)
+// LogAttr writes a journal entry for a directory or mode change (OpMkdir,
+// OpRmdir or OpChmod). mode carries fs.ModeDir for directories.
+func (j *Journal) LogAttr(op, path string, mode fs.FileMode) error {
+	if !IsAttrOp(op) {
+		return fmt.Errorf("not an attribute op: %q", op)
 	}
+	return j.append(JournalEntry{Path: NamespacePath(j.namespace, path), Op: op, Mode: mode})
+}
 
-	keySuffix, err := randomSuffix()
+// LogBaseline writes an OpBaseline entry: the content path had at, before
+// the recording changed it.
+func (j *Journal) LogBaseline(path string, data []byte, at time.Time) error {
+	return j.append(JournalEntry{Timestamp: at.UnixNano(), Path: NamespacePath(j.namespace, path), Op: OpBaseline, Data: data})
+}
+
+// CapturedBytes returns how much content has been appended to the journal,
+// before deduplication and compression.
+func (j *Journal) CapturedBytes() int64 {
+	return j.captured.Load()
+}
+
+// Flush commits the events a batching journal is still holding.
+func (j *Journal) Flush() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.commitLocked()
+	if j.err != nil {
+		err, j.err = j.err, nil
+	}
+	return err
+}
+
+func (j *Journal) append(entry JournalEntry) error {
+	j.captured.Add(int64(len(entry.Data)))
+	if j.sink != nil {
+		if entry.Timestamp == 0 {
+			entry.Timestamp = time.Now().UnixNano()
+		}
+		return j.sink(entry)
+	}
+	class := classSmall
+	if _, path := SplitNamespace(entry.Path); j.critical != nil && j.critical(path) {
+		class = classCritical
+	} else if len(entry.Data) > smallEntryBytes || entry.Patch != nil {
+		// A patch, however small, must not be stored before the capture
+		// of the large file it applies to.
+		class = classLarge
+	}
+	if j.window <= 0 || j.writeOpts == pebble.Sync {
+		return logEntry(j.db, j.writeOpts, class, entry)
+	}
+	if j.db == nil {
+		return fmt.Errorf("pebble database is not initialized")
+	}
+	key, payload, err := encodeEntry(class, entry)
 	if err != nil {
-		return fmt.Errorf("generate journal key: %w", err)
+		return err
 	}
 
-	key := []byte(fmt.Sprintf("%s%020d:%s", cas.PrefixLog, entry.Timestamp, keySuffix))
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err != nil {
+		err, j.err = j.err, nil
+		return err
+	}
+	if j.batch == nil {
+		j.batch = j.db.NewBatch()
+		j.timer = time.AfterFunc(j.window, j.flushWindow)
+	}
+	if err := j.batch.Set(key, payload, nil); err != nil {
+		return fmt.Errorf("write journal entry: %w", err)
+	}
+	if j.batch.Len() >= maxBatchBytes {
+		return j.commitLocked()
+	}
+	return nil
+}
+
+// flushWindow commits the batch once its window has passed.
+func (j *Journal) flushWindow() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.commitLocked(); err != nil && j.err == nil {
+		j.err = err
+	}
+}
+
+// commitLocked commits the pending batch, if any. j.mu must be held.
+func (j *Journal) commitLocked() error {
+	if j.batch == nil {
+		return nil
+	}
+	batch := j.batch
+	j.batch = nil
+	j.timer.Stop()
+	defer batch.Close()
+	if err := batch.Commit(j.writeOpts); err != nil {
+		return fmt.Errorf("commit journal batch: %w", err)
+	}
+	return nil
+}
+
+func logEntry(db *pebble.DB, writeOpts *pebble.WriteOptions, class string, entry JournalEntry) error {
+	if db == nil {
+		return fmt.Errorf("pebble database is not initialized")
+	}
+	key, payload, err := encodeEntry(class, entry)
+	if err != nil {
+		return err
+	}
 
 	batch := db.NewBatch()
 	defer batch.Close()
 
-	if err := batch.Set(key, payload, pebble.NoSync); err != nil {
+	if err := batch.Set(key, payload, nil); err != nil {
 		return fmt.Errorf("write journal entry: %w", err)
 	}
 
-	if err := batch.Commit(pebble.NoSync); err != nil {
+	if err := batch.Commit(writeOpts); err != nil {
 		return fmt.Errorf("commit journal entry: %w", err)
 	}
 
 	return nil
 }
 
+// encodeEntry stamps entry with the current time, unless it carries one,
+// and returns its journal key in class and its payload.
+func encodeEntry(class string, entry JournalEntry) ([]byte, []byte, error) {
+	if entry.Timestamp == 0 {
+		entry.Timestamp = time.Now().UnixNano()
+	}
+
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal journal entry: %w", err)
+	}
+
+	keySuffix, err := randomSuffix()
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate journal key: %w", err)
+	}
+
+	key := []byte(fmt.Sprintf("%s%s:%020d:%s", cas.PrefixLog, class, entry.Timestamp, keySuffix))
+	return key, payload, nil
+}
+
+// largeEntry reports whether key is a journal key of classLarge.
+func largeEntry(key []byte) bool {
+	return strings.HasPrefix(string(key), cas.PrefixLog+classLarge+":")
+}
+
 func randomSuffix() (string, error) {
 	var buf [8]byte
 	if _, err := rand.Read(buf[:]); err != nil {
@@ -0,0 +1,156 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+func countJournal(t *testing.T, db *pebble.DB) int {
+	t.Helper()
+	iter, err := newPrefixIter(db, cas.PrefixLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		n++
+	}
+	return n
+}
+
+func TestJournalBatchesUntilFlush(t *testing.T) {
+	db, _, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	journal := NewJournal(db)
+	journal.SetBatchWindow(time.Hour)
+	for _, path := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := journal.LogEvent(path, []byte(path)); err != nil {
+			t.Fatalf("LogEvent(%s) error = %v", path, err)
+		}
+	}
+	if err := journal.LogAttr(OpMkdir, "dir", 0o755); err != nil {
+		t.Fatalf("LogAttr() error = %v", err)
+	}
+	if n := countJournal(t, db); n != 0 {
+		t.Fatalf("%d entries committed before the window passed", n)
+	}
+	if err := journal.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if n := countJournal(t, db); n != 4 {
+		t.Fatalf("Flush() committed %d entries, want 4", n)
+	}
+	if err := journal.Flush(); err != nil {
+		t.Fatalf("second Flush() error = %v", err)
+	}
+}
+
+func TestJournalCommitsBatchAfterWindow(t *testing.T) {
+	db, _, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	journal := NewJournal(db)
+	journal.SetBatchWindow(time.Millisecond)
+	if err := journal.LogEvent("a.txt", []byte("a")); err != nil {
+		t.Fatalf("LogEvent() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for countJournal(t, db) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("batch was not committed after its window")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := journal.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+}
+
+func TestSyncedJournalDoesNotBatch(t *testing.T) {
+	db, _, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	journal := NewJournal(db)
+	journal.SetBatchWindow(time.Hour)
+	journal.SetSync(true)
+	if err := journal.LogEvent("a.txt", []byte("a")); err != nil {
+		t.Fatalf("LogEvent() error = %v", err)
+	}
+	if n := countJournal(t, db); n != 1 {
+		t.Fatalf("synced append left %d entries committed, want 1", n)
+	}
+}
+
+func TestJournalOrdersEntriesByPriority(t *testing.T) {
+	db, _, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	journal := NewJournal(db)
+	journal.SetNamespace("build-1")
+	journal.SetCritical(func(path string) bool { return path == "conf/app.yaml" })
+	large := bytes.Repeat([]byte("x"), smallEntryBytes+1)
+	for _, e := range []struct {
+		path string
+		data []byte
+	}{
+		{"big.log", large},
+		{"notes.txt", []byte("small")},
+		{"conf/app.yaml", large},
+		{"other.log", large},
+	} {
+		if err := journal.LogEvent(e.path, e.data); err != nil {
+			t.Fatalf("LogEvent(%s) error = %v", e.path, err)
+		}
+	}
+
+	iter, err := newPrefixIter(db, cas.PrefixLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	var order []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		var entry JournalEntry
+		if err := json.Unmarshal(iter.Value(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		_, path := SplitNamespace(entry.Path)
+		order = append(order, path)
+		if largeEntry(iter.Key()) != (path == "big.log" || path == "other.log") {
+			t.Errorf("%s: key %s has the wrong class", path, iter.Key())
+		}
+	}
+	want := "conf/app.yaml,notes.txt,big.log,other.log"
+	if got := strings.Join(order, ","); got != want {
+		t.Fatalf("journal order = %s, want %s", got, want)
+	}
+}
+
+func TestJournalLagIsOldestEntryAge(t *testing.T) {
+	db, _, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	now := time.Now()
+	if lag, err := JournalLag(db, now); err != nil || lag != 0 {
+		t.Fatalf("JournalLag() of an empty journal = %v, %v; want 0", lag, err)
+	}
+	journal := NewJournal(db)
+	if err := journal.LogEventAt("new.txt", []byte("new"), now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	// Large entries sort after small ones, however old.
+	if err := journal.LogEventAt("big.bin", bytes.Repeat([]byte("x"), smallEntryBytes+1), now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if lag, err := JournalLag(db, now); err != nil || lag != time.Minute {
+		t.Fatalf("JournalLag() = %v, %v; want 1m0s", lag, err)
+	}
+}
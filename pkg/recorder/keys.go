@@ -0,0 +1,83 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+// VersionKey returns the metadata key of path's version at ts. The path is
+// length-prefixed: reserved keys such as CAS reference counts and session
+// bookkeeping never start with a digit, so no path can collide with them.
+func VersionKey(path string, ts int64) []byte {
+	return encodeKey(cas.PrefixMeta, path, ts)
+}
+
+// VersionKeyPrefix returns the prefix shared by every version key of path.
+func VersionKeyPrefix(path string) []byte {
+	return []byte(fmt.Sprintf("%s%d:%s:", cas.PrefixMeta, len(path), path))
+}
+
+func attrKey(path string, ts int64) []byte {
+	return encodeKey(cas.PrefixDir, path, ts)
+}
+
+func encodeKey(prefix, path string, ts int64) []byte {
+	return []byte(fmt.Sprintf("%s%d:%s:%020d", prefix, len(path), path, ts))
+}
+
+// rekeyRecords moves version and attribute records whose key does not match
+// the layout written by VersionKey and attrKey. Keys are derived from the
+// records themselves, so records that are already in place are left alone.
+func rekeyRecords(batch *pebble.Batch) (int, error) {
+	moved := 0
+	move := func(prefix string, keyOf func(value []byte) []byte) error {
+		iter, err := batch.NewIter(&pebble.IterOptions{
+			LowerBound: []byte(prefix),
+			UpperBound: append([]byte(prefix), 0xff),
+		})
+		if err != nil {
+			return err
+		}
+		defer iter.Close()
+		for iter.First(); iter.Valid(); iter.Next() {
+			want := keyOf(iter.Value())
+			if want == nil || string(want) == string(iter.Key()) {
+				continue
+			}
+			if err := batch.Set(want, iter.Value(), nil); err != nil {
+				return err
+			}
+			if err := batch.Delete(iter.Key(), nil); err != nil {
+				return err
+			}
+			moved++
+		}
+		return iter.Error()
+	}
+
+	err := move(cas.PrefixMeta, func(value []byte) []byte {
+		var meta MetadataRecord
+		// Session bookkeeping and CAS reference counts have no path and CID.
+		if json.Unmarshal(value, &meta) != nil || meta.Path == "" || meta.CID == "" {
+			return nil
+		}
+		return VersionKey(meta.Path, meta.Timestamp)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("migrate version keys: %w", err)
+	}
+	err = move(cas.PrefixDir, func(value []byte) []byte {
+		var rec AttrRecord
+		if json.Unmarshal(value, &rec) != nil || rec.Path == "" {
+			return nil
+		}
+		return attrKey(rec.Path, rec.Timestamp)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("migrate attribute keys: %w", err)
+	}
+	return moved, nil
+}
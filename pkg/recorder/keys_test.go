@@ -0,0 +1,103 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+func TestVersionKeysCannotCollideWithReservedKeys(t *testing.T) {
+	for _, path := range []string{"ref:abc", "session:start", "session:marker:x", "schema", "a:b:00000000000000000001"} {
+		key := string(VersionKey(path, 1))
+		if strings.HasPrefix(key, SessionKeyPrefix) || strings.HasPrefix(key, cas.PrefixMeta+"ref:") {
+			t.Errorf("version key %q for %q looks reserved", key, path)
+		}
+		if !strings.HasPrefix(key, string(VersionKeyPrefix(path))) {
+			t.Errorf("version key %q does not start with the prefix of %q", key, path)
+		}
+	}
+	if strings.HasPrefix(string(VersionKey("a:b", 1)), string(VersionKeyPrefix("a"))) {
+		t.Errorf("versions of a:b share a prefix with versions of a")
+	}
+}
+
+func TestMigrateKeysMovesVersionOneRecords(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	if err := MarkSessionStart(db, time.Unix(0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	cid, err := store.Put([]byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Version 1 keys: m:<path>:<ts>.
+	paths := []string{"plain.txt", "ref:abc", "session:start", "logs/a:b.log"}
+	for i, path := range paths {
+		val, _ := json.Marshal(MetadataRecord{Path: path, Timestamp: int64(i + 10), CID: cid, Size: 7, Op: "write"})
+		key := fmt.Sprintf("%s%s:%020d", cas.PrefixMeta, path, i+10)
+		if err := db.Set([]byte(key), val, pebble.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attr, _ := json.Marshal(AttrRecord{Path: "out:dir", Timestamp: 20, Op: OpMkdir, Mode: fs.ModeDir | 0o755})
+	if err := db.Set([]byte(fmt.Sprintf("%sout:dir:%020d", cas.PrefixDir, 20)), attr, pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := StoredSchemaVersion(db); err != nil || v != 1 {
+		t.Fatalf("store without a schema key should be version 1, got %d (err=%v)", v, err)
+	}
+	report, err := Migrate(db, false)
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	if len(report.Steps) == 0 || report.Steps[0].Version != 2 || report.Steps[0].Records != len(paths)+1 {
+		t.Fatalf("expected %d records re-keyed, got %+v", len(paths)+1, report)
+	}
+	if v, err := StoredSchemaVersion(db); err != nil || v != SchemaVersion {
+		t.Fatalf("schema version after migration = %d (err=%v), want %d", v, err, SchemaVersion)
+	}
+
+	state, err := StateAt(db, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		if state[path].CID != cid {
+			t.Errorf("%s missing after migration: %+v", path, state)
+		}
+		if _, closer, err := db.Get(VersionKey(path, state[path].Timestamp)); err != nil {
+			t.Errorf("%s not stored under its version 2 key: %v", path, err)
+		} else {
+			closer.Close()
+		}
+	}
+	if attrs, err := AttrsAt(db, time.Now()); err != nil || !attrs["out:dir"].IsDir() {
+		t.Fatalf("attribute record lost in migration: %+v (err=%v)", attrs, err)
+	}
+	if _, closer, err := db.Get([]byte(SessionStartKey)); err != nil {
+		t.Fatalf("session start must not be migrated: %v", err)
+	} else {
+		closer.Close()
+	}
+
+	if moved, err := MigrateImported(db); err != nil || moved != 0 {
+		t.Fatalf("second migration moved %d records (err=%v)", moved, err)
+	}
+
+	if err := db.Set([]byte(SchemaKey), []byte("99"), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Recover(db, store, DefaultProcessorOptions()); err == nil {
+		t.Fatalf("expected a newer schema version to be rejected")
+	}
+}
@@ -0,0 +1,154 @@
+package recorder
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+// SchemaVersion is the schema version written by this build. It matches the
+// last entry in migrations.
+const SchemaVersion = 3
+
+// SchemaKey holds the state dir's schema version. It is not synced by push
+// and pull, since each state dir is migrated on its own; a state dir without
+// it is version 1.
+const SchemaKey = cas.PrefixState + "schema"
+
+// Migration upgrades a state dir from schema version Version-1 to Version.
+type Migration struct {
+	Version     int
+	Description string
+	// Apply stages its changes in batch and returns the number of records
+	// it rewrote. The batch is indexed, so reads see the changes of earlier
+	// migrations. Apply must be idempotent: records pulled from an older
+	// state dir are passed through every migration again.
+	Apply func(batch *pebble.Batch) (int, error)
+}
+
+// migrations is the registry of schema changes, in version order. Append a
+// Migration whenever the on-disk layout changes.
+var migrations = []Migration{
+	{
+		// Version 1 keyed versions as m:<path>:<ts>, so paths containing ':'
+		// or starting with "ref:" or "session:" could be mistaken for other
+		// paths, CAS reference counts or session bookkeeping.
+		Version:     2,
+		Description: "length-prefix paths in metadata and attribute keys",
+		Apply:       rekeyRecords,
+	},
+	{
+		Version:     indexedSchemaVersion,
+		Description: "index the latest version of every path",
+		Apply:       indexLatestVersions,
+	},
+}
+
+// MigrationStep is one migration run by Migrate.
+type MigrationStep struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	Records     int    `json:"records"`
+}
+
+// MigrationReport summarises a Migrate run.
+type MigrationReport struct {
+	From   int             `json:"from"`
+	To     int             `json:"to"`
+	DryRun bool            `json:"dry_run,omitempty"`
+	Steps  []MigrationStep `json:"steps"`
+}
+
+// Records returns the number of records rewritten by all steps.
+func (r MigrationReport) Records() int {
+	n := 0
+	for _, step := range r.Steps {
+		n += step.Records
+	}
+	return n
+}
+
+// StoredSchemaVersion returns the schema version recorded in db.
+func StoredSchemaVersion(db pebble.Reader) (int, error) {
+	val, closer, err := db.Get([]byte(SchemaKey))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+	v, err := strconv.Atoi(string(val))
+	if err != nil {
+		return 0, fmt.Errorf("corrupt schema version %q: %w", val, err)
+	}
+	return v, nil
+}
+
+// Migrate brings db up to SchemaVersion by running every pending migration
+// in a single batch, so a failed run leaves the state dir untouched. With
+// dryRun the batch is discarded and the report says what would have changed.
+func Migrate(db *pebble.DB, dryRun bool) (MigrationReport, error) {
+	from, err := StoredSchemaVersion(db)
+	if err != nil {
+		return MigrationReport{}, err
+	}
+	return runMigrations(db, from, dryRun)
+}
+
+// MigrateImported runs every migration again, regardless of the stored
+// schema version. Push and pull copy records as they are, so records
+// transferred from an older state dir may still use an old layout. It
+// returns the number of records rewritten.
+func MigrateImported(db *pebble.DB) (int, error) {
+	from, err := StoredSchemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkSchemaVersion(from); err != nil {
+		return 0, err
+	}
+	report, err := runMigrations(db, 1, false)
+	return report.Records(), err
+}
+
+func checkSchemaVersion(v int) error {
+	if v > SchemaVersion {
+		return fmt.Errorf("state dir has schema version %d; this build supports up to %d", v, SchemaVersion)
+	}
+	return nil
+}
+
+func runMigrations(db *pebble.DB, from int, dryRun bool) (MigrationReport, error) {
+	report := MigrationReport{From: from, To: SchemaVersion, DryRun: dryRun, Steps: []MigrationStep{}}
+	if err := checkSchemaVersion(from); err != nil {
+		return report, err
+	}
+
+	batch := db.NewIndexedBatch()
+	defer batch.Close()
+	for _, m := range migrations {
+		if m.Version <= from {
+			continue
+		}
+		n, err := m.Apply(batch)
+		if err != nil {
+			return report, fmt.Errorf("migrate to schema version %d: %w", m.Version, err)
+		}
+		report.Steps = append(report.Steps, MigrationStep{Version: m.Version, Description: m.Description, Records: n})
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	if err := batch.Set([]byte(SchemaKey), []byte(strconv.Itoa(SchemaVersion)), nil); err != nil {
+		return report, err
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return report, fmt.Errorf("commit migration: %w", err)
+	}
+	return report, nil
+}
@@ -0,0 +1,66 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+func TestMigrationRegistryIsOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+2 {
+			t.Fatalf("migration %d has version %d, want %d", i, m.Version, i+2)
+		}
+		if m.Description == "" || m.Apply == nil {
+			t.Fatalf("migration to version %d is incomplete", m.Version)
+		}
+	}
+	if last := migrations[len(migrations)-1].Version; last != SchemaVersion {
+		t.Fatalf("last migration is version %d, SchemaVersion is %d", last, SchemaVersion)
+	}
+}
+
+func TestMigrateDryRunLeavesStateDirUntouched(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	cid, err := store.Put([]byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, _ := json.Marshal(MetadataRecord{Path: "a:b", Timestamp: 5, CID: cid, Size: 7, Op: "write"})
+	oldKey := []byte(fmt.Sprintf("%sa:b:%020d", cas.PrefixMeta, 5))
+	if err := db.Set(oldKey, val, pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Migrate(db, true)
+	if err != nil {
+		t.Fatalf("Migrate(dry run) error = %v", err)
+	}
+	if report.From != 1 || report.To != SchemaVersion || !report.DryRun || report.Steps[0].Records != 1 {
+		t.Fatalf("unexpected dry-run report: %+v", report)
+	}
+	if v, _ := StoredSchemaVersion(db); v != 1 {
+		t.Fatalf("dry run changed the schema version to %d", v)
+	}
+	if _, closer, err := db.Get(oldKey); err != nil {
+		t.Fatalf("dry run moved the record: %v", err)
+	} else {
+		closer.Close()
+	}
+
+	report, err = Migrate(db, false)
+	if err != nil || report.Steps[0].Records != 1 {
+		t.Fatalf("Migrate() = %+v, %v", report, err)
+	}
+	if _, _, err := db.Get(oldKey); err != pebble.ErrNotFound {
+		t.Fatalf("old key still present after migration: %v", err)
+	}
+	if report, err = Migrate(db, false); err != nil || len(report.Steps) != 0 {
+		t.Fatalf("second Migrate() = %+v, %v; want no steps", report, err)
+	}
+}
@@ -0,0 +1,72 @@
+package recorder
+
+import "strings"
+
+// namespaceSep separates a namespace from the path of a file recorded in
+// it. Clean relative paths never contain it, so recorded paths from
+// different namespaces cannot collide, and every key derived from a path
+// (versions, attributes, the latest-version index) is isolated with it. CAS
+// objects stay shared: identical content is stored once across namespaces.
+// The empty namespace is the default one, holding unprefixed paths.
+const namespaceSep = "//"
+
+// NamespacePath returns the recorded path of path in namespace ns.
+func NamespacePath(ns, path string) string {
+	if ns == "" {
+		return path
+	}
+	return ns + namespaceSep + path
+}
+
+// SplitNamespace returns the namespace a recorded path belongs to and the
+// path within it.
+func SplitNamespace(recorded string) (ns, path string) {
+	if ns, path, ok := strings.Cut(recorded, namespaceSep); ok {
+		return ns, path
+	}
+	return "", recorded
+}
+
+// InNamespace returns the path within ns of a recorded path, and whether
+// it belongs to ns at all.
+func InNamespace(recorded, ns string) (string, bool) {
+	got, path := SplitNamespace(recorded)
+	return path, got == ns
+}
+
+// NamespaceState keeps the records of ns, keyed and named by their path
+// within it.
+func NamespaceState(records map[string]MetadataRecord, ns string) map[string]MetadataRecord {
+	out := make(map[string]MetadataRecord, len(records))
+	for recorded, meta := range records {
+		if path, ok := InNamespace(recorded, ns); ok {
+			meta.Path = path
+			out[path] = meta
+		}
+	}
+	return out
+}
+
+// NamespaceAttrs is NamespaceState for attribute records.
+func NamespaceAttrs(attrs map[string]AttrRecord, ns string) map[string]AttrRecord {
+	out := make(map[string]AttrRecord, len(attrs))
+	for recorded, rec := range attrs {
+		if path, ok := InNamespace(recorded, ns); ok {
+			rec.Path = path
+			out[path] = rec
+		}
+	}
+	return out
+}
+
+// NamespaceHistory keeps the records of ns from history, in order.
+func NamespaceHistory(history []MetadataRecord, ns string) []MetadataRecord {
+	var out []MetadataRecord
+	for _, meta := range history {
+		if path, ok := InNamespace(meta.Path, ns); ok {
+			meta.Path = path
+			out = append(out, meta)
+		}
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+package recorder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNamespacePaths(t *testing.T) {
+	recorded := NamespacePath("build-7", "conf/app.yaml")
+	if ns, path := SplitNamespace(recorded); ns != "build-7" || path != "conf/app.yaml" {
+		t.Fatalf("SplitNamespace(%q) = %q, %q", recorded, ns, path)
+	}
+	if NamespacePath("", "app.log") != "app.log" {
+		t.Fatalf("the default namespace must not change paths")
+	}
+	if _, ok := InNamespace("app.log", "build-7"); ok {
+		t.Fatalf("a default namespace path must not belong to build-7")
+	}
+	if _, ok := InNamespace(recorded, ""); ok {
+		t.Fatalf("a build-7 path must not belong to the default namespace")
+	}
+
+	state := map[string]MetadataRecord{
+		recorded:  {Path: recorded, CID: "a"},
+		"app.log": {Path: "app.log", CID: "b"},
+	}
+	got := NamespaceState(state, "build-7")
+	if len(got) != 1 || got["conf/app.yaml"].Path != "conf/app.yaml" || got["conf/app.yaml"].CID != "a" {
+		t.Fatalf("NamespaceState = %+v", got)
+	}
+}
+
+func TestPruneOnlyTouchesItsNamespace(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	now := time.Unix(1_000_000, 0)
+	opts := DefaultProcessorOptions()
+	for _, ns := range []string{"", "other"} {
+		path := NamespacePath(ns, "app.log")
+		processEntry(t, db, store, opts, JournalEntry{Timestamp: now.Add(-2 * time.Hour).UnixNano(), Path: path, Op: "write", Data: []byte(ns + "v1")})
+		processEntry(t, db, store, opts, JournalEntry{Timestamp: now.Add(-time.Minute).UnixNano(), Path: path, Op: "write", Data: []byte(ns + "v2")})
+	}
+
+	stats, err := Prune(db, store, RetentionPolicy{MaxAge: time.Hour, Namespace: "other"}, now)
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if stats.Versions != 1 {
+		t.Fatalf("expected only other's old version to be pruned, got %+v", stats)
+	}
+	byPath, err := loadVersionKeys(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byPath["app.log"]) != 2 || len(byPath[NamespacePath("other", "app.log")]) != 1 {
+		t.Fatalf("unexpected versions after prune: %v", byPath)
+	}
+}
@@ -0,0 +1,158 @@
+package recorder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/chunk"
+)
+
+// patchesOnto reports whether entry's patch applies to base, the latest
+// version of its path: base holds the content the ranges were written
+// over, and the size of its objects is known.
+func patchesOnto(base MetadataRecord, entry JournalEntry) bool {
+	p := entry.Patch
+	if base.Observed || base.Truncated != nil || base.objectSizes() == nil {
+		return false
+	}
+	if int64(base.Size) != p.BaseSize || base.Timestamp >= entry.Timestamp || p.Size <= 0 {
+		return false
+	}
+	n := 0
+	for _, r := range p.Ranges {
+		if r.Offset < 0 || r.Length < 0 {
+			return false
+		}
+		n += r.Length
+	}
+	return n == len(entry.Data)
+}
+
+// storePatched stores the version entry's patch makes of base. Objects of
+// base the patch leaves alone are kept as they are; each run of the others
+// is loaded, overwritten with the ranges and chunked again, so a write to
+// a multi-gigabyte file costs about the size of the chunks it touched.
+func storePatched(store *cas.CASStore, base MetadataRecord, entry JournalEntry, params chunk.Params) (chunkedContent, error) {
+	p := entry.Patch
+	objects, sizes := base.objects(), base.objectSizes()
+	var res chunkedContent
+
+	// span is the byte range being rewritten, from the start of the first
+	// object it touches, and the indexes of base's objects within it.
+	var span struct {
+		start, end int64
+		objects    []int
+	}
+	flush := func() error {
+		if span.end <= span.start {
+			return nil
+		}
+		data, err := patchedSpan(store, base, entry, span.start, span.end, span.objects)
+		if err != nil {
+			return err
+		}
+		stored, err := storeChunked(store, data, params, MetadataRecord{})
+		if err != nil {
+			return err
+		}
+		res.cids = append(res.cids, stored.cids...)
+		res.sizes = append(res.sizes, stored.sizes...)
+		res.fresh += stored.fresh
+		span.start, span.end, span.objects = 0, 0, nil
+		return nil
+	}
+
+	var off int64
+	for i, cid := range objects {
+		start, end := off, off+int64(sizes[i])
+		off = end
+		if start >= p.Size {
+			break
+		}
+		if start == end {
+			continue
+		}
+		if end <= p.Size && !p.touches(start, end) {
+			if err := flush(); err != nil {
+				return chunkedContent{}, err
+			}
+			res.cids = append(res.cids, cid)
+			res.sizes = append(res.sizes, sizes[i])
+			continue
+		}
+		if span.end <= span.start {
+			span.start = start
+		}
+		span.end = min(end, p.Size)
+		span.objects = append(span.objects, i)
+	}
+	if p.Size > off {
+		// The file grew: the new bytes join a span ending at the old end.
+		if span.end != off {
+			if err := flush(); err != nil {
+				return chunkedContent{}, err
+			}
+			span.start = off
+		}
+		span.end = p.Size
+	}
+	if err := flush(); err != nil {
+		return chunkedContent{}, err
+	}
+	return res, nil
+}
+
+// touches reports whether a range of p overlaps [start, end).
+func (p *Patch) touches(start, end int64) bool {
+	for _, r := range p.Ranges {
+		if r.Offset < end && r.Offset+int64(r.Length) > start {
+			return true
+		}
+	}
+	return false
+}
+
+// patchedSpan returns bytes [start, end) of the patched content: those of
+// base's objects in the span, zeros past base's end, and over both the
+// ranges of entry's patch.
+func patchedSpan(store *cas.CASStore, base MetadataRecord, entry JournalEntry, start, end int64, objects []int) ([]byte, error) {
+	buf := make([]byte, end-start)
+	cids, sizes := base.objects(), base.objectSizes()
+	var off int64
+	for i := range cids {
+		size := int64(sizes[i])
+		if len(objects) > 0 && i == objects[0] {
+			data, err := store.Get(cids[i])
+			if err != nil {
+				return nil, fmt.Errorf("load chunk %d of %s: %w", i, base.Path, err)
+			}
+			if int64(len(data)) != size {
+				return nil, fmt.Errorf("chunk %d of %s is %d bytes, expected %d", i, base.Path, len(data), size)
+			}
+			copy(buf[off-start:], data)
+			objects = objects[1:]
+		}
+		off += size
+	}
+
+	pos := 0
+	for _, r := range entry.Patch.Ranges {
+		data := entry.Data[pos : pos+r.Length]
+		pos += r.Length
+		from, to := max(r.Offset, start), min(r.Offset+int64(len(data)), end)
+		if from < to {
+			copy(buf[from-start:to-start], data[from-r.Offset:])
+		}
+	}
+	return buf, nil
+}
+
+// chunkListID identifies a patched version by its list of chunks, as its
+// content was never hashed whole.
+func chunkListID(cids []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(cids, "\n")))
+	return "patched:" + hex.EncodeToString(sum[:])
+}
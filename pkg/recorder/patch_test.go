@@ -0,0 +1,87 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+func TestProcessorAppliesPatchesToPreviousVersion(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+	opts := testChunkOptions()
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+	base := processEntry(t, db, store, opts, JournalEntry{Timestamp: 1, Path: "db.img", Data: data})
+
+	// Overwrite a few bytes in the middle and grow the file past a hole.
+	want := append(slices.Clone(data), make([]byte, 1000)...)
+	copy(want[100000:], "in place")
+	copy(want[len(want)-10:], "appended!!")
+	patch := Patch{Size: int64(len(want)), BaseSize: int64(len(data)), Ranges: []PatchRange{
+		{Offset: 100000, Length: 8},
+		{Offset: int64(len(want) - 10), Length: 10},
+	}}
+	entry := JournalEntry{Timestamp: 2, Path: "db.img", Op: "write", Data: []byte("in placeappended!!"), Patch: &patch}
+	patched := processEntry(t, db, store, opts, entry)
+
+	if !patched.Patched || patched.Size != len(want) || !strings.HasPrefix(patched.CID, "patched:") {
+		t.Fatalf("patched version = %+v", patched)
+	}
+	got, err := ReadContent(store, patched)
+	if err != nil {
+		t.Fatalf("ReadContent() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("patched content mismatch")
+	}
+	shared := 0
+	for _, cid := range patched.Chunks {
+		if slices.Contains(base.Chunks, cid) {
+			shared++
+		}
+	}
+	if shared < len(base.Chunks)-3 {
+		t.Fatalf("patched version shares %d of %d chunks, want all but those written", shared, len(base.Chunks))
+	}
+
+	// The next full capture is not taken for an append to the patch.
+	full := processEntry(t, db, store, opts, JournalEntry{Timestamp: 3, Path: "db.img", Data: append(want, "more"...)})
+	if full.Appended != 0 || full.Patched {
+		t.Fatalf("full capture after a patch = %+v", full)
+	}
+}
+
+func TestProcessorDropsPatchWithoutItsBase(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+	opts := testChunkOptions()
+
+	processEntry(t, db, store, opts, JournalEntry{Timestamp: 1, Path: "db.img", Data: bytes.Repeat([]byte("x"), 8192)})
+	patch := Patch{Size: 8192, BaseSize: 4096, Ranges: []PatchRange{{Offset: 0, Length: 1}}}
+	payload, err := json.Marshal(JournalEntry{Timestamp: 2, Path: "db.img", Op: "write", Data: []byte("y"), Patch: &patch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logKey := []byte(cas.PrefixLog + "test")
+	if err := db.Set(logKey, payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := processJournalEntry(db, store, opts, logKey, payload); err != nil {
+		t.Fatalf("processJournalEntry() error = %v", err)
+	}
+	if _, closer, err := db.Get(logKey); err == nil {
+		closer.Close()
+		t.Fatalf("journal entry of an inapplicable patch was kept")
+	}
+	latest, _, err := latestVersion(db, "db.img")
+	if err != nil || latest.Timestamp != 1 {
+		t.Fatalf("latest version = %+v (%v), want the first capture", latest, err)
+	}
+}
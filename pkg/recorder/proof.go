@@ -0,0 +1,131 @@
+package recorder
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/merkle"
+)
+
+// StateProof binds one recorded file version to the Merkle root over the
+// state it belongs to. It is self-contained and can be checked offline.
+type StateProof struct {
+	// Version is the merkle.ProofVersion of Root and Siblings.
+	Version int `json:"version"`
+
+	Path string `json:"path"`
+	CID  string `json:"cid"`
+	// Timestamp is when the version was recorded.
+	Timestamp int64 `json:"ts"`
+
+	// Root (hex) covers the newest version of every path at StateTime.
+	Root      string `json:"root"`
+	StateTime int64  `json:"state_time"`
+	Files     int    `json:"files"`
+
+	// Siblings (hex) and Index walk from the leaf to Root; see merkle.Proof.
+	Siblings []string `json:"siblings"`
+	Index    []int64  `json:"index"`
+
+	// Sealed is set when Root is the root stored at the session end, which
+	// Signature (if any) signs.
+	Sealed    bool              `json:"sealed"`
+	Signature *merkle.Signature `json:"signature,omitempty"`
+}
+
+// ProveState builds an inclusion proof for the version of path current at
+// target. The proof is sealed when target is at or after the session end
+// and the state still matches the sealed root.
+func ProveState(db *pebble.DB, path string, target time.Time) (*StateProof, error) {
+	records, err := StateAt(db, target)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := records[path]
+	if !ok {
+		return nil, fmt.Errorf("no version of %s recorded at %s", path, target.Format(time.RFC3339Nano))
+	}
+
+	states := SessionStates(records)
+	mm := merkle.NewMerkleManager()
+	tree, err := mm.BuildTree(merkle.SessionLeaves(states))
+	if err != nil {
+		return nil, err
+	}
+	slashPath := filepath.ToSlash(path)
+	proof, err := mm.GenerateProof(tree, merkle.SessionLeaf(slashPath, meta.CID))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &StateProof{
+		Version:   proof.Version,
+		Path:      slashPath,
+		CID:       meta.CID,
+		Timestamp: meta.Timestamp,
+		Root:      hex.EncodeToString(merkle.GetRoot(tree)),
+		StateTime: target.UnixNano(),
+		Files:     len(states),
+		Siblings:  make([]string, len(proof.Siblings)),
+		Index:     proof.Index,
+	}
+	for i, sibling := range proof.Siblings {
+		p.Siblings[i] = hex.EncodeToString(sibling)
+	}
+
+	end, ended, err := LoadSessionEnd(db)
+	if err != nil {
+		return nil, err
+	}
+	if ended && end.MerkleRoot == p.Root && merkle.SupportedVersion(end.MerkleVersion) && target.UnixNano() >= end.Timestamp {
+		p.Sealed = true
+		p.Signature = end.Signature
+	}
+	return p, nil
+}
+
+// Verify checks that the version is included in Root and, for sealed proofs,
+// that the signature matches. pubPEM names the trusted signer; when empty
+// the signature is checked against its embedded key only.
+func (p *StateProof) Verify(pubPEM []byte) error {
+	root, err := hex.DecodeString(p.Root)
+	if err != nil {
+		return fmt.Errorf("decode root: %w", err)
+	}
+	proof := &merkle.Proof{
+		Version:  p.Version,
+		Leaf:     merkle.SessionLeaf(p.Path, p.CID),
+		Siblings: make([][]byte, len(p.Siblings)),
+		Index:    p.Index,
+	}
+	for i, sibling := range p.Siblings {
+		if proof.Siblings[i], err = hex.DecodeString(sibling); err != nil {
+			return fmt.Errorf("decode sibling %d: %w", i, err)
+		}
+	}
+
+	ok, err := merkle.VerifyInclusion(root, proof)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s@%s is not included in root %s", p.Path, p.CID, p.Root)
+	}
+
+	if p.Signature == nil {
+		if len(pubPEM) > 0 {
+			return fmt.Errorf("proof is not signed")
+		}
+		return nil
+	}
+	if !p.Sealed {
+		return fmt.Errorf("signature present on an unsealed proof")
+	}
+	if err := p.Signature.Verify(root, pubPEM); err != nil {
+		return fmt.Errorf("session signature: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package recorder
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/merkle"
+)
+
+func TestProveStateRoundTrip(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	base := time.Unix(1_000_000, 0)
+	opts := DefaultProcessorOptions()
+	paths := []string{"a.txt", "b.txt", "logs/app.log"}
+	for i, path := range paths {
+		processEntry(t, db, store, opts, JournalEntry{Timestamp: base.Add(time.Duration(i) * time.Second).UnixNano(), Path: path, Op: "write", Data: []byte(path)})
+	}
+	end := base.Add(5 * time.Second)
+	if err := MarkSessionEnd(db, end, 0); err != nil {
+		t.Fatalf("MarkSessionEnd() error = %v", err)
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := SealSession(db, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("SealSession() error = %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+
+	for _, path := range paths {
+		proof, err := ProveState(db, path, end)
+		if err != nil {
+			t.Fatalf("ProveState(%s) error = %v", path, err)
+		}
+		if !proof.Sealed || proof.Root != sealed.MerkleRoot || proof.Signature == nil {
+			t.Fatalf("proof for %s should be sealed by %s, got %+v", path, sealed.MerkleRoot, proof)
+		}
+		if err := proof.Verify(pubPEM); err != nil {
+			t.Fatalf("Verify(%s) error = %v", path, err)
+		}
+
+		data, err := json.Marshal(proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded StateProof
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("decode proof: %v", err)
+		}
+		if decoded.Version != merkle.ProofVersion {
+			t.Fatalf("decoded proof version = %d, want %d", decoded.Version, merkle.ProofVersion)
+		}
+		if err := decoded.Verify(pubPEM); err != nil {
+			t.Fatalf("Verify(%s) after JSON round trip error = %v", path, err)
+		}
+	}
+	if sealed.MerkleVersion != merkle.ProofVersion {
+		t.Fatalf("sealed root version = %d, want %d", sealed.MerkleVersion, merkle.ProofVersion)
+	}
+
+	proof, err := ProveState(db, "a.txt", base.Add(time.Second))
+	if err != nil {
+		t.Fatalf("ProveState() before end error = %v", err)
+	}
+	if proof.Sealed || proof.Signature != nil || proof.Files != 2 {
+		t.Fatalf("mid-session proof should be unsealed over 2 files, got %+v", proof)
+	}
+	if err := proof.Verify(nil); err != nil {
+		t.Fatalf("Verify() unsealed error = %v", err)
+	}
+	if err := proof.Verify(pubPEM); err == nil {
+		t.Fatalf("an unsigned proof must not pass a key check")
+	}
+
+	if _, err := ProveState(db, "logs/app.log", base); err == nil {
+		t.Fatalf("expected an error for a path not yet recorded")
+	}
+}
+
+func TestStateProofDetectsTampering(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	base := time.Unix(1_000_000, 0)
+	opts := DefaultProcessorOptions()
+	for i, path := range []string{"a.txt", "b.txt", "c.txt"} {
+		processEntry(t, db, store, opts, JournalEntry{Timestamp: base.Add(time.Duration(i) * time.Second).UnixNano(), Path: path, Op: "write", Data: []byte(path)})
+	}
+
+	fresh := func() *StateProof {
+		proof, err := ProveState(db, "b.txt", base.Add(time.Minute))
+		if err != nil {
+			t.Fatalf("ProveState() error = %v", err)
+		}
+		return proof
+	}
+
+	tampered := map[string]func(*StateProof){
+		"cid":     func(p *StateProof) { p.CID = strings.Repeat("0", len(p.CID)) },
+		"path":    func(p *StateProof) { p.Path = "c.txt" },
+		"index":   func(p *StateProof) { p.Index[0] ^= 1 },
+		"sibling": func(p *StateProof) { p.Siblings = p.Siblings[1:] },
+		"root":    func(p *StateProof) { p.Root = p.Siblings[0] },
+		"version": func(p *StateProof) { p.Version = merkle.ProofVersion + 1 },
+	}
+	for name, tamper := range tampered {
+		proof := fresh()
+		tamper(proof)
+		if err := proof.Verify(nil); err == nil {
+			t.Errorf("tampered %s: expected verification to fail", name)
+		}
+	}
+}
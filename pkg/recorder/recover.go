@@ -0,0 +1,175 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+// RecoveryReport summarizes what Recover salvaged from a dirty state dir.
+type RecoveryReport struct {
+	// Replayed journal entries turned into metadata.
+	Replayed int `json:"replayed"`
+	// DiscardedJournal entries that could not be decoded.
+	DiscardedJournal int `json:"discarded_journal"`
+	// DroppedMetadata records that could not be decoded.
+	DroppedMetadata int `json:"dropped_metadata"`
+	// MissingContent records whose CAS objects are gone; they are dropped
+	// because the version can no longer be reconstructed.
+	MissingContent int `json:"missing_content"`
+	// CorruptChunks records whose chunk list does not hash to their
+	// ChunkRoot; they are dropped because their content cannot be trusted.
+	CorruptChunks int `json:"corrupt_chunks"`
+	// Unfinished is set when the session has a start but no end, i.e. the
+	// recorder did not exit cleanly.
+	Unfinished bool `json:"unfinished"`
+	// MigratedKeys records moved to the current SchemaVersion layout.
+	MigratedKeys int `json:"migrated_keys"`
+}
+
+// Clean reports whether recovery found nothing to do.
+func (r RecoveryReport) Clean() bool {
+	return r.Replayed == 0 && r.DiscardedJournal == 0 && r.DroppedMetadata == 0 && r.MissingContent == 0 && r.CorruptChunks == 0
+}
+
+// Recover brings a state dir left behind by a killed recorder back to a
+// consistent state: pending journal entries are processed, and metadata that
+// is truncated, points at missing CAS objects or whose chunks do not match
+// its ChunkRoot is removed. State dirs
+// written with an older SchemaVersion are migrated first. It must run before
+// a processor is started on db.
+func Recover(db *pebble.DB, store *cas.CASStore, opts ProcessorOptions) (RecoveryReport, error) {
+	var report RecoveryReport
+
+	version, err := StoredSchemaVersion(db)
+	if err != nil {
+		return report, err
+	}
+	if version != SchemaVersion {
+		migration, err := Migrate(db, false)
+		if err != nil {
+			return report, err
+		}
+		report.MigratedKeys = migration.Records()
+	}
+
+	if err := replayJournal(db, store, opts, &report); err != nil {
+		return report, err
+	}
+	if err := repairMetadata(db, store, &report); err != nil {
+		return report, err
+	}
+	if err := pruneChunkTrees(db); err != nil {
+		return report, err
+	}
+
+	if _, closer, err := db.Get([]byte(SessionStartKey)); err == nil {
+		closer.Close()
+		if _, closer, err := db.Get([]byte(SessionEndKey)); err == nil {
+			closer.Close()
+		} else {
+			report.Unfinished = true
+		}
+	}
+
+	return report, nil
+}
+
+func replayJournal(db *pebble.DB, store *cas.CASStore, opts ProcessorOptions, report *RecoveryReport) error {
+	iter, err := newPrefixIter(db, cas.PrefixLog)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		logKey := append([]byte(nil), iter.Key()...)
+		payload := append([]byte(nil), iter.Value()...)
+
+		var entry JournalEntry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			log.Printf("[recover] discard truncated journal entry %s: %v", logKey, err)
+			if err := db.Delete(logKey, pebble.Sync); err != nil {
+				return fmt.Errorf("delete journal key: %w", err)
+			}
+			report.DiscardedJournal++
+			continue
+		}
+
+		if err := processJournalEntry(db, store, opts, logKey, payload); err != nil {
+			return fmt.Errorf("replay journal %s: %w", logKey, err)
+		}
+		report.Replayed++
+	}
+	return iter.Error()
+}
+
+func repairMetadata(db *pebble.DB, store *cas.CASStore, report *RecoveryReport) error {
+	iter, err := newPrefixIter(db, cas.PrefixMeta)
+	if err != nil {
+		return err
+	}
+
+	var drop [][]byte
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		if IsSessionKey(key) {
+			continue
+		}
+
+		var meta MetadataRecord
+		if err := json.Unmarshal(iter.Value(), &meta); err != nil {
+			log.Printf("[recover] drop truncated metadata %s: %v", key, err)
+			drop = append(drop, []byte(key))
+			report.DroppedMetadata++
+			continue
+		}
+		if meta.Path == "" || meta.Observed {
+			// Not a file version (e.g. a CAS reference count), or one
+			// whose content was never stored.
+			continue
+		}
+		if err := verifyChunkRoot(meta); err != nil {
+			log.Printf("[recover] drop %s: %v", key, err)
+			drop = append(drop, []byte(key))
+			report.CorruptChunks++
+			continue
+		}
+
+		cids := meta.Chunks
+		if len(cids) == 0 {
+			cids = []string{meta.CID}
+		}
+		for _, cid := range cids {
+			ok, err := store.Has(cid)
+			if err != nil {
+				iter.Close()
+				return fmt.Errorf("check CAS object %s: %w", cid, err)
+			}
+			if !ok {
+				log.Printf("[recover] drop %s: CAS object %s is missing", key, cid)
+				drop = append(drop, []byte(key))
+				report.MissingContent++
+				break
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if len(drop) == 0 {
+		return nil
+	}
+	batch := db.NewBatch()
+	defer batch.Close()
+	for _, key := range drop {
+		if err := batch.Delete(key, nil); err != nil {
+			return err
+		}
+	}
+	return batch.Commit(pebble.Sync)
+}
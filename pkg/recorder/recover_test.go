@@ -0,0 +1,86 @@
+package recorder
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+func TestRecoverSalvagesDirtyState(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	opts := DefaultProcessorOptions()
+	if err := MarkSessionStart(db, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	kept := processEntry(t, db, store, opts, JournalEntry{Timestamp: 1, Path: "kept.txt", Op: "write", Data: []byte("kept")})
+	lost := processEntry(t, db, store, opts, JournalEntry{Timestamp: 2, Path: "lost.txt", Op: "write", Data: []byte("lost")})
+	if err := store.Delete(lost.CID); err != nil {
+		t.Fatal(err)
+	}
+
+	journal := NewJournal(db)
+	if err := journal.LogEvent("pending.txt", []byte("pending")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte(cas.PrefixLog+"00000000000000000001:torn"), []byte(`{"ts":1,"pa`), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte(cas.PrefixMeta+"torn.txt:00000000000000000003"), []byte(`{"path":"torn`), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Recover(db, store, opts)
+	if err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	want := RecoveryReport{Replayed: 1, DiscardedJournal: 1, DroppedMetadata: 1, MissingContent: 1, Unfinished: true}
+	if report != want {
+		t.Fatalf("Recover() = %+v, want %+v", report, want)
+	}
+
+	state, err := StateAt(db, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state) != 2 || state["kept.txt"].CID != kept.CID || state["pending.txt"].Size != len("pending") {
+		t.Fatalf("unexpected state after recovery: %+v", state)
+	}
+
+	if report, err := Recover(db, store, opts); err != nil || !report.Clean() {
+		t.Fatalf("second Recover() should be clean, got %+v err=%v", report, err)
+	}
+}
+
+func TestRecoverDropsVersionsNotMatchingTheirChunkRoot(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+	opts := testChunkOptions()
+
+	processEntry(t, db, store, opts, JournalEntry{Timestamp: 1, Path: "app.log", Data: []byte("line 1\n")})
+	meta := processEntry(t, db, store, opts, JournalEntry{Timestamp: 2, Path: "app.log", Data: []byte("line 1\nline 2\n")})
+
+	meta.Chunks[0], meta.Chunks[1] = meta.Chunks[1], meta.Chunks[0]
+	val, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(VersionKey(meta.Path, meta.Timestamp), val, pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Recover(db, store, opts)
+	if err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	if report.CorruptChunks != 1 {
+		t.Fatalf("Recover() = %+v, want one corrupt version", report)
+	}
+	if _, ok, _ := loadChunkTree(db, "app.log"); ok {
+		t.Fatalf("chunk tree of the dropped version was kept")
+	}
+}
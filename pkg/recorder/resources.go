@@ -0,0 +1,81 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// ResourceKeyPrefix holds resource usage samples of the recorded process
+// tree, keyed by zero-padded timestamp. Like markers they are session
+// bookkeeping, so they sync with the file records and readers of file
+// metadata skip them. Samples of a named namespace live under
+// resourceKeyPrefix(ns) instead.
+const ResourceKeyPrefix = SessionKeyPrefix + "resources:"
+
+func resourceKeyPrefix(ns string) string {
+	if ns == "" {
+		return ResourceKeyPrefix
+	}
+	return SessionKeyPrefix + "ns:" + ns + ":resources:"
+}
+
+// ResourceSample is one reading of the recorded process tree. CPU and I/O
+// counters are cumulative and cover live processes plus the children they
+// have already reaped.
+type ResourceSample struct {
+	Timestamp  int64   `json:"ts"`
+	Processes  int     `json:"processes"`
+	CPUSeconds float64 `json:"cpu_seconds"`
+	RSSBytes   int64   `json:"rss_bytes"`
+	ReadBytes  int64   `json:"read_bytes"`
+	WriteBytes int64   `json:"write_bytes"`
+	// DiskFreeBytes is the space available on the watch dir's filesystem.
+	DiskFreeBytes uint64 `json:"disk_free_bytes,omitempty"`
+}
+
+// RecordResourceSample stores s in namespace ns. Samples are not synced to
+// disk on their own; the recorder's periodic sync covers them.
+func RecordResourceSample(db *pebble.DB, ns string, s ResourceSample) error {
+	val, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s%020d", resourceKeyPrefix(ns), s.Timestamp)
+	if err := db.Set([]byte(key), val, pebble.NoSync); err != nil {
+		return fmt.Errorf("record resource sample: %w", err)
+	}
+	return nil
+}
+
+// ResourceSamples returns the samples of namespace ns taken between from
+// and to (inclusive), oldest first. A zero from starts at the first sample.
+func ResourceSamples(db *pebble.DB, ns string, from, to time.Time) ([]ResourceSample, error) {
+	prefix := resourceKeyPrefix(ns)
+	lower := prefix
+	if !from.IsZero() {
+		lower = fmt.Sprintf("%s%020d", prefix, from.UnixNano())
+	}
+	iter, err := db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(lower),
+		UpperBound: []byte(fmt.Sprintf("%s%020d", prefix, to.UnixNano()+1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var samples []ResourceSample
+	for iter.First(); iter.Valid(); iter.Next() {
+		var s ResourceSample
+		if err := json.Unmarshal(iter.Value(), &s); err != nil {
+			log.Printf("[recorder] skip corrupt resource sample %s: %v", iter.Key(), err)
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, iter.Error()
+}
@@ -0,0 +1,222 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+// RetentionPolicy bounds recorded history. Zero values disable a limit. The
+// newest version of every path is always kept so the latest state stays
+// reconstructible. Every version resolves to CAS objects on its own, so
+// dropping one never breaks another. A policy only applies to the paths and resource samples
+// of its Namespace; CAS objects are shared, so any that no namespace
+// references any more are collected.
+type RetentionPolicy struct {
+	MaxAge      time.Duration
+	MaxVersions int
+	// PathMaxVersions, if set, returns a version limit for path (within
+	// Namespace) that replaces MaxVersions, or 0 to keep MaxVersions.
+	PathMaxVersions func(path string) int
+	// Downsample thins older history, ordered by After. A version older
+	// than a step's After (and younger than the next step's) is kept only
+	// if it is the newest of its path in its Every-long window, which holds
+	// the state the path had when the window closed. Windows are aligned
+	// to the Unix epoch, so pruning again keeps the same versions.
+	Downsample []config.DownsampleStep
+	Namespace  string
+	// DeferCollection leaves the objects pruned versions no longer
+	// reference for a later CollectUnreferenced. It is needed while other
+	// jobs record into the store: their objects are stored before the
+	// metadata that references them.
+	DeferCollection bool
+}
+
+// PruneStats reports what Prune removed.
+type PruneStats struct {
+	Versions int
+	Objects  int
+}
+
+type versionKey struct {
+	key []byte
+	ts  int64
+}
+
+// Prune deletes metadata versions outside the policy, then CAS objects no
+// longer referenced by any remaining version or CAS reference record.
+func Prune(db *pebble.DB, store *cas.CASStore, policy RetentionPolicy, now time.Time) (PruneStats, error) {
+	var stats PruneStats
+	if db == nil {
+		return stats, fmt.Errorf("prune requires db")
+	}
+	if policy.MaxAge <= 0 && policy.MaxVersions <= 0 && policy.PathMaxVersions == nil && len(policy.Downsample) == 0 {
+		return stats, nil
+	}
+
+	byPath, err := loadVersionKeys(db)
+	if err != nil {
+		return stats, err
+	}
+
+	cutoff := now.Add(-policy.MaxAge).UnixNano()
+	batch := db.NewBatch()
+	defer batch.Close()
+	for recorded, versions := range byPath {
+		path, ok := InNamespace(recorded, policy.Namespace)
+		if !ok {
+			continue
+		}
+		maxVersions := policy.MaxVersions
+		if policy.PathMaxVersions != nil {
+			if n := policy.PathMaxVersions(path); n > 0 {
+				maxVersions = n
+			}
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i].ts > versions[j].ts })
+		windows := make(map[downsampleWindow]bool)
+		for i, v := range versions {
+			if i == 0 {
+				continue
+			}
+			tooMany := maxVersions > 0 && i >= maxVersions
+			tooOld := policy.MaxAge > 0 && v.ts < cutoff
+			thinned := false
+			if w, ok := windowOf(policy.Downsample, v.ts, now); ok {
+				// Versions are newest first: the first in a window is kept.
+				thinned = windows[w]
+				windows[w] = true
+			}
+			if !tooMany && !tooOld && !thinned {
+				continue
+			}
+			if err := batch.Delete(v.key, nil); err != nil {
+				return stats, err
+			}
+			stats.Versions++
+		}
+	}
+	if policy.MaxAge > 0 {
+		// Resource samples hold no content; age is their only limit.
+		prefix := resourceKeyPrefix(policy.Namespace)
+		end := fmt.Sprintf("%s%020d", prefix, cutoff)
+		if err := batch.DeleteRange([]byte(prefix), []byte(end), nil); err != nil {
+			return stats, err
+		}
+	}
+	if batch.Empty() {
+		return stats, nil
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return stats, fmt.Errorf("delete pruned metadata: %w", err)
+	}
+	if stats.Versions == 0 || policy.DeferCollection {
+		return stats, nil
+	}
+
+	stats.Objects, err = CollectUnreferenced(db, store)
+	return stats, err
+}
+
+// downsampleWindow identifies one window of one downsample step.
+type downsampleWindow struct {
+	step  int
+	start int64
+}
+
+// windowOf returns the window of steps that a version recorded at ts
+// falls in, or false when it is younger than every step.
+func windowOf(steps []config.DownsampleStep, ts int64, now time.Time) (downsampleWindow, bool) {
+	age := now.Sub(time.Unix(0, ts))
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		if age < step.After || step.Every <= 0 {
+			continue
+		}
+		every := step.Every.Nanoseconds()
+		return downsampleWindow{step: i, start: ts - ts%every}, true
+	}
+	return downsampleWindow{}, false
+}
+
+// loadVersionKeys groups file metadata keys by path. Values that are not file
+// records (session bookkeeping, CAS reference counts) are skipped.
+func loadVersionKeys(db *pebble.DB) (map[string][]versionKey, error) {
+	iter, err := newPrefixIter(db, cas.PrefixMeta)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	byPath := make(map[string][]versionKey)
+	for iter.First(); iter.Valid(); iter.Next() {
+		var meta MetadataRecord
+		if err := json.Unmarshal(iter.Value(), &meta); err != nil || meta.Path == "" || meta.CID == "" {
+			continue
+		}
+		key := append([]byte(nil), iter.Key()...)
+		byPath[meta.Path] = append(byPath[meta.Path], versionKey{key: key, ts: meta.Timestamp})
+	}
+	return byPath, iter.Error()
+}
+
+// CollectUnreferenced deletes CAS objects that no metadata record or CAS
+// reference count points to, returning how many were removed. Objects are
+// deleted through store, so its existence cache forgets them. Nothing may
+// be recording into db meanwhile.
+func CollectUnreferenced(db *pebble.DB, store *cas.CASStore) (int, error) {
+	live := make(map[string]bool)
+
+	iter, err := newPrefixIter(db, cas.PrefixMeta)
+	if err != nil {
+		return 0, err
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		var meta MetadataRecord
+		if err := json.Unmarshal(iter.Value(), &meta); err == nil && meta.Path != "" && meta.CID != "" {
+			live[meta.CID] = true
+			for _, c := range meta.Chunks {
+				live[c] = true
+			}
+		}
+		var ref cas.CASRefCount
+		if err := json.Unmarshal(iter.Value(), &ref); err == nil && ref.CID != "" && ref.Refs > 0 {
+			live[ref.CID] = true
+		}
+	}
+	if err := iter.Error(); err != nil {
+		iter.Close()
+		return 0, err
+	}
+	iter.Close()
+
+	casIter, err := newPrefixIter(db, cas.PrefixCAS)
+	if err != nil {
+		return 0, err
+	}
+	defer casIter.Close()
+
+	var dead []string
+	for casIter.First(); casIter.Valid(); casIter.Next() {
+		cid := strings.TrimPrefix(string(casIter.Key()), cas.PrefixCAS)
+		if !live[cid] {
+			dead = append(dead, cid)
+		}
+	}
+	if err := casIter.Error(); err != nil {
+		return 0, err
+	}
+	if len(dead) == 0 {
+		return 0, nil
+	}
+	if err := store.DeleteBatch(dead); err != nil {
+		return 0, fmt.Errorf("delete unreferenced objects: %w", err)
+	}
+	return len(dead), nil
+}
@@ -0,0 +1,192 @@
+package recorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+func TestPruneKeepsLatestAndCollectsObjects(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	now := time.Unix(1_000_000, 0)
+	opts := DefaultProcessorOptions()
+	old := processEntry(t, db, store, opts, JournalEntry{Timestamp: now.Add(-2 * time.Hour).UnixNano(), Path: "app.log", Op: "write", Data: []byte("v1")})
+	processEntry(t, db, store, opts, JournalEntry{Timestamp: now.Add(-30 * time.Minute).UnixNano(), Path: "app.log", Op: "write", Data: []byte("v2")})
+	processEntry(t, db, store, opts, JournalEntry{Timestamp: now.Add(-time.Minute).UnixNano(), Path: "app.log", Op: "write", Data: []byte("v3")})
+	stale := processEntry(t, db, store, opts, JournalEntry{Timestamp: now.Add(-3 * time.Hour).UnixNano(), Path: "config.json", Op: "write", Data: []byte("{}")})
+
+	stats, err := Prune(db, store, RetentionPolicy{MaxAge: time.Hour, MaxVersions: 2}, now)
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if stats.Versions != 1 || stats.Objects != 1 {
+		t.Fatalf("expected 1 version and 1 object pruned, got %+v", stats)
+	}
+	if ok, _ := store.Has(old.CID); ok {
+		t.Fatalf("object only referenced by the pruned version should be collected")
+	}
+	if ok, _ := store.Has(stale.CID); !ok {
+		t.Fatalf("the only version of config.json must be kept")
+	}
+
+	stats, err = Prune(db, store, RetentionPolicy{MaxVersions: 1}, now)
+	if err != nil || stats.Versions != 1 {
+		t.Fatalf("expected v2 to be pruned by MaxVersions, got %+v err=%v", stats, err)
+	}
+}
+
+func TestCollectedObjectsAreStoredAgain(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+	if _, err := store.EnableExistenceCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_000_000, 0)
+	opts := DefaultProcessorOptions()
+	old := processEntry(t, db, store, opts, JournalEntry{Timestamp: now.Add(-2 * time.Hour).UnixNano(), Path: "app.log", Op: "write", Data: []byte("v1")})
+	processEntry(t, db, store, opts, JournalEntry{Timestamp: now.Add(-time.Minute).UnixNano(), Path: "app.log", Op: "write", Data: []byte("v2")})
+	if stats, err := Prune(db, store, RetentionPolicy{MaxAge: time.Hour}, now); err != nil || stats.Objects != 1 {
+		t.Fatalf("Prune() = %+v, %v", stats, err)
+	}
+
+	// The cache must not still list the collected object as stored.
+	again := processEntry(t, db, store, opts, JournalEntry{Timestamp: now.UnixNano(), Path: "app.log", Op: "write", Data: []byte("v1")})
+	if again.CID != old.CID {
+		t.Fatalf("CID = %s, want %s", again.CID, old.CID)
+	}
+	if data, err := store.Get(again.CID); err != nil || string(data) != "v1" {
+		t.Fatalf("Get() after recording collected content again = %q, %v", data, err)
+	}
+}
+
+func TestPruneDefersCollection(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	now := time.Unix(1_000_000, 0)
+	opts := DefaultProcessorOptions()
+	old := processEntry(t, db, store, opts, JournalEntry{Timestamp: now.Add(-2 * time.Hour).UnixNano(), Path: "app.log", Op: "write", Data: []byte("v1")})
+	processEntry(t, db, store, opts, JournalEntry{Timestamp: now.Add(-time.Minute).UnixNano(), Path: "app.log", Op: "write", Data: []byte("v2")})
+	stats, err := Prune(db, store, RetentionPolicy{MaxAge: time.Hour, DeferCollection: true}, now)
+	if err != nil || stats.Versions != 1 || stats.Objects != 0 {
+		t.Fatalf("Prune() = %+v, %v; want the version pruned and its object kept", stats, err)
+	}
+	if ok, _ := store.Has(old.CID); !ok {
+		t.Fatal("deferred collection deleted an object")
+	}
+	if removed, err := CollectUnreferenced(db, store); err != nil || removed != 1 {
+		t.Fatalf("CollectUnreferenced() = %d, %v", removed, err)
+	}
+}
+
+func TestPruneAppliesPathVersionLimits(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	now := time.Unix(1_000_000, 0)
+	opts := DefaultProcessorOptions()
+	for i := 0; i < 4; i++ {
+		ts := now.Add(time.Duration(i-10) * time.Minute).UnixNano()
+		processEntry(t, db, store, opts, JournalEntry{Timestamp: ts, Path: "app.log", Op: "write", Data: []byte{'l', byte(i)}})
+		processEntry(t, db, store, opts, JournalEntry{Timestamp: ts, Path: "conf/app.yaml", Op: "write", Data: []byte{'c', byte(i)}})
+	}
+
+	policy := RetentionPolicy{
+		MaxVersions: 3,
+		PathMaxVersions: func(path string) int {
+			if path == "app.log" {
+				return 1
+			}
+			return 0
+		},
+	}
+	stats, err := Prune(db, store, policy, now)
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	// app.log keeps 1 of 4 versions, conf/app.yaml falls back to 3 of 4.
+	if stats.Versions != 4 {
+		t.Fatalf("expected 4 versions pruned, got %+v", stats)
+	}
+}
+
+func TestPruneDownsamplesOlderHistory(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	// now is on an hour boundary so every window below is whole.
+	now := time.Unix(3600*300, 0)
+	opts := DefaultProcessorOptions()
+	// One version every 10s for the last 3 hours, none on a window edge.
+	for age := 3*time.Hour - 5*time.Second; age > 0; age -= 10 * time.Second {
+		ts := now.Add(-age).UnixNano()
+		processEntry(t, db, store, opts, JournalEntry{Timestamp: ts, Path: "soak.log", Op: "write", Data: []byte(age.String())})
+	}
+
+	policy := RetentionPolicy{Downsample: []config.DownsampleStep{
+		{After: time.Hour, Every: time.Minute},
+		{After: 2 * time.Hour, Every: time.Hour},
+	}}
+	stats, err := Prune(db, store, policy, now)
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	// The last hour keeps all 360 versions, the hour before one per minute,
+	// and the oldest hour one.
+	versions, err := loadVersionKeys(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(versions["soak.log"]); got != 360+60+1 {
+		t.Fatalf("kept %d versions, want 421 (pruned %+v)", got, stats)
+	}
+	if stats.Versions != 3*360-421 || stats.Objects != stats.Versions {
+		t.Fatalf("unexpected prune stats %+v", stats)
+	}
+
+	// Each kept version holds the state at the end of its window.
+	state, err := StateAt(db, now.Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Get(state["soak.log"].CID)
+	if err != nil || string(data) != (2*time.Hour+5*time.Second).String() {
+		t.Fatalf("state 2h ago = %q, %v; want the newest version of the oldest hour", data, err)
+	}
+
+	if stats, err := Prune(db, store, policy, now); err != nil || stats.Versions != 0 {
+		t.Fatalf("pruning again should keep the same versions, got %+v err=%v", stats, err)
+	}
+}
+
+func TestPruneDropsOldResourceSamples(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	now := time.Unix(1_000_000, 0)
+	for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, 10 * time.Minute} {
+		s := ResourceSample{Timestamp: now.Add(-age).UnixNano(), Processes: 1, RSSBytes: int64(age)}
+		if err := RecordResourceSample(db, "", s); err != nil {
+			t.Fatalf("RecordResourceSample() error = %v", err)
+		}
+	}
+	samples, err := ResourceSamples(db, "", time.Time{}, now)
+	if err != nil || len(samples) != 3 || samples[0].RSSBytes != int64(3*time.Hour) {
+		t.Fatalf("expected 3 samples oldest first, got %+v err=%v", samples, err)
+	}
+	if samples, _ := ResourceSamples(db, "", now.Add(-2*time.Hour), now.Add(-time.Hour)); len(samples) != 1 {
+		t.Fatalf("range should be inclusive of from and exclude later samples, got %+v", samples)
+	}
+
+	if _, err := Prune(db, store, RetentionPolicy{MaxAge: time.Hour}, now); err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	samples, err = ResourceSamples(db, "", time.Time{}, now)
+	if err != nil || len(samples) != 1 || samples[0].Timestamp != now.Add(-10*time.Minute).UnixNano() {
+		t.Fatalf("expected only the recent sample to survive, got %+v err=%v", samples, err)
+	}
+}
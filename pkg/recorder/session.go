@@ -0,0 +1,236 @@
+package recorder
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/merkle"
+)
+
+// Session bookkeeping shares the metadata prefix with file records.
+const (
+	SessionKeyPrefix = cas.PrefixMeta + "session:"
+	SessionStartKey  = SessionKeyPrefix + "start"
+	SessionEndKey    = SessionKeyPrefix + "end"
+	SessionInfoKey   = SessionKeyPrefix + "info"
+)
+
+// SessionInfo identifies a recording: a random ID assigned when it started,
+// the command it wrapped and the agent version that recorded it.
+type SessionInfo struct {
+	ID      string   `json:"id"`
+	Command []string `json:"command,omitempty"`
+	Agent   string   `json:"agent,omitempty"`
+}
+
+// SessionEnd records when and how the recorded command finished.
+type SessionEnd struct {
+	Timestamp int64 `json:"ts"`
+	ExitCode  int   `json:"exit_code"`
+	// RecorderError is set when diffkeeper failed to record part of the
+	// session, which may then be incomplete; see MarkRecorderError.
+	RecorderError string `json:"recorder_error,omitempty"`
+	// Termination is set when the command was killed by a signal or the
+	// OOM killer; see MarkTermination.
+	Termination *Termination `json:"termination,omitempty"`
+
+	// MerkleRoot (hex) covers the final version of every path; see
+	// SealSession. Files is the number of leaves and MerkleVersion the
+	// merkle.ProofVersion the root was built with (zero for version 1).
+	MerkleRoot    string            `json:"merkle_root,omitempty"`
+	MerkleVersion int               `json:"merkle_version,omitempty"`
+	Files         int               `json:"files,omitempty"`
+	Signature     *merkle.Signature `json:"signature,omitempty"`
+}
+
+// Termination records how a recorded command that did not exit on its own
+// was ended.
+type Termination struct {
+	// Timestamp is when the kill happened, as near as it is known.
+	Timestamp int64 `json:"ts"`
+	// Signal names the signal that killed the command, e.g. "SIGKILL". It
+	// is empty when the OOM killer killed a process under the command and
+	// the command exited on its own after.
+	Signal string `json:"signal,omitempty"`
+	// OOMKilled is set when the kernel's OOM killer killed the command or
+	// a process under it during the session.
+	OOMKilled bool `json:"oom_killed,omitempty"`
+	// KernelLog holds the kernel log lines about the OOM kill, when they
+	// could be read.
+	KernelLog string `json:"kernel_log,omitempty"`
+}
+
+// IsSessionKey reports whether a metadata key holds session bookkeeping
+// rather than a file MetadataRecord.
+func IsSessionKey(key string) bool {
+	return strings.HasPrefix(key, SessionKeyPrefix)
+}
+
+// MarkSessionStart stores the session start time unless one is already set,
+// so resumed recordings keep their original anchor.
+func MarkSessionStart(db *pebble.DB, start time.Time) error {
+	if _, closer, err := db.Get([]byte(SessionStartKey)); err == nil {
+		closer.Close()
+		return nil
+	} else if !errors.Is(err, pebble.ErrNotFound) {
+		return err
+	}
+
+	val := []byte(fmt.Sprintf("%020d", start.UnixNano()))
+	return db.Set([]byte(SessionStartKey), val, pebble.Sync)
+}
+
+// MarkSessionInfo stores info, with a fresh ID, unless the session already
+// has one, and returns the stored info. Resumed recordings keep their ID.
+func MarkSessionInfo(db *pebble.DB, info SessionInfo) (SessionInfo, error) {
+	if prev, ok, err := LoadSessionInfo(db); err != nil || ok {
+		return prev, err
+	}
+
+	id, err := randomSuffix()
+	if err != nil {
+		return info, fmt.Errorf("generate session id: %w", err)
+	}
+	info.ID = id
+	val, err := json.Marshal(info)
+	if err != nil {
+		return info, err
+	}
+	return info, db.Set([]byte(SessionInfoKey), val, pebble.Sync)
+}
+
+// LoadSessionInfo returns the session info, if it was recorded.
+func LoadSessionInfo(db *pebble.DB) (SessionInfo, bool, error) {
+	val, closer, err := db.Get([]byte(SessionInfoKey))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return SessionInfo{}, false, nil
+	}
+	if err != nil {
+		return SessionInfo{}, false, err
+	}
+	defer closer.Close()
+
+	var info SessionInfo
+	if err := json.Unmarshal(val, &info); err != nil {
+		return SessionInfo{}, false, fmt.Errorf("decode session info: %w", err)
+	}
+	return info, true, nil
+}
+
+// MarkSessionEnd stores when the session ended and the command's exit code.
+func MarkSessionEnd(db *pebble.DB, end time.Time, exitCode int) error {
+	val, err := json.Marshal(SessionEnd{Timestamp: end.UnixNano(), ExitCode: exitCode})
+	if err != nil {
+		return err
+	}
+	return db.Set([]byte(SessionEndKey), val, pebble.Sync)
+}
+
+// MarkRecorderError notes on the session end record that recording the
+// session failed with err.
+func MarkRecorderError(db *pebble.DB, err error) error {
+	return updateSessionEnd(db, func(end *SessionEnd) {
+		end.RecorderError = err.Error()
+	})
+}
+
+// MarkTermination notes on the session end record how the command was
+// killed.
+func MarkTermination(db *pebble.DB, term Termination) error {
+	return updateSessionEnd(db, func(end *SessionEnd) {
+		end.Termination = &term
+	})
+}
+
+func updateSessionEnd(db *pebble.DB, update func(*SessionEnd)) error {
+	end, ok, err := LoadSessionEnd(db)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("session has not ended")
+	}
+	update(&end)
+	val, err := json.Marshal(end)
+	if err != nil {
+		return err
+	}
+	return db.Set([]byte(SessionEndKey), val, pebble.Sync)
+}
+
+// LoadSessionEnd returns the session end record, if the session has ended.
+func LoadSessionEnd(db *pebble.DB) (SessionEnd, bool, error) {
+	val, closer, err := db.Get([]byte(SessionEndKey))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return SessionEnd{}, false, nil
+	}
+	if err != nil {
+		return SessionEnd{}, false, err
+	}
+	defer closer.Close()
+
+	var end SessionEnd
+	if err := json.Unmarshal(val, &end); err != nil {
+		return SessionEnd{}, false, fmt.Errorf("decode session end: %w", err)
+	}
+	return end, true, nil
+}
+
+// SealSession computes the Merkle root over the final version of every path
+// at the session end and stores it with the end record, signed when keyPEM
+// is set. Call it once the journal has drained, so the root covers every
+// capture. A session without files is left unsealed.
+func SealSession(db *pebble.DB, keyPEM []byte) (SessionEnd, error) {
+	end, ok, err := LoadSessionEnd(db)
+	if err != nil {
+		return end, err
+	}
+	if !ok {
+		return end, fmt.Errorf("session has not ended")
+	}
+
+	records, err := StateAt(db, time.Unix(0, end.Timestamp))
+	if err != nil {
+		return end, err
+	}
+	if len(records) == 0 {
+		return end, nil
+	}
+	root, err := merkle.NewMerkleManager().SessionRoot(SessionStates(records))
+	if err != nil {
+		return end, err
+	}
+
+	end.MerkleRoot = hex.EncodeToString(root)
+	end.MerkleVersion = merkle.ProofVersion
+	end.Files = len(records)
+	end.Signature = nil
+	if len(keyPEM) > 0 {
+		if end.Signature, err = merkle.SignRoot(root, keyPEM); err != nil {
+			return end, err
+		}
+	}
+
+	val, err := json.Marshal(end)
+	if err != nil {
+		return end, err
+	}
+	return end, db.Set([]byte(SessionEndKey), val, pebble.Sync)
+}
+
+// SessionStates maps slash-separated paths to CIDs, the form hashed into a
+// session root.
+func SessionStates(records map[string]MetadataRecord) map[string]string {
+	states := make(map[string]string, len(records))
+	for path, meta := range records {
+		states[filepath.ToSlash(path)] = meta.CID
+	}
+	return states
+}
@@ -3,32 +3,221 @@ package recorder
 import (
 	"context"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/internal/metrics"
 	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/chunk"
+	"github.com/saworbit/diffkeeper/pkg/config"
 )
 
 // MetadataRecord links a logical path to a CAS object at a point in time.
+// Payloads above the chunking threshold list their chunk CIDs in Chunks; CID
+// then identifies the full contents and is not stored as a CAS object.
 type MetadataRecord struct {
-	Path      string `json:"path"`
+	Path      string   `json:"path"`
+	Timestamp int64    `json:"ts"`
+	CID       string   `json:"cid"`
+	Size      int      `json:"size"`
+	Op        string   `json:"op"`
+	Chunks    []string `json:"chunks,omitempty"`
+	// ChunkSizes are the sizes of Chunks, in order, so the next version of
+	// the path can reuse the chunks it shares with this one.
+	ChunkSizes []int `json:"chunk_sizes,omitempty"`
+	// ChunkRoot (hex) is the root of the merkle.IncrementalTree over Chunks.
+	ChunkRoot string `json:"chunk_root,omitempty"`
+	// Truncated is set when only the head and tail of a file above the
+	// capture size limit were stored; Size is then the stored size.
+	Truncated *Truncation `json:"truncated,omitempty"`
+	// Observed is set when only the size and hash were captured: CID is
+	// the SHA-256 of the content, which is not in CAS.
+	Observed bool `json:"observed,omitempty"`
+	// Appended counts the versions in a row, this one included, that only
+	// appended to the previous one. Such a version stores just the appended
+	// bytes, as the last of its Chunks after those of the previous version.
+	Appended int `json:"appended,omitempty"`
+	// Patched is set when the version was stored from the byte ranges
+	// written since the previous one. Its content was never read whole,
+	// so CID identifies its list of chunks instead; versions with the same
+	// content may then have different CIDs.
+	Patched bool `json:"patched,omitempty"`
+}
+
+// ProcessorOptions tunes how journal entries are turned into CAS objects.
+type ProcessorOptions struct {
+	// ChunkThreshold is the payload size (bytes) above which content-defined
+	// chunking is used. Zero or negative disables chunking.
+	ChunkThreshold int
+
+	// ChunkParams configures the Rabin chunker for large payloads.
+	ChunkParams chunk.Params
+
+	// NoSync publishes metadata without waiting for an fsync.
+	NoSync bool
+
+	// Workers is how many goroutines process journal entries. Entries are
+	// sharded by path, so the versions of one path are still published in
+	// journal order. Zero or negative means one.
+	Workers int
+
+	// OnStored, if set, is called after each journal entry is published.
+	// With several workers it is called concurrently.
+	OnStored func(StoredEvent)
+
+	// Pace, if set, is called with the size of each journal entry before a
+	// worker processes it, and may block to slow the processor down.
+	Pace func(n int)
+
+	// Storage, if set, returns how the content of path (within its
+	// namespace) is stored: one of the config.Storage* strategies, or ""
+	// for config.StorageAuto.
+	Storage func(path string) string
+}
+
+// StoredEvent describes a journal entry the processor has published.
+type StoredEvent struct {
 	Timestamp int64  `json:"ts"`
-	CID       string `json:"cid"`
-	Size      int    `json:"size"`
 	Op        string `json:"op"`
+	Path      string `json:"path"`
+	Size      int    `json:"size"`
+	// Dedup is set when the content was already in CAS.
+	Dedup bool `json:"dedup"`
+}
+
+// DefaultProcessorOptions returns chunking tuned for lockfiles and bundles.
+func DefaultProcessorOptions() ProcessorOptions {
+	return ProcessorOptions{
+		ChunkThreshold: 256 * 1024,
+		ChunkParams: chunk.Params{
+			MinSize: 16 * 1024,
+			AvgSize: 64 * 1024,
+			MaxSize: 256 * 1024,
+			Window:  64,
+		},
+	}
+}
+
+// storage returns the storage strategy for recorded, a journaled path.
+func (opts ProcessorOptions) storage(recorded string) string {
+	if opts.Storage == nil {
+		return ""
+	}
+	_, path := SplitNamespace(recorded)
+	return opts.Storage(path)
 }
 
 // StartProcessor launches a background worker that drains journal entries into CAS and metadata.
 func StartProcessor(db *pebble.DB, store *cas.CASStore) context.CancelFunc {
+	return StartProcessorWithOptions(db, store, DefaultProcessorOptions())
+}
+
+// StartProcessorWithOptions is StartProcessor with explicit tuning. The
+// returned function stops the worker and waits for it to exit, so the
+// database can be closed right after.
+func StartProcessorWithOptions(db *pebble.DB, store *cas.CASStore, opts ProcessorOptions) context.CancelFunc {
 	ctx, cancel := context.WithCancel(context.Background())
-	go processorLoop(ctx, db, store)
-	return cancel
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		processorLoop(ctx, db, store, opts)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
 }
 
-func processorLoop(ctx context.Context, db *pebble.DB, store *cas.CASStore) {
+// WaitIdle blocks until the journal is empty, meaning every logged event has
+// been turned into metadata, or ctx is done.
+func WaitIdle(ctx context.Context, db *pebble.DB) error {
+	for {
+		iter, err := newPrefixIter(db, cas.PrefixLog)
+		if err != nil {
+			return err
+		}
+		pending := iter.First()
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		if !pending {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// JournalLag returns how long the oldest entry still in the journal has
+// waited for the processor at now, or 0 when the journal is empty.
+func JournalLag(db *pebble.DB, now time.Time) (time.Duration, error) {
+	var oldest int64
+	for _, class := range []string{classCritical, classSmall, classLarge} {
+		iter, err := newPrefixIter(db, cas.PrefixLog+class+":")
+		if err != nil {
+			return 0, err
+		}
+		if iter.First() {
+			// Keys are l:<class>:<timestamp>:<suffix>.
+			fields := strings.SplitN(string(iter.Key()), ":", 4)
+			if len(fields) == 4 {
+				if ts, err := strconv.ParseInt(fields[2], 10, 64); err == nil && (oldest == 0 || ts < oldest) {
+					oldest = ts
+				}
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return 0, err
+		}
+	}
+	if oldest == 0 {
+		return 0, nil
+	}
+	return max(now.Sub(time.Unix(0, oldest)), 0), nil
+}
+
+// journalItem is a journal entry handed to a processor worker.
+type journalItem struct {
+	key, payload []byte
+}
+
+// shardBuffer is how many entries may queue for each processor worker.
+const shardBuffer = 64
+
+func processorLoop(ctx context.Context, db *pebble.DB, store *cas.CASStore, opts ProcessorOptions) {
+	workers := max(opts.Workers, 1)
+	metrics.ProcessorWorkers.Set(float64(workers))
+
+	var pass, running sync.WaitGroup
+	shards := make([]chan journalItem, workers)
+	for i := range shards {
+		shards[i] = make(chan journalItem, shardBuffer)
+		running.Add(1)
+		go func(worker int, items <-chan journalItem) {
+			defer running.Done()
+			processShard(db, store, opts, worker, items, &pass)
+		}(i, shards[i])
+	}
+	defer func() {
+		for _, items := range shards {
+			close(items)
+		}
+		running.Wait()
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -44,14 +233,22 @@ func processorLoop(ctx context.Context, db *pebble.DB, store *cas.CASStore) {
 			continue
 		}
 
+		large := 0
 		for iter.First(); iter.Valid(); iter.Next() {
 			processed = true
 
 			logKey := append([]byte(nil), iter.Key()...)
 			payload := append([]byte(nil), iter.Value()...)
 
-			if err := processJournalEntry(db, store, logKey, payload); err != nil {
-				log.Printf("[processor] failed to handle journal %s: %v", string(logKey), err)
+			pass.Add(1)
+			shards[journalShard(payload, workers)] <- journalItem{key: logKey, payload: payload}
+			if largeEntry(logKey) {
+				large++
+			}
+			if large == workers {
+				// The iterator does not see entries journaled since it was
+				// opened; start over so those of a higher class go first.
+				break
 			}
 		}
 
@@ -61,6 +258,8 @@ func processorLoop(ctx context.Context, db *pebble.DB, store *cas.CASStore) {
 		if err := iter.Error(); err != nil {
 			log.Printf("[processor] iterator error: %v", err)
 		}
+		// Entries still queued would be seen again by the next scan.
+		pass.Wait()
 
 		if !processed {
 			select {
@@ -72,7 +271,41 @@ func processorLoop(ctx context.Context, db *pebble.DB, store *cas.CASStore) {
 	}
 }
 
-func processJournalEntry(db *pebble.DB, store *cas.CASStore, logKey, payload []byte) error {
+// processShard processes the entries of one worker's shard in the order
+// they arrive, marking each done on pass.
+func processShard(db *pebble.DB, store *cas.CASStore, opts ProcessorOptions, worker int, items <-chan journalItem, pass *sync.WaitGroup) {
+	entries := metrics.ProcessorEntriesTotal.WithLabelValues(strconv.Itoa(worker))
+	for item := range items {
+		if opts.Pace != nil {
+			opts.Pace(len(item.payload))
+		}
+		if err := processJournalEntry(db, store, opts, item.key, item.payload); err != nil {
+			log.Printf("[processor] failed to handle journal %s: %v", string(item.key), err)
+		}
+		entries.Inc()
+		pass.Done()
+	}
+}
+
+// journalShard returns the worker that processes the journal entry in
+// payload: every entry of a path goes to the same one. Entries that do not
+// decode go to the first worker, which logs them.
+func journalShard(payload []byte, workers int) int {
+	if workers == 1 {
+		return 0
+	}
+	var entry struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(entry.Path))
+	return int(h.Sum32() % uint32(workers))
+}
+
+func processJournalEntry(db *pebble.DB, store *cas.CASStore, opts ProcessorOptions, logKey, payload []byte) error {
 	if db == nil || store == nil {
 		return fmt.Errorf("processor requires db and store")
 	}
@@ -85,20 +318,111 @@ func processJournalEntry(db *pebble.DB, store *cas.CASStore, logKey, payload []b
 	if entry.Op == "" {
 		entry.Op = "write"
 	}
-
-	hash := sha256.Sum256(entry.Data)
-
-	cid, _, err := store.PutChunkWithHash(hash, entry.Data)
-	if err != nil {
-		return fmt.Errorf("store CAS chunk: %w", err)
+	if IsAttrOp(entry.Op) {
+		return processAttrEntry(db, opts, logKey, entry)
 	}
 
 	meta := MetadataRecord{
 		Path:      entry.Path,
 		Timestamp: entry.Timestamp,
-		CID:       cid,
 		Size:      len(entry.Data),
 		Op:        entry.Op,
+		Truncated: entry.Truncated,
+	}
+	var dedup bool
+
+	base, found, err := latestVersion(db, entry.Path)
+	if err != nil {
+		return fmt.Errorf("look up previous version: %w", err)
+	}
+	storage := opts.storage(entry.Path)
+	params := opts.ChunkParams
+	params.Lines = storage == config.StorageLines
+	// Content stored as one object is stored whole again when it grows.
+	appended := found && storage != config.StorageStore && storage != config.StorageWhole && appendsTo(base, entry)
+	// A long run of appends is stored through the chunker once more.
+	rechunk := appended && base.Appended >= maxAppendRun
+	chunked := rechunk || len(entry.Data) > 0 && (storage == config.StorageChunk || storage == config.StorageLines)
+	if storage == "" || storage == config.StorageAuto {
+		chunked = chunked || opts.ChunkThreshold > 0 && len(entry.Data) > opts.ChunkThreshold
+	}
+
+	if entry.Observed != nil {
+		meta.CID = entry.Observed.SHA256
+		meta.Size = int(entry.Observed.Size)
+		meta.Observed = true
+	} else if entry.Patch != nil {
+		if !found || !patchesOnto(base, entry) {
+			// Without the content the ranges were written over, the
+			// version cannot be reconstructed; the next full capture
+			// records the file again.
+			log.Printf("[processor] drop patch of %s: its base is not the latest version", entry.Path)
+			if err := db.Delete(logKey, pebble.Sync); err != nil {
+				return fmt.Errorf("delete journal key: %w", err)
+			}
+			return nil
+		}
+		stored, err := storePatched(store, base, entry, params)
+		if err != nil {
+			return err
+		}
+		meta.Size = int(entry.Patch.Size)
+		meta.CID = chunkListID(stored.cids)
+		meta.Chunks = stored.cids
+		meta.ChunkSizes = stored.sizes
+		meta.Patched = true
+		dedup = stored.fresh == 0
+	} else if appended && !rechunk {
+		suffix := entry.Data[base.Size:]
+		cid, written, err := store.PutChunkWithHash(sha256.Sum256(suffix), suffix)
+		if err != nil {
+			return fmt.Errorf("store appended bytes: %w", err)
+		}
+		meta.CID = contentID(entry.Data)
+		meta.Chunks = append(slices.Clone(base.objects()), cid)
+		if sizes := base.objectSizes(); sizes != nil {
+			meta.ChunkSizes = append(slices.Clone(sizes), len(suffix))
+		}
+		meta.Appended = base.Appended + 1
+		dedup = written == 0
+		metrics.ObserveStorageSavings(int64(len(entry.Data)), int64(len(suffix)))
+	} else if chunked {
+		stored, err := storeChunked(store, entry.Data, params, base)
+		if err != nil {
+			return err
+		}
+		meta.CID = contentID(entry.Data)
+		meta.Chunks = stored.cids
+		meta.ChunkSizes = stored.sizes
+		dedup = stored.fresh == 0
+	} else if storage == config.StorageStore {
+		cid, written, err := storeUncompressed(store, entry.Data)
+		if err != nil {
+			return err
+		}
+		meta.CID = cid
+		dedup = written == 0
+	} else {
+		hash := sha256.Sum256(entry.Data)
+
+		cid, written, err := store.PutChunkWithHash(hash, entry.Data)
+		if err != nil {
+			return fmt.Errorf("store CAS chunk: %w", err)
+		}
+		meta.CID = cid
+		dedup = written == 0
+	}
+
+	var tree []byte
+	if len(meta.Chunks) > 0 {
+		t, err := chunkTree(db, base, meta, appended && !rechunk)
+		if err != nil {
+			return fmt.Errorf("load chunk tree: %w", err)
+		}
+		meta.ChunkRoot = hex.EncodeToString(t.Root())
+		if tree, err = t.MarshalBinary(); err != nil {
+			return fmt.Errorf("encode chunk tree: %w", err)
+		}
 	}
 
 	metaBytes, err := json.Marshal(meta)
@@ -106,16 +430,40 @@ func processJournalEntry(db *pebble.DB, store *cas.CASStore, logKey, payload []b
 		return fmt.Errorf("marshal metadata: %w", err)
 	}
 
-	metaKey := []byte(fmt.Sprintf("%s%s:%020d", cas.PrefixMeta, entry.Path, entry.Timestamp))
+	metaKey := VersionKey(entry.Path, entry.Timestamp)
 
-	if err := db.Set(metaKey, metaBytes, pebble.Sync); err != nil {
+	// Publish the version and retire the journal entry atomically.
+	batch := db.NewBatch()
+	defer batch.Close()
+	if err := batch.Set(metaKey, metaBytes, nil); err != nil {
 		return fmt.Errorf("write metadata: %w", err)
 	}
-
-	if err := db.Delete(logKey, pebble.Sync); err != nil {
+	if err := advanceLatest(db, batch, entry.Path, entry.Timestamp); err != nil {
+		return fmt.Errorf("index metadata: %w", err)
+	}
+	// Only the latest version's chunk tree is kept.
+	if latest := !found || entry.Timestamp > base.Timestamp; latest && tree != nil {
+		err = batch.Set(chunkTreeKey(entry.Path), tree, nil)
+	} else if latest && base.ChunkRoot != "" {
+		err = batch.Delete(chunkTreeKey(entry.Path), nil)
+	}
+	if err != nil {
+		return fmt.Errorf("write chunk tree: %w", err)
+	}
+	if err := batch.Delete(logKey, nil); err != nil {
 		return fmt.Errorf("delete journal key: %w", err)
 	}
+	writeOpts := pebble.Sync
+	if opts.NoSync {
+		writeOpts = pebble.NoSync
+	}
+	if err := batch.Commit(writeOpts); err != nil {
+		return fmt.Errorf("commit metadata: %w", err)
+	}
 
+	if opts.OnStored != nil {
+		opts.OnStored(StoredEvent{Timestamp: meta.Timestamp, Op: meta.Op, Path: meta.Path, Size: meta.Size, Dedup: dedup})
+	}
 	return nil
 }
 
@@ -0,0 +1,458 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/chunk"
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+func setupTestStore(tb testing.TB) (*pebble.DB, *cas.CASStore, func()) {
+	tb.Helper()
+
+	tmpDir := tb.TempDir()
+
+	db, err := pebble.Open(tmpDir, &pebble.Options{})
+	if err != nil {
+		tb.Fatalf("Failed to open test database: %v", err)
+	}
+
+	store, err := cas.NewCASStore(db, "sha256")
+	if err != nil {
+		tb.Fatalf("NewCASStore() error = %v", err)
+	}
+
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(tmpDir)
+	}
+
+	return db, store, cleanup
+}
+
+func testChunkOptions() ProcessorOptions {
+	return ProcessorOptions{
+		ChunkThreshold: 4 * 1024,
+		ChunkParams: chunk.Params{
+			MinSize: 512,
+			AvgSize: 1024,
+			MaxSize: 4096,
+			Window:  32,
+		},
+	}
+}
+
+// processEntry runs a single journal entry through the processor and returns its metadata.
+func processEntry(tb testing.TB, db *pebble.DB, store *cas.CASStore, opts ProcessorOptions, entry JournalEntry) MetadataRecord {
+	tb.Helper()
+
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		tb.Fatalf("marshal entry: %v", err)
+	}
+	if err := processJournalEntry(db, store, opts, []byte(cas.PrefixLog+"test"), payload); err != nil {
+		tb.Fatalf("processJournalEntry() error = %v", err)
+	}
+
+	iter, err := newPrefixIter(db, string(VersionKeyPrefix(entry.Path)))
+	if err != nil {
+		tb.Fatalf("iterator: %v", err)
+	}
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		var meta MetadataRecord
+		if err := json.Unmarshal(iter.Value(), &meta); err != nil {
+			tb.Fatalf("decode metadata: %v", err)
+		}
+		if meta.Timestamp == entry.Timestamp {
+			return meta
+		}
+	}
+	tb.Fatalf("metadata for %s@%d not found", entry.Path, entry.Timestamp)
+	return MetadataRecord{}
+}
+
+func TestProcessorChunksLargePayloads(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	opts := testChunkOptions()
+
+	base := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(base)
+
+	v1 := processEntry(t, db, store, opts, JournalEntry{Timestamp: 1, Path: "package-lock.json", Op: "write", Data: base})
+	if len(v1.Chunks) < 2 {
+		t.Fatalf("expected payload to be chunked, got %d chunk(s)", len(v1.Chunks))
+	}
+
+	before, err := store.GetStats()
+	if err != nil {
+		t.Fatalf("GetStats() error = %v", err)
+	}
+
+	// Append a small tail: everything but the final chunk(s) should be reused.
+	v2Data := append(append([]byte(nil), base...), []byte("tail change")...)
+	v2 := processEntry(t, db, store, opts, JournalEntry{Timestamp: 2, Path: "package-lock.json", Op: "write", Data: v2Data})
+
+	after, err := store.GetStats()
+	if err != nil {
+		t.Fatalf("GetStats() error = %v", err)
+	}
+	if added := after.TotalObjects - before.TotalObjects; added >= len(v2.Chunks) {
+		t.Fatalf("expected chunk reuse across versions, %d new objects for %d chunks", added, len(v2.Chunks))
+	}
+
+	got, err := ReadContent(store, v2)
+	if err != nil {
+		t.Fatalf("ReadContent() error = %v", err)
+	}
+	if !bytes.Equal(got, v2Data) {
+		t.Fatalf("reassembled content mismatch")
+	}
+
+	rc, err := OpenContent(store, v2)
+	if err != nil {
+		t.Fatalf("OpenContent() error = %v", err)
+	}
+	defer rc.Close()
+	streamed, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read streamed content: %v", err)
+	}
+	if !bytes.Equal(streamed, v2Data) {
+		t.Fatalf("streamed content mismatch")
+	}
+}
+
+func TestStoreChunkedKeepsManifestOrder(t *testing.T) {
+	_, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	params := testChunkOptions().ChunkParams
+	data := make([]byte, 512*1024)
+	rand.New(rand.NewSource(7)).Read(data)
+
+	// The serial chunker, hashing as it goes, gives the expected manifest.
+	var want []string
+	chunker := chunk.NewRabinChunker(bytes.NewReader(data), params)
+	for {
+		c, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, hex.EncodeToString(c.Ref.Hash[:]))
+	}
+	if len(want) < 100 {
+		t.Fatalf("expected many chunks to exercise the pipeline, got %d", len(want))
+	}
+
+	stored, err := storeChunked(store, data, params, MetadataRecord{})
+	if err != nil {
+		t.Fatalf("storeChunked() error = %v", err)
+	}
+	if !slices.Equal(stored.cids, want) {
+		t.Fatalf("manifest out of order: %d chunks, want %d", len(stored.cids), len(want))
+	}
+	if stored.fresh != len(want) {
+		t.Fatalf("fresh = %d, want %d", stored.fresh, len(want))
+	}
+	got, err := ReadContent(store, MetadataRecord{Path: "big.bin", Size: len(data), Chunks: stored.cids})
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("reassembled content mismatch: %v", err)
+	}
+
+	if again, err := storeChunked(store, data, params, MetadataRecord{}); err != nil || again.fresh != 0 {
+		t.Fatalf("storing again should reuse every chunk, fresh = %d err = %v", again.fresh, err)
+	}
+}
+
+func TestProcessorReusesUnchangedChunkRuns(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+	opts := testChunkOptions()
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(11)).Read(data)
+	first := processEntry(t, db, store, opts, JournalEntry{Timestamp: 1, Path: "disk.img", Data: data})
+	if len(first.ChunkSizes) != len(first.Chunks) {
+		t.Fatalf("chunk sizes = %d, want one per chunk (%d)", len(first.ChunkSizes), len(first.Chunks))
+	}
+
+	edited := slices.Clone(data)
+	copy(edited[len(edited)/2:], "patched in place")
+	second := processEntry(t, db, store, opts, JournalEntry{Timestamp: 2, Path: "disk.img", Data: edited})
+
+	head, tail := sharedRuns(edited, first)
+	if head == 0 || tail == 0 || head+tail < len(first.Chunks)-2 {
+		t.Fatalf("shared runs = %d+%d of %d chunks, want all but the edited region", head, tail, len(first.Chunks))
+	}
+	if !slices.Equal(second.Chunks[:head], first.Chunks[:head]) ||
+		!slices.Equal(second.Chunks[len(second.Chunks)-tail:], first.Chunks[len(first.Chunks)-tail:]) {
+		t.Fatalf("second manifest does not keep the unchanged runs")
+	}
+	got, err := ReadContent(store, second)
+	if err != nil || !bytes.Equal(got, edited) {
+		t.Fatalf("edited content mismatch: %v", err)
+	}
+
+	third := processEntry(t, db, store, opts, JournalEntry{Timestamp: 3, Path: "disk.img", Data: edited})
+	if !slices.Equal(third.Chunks, second.Chunks) || !slices.Equal(third.ChunkSizes, second.ChunkSizes) {
+		t.Fatalf("unchanged content should reuse the whole manifest")
+	}
+}
+
+func TestProcessorStoresSmallPayloadsWhole(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	data := []byte("INIT: System OK")
+	meta := processEntry(t, db, store, testChunkOptions(), JournalEntry{Timestamp: 1, Path: "status.log", Data: data})
+
+	if len(meta.Chunks) != 0 {
+		t.Fatalf("small payload should not be chunked")
+	}
+	if meta.Op != "write" {
+		t.Fatalf("expected default op 'write', got %q", meta.Op)
+	}
+
+	got, err := ReadContent(store, meta)
+	if err != nil {
+		t.Fatalf("ReadContent() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("content mismatch: %q", got)
+	}
+}
+
+func TestProcessorRecordsDirectoryOps(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	entries := []JournalEntry{
+		{Timestamp: 100, Path: "cache", Op: OpMkdir, Mode: fs.ModeDir | 0o755},
+		{Timestamp: 200, Path: "tmp", Op: OpMkdir, Mode: fs.ModeDir | 0o755},
+		{Timestamp: 300, Path: "run.sh", Op: OpChmod, Mode: 0o755},
+		{Timestamp: 400, Path: "cache", Op: OpChmod, Mode: fs.ModeDir | 0o700},
+		{Timestamp: 500, Path: "tmp", Op: OpRmdir, Mode: fs.ModeDir | 0o755},
+	}
+	for i, entry := range entries {
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatalf("marshal entry: %v", err)
+		}
+		logKey := []byte(fmt.Sprintf("%s%d", cas.PrefixLog, i))
+		if err := processJournalEntry(db, store, DefaultProcessorOptions(), logKey, payload); err != nil {
+			t.Fatalf("processJournalEntry(%s %s) error = %v", entry.Op, entry.Path, err)
+		}
+	}
+
+	attrs, err := AttrsAt(db, time.Unix(0, 250))
+	if err != nil {
+		t.Fatalf("AttrsAt() error = %v", err)
+	}
+	if len(attrs) != 2 || attrs["cache"].Mode != fs.ModeDir|0o755 || !attrs["tmp"].IsDir() {
+		t.Fatalf("unexpected attributes at 250: %+v", attrs)
+	}
+
+	attrs, err = AttrsAt(db, time.Unix(0, 1000))
+	if err != nil {
+		t.Fatalf("AttrsAt() error = %v", err)
+	}
+	if attrs["cache"].Mode != fs.ModeDir|0o700 || attrs["tmp"].Op != OpRmdir || attrs["run.sh"].IsDir() {
+		t.Fatalf("unexpected attributes at 1000: %+v", attrs)
+	}
+
+	// Directory and mode records are not file versions.
+	state, err := StateAt(db, time.Unix(0, 1000))
+	if err != nil {
+		t.Fatalf("StateAt() error = %v", err)
+	}
+	if len(state) != 0 {
+		t.Fatalf("attribute records leaked into file state: %+v", state)
+	}
+}
+
+func TestProcessorReportsStoredEvents(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	var events []StoredEvent
+	opts := DefaultProcessorOptions()
+	opts.OnStored = func(ev StoredEvent) { events = append(events, ev) }
+
+	processEntry(t, db, store, opts, JournalEntry{Path: "a.txt", Timestamp: 1, Data: []byte("same")})
+	processEntry(t, db, store, opts, JournalEntry{Path: "b.txt", Timestamp: 2, Data: []byte("same")})
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %+v", events)
+	}
+	if events[0].Dedup || events[0].Path != "a.txt" || events[0].Size != 4 || events[0].Op != "write" {
+		t.Fatalf("first event = %+v, want new content", events[0])
+	}
+	if !events[1].Dedup {
+		t.Fatalf("second event = %+v, want dedup hit", events[1])
+	}
+}
+
+func TestShardedProcessorKeepsPathOrder(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	var mu sync.Mutex
+	stored := make(map[string][]int64)
+	opts := DefaultProcessorOptions()
+	opts.Workers = 4
+	opts.OnStored = func(ev StoredEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		stored[ev.Path] = append(stored[ev.Path], ev.Timestamp)
+	}
+
+	journal := NewJournal(db)
+	const paths, versions = 16, 5
+	for v := 0; v < versions; v++ {
+		for p := 0; p < paths; p++ {
+			if err := journal.LogEvent(fmt.Sprintf("f%d.txt", p), []byte(fmt.Sprintf("v%d", v))); err != nil {
+				t.Fatalf("LogEvent() error = %v", err)
+			}
+		}
+	}
+
+	stopProcessor := StartProcessorWithOptions(db, store, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitIdle(ctx, db); err != nil {
+		t.Fatalf("WaitIdle() error = %v", err)
+	}
+	stopProcessor()
+
+	state, err := StateAt(db, time.Now())
+	if err != nil {
+		t.Fatalf("StateAt() error = %v", err)
+	}
+	for p := 0; p < paths; p++ {
+		path := fmt.Sprintf("f%d.txt", p)
+		got := stored[path]
+		if len(got) != versions {
+			t.Fatalf("%s: stored %d versions, want %d", path, len(got), versions)
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i] <= got[i-1] {
+				t.Fatalf("%s: versions published out of order: %v", path, got)
+			}
+		}
+		data, err := ReadContent(store, state[path])
+		if err != nil {
+			t.Fatalf("ReadContent(%s) error = %v", path, err)
+		}
+		if want := fmt.Sprintf("v%d", versions-1); string(data) != want {
+			t.Fatalf("%s: latest = %q, want %q", path, data, want)
+		}
+	}
+}
+
+func TestProcessorStorageStrategies(t *testing.T) {
+	db, store, cleanup := setupTestStore(t)
+	defer cleanup()
+	opts := testChunkOptions()
+	opts.Storage = func(path string) string {
+		switch {
+		case strings.HasSuffix(path, ".png"):
+			return config.StorageStore
+		case strings.HasSuffix(path, ".sql"):
+			return config.StorageWhole
+		case strings.HasSuffix(path, ".tar"):
+			return config.StorageChunk
+		case strings.HasSuffix(path, ".txt"):
+			return config.StorageLines
+		}
+		return ""
+	}
+	readBack := func(meta MetadataRecord, want []byte) {
+		t.Helper()
+		got, err := ReadContent(store, meta)
+		if err != nil {
+			t.Fatalf("ReadContent(%s) error = %v", meta.Path, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("content of %s mismatch", meta.Path)
+		}
+	}
+
+	// store keeps the object as it is, unless it would read as compressed.
+	img := bytes.Repeat([]byte("png"), 4096)
+	meta := processEntry(t, db, store, opts, JournalEntry{Timestamp: 1, Path: "logo.png", Data: img})
+	raw, closer, err := db.Get([]byte(cas.PrefixCAS + meta.CID))
+	if err != nil {
+		t.Fatalf("raw object of logo.png: %v", err)
+	}
+	stored := bytes.Equal(raw, img)
+	closer.Close()
+	if len(meta.Chunks) != 0 || !stored {
+		t.Fatalf("logo.png was not stored as one uncompressed object: %+v", meta)
+	}
+	readBack(meta, img)
+	magic := append([]byte("DKZ1"), img...)
+	readBack(processEntry(t, db, store, opts, JournalEntry{Timestamp: 2, Path: "logo.png", Data: magic}), magic)
+
+	// whole never chunks, nor stores appends as a suffix.
+	dump := make([]byte, 64*1024)
+	rand.New(rand.NewSource(5)).Read(dump)
+	meta = processEntry(t, db, store, opts, JournalEntry{Timestamp: 1, Path: "dump.sql", Data: dump})
+	if len(meta.Chunks) != 0 {
+		t.Fatalf("dump.sql was chunked: %d chunks", len(meta.Chunks))
+	}
+	dump = append(dump, "more"...)
+	meta = processEntry(t, db, store, opts, JournalEntry{Timestamp: 2, Path: "dump.sql", Data: dump})
+	if len(meta.Chunks) != 0 || meta.Appended != 0 {
+		t.Fatalf("append to dump.sql = %+v", meta)
+	}
+	readBack(meta, dump)
+
+	// chunk chunks content below the threshold.
+	tarball := dump[:3000]
+	meta = processEntry(t, db, store, opts, JournalEntry{Timestamp: 1, Path: "app.tar", Data: tarball})
+	if len(meta.Chunks) < 2 {
+		t.Fatalf("app.tar has %d chunks, want several", len(meta.Chunks))
+	}
+	readBack(meta, tarball)
+
+	// lines cuts chunks at line ends.
+	var text []byte
+	for i := 0; len(text) < 32*1024; i++ {
+		text = fmt.Appendf(text, "row %d: %x\n", i, dump[i%1000:i%1000+i%24])
+	}
+	meta = processEntry(t, db, store, opts, JournalEntry{Timestamp: 1, Path: "notes.txt", Data: text})
+	if len(meta.Chunks) < 2 {
+		t.Fatalf("notes.txt has %d chunks, want several", len(meta.Chunks))
+	}
+	off := 0
+	for _, size := range meta.ChunkSizes {
+		off += size
+		if text[off-1] != '\n' {
+			t.Fatalf("chunk of notes.txt ending at %d is not cut at a line end", off)
+		}
+	}
+	readBack(meta, text)
+}
@@ -0,0 +1,243 @@
+package remote
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+)
+
+// Scopes granted to the credentials of a sync server. Each scope includes
+// the ones before it: read lists what the server holds and fetches metadata,
+// export also fetches file content (pull), write also pushes, and admin also
+// runs operations that delete served state, such as gc.
+const (
+	ScopeRead   = "read"
+	ScopeExport = "export"
+	ScopeWrite  = "write"
+	ScopeAdmin  = "admin"
+)
+
+// EnvToken holds the bearer token push and pull send to http(s) remotes.
+const EnvToken = "DIFFKEEPER_REMOTE_TOKEN"
+
+var scopeRank = map[string]int{ScopeRead: 1, ScopeExport: 2, ScopeWrite: 3, ScopeAdmin: 4}
+
+// Access maps the credentials a sync server accepts to their grants:
+// bearer tokens and, over mutual TLS, client certificate common names.
+type Access struct {
+	// tokens is keyed by the SHA-256 of each token, so a lookup does not
+	// compare secrets byte by byte.
+	tokens map[[32]byte]grant
+	names  map[string]grant
+}
+
+// grant is what one credential may do: its scope and, when namespaces is
+// set, the only namespaces it may record into.
+type grant struct {
+	scope      string
+	namespaces []string
+}
+
+// allowsNamespace reports whether g may record into ns.
+func (g grant) allowsNamespace(ns string) bool {
+	return g.namespaces == nil || slices.Contains(g.namespaces, ns)
+}
+
+// LoadAccess reads an access file; see ParseAccess.
+func LoadAccess(path string) (*Access, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open access file: %w", err)
+	}
+	defer f.Close()
+	access, err := ParseAccess(f)
+	if err != nil {
+		return nil, fmt.Errorf("access file %s: %w", path, err)
+	}
+	return access, nil
+}
+
+// ParseAccess reads one credential per line, as "<scope> token:<secret>"
+// or "<scope> cn:<client certificate common name>", optionally followed by
+// "ns:<namespace>[,<namespace>...]" to bind the credential to those
+// namespaces. Blank lines and lines starting with # are ignored.
+func ParseAccess(r io.Reader) (*Access, error) {
+	access := &Access{tokens: make(map[[32]byte]grant), names: make(map[string]grant)}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want \"<scope> token:<secret> [ns:<namespaces>]\" or \"<scope> cn:<name> [ns:<namespaces>]\"", n)
+		}
+		g, cred := grant{scope: fields[0]}, fields[1]
+		if scopeRank[g.scope] == 0 {
+			return nil, fmt.Errorf("line %d: unknown scope %q (want %s, %s, %s or %s)", n, g.scope, ScopeRead, ScopeExport, ScopeWrite, ScopeAdmin)
+		}
+		if len(fields) == 3 {
+			list, ok := strings.CutPrefix(fields[2], "ns:")
+			if !ok || list == "" {
+				return nil, fmt.Errorf("line %d: want ns:<namespace>[,<namespace>...] after the credential, got %q", n, fields[2])
+			}
+			for _, ns := range strings.Split(list, ",") {
+				if ns == "" {
+					return nil, fmt.Errorf("line %d: empty namespace in %q", n, fields[2])
+				}
+				if err := config.ValidateNamespace(ns); err != nil {
+					return nil, fmt.Errorf("line %d: %w", n, err)
+				}
+				g.namespaces = append(g.namespaces, ns)
+			}
+		}
+		kind, value, _ := strings.Cut(cred, ":")
+		if value == "" {
+			return nil, fmt.Errorf("line %d: empty credential", n)
+		}
+		switch kind {
+		case "token":
+			access.tokens[sha256.Sum256([]byte(value))] = g
+		case "cn":
+			access.names[value] = g
+		default:
+			return nil, fmt.Errorf("line %d: unknown credential type %q (want token or cn)", n, kind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(access.tokens) == 0 && len(access.names) == 0 {
+		return nil, fmt.Errorf("no credentials")
+	}
+	return access, nil
+}
+
+// NeedsClientCerts reports whether any credential is a client certificate.
+func (a *Access) NeedsClientCerts() bool {
+	return len(a.names) > 0
+}
+
+// scopeOf returns the scope of the credentials r presents. A bearer token,
+// when sent, must be valid; otherwise a verified client certificate is used.
+// Sync requests span every namespace, so credentials bound to namespaces
+// are not accepted.
+func (a *Access) scopeOf(r *http.Request) (string, bool) {
+	g, ok := a.grant(r.Header.Get("Authorization"), r.TLS)
+	if !ok || g.namespaces != nil {
+		return "", false
+	}
+	return g.scope, true
+}
+
+// Authorize reports whether the credentials of a request grant required in
+// namespace ns: auth is its Authorization header ("Bearer <token>", or
+// empty) and state its TLS connection, if any. Servers other than the sync
+// server, such as the ingest collector, check their clients with it.
+func (a *Access) Authorize(auth string, state *tls.ConnectionState, required, ns string) bool {
+	g, ok := a.grant(auth, state)
+	return ok && scopeAllows(g.scope, required) && g.allowsNamespace(ns)
+}
+
+func (a *Access) grant(auth string, state *tls.ConnectionState) (grant, bool) {
+	if auth != "" {
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok {
+			return grant{}, false
+		}
+		g, ok := a.tokens[sha256.Sum256([]byte(token))]
+		return g, ok
+	}
+	if state != nil && len(state.VerifiedChains) > 0 {
+		g, ok := a.names[state.VerifiedChains[0][0].Subject.CommonName]
+		return g, ok
+	}
+	return grant{}, false
+}
+
+// requiredScope is the scope a request needs. Fetching CAS objects or
+// packs returns recorded file content and needs export; metadata alone
+// only needs read.
+func requiredScope(req Request) string {
+	switch req.Op {
+	case OpPut:
+		return ScopeWrite
+	case OpGC:
+		return ScopeAdmin
+	case OpGet:
+		for _, key := range req.Keys {
+			if strings.HasPrefix(key, cas.PrefixCAS) || strings.HasPrefix(key, cas.PrefixPack) {
+				return ScopeExport
+			}
+		}
+	}
+	return ScopeRead
+}
+
+// scopeAllows reports whether granted includes required.
+func scopeAllows(granted, required string) bool {
+	return scopeRank[granted] >= scopeRank[required]
+}
+
+// ServerTLS loads the certificate a sync server presents. With clientCA
+// set, clients may present certificates signed by it, which are verified
+// and matched against cn: credentials.
+func ServerTLS(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		if cfg.ClientCAs, err = loadCertPool(clientCA); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// ClientTLS configures how push and pull reach an https remote: caFile,
+// when set, replaces the system roots, and certFile/keyFile are presented
+// as the client certificate.
+func ClientTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA certificates: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
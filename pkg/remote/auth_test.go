@@ -0,0 +1,214 @@
+package remote
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+func TestParseAccessRejectsBadLines(t *testing.T) {
+	for _, file := range []string{
+		"",
+		"# only comments\n",
+		"owner token:abc\n",
+		"read password:abc\n",
+		"read token:\n",
+		"read token:abc extra\n",
+		"write token:abc ns:\n",
+		"write token:abc ns:ci,,build\n",
+		"write token:abc ns:ci/../x\n",
+		"write token:abc ns:ci more\n",
+	} {
+		if _, err := ParseAccess(strings.NewReader(file)); err == nil {
+			t.Errorf("ParseAccess(%q) should fail", file)
+		}
+	}
+}
+
+func TestAccessBindsNamespaces(t *testing.T) {
+	access, err := ParseAccess(strings.NewReader("write token:runner ns:ci,build\nwrite token:any\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		token, ns string
+		want      bool
+	}{
+		{"runner", "ci", true},
+		{"runner", "build", true},
+		{"runner", "other", false},
+		{"runner", "", false},
+		{"any", "other", true},
+		{"any", "", true},
+	} {
+		if got := access.Authorize("Bearer "+tc.token, nil, ScopeWrite, tc.ns); got != tc.want {
+			t.Errorf("Authorize(%s, %q) = %v, want %v", tc.token, tc.ns, got, tc.want)
+		}
+	}
+
+	// Sync requests are not namespaced, so a bound token cannot use them.
+	r := httptest.NewRequest(http.MethodPost, HTTPPath, nil)
+	r.Header.Set("Authorization", "Bearer runner")
+	if _, ok := access.scopeOf(r); ok {
+		t.Error("a namespace-bound token was accepted by the sync server")
+	}
+}
+
+func TestHTTPAccessScopes(t *testing.T) {
+	remoteDB := openTestDB(t)
+	set(t, remoteDB, casObject("A"), "A")
+	set(t, remoteDB, cas.PrefixMeta+"file:1", "meta")
+
+	access, err := ParseAccess(strings.NewReader("# ci runners\nread token:reader\nexport token:exporter\nwrite token:writer\nadmin token:admin\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(remoteDB, false)
+	handler.RequireAccess(access)
+	mux := http.NewServeMux()
+	mux.Handle(HTTPPath, handler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	transfer := func(token string, push bool) error {
+		t.Helper()
+		local := openTestDB(t)
+		set(t, local, casObject("B"), "B")
+		tr, err := Dial(srv.URL, DialOptions{Token: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if push {
+			_, err = Push(local, tr)
+		} else {
+			_, err = Pull(local, tr)
+		}
+		return err
+	}
+
+	for _, token := range []string{"", "guess"} {
+		if err := transfer(token, false); err == nil || !strings.Contains(err.Error(), "401") {
+			t.Errorf("pull with token %q: %v, want 401", token, err)
+		}
+	}
+	send := func(token string, req Request) error {
+		t.Helper()
+		tr, err := Dial(srv.URL, DialOptions{Token: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = call(tr, req)
+		return err
+	}
+	if err := send("reader", Request{Op: OpGet, Keys: []string{cas.PrefixMeta + "file:1"}}); err != nil {
+		t.Errorf("read token should fetch metadata: %v", err)
+	}
+	if err := transfer("reader", false); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("read token pull: %v, want 403", err)
+	}
+	if err := transfer("exporter", false); err != nil {
+		t.Errorf("export token should pull: %v", err)
+	}
+	if err := transfer("exporter", true); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("export token push: %v, want 403", err)
+	}
+	if err := transfer("writer", true); err != nil {
+		t.Errorf("write token should push: %v", err)
+	}
+	if _, ok := get(t, remoteDB, casObject("B")); !ok {
+		t.Error("pushed object missing on the remote")
+	}
+
+	if err := send("writer", Request{Op: OpGC}); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("write token gc: %v, want 403", err)
+	}
+	// The push above is over.
+	handler.lastPut.Store(time.Now().Add(-pushIdle).UnixNano())
+	if err := send("admin", Request{Op: OpGC}); err != nil {
+		t.Errorf("admin token should gc: %v", err)
+	}
+	if _, ok := get(t, remoteDB, casObject("B")); ok {
+		t.Error("gc kept an object no metadata references")
+	}
+}
+
+func TestHTTPAccessClientCertificates(t *testing.T) {
+	ca, caKey := testCert(t, "test CA", nil, nil)
+	client, clientKey := testCert(t, "release-bot", ca, caKey)
+	stranger, strangerKey := testCert(t, "stranger", ca, caKey)
+
+	access, err := ParseAccess(strings.NewReader("read cn:release-bot\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(openTestDB(t), true)
+	handler.RequireAccess(access)
+	mux := http.NewServeMux()
+	mux.Handle(HTTPPath, handler)
+	srv := httptest.NewUnstartedServer(mux)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	srv.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	defer srv.Close()
+
+	pull := func(cert *x509.Certificate, key *ecdsa.PrivateKey) error {
+		t.Helper()
+		cfg := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		cfg.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+		tr, err := Dial(srv.URL, DialOptions{TLS: cfg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Pull(openTestDB(t), tr)
+		return err
+	}
+	if err := pull(client, clientKey); err != nil {
+		t.Errorf("listed client certificate should pull: %v", err)
+	}
+	if err := pull(stranger, strangerKey); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("unlisted client certificate: %v, want 401", err)
+	}
+}
+
+// testCert issues a certificate for name, signed by parent or, when parent
+// is nil, self-signed as a CA.
+func testCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
@@ -0,0 +1,151 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// azureAPIVersion is the Blob service REST version requests are made with.
+const azureAPIVersion = "2021-08-06"
+
+// azureStore reaches an Azure Blob Storage container through the REST API.
+type azureStore struct {
+	base   string // container URL
+	client *http.Client
+	// sas is a shared access signature appended to every request; bearer
+	// is an Entra ID access token. At most one is set; with neither the
+	// container must allow anonymous access.
+	sas    url.Values
+	bearer string
+}
+
+func newAzureStore(account, container, endpoint, token string, client *http.Client) *azureStore {
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	s := &azureStore{base: strings.TrimSuffix(endpoint, "/") + "/" + url.PathEscape(container), client: client}
+	if sas, err := url.ParseQuery(strings.TrimPrefix(token, "?")); err == nil && sas.Get("sig") != "" {
+		s.sas = sas
+	} else {
+		s.bearer = token
+	}
+	return s
+}
+
+func (s *azureStore) list(prefix string) ([]string, error) {
+	var names []string
+	q := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+	for {
+		resp, err := s.do(http.MethodGet, s.base, q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Blobs []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = checkStatus(resp, http.StatusOK)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %s/%s: %w", s.base, prefix, err)
+		}
+		for _, blob := range page.Blobs {
+			names = append(names, blob.Name)
+		}
+		if page.NextMarker == "" {
+			return names, nil
+		}
+		q.Set("marker", page.NextMarker)
+	}
+}
+
+func (s *azureStore) get(name string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, s.blobURL(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errObjectNotFound
+	}
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *azureStore) has(name string) (bool, error) {
+	resp, err := s.do(http.MethodHead, s.blobURL(name), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return true, checkStatus(resp, http.StatusOK)
+}
+
+func (s *azureStore) put(name string, data []byte) error {
+	resp, err := s.do(http.MethodPut, s.blobURL(name), nil, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp, http.StatusCreated)
+}
+
+// blobURL escapes each segment of name, keeping its slashes as virtual
+// directories.
+func (s *azureStore) blobURL(name string) string {
+	segments := strings.Split(name, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return s.base + "/" + strings.Join(segments, "/")
+}
+
+func (s *azureStore) do(method, rawURL string, q url.Values, body []byte) (*http.Response, error) {
+	params := url.Values{}
+	for k, v := range s.sas {
+		params[k] = v
+	}
+	for k, v := range q {
+		params[k] = v
+	}
+	if len(params) > 0 {
+		rawURL += "?" + params.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawURL, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	if body != nil {
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if s.bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+s.bearer)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("azure request: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,142 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// objectStore is a bucket of named objects, as offered by cloud object
+// storage. Names are listed in lexical order.
+type objectStore interface {
+	list(prefix string) ([]string, error)
+	get(name string) ([]byte, error)
+	has(name string) (bool, error)
+	put(name string, data []byte) error
+}
+
+// errObjectNotFound is returned by objectStore.get for a missing object.
+var errObjectNotFound = errors.New("object not found")
+
+// blobTransport keeps a state dir's synced keys as objects under root, one
+// object per key. CAS objects and chunks keep their content-addressed
+// names, so every state dir pushed to the same bucket and root shares one
+// dedup pool whatever the provider.
+type blobTransport struct {
+	store objectStore
+	root  string
+}
+
+// objectName maps a key to its object name. Keys are escaped byte by byte,
+// so the name of a key prefix is a prefix of the names of its keys.
+func (t *blobTransport) objectName(key string) string {
+	return t.root + url.PathEscape(key)
+}
+
+func (t *blobTransport) keyOf(name string) (string, error) {
+	return url.PathUnescape(strings.TrimPrefix(name, t.root))
+}
+
+func (t *blobTransport) Do(req Request) (Response, error) {
+	var resp Response
+	switch req.Op {
+	case OpList:
+		if !isSyncedPrefix(req.Prefix) {
+			return Response{Error: fmt.Sprintf("prefix %q is not synced", req.Prefix)}, nil
+		}
+		names, err := t.store.list(t.objectName(req.Prefix))
+		if err != nil {
+			return Response{}, err
+		}
+		for _, name := range names {
+			key, err := t.keyOf(name)
+			if err != nil {
+				return Response{}, fmt.Errorf("object %s: %w", name, err)
+			}
+			resp.Keys = append(resp.Keys, key)
+		}
+	case OpGet:
+		for _, key := range req.Keys {
+			data, err := t.store.get(t.objectName(key))
+			if err != nil {
+				return Response{}, fmt.Errorf("get %s: %w", key, err)
+			}
+			resp.Entries = append(resp.Entries, Entry{Key: key, Value: data})
+		}
+	case OpHas:
+		for _, key := range req.Keys {
+			ok, err := t.store.has(t.objectName(key))
+			if err != nil {
+				return Response{}, fmt.Errorf("stat %s: %w", key, err)
+			}
+			if ok {
+				resp.Keys = append(resp.Keys, key)
+			}
+		}
+	case OpPut:
+		for _, e := range req.Entries {
+			if !isSyncedKey(e.Key) {
+				return Response{Error: fmt.Sprintf("key %q is not synced", e.Key)}, nil
+			}
+			if err := t.store.put(t.objectName(e.Key), e.Value); err != nil {
+				return Response{}, fmt.Errorf("put %s: %w", e.Key, err)
+			}
+		}
+	default:
+		return Response{Error: fmt.Sprintf("unknown op %q", req.Op)}, nil
+	}
+	return resp, nil
+}
+
+func (t *blobTransport) Close() error { return nil }
+
+// dialBlob connects to a gs:// or az:// remote.
+func dialBlob(remote string, opts DialOptions) (Transport, error) {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote %q: %w", remote, err)
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Minute}
+		if opts.TLS != nil {
+			client.Transport = &http.Transport{TLSClientConfig: opts.TLS}
+		}
+	}
+
+	var store objectStore
+	root := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "gs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid remote %q: want gs://bucket[/prefix]", remote)
+		}
+		store = newGCSStore(u.Host, opts.Endpoint, opts.Token, client)
+	case "az":
+		container, prefix, _ := strings.Cut(root, "/")
+		if u.Host == "" || container == "" {
+			return nil, fmt.Errorf("invalid remote %q: want az://account/container[/prefix]", remote)
+		}
+		store = newAzureStore(u.Host, container, opts.Endpoint, opts.Token, client)
+		root = prefix
+	default:
+		return nil, fmt.Errorf("unsupported remote scheme %q", u.Scheme)
+	}
+	if root != "" {
+		root += "/"
+	}
+	return &blobTransport{store: store, root: root}, nil
+}
+
+// checkStatus turns an unexpected HTTP response into an error.
+func checkStatus(resp *http.Response, want int) error {
+	if resp.StatusCode == want {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,220 @@
+package remote
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+// fakeBucket holds objects for the fake GCS and Azure servers. Listings
+// return two names per page to exercise pagination.
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (b *fakeBucket) page(prefix, from string) ([]string, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var names []string
+	for name := range b.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	start, _ := strconv.Atoi(from)
+	end := min(start+2, len(names))
+	next := ""
+	if end < len(names) {
+		next = strconv.Itoa(end)
+	}
+	return names[start:end], next
+}
+
+func (b *fakeBucket) get(w http.ResponseWriter, name string) {
+	b.mu.Lock()
+	data, ok := b.objects[name]
+	b.mu.Unlock()
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+	w.Write(data)
+}
+
+func (b *fakeBucket) put(name string, r io.Reader) {
+	data, _ := io.ReadAll(r)
+	b.mu.Lock()
+	b.objects[name] = data
+	b.mu.Unlock()
+}
+
+func fakeGCS(t *testing.T, bucket *fakeBucket) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gcs-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		path := r.URL.EscapedPath()
+		switch {
+		case r.Method == http.MethodGet && path == "/storage/v1/b/runs/o":
+			names, next := bucket.page(r.URL.Query().Get("prefix"), r.URL.Query().Get("pageToken"))
+			resp := map[string]any{"nextPageToken": next}
+			var items []map[string]string
+			for _, name := range names {
+				items = append(items, map[string]string{"name": name})
+			}
+			resp["items"] = items
+			json.NewEncoder(w).Encode(resp)
+		case r.Method == http.MethodGet && strings.HasPrefix(path, "/storage/v1/b/runs/o/"):
+			name, err := url.PathUnescape(strings.TrimPrefix(path, "/storage/v1/b/runs/o/"))
+			if err != nil || (r.URL.Query().Get("alt") != "media" && r.URL.Query().Get("fields") != "name") {
+				http.Error(w, "bad object", http.StatusBadRequest)
+				return
+			}
+			bucket.get(w, name)
+		case r.Method == http.MethodPost && path == "/upload/storage/v1/b/runs/o":
+			bucket.put(r.URL.Query().Get("name"), r.Body)
+			json.NewEncoder(w).Encode(map[string]string{"name": r.URL.Query().Get("name")})
+		default:
+			t.Errorf("unexpected GCS request %s %s", r.Method, r.URL)
+			http.Error(w, "unexpected", http.StatusBadRequest)
+		}
+	}))
+}
+
+func fakeAzure(t *testing.T, bucket *fakeBucket) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("sig") != "secret" || r.Header.Get("x-ms-version") == "" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		path := r.URL.EscapedPath()
+		switch {
+		case r.Method == http.MethodGet && path == "/artifacts" && q.Get("comp") == "list":
+			names, next := bucket.page(q.Get("prefix"), q.Get("marker"))
+			type blob struct {
+				Name string `xml:"Name"`
+			}
+			var resp struct {
+				XMLName    xml.Name `xml:"EnumerationResults"`
+				Blobs      []blob   `xml:"Blobs>Blob"`
+				NextMarker string   `xml:"NextMarker"`
+			}
+			for _, name := range names {
+				resp.Blobs = append(resp.Blobs, blob{Name: name})
+			}
+			resp.NextMarker = next
+			xml.NewEncoder(w).Encode(resp)
+		case strings.HasPrefix(path, "/artifacts/"):
+			name, err := url.PathUnescape(strings.TrimPrefix(path, "/artifacts/"))
+			if err != nil {
+				http.Error(w, "bad blob", http.StatusBadRequest)
+				return
+			}
+			if r.Method == http.MethodPut {
+				if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+					http.Error(w, "missing blob type", http.StatusBadRequest)
+					return
+				}
+				bucket.put(name, r.Body)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			bucket.get(w, name)
+		default:
+			t.Errorf("unexpected Azure request %s %s", r.Method, r.URL)
+			http.Error(w, "unexpected", http.StatusBadRequest)
+		}
+	}))
+}
+
+func TestBlobRemotesRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name, remote, token, root string
+		server                    func(*testing.T, *fakeBucket) *httptest.Server
+	}{
+		{"gcs", "gs://runs/ci/linux", "gcs-token", "ci/linux/", fakeGCS},
+		{"azure", "az://acct/artifacts/ci", "?sv=2021-08-06&sig=secret", "ci/", fakeAzure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bucket := &fakeBucket{objects: make(map[string][]byte)}
+			srv := tc.server(t, bucket)
+			defer srv.Close()
+			dial := func() Transport {
+				tr, err := Dial(tc.remote, DialOptions{Token: tc.token, Endpoint: srv.URL})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return tr
+			}
+
+			local := openTestDB(t)
+			metaKey := cas.PrefixMeta + "13:logs/app%1.log:42"
+			set(t, local, casObject("A"), "A")
+			set(t, local, casObject("B"), "B")
+			set(t, local, casObject("C"), "C")
+			set(t, local, metaKey, "meta")
+
+			stats, err := Push(local, dial())
+			if err != nil {
+				t.Fatalf("push: %v", err)
+			}
+			if stats.Objects != 4 {
+				t.Fatalf("pushed %d objects, want 4", stats.Objects)
+			}
+			for name := range bucket.objects {
+				if !strings.HasPrefix(name, tc.root) {
+					t.Errorf("object %q is outside the remote prefix %q", name, tc.root)
+				}
+			}
+
+			// A second runner with one object in common only uploads the rest.
+			other := openTestDB(t)
+			set(t, other, casObject("A"), "A")
+			set(t, other, casObject("D"), "D")
+			stats, err = Push(other, dial())
+			if err != nil {
+				t.Fatalf("second push: %v", err)
+			}
+			if stats.Objects != 1 || stats.Existing != 1 {
+				t.Fatalf("second push stats = %+v, want 1 sent and 1 existing", stats)
+			}
+
+			resp, err := call(dial(), Request{Op: OpHas, Keys: []string{casObject("A"), cas.PrefixCAS + "zzz"}})
+			if err != nil || len(resp.Keys) != 1 || resp.Keys[0] != casObject("A") {
+				t.Fatalf("has = %v, %v; want only aaa", resp.Keys, err)
+			}
+
+			fresh := openTestDB(t)
+			if _, err := Pull(fresh, dial()); err != nil {
+				t.Fatalf("pull: %v", err)
+			}
+			for key, want := range map[string]string{casObject("A"): "A", casObject("D"): "D", metaKey: "meta"} {
+				if got, ok := get(t, fresh, key); !ok || got != want {
+					t.Errorf("pulled %s = %q, %v; want %q", key, got, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDialBlobRejectsIncompleteRemotes(t *testing.T) {
+	for _, remote := range []string{"gs://", "az://acct", "az:///container"} {
+		if _, err := Dial(remote, DialOptions{}); err == nil {
+			t.Errorf("Dial(%q) should fail", remote)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+const (
+	// EnvSSH overrides the ssh binary used for ssh remotes, like GIT_SSH.
+	EnvSSH = "DIFFKEEPER_SSH"
+
+	// getBatch bounds how many objects are fetched per request.
+	getBatch = 64
+	// putBatchBytes bounds the payload of a single put request.
+	putBatchBytes = 8 << 20
+)
+
+// Transport carries sync requests to a remote state dir.
+type Transport interface {
+	Do(req Request) (Response, error)
+	Close() error
+}
+
+// DialOptions configures how remotes are reached.
+type DialOptions struct {
+	// RemoteCommand is the diffkeeper binary invoked on ssh remotes.
+	RemoteCommand string
+	// HTTPClient is used for http(s) remotes; nil means a client with a
+	// generous timeout, using TLS when set.
+	HTTPClient *http.Client
+	TLS        *tls.Config
+	// Token is sent as a bearer token to http(s) remotes. For gs:// it is
+	// an OAuth access token, and for az:// a SAS token or an Entra ID
+	// access token.
+	Token string
+	// Endpoint replaces the service URL of gs:// and az:// remotes, e.g.
+	// to reach an emulator or a sovereign cloud.
+	Endpoint string
+}
+
+// Dial connects to remote, which is one of:
+//
+//	http(s)://host[:port]            a `diffkeeper serve` endpoint
+//	ssh://[user@]host[:port]/path    state dir on an ssh host
+//	[user@]host:path                 scp-style ssh shorthand
+//	gs://bucket[/prefix]             a Google Cloud Storage bucket
+//	az://account/container[/prefix]  an Azure Blob Storage container
+//	file:///path                     state dir on this machine, e.g. on
+//	                                 another volume
+func Dial(remote string, opts DialOptions) (Transport, error) {
+	if opts.RemoteCommand == "" {
+		opts.RemoteCommand = "diffkeeper"
+	}
+
+	if path, ok := strings.CutPrefix(remote, "file://"); ok {
+		return dialLocal(path)
+	}
+
+	if strings.HasPrefix(remote, "gs://") || strings.HasPrefix(remote, "az://") {
+		return dialBlob(remote, opts)
+	}
+
+	if strings.HasPrefix(remote, "http://") || strings.HasPrefix(remote, "https://") {
+		client := opts.HTTPClient
+		if client == nil {
+			client = &http.Client{Timeout: 5 * time.Minute}
+			if opts.TLS != nil {
+				client.Transport = &http.Transport{TLSClientConfig: opts.TLS}
+			}
+		}
+		return &httpTransport{url: strings.TrimSuffix(remote, "/") + HTTPPath, client: client, token: opts.Token}, nil
+	}
+
+	args, err := sshArgs(remote, opts.RemoteCommand)
+	if err != nil {
+		return nil, err
+	}
+	sshBin := os.Getenv(EnvSSH)
+	if sshBin == "" {
+		sshBin = "ssh"
+	}
+	return dialCommand(exec.Command(sshBin, args...))
+}
+
+// sshArgs builds the ssh argument list that starts a sync server remotely.
+func sshArgs(remote, remoteCommand string) ([]string, error) {
+	var host, port, path string
+
+	if strings.HasPrefix(remote, "ssh://") {
+		u, err := url.Parse(remote)
+		if err != nil {
+			return nil, fmt.Errorf("parse remote: %w", err)
+		}
+		host = u.Hostname()
+		if u.User != nil {
+			host = u.User.Username() + "@" + host
+		}
+		port = u.Port()
+		path = u.Path
+	} else {
+		var ok bool
+		host, path, ok = strings.Cut(remote, ":")
+		if !ok || host == "" || strings.ContainsAny(host, "/\\") {
+			return nil, fmt.Errorf("unsupported remote %q (expected http(s)://, ssh://, or host:path)", remote)
+		}
+	}
+	if host == "" || path == "" {
+		return nil, fmt.Errorf("remote %q must name a host and a state dir", remote)
+	}
+
+	var args []string
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", host, fmt.Sprintf("%s sync-serve --state-dir %s", remoteCommand, shellQuote(path)))
+	return args, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// streamTransport speaks newline-delimited JSON over a pair of pipes.
+type streamTransport struct {
+	enc    *json.Encoder
+	w      *bufio.Writer
+	dec    *json.Decoder
+	closer func() error
+}
+
+// NewStreamTransport talks to a Handler.ServeStream on the other end of r/w.
+func NewStreamTransport(r io.Reader, w io.Writer, closer func() error) Transport {
+	bw := bufio.NewWriter(w)
+	return &streamTransport{enc: json.NewEncoder(bw), w: bw, dec: json.NewDecoder(bufio.NewReader(r)), closer: closer}
+}
+
+func dialCommand(cmd *exec.Cmd) (Transport, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %s: %w", cmd.Path, err)
+	}
+
+	return NewStreamTransport(stdout, stdin, func() error {
+		stdin.Close()
+		return cmd.Wait()
+	}), nil
+}
+
+func (t *streamTransport) Do(req Request) (Response, error) {
+	if err := t.enc.Encode(req); err != nil {
+		return Response{}, fmt.Errorf("send sync request: %w", err)
+	}
+	if err := t.w.Flush(); err != nil {
+		return Response{}, fmt.Errorf("send sync request: %w", err)
+	}
+	var resp Response
+	if err := t.dec.Decode(&resp); err != nil {
+		return Response{}, fmt.Errorf("read sync response: %w", err)
+	}
+	return resp, nil
+}
+
+func (t *streamTransport) Close() error {
+	if t.closer == nil {
+		return nil
+	}
+	return t.closer()
+}
+
+// localTransport serves requests from a state dir opened in-process.
+type localTransport struct {
+	db *pebble.DB
+	h  *Handler
+}
+
+func dialLocal(path string) (Transport, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file remote must name a state dir")
+	}
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, fmt.Errorf("create state dir: %w", err)
+	}
+	db, err := pebble.Open(path, &pebble.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("open state dir %s: %w", path, err)
+	}
+	return &localTransport{db: db, h: NewHandler(db, false)}, nil
+}
+
+func (t *localTransport) Do(req Request) (Response, error) { return t.h.Do(req), nil }
+
+func (t *localTransport) Close() error { return t.db.Close() }
+
+type httpTransport struct {
+	url    string
+	client *http.Client
+	token  string
+}
+
+func (t *httpTransport) Do(req Request) (Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Response{}, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return Response{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if t.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	httpResp, err := t.client.Do(httpReq)
+	if err != nil {
+		return Response{}, fmt.Errorf("sync request: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 4096))
+		return Response{}, fmt.Errorf("sync request: %s: %s", httpResp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var resp Response
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return Response{}, fmt.Errorf("read sync response: %w", err)
+	}
+	return resp, nil
+}
+
+func (t *httpTransport) Close() error { return nil }
+
+// Stats summarizes a transfer.
+type Stats struct {
+	Objects  int   // keys transferred
+	Bytes    int64 // value bytes transferred
+	Existing int   // keys already present on the receiving side
+}
+
+// Push sends every synced key that the remote lacks.
+func Push(db *pebble.DB, t Transport) (Stats, error) {
+	var stats Stats
+
+	for _, prefix := range SyncedPrefixes {
+		remoteKeys, err := call(t, Request{Op: OpList, Prefix: prefix})
+		if err != nil {
+			return stats, err
+		}
+		localKeys, err := listKeys(db, prefix)
+		if err != nil {
+			return stats, err
+		}
+		missing := diffKeys(localKeys, remoteKeys.Keys)
+		stats.Existing += len(localKeys) - len(missing)
+
+		var batch []Entry
+		var batchBytes int
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if _, err := call(t, Request{Op: OpPut, Entries: batch}); err != nil {
+				return err
+			}
+			batch, batchBytes = nil, 0
+			return nil
+		}
+
+		for _, key := range missing {
+			entries, err := getEntries(db, []string{key})
+			if err != nil {
+				return stats, fmt.Errorf("read local state: %w", err)
+			}
+			for _, e := range entries {
+				batch = append(batch, e)
+				batchBytes += len(e.Value)
+				stats.Objects++
+				stats.Bytes += int64(len(e.Value))
+			}
+			if batchBytes >= putBatchBytes {
+				if err := flush(); err != nil {
+					return stats, err
+				}
+			}
+		}
+		if err := flush(); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// Pull fetches every synced key that db lacks from the remote.
+func Pull(db *pebble.DB, t Transport) (Stats, error) {
+	var stats Stats
+
+	for _, prefix := range SyncedPrefixes {
+		remoteKeys, err := call(t, Request{Op: OpList, Prefix: prefix})
+		if err != nil {
+			return stats, err
+		}
+		localKeys, err := listKeys(db, prefix)
+		if err != nil {
+			return stats, err
+		}
+		missing := diffKeys(remoteKeys.Keys, localKeys)
+		stats.Existing += len(remoteKeys.Keys) - len(missing)
+
+		for start := 0; start < len(missing); start += getBatch {
+			end := min(start+getBatch, len(missing))
+			resp, err := call(t, Request{Op: OpGet, Keys: missing[start:end]})
+			if err != nil {
+				return stats, err
+			}
+			if err := putEntries(db, resp.Entries); err != nil {
+				return stats, fmt.Errorf("store pulled objects: %w", err)
+			}
+			for _, e := range resp.Entries {
+				stats.Objects++
+				stats.Bytes += int64(len(e.Value))
+			}
+		}
+	}
+	return stats, nil
+}
+
+// GC deletes the CAS objects on the remote that none of its metadata
+// references and returns how many were removed.
+func GC(t Transport) (int, error) {
+	resp, err := call(t, Request{Op: OpGC})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Removed, nil
+}
+
+func call(t Transport, req Request) (Response, error) {
+	resp, err := t.Do(req)
+	if err != nil {
+		return Response{}, err
+	}
+	if resp.Error != "" {
+		return Response{}, fmt.Errorf("remote %s: %s", req.Op, resp.Error)
+	}
+	return resp, nil
+}
+
+// diffKeys returns the keys in have that are absent from other.
+func diffKeys(have, other []string) []string {
+	seen := make(map[string]struct{}, len(other))
+	for _, k := range other {
+		seen[k] = struct{}{}
+	}
+	var missing []string
+	for _, k := range have {
+		if _, ok := seen[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,180 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcsEndpoint = "https://storage.googleapis.com"
+
+	// EnvGCEMetadataHost overrides the metadata server gs:// remotes take
+	// access tokens from when no token is given.
+	EnvGCEMetadataHost = "GCE_METADATA_HOST"
+	gceMetadataHost    = "metadata.google.internal"
+)
+
+// gcsStore reaches a Google Cloud Storage bucket through the JSON API.
+type gcsStore struct {
+	bucket   string
+	endpoint string
+	client   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time // zero for a token that was given, not fetched
+}
+
+func newGCSStore(bucket, endpoint, token string, client *http.Client) *gcsStore {
+	if endpoint == "" {
+		endpoint = gcsEndpoint
+	}
+	return &gcsStore{bucket: bucket, endpoint: strings.TrimSuffix(endpoint, "/"), client: client, token: token}
+}
+
+func (s *gcsStore) list(prefix string) ([]string, error) {
+	var names []string
+	q := url.Values{"prefix": {prefix}, "fields": {"items(name),nextPageToken"}}
+	for {
+		resp, err := s.do(http.MethodGet, s.endpoint+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = checkStatus(resp, http.StatusOK)
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list gs://%s/%s: %w", s.bucket, prefix, err)
+		}
+		for _, item := range page.Items {
+			names = append(names, item.Name)
+		}
+		if page.NextPageToken == "" {
+			return names, nil
+		}
+		q.Set("pageToken", page.NextPageToken)
+	}
+}
+
+func (s *gcsStore) get(name string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, s.endpoint+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o/"+url.PathEscape(name)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errObjectNotFound
+	}
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// has reads the object's metadata, not its content.
+func (s *gcsStore) has(name string) (bool, error) {
+	resp, err := s.do(http.MethodGet, s.endpoint+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o/"+url.PathEscape(name)+"?fields=name", nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return true, checkStatus(resp, http.StatusOK)
+}
+
+func (s *gcsStore) put(name string, data []byte) error {
+	q := url.Values{"uploadType": {"media"}, "name": {name}}
+	resp, err := s.do(http.MethodPost, s.endpoint+"/upload/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+q.Encode(), data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp, http.StatusOK)
+}
+
+func (s *gcsStore) do(method, rawURL string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawURL, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	token, err := s.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("gcs request: %w", err)
+	}
+	return resp, nil
+}
+
+// accessToken returns the OAuth token requests carry. Without a given
+// token, one is fetched from the metadata server of the GCE or GKE machine
+// the runner is on and refreshed before it expires. Requests to an
+// emulator endpoint go unauthenticated.
+func (s *gcsStore) accessToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && (s.expires.IsZero() || time.Until(s.expires) > time.Minute) {
+		return s.token, nil
+	}
+	if s.endpoint != gcsEndpoint {
+		return "", nil
+	}
+
+	host := os.Getenv(EnvGCEMetadataHost)
+	if host == "" {
+		host = gceMetadataHost
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("no token for gs:// remote (pass --token or run on GCE): %w", err)
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = checkStatus(resp, http.StatusOK)
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&tok)
+	}
+	if err != nil {
+		return "", fmt.Errorf("fetch GCE access token: %w", err)
+	}
+	s.token, s.expires = tok.AccessToken, time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second)
+	return s.token, nil
+}
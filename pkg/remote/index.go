@@ -0,0 +1,97 @@
+package remote
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// indexBatch bounds how many keys one has request asks about.
+	indexBatch = 256
+	// indexMissingTTL is how long a key the remote lacked is assumed to
+	// stay missing; another runner may upload it in the meantime.
+	indexMissingTTL = time.Minute
+	// indexMaxMissing bounds the negative cache.
+	indexMaxMissing = 64 * 1024
+)
+
+// Index asks a remote which CAS objects it already holds, so runners
+// sharing the remote upload identical content once. Keys the remote
+// lacked are cached for indexMissingTTL and not asked about again, which
+// keeps retried uploads from repeating the lookups.
+type Index struct {
+	t   Transport
+	now func() time.Time
+
+	mu      sync.Mutex
+	missing map[string]time.Time
+	// unsupported is set once the remote turns out to predate OpHas; every
+	// key is then treated as missing.
+	unsupported bool
+}
+
+// NewIndex answers existence checks through t.
+func NewIndex(t Transport) *Index {
+	return &Index{t: t, now: time.Now, missing: make(map[string]time.Time)}
+}
+
+// Present returns the subset of keys the remote holds.
+func (x *Index) Present(keys []string) (map[string]bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	present := make(map[string]bool)
+	if x.unsupported {
+		return present, nil
+	}
+	now := x.now()
+	var ask []string
+	for _, key := range keys {
+		if at, ok := x.missing[key]; ok && now.Sub(at) < indexMissingTTL {
+			continue
+		}
+		ask = append(ask, key)
+	}
+
+	for start := 0; start < len(ask); start += indexBatch {
+		batch := ask[start:min(start+indexBatch, len(ask))]
+		resp, err := x.t.Do(Request{Op: OpHas, Keys: batch})
+		if err != nil {
+			return nil, err
+		}
+		if resp.Error != "" {
+			if strings.Contains(resp.Error, "unknown op") {
+				x.unsupported = true
+				return present, nil
+			}
+			return nil, fmt.Errorf("remote %s: %s", OpHas, resp.Error)
+		}
+		for _, key := range resp.Keys {
+			present[key] = true
+		}
+		for _, key := range batch {
+			if !present[key] {
+				x.remember(key, now)
+			}
+		}
+	}
+	return present, nil
+}
+
+// remember caches key as missing, dropping expired entries once the cache
+// is full.
+func (x *Index) remember(key string, now time.Time) {
+	if len(x.missing) >= indexMaxMissing {
+		for k, at := range x.missing {
+			if now.Sub(at) >= indexMissingTTL {
+				delete(x.missing, k)
+			}
+		}
+		if len(x.missing) >= indexMaxMissing {
+			return
+		}
+	}
+	x.missing[key] = now
+}
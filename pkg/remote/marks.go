@@ -0,0 +1,103 @@
+package remote
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+// Background shippers (the tier and replication) remember which keys the
+// remote has by writing a marker per key under their own state prefix; the
+// value is the time the key was shipped.
+
+type pendingKey struct {
+	key  string
+	size int64
+}
+
+// markedKeys returns the ship time of every key marked under markPrefix.
+func markedKeys(db *pebble.DB, markPrefix string) (map[string]int64, error) {
+	iter, err := db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(markPrefix),
+		UpperBound: append([]byte(markPrefix), 0xff),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	marked := make(map[string]int64)
+	for iter.First(); iter.Valid(); iter.Next() {
+		var at int64
+		if v := iter.Value(); len(v) == 8 {
+			at = int64(binary.BigEndian.Uint64(v))
+		}
+		marked[string(iter.Key()[len(markPrefix):])] = at
+	}
+	return marked, iter.Error()
+}
+
+// unmarkedKeys lists the keys under prefixes that are not marked, in
+// prefix order. Stubs of evicted objects are skipped: their content is
+// not here.
+func unmarkedKeys(db *pebble.DB, prefixes []string, marked map[string]int64) ([]pendingKey, error) {
+	var pending []pendingKey
+	for _, prefix := range prefixes {
+		iter, err := db.NewIter(&pebble.IterOptions{
+			LowerBound: []byte(prefix),
+			UpperBound: append([]byte(prefix), 0xff),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for iter.First(); iter.Valid(); iter.Next() {
+			key := string(iter.Key())
+			if _, ok := marked[key]; ok || cas.IsRemoteStub(iter.Value()) {
+				continue
+			}
+			pending = append(pending, pendingKey{key: key, size: int64(len(iter.Value()))})
+		}
+		if err := errors.Join(iter.Error(), iter.Close()); err != nil {
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// readKeys loads the values of keys, skipping those deleted or evicted
+// since they were listed.
+func readKeys(db *pebble.DB, keys []pendingKey) ([]Entry, error) {
+	entries := make([]Entry, 0, len(keys))
+	for _, p := range keys {
+		val, closer, err := db.Get([]byte(p.key))
+		if errors.Is(err, pebble.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %w", p.key, err)
+		}
+		if !cas.IsRemoteStub(val) {
+			entries = append(entries, Entry{Key: p.key, Value: append([]byte(nil), val...)})
+		}
+		closer.Close()
+	}
+	return entries, nil
+}
+
+// markKeys marks the keys of entries shipped now, in db and in marked.
+func markKeys(db *pebble.DB, markPrefix string, entries []Entry, marked map[string]int64) error {
+	now := time.Now().UnixNano()
+	marks := db.NewBatch()
+	defer marks.Close()
+	for _, e := range entries {
+		if err := marks.Set([]byte(markPrefix+e.Key), binary.BigEndian.AppendUint64(nil, uint64(now)), nil); err != nil {
+			return err
+		}
+		marked[e.Key] = now
+	}
+	return marks.Commit(pebble.Sync)
+}
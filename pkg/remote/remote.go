@@ -0,0 +1,372 @@
+// Package remote transfers recorded state between machines. Both sides
+// exchange the key sets they hold so only missing CAS objects and metadata
+// cross the wire.
+package remote
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+// SyncedPrefixes are the keyspaces transferred by push and pull. The journal
+// is not included; it only holds events the recorder has not processed yet.
+// They are sent in this order, so the receiver holds a pack before any
+// object that points into it, which it verifies against the pack.
+var SyncedPrefixes = []string{cas.PrefixPack, cas.PrefixCAS, cas.PrefixMeta, cas.PrefixDir}
+
+// Operations understood by a sync server.
+const (
+	OpList = "list"
+	OpGet  = "get"
+	OpPut  = "put"
+	// OpHas answers which of the requested keys the remote holds.
+	OpHas = "has"
+	// OpGC deletes CAS objects no metadata record references.
+	OpGC = "gc"
+)
+
+// HTTPPath is the endpoint served by Handler.ServeHTTP.
+const HTTPPath = "/v1/sync"
+
+// maxRequestBody caps a single HTTP sync request.
+const maxRequestBody = 256 << 20
+
+// pushIdle is how long after the last put a gc is refused. A push sends
+// CAS objects before the metadata that references them, in separate
+// requests, so a gc in between would delete what it just pushed.
+const pushIdle = time.Minute
+
+// Entry is one key/value pair as stored in Pebble.
+type Entry struct {
+	Key   string `json:"k"`
+	Value []byte `json:"v"`
+}
+
+// Request is a single sync operation.
+type Request struct {
+	Op      string   `json:"op"`
+	Prefix  string   `json:"prefix,omitempty"`
+	Keys    []string `json:"keys,omitempty"`
+	Entries []Entry  `json:"entries,omitempty"`
+}
+
+// Response answers a Request.
+type Response struct {
+	Error   string   `json:"error,omitempty"`
+	Keys    []string `json:"keys,omitempty"`
+	Entries []Entry  `json:"entries,omitempty"`
+	// Removed counts the objects deleted by OpGC.
+	Removed int `json:"removed,omitempty"`
+}
+
+// Handler serves sync requests against a state dir.
+type Handler struct {
+	db       *pebble.DB
+	readOnly bool
+	access   *Access
+
+	// mu is held shared by puts and exclusively by gc.
+	mu sync.RWMutex
+	// lastPut is when the last put finished, in Unix nanoseconds.
+	lastPut atomic.Int64
+}
+
+// NewHandler serves db. A read-only handler rejects pushes.
+func NewHandler(db *pebble.DB, readOnly bool) *Handler {
+	return &Handler{db: db, readOnly: readOnly}
+}
+
+// RequireAccess makes ServeHTTP answer only requests whose credentials are
+// in access, and only for ops their scope allows. Streams are served as is;
+// ssh has already authenticated their clients.
+func (h *Handler) RequireAccess(access *Access) {
+	h.access = access
+}
+
+// Do executes one request.
+func (h *Handler) Do(req Request) Response {
+	var resp Response
+	var err error
+
+	switch req.Op {
+	case OpList:
+		if !isSyncedPrefix(req.Prefix) {
+			err = fmt.Errorf("prefix %q is not synced", req.Prefix)
+			break
+		}
+		resp.Keys, err = listKeys(h.db, req.Prefix)
+	case OpGet:
+		resp.Entries, err = getEntries(h.db, req.Keys)
+	case OpHas:
+		resp.Keys, err = hasKeys(h.db, req.Keys)
+	case OpPut:
+		if h.readOnly {
+			err = errors.New("remote state dir is read-only")
+			break
+		}
+		err = h.put(req.Entries)
+	case OpGC:
+		if h.readOnly {
+			err = errors.New("remote state dir is read-only")
+			break
+		}
+		resp.Removed, err = h.gc()
+	default:
+		err = fmt.Errorf("unknown op %q", req.Op)
+	}
+
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	return resp
+}
+
+// put stores entries, holding off gc until the push they belong to is done.
+func (h *Handler) put(entries []Entry) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	err := putEntries(h.db, entries)
+	h.lastPut.Store(time.Now().UnixNano())
+	return err
+}
+
+// gc collects unreferenced CAS objects unless a push is in progress.
+func (h *Handler) gc() (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if since := time.Since(time.Unix(0, h.lastPut.Load())); since < pushIdle {
+		return 0, fmt.Errorf("a push is in progress (last put %s ago); retry gc once it finishes", since.Round(time.Second))
+	}
+	// Deleting objects needs no hash algorithm, and the handler keeps no
+	// existence cache for the store to update.
+	store, err := cas.NewCASStore(h.db, "")
+	if err != nil {
+		return 0, err
+	}
+	return recorder.CollectUnreferenced(h.db, store)
+}
+
+// ServeStream answers newline-delimited JSON requests from r until EOF. It is
+// used over SSH, where the client runs `diffkeeper sync-serve` remotely.
+func (h *Handler) ServeStream(r io.Reader, w io.Writer) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	for {
+		var req Request
+		if err := dec.Decode(&req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("decode sync request: %w", err)
+		}
+		if err := enc.Encode(h.Do(req)); err != nil {
+			return fmt.Errorf("encode sync response: %w", err)
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// ServeHTTP answers a single JSON request posted to HTTPPath.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var scope string
+	if h.access != nil {
+		var ok bool
+		if scope, ok = h.access.scopeOf(r); !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="diffkeeper"`)
+			http.Error(w, "missing or unknown credentials", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var req Request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+		http.Error(w, "invalid sync request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.access != nil && !scopeAllows(scope, requiredScope(req)) {
+		http.Error(w, fmt.Sprintf("scope %s does not allow %s", scope, req.Op), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(h.Do(req))
+}
+
+func isSyncedPrefix(prefix string) bool {
+	for _, p := range SyncedPrefixes {
+		if prefix == p {
+			return true
+		}
+	}
+	return false
+}
+
+func isSyncedKey(key string) bool {
+	for _, p := range SyncedPrefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func listKeys(db *pebble.DB, prefix string) ([]string, error) {
+	iter, err := db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefix),
+		UpperBound: append([]byte(prefix), 0xff),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	return keys, iter.Error()
+}
+
+func getEntries(db *pebble.DB, keys []string) ([]Entry, error) {
+	entries := make([]Entry, 0, len(keys))
+	for _, key := range keys {
+		if !isSyncedKey(key) {
+			return nil, fmt.Errorf("key %q is not synced", key)
+		}
+		val, closer, err := db.Get([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %w", key, err)
+		}
+		// The content of evicted objects lives in the remote tier only.
+		if !cas.IsRemoteStub(val) {
+			entries = append(entries, Entry{Key: key, Value: append([]byte(nil), val...)})
+		}
+		closer.Close()
+	}
+	return entries, nil
+}
+
+// hasKeys returns the keys db holds content for. Evicted objects do not
+// count: their content is not here.
+func hasKeys(db *pebble.DB, keys []string) ([]string, error) {
+	var present []string
+	for _, key := range keys {
+		if !isSyncedKey(key) {
+			return nil, fmt.Errorf("key %q is not synced", key)
+		}
+		val, closer, err := db.Get([]byte(key))
+		if errors.Is(err, pebble.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %w", key, err)
+		}
+		if !cas.IsRemoteStub(val) {
+			present = append(present, key)
+		}
+		closer.Close()
+	}
+	return present, nil
+}
+
+// putEntries stores entries that are not already present. Existing keys are
+// never overwritten: CAS keys are content-addressed and metadata keys are
+// unique per path and timestamp. That makes a wrong object permanent, so
+// CAS objects and packs are checked against their keys first and the whole
+// push is rejected if any does not match.
+func putEntries(db *pebble.DB, entries []Entry) error {
+	for _, e := range entries {
+		if !isSyncedKey(e.Key) {
+			return fmt.Errorf("key %q is not synced", e.Key)
+		}
+	}
+	if err := verifyEntries(db, entries); err != nil {
+		return err
+	}
+
+	batch := db.NewBatch()
+	defer batch.Close()
+
+	for _, e := range entries {
+		if _, closer, err := db.Get([]byte(e.Key)); err == nil {
+			closer.Close()
+			continue
+		} else if !errors.Is(err, pebble.ErrNotFound) {
+			return err
+		}
+		if err := batch.Set([]byte(e.Key), e.Value, nil); err != nil {
+			return err
+		}
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// verifyEntries checks pushed CAS objects and packs against the keys they
+// are stored under. Packed objects are checked against their pack, taken
+// from the same push or, failing that, from db.
+func verifyEntries(db *pebble.DB, entries []Entry) error {
+	packs := make(map[string][]byte)
+	for _, e := range entries {
+		hash, ok := strings.CutPrefix(e.Key, cas.PrefixPack)
+		if !ok {
+			continue
+		}
+		data, err := cas.VerifyPack(hash, e.Value)
+		if err != nil {
+			return fmt.Errorf("rejecting %s: %w", e.Key, err)
+		}
+		packs[hash] = data
+	}
+
+	pack := func(hash string) ([]byte, error) {
+		if data, ok := packs[hash]; ok {
+			return data, nil
+		}
+		val, closer, err := db.Get([]byte(cas.PrefixPack + hash))
+		if errors.Is(err, pebble.ErrNotFound) {
+			return nil, fmt.Errorf("pack not found: %s", hash)
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		data, err := cas.DecodeObject(val)
+		if err != nil {
+			return nil, err
+		}
+		packs[hash] = data
+		return data, nil
+	}
+
+	for _, e := range entries {
+		cid, ok := strings.CutPrefix(e.Key, cas.PrefixCAS)
+		if !ok {
+			continue
+		}
+		if err := cas.VerifyObject(cid, e.Value, pack); err != nil {
+			return fmt.Errorf("rejecting %s: %w", e.Key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+func openTestDB(t *testing.T) *pebble.DB {
+	t.Helper()
+	db, err := pebble.Open(t.TempDir(), &pebble.Options{})
+	if err != nil {
+		t.Fatalf("open pebble: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func set(t *testing.T, db *pebble.DB, key, val string) {
+	t.Helper()
+	if err := db.Set([]byte(key), []byte(val), pebble.Sync); err != nil {
+		t.Fatalf("set %s: %v", key, err)
+	}
+}
+
+func get(t *testing.T, db *pebble.DB, key string) (string, bool) {
+	t.Helper()
+	val, closer, err := db.Get([]byte(key))
+	if err != nil {
+		return "", false
+	}
+	defer closer.Close()
+	return string(val), true
+}
+
+// casObject returns the key content is stored under as a chunk.
+func casObject(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return cas.PrefixCAS + hex.EncodeToString(sum[:])
+}
+
+// pipeTransport connects a stream transport to an in-process ServeStream.
+func pipeTransport(t *testing.T, h *Handler) Transport {
+	t.Helper()
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.ServeStream(reqR, respW)
+		respW.Close()
+	}()
+	return NewStreamTransport(respR, reqW, func() error {
+		reqW.Close()
+		return <-done
+	})
+}
+
+func TestPushSendsOnlyMissingKeys(t *testing.T) {
+	local := openTestDB(t)
+	remoteDB := openTestDB(t)
+
+	set(t, local, casObject("A"), "A")
+	set(t, local, casObject("B"), "B")
+	set(t, local, cas.PrefixMeta+"file:1", "meta")
+	set(t, local, cas.PrefixLog+"1", "journal")
+	set(t, remoteDB, casObject("A"), "A")
+
+	tr := pipeTransport(t, NewHandler(remoteDB, false))
+	stats, err := Push(local, tr)
+	if err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if stats.Objects != 2 || stats.Existing != 1 {
+		t.Fatalf("stats = %+v, want 2 transferred and 1 existing", stats)
+	}
+	if v, ok := get(t, remoteDB, casObject("B")); !ok || v != "B" {
+		t.Fatalf("CAS object not pushed")
+	}
+	if _, ok := get(t, remoteDB, cas.PrefixLog+"1"); ok {
+		t.Fatalf("journal entries must not be pushed")
+	}
+
+	tr = pipeTransport(t, NewHandler(remoteDB, false))
+	defer tr.Close()
+	again, err := Push(local, tr)
+	if err != nil {
+		t.Fatalf("second Push: %v", err)
+	}
+	if again.Objects != 0 {
+		t.Fatalf("second push transferred %d objects, want 0", again.Objects)
+	}
+}
+
+func TestPullOverHTTP(t *testing.T) {
+	local := openTestDB(t)
+	remoteDB := openTestDB(t)
+
+	set(t, remoteDB, casObject("C"), "C")
+	set(t, remoteDB, cas.PrefixMeta+"file:2", "meta")
+	set(t, local, cas.PrefixMeta+"file:2", "local wins")
+
+	mux := http.NewServeMux()
+	mux.Handle(HTTPPath, NewHandler(remoteDB, true))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tr, err := Dial(srv.URL, DialOptions{})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	stats, err := Pull(local, tr)
+	if err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	if stats.Objects != 1 || stats.Existing != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if v, _ := get(t, local, cas.PrefixMeta+"file:2"); v != "local wins" {
+		t.Fatalf("existing key overwritten: %q", v)
+	}
+
+	set(t, local, casObject("D"), "D")
+	if _, err := Push(local, tr); err == nil {
+		t.Fatalf("expected push to a read-only remote to fail")
+	}
+}
+
+func TestPushAndPullPackedStore(t *testing.T) {
+	local := openTestDB(t)
+	store, err := cas.NewCASStore(local, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cids []string
+	for i := 0; i < 8; i++ {
+		cid, err := store.Put([]byte(fmt.Sprintf("small object %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cids = append(cids, cid)
+	}
+	if report, err := store.Pack(cas.DefaultPackOptions()); err != nil || report.Objects != len(cids) {
+		t.Fatalf("Pack() = %+v, %v", report, err)
+	}
+
+	remoteDB := openTestDB(t)
+	tr := pipeTransport(t, NewHandler(remoteDB, false))
+	if _, err := Push(local, tr); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	pulled := openTestDB(t)
+	tr = pipeTransport(t, NewHandler(remoteDB, true))
+	defer tr.Close()
+	if _, err := Pull(pulled, tr); err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	pulledStore, err := cas.NewCASStore(pulled, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cid := range cids {
+		data, err := pulledStore.Get(cid)
+		if err != nil || string(data) != fmt.Sprintf("small object %d", i) {
+			t.Fatalf("Get(%s) after pull = %q, %v", cid, data, err)
+		}
+	}
+}
+
+func TestGCWaitsForPushToFinish(t *testing.T) {
+	db := openTestDB(t)
+	h := NewHandler(db, false)
+
+	// A push has sent its objects but not yet the metadata for them.
+	key := casObject("pushed")
+	if resp := h.Do(Request{Op: OpPut, Entries: []Entry{{Key: key, Value: []byte("pushed")}}}); resp.Error != "" {
+		t.Fatalf("put: %s", resp.Error)
+	}
+	if resp := h.Do(Request{Op: OpGC}); resp.Error == "" || !strings.Contains(resp.Error, "push is in progress") {
+		t.Fatalf("gc during a push = %+v, want it refused", resp)
+	}
+	if _, ok := get(t, db, key); !ok {
+		t.Fatal("gc deleted an object of a push in progress")
+	}
+
+	h.lastPut.Store(time.Now().Add(-pushIdle).UnixNano())
+	if resp := h.Do(Request{Op: OpGC}); resp.Error != "" || resp.Removed != 1 {
+		t.Fatalf("gc after the push = %+v, want 1 object removed", resp)
+	}
+}
+
+func TestPutRejectsContentNotMatchingItsCID(t *testing.T) {
+	db := openTestDB(t)
+	h := NewHandler(db, false)
+
+	resp := h.Do(Request{Op: OpPut, Entries: []Entry{
+		{Key: casObject("good"), Value: []byte("good")},
+		{Key: casObject("A"), Value: []byte("not A")},
+	}})
+	if resp.Error == "" {
+		t.Fatalf("expected a push with a mismatched object to fail")
+	}
+	if _, ok := get(t, db, casObject("good")); ok {
+		t.Fatalf("a rejected push must not store any of its entries")
+	}
+
+	compressed, err := cas.CompressObject([]byte("A"))
+	if err != nil {
+		t.Fatalf("CompressObject: %v", err)
+	}
+	if resp := h.Do(Request{Op: OpPut, Entries: []Entry{{Key: casObject("A"), Value: compressed}}}); resp.Error != "" {
+		t.Fatalf("compressed object rejected: %s", resp.Error)
+	}
+}
+
+func TestSSHArgs(t *testing.T) {
+	tests := []struct {
+		remote string
+		want   []string
+	}{
+		{"ci@runner:/tmp/trace", []string{"--", "ci@runner", "diffkeeper sync-serve --state-dir '/tmp/trace'"}},
+		{"ssh://ci@runner:2222/tmp/it's", []string{"-p", "2222", "--", "ci@runner", `diffkeeper sync-serve --state-dir '/tmp/it'\''s'`}},
+	}
+	for _, tt := range tests {
+		got, err := sshArgs(tt.remote, "diffkeeper")
+		if err != nil {
+			t.Fatalf("sshArgs(%q): %v", tt.remote, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("sshArgs(%q) = %q, want %q", tt.remote, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("sshArgs(%q) = %q, want %q", tt.remote, got, tt.want)
+			}
+		}
+	}
+
+	if _, err := sshArgs("./relative/dir", "diffkeeper"); err == nil {
+		t.Fatalf("expected error for a local path")
+	}
+}
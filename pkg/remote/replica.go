@@ -0,0 +1,217 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/internal/metrics"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+const (
+	// replicaStatePrefix marks the keys already shipped to the standby.
+	replicaStatePrefix = cas.PrefixState + "replica:"
+	// replicaStatusKey holds the ReplicationStatus of the last pass.
+	replicaStatusKey = cas.PrefixState + "replication"
+)
+
+// replicaPrefixes are shipped in this order, so the standby holds the
+// content a version points to before the version itself.
+var replicaPrefixes = []string{cas.PrefixPack, cas.PrefixCAS, cas.PrefixDir, cas.PrefixMeta}
+
+// ReplicationStatus describes how far a standby is behind its primary. It
+// is kept in the primary's state dir, so it can be read while recording.
+type ReplicationStatus struct {
+	Target string `json:"target"`
+	// CaughtUp is when the last complete pass started: everything
+	// recorded before then is on the standby. Zero until a pass completes.
+	CaughtUp    time.Time `json:"caught_up,omitempty"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	// PendingKeys and PendingBytes were left to ship after the last pass.
+	PendingKeys  int   `json:"pending_keys"`
+	PendingBytes int64 `json:"pending_bytes"`
+	// ShippedKeys and ShippedBytes count everything shipped so far.
+	ShippedKeys  int64 `json:"shipped_keys"`
+	ShippedBytes int64 `json:"shipped_bytes"`
+}
+
+// Lag returns how much history the standby would miss if the primary were
+// lost at now.
+func (s ReplicationStatus) Lag(now time.Time) time.Duration {
+	if s.CaughtUp.IsZero() {
+		return 0
+	}
+	return now.Sub(s.CaughtUp)
+}
+
+// ReadReplicationStatus returns the status a Replicator last wrote to db,
+// and false if replication never ran.
+func ReadReplicationStatus(db *pebble.DB) (ReplicationStatus, bool, error) {
+	var status ReplicationStatus
+	val, closer, err := db.Get([]byte(replicaStatusKey))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return status, false, nil
+	}
+	if err != nil {
+		return status, false, err
+	}
+	defer closer.Close()
+	if err := json.Unmarshal(val, &status); err != nil {
+		return status, false, fmt.Errorf("decode replication status: %w", err)
+	}
+	return status, true, nil
+}
+
+// ReplicationPending returns how many keys and bytes of db have not been
+// shipped to the standby yet.
+func ReplicationPending(db *pebble.DB) (keys int, bytes int64, err error) {
+	shipped, err := markedKeys(db, replicaStatePrefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	pending, err := unmarkedKeys(db, replicaPrefixes, shipped)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, p := range pending {
+		bytes += p.size
+	}
+	return len(pending), bytes, nil
+}
+
+// Replicator ships a state dir's objects and metadata to a standby as they
+// are recorded, so losing the primary's disk loses at most the keys of one
+// pass. Like push, keys the standby already holds are never overwritten,
+// and keys pruned from the primary stay on the standby.
+type Replicator struct {
+	db     *pebble.DB
+	t      Transport
+	target string
+
+	mu     sync.Mutex
+	status ReplicationStatus
+}
+
+// NewReplicator ships db through t; target names the standby in the status.
+func NewReplicator(db *pebble.DB, t Transport, target string) (*Replicator, error) {
+	status, _, err := ReadReplicationStatus(db)
+	if err != nil {
+		return nil, err
+	}
+	if status.Target != target {
+		// A new standby starts from scratch.
+		if err := db.DeleteRange([]byte(replicaStatePrefix), append([]byte(replicaStatePrefix), 0xff), pebble.Sync); err != nil {
+			return nil, fmt.Errorf("reset replication state: %w", err)
+		}
+		status = ReplicationStatus{Target: target}
+	}
+	return &Replicator{db: db, t: t, target: target, status: status}, nil
+}
+
+// Run syncs every interval until ctx is done, then once more so everything
+// recorded by then is shipped.
+func (r *Replicator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if status, err := r.Sync(); err != nil {
+				log.Printf("[replicate] final pass failed with %d keys (%d bytes) not on %s: %v", status.PendingKeys, status.PendingBytes, r.target, err)
+			}
+			return
+		case <-ticker.C:
+			if status, err := r.Sync(); err != nil {
+				log.Printf("[replicate] pass failed with %d keys (%d bytes) not on %s, retrying in %s: %v", status.PendingKeys, status.PendingBytes, r.target, interval, err)
+			}
+		}
+	}
+}
+
+// Sync ships every key not shipped yet and records the outcome in the
+// status. Progress is kept per batch, so a failed pass resumes where it
+// stopped.
+func (r *Replicator) Sync() (ReplicationStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	started := time.Now()
+	err := r.ship()
+	r.status.LastAttempt = started
+	r.status.LastError = ""
+	if err != nil {
+		r.status.LastError = err.Error()
+	} else {
+		r.status.CaughtUp = started
+	}
+	metrics.SetReplicationLag(r.status.Lag(time.Now()))
+	if saveErr := r.save(); saveErr != nil {
+		err = errors.Join(err, saveErr)
+	}
+	return r.status, err
+}
+
+// ship sends the pending keys in batches, marking each batch once the
+// standby has it.
+func (r *Replicator) ship() error {
+	shipped, err := markedKeys(r.db, replicaStatePrefix)
+	if err != nil {
+		return err
+	}
+	pending, err := unmarkedKeys(r.db, replicaPrefixes, shipped)
+	if err != nil {
+		return err
+	}
+	r.status.PendingKeys, r.status.PendingBytes = len(pending), 0
+	for _, p := range pending {
+		r.status.PendingBytes += p.size
+	}
+	metrics.SetReplicationPending(r.status.PendingBytes)
+
+	for start := 0; start < len(pending); {
+		end, size := start, int64(0)
+		for end < len(pending) && (end == start || size+pending[end].size <= putBatchBytes) {
+			size += pending[end].size
+			end++
+		}
+		batch, err := readKeys(r.db, pending[start:end])
+		if err != nil {
+			return err
+		}
+		if len(batch) > 0 {
+			if _, err := call(r.t, Request{Op: OpPut, Entries: batch}); err != nil {
+				return fmt.Errorf("ship to %s: %w", r.target, err)
+			}
+			if err := markKeys(r.db, replicaStatePrefix, batch, shipped); err != nil {
+				return err
+			}
+		}
+		var sent int64
+		for _, e := range batch {
+			sent += int64(len(e.Value))
+		}
+		r.status.ShippedKeys += int64(len(batch))
+		r.status.ShippedBytes += sent
+		r.status.PendingKeys -= end - start
+		r.status.PendingBytes -= size
+		metrics.ObserveReplication(len(batch), sent)
+		metrics.SetReplicationPending(r.status.PendingBytes)
+		start = end
+	}
+	return nil
+}
+
+func (r *Replicator) save() error {
+	data, err := json.Marshal(r.status)
+	if err != nil {
+		return err
+	}
+	return r.db.Set([]byte(replicaStatusKey), data, pebble.Sync)
+}
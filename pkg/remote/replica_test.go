@@ -0,0 +1,105 @@
+package remote
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+func TestReplicatorShipsNewKeysAndReportsLag(t *testing.T) {
+	local := openTestDB(t)
+	standby := openTestDB(t)
+	set(t, local, casObject("obj-a"), "obj-a")
+	set(t, local, cas.PrefixMeta+"v1", "meta-1")
+	set(t, local, cas.PrefixState+"local", "never shipped")
+
+	flaky := &flakyTransport{Transport: pipeTransport(t, NewHandler(standby, false))}
+	r, err := NewReplicator(local, flaky, "standby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := r.Sync()
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if status.ShippedKeys != 2 || status.PendingKeys != 0 || status.CaughtUp.IsZero() {
+		t.Fatalf("first pass = %+v, want 2 keys shipped and caught up", status)
+	}
+	if _, ok := get(t, standby, cas.PrefixState+"local"); ok {
+		t.Error("local state was shipped")
+	}
+	caughtUp := status.CaughtUp
+
+	// A failed pass keeps the new keys pending and the lag growing.
+	set(t, local, casObject("obj-b"), "obj-b")
+	set(t, local, cas.PrefixMeta+"v2", "meta-2")
+	flaky.fails = 1
+	if status, err = r.Sync(); err == nil {
+		t.Fatal("sync should fail while the standby is unreachable")
+	}
+	if status.PendingKeys != 2 || status.LastError == "" || !status.CaughtUp.Equal(caughtUp) {
+		t.Fatalf("failed pass = %+v, want 2 keys pending and the old catch-up time", status)
+	}
+	if lag := status.Lag(caughtUp.Add(time.Minute)); lag != time.Minute {
+		t.Fatalf("lag = %s, want 1m", lag)
+	}
+	if keys, bytes, err := ReplicationPending(local); err != nil || keys != 2 || bytes != 11 {
+		t.Fatalf("pending = %d keys, %d bytes, %v; want 2 keys, 11 bytes", keys, bytes, err)
+	}
+
+	// The status survives a restart, and the next pass ships only what is new.
+	flaky.puts = 0
+	if r, err = NewReplicator(local, flaky, "standby"); err != nil {
+		t.Fatal(err)
+	}
+	if status, err = r.Sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if status.ShippedKeys != 4 || status.PendingKeys != 0 || flaky.puts != 1 || status.LastError != "" {
+		t.Fatalf("resumed pass = %+v after %d puts, want 4 keys shipped in 1 put", status, flaky.puts)
+	}
+	if v, ok := get(t, standby, cas.PrefixMeta+"v2"); !ok || v != "meta-2" {
+		t.Fatalf("standby v2 = %q, %v", v, ok)
+	}
+	saved, ok, err := ReadReplicationStatus(local)
+	if err != nil || !ok || saved.ShippedKeys != 4 || saved.Target != "standby" {
+		t.Fatalf("saved status = %+v, %v, %v", saved, ok, err)
+	}
+
+	// A different standby starts over.
+	other := openTestDB(t)
+	if r, err = NewReplicator(local, pipeTransport(t, NewHandler(other, false)), "other"); err != nil {
+		t.Fatal(err)
+	}
+	if status, err = r.Sync(); err != nil || status.ShippedKeys != 4 {
+		t.Fatalf("new standby pass = %+v, %v; want all 4 keys shipped", status, err)
+	}
+}
+
+func TestDialFileRemote(t *testing.T) {
+	local := openTestDB(t)
+	set(t, local, casObject("obj-a"), "obj-a")
+	dir := t.TempDir()
+
+	tr, err := Dial("file://"+dir, DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Push(local, tr); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := pebble.Open(dir, &pebble.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, ok := get(t, db, casObject("obj-a")); !ok || v != "obj-a" {
+		t.Fatalf("file remote a = %q, %v", v, ok)
+	}
+}
@@ -0,0 +1,336 @@
+package remote
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/internal/metrics"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+// tierStatePrefix marks the CAS and pack keys already uploaded to the
+// remote tier; the value is the upload time. Markers are local state and
+// never synced.
+const tierStatePrefix = cas.PrefixState + "tier:"
+
+// tierPrefixes are uploaded in this order, so a pack is in the remote
+// before any object that points into it.
+var tierPrefixes = []string{cas.PrefixPack, cas.PrefixCAS}
+
+// tierRetries is how many times a failed upload batch is retried within
+// one Sync; after that the next Sync resumes from the same batch.
+const tierRetries = 3
+
+// Tier copies a state dir's CAS objects and packs to a remote as they are
+// stored and keeps the local copies within a size budget: above it, the
+// objects uploaded longest ago are evicted and read back through Fetcher.
+type Tier struct {
+	db    *pebble.DB
+	store *cas.CASStore
+	t     Transport
+	opts  TierOptions
+
+	mu         sync.Mutex
+	pace       pacer
+	retryDelay time.Duration
+}
+
+// TierOptions tune a Tier. Zero values disable a limit.
+type TierOptions struct {
+	// CacheMaxBytes bounds the stored size of the CAS objects kept locally.
+	CacheMaxBytes int64
+	// RateLimit caps the upload bandwidth in bytes per second.
+	RateLimit int64
+	// Index, when set, is asked which objects the remote already holds
+	// before they are uploaded; those are only marked uploaded.
+	Index *Index
+}
+
+// TierStats summarizes one Tier.Sync. PendingBytes is what is left to
+// upload when Sync fails.
+type TierStats struct {
+	Uploaded      int
+	UploadedBytes int64
+	// Deduplicated objects were already in the remote and not sent.
+	Deduplicated      int
+	DeduplicatedBytes int64
+	PendingBytes      int64
+	Evicted           int
+	FreedBytes        int64
+}
+
+// NewTier uploads the objects of db and store through t.
+func NewTier(db *pebble.DB, store *cas.CASStore, t Transport, opts TierOptions) *Tier {
+	return &Tier{
+		db:         db,
+		store:      store,
+		t:          t,
+		opts:       opts,
+		pace:       pacer{rate: opts.RateLimit, now: time.Now, sleep: time.Sleep},
+		retryDelay: time.Second,
+	}
+}
+
+// Run syncs every interval until ctx is done, then once more so everything
+// stored by then is uploaded.
+func (t *Tier) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if stats, err := t.Sync(); err != nil {
+				log.Printf("[tier] final upload failed with %d bytes pending: %v", stats.PendingBytes, err)
+			}
+			return
+		case <-ticker.C:
+			stats, err := t.Sync()
+			if err != nil {
+				log.Printf("[tier] upload failed with %d bytes pending, resuming in %s: %v", stats.PendingBytes, interval, err)
+			} else if stats.Uploaded > 0 || stats.Deduplicated > 0 {
+				log.Printf("[tier] uploaded %d objects (%d bytes), %d already in the remote (%d bytes), evicted %d (%d bytes)",
+					stats.Uploaded, stats.UploadedBytes, stats.Deduplicated, stats.DeduplicatedBytes, stats.Evicted, stats.FreedBytes)
+			}
+		}
+	}
+}
+
+// Sync uploads every object and pack not uploaded yet, then evicts
+// uploaded objects until the local ones fit the budget. Progress is kept
+// per batch, so a failed Sync loses at most the batch in flight.
+func (t *Tier) Sync() (TierStats, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var stats TierStats
+	uploaded, err := t.uploaded()
+	if err != nil {
+		return stats, err
+	}
+	pending, err := t.pending(uploaded)
+	if err != nil {
+		return stats, err
+	}
+	if t.opts.Index != nil {
+		if pending, err = t.dedup(pending, uploaded, &stats); err != nil {
+			return stats, err
+		}
+	}
+	for _, p := range pending {
+		stats.PendingBytes += p.size
+	}
+	metrics.SetTierPending(stats.PendingBytes)
+	if err := t.upload(pending, uploaded, &stats); err != nil {
+		return stats, err
+	}
+	if t.opts.CacheMaxBytes > 0 {
+		if err := t.evict(uploaded, &stats); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// uploaded returns the upload time of every key already in the remote.
+func (t *Tier) uploaded() (map[string]int64, error) {
+	return markedKeys(t.db, tierStatePrefix)
+}
+
+// pending lists the keys not uploaded yet, in upload order.
+func (t *Tier) pending(uploaded map[string]int64) ([]pendingKey, error) {
+	return unmarkedKeys(t.db, tierPrefixes, uploaded)
+}
+
+// dedup marks the pending CAS objects the remote already holds as
+// uploaded and returns the rest. Packs are local to a state dir and never
+// asked about.
+func (t *Tier) dedup(pending []pendingKey, uploaded map[string]int64, stats *TierStats) ([]pendingKey, error) {
+	var keys []string
+	for _, p := range pending {
+		if strings.HasPrefix(p.key, cas.PrefixCAS) {
+			keys = append(keys, p.key)
+		}
+	}
+	if len(keys) == 0 {
+		return pending, nil
+	}
+	present, err := t.opts.Index.Present(keys)
+	if err != nil {
+		return nil, fmt.Errorf("check remote for existing objects: %w", err)
+	}
+	if len(present) == 0 {
+		return pending, nil
+	}
+
+	now := time.Now().UnixNano()
+	marks := t.db.NewBatch()
+	defer marks.Close()
+	rest := pending[:0]
+	for _, p := range pending {
+		if !present[p.key] {
+			rest = append(rest, p)
+			continue
+		}
+		if err := marks.Set([]byte(tierStatePrefix+p.key), binary.BigEndian.AppendUint64(nil, uint64(now)), nil); err != nil {
+			return nil, err
+		}
+		uploaded[p.key] = now
+		stats.Deduplicated++
+		stats.DeduplicatedBytes += p.size
+	}
+	if err := marks.Commit(pebble.Sync); err != nil {
+		return nil, err
+	}
+	metrics.ObserveTierDedup(stats.Deduplicated, stats.DeduplicatedBytes)
+	return rest, nil
+}
+
+// upload sends pending in batches, marking each batch uploaded once the
+// remote has it. With a rate limit, a batch holds about a second of
+// bandwidth so the pacing stays smooth.
+func (t *Tier) upload(pending []pendingKey, uploaded map[string]int64, stats *TierStats) error {
+	maxBatch := int64(putBatchBytes)
+	if rate := t.opts.RateLimit; rate > 0 && rate < maxBatch {
+		maxBatch = max(rate, 64<<10)
+	}
+
+	for start := 0; start < len(pending); {
+		end, size := start, int64(0)
+		for end < len(pending) && (end == start || size+pending[end].size <= maxBatch) {
+			size += pending[end].size
+			end++
+		}
+		batch, err := readKeys(t.db, pending[start:end])
+		if err != nil {
+			return err
+		}
+		if err := t.put(batch); err != nil {
+			return err
+		}
+
+		if err := markKeys(t.db, tierStatePrefix, batch, uploaded); err != nil {
+			return err
+		}
+		for _, e := range batch {
+			stats.Uploaded++
+			stats.UploadedBytes += int64(len(e.Value))
+		}
+		stats.PendingBytes -= size
+		metrics.ObserveTierUpload(len(batch), size)
+		metrics.SetTierPending(stats.PendingBytes)
+		start = end
+	}
+	return nil
+}
+
+// put sends one batch within the rate limit, retrying with backoff.
+func (t *Tier) put(batch []Entry) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	var size int64
+	for _, e := range batch {
+		size += int64(len(e.Value))
+	}
+	t.pace.wait(size)
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if _, err = call(t.t, Request{Op: OpPut, Entries: batch}); err == nil || attempt == tierRetries {
+			return err
+		}
+		metrics.ObserveTierRetry()
+		delay := t.retryDelay << attempt
+		log.Printf("[tier] upload of %d objects failed, retrying in %s: %v", len(batch), delay, err)
+		t.pace.sleep(delay)
+	}
+}
+
+// evict replaces the content of the objects uploaded longest ago with
+// stubs until the stored CAS objects fit maxBytes.
+func (t *Tier) evict(uploaded map[string]int64, stats *TierStats) error {
+	iter, err := t.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(cas.PrefixCAS),
+		UpperBound: append([]byte(cas.PrefixCAS), 0xff),
+	})
+	if err != nil {
+		return err
+	}
+	var total int64
+	var candidates []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		total += int64(len(iter.Value()))
+		if _, ok := uploaded[string(iter.Key())]; ok {
+			candidates = append(candidates, string(iter.Key()))
+		}
+	}
+	if err := errors.Join(iter.Error(), iter.Close()); err != nil {
+		return err
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return uploaded[candidates[i]] < uploaded[candidates[j]] })
+	for _, key := range candidates {
+		if total <= t.opts.CacheMaxBytes {
+			break
+		}
+		freed, err := t.store.Evict(key[len(cas.PrefixCAS):])
+		if err != nil {
+			return err
+		}
+		if freed > 0 {
+			total -= int64(freed)
+			stats.Evicted++
+			stats.FreedBytes += int64(freed)
+			metrics.ObserveTierEviction(freed)
+		}
+	}
+	return nil
+}
+
+// Fetcher reads evicted objects back from the remote tier through t, one
+// request at a time.
+func Fetcher(t Transport) cas.RemoteFetcher {
+	var mu sync.Mutex
+	return func(key string) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		resp, err := call(t, Request{Op: OpGet, Keys: []string{key}})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Entries) != 1 || resp.Entries[0].Key != key {
+			return nil, fmt.Errorf("remote has no %s", key)
+		}
+		return resp.Entries[0].Value, nil
+	}
+}
+
+// pacer spaces out uploads so they average at most rate bytes per second.
+type pacer struct {
+	rate  int64
+	next  time.Time
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// wait blocks until n more bytes may be sent.
+func (p *pacer) wait(n int64) {
+	if p.rate <= 0 {
+		return
+	}
+	now := p.now()
+	if p.next.Before(now) {
+		p.next = now
+	} else {
+		p.sleep(p.next.Sub(now))
+	}
+	p.next = p.next.Add(time.Duration(float64(n) / float64(p.rate) * float64(time.Second)))
+}
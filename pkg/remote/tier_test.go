@@ -0,0 +1,241 @@
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+)
+
+func TestTierUploadsEvictsAndReadsThrough(t *testing.T) {
+	local := openTestDB(t)
+	remoteDB := openTestDB(t)
+	store, err := cas.NewCASStore(local, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := store.Put(incompressible(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tier := NewTier(local, store, pipeTransport(t, NewHandler(remoteDB, false)), TierOptions{CacheMaxBytes: 100 << 10})
+	stats, err := tier.Sync()
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if stats.Uploaded != 1 || stats.Evicted != 0 {
+		t.Fatalf("first sync = %+v, want 1 upload and nothing evicted", stats)
+	}
+
+	second, err := store.Put(incompressible(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = tier.Sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if stats.Uploaded != 1 || stats.Evicted != 1 {
+		t.Fatalf("second sync = %+v, want 1 upload and the oldest object evicted", stats)
+	}
+	if _, ok := get(t, remoteDB, cas.PrefixCAS+first); !ok {
+		t.Fatal("evicted object is missing from the remote")
+	}
+
+	// The evicted object still counts as stored, but its content is remote.
+	if ok, err := store.Has(first); err != nil || !ok {
+		t.Fatalf("Has(evicted) = %v, %v", ok, err)
+	}
+	if _, err := store.Get(first); err == nil || !strings.Contains(err.Error(), cas.ErrEvicted.Error()) {
+		t.Fatalf("Get without a remote tier: %v, want ErrEvicted", err)
+	}
+	store.SetRemote(Fetcher(pipeTransport(t, NewHandler(remoteDB, true))))
+	if data, err := store.Get(first); err != nil || !bytes.Equal(data, incompressible(1)) {
+		t.Fatalf("read-through Get: %v", err)
+	}
+	if data, err := store.Get(second); err != nil || !bytes.Equal(data, incompressible(2)) {
+		t.Fatalf("cached Get: %v", err)
+	}
+
+	// Nothing new: no uploads, and pushing elsewhere never sends stubs.
+	if stats, err = tier.Sync(); err != nil || stats.Uploaded != 0 {
+		t.Fatalf("idle sync = %+v, %v", stats, err)
+	}
+	other := openTestDB(t)
+	if _, err := Push(local, pipeTransport(t, NewHandler(other, false))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := get(t, other, cas.PrefixCAS+first); ok {
+		t.Error("push copied the stub of an evicted object")
+	}
+}
+
+// incompressible returns 64 KiB that zstd cannot shrink, so the stored size
+// of an object is known.
+func incompressible(seed byte) []byte {
+	data := make([]byte, 64<<10)
+	x := uint32(seed) + 1
+	for i := range data {
+		x = x*1664525 + 1013904223
+		data[i] = byte(x >> 24)
+	}
+	return data
+}
+
+// flakyTransport fails the next fails put requests.
+type flakyTransport struct {
+	Transport
+	fails int
+	puts  int
+}
+
+func (f *flakyTransport) Do(req Request) (Response, error) {
+	if req.Op == OpPut {
+		f.puts++
+		if f.fails > 0 {
+			f.fails--
+			return Response{}, errors.New("connection reset")
+		}
+	}
+	return f.Transport.Do(req)
+}
+
+func TestTierResumesAndPacesUploads(t *testing.T) {
+	local := openTestDB(t)
+	remoteDB := openTestDB(t)
+	store, err := cas.NewCASStore(local, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seed := byte(1); seed <= 3; seed++ {
+		if _, err := store.Put(incompressible(seed)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flaky := &flakyTransport{Transport: pipeTransport(t, NewHandler(remoteDB, false))}
+	tier := NewTier(local, store, flaky, TierOptions{RateLimit: 64 << 10})
+	var clock time.Time
+	var slept time.Duration
+	tier.pace.now = func() time.Time { return clock }
+	tier.pace.sleep = func(d time.Duration) { clock = clock.Add(d); slept += d }
+	tier.retryDelay = time.Millisecond
+
+	if _, err := tier.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put(incompressible(4)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put(incompressible(5)); err != nil {
+		t.Fatal(err)
+	}
+	// The network fails for longer than one Sync retries.
+	flaky.fails = tierRetries + 1
+	stats, err := tier.Sync()
+	if err == nil {
+		t.Fatal("sync should fail once retries are exhausted")
+	}
+	if stats.Uploaded != 0 || stats.PendingBytes < 2*64<<10 {
+		t.Fatalf("failed sync = %+v, want both new objects pending", stats)
+	}
+
+	// The next Sync resumes with only what was not uploaded.
+	flaky.puts = 0
+	if stats, err = tier.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Uploaded != 2 || stats.PendingBytes != 0 || flaky.puts != 2 {
+		t.Fatalf("resumed sync = %+v after %d puts, want the 2 pending objects", stats, flaky.puts)
+	}
+	if keys, err := listKeys(remoteDB, cas.PrefixCAS); err != nil || len(keys) != 5 {
+		t.Fatalf("remote has %d objects, want 5", len(keys))
+	}
+
+	// At 64 KiB/s each object is a batch of its own, paced a second apart.
+	if slept < 4*time.Second {
+		t.Fatalf("uploads slept %s, want at least 4s at the rate limit", slept)
+	}
+}
+
+// countingTransport counts has requests and can play a server that
+// predates them.
+type countingTransport struct {
+	Transport
+	has    int
+	legacy bool
+}
+
+func (c *countingTransport) Do(req Request) (Response, error) {
+	if req.Op == OpHas {
+		c.has++
+		if c.legacy {
+			return Response{Error: `unknown op "has"`}, nil
+		}
+	}
+	return c.Transport.Do(req)
+}
+
+func TestTierClusterDedupSkipsObjectsInTheRemote(t *testing.T) {
+	remoteDB := openTestDB(t)
+	runner := func() (*pebble.DB, *cas.CASStore) {
+		db := openTestDB(t)
+		store, err := cas.NewCASStore(db, "sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db, store
+	}
+
+	// The first runner uploads a shared dependency.
+	firstDB, first := runner()
+	if _, err := first.Put(incompressible(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTier(firstDB, first, pipeTransport(t, NewHandler(remoteDB, false)), TierOptions{}).Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second stores it too, plus its own output.
+	secondDB, second := runner()
+	for seed := byte(1); seed <= 2; seed++ {
+		if _, err := second.Put(incompressible(seed)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr := &countingTransport{Transport: pipeTransport(t, NewHandler(remoteDB, false))}
+	stats, err := NewTier(secondDB, second, tr, TierOptions{Index: NewIndex(tr)}).Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Deduplicated != 1 || stats.Uploaded != 1 {
+		t.Fatalf("second runner sync = %+v, want 1 deduplicated and 1 uploaded", stats)
+	}
+
+	// Keys the remote lacked are not asked about again right away.
+	index := NewIndex(tr)
+	tr.has = 0
+	for i := 0; i < 2; i++ {
+		if present, err := index.Present([]string{cas.PrefixCAS + "missing"}); err != nil || len(present) != 0 {
+			t.Fatalf("Present() = %v, %v", present, err)
+		}
+	}
+	if tr.has != 1 {
+		t.Fatalf("asked the remote %d times, want the miss cached", tr.has)
+	}
+
+	// A server without has uploads everything.
+	thirdDB, third := runner()
+	if _, err := third.Put(incompressible(1)); err != nil {
+		t.Fatal(err)
+	}
+	legacy := &countingTransport{Transport: pipeTransport(t, NewHandler(remoteDB, false)), legacy: true}
+	if stats, err = NewTier(thirdDB, third, legacy, TierOptions{Index: NewIndex(legacy)}).Sync(); err != nil || stats.Uploaded != 1 {
+		t.Fatalf("sync against a legacy server = %+v, %v; want a plain upload", stats, err)
+	}
+}
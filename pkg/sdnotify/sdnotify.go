@@ -0,0 +1,79 @@
+// Package sdnotify implements the client side of systemd's service
+// notification protocol: readiness, status, watchdog pings and stopping.
+// Outside a Type=notify unit every call is a no-op.
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// EnvSocket names the datagram socket systemd listens on.
+	EnvSocket = "NOTIFY_SOCKET"
+	// EnvWatchdogUSec is the watchdog timeout, in microseconds.
+	EnvWatchdogUSec = "WATCHDOG_USEC"
+	// EnvWatchdogPID is the process the watchdog applies to, when set.
+	EnvWatchdogPID = "WATCHDOG_PID"
+)
+
+// Messages understood by systemd.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns a message setting the free-form status shown by
+// `systemctl status`.
+func Status(text string) string {
+	return "STATUS=" + text
+}
+
+// Notify sends state to the service manager. It reports false, with no
+// error, when the process is not run under one.
+func Notify(state string) (bool, error) {
+	path := os.Getenv(EnvSocket)
+	if path == "" {
+		return false, nil
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("connect to %s: %w", EnvSocket, err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("notify service manager: %w", err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the watchdog timeout systemd expects this process
+// to ping within, or 0 when the watchdog is off or meant for another process.
+func WatchdogInterval() (time.Duration, error) {
+	raw := os.Getenv(EnvWatchdogUSec)
+	if raw == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv(EnvWatchdogPID); pid != "" {
+		n, err := strconv.Atoi(pid)
+		if err != nil {
+			return 0, fmt.Errorf("parse %s: %w", EnvWatchdogPID, err)
+		}
+		if n != os.Getpid() {
+			return 0, nil
+		}
+	}
+	usec, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", EnvWatchdogUSec, raw)
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
@@ -0,0 +1,65 @@
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotifyWithoutServiceManager(t *testing.T) {
+	t.Setenv(EnvSocket, "")
+	sent, err := Notify(Ready)
+	if sent || err != nil {
+		t.Fatalf("Notify() = %v, %v; want no-op", sent, err)
+	}
+}
+
+func TestNotifySendsState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets unavailable: %v", err)
+	}
+	defer conn.Close()
+	t.Setenv(EnvSocket, path)
+
+	sent, err := Notify(Ready + "\n" + Status("2 jobs attached"))
+	if !sent || err != nil {
+		t.Fatalf("Notify() = %v, %v", sent, err)
+	}
+	buf := make([]byte, 256)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "READY=1\nSTATUS=2 jobs attached" {
+		t.Errorf("received %q", got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	cases := []struct {
+		usec, pid string
+		want      time.Duration
+		wantErr   bool
+	}{
+		{usec: "", want: 0},
+		{usec: "30000000", want: 30 * time.Second},
+		{usec: "30000000", pid: self, want: 30 * time.Second},
+		{usec: "30000000", pid: "1", want: 0},
+		{usec: "soon", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Setenv(EnvWatchdogUSec, tc.usec)
+		t.Setenv(EnvWatchdogPID, tc.pid)
+		got, err := WatchdogInterval()
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("usec=%q pid=%q: got %v, %v; want %v", tc.usec, tc.pid, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package statelock
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ProcessAlive reports whether pid exists. EPERM means it exists but belongs
+// to another user.
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,186 @@
+// Package statelock guards a state dir against concurrent writers with an
+// advisory lock file that names its owner.
+package statelock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileName is the lock file created inside the state dir.
+const FileName = "diffkeeper.lock"
+
+// Owner identifies the process holding a lock.
+type Owner struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Command  string    `json:"command,omitempty"`
+	Since    time.Time `json:"since"`
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("pid %d on %s since %s", o.PID, o.Hostname, o.Since.Format(time.RFC3339))
+}
+
+// Stale reports whether the owner ran on this host and is no longer alive.
+// Owners on other hosts cannot be checked and are never stale.
+func (o Owner) Stale() bool {
+	hostname, _ := os.Hostname()
+	return o.Hostname == hostname && !o.alive()
+}
+
+// alive reports whether a local owner is still running. An owner naming
+// this process is only alive if this process took the lock: a container
+// that restarts runs its recorder under the same PID, often 1, as the run
+// that left the lock behind.
+func (o Owner) alive() bool {
+	if o.PID == os.Getpid() {
+		return acquiredByProcess(o)
+	}
+	return ProcessAlive(o.PID)
+}
+
+// acquired tracks the locks this process has taken and not yet released.
+var acquired struct {
+	sync.Mutex
+	owners map[string]Owner
+}
+
+func acquiredByProcess(o Owner) bool {
+	acquired.Lock()
+	defer acquired.Unlock()
+	for _, owner := range acquired.owners {
+		if owner.PID == o.PID && owner.Hostname == o.Hostname && owner.Since.Equal(o.Since) {
+			return true
+		}
+	}
+	return false
+}
+
+func setAcquired(path string, owner *Owner) {
+	acquired.Lock()
+	defer acquired.Unlock()
+	if owner == nil {
+		delete(acquired.owners, path)
+		return
+	}
+	if acquired.owners == nil {
+		acquired.owners = make(map[string]Owner)
+	}
+	acquired.owners[path] = *owner
+}
+
+// LockedError reports a state dir held by another process.
+type LockedError struct {
+	Path  string
+	Owner Owner
+	// Stale is set when the owner runs on this host and is no longer alive.
+	Stale bool
+}
+
+func (e *LockedError) Error() string {
+	if e.Stale {
+		return fmt.Sprintf("state dir is locked by %s, which is no longer running; rerun with --force to take it over (lock file %s)", e.Owner, e.Path)
+	}
+	return fmt.Sprintf("state dir is in use by %s (lock file %s); only one recorder may write to a state dir", e.Owner, e.Path)
+}
+
+// Lock is a held state dir lock.
+type Lock struct {
+	path  string
+	owner Owner
+}
+
+// Acquire locks dir for the calling process. With force, a lock whose owner
+// is verifiably dead (same host, process gone) or on another host is taken
+// over; a lock held by a live local process is never broken. A lock naming
+// this process's PID that this process did not take is left over from an
+// earlier run and counts as dead.
+func Acquire(dir, command string, force bool) (*Lock, error) {
+	hostname, _ := os.Hostname()
+	owner := Owner{PID: os.Getpid(), Hostname: hostname, Command: command, Since: time.Now().UTC()}
+	path := filepath.Join(dir, FileName)
+
+	payload, err := json.Marshal(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			_, werr := f.Write(payload)
+			cerr := f.Close()
+			if werr = errors.Join(werr, cerr); werr != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("write lock file: %w", werr)
+			}
+			setAcquired(path, &owner)
+			return &Lock{path: path, owner: owner}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("create lock file: %w", err)
+		}
+
+		held, err := Read(dir)
+		if err != nil {
+			// A torn lock file from a crash mid-write names no owner.
+			if !force {
+				return nil, fmt.Errorf("unreadable lock file %s (rerun with --force to replace it): %w", path, err)
+			}
+		} else {
+			local := held.Hostname == hostname
+			alive := local && held.alive()
+			if !force || alive {
+				return nil, &LockedError{Path: path, Owner: held, Stale: local && !alive}
+			}
+		}
+
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("remove stale lock file: %w", err)
+		}
+	}
+	return nil, fmt.Errorf("lost the race for %s to another process", path)
+}
+
+// Read returns the owner recorded in dir's lock file.
+func Read(dir string) (Owner, error) {
+	var owner Owner
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		return owner, err
+	}
+	if err := json.Unmarshal(data, &owner); err != nil {
+		return owner, fmt.Errorf("decode lock file: %w", err)
+	}
+	return owner, nil
+}
+
+// Owner returns the process recorded as holding the lock.
+func (l *Lock) Owner() Owner {
+	return l.owner
+}
+
+// Release removes the lock file if it still belongs to this lock.
+func (l *Lock) Release() error {
+	if l == nil {
+		return nil
+	}
+	setAcquired(l.path, nil)
+	held, err := Read(filepath.Dir(l.path))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if held.PID != l.owner.PID || held.Hostname != l.owner.Hostname || !held.Since.Equal(l.owner.Since) {
+		return nil
+	}
+	return os.Remove(l.path)
+}
@@ -0,0 +1,109 @@
+package statelock
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeOwner(t *testing.T, dir string, owner Owner) {
+	t.Helper()
+	data, err := json.Marshal(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, FileName), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireRejectsLiveOwner(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := Acquire(dir, "record", false)
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+
+	for _, force := range []bool{false, true} {
+		_, err := Acquire(dir, "record", force)
+		var locked *LockedError
+		if !errors.As(err, &locked) || locked.Stale || locked.Owner.PID != os.Getpid() {
+			t.Fatalf("force=%v: expected live LockedError, got %v", force, err)
+		}
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, FileName)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("lock file should be removed, stat err = %v", err)
+	}
+}
+
+func TestAcquireForceTakesOverDeadOwner(t *testing.T) {
+	dir := t.TempDir()
+	hostname, _ := os.Hostname()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run helper process: %v", err)
+	}
+	writeOwner(t, dir, Owner{PID: cmd.Process.Pid, Hostname: hostname, Since: time.Now()})
+
+	_, err := Acquire(dir, "record", false)
+	var locked *LockedError
+	if !errors.As(err, &locked) || !locked.Stale {
+		t.Fatalf("expected stale LockedError, got %v", err)
+	}
+
+	lock, err := Acquire(dir, "record", true)
+	if err != nil {
+		t.Fatalf("forced Acquire() error = %v", err)
+	}
+	defer lock.Release()
+	if owner, err := Read(dir); err != nil || owner.PID != os.Getpid() {
+		t.Fatalf("expected lock to be taken over, got %+v err=%v", owner, err)
+	}
+}
+
+func TestAcquireTreatsOwnPIDFromEarlierRunAsStale(t *testing.T) {
+	dir := t.TempDir()
+	hostname, _ := os.Hostname()
+	// A restarted container runs under the PID of the run that left the lock.
+	writeOwner(t, dir, Owner{PID: os.Getpid(), Hostname: hostname, Since: time.Now().Add(-time.Hour)})
+
+	_, err := Acquire(dir, "record", false)
+	var locked *LockedError
+	if !errors.As(err, &locked) || !locked.Stale {
+		t.Fatalf("expected stale LockedError, got %v", err)
+	}
+
+	lock, err := Acquire(dir, "record", true)
+	if err != nil {
+		t.Fatalf("forced Acquire() error = %v", err)
+	}
+	defer lock.Release()
+	if owner, err := Read(dir); err != nil || !owner.Since.Equal(lock.Owner().Since) {
+		t.Fatalf("expected lock to be taken over, got %+v err=%v", owner, err)
+	}
+}
+
+func TestReleaseKeepsForeignLock(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := Acquire(dir, "record", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeOwner(t, dir, Owner{PID: 1, Hostname: "other-host", Since: time.Now()})
+
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if owner, err := Read(dir); err != nil || owner.Hostname != "other-host" {
+		t.Fatalf("foreign lock must survive Release, got %+v err=%v", owner, err)
+	}
+}
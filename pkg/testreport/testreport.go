@@ -0,0 +1,214 @@
+// Package testreport reads test results with timing information from JUnit
+// XML and `go test -json` output.
+package testreport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status values for a TestCase.
+const (
+	StatusPass = "pass"
+	StatusFail = "fail"
+	StatusSkip = "skip"
+)
+
+// TestCase is one test with the wall-clock window it ran in.
+type TestCase struct {
+	Suite  string    `json:"suite,omitempty"`
+	Name   string    `json:"name"`
+	Status string    `json:"status"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+// Failed reports whether the test failed or errored.
+func (tc TestCase) Failed() bool { return tc.Status == StatusFail }
+
+// FullName joins suite and test name.
+func (tc TestCase) FullName() string {
+	if tc.Suite == "" {
+		return tc.Name
+	}
+	return tc.Suite + "." + tc.Name
+}
+
+// Parse detects the report format and returns its test cases. JUnit
+// timestamps without a zone are interpreted in loc.
+func Parse(r io.Reader, loc *time.Location) ([]TestCase, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("empty test report")
+			}
+			return nil, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n', 0xef, 0xbb, 0xbf: // whitespace and UTF-8 BOM
+			br.ReadByte()
+			continue
+		case '<':
+			return ParseJUnit(br, loc)
+		case '{':
+			return ParseGoTestJSON(br)
+		default:
+			return nil, fmt.Errorf("unrecognized test report format (expected JUnit XML or go test -json)")
+		}
+	}
+}
+
+type junitSuites struct {
+	Suites []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string       `xml:"name,attr"`
+	Timestamp string       `xml:"timestamp,attr"`
+	Cases     []junitCase  `xml:"testcase"`
+	Suites    []junitSuite `xml:"testsuite"`
+}
+
+type junitCase struct {
+	Name      string    `xml:"name,attr"`
+	Classname string    `xml:"classname,attr"`
+	Time      string    `xml:"time,attr"`
+	Failure   *struct{} `xml:"failure"`
+	Error     *struct{} `xml:"error"`
+	Skipped   *struct{} `xml:"skipped"`
+}
+
+// ParseJUnit reads a JUnit XML report. JUnit only records each suite's start
+// and every case's duration, so cases are assumed to run back to back in
+// document order.
+func ParseJUnit(r io.Reader, loc *time.Location) ([]TestCase, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var root junitSuites
+	trimmed := bytes.TrimSpace(data)
+	if bytes.Contains(trimmed[:min(len(trimmed), 512)], []byte("<testsuites")) {
+		err = xml.Unmarshal(data, &root)
+	} else {
+		var suite junitSuite
+		err = xml.Unmarshal(data, &suite)
+		root.Suites = []junitSuite{suite}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse JUnit XML: %w", err)
+	}
+
+	var cases []TestCase
+	var walk func(s junitSuite) error
+	walk = func(s junitSuite) error {
+		start, err := parseJUnitTime(s.Timestamp, loc)
+		if err != nil && len(s.Cases) > 0 {
+			return fmt.Errorf("suite %q: %w", s.Name, err)
+		}
+		for _, c := range s.Cases {
+			secs, _ := strconv.ParseFloat(c.Time, 64)
+			end := start.Add(time.Duration(secs * float64(time.Second)))
+
+			status := StatusPass
+			switch {
+			case c.Failure != nil || c.Error != nil:
+				status = StatusFail
+			case c.Skipped != nil:
+				status = StatusSkip
+			}
+
+			suite := c.Classname
+			if suite == "" {
+				suite = s.Name
+			}
+			cases = append(cases, TestCase{Suite: suite, Name: c.Name, Status: status, Start: start, End: end})
+			start = end
+		}
+		for _, child := range s.Suites {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, s := range root.Suites {
+		if err := walk(s); err != nil {
+			return nil, err
+		}
+	}
+	return cases, nil
+}
+
+func parseJUnitTime(raw string, loc *time.Location) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return time.Time{}, errors.New("missing timestamp attribute")
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return ts, nil
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999"} {
+		if ts, err := time.ParseInLocation(layout, raw, loc); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", raw)
+}
+
+type goTestEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string
+}
+
+// ParseGoTestJSON reads `go test -json` output. Package-level events and
+// tests that never finished are ignored.
+func ParseGoTestJSON(r io.Reader) ([]TestCase, error) {
+	type key struct{ pkg, test string }
+	running := make(map[key]time.Time)
+	var cases []TestCase
+
+	dec := json.NewDecoder(r)
+	for {
+		var ev goTestEvent
+		if err := dec.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("parse go test -json: %w", err)
+		}
+		if ev.Test == "" {
+			continue
+		}
+
+		k := key{ev.Package, ev.Test}
+		switch ev.Action {
+		case "run":
+			running[k] = ev.Time
+		case "pass", "fail", "skip":
+			start, ok := running[k]
+			if !ok {
+				start = ev.Time
+			}
+			delete(running, k)
+			cases = append(cases, TestCase{Suite: ev.Package, Name: ev.Test, Status: ev.Action, Start: start, End: ev.Time})
+		}
+	}
+	return cases, nil
+}
@@ -0,0 +1,76 @@
+package testreport
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseJUnitSequentialWindows(t *testing.T) {
+	report := `<?xml version="1.0"?>
+<testsuites>
+  <testsuite name="api" timestamp="2025-01-02T15:00:00" tests="3">
+    <testcase classname="api.Users" name="create" time="1.5"/>
+    <testcase classname="api.Users" name="delete" time="2">
+      <failure message="boom">trace</failure>
+    </testcase>
+    <testcase classname="api.Users" name="later" time="0.5"><skipped/></testcase>
+  </testsuite>
+</testsuites>`
+
+	cases, err := Parse(strings.NewReader(report), time.UTC)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(cases) != 3 {
+		t.Fatalf("got %d cases", len(cases))
+	}
+
+	base := time.Date(2025, 1, 2, 15, 0, 0, 0, time.UTC)
+	del := cases[1]
+	if del.FullName() != "api.Users.delete" || !del.Failed() {
+		t.Fatalf("unexpected case %+v", del)
+	}
+	if !del.Start.Equal(base.Add(1500*time.Millisecond)) || !del.End.Equal(base.Add(3500*time.Millisecond)) {
+		t.Fatalf("delete window = %s..%s", del.Start, del.End)
+	}
+	if cases[2].Status != StatusSkip {
+		t.Fatalf("expected skipped status, got %s", cases[2].Status)
+	}
+}
+
+func TestParseJUnitSingleSuite(t *testing.T) {
+	report := `<testsuite name="s" timestamp="2025-01-02T15:00:00Z"><testcase name="a" time="1"/></testsuite>`
+	cases, err := Parse(strings.NewReader(report), nil)
+	if err != nil || len(cases) != 1 || cases[0].Suite != "s" {
+		t.Fatalf("cases=%+v err=%v", cases, err)
+	}
+}
+
+func TestParseGoTestJSON(t *testing.T) {
+	report := `{"Time":"2025-01-02T15:00:00Z","Action":"start","Package":"p"}
+{"Time":"2025-01-02T15:00:01Z","Action":"run","Package":"p","Test":"TestA"}
+{"Time":"2025-01-02T15:00:01.5Z","Action":"output","Package":"p","Test":"TestA","Output":"x\n"}
+{"Time":"2025-01-02T15:00:03Z","Action":"fail","Package":"p","Test":"TestA","Elapsed":2}
+{"Time":"2025-01-02T15:00:03Z","Action":"run","Package":"p","Test":"TestB"}
+{"Time":"2025-01-02T15:00:04Z","Action":"pass","Package":"p","Test":"TestB","Elapsed":1}
+{"Time":"2025-01-02T15:00:04Z","Action":"fail","Package":"p","Elapsed":4}
+`
+	cases, err := Parse(strings.NewReader(report), nil)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(cases) != 2 {
+		t.Fatalf("got %d cases", len(cases))
+	}
+	a := cases[0]
+	if a.FullName() != "p.TestA" || !a.Failed() || a.End.Sub(a.Start) != 2*time.Second {
+		t.Fatalf("unexpected case %+v", a)
+	}
+}
+
+func TestParseRejectsUnknownFormat(t *testing.T) {
+	if _, err := Parse(strings.NewReader("PASS\nok  p 0.1s\n"), nil); err == nil {
+		t.Fatalf("expected error for plain text output")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/glob"
+)
+
+// redactedMarker replaces secrets in content captured under
+// config.CaptureRedact.
+const redactedMarker = "[REDACTED]"
+
+// defaultRedactPatterns mask common secrets when a redact policy lists no
+// patterns of its own. The first capture group, if any, is masked.
+var defaultRedactPatterns = []string{
+	`(?i)(?:password|passwd|secret|token|api[_-]?key|access[_-]?key)["']?\s*[:=]\s*["']?([^\s"',;]+)`,
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+	`\bAKIA[0-9A-Z]{16}\b`,
+}
+
+// capturePolicies resolves the config.PathPolicy that applies to a path
+// relative to the watch dir. A nil *capturePolicies matches nothing.
+type capturePolicies struct {
+	rules  []config.PathPolicy
+	redact [][]*regexp.Regexp
+}
+
+func newCapturePolicies(rules []config.PathPolicy) (*capturePolicies, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	p := &capturePolicies{rules: rules, redact: make([][]*regexp.Regexp, len(rules))}
+	for i, rule := range rules {
+		if rule.Capture != config.CaptureRedact {
+			continue
+		}
+		exprs := rule.Redact
+		if len(exprs) == 0 {
+			exprs = defaultRedactPatterns
+		}
+		for _, expr := range exprs {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("policy %s: %w", rule.Path, err)
+			}
+			p.redact[i] = append(p.redact[i], re)
+		}
+	}
+	return p, nil
+}
+
+// match returns the index of the first rule matching rel, or -1.
+func (p *capturePolicies) match(rel string) int {
+	if p == nil {
+		return -1
+	}
+	rel = filepath.ToSlash(rel)
+	for i, rule := range p.rules {
+		if glob.Match(rule.Path, rel) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Capture returns the capture mode for rel, or "" for the global settings.
+func (p *capturePolicies) Capture(rel string) string {
+	if i := p.match(rel); i >= 0 {
+		return p.rules[i].Capture
+	}
+	return ""
+}
+
+// MaxVersions returns the version limit for rel, or 0 for the global one.
+func (p *capturePolicies) MaxVersions(rel string) int {
+	if i := p.match(rel); i >= 0 {
+		return p.rules[i].MaxVersions
+	}
+	return 0
+}
+
+// Critical reports whether captures of rel are stored ahead of others.
+func (p *capturePolicies) Critical(rel string) bool {
+	if i := p.match(rel); i >= 0 {
+		return p.rules[i].Critical
+	}
+	return false
+}
+
+// Storage returns the storage strategy for rel, or "" for
+// config.StorageAuto.
+func (p *capturePolicies) Storage(rel string) string {
+	if i := p.match(rel); i >= 0 {
+		return p.rules[i].Storage
+	}
+	return ""
+}
+
+// Redact masks secrets in data if rel is captured under
+// config.CaptureRedact.
+func (p *capturePolicies) Redact(rel string, data []byte) []byte {
+	i := p.match(rel)
+	if i < 0 || len(p.redact[i]) == 0 {
+		return data
+	}
+	for _, re := range p.redact[i] {
+		data = redact(re, data)
+	}
+	return data
+}
+
+// redact replaces every match of re in data, or only its first capture
+// group when re has one, with redactedMarker.
+func redact(re *regexp.Regexp, data []byte) []byte {
+	matches := re.FindAllSubmatchIndex(data, -1)
+	if len(matches) == 0 {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) >= 4 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		out = append(out, data[last:start]...)
+		out = append(out, redactedMarker...)
+		last = end
+	}
+	return append(out, data[last:]...)
+}
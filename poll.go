@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+// fallbackPollInterval is how often directories beyond the inotify watch
+// limit are scanned.
+const fallbackPollInterval = 2 * time.Second
+
+// pollRacyWindow covers coarse mtimes (one or two seconds on NFS and FAT):
+// a file modified this recently may change again without its size or mtime
+// changing, so scans compare its content hash too.
+const pollRacyWindow = 2 * time.Second
+
+// fileStamp is what a scan compares to notice a change.
+type fileStamp struct {
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+	// sum is the content hash of files whose mtime was racy when scanned.
+	sum string
+}
+
+// dirPoller finds changed files by scanning directory trees, for trees that
+// cannot be watched. Changed files are offered to gate like fsnotify events.
+//
+// Scans run every minInterval while files keep changing and back off up to
+// maxInterval while nothing does.
+type dirPoller struct {
+	gate        *captureGate
+	minInterval time.Duration
+	maxInterval time.Duration
+
+	mu sync.Mutex
+	// roots maps each scanned tree to the files seen by its last scan.
+	roots map[string]map[string]fileStamp
+}
+
+func newDirPoller(gate *captureGate, minInterval, maxInterval time.Duration) *dirPoller {
+	return &dirPoller{
+		gate:        gate,
+		minInterval: minInterval,
+		maxInterval: maxInterval,
+		roots:       make(map[string]map[string]fileStamp),
+	}
+}
+
+// Add starts scanning root. With baseline, files already present are taken
+// as unchanged; otherwise the next scan offers all of them, as for a
+// directory created during the recording.
+func (p *dirPoller) Add(root string, baseline bool) {
+	seen := map[string]fileStamp{}
+	if baseline {
+		seen, _ = p.scan(root, nil)
+	}
+	p.mu.Lock()
+	if _, ok := p.roots[root]; !ok {
+		p.roots[root] = seen
+	}
+	p.mu.Unlock()
+}
+
+// Roots returns the number of scanned trees.
+func (p *dirPoller) Roots() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.roots)
+}
+
+// Run scans every tree until ctx is done, adapting the interval to how
+// much changes.
+func (p *dirPoller) Run(ctx context.Context) {
+	interval := p.minInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			start := time.Now()
+			changed := p.Poll()
+			interval = nextPollInterval(interval, p.minInterval, p.maxInterval, changed, time.Since(start))
+			timer.Reset(interval)
+		}
+	}
+}
+
+// nextPollInterval returns the wait before the next scan: minInterval after
+// a scan that found changes, otherwise double the current interval up to
+// maxInterval. Slow scans (large trees, network filesystems) are spaced to
+// at least twice their duration so polling never takes over the recorder.
+func nextPollInterval(current, minInterval, maxInterval time.Duration, changed int, took time.Duration) time.Duration {
+	next := minInterval
+	if changed == 0 {
+		next = min(current*2, maxInterval)
+	}
+	return max(next, 2*took)
+}
+
+// Poll scans every tree once, offers files that are new or changed and
+// returns how many there were.
+func (p *dirPoller) Poll() int {
+	p.mu.Lock()
+	roots := make(map[string]map[string]fileStamp, len(p.roots))
+	for root, seen := range p.roots {
+		roots[root] = seen
+	}
+	p.mu.Unlock()
+
+	changed := 0
+	for root, seen := range roots {
+		next, n := p.scan(root, seen)
+		changed += n
+		p.mu.Lock()
+		p.roots[root] = next
+		p.mu.Unlock()
+	}
+	return changed
+}
+
+// scan walks root and returns the files and directories found. Changes
+// from seen are offered and counted, unless seen is nil (a baseline scan):
+// new or rewritten files, new and removed directories, and mode changes.
+func (p *dirPoller) scan(root string, seen map[string]fileStamp) (map[string]fileStamp, int) {
+	now := time.Now()
+	found := make(map[string]fileStamp, len(seen))
+	changed := 0
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Vanished or unreadable entries are picked up by a later scan.
+			return nil
+		}
+		if p.gate.Ignored(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		stamp := fileStamp{mode: info.Mode()}
+		prev, known := seen[path]
+		if d.IsDir() {
+			if path == root {
+				return nil
+			}
+			found[path] = stamp
+			switch {
+			case seen == nil:
+			case !known:
+				p.gate.OfferAttr(recorder.OpMkdir, path, stamp.mode)
+				changed++
+			case prev.mode != stamp.mode:
+				p.gate.OfferAttr(recorder.OpChmod, path, stamp.mode)
+				changed++
+			}
+			return nil
+		}
+
+		stamp.size, stamp.modTime = info.Size(), info.ModTime()
+		racy := now.Sub(stamp.modTime) < pollRacyWindow
+		if racy || prev.sum != "" {
+			// Unreadable files keep an empty sum and are compared by size
+			// and mtime alone.
+			stamp.sum, _ = hashFile(path)
+		}
+		differs := !known || prev.size != stamp.size || !prev.modTime.Equal(stamp.modTime) ||
+			(prev.sum != "" && stamp.sum != "" && prev.sum != stamp.sum)
+		if !racy {
+			// Settled: later scans can rely on size and mtime again.
+			stamp.sum = ""
+		}
+		found[path] = stamp
+		if seen == nil {
+			return nil
+		}
+		if differs {
+			p.gate.Offer(path)
+			changed++
+		}
+		if known && prev.mode != stamp.mode {
+			p.gate.OfferAttr(recorder.OpChmod, path, stamp.mode)
+			changed++
+		}
+		return nil
+	})
+
+	for path, prev := range seen {
+		if _, ok := found[path]; !ok && prev.mode.IsDir() {
+			p.gate.OfferRemove(path)
+			changed++
+		}
+	}
+	return found, changed
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Values of --progress.
+const (
+	progressAuto = "auto"
+	progressBar  = "bar"
+	progressJSON = "json"
+	progressNone = "none"
+)
+
+const (
+	// progressBarInterval is how often the bar is redrawn at most.
+	progressBarInterval = 200 * time.Millisecond
+
+	// progressJSONInterval is how often a JSON event is written at most,
+	// besides the first and last of each phase.
+	progressJSONInterval = time.Second
+
+	progressBarWidth = 24
+)
+
+// addProgressFlag registers --progress on cmd.
+func addProgressFlag(cmd *cobra.Command, mode *string) {
+	cmd.Flags().StringVar(mode, "progress", progressAuto, "Report progress on stderr: auto (a bar when stderr is a terminal), bar, json (one event per line) or none")
+	completeValues(cmd, "progress", progressAuto, progressBar, progressJSON, progressNone)
+}
+
+// progressEvent is a line written with --progress=json. Done and Total
+// count Unit ("files", or "keyspaces" for compact-store); Total and
+// TotalBytes are zero when unknown, as is ETA until it can be estimated.
+type progressEvent struct {
+	Phase          string  `json:"phase"`
+	Unit           string  `json:"unit"`
+	Done           int     `json:"done"`
+	Total          int     `json:"total,omitempty"`
+	Bytes          int64   `json:"bytes"`
+	TotalBytes     int64   `json:"total_bytes,omitempty"`
+	Percent        float64 `json:"percent"`
+	ETASeconds     float64 `json:"eta_seconds,omitempty"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	Finished       bool    `json:"finished"`
+}
+
+// progressReporter reports how far a long operation got, phase by phase:
+// as a bar redrawn in place, as JSON events, or not at all. A nil
+// *progressReporter reports nothing. It is safe for concurrent use.
+type progressReporter struct {
+	w        io.Writer
+	json     bool
+	interval time.Duration
+	now      func() time.Time
+
+	mu                sync.Mutex
+	phase, unit       string
+	done, total       int
+	bytes, totalBytes int64
+	started, reported time.Time
+}
+
+// newProgress returns the reporter for --progress mode, writing to w, or
+// nil when progress is not reported.
+func newProgress(w io.Writer, mode string) (*progressReporter, error) {
+	p := &progressReporter{w: w, interval: progressBarInterval, now: time.Now}
+	switch mode {
+	case progressAuto:
+		if f, ok := w.(*os.File); !ok || !isTerminal(f) {
+			return nil, nil
+		}
+	case progressBar:
+	case progressJSON:
+		p.json, p.interval = true, progressJSONInterval
+	case progressNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported --progress %q (use %s, %s, %s or %s)", mode, progressAuto, progressBar, progressJSON, progressNone)
+	}
+	return p, nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Start begins a phase of total units and totalBytes bytes; zero when
+// unknown.
+func (p *progressReporter) Start(phase, unit string, total int, totalBytes int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phase, p.unit = phase, unit
+	p.done, p.total, p.bytes, p.totalBytes = 0, total, 0, totalBytes
+	p.started = p.now()
+	p.report(false)
+}
+
+// Advance records n more units done and bytes more bytes written.
+func (p *progressReporter) Advance(n int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	p.bytes += bytes
+	if p.now().Sub(p.reported) >= p.interval {
+		p.report(false)
+	}
+}
+
+// Finish ends the phase.
+func (p *progressReporter) Finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report(true)
+}
+
+// countReads wraps open so every byte read from the files it opens is
+// counted, and every file closed is one unit done.
+func (p *progressReporter) countReads(open func(rel string) (io.ReadCloser, error)) func(rel string) (io.ReadCloser, error) {
+	if p == nil {
+		return open
+	}
+	return func(rel string) (io.ReadCloser, error) {
+		rc, err := open(rel)
+		if err != nil {
+			return nil, err
+		}
+		return &progressReader{ReadCloser: rc, progress: p}, nil
+	}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	progress *progressReporter
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.progress.Advance(0, int64(n))
+	return n, err
+}
+
+func (r *progressReader) Close() error {
+	r.progress.Advance(1, 0)
+	return r.ReadCloser.Close()
+}
+
+// event returns the state of the phase. The caller holds p.mu.
+func (p *progressReporter) event(finished bool) progressEvent {
+	elapsed := p.now().Sub(p.started)
+	ev := progressEvent{
+		Phase:          p.phase,
+		Unit:           p.unit,
+		Done:           p.done,
+		Total:          p.total,
+		Bytes:          p.bytes,
+		TotalBytes:     p.totalBytes,
+		ElapsedSeconds: elapsed.Seconds(),
+		Finished:       finished,
+	}
+	// Bytes track the work more closely than files of any size.
+	var frac float64
+	switch {
+	case finished:
+		frac = 1
+	case p.totalBytes > 0:
+		frac = float64(p.bytes) / float64(p.totalBytes)
+	case p.total > 0:
+		frac = float64(p.done) / float64(p.total)
+	}
+	frac = min(frac, 1)
+	ev.Percent = frac * 100
+	if frac > 0 && frac < 1 {
+		ev.ETASeconds = elapsed.Seconds() * (1 - frac) / frac
+	}
+	return ev
+}
+
+// report writes the state of the phase. The caller holds p.mu.
+func (p *progressReporter) report(finished bool) {
+	p.reported = p.now()
+	ev := p.event(finished)
+	if p.json {
+		_ = json.NewEncoder(p.w).Encode(ev)
+		return
+	}
+
+	filled := int(ev.Percent / 100 * progressBarWidth)
+	line := fmt.Sprintf("%s [%s%s] %3.0f%% %d", ev.Phase, strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), ev.Percent, ev.Done)
+	if ev.Total > 0 {
+		line += fmt.Sprintf("/%d", ev.Total)
+	}
+	line += " " + ev.Unit
+	if ev.Bytes > 0 {
+		line += ", " + formatSize(int(ev.Bytes))
+	}
+	switch {
+	case finished:
+		line += fmt.Sprintf(" in %s", time.Duration(ev.ElapsedSeconds*float64(time.Second)).Round(time.Second))
+	case ev.ETASeconds > 0:
+		line += fmt.Sprintf(", ETA %s", time.Duration(ev.ETASeconds*float64(time.Second)).Round(time.Second))
+	}
+	// Clear what is left of a longer previous line.
+	fmt.Fprintf(p.w, "\r%s\x1b[K", line)
+	if finished {
+		fmt.Fprintln(p.w)
+	}
+}
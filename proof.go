@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/spf13/cobra"
+)
+
+// proofOptions carries the flags accepted by the proof command.
+type proofOptions struct {
+	stateDir string
+	path     string
+	atTime   string
+	outFile  string
+}
+
+func newProofCmd() *cobra.Command {
+	var opts proofOptions
+
+	cmd := &cobra.Command{
+		Use: "proof <path> --state-dir <dir>",
+		// The proof is JSON already.
+		Annotations: map[string]string{annotationJSONOutput: "always"},
+		Short:       "Print a Merkle inclusion proof for a recorded file version",
+		Long: `Print a Merkle inclusion proof for a recorded file version.
+
+The proof (JSON) binds the version of <path> current at --time to the Merkle
+root over every file at that time. At or after the session end that is the
+root sealed (and optionally signed) when the recording finished, so the proof
+can be checked offline with "diffkeeper verify-proof".`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			opts.path = args[0]
+			return runProof(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&opts.atTime, "time", "", "Point in time (timestamp, duration from start, or anchor like end-5s); default latest")
+	cmd.Flags().StringVar(&opts.outFile, "out", "", "Write the proof to this file instead of stdout")
+	return cmd
+}
+
+func runProof(w io.Writer, opts proofOptions) error {
+	db, snapshot, err := openReadOnlyOrSnapshot(opts.stateDir)
+	if err != nil {
+		return err
+	}
+	defer releaseSnapshot(opts.stateDir, snapshot)
+	defer db.Close()
+
+	target, err := parseTargetTime(opts.atTime, loadSessionAnchors(db))
+	if err != nil {
+		return err
+	}
+	proof, err := recorder.ProveState(db, opts.path, target)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(proof, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if opts.outFile != "" {
+		return os.WriteFile(opts.outFile, data, 0o644)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// verifyProofOptions carries the flags accepted by the verify-proof command.
+type verifyProofOptions struct {
+	proofFile string
+	file      string
+	keyFile   string
+	jsonOut   bool
+}
+
+// verifyProofResult is what verify-proof prints with --json.
+type verifyProofResult struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+	Path  string `json:"path,omitempty"`
+	CID   string `json:"cid,omitempty"`
+	Root  string `json:"root,omitempty"`
+	// Sealed is set when the root was stored at session end, and Signer
+	// when it is signed: "given key", or the embedded key's fingerprint.
+	Sealed bool   `json:"sealed"`
+	Signer string `json:"signer,omitempty"`
+}
+
+func newVerifyProofCmd() *cobra.Command {
+	var opts verifyProofOptions
+
+	cmd := &cobra.Command{
+		Use:   "verify-proof <proof.json>",
+		Short: "Check a Merkle inclusion proof offline",
+		Long: `Check a Merkle inclusion proof offline.
+
+Verifies that the proven version is included in the proof's root and, for
+sealed proofs, that the session signature matches. --key checks the signature
+against a trusted public key instead of the one embedded in the proof, and
+--file checks that a file's content is the proven version.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.proofFile = args[0]
+			return runVerifyProof(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.file, "file", "", "Also check that this file's content is the proven version")
+	cmd.Flags().StringVar(&opts.keyFile, "key", "", "Trusted PEM public key of the signer")
+	cmd.Flags().BoolVar(&opts.jsonOut, "json", false, "Print JSON instead of a summary")
+	return cmd
+}
+
+func runVerifyProof(w io.Writer, opts verifyProofOptions) error {
+	result, err := verifyProof(opts)
+	if opts.jsonOut {
+		if err != nil {
+			result = verifyProofResult{Error: err.Error()}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(result); encErr != nil {
+			return encErr
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "OK: %s (%s) is included in root %s\n", result.Path, result.CID, result.Root)
+	switch {
+	case result.Signer == "given key":
+		fmt.Fprintln(w, "Sealed at session end and signed by the given key.")
+	case result.Signer != "":
+		fmt.Fprintf(w, "Sealed at session end; signature matches the embedded key %s (pass --key to check the signer).\n", result.Signer)
+	case result.Sealed:
+		fmt.Fprintln(w, "Sealed at session end (unsigned).")
+	default:
+		fmt.Fprintln(w, "Not sealed: the root was computed when the proof was made.")
+	}
+	return nil
+}
+
+func verifyProof(opts verifyProofOptions) (verifyProofResult, error) {
+	data, err := os.ReadFile(opts.proofFile)
+	if err != nil {
+		return verifyProofResult{}, err
+	}
+	var proof recorder.StateProof
+	if err := json.Unmarshal(data, &proof); err != nil {
+		return verifyProofResult{}, fmt.Errorf("decode proof: %w", err)
+	}
+
+	var pub []byte
+	if opts.keyFile != "" {
+		if pub, err = os.ReadFile(opts.keyFile); err != nil {
+			return verifyProofResult{}, fmt.Errorf("read key: %w", err)
+		}
+	}
+	if opts.file != "" {
+		sum, err := hashFile(opts.file)
+		if err != nil {
+			return verifyProofResult{}, err
+		}
+		if sum != proof.CID {
+			return verifyProofResult{}, fmt.Errorf("%s has SHA-256 %s, proof is for %s", opts.file, sum, proof.CID)
+		}
+	}
+	if err := proof.Verify(pub); err != nil {
+		return verifyProofResult{}, fmt.Errorf("proof invalid: %w", err)
+	}
+
+	result := verifyProofResult{Valid: true, Path: proof.Path, CID: proof.CID, Root: proof.Root, Sealed: proof.Sealed}
+	switch {
+	case proof.Signature != nil && pub != nil:
+		result.Sealed, result.Signer = true, "given key"
+	case proof.Signature != nil:
+		result.Sealed, result.Signer = true, keyFingerprint(proof.Signature.PublicKey)
+	}
+	return result, nil
+}
+
+// keyFingerprint shortens a PEM public key for display.
+func keyFingerprint(pemKey string) string {
+	sum := sha256.Sum256([]byte(pemKey))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/internal/metrics"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+const (
+	// quotaCheckInterval is how often usage is compared to the quotas.
+	quotaCheckInterval = time.Second
+
+	// quotaObjectInterval is how often CAS objects are counted; it takes a
+	// scan of the store.
+	quotaObjectInterval = 30 * time.Second
+)
+
+// quotaLevel is how far usage is over the quotas.
+type quotaLevel int32
+
+const (
+	quotaUnder quotaLevel = iota
+	quotaSoft
+	quotaHard
+)
+
+func (l quotaLevel) String() string {
+	switch l {
+	case quotaSoft:
+		return "soft"
+	case quotaHard:
+		return "hard"
+	}
+	return "under"
+}
+
+// quotaGuard compares what a recording captured, and what its state dir
+// stores, to the configured quotas. Over a soft quota it warns; over a hard
+// quota captures store metadata only, or stop, until usage drops again.
+type quotaGuard struct {
+	db      *pebble.DB
+	journal *recorder.Journal
+	quota   config.QuotaConfig
+
+	level atomic.Int32
+
+	mu         sync.Mutex
+	objects    int
+	countedAt  time.Time
+	exceedings int
+}
+
+// newQuotaGuard returns a guard for the session recorded by journal, or nil
+// when no quota is set.
+func newQuotaGuard(db *pebble.DB, journal *recorder.Journal, quota config.QuotaConfig) *quotaGuard {
+	if !quota.Enabled() {
+		return nil
+	}
+	return &quotaGuard{db: db, journal: journal, quota: quota}
+}
+
+// MetadataOnly reports whether captures should store metadata only. A nil
+// guard never does.
+func (g *quotaGuard) MetadataOnly() bool {
+	return g != nil && quotaLevel(g.level.Load()) == quotaHard && g.quota.HardAction == config.QuotaActionMetadata
+}
+
+// Stopped reports whether captures should be skipped. A nil guard never
+// does.
+func (g *quotaGuard) Stopped() bool {
+	return g != nil && quotaLevel(g.level.Load()) == quotaHard && g.quota.HardAction == config.QuotaActionStop
+}
+
+// Check measures usage once and updates the guard.
+func (g *quotaGuard) Check() error {
+	level, reason, err := g.measure()
+	if err != nil {
+		return err
+	}
+	prev := quotaLevel(g.level.Swap(int32(level)))
+	if level == prev {
+		return nil
+	}
+	switch {
+	case level == quotaUnder:
+		log.Printf("[quota] back under quota; capturing as configured again")
+	case level < prev:
+		log.Printf("[quota] back under the hard quota (%s); capturing as configured again", reason)
+	case level == quotaSoft:
+		metrics.QuotaExceededTotal.WithLabelValues(level.String()).Inc()
+		log.Printf("[quota] warning: %s", reason)
+	default:
+		metrics.QuotaExceededTotal.WithLabelValues(level.String()).Inc()
+		g.mu.Lock()
+		g.exceedings++
+		name := "quota-exceeded"
+		if g.exceedings > 1 {
+			name = fmt.Sprintf("quota-exceeded-%d", g.exceedings)
+		}
+		g.mu.Unlock()
+		action := "recording metadata only"
+		if g.quota.HardAction == config.QuotaActionStop {
+			action = "capture stopped"
+		}
+		log.Printf("[quota] %s; %s, marked %s", reason, action, name)
+		if err := recordMarker(g.db, name, time.Now()); err != nil {
+			log.Printf("[quota] failed to record marker: %v", err)
+		}
+	}
+	return nil
+}
+
+// measure returns the highest quota level usage reaches and why.
+func (g *quotaGuard) measure() (quotaLevel, string, error) {
+	q := g.quota
+	session := g.journal.CapturedBytes()
+	store := int64(g.db.Metrics().DiskSpaceUsage())
+	objects, err := g.countObjects()
+	if err != nil {
+		return quotaUnder, "", err
+	}
+
+	const mb = 1 << 20
+	switch {
+	case q.SessionHardMB > 0 && session >= int64(q.SessionHardMB)*mb:
+		return quotaHard, fmt.Sprintf("session captured %s, hard quota %d MB", formatSize(int(session)), q.SessionHardMB), nil
+	case q.StoreHardMB > 0 && store >= int64(q.StoreHardMB)*mb:
+		return quotaHard, fmt.Sprintf("store holds %s, hard quota %d MB", formatSize(int(store)), q.StoreHardMB), nil
+	case q.StoreHardObjects > 0 && objects >= q.StoreHardObjects:
+		return quotaHard, fmt.Sprintf("store holds %d objects, hard quota %d", objects, q.StoreHardObjects), nil
+	case q.SessionSoftMB > 0 && session >= int64(q.SessionSoftMB)*mb:
+		return quotaSoft, fmt.Sprintf("session captured %s, soft quota %d MB", formatSize(int(session)), q.SessionSoftMB), nil
+	case q.StoreSoftMB > 0 && store >= int64(q.StoreSoftMB)*mb:
+		return quotaSoft, fmt.Sprintf("store holds %s, soft quota %d MB", formatSize(int(store)), q.StoreSoftMB), nil
+	case q.StoreSoftObjects > 0 && objects >= q.StoreSoftObjects:
+		return quotaSoft, fmt.Sprintf("store holds %d objects, soft quota %d", objects, q.StoreSoftObjects), nil
+	}
+	return quotaUnder, "", nil
+}
+
+// countObjects returns the number of CAS objects, recounting at most every
+// quotaObjectInterval. It is 0 when no object quota is set.
+func (g *quotaGuard) countObjects() (int, error) {
+	if g.quota.StoreSoftObjects == 0 && g.quota.StoreHardObjects == 0 {
+		return 0, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.countedAt.IsZero() && time.Since(g.countedAt) < quotaObjectInterval {
+		return g.objects, nil
+	}
+	iter, err := newPrefixIter(g.db, cas.PrefixCAS)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("count objects: %w", err)
+	}
+	g.objects, g.countedAt = n, time.Now()
+	return n, nil
+}
+
+// Run checks usage until ctx is done.
+func (g *quotaGuard) Run(ctx context.Context) {
+	ticker := time.NewTicker(quotaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := g.Check(); err != nil {
+			log.Printf("[quota] check failed: %v", err)
+		}
+	}
+}
+
+// startQuotaGuard checks the quotas of the session recorded by journal
+// until ctx is done, or returns nil when no quota is set.
+func startQuotaGuard(ctx context.Context, db *pebble.DB, journal *recorder.Journal, cfg *config.DiffConfig) *quotaGuard {
+	quota := newQuotaGuard(db, journal, cfg.Quota)
+	if quota == nil {
+		return nil
+	}
+	if err := quota.Check(); err != nil {
+		log.Printf("[quota] check failed: %v", err)
+	}
+	go quota.Run(ctx)
+	return quota
+}
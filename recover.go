@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+	"github.com/spf13/cobra"
+)
+
+// recoverOptions carries the flags accepted by the recover command.
+type recoverOptions struct {
+	stateDir string
+	jsonOut  bool
+	force    bool
+}
+
+func newRecoverCmd() *cobra.Command {
+	var opts recoverOptions
+
+	cmd := &cobra.Command{
+		Use:   "recover --state-dir <dir>",
+		Short: "Repair a state dir left behind by a killed recorder",
+		Long: `Repair a state dir left behind by a killed recorder.
+
+Captured events still waiting in the journal are stored, truncated journal
+entries and metadata records are removed, and versions whose content is
+missing from the CAS are dropped. record runs the same recovery automatically
+when it opens an existing state dir.
+
+A recorder killed with SIGKILL leaves its lock file behind; --force takes it
+over once the owning process is confirmed gone.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			return runRecover(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().BoolVar(&opts.jsonOut, "json", false, "Print JSON instead of a summary")
+	cmd.Flags().BoolVar(&opts.force, "force", false, "Take over the state dir lock if its previous owner is no longer running")
+	return cmd
+}
+
+func runRecover(w io.Writer, opts recoverOptions) error {
+	cfg, err := loadEnvConfig(nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(opts.stateDir); err != nil {
+		return fmt.Errorf("open state dir: %w", err)
+	}
+	lock, err := statelock.Acquire(opts.stateDir, "recover", opts.force)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	db, err := pebble.Open(opts.stateDir, &pebble.Options{ErrorIfNotExists: true})
+	if err != nil {
+		return fmt.Errorf("open pebble: %w", err)
+	}
+	defer db.Close()
+
+	casStore, err := cas.NewCASStore(db, cfg.HashAlgo)
+	if err != nil {
+		return fmt.Errorf("init CAS: %w", err)
+	}
+
+	report, err := recorder.Recover(db, casStore, recorder.DefaultProcessorOptions())
+	if err != nil {
+		return fmt.Errorf("recover: %w", err)
+	}
+	if err := db.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	if !report.Clean() || report.MigratedKeys > 0 {
+		recordAudit(opts.stateDir, auditRecover, map[string]any{"report": report})
+	}
+
+	if opts.jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	writeRecoveryReport(w, report)
+	return nil
+}
+
+func writeRecoveryReport(w io.Writer, report recorder.RecoveryReport) {
+	if report.Clean() {
+		fmt.Fprintln(w, "State dir is consistent; nothing to recover.")
+	} else {
+		fmt.Fprintf(w, "Replayed journal entries:    %d\n", report.Replayed)
+		fmt.Fprintf(w, "Discarded journal entries:   %d (truncated)\n", report.DiscardedJournal)
+		fmt.Fprintf(w, "Dropped metadata records:    %d (truncated)\n", report.DroppedMetadata)
+		fmt.Fprintf(w, "Dropped versions:            %d (content missing)\n", report.MissingContent)
+		fmt.Fprintf(w, "Dropped versions:            %d (chunks do not match their root)\n", report.CorruptChunks)
+	}
+	if report.Unfinished {
+		fmt.Fprintln(w, "The recorded session has no end: the recorder did not exit cleanly.")
+	}
+	if report.MigratedKeys > 0 {
+		fmt.Fprintf(w, "Migrated %d metadata records to schema version %d.\n", report.MigratedKeys, recorder.SchemaVersion)
+	}
+}
+
+// recoverOnOpen runs crash recovery on a state dir opened for writing.
+func recoverOnOpen(db *pebble.DB, store *cas.CASStore) error {
+	report, err := recorder.Recover(db, store, recorder.DefaultProcessorOptions())
+	if err != nil {
+		return fmt.Errorf("recover state dir: %w", err)
+	}
+	if report.MigratedKeys > 0 {
+		log.Printf("[record] migrated %d metadata records to schema version %d", report.MigratedKeys, recorder.SchemaVersion)
+	}
+	if !report.Clean() {
+		log.Printf("[record] recovered state dir: replayed %d journal entries, discarded %d truncated entries, dropped %d truncated, %d incomplete and %d corrupt versions",
+			report.Replayed, report.DiscardedJournal, report.DroppedMetadata, report.MissingContent, report.CorruptChunks)
+	}
+	return nil
+}
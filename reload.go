@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/control"
+	"github.com/saworbit/diffkeeper/pkg/ebpf"
+	"github.com/spf13/cobra"
+)
+
+const opReload = "reload"
+
+// runtimeSettings is the subset of the record configuration that can be
+// changed without restarting the recorded command.
+type runtimeSettings struct {
+	Ignore               []string `json:"ignore"`
+	Debounce             string   `json:"debounce"`
+	MaxCapturesPerSecond int      `json:"max_captures_per_second"`
+	ProfilerAlpha        float64  `json:"profiler_alpha"`
+	HotPathThreshold     float64  `json:"hot_path_threshold"`
+}
+
+func runtimeSettingsOf(cfg *config.DiffConfig) runtimeSettings {
+	return runtimeSettings{
+		Ignore:               cfg.IgnorePatterns,
+		Debounce:             cfg.DebounceWindow.String(),
+		MaxCapturesPerSecond: cfg.MaxCapturesPerSecond,
+		ProfilerAlpha:        cfg.EBPF.ProfilerAlpha,
+		HotPathThreshold:     cfg.EBPF.HotPathThreshold,
+	}
+}
+
+func captureSettingsOf(cfg *config.DiffConfig) captureSettings {
+	return captureSettings{
+		ignore:       cfg.IgnorePatterns,
+		debounce:     cfg.DebounceWindow,
+		maxPerSecond: cfg.MaxCapturesPerSecond,
+	}
+}
+
+// recordReloader applies runtime-tunable settings to a running recording,
+// either by re-resolving the configuration (SIGHUP, `reload`) or from
+// explicit key=value overrides (`reload key=value`).
+type recordReloader struct {
+	load     func() (*config.DiffConfig, error)
+	gate     *captureGate
+	profiler *ebpf.Profiler
+	// stateDir receives an audit entry for every applied change; empty
+	// disables auditing.
+	stateDir string
+
+	mu      sync.Mutex
+	current *config.DiffConfig
+}
+
+// Reload re-reads the config file and environment and applies what can
+// change at runtime. Other changed settings are logged and ignored.
+func (r *recordReloader) Reload() (runtimeSettings, error) {
+	next, err := r.load()
+	if err != nil {
+		return runtimeSettings{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if next.WatchDir != r.current.WatchDir || next.HashAlgo != r.current.HashAlgo ||
+		next.MetricsAddr != r.current.MetricsAddr || next.EBPF.CaptureBackend != r.current.EBPF.CaptureBackend {
+		log.Printf("[record] reload: watch dir, hash algorithm, metrics address and capture backend only change on restart")
+	}
+
+	merged := *r.current
+	merged.IgnorePatterns = next.IgnorePatterns
+	merged.DebounceWindow = next.DebounceWindow
+	merged.MaxCapturesPerSecond = next.MaxCapturesPerSecond
+	merged.EBPF.ProfilerAlpha = next.EBPF.ProfilerAlpha
+	merged.EBPF.HotPathThreshold = next.EBPF.HotPathThreshold
+	return r.apply(&merged)
+}
+
+// Tune applies key=value overrides on top of the current settings.
+func (r *recordReloader) Tune(settings map[string]string) (runtimeSettings, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next := *r.current
+	for key, value := range settings {
+		var err error
+		switch key {
+		case "ignore":
+			next.IgnorePatterns = splitList(value)
+		case "debounce":
+			next.DebounceWindow, err = time.ParseDuration(value)
+		case "max_captures_per_second":
+			next.MaxCapturesPerSecond, err = strconv.Atoi(value)
+		case "profiler_alpha":
+			next.EBPF.ProfilerAlpha, err = strconv.ParseFloat(value, 64)
+		case "hot_path_threshold":
+			next.EBPF.HotPathThreshold, err = strconv.ParseFloat(value, 64)
+		default:
+			return runtimeSettings{}, fmt.Errorf("%q cannot be changed at runtime", key)
+		}
+		if err != nil {
+			return runtimeSettings{}, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return r.apply(&next)
+}
+
+// apply validates next and makes it current. r.mu must be held.
+func (r *recordReloader) apply(next *config.DiffConfig) (runtimeSettings, error) {
+	if err := next.Validate(); err != nil {
+		return runtimeSettings{}, err
+	}
+	r.current = next
+	r.gate.Update(captureSettingsOf(next))
+	r.profiler.SetTuning(next.EBPF.ProfilerAlpha, next.EBPF.HotPathThreshold)
+
+	applied := runtimeSettingsOf(next)
+	log.Printf("[record] runtime settings: ignore=%v debounce=%s max_captures_per_second=%d profiler_alpha=%g hot_path_threshold=%g",
+		applied.Ignore, applied.Debounce, applied.MaxCapturesPerSecond, applied.ProfilerAlpha, applied.HotPathThreshold)
+	if r.stateDir != "" {
+		recordAudit(r.stateDir, auditReload, map[string]any{"settings": applied})
+	}
+	return applied, nil
+}
+
+// register exposes reload and tune on the recorder's control socket.
+func (r *recordReloader) register(srv *control.Server) {
+	srv.Handle(opReload, func(req control.Request) (any, error) {
+		if len(req.Settings) > 0 {
+			return r.Tune(req.Settings)
+		}
+		return r.Reload()
+	})
+}
+
+// watchReloadSignal reloads the configuration on SIGHUP until ctx is done.
+func watchReloadSignal(ctx context.Context, r *recordReloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if _, err := r.Reload(); err != nil {
+					log.Printf("[record] reload failed, keeping current settings: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func newReloadCmd() *cobra.Command {
+	var stateDir string
+	var socketPath string
+
+	cmd := &cobra.Command{
+		Use:   "reload [key=value...]",
+		Short: "Change runtime settings of a running recording",
+		Long: `Change runtime settings of a running recording without restarting it.
+
+Without arguments the recorder re-reads its config file and environment, like
+sending it SIGHUP. With key=value arguments only those settings change:
+
+  ignore                   comma-separated globs (empty to clear)
+  debounce                 quiet period before a capture, e.g. 250ms
+  max_captures_per_second  per-path capture rate limit (0 = unlimited)
+  profiler_alpha           EMA smoothing factor of the hot-path profiler
+  hot_path_threshold       EMA value above which a path counts as hot`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := control.Request{Op: opReload}
+			for _, arg := range args {
+				key, value, ok := strings.Cut(arg, "=")
+				if !ok || key == "" {
+					return fmt.Errorf("expected key=value, got %q", arg)
+				}
+				if req.Settings == nil {
+					req.Settings = make(map[string]string)
+				}
+				req.Settings[key] = value
+			}
+
+			path := socketPath
+			if path == "" {
+				path = os.Getenv(control.EnvSocket)
+			}
+			if path == "" && stateDir != "" {
+				path = control.SocketPath(stateDir)
+			}
+			if path == "" {
+				return fmt.Errorf("no recorder found: run inside `diffkeeper record` or pass --state-dir")
+			}
+
+			resp, err := control.Call(path, req)
+			if err != nil {
+				return err
+			}
+			return writeRuntimeSettings(cmd.OutOrStdout(), resp.Data)
+		},
+	}
+
+	cmd.Flags().StringVar(&stateDir, "state-dir", "", "State dir of the running recording")
+	cmd.Flags().StringVar(&socketPath, "socket", "", "Control socket path (overrides $"+control.EnvSocket+")")
+	return cmd
+}
+
+func writeRuntimeSettings(w io.Writer, data json.RawMessage) error {
+	var applied runtimeSettings
+	if err := json.Unmarshal(data, &applied); err != nil {
+		return fmt.Errorf("decode reply: %w", err)
+	}
+	fmt.Fprintf(w, "ignore:                  %s\n", strings.Join(applied.Ignore, ", "))
+	fmt.Fprintf(w, "debounce:                %s\n", applied.Debounce)
+	fmt.Fprintf(w, "max_captures_per_second: %d\n", applied.MaxCapturesPerSecond)
+	fmt.Fprintf(w, "profiler_alpha:          %g\n", applied.ProfilerAlpha)
+	fmt.Fprintf(w, "hot_path_threshold:      %g\n", applied.HotPathThreshold)
+	return nil
+}
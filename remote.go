@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/remote"
+	"github.com/spf13/cobra"
+)
+
+const remoteHelp = `Remotes are one of:
+  http(s)://host:port              a "diffkeeper serve" endpoint
+  ssh://[user@]host[:port]/dir     a state dir on an ssh host
+  [user@]host:dir                  scp-style ssh shorthand
+  gs://bucket[/prefix]             a Google Cloud Storage bucket
+  az://account/container[/prefix]  an Azure Blob Storage container
+
+Over ssh the remote must have diffkeeper on its PATH (see --remote-bin).
+Set $` + remote.EnvSSH + ` to use a different ssh client.
+
+Buckets hold one object per CAS object and metadata record, named by its
+key, so state dirs pushed to the same bucket and prefix share their
+objects. For gs:// --token is an OAuth access token (e.g. from
+"gcloud auth print-access-token"); without one, the token of the GCE or GKE
+service account is used. For az:// it is a SAS token or an Entra ID access
+token; without one, the container must allow anonymous reads.`
+
+// remoteFlags are the connection flags shared by push and pull.
+type remoteFlags struct {
+	bin      string
+	token    string
+	tlsCert  string
+	tlsKey   string
+	tlsCA    string
+	endpoint string
+	// jsonOut prints the transfer stats as JSON.
+	jsonOut bool
+}
+
+func (f *remoteFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.bin, "remote-bin", "diffkeeper", "diffkeeper binary to run on ssh remotes")
+	cmd.Flags().StringVar(&f.token, "token", "", "Bearer token for http(s) remotes, or access/SAS token for gs:// and az:// (default $"+remote.EnvToken+")")
+	cmd.Flags().StringVar(&f.tlsCert, "tls-cert", "", "Client certificate (PEM) to present to https remotes")
+	cmd.Flags().StringVar(&f.tlsKey, "tls-key", "", "Private key (PEM) of --tls-cert")
+	cmd.Flags().StringVar(&f.tlsCA, "tls-ca", "", "CA certificates (PEM) to verify https remotes with instead of the system roots")
+	cmd.Flags().StringVar(&f.endpoint, "endpoint", "", "Service URL for gs:// and az:// remotes instead of the public cloud (e.g. an emulator)")
+	cmd.Flags().BoolVar(&f.jsonOut, "json", false, "Print JSON instead of a summary")
+}
+
+func (f *remoteFlags) dialOptions() (remote.DialOptions, error) {
+	opts := remote.DialOptions{RemoteCommand: f.bin, Token: f.token, Endpoint: f.endpoint}
+	if opts.Token == "" {
+		opts.Token = os.Getenv(remote.EnvToken)
+	}
+	if f.tlsCert != "" || f.tlsKey != "" || f.tlsCA != "" {
+		var err error
+		if opts.TLS, err = remote.ClientTLS(f.tlsCert, f.tlsKey, f.tlsCA); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+func newPushCmd() *cobra.Command {
+	var stateDir string
+	var flags remoteFlags
+
+	cmd := &cobra.Command{
+		Use:   "push <remote> --state-dir <dir>",
+		Short: "Send recorded state to a remote, transferring only objects it lacks",
+		Long:  "Send recorded state to a remote, transferring only objects it lacks.\n\n" + remoteHelp,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			db, err := openReadOnlyDB(stateDir)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			return runTransfer(cmd, args[0], flags, "pushed", func(t remote.Transport) (remote.Stats, error) {
+				return remote.Push(db, t)
+			})
+		},
+	}
+
+	cmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	flags.register(cmd)
+	return cmd
+}
+
+func newPullCmd() *cobra.Command {
+	var stateDir string
+	var flags remoteFlags
+
+	cmd := &cobra.Command{
+		Use:   "pull <remote> --state-dir <dir>",
+		Short: "Fetch recorded state from a remote, transferring only objects missing locally",
+		Long:  "Fetch recorded state from a remote, transferring only objects missing locally.\nThe local state dir is created if needed.\n\n" + remoteHelp,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			db, err := pebble.Open(stateDir, &pebble.Options{})
+			if err != nil {
+				return fmt.Errorf("open pebble: %w", err)
+			}
+			defer db.Close()
+
+			return runTransfer(cmd, args[0], flags, "pulled", func(t remote.Transport) (remote.Stats, error) {
+				stats, err := remote.Pull(db, t)
+				if err != nil {
+					return stats, err
+				}
+				// The remote may use an older key layout.
+				if _, err := recorder.MigrateImported(db); err != nil {
+					return stats, err
+				}
+				if stats.Objects > 0 {
+					recordAudit(stateDir, auditPull, map[string]any{"remote": args[0], "objects": stats.Objects, "bytes": stats.Bytes})
+				}
+				return stats, nil
+			})
+		},
+	}
+
+	cmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory where Pebble state is stored (created if missing)")
+	flags.register(cmd)
+	return cmd
+}
+
+func newGCCmd() *cobra.Command {
+	var flags remoteFlags
+
+	cmd := &cobra.Command{
+		Use:   "gc <remote>",
+		Short: "Delete objects on a remote that no recorded version references",
+		Long: `Delete objects on a remote that no recorded version references.
+
+Needs an admin credential on "diffkeeper serve" remotes. The remote refuses
+it for a minute after a push, which sends objects before the versions that
+reference them, so gc cannot delete what a push is still sending.
+
+Do not run it against a remote tier (tier.remote, $DIFFKEEPER_TIER_REMOTE):
+the metadata referencing its objects lives in the recording state dir, not
+on the remote.
+
+` + remoteHelp,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts, err := flags.dialOptions()
+			if err != nil {
+				return err
+			}
+			t, err := remote.Dial(args[0], opts)
+			if err != nil {
+				return err
+			}
+			removed, err := remote.GC(t)
+			if cerr := t.Close(); err == nil && cerr != nil {
+				err = fmt.Errorf("close remote: %w", cerr)
+			}
+			if err != nil {
+				return err
+			}
+
+			if flags.jsonOut {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(gcReport{Removed: removed})
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "removed %d unreferenced objects\n", removed)
+			return nil
+		},
+	}
+
+	flags.register(cmd)
+	return cmd
+}
+
+// gcReport is what gc prints with --json.
+type gcReport struct {
+	Removed int `json:"removed"`
+}
+
+// transferReport is what push and pull print with --json.
+type transferReport struct {
+	Objects  int   `json:"objects"`
+	Bytes    int64 `json:"bytes"`
+	Existing int   `json:"existing"`
+}
+
+func runTransfer(cmd *cobra.Command, target string, flags remoteFlags, verb string, transfer func(remote.Transport) (remote.Stats, error)) error {
+	opts, err := flags.dialOptions()
+	if err != nil {
+		return err
+	}
+	t, err := remote.Dial(target, opts)
+	if err != nil {
+		return err
+	}
+
+	stats, err := transfer(t)
+	if cerr := t.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("close remote: %w", cerr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if flags.jsonOut {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		return enc.Encode(transferReport{Objects: stats.Objects, Bytes: stats.Bytes, Existing: stats.Existing})
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "%s %d objects (%s), %d already present\n", verb, stats.Objects, formatSize(int(stats.Bytes)), stats.Existing)
+	return nil
+}
+
+func newServeCmd() *cobra.Command {
+	var stateDir string
+	var listen string
+	var readOnly bool
+	var accessFile, tlsCert, tlsKey, clientCA string
+	var allowUnauthenticated bool
+
+	cmd := &cobra.Command{
+		Use:   "serve --state-dir <dir> --listen <addr>",
+		Short: "Serve a state dir over HTTP for push and pull",
+		Long: `Serve a state dir over HTTP for push and pull.
+
+Recorded state often holds secrets, so requests must carry credentials
+listed in --access-file, one per line with the scope it grants:
+
+  read    token:<secret>     list recorded paths and fetch their metadata
+  export  token:<secret>     also fetch file content (pull)
+  write   token:<secret>     also push
+  admin   cn:<name>          also gc; a client certificate, verified against --client-ca
+
+Clients send tokens with push/pull --token (or $` + remote.EnvToken + `).
+Serve over TLS with --tls-cert and --tls-key; --client-ca also accepts
+client certificates (mutual TLS). Credentials bound to namespaces with
+ns:<namespace> are for collect and are refused here. Without --access-file
+only loopback addresses may be served, unless --allow-unauthenticated is
+given.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			var access *remote.Access
+			if accessFile != "" {
+				var err error
+				if access, err = remote.LoadAccess(accessFile); err != nil {
+					return err
+				}
+				if access.NeedsClientCerts() && clientCA == "" {
+					return fmt.Errorf("access file lists client certificates; --client-ca is required")
+				}
+			} else if !allowUnauthenticated && !isLoopbackAddr(listen) {
+				return fmt.Errorf("refusing to serve %s without --access-file (pass --allow-unauthenticated to override)", listen)
+			}
+			if (tlsCert == "") != (tlsKey == "") {
+				return fmt.Errorf("--tls-cert and --tls-key must be given together")
+			}
+			if clientCA != "" && tlsCert == "" {
+				return fmt.Errorf("--client-ca requires --tls-cert and --tls-key")
+			}
+
+			db, err := pebble.Open(stateDir, &pebble.Options{ReadOnly: readOnly})
+			if err != nil {
+				return fmt.Errorf("open pebble: %w", err)
+			}
+			defer db.Close()
+
+			handler := remote.NewHandler(db, readOnly)
+			if access != nil {
+				handler.RequireAccess(access)
+			}
+			mux := http.NewServeMux()
+			mux.Handle(remote.HTTPPath, handler)
+			srv := &http.Server{Addr: listen, Handler: mux}
+			if tlsCert != "" {
+				if srv.TLSConfig, err = remote.ServerTLS(tlsCert, tlsKey, clientCA); err != nil {
+					return err
+				}
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				_ = srv.Shutdown(context.Background())
+			}()
+
+			log.Printf("[serve] serving %s on %s (read-only=%t, tls=%t, auth=%t)", stateDir, listen, readOnly, tlsCert != "", access != nil)
+			if tlsCert != "" {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			if readOnly {
+				return nil
+			}
+			// Pushes from an older build use the old key layout.
+			_, err = recorder.MigrateImported(db)
+			return err
+		},
+	}
+
+	cmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&listen, "listen", "127.0.0.1:7070", "Address to listen on")
+	cmd.Flags().BoolVar(&readOnly, "read-only", false, "Reject pushes")
+	cmd.Flags().StringVar(&accessFile, "access-file", "", "File of credentials and their scopes (read, export, write, admin)")
+	cmd.Flags().StringVar(&tlsCert, "tls-cert", "", "Serve HTTPS with this certificate (PEM)")
+	cmd.Flags().StringVar(&tlsKey, "tls-key", "", "Private key (PEM) of --tls-cert")
+	cmd.Flags().StringVar(&clientCA, "client-ca", "", "CA certificates (PEM) that sign accepted client certificates")
+	cmd.Flags().BoolVar(&allowUnauthenticated, "allow-unauthenticated", false, "Serve a non-loopback address without --access-file")
+	return cmd
+}
+
+// isLoopbackAddr reports whether a listen address only accepts local
+// connections.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newSyncServeCmd is the remote end of ssh push/pull; it speaks the sync
+// protocol on stdin/stdout.
+func newSyncServeCmd() *cobra.Command {
+	var stateDir string
+
+	cmd := &cobra.Command{
+		Use:    "sync-serve --state-dir <dir>",
+		Short:  "Serve the sync protocol on stdin/stdout (used by push/pull over ssh)",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			db, err := pebble.Open(stateDir, &pebble.Options{})
+			if err != nil {
+				return fmt.Errorf("open pebble: %w", err)
+			}
+			defer db.Close()
+
+			if err := remote.NewHandler(db, false).ServeStream(cmd.InOrStdin(), cmd.OutOrStdout()); err != nil {
+				return err
+			}
+			// Pushes from an older build use the old key layout.
+			_, err = recorder.MigrateImported(db)
+			return err
+		},
+	}
+
+	cmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	return cmd
+}
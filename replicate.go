@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/remote"
+	"github.com/spf13/cobra"
+)
+
+func newReplicateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "replicate",
+		Short: "Inspect replication of a state dir to its standby",
+		Long: `Inspect replication of a state dir to its standby.
+
+Recorders with replication.target set (or $DIFFKEEPER_REPLICATION_TARGET)
+ship every object and version to the standby in the background, every
+replication.interval. The target is any push remote, or file:///path for a
+state dir on another volume of the same machine.`,
+	}
+	cmd.AddCommand(newReplicateStatusCmd())
+	return cmd
+}
+
+// replicateStatusOptions carries the flags accepted by `replicate status`.
+type replicateStatusOptions struct {
+	stateDir string
+	jsonOut  bool
+}
+
+func newReplicateStatusCmd() *cobra.Command {
+	var opts replicateStatusOptions
+
+	cmd := &cobra.Command{
+		Use:   "status --state-dir <dir>",
+		Short: "Show how far the standby is behind",
+		Long: `Show how far the standby is behind.
+
+Lag is the time since the standby last held everything recorded: losing the
+state dir now would lose the history of that window. Pending counts what is
+recorded but not shipped yet. Works while the state dir is being recorded.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			return runReplicateStatus(cmd.OutOrStdout(), opts, time.Now())
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().BoolVar(&opts.jsonOut, "json", false, "Print JSON instead of a table")
+	return cmd
+}
+
+// replicationReport is what `replicate status` prints.
+type replicationReport struct {
+	remote.ReplicationStatus
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+func runReplicateStatus(w io.Writer, opts replicateStatusOptions, now time.Time) error {
+	db, err := openReadOnlyDB(opts.stateDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	status, ok, err := remote.ReadReplicationStatus(db)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s has never been replicated (set replication.target)", opts.stateDir)
+	}
+	// The stored counts are from the last pass; count what is pending now.
+	if status.PendingKeys, status.PendingBytes, err = remote.ReplicationPending(db); err != nil {
+		return fmt.Errorf("count pending keys: %w", err)
+	}
+	report := replicationReport{ReplicationStatus: status, LagSeconds: status.Lag(now).Seconds()}
+
+	if opts.jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	fmt.Fprintf(w, "Standby:      %s\n", status.Target)
+	if status.CaughtUp.IsZero() {
+		fmt.Fprintf(w, "Lag:          never caught up\n")
+	} else {
+		fmt.Fprintf(w, "Lag:          %s (caught up at %s)\n", status.Lag(now).Round(time.Second), status.CaughtUp.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Pending:      %d keys (%s)\n", status.PendingKeys, formatSize(int(status.PendingBytes)))
+	fmt.Fprintf(w, "Shipped:      %d keys (%s)\n", status.ShippedKeys, formatSize(int(status.ShippedBytes)))
+	fmt.Fprintf(w, "Last attempt: %s\n", status.LastAttempt.Format(time.RFC3339))
+	if status.LastError != "" {
+		fmt.Fprintf(w, "Last error:   %s\n", status.LastError)
+	}
+	return nil
+}
+
+// startReplication ships what a recorder stores to cfg.Replication.Target
+// every interval. stop waits for a final pass and may be called more than
+// once.
+func startReplication(db *pebble.DB, cfg *config.DiffConfig) (stop func(), err error) {
+	target := cfg.Replication.Target
+	if target == "" {
+		return func() {}, nil
+	}
+	t, err := remote.Dial(target, remote.DialOptions{Token: os.Getenv(remote.EnvToken), Endpoint: cfg.Replication.Endpoint})
+	if err != nil {
+		return nil, fmt.Errorf("dial replication target: %w", err)
+	}
+	replicator, err := remote.NewReplicator(db, t, target)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		replicator.Run(ctx, cfg.Replication.Interval)
+	}()
+	log.Printf("[replicate] shipping to standby %s every %s", target, cfg.Replication.Interval)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+			if err := t.Close(); err != nil {
+				log.Printf("[replicate] close standby: %v", err)
+			}
+		})
+	}, nil
+}
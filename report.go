@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/spf13/cobra"
+)
+
+const (
+	reportFormatTable = "table"
+	reportFormatCSV   = "csv"
+	reportFormatJSON  = "json"
+
+	churnSortCaptures = "captures"
+	churnSortBytes    = "bytes"
+)
+
+func newReportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Aggregate reports over a recording",
+	}
+	cmd.AddCommand(newChurnReportCmd())
+	return cmd
+}
+
+// churnOptions carries the flags accepted by `report churn`.
+type churnOptions struct {
+	stateDir string
+	fromTime string
+	toTime   string
+	top      int
+	sortBy   string
+	format   string
+}
+
+func newChurnReportCmd() *cobra.Command {
+	var opts churnOptions
+
+	cmd := &cobra.Command{
+		Use:         "churn --state-dir <dir>",
+		Short:       "Rank paths by how often and how much they were written",
+		Annotations: map[string]string{annotationJSONOutput: "format=" + reportFormatJSON},
+		Long: `Rank paths by how often and how much they were written.
+
+Use it to find log writers and caches worth adding to the ignore rules. Bytes
+are the logical sizes of every captured version, before deduplication.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			switch opts.sortBy {
+			case churnSortCaptures, churnSortBytes:
+			default:
+				return fmt.Errorf("unsupported --sort %q (use captures or bytes)", opts.sortBy)
+			}
+			switch opts.format {
+			case reportFormatTable, reportFormatCSV, reportFormatJSON:
+			default:
+				return fmt.Errorf("unsupported --format %q (use table, csv, or json)", opts.format)
+			}
+			return runChurnReport(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&opts.fromTime, "from", "", "Only count captures after this point in time")
+	cmd.Flags().StringVar(&opts.toTime, "to", "latest", "Only count captures up to this point in time")
+	cmd.Flags().IntVar(&opts.top, "top", 20, "Number of paths to list (0 for all)")
+	cmd.Flags().StringVar(&opts.sortBy, "sort", churnSortCaptures, "Rank by captures or bytes")
+	cmd.Flags().StringVar(&opts.format, "format", reportFormatTable, "Output format: table, csv, or json")
+	completeValues(cmd, "sort", churnSortCaptures, churnSortBytes)
+	completeValues(cmd, "format", reportFormatTable, reportFormatCSV, reportFormatJSON)
+	_ = cmd.RegisterFlagCompletionFunc("from", completeTime)
+	_ = cmd.RegisterFlagCompletionFunc("to", completeTime)
+	return cmd
+}
+
+// pathChurn is one path's write activity.
+type pathChurn struct {
+	Path         string    `json:"path"`
+	Captures     int       `json:"captures"`
+	Bytes        int64     `json:"bytes"`
+	FirstCapture time.Time `json:"first_capture"`
+	LastCapture  time.Time `json:"last_capture"`
+	PerMinute    float64   `json:"captures_per_minute"`
+}
+
+func runChurnReport(w io.Writer, opts churnOptions) error {
+	db, _, err := openReadOnlyStore(opts.stateDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	anchors := loadSessionAnchors(db)
+	to, err := parseTargetTime(opts.toTime, anchors)
+	if err != nil {
+		return err
+	}
+	var from time.Time
+	if opts.fromTime != "" {
+		if from, err = parseTargetTime(opts.fromTime, anchors); err != nil {
+			return err
+		}
+	}
+
+	history, err := loadMetadataHistory(db, to)
+	if err != nil {
+		return err
+	}
+	lo := sort.Search(len(history), func(i int) bool { return history[i].Timestamp > from.UnixNano() })
+	churn := rankChurn(history[lo:], opts.sortBy, opts.top)
+
+	switch opts.format {
+	case reportFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(churn)
+	case reportFormatCSV:
+		return writeChurnCSV(w, churn)
+	default:
+		return writeChurnTable(w, churn)
+	}
+}
+
+// rankChurn aggregates history per path and returns the top entries ordered
+// by sortBy; top <= 0 keeps every path.
+func rankChurn(history []recorder.MetadataRecord, sortBy string, top int) []pathChurn {
+	byPath := make(map[string]*pathChurn)
+	for _, meta := range history {
+		at := time.Unix(0, meta.Timestamp)
+		c, ok := byPath[meta.Path]
+		if !ok {
+			c = &pathChurn{Path: meta.Path, FirstCapture: at}
+			byPath[meta.Path] = c
+		}
+		c.Captures++
+		c.Bytes += int64(meta.Size)
+		c.LastCapture = at
+	}
+
+	churn := make([]pathChurn, 0, len(byPath))
+	for _, c := range byPath {
+		if span := c.LastCapture.Sub(c.FirstCapture); span >= time.Second {
+			c.PerMinute = float64(c.Captures) / span.Minutes()
+		}
+		churn = append(churn, *c)
+	}
+
+	sort.Slice(churn, func(i, j int) bool {
+		a, b := churn[i], churn[j]
+		primaryA, primaryB := int64(a.Captures), int64(b.Captures)
+		secondaryA, secondaryB := a.Bytes, b.Bytes
+		if sortBy == churnSortBytes {
+			primaryA, primaryB, secondaryA, secondaryB = secondaryA, secondaryB, primaryA, primaryB
+		}
+		if primaryA != primaryB {
+			return primaryA > primaryB
+		}
+		if secondaryA != secondaryB {
+			return secondaryA > secondaryB
+		}
+		return a.Path < b.Path
+	})
+	if top > 0 && len(churn) > top {
+		churn = churn[:top]
+	}
+	return churn
+}
+
+func writeChurnCSV(w io.Writer, churn []pathChurn) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"path", "captures", "bytes", "first_capture", "last_capture", "captures_per_minute"})
+	for _, c := range churn {
+		cw.Write([]string{
+			c.Path,
+			strconv.Itoa(c.Captures),
+			strconv.FormatInt(c.Bytes, 10),
+			c.FirstCapture.UTC().Format(time.RFC3339Nano),
+			c.LastCapture.UTC().Format(time.RFC3339Nano),
+			strconv.FormatFloat(c.PerMinute, 'f', 2, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeChurnTable(w io.Writer, churn []pathChurn) error {
+	if len(churn) == 0 {
+		_, err := fmt.Fprintln(w, "No captures recorded.")
+		return err
+	}
+	fmt.Fprintf(w, "%-9s %-10s %-8s %s\n", "CAPTURES", "BYTES", "PER MIN", "PATH")
+	for _, c := range churn {
+		rate := "-"
+		if c.PerMinute > 0 {
+			rate = strconv.FormatFloat(c.PerMinute, 'f', 1, 64)
+		}
+		fmt.Fprintf(w, "%-9d %-10s %-8s %s\n", c.Captures, formatSize(int(c.Bytes)), rate, c.Path)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+// sampleResources records the CPU, memory and I/O of the process tree
+// rooted at pid, and the free space under watchDir, in namespace ns every
+// interval until ctx is done. It stops early, with one log line, where the platform
+// cannot report process usage.
+func sampleResources(ctx context.Context, db *pebble.DB, ns string, pid int, watchDir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sample, err := readProcessTreeUsage(pid)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("[resources] sampling stopped: %v", err)
+			}
+			return
+		}
+		if free, err := diskFree(watchDir); err == nil {
+			sample.DiskFreeBytes = free
+		}
+		sample.Timestamp = time.Now().UnixNano()
+		if err := recorder.RecordResourceSample(db, ns, sample); err != nil {
+			log.Printf("[resources] %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resourceSummary aggregates the samples of a recording.
+type resourceSummary struct {
+	Samples     int     `json:"samples"`
+	PeakRSS     int64   `json:"peak_rss_bytes"`
+	CPUSeconds  float64 `json:"cpu_seconds"`
+	ReadBytes   int64   `json:"read_bytes"`
+	WriteBytes  int64   `json:"write_bytes"`
+	MinDiskFree uint64  `json:"min_disk_free_bytes,omitempty"`
+}
+
+func summarizeResources(samples []recorder.ResourceSample) resourceSummary {
+	sum := resourceSummary{Samples: len(samples)}
+	for _, s := range samples {
+		sum.PeakRSS = max(sum.PeakRSS, s.RSSBytes)
+		sum.CPUSeconds = max(sum.CPUSeconds, s.CPUSeconds)
+		sum.ReadBytes = max(sum.ReadBytes, s.ReadBytes)
+		sum.WriteBytes = max(sum.WriteBytes, s.WriteBytes)
+		if s.DiskFreeBytes > 0 && (sum.MinDiskFree == 0 || s.DiskFreeBytes < sum.MinDiskFree) {
+			sum.MinDiskFree = s.DiskFreeBytes
+		}
+	}
+	return sum
+}
+
+func writeResourceSummary(w io.Writer, sum resourceSummary) {
+	line := fmt.Sprintf("Resources:       peak RSS %s, CPU %.1fs, read %s, written %s", formatSize(int(sum.PeakRSS)), sum.CPUSeconds, formatSize(int(sum.ReadBytes)), formatSize(int(sum.WriteBytes)))
+	if sum.MinDiskFree > 0 {
+		line += ", min disk free " + formatSize(int(sum.MinDiskFree))
+	}
+	fmt.Fprintf(w, "%s (%d samples)\n", line, sum.Samples)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+// userHZ is the unit of the CPU times in /proc/<pid>/stat, fixed at 100 on
+// Linux regardless of the kernel's internal tick rate.
+const userHZ = 100
+
+// readProcessTreeUsage sums /proc counters over pid and its descendants.
+// Processes that exit while being read are skipped.
+func readProcessTreeUsage(pid int) (recorder.ResourceSample, error) {
+	var sample recorder.ResourceSample
+	if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid))); err != nil {
+		return sample, fmt.Errorf("read process %d: %w", pid, err)
+	}
+	page := int64(os.Getpagesize())
+	for _, p := range processTree(pid) {
+		dir := filepath.Join("/proc", strconv.Itoa(p))
+		stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			continue
+		}
+		end := strings.LastIndexByte(string(stat), ')')
+		if end < 0 {
+			continue
+		}
+		// Fields after the command name, starting with state: utime,
+		// stime, cutime and cstime are 11-14 and rss (pages) is 21.
+		fields := strings.Fields(string(stat[end+1:]))
+		if len(fields) < 22 {
+			continue
+		}
+		var ticks int64
+		for _, f := range fields[11:15] {
+			n, _ := strconv.ParseInt(f, 10, 64)
+			ticks += n
+		}
+		rss, _ := strconv.ParseInt(fields[21], 10, 64)
+
+		sample.Processes++
+		sample.CPUSeconds += float64(ticks) / userHZ
+		sample.RSSBytes += rss * page
+		read, written := procIO(dir)
+		sample.ReadBytes += read
+		sample.WriteBytes += written
+	}
+	return sample, nil
+}
+
+// procIO returns the storage bytes read and written by a process. The file
+// is only readable for processes of the same user.
+func procIO(dir string) (read, written int64) {
+	data, err := os.ReadFile(filepath.Join(dir, "io"))
+	if err != nil {
+		return 0, 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "read_bytes:"); ok {
+			read, _ = strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		} else if v, ok := strings.CutPrefix(line, "write_bytes:"); ok {
+			written, _ = strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		}
+	}
+	return read, written
+}
+
+// diskFree returns the bytes available to unprivileged users on the
+// filesystem holding path.
+func diskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+func readProcessTreeUsage(int) (recorder.ResourceSample, error) {
+	return recorder.ResourceSample{}, fmt.Errorf("process usage needs /proc, which %s does not have", runtime.GOOS)
+}
+
+func diskFree(string) (uint64, error) {
+	return 0, fmt.Errorf("free space is only checked on Linux")
+}
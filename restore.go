@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/glob"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/saworbit/diffkeeper/pkg/statelock"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// restoreBackupDirName holds the safety backups restore takes, one
+	// timestamped directory per run.
+	restoreBackupDirName = "restore-backups"
+
+	// restoreManifestName lists what a restore changed, inside its backup.
+	restoreManifestName = "restore.json"
+
+	restoreTempPrefix = ".diffkeeper-restore-"
+)
+
+// restoreOptions carries the flags accepted by the restore command.
+type restoreOptions struct {
+	stateDir  string
+	watchDir  string
+	atTime    string
+	namespace string
+	paths     []string
+	backupDir string
+	noBackup  bool
+	dryRun    bool
+	force     bool
+}
+
+func newRestoreCmd() *cobra.Command {
+	var opts restoreOptions
+
+	cmd := &cobra.Command{
+		Use:   "restore --state-dir <dir> --watch <dir> --time <timestamp>",
+		Short: "Rewind the watch directory in place to a point in time",
+		Long: `Rewind the watch directory in place to a point in time.
+
+Recorded files whose content differs from --time are rewritten, and files first
+recorded after --time are removed. Files diffkeeper never recorded are left
+alone, as are files recorded with --observe or truncated by --max-file-size-mb,
+whose content was not stored in full.
+
+Before anything changes, every file that will be overwritten or removed is
+copied to a backup directory (default: restore-backups/<time> in the state dir)
+together with restore.json, which lists the changes. Restore takes the state
+dir lock, so it cannot run while the directory is being recorded.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			if opts.noBackup && opts.backupDir != "" {
+				return fmt.Errorf("--backup-dir cannot be combined with --no-backup")
+			}
+			if err := config.ValidateNamespace(opts.namespace); err != nil {
+				return err
+			}
+			for _, p := range opts.paths {
+				if err := glob.Validate(p); err != nil {
+					return fmt.Errorf("invalid --path pattern %q: %w", p, err)
+				}
+			}
+			return runRestore(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&opts.watchDir, "watch", ".", "Watch directory of the recording, rewritten in place")
+	cmd.Flags().StringVar(&opts.atTime, "time", "latest", "Timestamp, duration, or anchor (e.g. 2s, 2025-01-02T15:04:05Z, end-5s, failure, event:<marker>)")
+	cmd.Flags().StringVar(&opts.namespace, "namespace", "", "Restore the files recorded with record --namespace")
+	cmd.Flags().StringArrayVar(&opts.paths, "path", nil, "Only restore paths matching this glob (repeatable, supports **)")
+	cmd.Flags().StringVar(&opts.backupDir, "backup-dir", "", "Where to back up files before they change (default: restore-backups/<time> in the state dir)")
+	cmd.Flags().BoolVar(&opts.noBackup, "no-backup", false, "Change files without backing them up first")
+	cmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "Print the changes without making them")
+	cmd.Flags().BoolVar(&opts.force, "force", false, "Take over the state dir lock if its previous owner is no longer running")
+	return cmd
+}
+
+// restoreChange is one file restore rewrites or removes.
+type restoreChange struct {
+	Path   string `json:"path"` // slash-separated, relative to the watch dir
+	Remove bool   `json:"remove,omitempty"`
+	// Created is set when the file did not exist before the restore, so
+	// undoing it means deleting the file rather than copying the backup.
+	Created bool `json:"created,omitempty"`
+
+	meta recorder.MetadataRecord
+	mode fs.FileMode
+}
+
+// restoreManifest is written to the backup directory.
+type restoreManifest struct {
+	TargetTime int64           `json:"target_time,omitempty"`
+	WatchDir   string          `json:"watch_dir"`
+	Changes    []restoreChange `json:"changes"`
+}
+
+func runRestore(w io.Writer, opts restoreOptions) error {
+	cfg, err := loadEnvConfig(nil)
+	if err != nil {
+		return err
+	}
+	watchDir, err := filepath.Abs(opts.watchDir)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(watchDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("watch dir %s is not a directory", opts.watchDir)
+	}
+
+	if _, err := os.Stat(opts.stateDir); err != nil {
+		return fmt.Errorf("open state dir: %w", err)
+	}
+	lock, err := statelock.Acquire(opts.stateDir, "restore", opts.force)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	db, casStore, err := openReadOnlyStoreWithConfig(opts.stateDir, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	targetTime, err := parseTargetTime(opts.atTime, loadSessionAnchors(db))
+	if err != nil {
+		return err
+	}
+	r, err := newRestorer(db, casStore, watchDir, opts.namespace, opts.paths)
+	if err != nil {
+		return err
+	}
+	changes, err := r.plan(targetTime)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(w, "%s already matches %s\n", opts.watchDir, targetTime.Format(time.RFC3339Nano))
+		return nil
+	}
+	if opts.dryRun {
+		for _, c := range changes {
+			fmt.Fprintf(w, "%s %s\n", restoreVerb(c), c.Path)
+		}
+		fmt.Fprintf(w, "%d files would change (dry run)\n", len(changes))
+		return nil
+	}
+
+	backupDir := opts.backupDir
+	if !opts.noBackup {
+		if backupDir == "" {
+			backupDir = filepath.Join(opts.stateDir, restoreBackupDirName, time.Now().UTC().Format("20060102T150405.000Z"))
+		}
+		manifest := restoreManifest{TargetTime: targetTime.UnixNano(), WatchDir: watchDir, Changes: changes}
+		if err := backupRestore(watchDir, backupDir, manifest); err != nil {
+			return err
+		}
+	}
+
+	if err := r.apply(changes); err != nil {
+		return err
+	}
+	details := map[string]any{"watch_dir": watchDir, "target": targetTime.UTC().Format(time.RFC3339Nano), "files": len(changes)}
+	if !opts.noBackup {
+		details["backup"] = backupDir
+	}
+	recordAudit(opts.stateDir, auditRestore, details)
+
+	fmt.Fprintf(w, "Restored %s to %s: %d files changed\n", opts.watchDir, targetTime.Format(time.RFC3339Nano), len(changes))
+	if !opts.noBackup {
+		fmt.Fprintf(w, "Backup of the previous state: %s\n", backupDir)
+	}
+	return nil
+}
+
+// restorer rewinds a watch dir to recorded points in time.
+type restorer struct {
+	db       *pebble.DB
+	casStore *cas.CASStore
+	// content, when set, caches the versions plan compares with the watch
+	// dir; bisect plans the same unchanged files at every step.
+	content   *recorder.ContentCache
+	watchDir  string
+	namespace string
+	paths     []string
+	// latest is the newest version of every path recorded in namespace.
+	latest map[string]recorder.MetadataRecord
+}
+
+func newRestorer(db *pebble.DB, casStore *cas.CASStore, watchDir, namespace string, paths []string) (*restorer, error) {
+	latest, err := loadMetadataAt(db, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	latest = recorder.NamespaceState(latest, namespace)
+	return &restorer{db: db, casStore: casStore, watchDir: watchDir, namespace: namespace, paths: paths, latest: latest}, nil
+}
+
+// plan compares the watch dir with the state at target and returns the
+// changes, sorted by path. Target files whose content was not stored in
+// full (observed or truncated) are logged and left alone.
+func (r *restorer) plan(target time.Time) ([]restoreChange, error) {
+	state, err := loadMetadataAt(r.db, target)
+	if err != nil {
+		return nil, err
+	}
+	state = recorder.NamespaceState(state, r.namespace)
+	attrs, err := recorder.AttrsAt(r.db, target)
+	if err != nil {
+		return nil, err
+	}
+	attrs = recorder.NamespaceAttrs(attrs, r.namespace)
+
+	var changes []restoreChange
+	var skipped int
+	for path, meta := range state {
+		rel := filepath.ToSlash(cleanPath(path))
+		if !glob.MatchAny(r.paths, rel) {
+			continue
+		}
+		if meta.Observed || meta.Truncated != nil {
+			skipped++
+			continue
+		}
+		change := restoreChange{Path: rel, meta: meta}
+		if attr, ok := attrs[path]; ok && !attr.IsDir() {
+			change.mode = attr.Mode
+		}
+
+		current, err := os.ReadFile(filepath.Join(r.watchDir, filepath.FromSlash(rel)))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			change.Created = true
+		case err != nil:
+			return nil, fmt.Errorf("read %s: %w", rel, err)
+		case len(current) == meta.Size:
+			want, err := r.content.Read(r.casStore, meta)
+			if err != nil {
+				return nil, fmt.Errorf("load CAS object %s: %w", meta.CID, err)
+			}
+			if bytes.Equal(current, want) {
+				continue
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	// Files first recorded after the target did not exist yet.
+	for path := range r.latest {
+		if _, ok := state[path]; ok {
+			continue
+		}
+		rel := filepath.ToSlash(cleanPath(path))
+		if !glob.MatchAny(r.paths, rel) {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(r.watchDir, filepath.FromSlash(rel))); err != nil {
+			continue
+		}
+		changes = append(changes, restoreChange{Path: rel, Remove: true})
+	}
+
+	if skipped > 0 {
+		log.Printf("[restore] left %d files alone: their content was not stored in full", skipped)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// restoreTo brings the watch dir to the state at target.
+func (r *restorer) restoreTo(target time.Time) error {
+	changes, err := r.plan(target)
+	if err != nil {
+		return err
+	}
+	return r.apply(changes)
+}
+
+// apply makes the planned changes in the watch dir.
+func (r *restorer) apply(changes []restoreChange) error {
+	for _, c := range changes {
+		if err := applyRestoreChange(r.watchDir, r.casStore, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupRestore copies every file the restore overwrites or removes into
+// backupDir and writes the manifest next to them.
+func backupRestore(watchDir, backupDir string, manifest restoreManifest) error {
+	if err := ensureEmptyDir(backupDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(backupDir, 0o755); err != nil {
+		return fmt.Errorf("create backup dir: %w", err)
+	}
+	for _, c := range manifest.Changes {
+		if c.Created {
+			continue
+		}
+		src := filepath.Join(watchDir, filepath.FromSlash(c.Path))
+		dest := filepath.Join(backupDir, filepath.FromSlash(c.Path))
+		if err := copyFile(src, dest); err != nil {
+			return fmt.Errorf("back up %s: %w", c.Path, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode restore manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(backupDir, restoreManifestName), data, 0o644); err != nil {
+		return fmt.Errorf("write restore manifest: %w", err)
+	}
+	return nil
+}
+
+// applyRestoreChange removes c.Path or replaces it with the recorded
+// content. Files are written to a temporary name and renamed into place so
+// a failed restore never leaves a partial file.
+func applyRestoreChange(watchDir string, casStore *cas.CASStore, c restoreChange) error {
+	dest := filepath.Join(watchDir, filepath.FromSlash(c.Path))
+	if c.Remove {
+		if err := os.Remove(dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove %s: %w", c.Path, err)
+		}
+		return nil
+	}
+
+	mode := c.mode.Perm()
+	if mode == 0 {
+		mode = 0o644
+		if info, err := os.Stat(dest); err == nil {
+			mode = info.Mode().Perm()
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return fmt.Errorf("create parent for %s: %w", c.Path, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), restoreTempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("write %s: %w", c.Path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	src, err := recorder.OpenContent(casStore, c.meta)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("load CAS object %s: %w", c.meta.CID, err)
+	}
+	_, err = io.Copy(tmp, src)
+	src.Close()
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %w", c.Path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", c.Path, err)
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return fmt.Errorf("set mode of %s: %w", c.Path, err)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("replace %s: %w", c.Path, err)
+	}
+	return nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func restoreVerb(c restoreChange) string {
+	switch {
+	case c.Remove:
+		return "remove "
+	case c.Created:
+		return "create "
+	default:
+		return "rewrite"
+	}
+}
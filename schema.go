@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/saworbit/diffkeeper/internal/version"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// schemaVersion changes whenever the layout of the schema does, so tools
+// reading it can tell.
+const schemaVersion = 1
+
+// cliSchema is what schema prints: the root command, with the version of
+// diffkeeper it describes.
+type cliSchema struct {
+	SchemaVersion int    `json:"schema_version"`
+	Version       string `json:"version"`
+	commandSchema
+}
+
+// commandSchema describes a command and the commands under it.
+type commandSchema struct {
+	Name    string   `json:"name"`
+	Path    string   `json:"path"`
+	Use     string   `json:"use"`
+	Short   string   `json:"short,omitempty"`
+	Long    string   `json:"long,omitempty"`
+	Aliases []string `json:"aliases,omitempty"`
+	// Runnable is false for commands that only group others.
+	Runnable bool `json:"runnable"`
+	// JSONOutput is set when the command accepts --output json.
+	JSONOutput bool            `json:"json_output"`
+	Flags      []flagSchema    `json:"flags,omitempty"`
+	Commands   []commandSchema `json:"commands,omitempty"`
+}
+
+// flagSchema describes a flag. Persistent flags apply to the commands under
+// the one they are listed on too.
+type flagSchema struct {
+	Name       string `json:"name"`
+	Shorthand  string `json:"shorthand,omitempty"`
+	Type       string `json:"type"`
+	Default    string `json:"default"`
+	Usage      string `json:"usage"`
+	Persistent bool   `json:"persistent,omitempty"`
+	// Values lists the only values the flag accepts, when they are fixed.
+	Values []string `json:"values,omitempty"`
+}
+
+func newSchemaCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "schema",
+		Short: "Print the commands and flags of the CLI as JSON",
+		Long: `Print the commands and flags of the CLI as JSON.
+
+Wrapper tools and pipeline generators can read it to stay in sync with the
+CLI instead of parsing --help. Hidden and deprecated commands and flags are
+left out. schema_version changes whenever the layout of the output does.`,
+		Args:        cobra.NoArgs,
+		Annotations: map[string]string{annotationJSONOutput: "always"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			enc.SetEscapeHTML(false)
+			return enc.Encode(cliSchema{
+				SchemaVersion: schemaVersion,
+				Version:       version.Version,
+				commandSchema: describeCommand(cmd.Root()),
+			})
+		},
+	}
+}
+
+func describeCommand(cmd *cobra.Command) commandSchema {
+	schema := commandSchema{
+		Name:       cmd.Name(),
+		Path:       cmd.CommandPath(),
+		Use:        cmd.Use,
+		Short:      cmd.Short,
+		Long:       cmd.Long,
+		Aliases:    cmd.Aliases,
+		Runnable:   cmd.Runnable(),
+		JSONOutput: cmd.Runnable() && hasJSONOutput(cmd),
+	}
+	cmd.NonInheritedFlags().VisitAll(func(f *pflag.Flag) {
+		// --help is only added to the commands cobra has run.
+		if f.Hidden || f.Deprecated != "" || f.Name == "help" {
+			return
+		}
+		schema.Flags = append(schema.Flags, flagSchema{
+			Name:       f.Name,
+			Shorthand:  f.Shorthand,
+			Type:       f.Value.Type(),
+			Default:    f.DefValue,
+			Usage:      f.Usage,
+			Persistent: cmd.PersistentFlags().Lookup(f.Name) != nil,
+			Values:     f.Annotations[annotationFlagValues],
+		})
+	})
+	for _, sub := range cmd.Commands() {
+		if sub.IsAvailableCommand() {
+			schema.Commands = append(schema.Commands, describeCommand(sub))
+		}
+	}
+	return schema
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/internal/version"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+const (
+	sessionKeyPrefix = recorder.SessionKeyPrefix
+	sessionMetaKey   = recorder.SessionStartKey
+	sessionEndKey    = recorder.SessionEndKey
+	markerKeyPrefix  = sessionKeyPrefix + "marker:"
+)
+
+// sessionEnd records when and how the wrapped command finished.
+type sessionEnd = recorder.SessionEnd
+
+// isSessionMetaKey reports whether a metadata key holds session bookkeeping
+// rather than a file MetadataRecord.
+func isSessionMetaKey(key string) bool {
+	return recorder.IsSessionKey(key)
+}
+
+func recordSessionStart(db *pebble.DB, start time.Time) {
+	if db == nil {
+		return
+	}
+
+	if err := recorder.MarkSessionStart(db, start); err != nil {
+		log.Printf("[record] failed to record session start: %v", err)
+	}
+}
+
+// recordSessionInfo assigns the session its ID and stores the wrapped
+// command, unless a resumed recording already has them.
+func recordSessionInfo(db *pebble.DB, command []string) {
+	if db == nil {
+		return
+	}
+
+	info := recorder.SessionInfo{Command: command, Agent: version.Version}
+	if _, err := recorder.MarkSessionInfo(db, info); err != nil {
+		log.Printf("[record] failed to record session info: %v", err)
+	}
+}
+
+func loadSessionStart(db *pebble.DB) time.Time {
+	val, closer, err := db.Get([]byte(sessionMetaKey))
+	if err != nil {
+		return time.Time{}
+	}
+	defer closer.Close()
+
+	ts, err := strconv.ParseInt(strings.TrimSpace(string(val)), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ts)
+}
+
+func recordSessionEnd(db *pebble.DB, end time.Time, exitCode int) {
+	if db == nil {
+		return
+	}
+
+	if err := recorder.MarkSessionEnd(db, end, exitCode); err != nil {
+		log.Printf("[record] failed to record session end: %v", err)
+	}
+}
+
+// recordRecorderError reports that recording the session failed with err,
+// on stderr and on the session end record, so the recording is known to
+// be incomplete whatever the command's status.
+func recordRecorderError(db *pebble.DB, err error) {
+	log.Printf("[record] recording failed and may be incomplete: %v", err)
+	if err := recorder.MarkRecorderError(db, err); err != nil {
+		log.Printf("[record] failed to record the recording failure: %v", err)
+	}
+}
+
+// recordSummary is what record prints with --json once the command exits.
+type recordSummary struct {
+	SessionID     string                `json:"session_id,omitempty"`
+	Command       []string              `json:"command,omitempty"`
+	Start         time.Time             `json:"start"`
+	End           time.Time             `json:"end"`
+	Seconds       float64               `json:"seconds"`
+	ExitCode      int                   `json:"exit_code"`
+	Termination   *recorder.Termination `json:"termination,omitempty"`
+	RecorderError string                `json:"recorder_error,omitempty"`
+	Files         int                   `json:"files"`
+	MerkleRoot    string                `json:"merkle_root,omitempty"`
+	Signed        bool                  `json:"signed,omitempty"`
+}
+
+// writeRecordSummary prints the ended session as JSON. storeErr is a
+// recording failure found after the session end was stored.
+func writeRecordSummary(w io.Writer, db *pebble.DB, storeErr error) error {
+	end, ok := loadSessionEnd(db)
+	if !ok {
+		return fmt.Errorf("session has not ended")
+	}
+	summary := recordSummary{
+		Start:         loadSessionStart(db),
+		End:           time.Unix(0, end.Timestamp),
+		ExitCode:      end.ExitCode,
+		Termination:   end.Termination,
+		RecorderError: end.RecorderError,
+		Files:         end.Files,
+		MerkleRoot:    end.MerkleRoot,
+		Signed:        end.Signature != nil,
+	}
+	summary.Seconds = summary.End.Sub(summary.Start).Seconds()
+	if summary.RecorderError == "" && storeErr != nil {
+		summary.RecorderError = storeErr.Error()
+	}
+	if info, ok, err := recorder.LoadSessionInfo(db); err == nil && ok {
+		summary.SessionID, summary.Command = info.ID, info.Command
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summary)
+}
+
+// sealSession stores the session Merkle root once the journal has drained.
+func sealSession(db *pebble.DB, signKey []byte) {
+	end, err := recorder.SealSession(db, signKey)
+	if err != nil {
+		log.Printf("[record] failed to seal session: %v", err)
+		return
+	}
+	if end.MerkleRoot == "" {
+		return
+	}
+	signed := ""
+	if end.Signature != nil {
+		signed = ", signed"
+	}
+	log.Printf("[record] session root %s (%d files%s)", end.MerkleRoot, end.Files, signed)
+}
+
+func loadSessionEnd(db *pebble.DB) (sessionEnd, bool) {
+	val, closer, err := db.Get([]byte(sessionEndKey))
+	if err != nil {
+		return sessionEnd{}, false
+	}
+	defer closer.Close()
+
+	var end sessionEnd
+	if err := json.Unmarshal(val, &end); err != nil {
+		return sessionEnd{}, false
+	}
+	return end, true
+}
+
+func loadMarker(db *pebble.DB, name string) (time.Time, error) {
+	val, closer, err := db.Get([]byte(markerKeyPrefix + name))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return time.Time{}, fmt.Errorf("marker %q not found", name)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer closer.Close()
+
+	ts, err := strconv.ParseInt(strings.TrimSpace(string(val)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("marker %q is corrupt: %w", name, err)
+	}
+	return time.Unix(0, ts), nil
+}
+
+// maxMarkerName bounds marker names so they stay readable in the timeline.
+const maxMarkerName = 128
+
+func validateMarkerName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("marker name is required")
+	}
+	if len(name) > maxMarkerName {
+		return fmt.Errorf("marker name exceeds %d bytes", maxMarkerName)
+	}
+	if strings.ContainsAny(name, "\r\n") {
+		return fmt.Errorf("marker name must be a single line")
+	}
+	return nil
+}
+
+// recordMarker stores a named anchor point. Re-marking a name moves it.
+func recordMarker(db *pebble.DB, name string, at time.Time) error {
+	if err := validateMarkerName(name); err != nil {
+		return err
+	}
+	val := []byte(fmt.Sprintf("%020d", at.UnixNano()))
+	if err := db.Set([]byte(markerKeyPrefix+name), val, pebble.Sync); err != nil {
+		return fmt.Errorf("record marker: %w", err)
+	}
+	return nil
+}
+
+// loadMarkers returns every recorded marker keyed by name.
+func loadMarkers(db *pebble.DB) (map[string]time.Time, error) {
+	iter, err := newPrefixIter(db, markerKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	markers := make(map[string]time.Time)
+	for iter.First(); iter.Valid(); iter.Next() {
+		name := strings.TrimPrefix(string(iter.Key()), markerKeyPrefix)
+		ts, err := strconv.ParseInt(strings.TrimSpace(string(iter.Value())), 10, 64)
+		if err != nil {
+			log.Printf("[timeline] skip corrupt marker %q: %v", name, err)
+			continue
+		}
+		markers[name] = time.Unix(0, ts)
+	}
+	return markers, iter.Error()
+}
+
+// sessionAnchors holds the named points in time that --time values may be
+// expressed relative to.
+type sessionAnchors struct {
+	start    time.Time
+	end      time.Time
+	exitCode int
+	hasEnd   bool
+	// recorderError is set when the recording itself failed.
+	recorderError string
+	// termination is set when the command was killed.
+	termination *recorder.Termination
+	marker      func(name string) (time.Time, error)
+}
+
+func loadSessionAnchors(db *pebble.DB) sessionAnchors {
+	anchors := sessionAnchors{
+		start: loadSessionStart(db),
+		marker: func(name string) (time.Time, error) {
+			return loadMarker(db, name)
+		},
+	}
+	if end, ok := loadSessionEnd(db); ok {
+		anchors.end = time.Unix(0, end.Timestamp)
+		anchors.exitCode = end.ExitCode
+		anchors.recorderError = end.RecorderError
+		anchors.termination = end.Termination
+		anchors.hasEnd = true
+	}
+	return anchors
+}
+
+// parseTargetTime resolves a --time value. Accepted forms:
+//
+//	latest                      now (everything recorded so far)
+//	2s                          duration since session start
+//	2025-01-02T15:04:05Z        absolute RFC3339 timestamp
+//	start+2s, end-5s            offset from session start or command exit
+//	failure, failure-1s         command exit, only when it exited nonzero
+//	event:<marker>[-2s]         offset from a named marker
+func parseTargetTime(raw string, anchors sessionAnchors) (time.Time, error) {
+	if raw == "" || raw == "latest" {
+		return time.Now(), nil
+	}
+
+	if dur, err := time.ParseDuration(raw); err == nil {
+		if anchors.start.IsZero() {
+			return time.Time{}, fmt.Errorf("session start unknown; cannot apply duration %s", raw)
+		}
+		return anchors.start.Add(dur), nil
+	}
+
+	if ts, err := time.Parse(time.RFC3339, raw); err == nil {
+		return ts, nil
+	}
+
+	anchor, offset := splitAnchorOffset(raw)
+	switch {
+	case anchor == "start":
+		if anchors.start.IsZero() {
+			return time.Time{}, fmt.Errorf("session start unknown; cannot resolve %s", raw)
+		}
+		return anchors.start.Add(offset), nil
+	case anchor == "end":
+		if !anchors.hasEnd {
+			return time.Time{}, fmt.Errorf("session end unknown (recording still running or interrupted); cannot resolve %s", raw)
+		}
+		return anchors.end.Add(offset), nil
+	case anchor == "failure":
+		if !anchors.hasEnd {
+			return time.Time{}, fmt.Errorf("session end unknown; cannot resolve %s", raw)
+		}
+		if anchors.exitCode == 0 {
+			return time.Time{}, fmt.Errorf("recorded command exited successfully; no failure to anchor %s", raw)
+		}
+		return anchors.end.Add(offset), nil
+	case strings.HasPrefix(anchor, "event:"):
+		name := strings.TrimPrefix(anchor, "event:")
+		if name == "" || anchors.marker == nil {
+			return time.Time{}, fmt.Errorf("invalid marker reference %q", raw)
+		}
+		ts, err := anchors.marker(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return ts.Add(offset), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time value %q", raw)
+}
+
+// splitAnchorOffset splits "end-5s" into ("end", -5s). Values without a
+// trailing duration are returned unchanged with a zero offset, so marker names
+// may themselves contain '-' or '+'.
+func splitAnchorOffset(raw string) (string, time.Duration) {
+	idx := strings.LastIndexAny(raw, "+-")
+	if idx <= 0 {
+		return raw, 0
+	}
+	dur, err := time.ParseDuration(raw[idx+1:])
+	if err != nil {
+		return raw, 0
+	}
+	if raw[idx] == '-' {
+		dur = -dur
+	}
+	return raw[:idx], dur
+}
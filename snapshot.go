@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/control"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+const (
+	opSnapshot        = "snapshot"
+	opSnapshotRelease = "snapshot-release"
+	opBackup          = "backup"
+
+	// snapshotDirName holds checkpoints handed out to readers of a live
+	// state dir. Checkpoints hard-link table files, so they must live on
+	// the same filesystem as the store.
+	snapshotDirName = "snapshots"
+
+	// liveSnapshotTTL is how long a reader may use a snapshot before the
+	// recorder removes it.
+	liveSnapshotTTL = 30 * time.Minute
+
+	// snapshotDrainTimeout bounds the wait for pending captures to be
+	// processed before a snapshot is taken.
+	snapshotDrainTimeout = time.Second
+)
+
+// snapshotReply is the control socket reply to opSnapshot.
+type snapshotReply struct {
+	Dir string `json:"dir"`
+}
+
+// snapshotter hands out point-in-time checkpoints of a store that is being
+// recorded, so export, cat and friends can read it while the recorder keeps
+// writing.
+type snapshotter struct {
+	db   *pebble.DB
+	root string
+
+	mu  sync.Mutex
+	seq int
+}
+
+func newSnapshotter(db *pebble.DB, stateDir string) *snapshotter {
+	s := &snapshotter{db: db, root: filepath.Join(stateDir, snapshotDirName)}
+	// Snapshots left behind by an earlier recorder are unusable now.
+	s.prune(0)
+	return s
+}
+
+// Create checkpoints the store into a fresh directory and returns its path.
+func (s *snapshotter) Create() (snapshotReply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(liveSnapshotTTL)
+	if err := os.MkdirAll(s.root, 0o755); err != nil {
+		return snapshotReply{}, err
+	}
+	s.seq++
+	dir := filepath.Join(s.root, fmt.Sprintf("%d-%d", time.Now().UnixNano(), s.seq))
+	if err := s.checkpoint(dir); err != nil {
+		return snapshotReply{}, err
+	}
+	return snapshotReply{Dir: dir}, nil
+}
+
+// Backup checkpoints the store into dir, which must not exist yet. Unlike
+// a snapshot, the backup is the caller's to keep.
+func (s *snapshotter) Backup(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("backup dir %q must be absolute", dir)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoint(dir)
+}
+
+// checkpoint gives pending captures a moment to be processed, then
+// checkpoints the store into dir.
+func (s *snapshotter) checkpoint(dir string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotDrainTimeout)
+	if err := recorder.WaitIdle(ctx, s.db); err != nil {
+		log.Printf("[snapshot] journal still busy, checkpoint may miss the latest captures: %v", err)
+	}
+	cancel()
+
+	if err := s.db.Checkpoint(dir, pebble.WithFlushedWAL()); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	return nil
+}
+
+// prune removes snapshots older than maxAge (all of them when zero).
+func (s *snapshotter) prune(maxAge time.Duration) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || (maxAge > 0 && time.Since(info.ModTime()) < maxAge) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.root, entry.Name())); err != nil {
+			log.Printf("[snapshot] remove %s: %v", entry.Name(), err)
+		}
+	}
+}
+
+// Close removes every snapshot handed out.
+func (s *snapshotter) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(0)
+	os.Remove(s.root)
+}
+
+// Release removes a snapshot once its reader is done with it.
+func (s *snapshotter) Release(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if filepath.Dir(filepath.Clean(dir)) != s.root {
+		return fmt.Errorf("%s is not a snapshot of this recorder", dir)
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s *snapshotter) register(srv *control.Server) {
+	srv.Handle(opSnapshot, func(control.Request) (any, error) {
+		return s.Create()
+	})
+	srv.Handle(opSnapshotRelease, func(req control.Request) (any, error) {
+		return nil, s.Release(req.Name)
+	})
+	srv.Handle(opBackup, func(req control.Request) (any, error) {
+		return nil, s.Backup(req.Dir)
+	})
+}
+
+// openReadOnlyDB opens a state dir for reading. If a recorder holds it, the
+// recorder is asked for a snapshot over its control socket instead.
+func openReadOnlyDB(stateDir string) (*pebble.DB, error) {
+	db, dir, err := openReadOnlyOrSnapshot(stateDir)
+	if err == nil && dir != "" {
+		log.Printf("[snapshot] state dir is being recorded; reading snapshot %s", dir)
+	}
+	return db, err
+}
+
+// openReadOnlyOrSnapshot is openReadOnlyDB for callers that poll: it also
+// returns the snapshot dir (empty when the store was opened directly) so it
+// can be handed back with releaseSnapshot after use.
+func openReadOnlyOrSnapshot(stateDir string) (*pebble.DB, string, error) {
+	db, err := pebble.Open(stateDir, &pebble.Options{ReadOnly: true})
+	if err == nil {
+		return db, "", nil
+	}
+
+	dir, snapErr := requestSnapshot(stateDir)
+	if snapErr != nil {
+		return nil, "", fmt.Errorf("open pebble: %w", err)
+	}
+
+	db, err = pebble.Open(dir, &pebble.Options{ReadOnly: true})
+	if err != nil {
+		releaseSnapshot(stateDir, dir)
+		return nil, "", fmt.Errorf("open snapshot: %w", err)
+	}
+	return db, dir, nil
+}
+
+// releaseSnapshot tells the recorder a snapshot is no longer needed. Errors
+// are ignored: the recorder removes stale snapshots on its own.
+func releaseSnapshot(stateDir, dir string) {
+	if dir == "" {
+		return
+	}
+	_, _ = control.Call(control.SocketPath(stateDir), control.Request{Op: opSnapshotRelease, Name: dir})
+}
+
+func requestSnapshot(stateDir string) (string, error) {
+	resp, err := control.Call(control.SocketPath(stateDir), control.Request{Op: opSnapshot})
+	if err != nil {
+		return "", err
+	}
+	var reply snapshotReply
+	if err := json.Unmarshal(resp.Data, &reply); err != nil {
+		return "", fmt.Errorf("decode snapshot reply: %w", err)
+	}
+	if reply.Dir == "" {
+		return "", fmt.Errorf("recorder returned no snapshot")
+	}
+	return reply.Dir, nil
+}
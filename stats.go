@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+	"github.com/spf13/cobra"
+)
+
+// statsOptions carries the flags accepted by the stats command.
+type statsOptions struct {
+	stateDir  string
+	namespace string
+	top       int
+	jsonOut   bool
+}
+
+func newStatsCmd() *cobra.Command {
+	var opts statsOptions
+
+	cmd := &cobra.Command{
+		Use:   "stats --state-dir <dir>",
+		Short: "Show how much space a recording uses and where it goes",
+		Long: `Show how much space a recording uses and where it goes.
+
+Logical bytes are the sizes of every recorded version added up; stored bytes
+are what the CAS holds after deduplication and compression. Each stored object
+is attributed to the path that first wrote it.
+
+Version and path totals cover one namespace (--namespace, default the
+default namespace). An object shared with other namespaces counts towards
+each of them; CAS, journal and store file totals cover the whole state dir.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.stateDir == "" {
+				return fmt.Errorf("state-dir is required")
+			}
+			if err := config.ValidateNamespace(opts.namespace); err != nil {
+				return err
+			}
+			return runStats(cmd.OutOrStdout(), opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.stateDir, "state-dir", "", "Directory where Pebble state is stored")
+	cmd.Flags().StringVar(&opts.namespace, "namespace", "", "Namespace to report on (see record --namespace)")
+	cmd.Flags().IntVar(&opts.top, "top", 10, "Number of top paths to list")
+	cmd.Flags().BoolVar(&opts.jsonOut, "json", false, "Print JSON instead of a table")
+	return cmd
+}
+
+// storeStats is the storage breakdown printed by the stats command.
+type storeStats struct {
+	// Namespace is the namespace the version totals cover; Namespaces lists
+	// every named namespace in the state dir.
+	Namespace    string           `json:"namespace,omitempty"`
+	Namespaces   []string         `json:"namespaces,omitempty"`
+	CAS          cas.CASStats     `json:"cas"`
+	Versions     int              `json:"versions"`
+	Paths        int              `json:"paths"`
+	LogicalBytes int64            `json:"logical_bytes"`
+	StoredBytes  int64            `json:"stored_bytes"`
+	DedupRatio   float64          `json:"dedup_ratio"`
+	Journal      journalStats     `json:"journal"`
+	Files        storeFileStats   `json:"files"`
+	Resources    *resourceSummary `json:"resources,omitempty"`
+	TopPaths     []pathUsage      `json:"top_paths"`
+}
+
+// journalStats describes events captured but not yet processed into CAS.
+type journalStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// storeFileStats sums the Pebble files in the state dir by kind.
+type storeFileStats struct {
+	Tables     int   `json:"tables"`
+	TableBytes int64 `json:"table_bytes"`
+	WALBytes   int64 `json:"wal_bytes"`
+	OtherBytes int64 `json:"other_bytes"`
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+// pathUsage is one path's share of the store.
+type pathUsage struct {
+	Path         string `json:"path"`
+	Versions     int    `json:"versions"`
+	LogicalBytes int64  `json:"logical_bytes"`
+	StoredBytes  int64  `json:"stored_bytes"`
+}
+
+func runStats(w io.Writer, opts statsOptions) error {
+	db, casStore, err := openReadOnlyStore(opts.stateDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var stats storeStats
+	if stats.CAS, err = casStore.GetStats(); err != nil {
+		return fmt.Errorf("cas stats: %w", err)
+	}
+	objectSizes, err := loadObjectSizes(db)
+	if err != nil {
+		return err
+	}
+	history, err := loadMetadataHistory(db, time.Now())
+	if err != nil {
+		return err
+	}
+	stats.Namespace = opts.namespace
+	stats.Namespaces = namespacesOf(history)
+	summarizeStorage(&stats, recorder.NamespaceHistory(history, opts.namespace), objectSizes, opts.top)
+
+	if stats.Journal, err = loadJournalStats(db); err != nil {
+		return err
+	}
+	if stats.Files, err = loadStoreFileStats(opts.stateDir); err != nil {
+		return err
+	}
+
+	samples, err := recorder.ResourceSamples(db, opts.namespace, time.Time{}, time.Now())
+	if err != nil {
+		return fmt.Errorf("load resource samples: %w", err)
+	}
+	if len(samples) > 0 {
+		sum := summarizeResources(samples)
+		stats.Resources = &sum
+	}
+
+	if opts.jsonOut {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+	return writeStatsTable(w, stats)
+}
+
+// namespacesOf returns the named namespaces that recorded any of history,
+// sorted.
+func namespacesOf(history []recorder.MetadataRecord) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, meta := range history {
+		if ns, _ := recorder.SplitNamespace(meta.Path); ns != "" && !seen[ns] {
+			seen[ns] = true
+			names = append(names, ns)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadObjectSizes returns the stored (compressed) size of every CAS object.
+func loadObjectSizes(db *pebble.DB) (map[string]int64, error) {
+	iter, err := newPrefixIter(db, cas.PrefixCAS)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	sizes := make(map[string]int64)
+	for iter.First(); iter.Valid(); iter.Next() {
+		sizes[strings.TrimPrefix(string(iter.Key()), cas.PrefixCAS)] = int64(len(iter.Value()))
+	}
+	return sizes, iter.Error()
+}
+
+// summarizeStorage fills the version totals and the top paths from history
+// (sorted by time). Objects are charged to the first path that referenced them.
+func summarizeStorage(stats *storeStats, history []recorder.MetadataRecord, objectSizes map[string]int64, top int) {
+	byPath := make(map[string]*pathUsage)
+	charged := make(map[string]bool)
+
+	for _, meta := range history {
+		usage, ok := byPath[meta.Path]
+		if !ok {
+			usage = &pathUsage{Path: meta.Path}
+			byPath[meta.Path] = usage
+		}
+		usage.Versions++
+		usage.LogicalBytes += int64(meta.Size)
+		stats.Versions++
+		stats.LogicalBytes += int64(meta.Size)
+
+		objects := meta.Chunks
+		if len(objects) == 0 {
+			objects = []string{meta.CID}
+		}
+		for _, cid := range objects {
+			if charged[cid] {
+				continue
+			}
+			charged[cid] = true
+			usage.StoredBytes += objectSizes[cid]
+		}
+	}
+
+	if stats.Namespace == "" && len(stats.Namespaces) == 0 {
+		for _, size := range objectSizes {
+			stats.StoredBytes += size
+		}
+	} else {
+		// Other namespaces' objects belong to them.
+		for cid := range charged {
+			stats.StoredBytes += objectSizes[cid]
+		}
+	}
+	if stats.StoredBytes > 0 {
+		stats.DedupRatio = float64(stats.LogicalBytes) / float64(stats.StoredBytes)
+	}
+
+	stats.Paths = len(byPath)
+	stats.TopPaths = make([]pathUsage, 0, len(byPath))
+	for _, usage := range byPath {
+		stats.TopPaths = append(stats.TopPaths, *usage)
+	}
+	sort.Slice(stats.TopPaths, func(i, j int) bool {
+		a, b := stats.TopPaths[i], stats.TopPaths[j]
+		if a.StoredBytes != b.StoredBytes {
+			return a.StoredBytes > b.StoredBytes
+		}
+		if a.LogicalBytes != b.LogicalBytes {
+			return a.LogicalBytes > b.LogicalBytes
+		}
+		return a.Path < b.Path
+	})
+	if top >= 0 && len(stats.TopPaths) > top {
+		stats.TopPaths = stats.TopPaths[:top]
+	}
+}
+
+func loadJournalStats(db *pebble.DB) (journalStats, error) {
+	iter, err := newPrefixIter(db, cas.PrefixLog)
+	if err != nil {
+		return journalStats{}, err
+	}
+	defer iter.Close()
+
+	var stats journalStats
+	for iter.First(); iter.Valid(); iter.Next() {
+		stats.Entries++
+		stats.Bytes += int64(len(iter.Value()))
+	}
+	return stats, iter.Error()
+}
+
+func loadStoreFileStats(stateDir string) (storeFileStats, error) {
+	var stats storeFileStats
+	err := filepath.WalkDir(stateDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size := info.Size()
+		stats.TotalBytes += size
+		switch filepath.Ext(path) {
+		case ".sst":
+			stats.Tables++
+			stats.TableBytes += size
+		case ".log":
+			stats.WALBytes += size
+		default:
+			stats.OtherBytes += size
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("scan state dir: %w", err)
+	}
+	return stats, nil
+}
+
+func writeStatsTable(w io.Writer, stats storeStats) error {
+	if stats.Namespace != "" {
+		fmt.Fprintf(w, "Namespace:       %s\n", stats.Namespace)
+	}
+	if len(stats.Namespaces) > 0 {
+		fmt.Fprintf(w, "Namespaces:      %s\n", strings.Join(stats.Namespaces, ", "))
+	}
+	fmt.Fprintf(w, "Versions:        %d across %d paths\n", stats.Versions, stats.Paths)
+	fmt.Fprintf(w, "CAS objects:     %d\n", stats.CAS.TotalObjects)
+	if stats.CAS.TotalRefs > 0 {
+		fmt.Fprintf(w, "CAS references:  %d (%d unreferenced objects)\n", stats.CAS.TotalRefs, stats.CAS.UnreferencedObjs)
+	}
+	fmt.Fprintf(w, "Logical bytes:   %s\n", formatSize(int(stats.LogicalBytes)))
+	fmt.Fprintf(w, "Stored bytes:    %s (%.2fx reduction)\n", formatSize(int(stats.StoredBytes)), stats.DedupRatio)
+	fmt.Fprintf(w, "Journal backlog: %d entries (%s)\n", stats.Journal.Entries, formatSize(int(stats.Journal.Bytes)))
+	fmt.Fprintf(w, "Store files:     %s total, %d tables (%s), WAL %s, other %s\n",
+		formatSize(int(stats.Files.TotalBytes)), stats.Files.Tables, formatSize(int(stats.Files.TableBytes)),
+		formatSize(int(stats.Files.WALBytes)), formatSize(int(stats.Files.OtherBytes)))
+	if stats.Resources != nil {
+		writeResourceSummary(w, *stats.Resources)
+	}
+
+	if len(stats.TopPaths) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "\n%-10s %-10s %-8s %s\n", "STORED", "LOGICAL", "VERSIONS", "PATH")
+	for _, p := range stats.TopPaths {
+		fmt.Fprintf(w, "%-10s %-10s %-8d %s\n", formatSize(int(p.StoredBytes)), formatSize(int(p.LogicalBytes)), p.Versions, p.Path)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+// maxKernelLogLines bounds the kernel log lines kept about an OOM kill.
+const maxKernelLogLines = 20
+
+// oomKill is an OOM kill seen during the run.
+type oomKill struct {
+	// at is when the kernel logged the kill, or zero when the kernel log
+	// could not be read.
+	at time.Time
+	// log holds the kernel log lines about the kill.
+	log string
+}
+
+// terminationOf returns how the command with process pid, which exited
+// with runErr, was killed. It returns false when the command exited on its
+// own and no OOM kill was seen during the run.
+func terminationOf(runErr error, pid int, oom *oomWatch, now time.Time) (recorder.Termination, bool) {
+	var exitErr *exec.ExitError
+	if !errors.As(runErr, &exitErr) {
+		return recorder.Termination{}, false
+	}
+	term := recorder.Termination{Timestamp: now.UnixNano()}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		term.Signal = signalName(status.Signal())
+	}
+	if kill, ok := oom.Check(pid, now); ok {
+		term.OOMKilled = true
+		term.KernelLog = kill.log
+		if !kill.at.IsZero() {
+			term.Timestamp = kill.at.UnixNano()
+		}
+	}
+	return term, term.Signal != "" || term.OOMKilled
+}
+
+// recordTermination reports how the command was killed on stderr, as a
+// "killed" or "oom-killed" marker and on the session end record, so a
+// command that just disappeared leaves a reason behind.
+func recordTermination(db *pebble.DB, term recorder.Termination) {
+	name := "killed"
+	if term.OOMKilled {
+		name = "oom-killed"
+	}
+	switch {
+	case term.OOMKilled && term.Signal != "":
+		log.Printf("[record] command was killed by %s from the OOM killer; marked %s", term.Signal, name)
+	case term.OOMKilled:
+		log.Printf("[record] the OOM killer killed a process under the command; marked %s", name)
+	default:
+		log.Printf("[record] command was killed by %s; marked %s", term.Signal, name)
+	}
+	if term.KernelLog != "" {
+		log.Printf("[record] kernel log:\n%s", term.KernelLog)
+	}
+	if err := recordMarker(db, name, time.Unix(0, term.Timestamp)); err != nil {
+		log.Printf("[record] failed to record marker: %v", err)
+	}
+	if err := recorder.MarkTermination(db, term); err != nil {
+		log.Printf("[record] failed to record the termination: %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// kmsgPath is the kernel log device the OOM killer's reports are read from.
+var kmsgPath = "/dev/kmsg"
+
+// oomWatch notes the OOM kills before the command started, to tell the
+// ones during the run. It uses the oom_kill count of diffkeeper's cgroup,
+// which covers the command, and the kernel log where it is readable. A nil
+// *oomWatch sees no kills.
+type oomWatch struct {
+	// events is the memory.events file of diffkeeper's cgroup, or empty.
+	events string
+	kills  int64
+	// since is the CLOCK_MONOTONIC time the watch started, which kernel
+	// log records are stamped with.
+	since time.Duration
+}
+
+// startOOMWatch starts watching for OOM kills. cgroup is the group
+// diffkeeper moved itself into, if any; the one it started in is watched.
+func startOOMWatch(cgroup *overheadCgroup) *oomWatch {
+	w := &oomWatch{since: monotonicNow()}
+	dir := ""
+	if cgroup != nil {
+		dir = cgroup.parent
+	} else if own, err := ownCgroup(); err == nil {
+		dir = filepath.Join(cgroupRoot, own)
+	}
+	if dir != "" {
+		events := filepath.Join(dir, "memory.events")
+		if kills, ok := readOOMKills(events); ok {
+			w.events, w.kills = events, kills
+		}
+	}
+	return w
+}
+
+// Check reports whether the OOM killer killed the process pid, or any
+// process in diffkeeper's cgroup, since the watch started.
+func (w *oomWatch) Check(pid int, now time.Time) (oomKill, bool) {
+	if w == nil {
+		return oomKill{}, false
+	}
+	killed := false
+	if w.events != "" {
+		if kills, ok := readOOMKills(w.events); ok && kills > w.kills {
+			killed = true
+		}
+	}
+	records := readKernelOOMLog(w.since)
+	for _, rec := range records {
+		if killedPID(rec.msg) == pid {
+			killed = true
+		}
+	}
+	if !killed {
+		return oomKill{}, false
+	}
+
+	var kill oomKill
+	if len(records) > maxKernelLogLines {
+		records = records[len(records)-maxKernelLogLines:]
+	}
+	lines := make([]string, len(records))
+	for i, rec := range records {
+		lines[i] = rec.msg
+		if killedPID(rec.msg) > 0 {
+			kill.at = now.Add(rec.at - monotonicNow())
+		}
+	}
+	kill.log = strings.Join(lines, "\n")
+	return kill, true
+}
+
+// kmsgRecord is a kernel log record: its CLOCK_MONOTONIC stamp and the
+// first line of its message.
+type kmsgRecord struct {
+	at  time.Duration
+	msg string
+}
+
+// readKernelOOMLog returns the OOM killer's kernel log records stamped at
+// or after since. It returns nothing when the kernel log is not readable,
+// as in most containers or with kernel.dmesg_restrict set.
+func readKernelOOMLog(since time.Duration) []kmsgRecord {
+	// The device is read without Go's poller, which would wait for new
+	// records at the end of the log.
+	fd, err := unix.Open(kmsgPath, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil
+	}
+	defer unix.Close(fd)
+
+	var records []kmsgRecord
+	buf := make([]byte, 8192)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EPIPE {
+			// Records were overwritten while reading; carry on from the
+			// next one.
+			continue
+		}
+		if err != nil || n <= 0 {
+			return records
+		}
+		rec, ok := parseKmsgRecord(string(buf[:n]))
+		if ok && rec.at >= since && isOOMMessage(rec.msg) {
+			records = append(records, rec)
+		}
+	}
+}
+
+// parseKmsgRecord parses a /dev/kmsg record, "prio,seq,usec,flags;msg".
+func parseKmsgRecord(raw string) (kmsgRecord, bool) {
+	header, body, ok := strings.Cut(raw, ";")
+	fields := strings.Split(header, ",")
+	if !ok || len(fields) < 3 {
+		return kmsgRecord{}, false
+	}
+	usec, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return kmsgRecord{}, false
+	}
+	msg, _, _ := strings.Cut(body, "\n")
+	return kmsgRecord{at: time.Duration(usec) * time.Microsecond, msg: msg}, true
+}
+
+// isOOMMessage reports whether msg is one of the OOM killer's report
+// lines, leaving out the memory and task tables it also logs.
+func isOOMMessage(msg string) bool {
+	lower := strings.ToLower(msg)
+	for _, s := range []string{"invoked oom-killer", "out of memory", "oom-kill:", "killed process", "oom_reaper"} {
+		if strings.Contains(lower, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// killedPID returns the pid in an OOM killer's "Killed process <pid>" line,
+// or 0.
+func killedPID(msg string) int {
+	_, rest, ok := strings.Cut(msg, "Killed process ")
+	if !ok {
+		return 0
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return 0
+	}
+	pid, _ := strconv.Atoi(fields[0])
+	return pid
+}
+
+// readOOMKills returns the oom_kill count of a cgroup's memory.events.
+func readOOMKills(path string) (int64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if count, ok := strings.CutPrefix(scanner.Text(), "oom_kill "); ok {
+			n, err := strconv.ParseInt(count, 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+func monotonicNow() time.Duration {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return time.Duration(ts.Nano())
+}
+
+func signalName(sig syscall.Signal) string {
+	if name := unix.SignalName(sig); name != "" {
+		return name
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// oomWatch is only available on Linux; elsewhere no OOM kill is seen.
+type oomWatch struct{}
+
+func startOOMWatch(cgroup *overheadCgroup) *oomWatch { return nil }
+
+func (w *oomWatch) Check(pid int, now time.Time) (oomKill, bool) { return oomKill{}, false }
+
+func signalName(sig syscall.Signal) string {
+	return fmt.Sprintf("signal %d", int(sig))
+}
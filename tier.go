@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/saworbit/diffkeeper/pkg/cas"
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/remote"
+)
+
+// dialTier connects to the remote tier; the token comes from the same
+// variable push and pull use.
+func dialTier(cfg *config.DiffConfig) (remote.Transport, error) {
+	t, err := remote.Dial(cfg.Tier.Remote, remote.DialOptions{Token: os.Getenv(remote.EnvToken), Endpoint: cfg.Tier.Endpoint})
+	if err != nil {
+		return nil, fmt.Errorf("dial tier remote: %w", err)
+	}
+	return t, nil
+}
+
+// enableReadThrough lets store read objects evicted to cfg.Tier.Remote.
+// Without a tier it does nothing.
+func enableReadThrough(store *cas.CASStore, cfg *config.DiffConfig) error {
+	if cfg.Tier.Remote == "" {
+		return nil
+	}
+	t, err := dialTier(cfg)
+	if err != nil {
+		return err
+	}
+	store.SetRemote(remote.Fetcher(t))
+	return nil
+}
+
+// startTier uploads what a recorder stores to cfg.Tier.Remote every
+// upload interval, evicting local objects above the cache budget, and reads
+// evicted objects back. stop waits for a final upload and may be called
+// more than once.
+func startTier(db *pebble.DB, store *cas.CASStore, cfg *config.DiffConfig) (stop func(), err error) {
+	if cfg.Tier.Remote == "" {
+		return func() {}, nil
+	}
+	if err := enableReadThrough(store, cfg); err != nil {
+		return nil, err
+	}
+	t, err := dialTier(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := remote.TierOptions{
+		CacheMaxBytes: int64(cfg.Tier.CacheMaxMB) << 20,
+		RateLimit:     int64(cfg.Tier.UploadRateKB) << 10,
+	}
+	if cfg.DedupScope == "cluster" {
+		opts.Index = remote.NewIndex(t)
+	}
+	tier := remote.NewTier(db, store, t, opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tier.Run(ctx, cfg.Tier.UploadInterval)
+	}()
+	log.Printf("[tier] uploading CAS objects to %s every %s", cfg.Tier.Remote, cfg.Tier.UploadInterval)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+			if err := t.Close(); err != nil {
+				log.Printf("[tier] close remote: %v", err)
+			}
+		})
+	}, nil
+}
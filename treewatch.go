@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/ebpf"
+	"github.com/saworbit/diffkeeper/pkg/recorder"
+)
+
+// treeWatch journals every change under one directory tree: the inotify or
+// poll watcher feeds the capture gate, which hands settled files to the
+// capturer. Directories beyond the inotify watch limit go to the fallback,
+// which the caller starts once it knows whether eBPF events are available.
+//
+// The hot-path profiler sees every change the gate is offered; its hints
+// tune the gate and the capturer, and the kernel filter once eBPF runs.
+type treeWatch struct {
+	root     string
+	capturer *fileCapturer
+	gate     *captureGate
+	fallback *watchFallback
+	poller   *dirPoller
+	partial  *partialCaptures
+	profiler *ebpf.Profiler
+	kernel   atomic.Pointer[ebpf.HotPathSink]
+}
+
+// startTreeWatch watches root (absolute) until ctx is done. disk, quota
+// and overhead may be nil.
+func startTreeWatch(ctx context.Context, cfg *config.DiffConfig, policies *capturePolicies, journal *recorder.Journal, disk *diskGuard, quota *quotaGuard, overhead *overheadBudget, root string) (*treeWatch, error) {
+	w := &treeWatch{root: root}
+	if policies != nil {
+		journal.SetCritical(policies.Critical)
+	}
+	w.capturer = newFileCapturer(root, cfg.MaxFileSizeBytes(), cfg.Observe, journal)
+	w.capturer.UsePolicies(policies)
+	if disk != nil {
+		w.capturer.UseDiskGuard(disk)
+	}
+	if quota != nil {
+		w.capturer.UseQuotaGuard(quota)
+	}
+	w.capturer.UseOverhead(overhead)
+	if cfg.EBPF.Enable {
+		w.partial = newPartialCaptures(cfg.PartialCaptureBytes(), cfg.EBPF.PartialVerifyEvery)
+		w.capturer.UsePartialCaptures(w.partial)
+	}
+	w.gate = newCaptureGate(root, captureSettingsOf(cfg), w.capturer.Capture)
+	w.gate.UsePolicies(policies)
+	w.profiler = ebpf.NewProfiler(&cfg.EBPF, w)
+	w.gate.UseProfiler(w.profiler)
+	w.capturer.UseHotPaths(w.gate.Hot)
+	go w.profiler.Run(ctx)
+	if cfg.Backfill && !cfg.Observe {
+		w.capturer.UseBaseline(scanBaseline(root, w.gate.Ignored, cfg.MaxFileSizeBytes()))
+	}
+	w.gate.OnAttr(func(op, path string, mode fs.FileMode) {
+		if rel, relErr := filepath.Rel(root, path); relErr == nil {
+			path = rel
+		}
+		_ = journal.LogAttr(op, path, mode)
+	})
+
+	w.fallback = newWatchFallback(cfg.WatchFallback, w.gate, func() string { return watchLimitHint(cfg) })
+	var err error
+	if cfg.WatchBackend == config.WatchBackendPoll {
+		if w.poller, err = startPollRecorder(ctx, root, w.gate, cfg.PollInterval, cfg.PollMaxInterval); err != nil {
+			return nil, fmt.Errorf("start poll recorder: %w", err)
+		}
+	} else if err := startFSRecorder(ctx, root, w.gate, w.fallback); err != nil {
+		return nil, fmt.Errorf("start fs recorder: %w", err)
+	}
+	return w, nil
+}
+
+// StartFallback starts the watch fallback with events, the eBPF write
+// events for root (nil without eBPF), after noting their byte ranges for
+// partial captures.
+func (w *treeWatch) StartFallback(ctx context.Context, events <-chan ebpf.Event) {
+	w.fallback.Start(ctx, w.partial.TrackWrites(ctx, events))
+}
+
+// UseKernelHints also hands the profiler's hints to sink, the eBPF manager.
+func (w *treeWatch) UseKernelHints(sink ebpf.HotPathSink) {
+	w.kernel.Store(&sink)
+}
+
+// ApplyHotPathHints passes the profiler's hints on to the gate and the
+// kernel.
+func (w *treeWatch) ApplyHotPathHints(hints map[string]float64) error {
+	err := w.gate.ApplyHotPathHints(hints)
+	if sink := w.kernel.Load(); sink != nil {
+		err = errors.Join(err, (*sink).ApplyHotPathHints(hints))
+	}
+	return err
+}
+
+// Flush captures the changes still pending: one last poll, then whatever
+// the gate is holding back, then large files still being read.
+func (w *treeWatch) Flush() {
+	if w.poller != nil {
+		w.poller.Poll()
+	}
+	w.fallback.Flush()
+	w.gate.Flush()
+	w.capturer.Wait()
+}
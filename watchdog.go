@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+const (
+	// stallDirName holds the process dumps taken when a command stalls.
+	stallDirName = "stalls"
+
+	// stallKillGrace is how long a stalled command gets to exit after
+	// SIGQUIT (which makes Go programs print their goroutine stacks)
+	// before it is killed.
+	stallKillGrace = 10 * time.Second
+)
+
+// stallWatchdog notices when the recorded command stops producing file
+// changes and output. Each quiet period longer than the timeout fires
+// onStall once; activity re-arms it.
+type stallWatchdog struct {
+	timeout time.Duration
+	onStall func(quietSince time.Time)
+
+	// last is the UnixNano time of the most recent activity.
+	last atomic.Int64
+}
+
+func newStallWatchdog(timeout time.Duration, onStall func(quietSince time.Time)) *stallWatchdog {
+	w := &stallWatchdog{timeout: timeout, onStall: onStall}
+	w.Touch()
+	return w
+}
+
+// Touch records activity. A nil watchdog ignores it.
+func (w *stallWatchdog) Touch() {
+	if w == nil {
+		return
+	}
+	w.last.Store(time.Now().UnixNano())
+}
+
+// Writer returns dst wrapped so every write counts as activity, or dst
+// itself for a nil watchdog.
+func (w *stallWatchdog) Writer(dst io.Writer) io.Writer {
+	if w == nil {
+		return dst
+	}
+	return activityWriter{dst: dst, touch: w.Touch}
+}
+
+// Run checks for stalls until ctx is done.
+func (w *stallWatchdog) Run(ctx context.Context) {
+	interval := w.timeout / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	} else if interval > 5*time.Second {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var fired int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		last := w.last.Load()
+		if last == fired || time.Since(time.Unix(0, last)) < w.timeout {
+			continue
+		}
+		fired = last
+		w.onStall(time.Unix(0, last))
+	}
+}
+
+type activityWriter struct {
+	dst   io.Writer
+	touch func()
+}
+
+func (a activityWriter) Write(p []byte) (int, error) {
+	a.touch()
+	return a.dst.Write(p)
+}
+
+// stallHandler records stalls of one recorded command: a marker at the
+// start of the quiet period, a dump of the process tree, and optionally
+// stopping the command.
+type stallHandler struct {
+	db       *pebble.DB
+	stateDir string
+	timeout  time.Duration
+	kill     bool
+
+	mu     sync.Mutex
+	proc   *os.Process
+	stalls int
+}
+
+// Attach sets the process the handler dumps and stops.
+func (h *stallHandler) Attach(proc *os.Process) {
+	h.mu.Lock()
+	h.proc = proc
+	h.mu.Unlock()
+}
+
+func (h *stallHandler) Stall(quietSince time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stalls++
+	name := "stall"
+	if h.stalls > 1 {
+		name = fmt.Sprintf("stall-%d", h.stalls)
+	}
+	log.Printf("[watchdog] no file changes or output for %s (since %s); marked %s", h.timeout, quietSince.Format(time.RFC3339), name)
+	if err := recordMarker(h.db, name, quietSince); err != nil {
+		log.Printf("[watchdog] failed to record marker: %v", err)
+	}
+	if h.proc == nil {
+		return
+	}
+
+	dump := filepath.Join(h.stateDir, stallDirName, name+".txt")
+	if err := writeStallDump(dump, h.proc.Pid, quietSince); err != nil {
+		log.Printf("[watchdog] failed to dump process tree: %v", err)
+	} else {
+		log.Printf("[watchdog] process tree dumped to %s", dump)
+	}
+
+	if h.kill {
+		log.Printf("[watchdog] stopping stalled command (pid %d)", h.proc.Pid)
+		stopStalled(h.proc)
+	}
+}
+
+func writeStallDump(path string, pid int, quietSince time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	header := fmt.Sprintf("stall of pid %d, quiet since %s, dumped at %s\n\n", pid, quietSince.Format(time.RFC3339Nano), time.Now().Format(time.RFC3339Nano))
+	return os.WriteFile(path, []byte(header+dumpProcessTree(pid)), 0o644)
+}
+
+// stopStalled sends SIGQUIT, then kills the process if it is still running
+// after stallKillGrace. Where SIGQUIT is unsupported it kills right away.
+func stopStalled(proc *os.Process) {
+	if err := proc.Signal(syscall.SIGQUIT); err != nil {
+		_ = proc.Kill()
+		return
+	}
+	go func() {
+		time.Sleep(stallKillGrace)
+		_ = proc.Kill()
+	}()
+}
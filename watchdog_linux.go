@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dumpProcessTree describes pid and its descendants from /proc: command
+// line, scheduler state, wait channel and, when readable (usually root
+// only), the kernel stack of every thread.
+func dumpProcessTree(pid int) string {
+	var b strings.Builder
+	for _, p := range processTree(pid) {
+		dir := filepath.Join("/proc", strconv.Itoa(p))
+		cmdline, _ := os.ReadFile(filepath.Join(dir, "cmdline"))
+		fmt.Fprintf(&b, "== pid %d: %s\n", p, strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " ")))
+		fmt.Fprintf(&b, "state: %s\n", procStatusField(dir, "State"))
+
+		tasks, _ := os.ReadDir(filepath.Join(dir, "task"))
+		for _, task := range tasks {
+			taskDir := filepath.Join(dir, "task", task.Name())
+			wchan, _ := os.ReadFile(filepath.Join(taskDir, "wchan"))
+			fmt.Fprintf(&b, "-- thread %s: %s, wchan %s\n", task.Name(), procStatusField(taskDir, "State"), orDash(string(wchan)))
+			if stack, err := os.ReadFile(filepath.Join(taskDir, "stack")); err == nil && len(stack) > 0 {
+				b.Write(stack)
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// processTree returns pid followed by its descendants, found through the
+// parent pid in /proc/<pid>/stat.
+func processTree(root int) []int {
+	children := make(map[int][]int)
+	entries, _ := os.ReadDir("/proc")
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name may contain spaces; fields resume after ')'.
+		end := strings.LastIndexByte(string(stat), ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		if ppid, err := strconv.Atoi(fields[1]); err == nil {
+			children[ppid] = append(children[ppid], pid)
+		}
+	}
+
+	tree := []int{root}
+	for i := 0; i < len(tree); i++ {
+		kids := children[tree[i]]
+		sort.Ints(kids)
+		tree = append(tree, kids...)
+	}
+	return tree
+}
+
+func procStatusField(dir, field string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "status"))
+	if err != nil {
+		return "-"
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, field+":"); ok {
+			return strings.TrimSpace(v)
+		}
+	}
+	return "-"
+}
+
+func orDash(s string) string {
+	if s = strings.TrimSpace(s); s == "" || s == "0" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// dumpProcessTree needs /proc, so elsewhere it only names the process.
+func dumpProcessTree(pid int) string {
+	return fmt.Sprintf("pid %d: process tree dumps are only available on Linux\n", pid)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/saworbit/diffkeeper/pkg/config"
+	"github.com/saworbit/diffkeeper/pkg/ebpf"
+)
+
+// watchFallback covers directories inotify refused to watch because
+// fs.inotify.max_user_watches was exhausted, by polling them or by taking
+// their writes from eBPF events.
+type watchFallback struct {
+	mode   string
+	gate   *captureGate
+	poller *dirPoller
+	// hint says how to raise the limit; it is built on first use.
+	hint func() string
+
+	mu      sync.Mutex
+	roots   []string
+	warned  bool
+	polling bool
+}
+
+func newWatchFallback(mode string, gate *captureGate, hint func() string) *watchFallback {
+	return &watchFallback{
+		mode:   mode,
+		gate:   gate,
+		poller: newDirPoller(gate, fallbackPollInterval, fallbackPollInterval),
+		hint:   hint,
+	}
+}
+
+// isWatchLimit reports whether err is inotify running out of watches.
+func isWatchLimit(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// Add takes over dir after inotify refused it with err. Errors other than
+// the watch limit, and the limit itself in error mode, are returned. With
+// baseline, files already in dir count as unchanged (see dirPoller.Add).
+func (f *watchFallback) Add(dir string, err error, baseline bool) error {
+	if !isWatchLimit(err) {
+		return err
+	}
+	if f.mode == config.WatchFallbackError {
+		return fmt.Errorf("watch %s: inotify watch limit reached: %s", dir, f.hint())
+	}
+
+	f.mu.Lock()
+	f.roots = append(f.roots, dir)
+	first := !f.warned
+	f.warned = true
+	f.mu.Unlock()
+
+	if first {
+		log.Printf("[record] WARNING: inotify watch limit reached at %s; falling back to %s for unwatched directories. %s", dir, f.mode, f.hint())
+	}
+	f.poller.Add(dir, baseline)
+	return nil
+}
+
+// Unwatched returns the directories taken over so far.
+func (f *watchFallback) Unwatched() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.roots...)
+}
+
+// covers reports whether path lies in a directory taken over.
+func (f *watchFallback) covers(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, root := range f.roots {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start covers the unwatched directories until ctx is done: from eBPF
+// events in ebpf mode, by polling otherwise or when events is nil.
+func (f *watchFallback) Start(ctx context.Context, events <-chan ebpf.Event) {
+	source := "polling every " + fallbackPollInterval.String()
+	if f.mode == config.WatchFallbackEBPF && events != nil {
+		source = "eBPF write events"
+		go f.consume(ctx, events)
+	} else {
+		if f.mode == config.WatchFallbackEBPF {
+			log.Printf("[record] eBPF is unavailable; polling directories beyond the inotify watch limit instead")
+		}
+		f.mu.Lock()
+		f.polling = true
+		f.mu.Unlock()
+		go f.poller.Run(ctx)
+	}
+	if n := len(f.Unwatched()); n > 0 {
+		log.Printf("[record] %d directories beyond the inotify watch limit are covered by %s", n, source)
+	}
+}
+
+// Flush polls once more so writes since the last scan are not lost when
+// the recording ends.
+func (f *watchFallback) Flush() {
+	f.mu.Lock()
+	polling := f.polling
+	f.mu.Unlock()
+	if polling {
+		f.poller.Poll()
+	}
+}
+
+// consume offers eBPF writes to files under unwatched directories.
+func (f *watchFallback) consume(ctx context.Context, events <-chan ebpf.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case evt, ok := <-events:
+			if !ok {
+				return
+			}
+			path := filepath.Clean(evt.Path)
+			if filepath.IsAbs(path) && f.covers(path) && !f.gate.Ignored(path) {
+				f.gate.Offer(path)
+			}
+		}
+	}
+}
+
+// watchLimitHint explains how to raise the inotify watch limit so every
+// directory under cfg.WatchDir can be watched.
+func watchLimitHint(cfg *config.DiffConfig) string {
+	dirs, err := countWatchDirs(cfg)
+	if err != nil {
+		return "raise fs.inotify.max_user_watches"
+	}
+	if limit, err := inotifyWatchLimit(); err == nil {
+		return fmt.Sprintf("%d directories to watch, max_user_watches=%d; run %s", dirs, limit, watchLimitFix(dirs))
+	}
+	return "run " + watchLimitFix(dirs)
+}